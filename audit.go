@@ -0,0 +1,107 @@
+package macaroon
+
+import (
+	"time"
+
+	"github.com/superfly/macaroon/internal/merr"
+)
+
+// AuditRecord describes how an authorization decision was reached by
+// CaveatSet.ValidateWithAudit. It is suitable for JSON-encoding into audit
+// logs. It doesn't contain any secret material (signatures, keys, or tickets).
+type AuditRecord struct {
+	// Allowed is whether all accesses were allowed.
+	Allowed bool `json:"allowed"`
+
+	// Error is the validation error, if any.
+	Error string `json:"error,omitempty"`
+
+	// Accesses has an entry for each access that was validated, in order.
+	Accesses []*AccessAudit `json:"accesses"`
+
+	// Attestations are the attestations (e.g. user identities) in the caveat
+	// set. These aren't evaluated against accesses.
+	Attestations *CaveatSet `json:"attestations,omitempty"`
+
+	// Start is when validation began.
+	Start time.Time `json:"start"`
+
+	// Duration is how long validation took.
+	Duration time.Duration `json:"duration_ns"`
+}
+
+// AccessAudit describes the validation of a single access.
+type AccessAudit struct {
+	// Error is set if the access itself was invalid, in which case no caveats
+	// were evaluated.
+	Error string `json:"error,omitempty"`
+
+	// Caveats has an entry for each caveat that was evaluated, in evaluation
+	// order.
+	Caveats []*CaveatAudit `json:"caveats"`
+}
+
+// CaveatAudit describes the outcome of evaluating a single caveat.
+type CaveatAudit struct {
+	Name    string     `json:"name"`
+	Type    CaveatType `json:"type"`
+	Allowed bool       `json:"allowed"`
+	Error   string     `json:"error,omitempty"`
+}
+
+// ValidateWithAudit is like Validate, but also returns an AuditRecord
+// describing the outcome of each caveat. The returned error is the same as
+// would be returned by Validate.
+func (c *CaveatSet) ValidateWithAudit(accesses ...Access) (*AuditRecord, error) {
+	var (
+		rec = &AuditRecord{
+			Start:    time.Now(),
+			Accesses: make([]*AccessAudit, 0, len(accesses)),
+		}
+		err error
+	)
+
+	for _, access := range accesses {
+		aa := &AccessAudit{Caveats: []*CaveatAudit{}}
+		rec.Accesses = append(rec.Accesses, aa)
+
+		if ferr := access.Validate(); ferr != nil {
+			aa.Error = ferr.Error()
+			err = merr.Append(err, ferr)
+			continue
+		}
+
+		access := carryValidation(access, c, validateExhaustive)
+		for _, caveat := range c.Caveats {
+			if IsAttestation(caveat) {
+				continue
+			}
+
+			ca := &CaveatAudit{
+				Name:    caveat.Name(),
+				Type:    caveat.CaveatType(),
+				Allowed: true,
+			}
+
+			if cerr := caveat.Prohibits(access); cerr != nil {
+				ca.Allowed = false
+				ca.Error = cerr.Error()
+				err = merr.Append(err, cerr)
+			}
+
+			aa.Caveats = append(aa.Caveats, ca)
+		}
+	}
+
+	if atts := AttestationsOnly(c); len(atts.Caveats) > 0 {
+		rec.Attestations = atts
+	}
+
+	rec.Duration = time.Since(rec.Start)
+	rec.Allowed = err == nil
+	if err != nil {
+		rec.Error = err.Error()
+	}
+
+	return rec, err
+}
@@ -0,0 +1,118 @@
+package macaroon
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/alecthomas/assert/v2"
+)
+
+func TestValidateWithAudit(t *testing.T) {
+	cs := NewCaveatSet(
+		cavParent(ActionAll, 123),
+		ptr(TestAttestation(234)),
+		cavChild(ActionRead, 456),
+	)
+
+	golden := func(tb testing.TB, rec *AuditRecord, expected string) {
+		tb.Helper()
+
+		// zero out timing, which isn't deterministic
+		assert.False(tb, rec.Start.IsZero())
+		rec.Start, rec.Duration = time.Time{}, 0
+
+		actual, err := json.MarshalIndent(rec, "", "  ")
+		assert.NoError(tb, err)
+		assert.Equal(tb, expected, string(actual))
+	}
+
+	t.Run("pass", func(t *testing.T) {
+		access := &testAccess{
+			action:         ActionRead,
+			parentResource: ptr(uint64(123)),
+			childResource:  ptr(uint64(456)),
+		}
+
+		rec, err := cs.ValidateWithAudit(access)
+		assert.NoError(t, err)
+		golden(t, rec, `{
+  "allowed": true,
+  "accesses": [
+    {
+      "caveats": [
+        {
+          "name": "ParentResource",
+          "type": 281474976710656,
+          "allowed": true
+        },
+        {
+          "name": "ChildResource",
+          "type": 281474976710657,
+          "allowed": true
+        }
+      ]
+    }
+  ],
+  "attestations": [
+    {
+      "type": "FlyioUserID",
+      "body": 234
+    }
+  ],
+  "start": "0001-01-01T00:00:00Z",
+  "duration_ns": 0
+}`)
+	})
+
+	t.Run("fail", func(t *testing.T) {
+		accesses := []Access{
+			&testAccess{
+				action:         ActionRead,
+				parentResource: ptr(uint64(999)),
+				childResource:  ptr(uint64(456)),
+			},
+			&testAccess{
+				action:        ActionRead,
+				childResource: ptr(uint64(456)),
+			},
+		}
+
+		rec, err := cs.ValidateWithAudit(accesses...)
+		assert.Error(t, err)
+		assert.Equal(t, cs.Validate(accesses...).Error(), err.Error())
+		golden(t, rec, `{
+  "allowed": false,
+  "error": "unauthorized for resource; bad data for token verification",
+  "accesses": [
+    {
+      "caveats": [
+        {
+          "name": "ParentResource",
+          "type": 281474976710656,
+          "allowed": false,
+          "error": "unauthorized for resource"
+        },
+        {
+          "name": "ChildResource",
+          "type": 281474976710657,
+          "allowed": true
+        }
+      ]
+    },
+    {
+      "error": "bad data for token verification",
+      "caveats": []
+    }
+  ],
+  "attestations": [
+    {
+      "type": "FlyioUserID",
+      "body": 234
+    }
+  ],
+  "start": "0001-01-01T00:00:00Z",
+  "duration_ns": 0
+}`)
+	})
+}
@@ -10,6 +10,7 @@ import (
 	"golang.org/x/exp/slices"
 
 	"github.com/superfly/macaroon"
+	"github.com/superfly/macaroon/internal/merr"
 	"github.com/vmihailenco/msgpack/v5"
 )
 
@@ -19,6 +20,8 @@ const (
 	CavConfineGoogleHD      = macaroon.CavAuthConfineGoogleHD
 	CavConfineGitHubOrg     = macaroon.CavAuthConfineGitHubOrg
 	CavMaxValidity          = macaroon.CavAuthMaxValidity
+	CavConfineMachine       = macaroon.CavAuthConfineMachine
+	CavConfineAnyOf         = macaroon.CavAuthConfineAnyOf
 	AttestationFlyioUserID  = macaroon.AttestationAuthFlyioUserID
 	AttestationGitHubUserID = macaroon.AttestationAuthGitHubUserID
 	AttestationGoogleUserID = macaroon.AttestationAuthGoogleUserID
@@ -35,7 +38,9 @@ func RequireOrganization(id uint64) *ConfineOrganization {
 }
 
 // Implements macaroon.Caveat
-func init()                                                    { macaroon.RegisterCaveatType(&ConfineOrganization{}) }
+func init() {
+	macaroon.RegisterCaveatConstructor(func() macaroon.Caveat { return &ConfineOrganization{} })
+}
 func (c *ConfineOrganization) CaveatType() macaroon.CaveatType { return CavConfineOrganization }
 func (c *ConfineOrganization) Name() string                    { return "ConfineOrganization" }
 
@@ -58,6 +63,16 @@ func (c *ConfineOrganization) Error() string {
 	return fmt.Sprintf("must authenticate with Fly.io account with access to organization %d", c.ID)
 }
 
+// implements errors.Is. These errors are denials.
+func (c *ConfineOrganization) Is(target error) bool {
+	return target == macaroon.ErrUnauthorized
+}
+
+// Implements macaroon.DescribableCaveat
+func (c *ConfineOrganization) Describe() string {
+	return fmt.Sprintf("Requires a Fly.io account with access to organization %d", c.ID)
+}
+
 // ConfineUser is a caveat limiting this token to a specific user ID.
 type ConfineUser struct {
 	ID uint64 `json:"id"`
@@ -68,7 +83,7 @@ func RequireUser(id uint64) *ConfineUser {
 }
 
 // Implements macaroon.Caveat
-func init()                                            { macaroon.RegisterCaveatType(&ConfineUser{}) }
+func init()                                            { macaroon.RegisterCaveatConstructor(func() macaroon.Caveat { return &ConfineUser{} }) }
 func (c *ConfineUser) CaveatType() macaroon.CaveatType { return CavConfineUser }
 func (c *ConfineUser) Name() string                    { return "ConfineUser" }
 
@@ -91,6 +106,65 @@ func (c *ConfineUser) Error() string {
 	return fmt.Sprintf("must authenticate with Fly.io account %d", c.ID)
 }
 
+// implements errors.Is. These errors are denials.
+func (c *ConfineUser) Is(target error) bool {
+	return target == macaroon.ErrUnauthorized
+}
+
+// Implements macaroon.DescribableCaveat
+func (c *ConfineUser) Describe() string {
+	return fmt.Sprintf("Requires Fly.io account %d", c.ID)
+}
+
+// ConfineMachine is a requirement placed on 3P caveats, requiring that the
+// discharge request come from the specified Fly.io machine. It has no meaning
+// in a 1P setting.
+type ConfineMachine struct {
+	ID string `json:"id"`
+}
+
+// RequireMachine returns a ConfineMachine caveat requiring that discharge
+// requests come from the Fly.io machine with the given ID.
+func RequireMachine(id string) *ConfineMachine {
+	return &ConfineMachine{id}
+}
+
+// Implements macaroon.Caveat
+func init() {
+	macaroon.RegisterCaveatConstructor(func() macaroon.Caveat { return &ConfineMachine{} })
+}
+func (c *ConfineMachine) CaveatType() macaroon.CaveatType { return CavConfineMachine }
+func (c *ConfineMachine) Name() string                    { return "ConfineMachine" }
+
+// Implements macaroon.Caveat
+func (c *ConfineMachine) Prohibits(a macaroon.Access) error {
+	switch dr, isDR := a.(*DischargeRequest); {
+	case !isDR:
+		return macaroon.ErrInvalidAccess
+	case len(dr.Machine) == 0:
+		return c
+	case !slices.Contains(dr.MachineIDs(), c.ID):
+		return fmt.Errorf("%w (got %v)", c, dr.MachineIDs())
+	default:
+		return nil
+	}
+}
+
+// implements error
+func (c *ConfineMachine) Error() string {
+	return fmt.Sprintf("must authenticate from Fly.io machine %s", c.ID)
+}
+
+// implements errors.Is. These errors are denials.
+func (c *ConfineMachine) Is(target error) bool {
+	return target == macaroon.ErrUnauthorized
+}
+
+// Implements macaroon.DescribableCaveat
+func (c *ConfineMachine) Describe() string {
+	return fmt.Sprintf("Requires Fly.io machine %s", c.ID)
+}
+
 // Implements macaroon.Caveat and error. Requires that the user is
 // authenticated to Google with an account in the specified HD.
 type ConfineGoogleHD string
@@ -100,7 +174,9 @@ func RequireGoogleHD(hd string) *ConfineGoogleHD {
 }
 
 // Implements macaroon.Caveat
-func init()                                                { macaroon.RegisterCaveatType(new(ConfineGoogleHD)) }
+func init() {
+	macaroon.RegisterCaveatConstructor(func() macaroon.Caveat { return new(ConfineGoogleHD) })
+}
 func (c *ConfineGoogleHD) CaveatType() macaroon.CaveatType { return CavConfineGoogleHD }
 func (c *ConfineGoogleHD) Name() string                    { return "ConfineGoogleHD" }
 
@@ -123,6 +199,16 @@ func (c *ConfineGoogleHD) Error() string {
 	return fmt.Sprintf("must authenticate with %s Google account", string(*c))
 }
 
+// implements errors.Is. These errors are denials.
+func (c *ConfineGoogleHD) Is(target error) bool {
+	return target == macaroon.ErrUnauthorized
+}
+
+// Implements macaroon.DescribableCaveat
+func (c *ConfineGoogleHD) Describe() string {
+	return fmt.Sprintf("Requires a Google account in the %s domain", string(*c))
+}
+
 // Implements macaroon.Caveat and error. Requires that the user is
 // authenticated to GitHub with an account that has access the specified org.
 type ConfineGitHubOrg uint64
@@ -132,7 +218,9 @@ func RequireGitHubOrg(id uint64) *ConfineGitHubOrg {
 }
 
 // Implements macaroon.Caveat
-func init()                                                 { macaroon.RegisterCaveatType(new(ConfineGitHubOrg)) }
+func init() {
+	macaroon.RegisterCaveatConstructor(func() macaroon.Caveat { return new(ConfineGitHubOrg) })
+}
 func (c *ConfineGitHubOrg) CaveatType() macaroon.CaveatType { return CavConfineGitHubOrg }
 func (c *ConfineGitHubOrg) Name() string                    { return "ConfineGitHubOrg" }
 
@@ -155,12 +243,85 @@ func (c *ConfineGitHubOrg) Error() string {
 	return fmt.Sprintf("must authenticate with GitHub account with access to organization %d", uint64(*c))
 }
 
+// implements errors.Is. These errors are denials.
+func (c *ConfineGitHubOrg) Is(target error) bool {
+	return target == macaroon.ErrUnauthorized
+}
+
+// Implements macaroon.DescribableCaveat
+func (c *ConfineGitHubOrg) Describe() string {
+	return fmt.Sprintf("Requires a GitHub account with access to organization %d", uint64(*c))
+}
+
+// ConfineAnyOf is a requirement placed on 3P caveats, requiring that the
+// discharge request satisfy at least one of the wrapped caveats (e.g. a
+// ConfineGoogleHD or a ConfineGitHubOrg), rather than all of them. It has no
+// meaning in a 1P setting.
+//
+// ConfineAnyOf is a macaroon.WrapperCaveat, so macaroon.GetCaveats finds the
+// alternatives it wraps. Third parties must not treat those as individually
+// required. Check tickets with PolicyFromCaveats or by validating them against
+// a DischargeRequest instead. ConfineAnyOf never returns
+// resset.ErrResourceUnspecified, so resset.IfPresent always applies it.
+type ConfineAnyOf struct {
+	Caveats *macaroon.CaveatSet `json:"caveats"`
+}
+
+// RequireAnyOf returns a ConfineAnyOf caveat wrapping the alternatives.
+func RequireAnyOf(alternatives ...macaroon.Caveat) *ConfineAnyOf {
+	return &ConfineAnyOf{macaroon.NewCaveatSet(alternatives...)}
+}
+
+var _ macaroon.WrapperCaveat = (*ConfineAnyOf)(nil)
+
+// Implements macaroon.Caveat
+func init()                                             { macaroon.RegisterCaveatConstructor(func() macaroon.Caveat { return &ConfineAnyOf{} }) }
+func (c *ConfineAnyOf) CaveatType() macaroon.CaveatType { return CavConfineAnyOf }
+func (c *ConfineAnyOf) Name() string                    { return "ConfineAnyOf" }
+
+// Implements macaroon.Caveat
+func (c *ConfineAnyOf) Prohibits(a macaroon.Access) error {
+	if _, isDR := a.(*DischargeRequest); !isDR {
+		return macaroon.ErrInvalidAccess
+	}
+
+	var alternatives []macaroon.Caveat
+	if c.Caveats != nil {
+		alternatives = c.Caveats.Caveats
+	}
+
+	if len(alternatives) == 0 {
+		return fmt.Errorf("%w: no alternatives to satisfy", macaroon.ErrUnauthorized)
+	}
+
+	var err error
+	for _, alt := range alternatives {
+		altErr := alt.Prohibits(a)
+		if altErr == nil {
+			return nil
+		}
+		err = merr.Append(err, altErr)
+	}
+
+	return fmt.Errorf("%w: must satisfy one of: %w", macaroon.ErrUnauthorized, err)
+}
+
+// Implements macaroon.WrapperCaveat
+func (c *ConfineAnyOf) Unwrap() *macaroon.CaveatSet {
+	return c.Caveats
+}
+
+// Implements macaroon.DescribableCaveat
+func (c *ConfineAnyOf) Describe() string {
+	return "Requires any one of the following"
+}
+
 // Implements macaroon.Caveat. Limits the validity window length (seconds) of
 // discharges issued by 3ps.
 type MaxValidity uint64
 
 // Implements macaroon.Caveat
-func init()                                            { macaroon.RegisterCaveatType(new(MaxValidity)) }
+func init()                                            { macaroon.RegisterCaveatConstructor(func() macaroon.Caveat { return new(MaxValidity) }) }
 func (c *MaxValidity) CaveatType() macaroon.CaveatType { return CavMaxValidity }
 func (c *MaxValidity) Name() string                    { return "MaxValidity" }
 
@@ -181,6 +342,11 @@ func (c *MaxValidity) Prohibits(a macaroon.Access) error {
 	}
 }
 
+// Implements macaroon.DescribableCaveat
+func (c *MaxValidity) Describe() string {
+	return fmt.Sprintf("Limits discharge validity to %s", c.duration())
+}
+
 func (c *MaxValidity) duration() time.Duration {
 	return time.Duration(*c) * time.Second
 }
@@ -199,28 +365,65 @@ func GetMaxValidity(cs *macaroon.CaveatSet) (time.Duration, bool) {
 
 type FlyioUserID uint64
 
-func init()                                              { macaroon.RegisterCaveatType(new(FlyioUserID)) }
+func init()                                              { macaroon.RegisterCaveatConstructor(func() macaroon.Caveat { return new(FlyioUserID) }) }
 func (c *FlyioUserID) CaveatType() macaroon.CaveatType   { return AttestationFlyioUserID }
 func (c *FlyioUserID) Name() string                      { return "FlyioUserID" }
 func (c *FlyioUserID) Prohibits(a macaroon.Access) error { return macaroon.ErrBadCaveat }
 func (c *FlyioUserID) IsAttestation() bool               { return true }
 
+func (c *FlyioUserID) Describe() string {
+	return fmt.Sprintf("Attests Fly.io user %d", uint64(*c))
+}
+
+// RequireFlyioUser returns the ID from the single FlyioUserID attestation in
+// the caveat set. See macaroon.RequireAttestation.
+func RequireFlyioUser(cs *macaroon.CaveatSet) (uint64, error) {
+	id, err := macaroon.RequireAttestation[*FlyioUserID](cs)
+	if err != nil {
+		return 0, err
+	}
+	return uint64(*id), nil
+}
+
 type GitHubUserID uint64
 
-func init()                                               { macaroon.RegisterCaveatType(new(GitHubUserID)) }
+func init()                                               { macaroon.RegisterCaveatConstructor(func() macaroon.Caveat { return new(GitHubUserID) }) }
 func (c *GitHubUserID) CaveatType() macaroon.CaveatType   { return AttestationGitHubUserID }
 func (c *GitHubUserID) Name() string                      { return "GitHubUserID" }
 func (c *GitHubUserID) Prohibits(a macaroon.Access) error { return macaroon.ErrBadCaveat }
 func (c *GitHubUserID) IsAttestation() bool               { return true }
 
+func (c *GitHubUserID) Describe() string {
+	return fmt.Sprintf("Attests GitHub user %d", uint64(*c))
+}
+
+// RequireGitHubUser returns the ID from the single GitHubUserID attestation in
+// the caveat set. See macaroon.RequireAttestation.
+func RequireGitHubUser(cs *macaroon.CaveatSet) (uint64, error) {
+	id, err := macaroon.RequireAttestation[*GitHubUserID](cs)
+	if err != nil {
+		return 0, err
+	}
+	return uint64(*id), nil
+}
+
 type GoogleUserID big.Int
 
-func init()                                               { macaroon.RegisterCaveatType(new(GoogleUserID)) }
+func init()                                               { macaroon.RegisterCaveatConstructor(func() macaroon.Caveat { return new(GoogleUserID) }) }
 func (c *GoogleUserID) CaveatType() macaroon.CaveatType   { return AttestationGoogleUserID }
 func (c *GoogleUserID) Name() string                      { return "GoogleUserID" }
 func (c *GoogleUserID) Prohibits(a macaroon.Access) error { return macaroon.ErrBadCaveat }
 func (c *GoogleUserID) IsAttestation() bool               { return true }
 
+func (c *GoogleUserID) Describe() string {
+	return fmt.Sprintf("Attests Google user %s", (*big.Int)(c))
+}
+
+func (c *GoogleUserID) Equal(other macaroon.Caveat) bool {
+	o, ok := other.(*GoogleUserID)
+	return ok && (*big.Int)(c).Cmp((*big.Int)(o)) == 0
+}
+
 func (c *GoogleUserID) EncodeMsgpack(enc *msgpack.Encoder) error {
 	return enc.Encode((*big.Int)(c).Bytes())
 }
@@ -15,6 +15,8 @@ func TestCaveatSerialization(t *testing.T) {
 		RequireOrganization(123),
 		RequireGoogleHD("123"),
 		RequireGitHubOrg(123),
+		RequireMachine("123"),
+		RequireAnyOf(RequireGoogleHD("123"), RequireGitHubOrg(123)),
 		ptr(FlyioUserID(123)),
 		ptr(GitHubUserID(123)),
 		(*GoogleUserID)(new(big.Int).SetBytes([]byte{
@@ -39,6 +41,125 @@ func TestCaveatSerialization(t *testing.T) {
 	assert.Equal(t, cs, cs2)
 }
 
+func TestGoogleUserIDEqual(t *testing.T) {
+	a := (*GoogleUserID)(new(big.Int).SetBytes([]byte{0x00, 0x01, 0x00}))
+	b := (*GoogleUserID)(big.NewInt(256))
+
+	assert.True(t, macaroon.EqualCaveat(a, b))
+	assert.False(t, macaroon.EqualCaveat(a, (*GoogleUserID)(big.NewInt(257))))
+	assert.False(t, macaroon.EqualCaveat(a, ptr(GitHubUserID(256))))
+}
+
+func TestRequireFlyioUser(t *testing.T) {
+	_, err := RequireFlyioUser(macaroon.NewCaveatSet(ptr(GitHubUserID(123))))
+	assert.IsError(t, err, macaroon.ErrMissingAttestation)
+	assert.Contains(t, err.Error(), "FlyioUserID")
+
+	id, err := RequireFlyioUser(macaroon.NewCaveatSet(ptr(GitHubUserID(123)), ptr(FlyioUserID(456))))
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(456), id)
+
+	id, err = RequireGitHubUser(macaroon.NewCaveatSet(ptr(GitHubUserID(123)), ptr(FlyioUserID(456))))
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(123), id)
+
+	_, err = RequireFlyioUser(macaroon.NewCaveatSet(ptr(FlyioUserID(456)), ptr(FlyioUserID(456))))
+	assert.IsError(t, err, macaroon.ErrDuplicateAttestation)
+}
+
+func TestDescribe(t *testing.T) {
+	assert.Equal(t, []string{
+		"Requires a Fly.io account with access to organization 123",
+		"Requires Fly.io account 234",
+		"Requires a Google account in the fly.io domain",
+		"Requires a GitHub account with access to organization 345",
+		"Requires Fly.io machine m1",
+		"Requires any one of the following",
+		"  Requires a Google account in the fly.io domain",
+		"  Requires a GitHub account with access to organization 345",
+		"Limits discharge validity to 1h0m0s",
+		"Attests Fly.io user 456",
+		"Attests GitHub user 567",
+		"Attests Google user 678",
+	}, macaroon.DescribeCaveatSet(macaroon.NewCaveatSet(
+		RequireOrganization(123),
+		RequireUser(234),
+		RequireGoogleHD("fly.io"),
+		RequireGitHubOrg(345),
+		RequireMachine("m1"),
+		RequireAnyOf(RequireGoogleHD("fly.io"), RequireGitHubOrg(345)),
+		ptr(MaxValidity(3600)),
+		ptr(FlyioUserID(456)),
+		ptr(GitHubUserID(567)),
+		(*GoogleUserID)(big.NewInt(678)),
+	)))
+}
+
+func TestConfineAnyOf(t *testing.T) {
+	var (
+		google = &DischargeRequest{Google: []*GoogleAuth{{HD: "fly.io"}}}
+		github = &DischargeRequest{GitHub: []*GitHubAuth{{OrgIDs: []uint64{345}}}}
+		flyio  = &DischargeRequest{Flyio: []*FlyioAuth{{UserID: 234, OrganizationIDs: []uint64{123}}}}
+		nobody = &DischargeRequest{}
+	)
+
+	anyOf := RequireAnyOf(RequireGoogleHD("fly.io"), RequireGitHubOrg(345))
+	assert.NoError(t, anyOf.Prohibits(google))
+	assert.NoError(t, anyOf.Prohibits(github))
+
+	err := anyOf.Prohibits(nobody)
+	assert.IsError(t, err, macaroon.ErrUnauthorized)
+	assert.Contains(t, err.Error(), "must authenticate with fly.io Google account")
+	assert.Contains(t, err.Error(), "organization 345")
+
+	err = anyOf.Prohibits(&DischargeRequest{Google: []*GoogleAuth{{HD: "example.com"}}})
+	assert.IsError(t, err, macaroon.ErrUnauthorized)
+	assert.Contains(t, err.Error(), "got [example.com]")
+
+	assert.IsError(t, RequireAnyOf().Prohibits(google), macaroon.ErrUnauthorized)
+	assert.IsError(t, (&ConfineAnyOf{}).Prohibits(google), macaroon.ErrUnauthorized)
+
+	// nested: Google, or a Fly.io user in organization 123
+	nested := RequireAnyOf(
+		RequireGoogleHD("fly.io"),
+		RequireAnyOf(RequireGitHubOrg(345), RequireOrganization(123)),
+	)
+	assert.NoError(t, nested.Prohibits(google))
+	assert.NoError(t, nested.Prohibits(github))
+	assert.NoError(t, nested.Prohibits(flyio))
+	assert.IsError(t, nested.Prohibits(nobody), macaroon.ErrUnauthorized)
+
+	// alongside other confinements, which must all be satisfied
+	cs := macaroon.NewCaveatSet(RequireUser(234), nested)
+	assert.NoError(t, cs.Validate(flyio))
+	assert.Error(t, cs.Validate(google))
+
+	// alternatives are found by GetCaveats
+	assert.Equal(t, 1, len(macaroon.GetCaveats[*ConfineGoogleHD](cs)))
+	assert.Equal(t, 1, len(macaroon.GetCaveats[*ConfineOrganization](cs)))
+
+	// round trip through a ticket
+	var (
+		tpLoc = "https://tp.example"
+		tpKey = macaroon.NewEncryptionKey()
+	)
+
+	m, err := macaroon.New([]byte("kid"), "https://fp.example", macaroon.NewSigningKey())
+	assert.NoError(t, err)
+	assert.NoError(t, m.Add3P(tpKey, tpLoc, nested))
+
+	ticket, err := m.ThirdPartyTicket(tpLoc)
+	assert.NoError(t, err)
+
+	tcavs, _, err := macaroon.DischargeTicket(tpKey, tpLoc, ticket)
+	assert.NoError(t, err)
+	assert.Equal(t, []macaroon.Caveat{nested}, tcavs)
+
+	tcs := macaroon.NewCaveatSet(tcavs...)
+	assert.NoError(t, tcs.Validate(github))
+	assert.IsError(t, tcs.Validate(nobody), macaroon.ErrUnauthorized)
+}
+
 func ptr[T any](t T) *T {
 	return &t
 }
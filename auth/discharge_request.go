@@ -12,6 +12,10 @@ type DischargeRequest struct {
 	Google []*GoogleAuth
 	GitHub []*GitHubAuth
 	Expiry time.Time
+
+	// Machine is set when the request was authenticated as coming from a
+	// Fly.io machine (e.g. by its source address on Fly's private network).
+	Machine []*MachineAuth
 }
 
 func (a *DischargeRequest) Now() time.Time  { return time.Now() }
@@ -57,6 +61,15 @@ func (a *DischargeRequest) GitHubOrgIDs() []uint64 {
 	return maps.Keys(m)
 }
 
+func (a *DischargeRequest) MachineIDs() []string {
+	m := map[string]struct{}{}
+	for _, ma := range a.Machine {
+		m[ma.MachineID] = struct{}{}
+	}
+
+	return maps.Keys(m)
+}
+
 type FlyioAuth struct {
 	UserID          uint64
 	OrganizationIDs []uint64
@@ -73,3 +86,9 @@ type GitHubAuth struct {
 	UserID uint64
 	Login  string
 }
+
+type MachineAuth struct {
+	MachineID string
+	AppID     uint64
+	OrgID     uint64
+}
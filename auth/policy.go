@@ -0,0 +1,218 @@
+package auth
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/superfly/macaroon"
+	"github.com/superfly/macaroon/internal/merr"
+)
+
+// ErrUnsupportedTicketCaveat is returned by PolicyFromCaveats when a ticket
+// contains a caveat that isn't part of the auth protocol.
+var ErrUnsupportedTicketCaveat = fmt.Errorf("%w: unsupported ticket caveat", macaroon.ErrBadCaveat)
+
+// ErrExceedsMaxValidity is returned by DischargeWithMaxValidity when the
+// discharge already has a ValidityWindow that outlasts the ticket's
+// MaxValidity.
+var ErrExceedsMaxValidity = fmt.Errorf("%w: validity window exceeds max validity", macaroon.ErrUnauthorized)
+
+// TicketPolicy aggregates the auth caveats found in a third party ticket. Third
+// parties implementing the auth protocol can use it instead of handling each
+// caveat type themselves. Each field is a separate requirement and all
+// requirements must be met. Where a ticket has multiple caveats of the same
+// type, each of them must be satisfied (e.g. two ConfineOrganization caveats
+// require access to both organizations).
+type TicketPolicy struct {
+	// Users are the Fly.io user IDs from ConfineUser caveats.
+	Users []uint64
+
+	// Organizations are the Fly.io organization IDs from ConfineOrganization
+	// caveats.
+	Organizations []uint64
+
+	// GoogleHDs are the Google hosted domains from ConfineGoogleHD caveats.
+	GoogleHDs []string
+
+	// GitHubOrgs are the GitHub organization IDs from ConfineGitHubOrg
+	// caveats.
+	GitHubOrgs []uint64
+
+	// Machines are the Fly.io machine IDs from ConfineMachine caveats.
+	Machines []string
+
+	// MaxValidity is the shortest validity window from MaxValidity caveats, or
+	// nil if there were none.
+	MaxValidity *time.Duration
+
+	// AnyOf has an entry for each ConfineAnyOf caveat, with a policy for each
+	// of its alternatives. At least one policy in each entry must be
+	// satisfied. CapExpiry ignores MaxValidity caveats within alternatives.
+	AnyOf [][]*TicketPolicy
+}
+
+// PolicyFromCaveats builds a TicketPolicy from the caveats in a third party
+// ticket (e.g. as returned by tp.CaveatsFromRequest or passed to a
+// bundle.Discharger). ErrUnsupportedTicketCaveat is returned if any of the
+// caveats aren't auth caveats, so that third parties fail closed on
+// requirements they don't understand.
+func PolicyFromCaveats(cavs []macaroon.Caveat) (*TicketPolicy, error) {
+	p := new(TicketPolicy)
+
+	for _, cav := range cavs {
+		switch c := cav.(type) {
+		case *ConfineUser:
+			p.Users = append(p.Users, c.ID)
+		case *ConfineOrganization:
+			p.Organizations = append(p.Organizations, c.ID)
+		case *ConfineGoogleHD:
+			p.GoogleHDs = append(p.GoogleHDs, string(*c))
+		case *ConfineGitHubOrg:
+			p.GitHubOrgs = append(p.GitHubOrgs, uint64(*c))
+		case *ConfineMachine:
+			p.Machines = append(p.Machines, c.ID)
+		case *MaxValidity:
+			if d := c.duration(); p.MaxValidity == nil || d < *p.MaxValidity {
+				p.MaxValidity = &d
+			}
+		case *ConfineAnyOf:
+			var alternatives []*TicketPolicy
+			if c.Caveats != nil {
+				for _, alt := range c.Caveats.Caveats {
+					altPolicy, err := PolicyFromCaveats([]macaroon.Caveat{alt})
+					if err != nil {
+						return nil, err
+					}
+					alternatives = append(alternatives, altPolicy)
+				}
+			}
+			p.AnyOf = append(p.AnyOf, alternatives)
+		default:
+			return nil, fmt.Errorf("%w: %s", ErrUnsupportedTicketCaveat, cav.Name())
+		}
+	}
+
+	return p, nil
+}
+
+// Check returns an error describing each requirement of the policy that the
+// DischargeRequest doesn't satisfy. The MaxValidity requirement is checked
+// against the request's Expiry. Use CapExpiry to pick an acceptable expiry
+// instead.
+func (p *TicketPolicy) Check(dr *DischargeRequest) error {
+	var err error
+
+	for _, id := range p.Users {
+		err = merr.Append(err, RequireUser(id).Prohibits(dr))
+	}
+
+	for _, id := range p.Organizations {
+		err = merr.Append(err, RequireOrganization(id).Prohibits(dr))
+	}
+
+	for _, hd := range p.GoogleHDs {
+		err = merr.Append(err, RequireGoogleHD(hd).Prohibits(dr))
+	}
+
+	for _, id := range p.GitHubOrgs {
+		err = merr.Append(err, RequireGitHubOrg(id).Prohibits(dr))
+	}
+
+	for _, id := range p.Machines {
+		err = merr.Append(err, RequireMachine(id).Prohibits(dr))
+	}
+
+	if p.MaxValidity != nil {
+		mv := MaxValidity(*p.MaxValidity / time.Second)
+		err = merr.Append(err, mv.Prohibits(dr))
+	}
+
+	for _, alternatives := range p.AnyOf {
+		err = merr.Append(err, checkAnyOf(alternatives, dr))
+	}
+
+	return err
+}
+
+func checkAnyOf(alternatives []*TicketPolicy, dr *DischargeRequest) error {
+	if len(alternatives) == 0 {
+		return fmt.Errorf("%w: no alternatives to satisfy", macaroon.ErrUnauthorized)
+	}
+
+	var err error
+	for _, alt := range alternatives {
+		altErr := alt.Check(dr)
+		if altErr == nil {
+			return nil
+		}
+		err = merr.Append(err, altErr)
+	}
+
+	return fmt.Errorf("%w: must satisfy one of: %w", macaroon.ErrUnauthorized, err)
+}
+
+// CapExpiry returns the requested expiry, moved earlier if necessary to
+// satisfy the policy's MaxValidity.
+func (p *TicketPolicy) CapExpiry(requested time.Time) time.Time {
+	if p.MaxValidity == nil {
+		return requested
+	}
+
+	if max := time.Now().Add(*p.MaxValidity); requested.After(max) {
+		return max
+	}
+
+	return requested
+}
+
+// DischargeWithMaxValidity adds a ValidityWindow to the discharge macaroon dm
+// enforcing the shortest MaxValidity caveat in the ticket, so that the bound
+// is visible to whoever verifies the discharge and not just to the third party
+// issuing it. Nothing is added if the ticket has no MaxValidity caveats or if
+// dm already has a ValidityWindow within the bound. ErrExceedsMaxValidity is
+// returned if dm's existing ValidityWindow outlasts the bound.
+func DischargeWithMaxValidity(ticketCavs []macaroon.Caveat, dm *macaroon.Macaroon, now time.Time) error {
+	max, ok := GetMaxValidity(macaroon.NewCaveatSet(ticketCavs...))
+	if !ok {
+		return nil
+	}
+
+	bound := now.Add(max)
+
+	if expiry, ok := EffectiveExpiry(&dm.UnsafeCaveats); ok {
+		if expiry.After(bound) {
+			return fmt.Errorf("%w: %s is after %s", ErrExceedsMaxValidity, expiry.UTC().Format(time.RFC3339), bound.UTC().Format(time.RFC3339))
+		}
+
+		return nil
+	}
+
+	return dm.Add(&macaroon.ValidityWindow{
+		NotBefore: now.Unix(),
+		NotAfter:  bound.Unix(),
+	})
+}
+
+// EffectiveExpiry returns the earliest NotAfter of the ValidityWindow caveats
+// in a verified caveat set. Services caching verification results shouldn't
+// keep them past this time. The second return value is false if there are no
+// ValidityWindow caveats.
+func EffectiveExpiry(verified *macaroon.CaveatSet) (time.Time, bool) {
+	var (
+		notAfter int64
+		found    bool
+	)
+
+	for _, vw := range macaroon.GetCaveats[*macaroon.ValidityWindow](verified) {
+		if !found || vw.NotAfter < notAfter {
+			notAfter = vw.NotAfter
+			found = true
+		}
+	}
+
+	if !found {
+		return time.Time{}, false
+	}
+
+	return time.Unix(notAfter, 0), true
+}
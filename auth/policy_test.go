@@ -0,0 +1,178 @@
+package auth
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alecthomas/assert/v2"
+	"github.com/superfly/macaroon"
+)
+
+func TestTicketPolicy(t *testing.T) {
+	t.Run("multiple confinements", func(t *testing.T) {
+		p, err := PolicyFromCaveats([]macaroon.Caveat{
+			RequireOrganization(1),
+			RequireOrganization(2),
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, []uint64{1, 2}, p.Organizations)
+
+		assert.NoError(t, p.Check(&DischargeRequest{
+			Flyio: []*FlyioAuth{{UserID: 9, OrganizationIDs: []uint64{1, 2, 3}}},
+		}))
+
+		err = p.Check(&DischargeRequest{
+			Flyio: []*FlyioAuth{{UserID: 9, OrganizationIDs: []uint64{1}}},
+		})
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "organization 2")
+	})
+
+	t.Run("mixed types", func(t *testing.T) {
+		p, err := PolicyFromCaveats([]macaroon.Caveat{
+			RequireUser(9),
+			RequireGoogleHD("fly.io"),
+			RequireGitHubOrg(5),
+			RequireMachine("m1"),
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, &TicketPolicy{
+			Users:      []uint64{9},
+			GoogleHDs:  []string{"fly.io"},
+			GitHubOrgs: []uint64{5},
+			Machines:   []string{"m1"},
+		}, p)
+
+		dr := &DischargeRequest{
+			Flyio:   []*FlyioAuth{{UserID: 9}},
+			Google:  []*GoogleAuth{{HD: "fly.io"}},
+			GitHub:  []*GitHubAuth{{OrgIDs: []uint64{5}}},
+			Machine: []*MachineAuth{{MachineID: "m1"}},
+		}
+		assert.NoError(t, p.Check(dr))
+
+		dr.Machine = []*MachineAuth{{MachineID: "m2"}}
+		assert.IsError(t, p.Check(dr), macaroon.ErrUnauthorized)
+
+		dr.Machine = []*MachineAuth{{MachineID: "m1"}}
+		dr.GitHub = nil
+		assert.Error(t, p.Check(dr))
+	})
+
+	t.Run("unknown caveat", func(t *testing.T) {
+		_, err := PolicyFromCaveats([]macaroon.Caveat{
+			RequireUser(9),
+			&macaroon.ValidityWindow{},
+		})
+		assert.IsError(t, err, ErrUnsupportedTicketCaveat)
+	})
+
+	t.Run("any of", func(t *testing.T) {
+		p, err := PolicyFromCaveats([]macaroon.Caveat{
+			RequireUser(9),
+			RequireAnyOf(
+				RequireGoogleHD("fly.io"),
+				RequireAnyOf(RequireGitHubOrg(5), RequireOrganization(1)),
+			),
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, &TicketPolicy{
+			Users: []uint64{9},
+			AnyOf: [][]*TicketPolicy{{
+				{GoogleHDs: []string{"fly.io"}},
+				{AnyOf: [][]*TicketPolicy{{
+					{GitHubOrgs: []uint64{5}},
+					{Organizations: []uint64{1}},
+				}}},
+			}},
+		}, p)
+
+		dr := &DischargeRequest{Flyio: []*FlyioAuth{{UserID: 9}}}
+		assert.IsError(t, p.Check(dr), macaroon.ErrUnauthorized)
+
+		dr.GitHub = []*GitHubAuth{{OrgIDs: []uint64{5}}}
+		assert.NoError(t, p.Check(dr))
+
+		dr = &DischargeRequest{Flyio: []*FlyioAuth{{UserID: 9, OrganizationIDs: []uint64{1}}}}
+		assert.NoError(t, p.Check(dr))
+
+		dr.Flyio[0].UserID = 8
+		assert.Error(t, p.Check(dr))
+
+		_, err = PolicyFromCaveats([]macaroon.Caveat{RequireAnyOf(RequireUser(9), &macaroon.ValidityWindow{})})
+		assert.IsError(t, err, ErrUnsupportedTicketCaveat)
+
+		p, err = PolicyFromCaveats([]macaroon.Caveat{RequireAnyOf()})
+		assert.NoError(t, err)
+		assert.IsError(t, p.Check(&DischargeRequest{Flyio: []*FlyioAuth{{UserID: 9}}}), macaroon.ErrUnauthorized)
+	})
+
+	t.Run("max validity", func(t *testing.T) {
+		p, err := PolicyFromCaveats([]macaroon.Caveat{
+			ptr(MaxValidity(3600)),
+			ptr(MaxValidity(60)),
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, time.Minute, *p.MaxValidity)
+
+		soon := time.Now().Add(30 * time.Second)
+		assert.Equal(t, soon, p.CapExpiry(soon))
+
+		capped := p.CapExpiry(time.Now().Add(time.Hour))
+		assert.True(t, capped.Before(time.Now().Add(time.Minute+time.Second)))
+
+		assert.NoError(t, p.Check(&DischargeRequest{Expiry: soon}))
+		assert.IsError(t, p.Check(&DischargeRequest{Expiry: time.Now().Add(time.Hour)}), macaroon.ErrUnauthorized)
+
+		p, err = PolicyFromCaveats(nil)
+		assert.NoError(t, err)
+		assert.Zero(t, p.MaxValidity)
+		assert.Equal(t, soon, p.CapExpiry(soon))
+	})
+}
+
+func TestDischargeWithMaxValidity(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	ticketCavs := []macaroon.Caveat{RequireUser(9), ptr(MaxValidity(3600))}
+
+	newDischarge := func(cavs ...macaroon.Caveat) *macaroon.Macaroon {
+		t.Helper()
+		dm, err := macaroon.New([]byte{1}, "https://auth", macaroon.NewSigningKey())
+		assert.NoError(t, err)
+		assert.NoError(t, dm.Add(cavs...))
+		return dm
+	}
+
+	t.Run("adds window", func(t *testing.T) {
+		dm := newDischarge()
+		assert.NoError(t, DischargeWithMaxValidity(ticketCavs, dm, now))
+		assert.Equal(t, []*macaroon.ValidityWindow{{NotBefore: now.Unix(), NotAfter: now.Add(time.Hour).Unix()}}, macaroon.GetCaveats[*macaroon.ValidityWindow](&dm.UnsafeCaveats))
+
+		expiry, ok := EffectiveExpiry(&dm.UnsafeCaveats)
+		assert.True(t, ok)
+		assert.Equal(t, now.Add(time.Hour), expiry)
+	})
+
+	t.Run("existing window within bound", func(t *testing.T) {
+		dm := newDischarge(&macaroon.ValidityWindow{NotBefore: now.Unix(), NotAfter: now.Add(time.Minute).Unix()})
+		assert.NoError(t, DischargeWithMaxValidity(ticketCavs, dm, now))
+		assert.Equal(t, 1, len(dm.UnsafeCaveats.Caveats))
+	})
+
+	t.Run("existing window exceeds bound", func(t *testing.T) {
+		dm := newDischarge(&macaroon.ValidityWindow{NotBefore: now.Unix(), NotAfter: now.Add(2 * time.Hour).Unix()})
+		err := DischargeWithMaxValidity(ticketCavs, dm, now)
+		assert.IsError(t, err, ErrExceedsMaxValidity)
+		assert.IsError(t, err, macaroon.ErrUnauthorized)
+		assert.Equal(t, 1, len(dm.UnsafeCaveats.Caveats))
+	})
+
+	t.Run("no max validity", func(t *testing.T) {
+		dm := newDischarge()
+		assert.NoError(t, DischargeWithMaxValidity([]macaroon.Caveat{RequireUser(9)}, dm, now))
+		assert.Equal(t, 0, len(dm.UnsafeCaveats.Caveats))
+
+		_, ok := EffectiveExpiry(&dm.UnsafeCaveats)
+		assert.False(t, ok)
+	})
+}
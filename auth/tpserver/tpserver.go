@@ -0,0 +1,89 @@
+// Package tpserver glues the auth caveats to the tp server, for third parties
+// that discharge tickets based on a user's existing session (e.g. an OIDC
+// login cookie) rather than interactively.
+package tpserver
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/superfly/macaroon"
+	"github.com/superfly/macaroon/auth"
+	"github.com/superfly/macaroon/tp"
+)
+
+// DefaultValidity is how long discharges are valid for when the identify
+// function passed to DischargeHandler doesn't set an Expiry on the
+// DischargeRequest. It is further limited by any MaxValidity caveats in the
+// ticket.
+const DefaultValidity = time.Hour
+
+// Error messages returned by DischargeHandler start with one of these reasons,
+// followed by a colon and details.
+const (
+	// ReasonUnauthenticated means that the identify function couldn't
+	// authenticate the request.
+	ReasonUnauthenticated = "unauthenticated"
+
+	// ReasonUnsupportedTicket means that the ticket has caveats that aren't
+	// part of the auth protocol. See auth.ErrUnsupportedTicketCaveat.
+	ReasonUnsupportedTicket = "unsupported ticket"
+
+	// ReasonDenied means that the authenticated user doesn't satisfy the
+	// ticket's caveats.
+	ReasonDenied = "denied"
+)
+
+// DischargeHandler returns a handler to be wrapped by
+// tp.InitRequestMiddleware. It builds a DischargeRequest for each request
+// with identify, checks it against the auth caveats in the ticket, and
+// responds with a discharge whose ValidityWindow ends at the request's Expiry,
+// capped by any MaxValidity caveats. If identify doesn't set an Expiry,
+// DefaultValidity is used. Requests are refused if the ticket has caveats that
+// aren't auth caveats.
+func DischargeHandler(t *tp.TP, identify func(*http.Request) (*auth.DischargeRequest, error)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cavs, err := tp.CaveatsFromRequest(r)
+		if err != nil {
+			t.RespondError(w, r, http.StatusInternalServerError, "internal server error")
+			return
+		}
+
+		policy, err := auth.PolicyFromCaveats(cavs)
+		if err != nil {
+			respondError(t, w, r, http.StatusBadRequest, ReasonUnsupportedTicket, err)
+			return
+		}
+
+		dr, err := identify(r)
+		switch {
+		case err != nil:
+			respondError(t, w, r, http.StatusUnauthorized, ReasonUnauthenticated, err)
+			return
+		case dr == nil:
+			respondError(t, w, r, http.StatusUnauthorized, ReasonUnauthenticated, macaroon.ErrUnauthorized)
+			return
+		}
+
+		now := time.Now()
+		if dr.Expiry.IsZero() {
+			dr.Expiry = now.Add(DefaultValidity)
+		}
+		dr.Expiry = policy.CapExpiry(dr.Expiry)
+
+		if err := policy.Check(dr); err != nil {
+			respondError(t, w, r, http.StatusForbidden, ReasonDenied, err)
+			return
+		}
+
+		t.RespondDischarge(w, r, &macaroon.ValidityWindow{
+			NotBefore: now.Unix(),
+			NotAfter:  dr.Expiry.Unix(),
+		})
+	})
+}
+
+func respondError(t *tp.TP, w http.ResponseWriter, r *http.Request, statusCode int, reason string, err error) {
+	t.RespondError(w, r, statusCode, fmt.Sprintf("%s: %v", reason, err))
+}
@@ -0,0 +1,141 @@
+package tpserver
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alecthomas/assert/v2"
+	"github.com/sirupsen/logrus"
+	"github.com/superfly/macaroon"
+	"github.com/superfly/macaroon/auth"
+	"github.com/superfly/macaroon/tp"
+)
+
+var (
+	firstPartyLocation = "https://first-party"
+	fpKey              = macaroon.NewSigningKey()
+	fpKID              = []byte{1, 2, 3}
+)
+
+func TestDischargeHandler(t *testing.T) {
+	// sessions maps bearer tokens to the DischargeRequests that a real
+	// identify function would build from a cookie or OIDC session.
+	sessions := map[string]*auth.DischargeRequest{
+		"org-1": {Flyio: []*auth.FlyioAuth{{UserID: 9, OrganizationIDs: []uint64{1}}}},
+		"org-2": {Flyio: []*auth.FlyioAuth{{UserID: 9, OrganizationIDs: []uint64{2}}}},
+	}
+
+	identify := func(r *http.Request) (*auth.DischargeRequest, error) {
+		dr, ok := sessions[strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")]
+		if !ok {
+			return nil, errors.New("no session")
+		}
+
+		cp := *dr
+		return &cp, nil
+	}
+
+	var t3p *tp.TP
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t3p.InitRequestMiddleware(DischargeHandler(t3p, identify)).ServeHTTP(w, r)
+	}))
+	t.Cleanup(s.Close)
+
+	t3p = &tp.TP{
+		Location: s.URL,
+		Key:      macaroon.NewEncryptionKey(),
+		Log:      logrus.StandardLogger(),
+	}
+
+	genFP := func(t *testing.T, cavs ...macaroon.Caveat) string {
+		t.Helper()
+
+		m, err := macaroon.New(fpKID, firstPartyLocation, fpKey)
+		assert.NoError(t, err)
+		assert.NoError(t, m.Add3P(t3p.Key, t3p.Location, cavs...))
+
+		tok, err := m.Encode()
+		assert.NoError(t, err)
+
+		return macaroon.ToAuthorizationHeader(tok)
+	}
+
+	discharge := func(t *testing.T, session string, hdr string) (*macaroon.CaveatSet, error) {
+		t.Helper()
+
+		hdr, err := tp.NewClient(firstPartyLocation,
+			tp.WithBearerAuthentication(t3p.Location, session),
+		).FetchDischargeTokens(context.Background(), hdr)
+		if err != nil {
+			return nil, err
+		}
+
+		perm, diss, err := macaroon.ParsePermissionAndDischargeTokens(hdr, firstPartyLocation)
+		assert.NoError(t, err)
+
+		m, err := macaroon.Decode(perm)
+		assert.NoError(t, err)
+
+		return m.Verify(fpKey, diss, nil)
+	}
+
+	t.Run("allow", func(t *testing.T) {
+		cs, err := discharge(t, "org-1", genFP(t, auth.RequireOrganization(1)))
+		assert.NoError(t, err)
+
+		expiry, ok := auth.EffectiveExpiry(cs)
+		assert.True(t, ok)
+		assert.True(t, time.Until(expiry) > DefaultValidity-time.Minute)
+		assert.True(t, time.Until(expiry) <= DefaultValidity)
+	})
+
+	t.Run("wrong org deny", func(t *testing.T) {
+		_, err := discharge(t, "org-2", genFP(t, auth.RequireOrganization(1)))
+
+		var tpErr *tp.Error
+		assert.True(t, errors.As(err, &tpErr))
+		assert.Equal(t, http.StatusForbidden, tpErr.StatusCode)
+		assert.True(t, strings.HasPrefix(tpErr.Msg, ReasonDenied+":"))
+		assert.Contains(t, tpErr.Msg, "organization 1")
+	})
+
+	t.Run("unauthenticated", func(t *testing.T) {
+		_, err := discharge(t, "bogus", genFP(t, auth.RequireOrganization(1)))
+
+		var tpErr *tp.Error
+		assert.True(t, errors.As(err, &tpErr))
+		assert.Equal(t, http.StatusUnauthorized, tpErr.StatusCode)
+		assert.True(t, strings.HasPrefix(tpErr.Msg, ReasonUnauthenticated+":"))
+	})
+
+	t.Run("unsupported ticket", func(t *testing.T) {
+		_, err := discharge(t, "org-1", genFP(t, &macaroon.ValidityWindow{NotAfter: time.Now().Add(time.Hour).Unix()}))
+
+		var tpErr *tp.Error
+		assert.True(t, errors.As(err, &tpErr))
+		assert.Equal(t, http.StatusBadRequest, tpErr.StatusCode)
+		assert.True(t, strings.HasPrefix(tpErr.Msg, ReasonUnsupportedTicket+":"))
+	})
+
+	t.Run("validity capping", func(t *testing.T) {
+		maxValidity := auth.MaxValidity(60)
+
+		sessions["long"] = &auth.DischargeRequest{
+			Flyio:  []*auth.FlyioAuth{{UserID: 9, OrganizationIDs: []uint64{1}}},
+			Expiry: time.Now().Add(24 * time.Hour),
+		}
+
+		cs, err := discharge(t, "long", genFP(t, auth.RequireOrganization(1), &maxValidity))
+		assert.NoError(t, err)
+
+		expiry, ok := auth.EffectiveExpiry(cs)
+		assert.True(t, ok)
+		assert.True(t, time.Until(expiry) <= time.Minute)
+	})
+}
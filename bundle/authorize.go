@@ -0,0 +1,145 @@
+package bundle
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/google/uuid"
+	"github.com/superfly/macaroon"
+)
+
+// Decision is the coarse outcome of Bundle.Authorize.
+type Decision int
+
+const (
+	// Unauthenticated indicates that no permission token in the Bundle could
+	// be verified. This maps to HTTP 401.
+	Unauthenticated Decision = iota
+
+	// Forbidden indicates that at least one permission token was verified, but
+	// none of the verified tokens allow the requested accesses. This maps to
+	// HTTP 403.
+	Forbidden
+
+	// Allowed indicates that a verified permission token allows the requested
+	// accesses. This maps to HTTP 200.
+	Allowed
+)
+
+func (d Decision) String() string {
+	switch d {
+	case Unauthenticated:
+		return "unauthenticated"
+	case Forbidden:
+		return "forbidden"
+	case Allowed:
+		return "allowed"
+	default:
+		return fmt.Sprintf("Decision(%d)", int(d))
+	}
+}
+
+// AuthorizeResult is the result of Bundle.Authorize.
+type AuthorizeResult struct {
+	// Decision is the overall authorization decision.
+	Decision Decision
+
+	// Macaroon is the verified macaroon that allowed the accesses. It is nil
+	// unless Decision is Allowed.
+	Macaroon *VerifiedMacaroon
+
+	// Caveats is the verified caveat set of Macaroon. It is nil unless
+	// Decision is Allowed.
+	Caveats *macaroon.CaveatSet
+
+	// Failures maps the UUIDs of permission tokens that failed verification or
+	// validation to the reason they failed.
+	Failures map[uuid.UUID]error
+}
+
+// Authorize verifies the permission macaroons in the Bundle, skipping those
+// that were already verified, and validates the provided accesses against the
+// verified macaroons. The returned result is never nil. The returned error is
+// non-nil unless the Decision is Allowed and combines the reasons for each
+// token's failure.
+func (b *Bundle) Authorize(ctx context.Context, v Verifier, accesses ...macaroon.Access) (*AuthorizeResult, error) {
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	b.checkInvariants()
+	b.mutated()
+
+	return b.ts.Authorize(ctx, b.IsPermissionToken, v, withVerifierLocation(b.verifierLocation, accesses)...)
+}
+
+func (ts tokens) Authorize(ctx context.Context, isPerm Predicate, v Verifier, accesses ...macaroon.Access) (*AuthorizeResult, error) {
+	res := &AuthorizeResult{
+		Decision: Unauthenticated,
+		Failures: make(map[uuid.UUID]error),
+	}
+
+	dbp := ts.dischargesByPermission(isPerm)
+	for m := range dbp {
+		if _, verified := m.(*VerifiedMacaroon); verified {
+			delete(dbp, m)
+		}
+	}
+
+	var vres map[Macaroon]VerificationResult
+	if len(dbp) != 0 {
+		vres = v.Verify(ctx, dbp)
+	}
+
+	var errs []error
+
+	for i, t := range ts {
+		if m, ok := t.(Macaroon); ok && vres[m] != nil {
+			switch tt := vres[m].(type) {
+			case *VerifiedMacaroon:
+				t = tt
+			case *FailedMacaroon:
+				t = tt
+			default:
+				return res, fmt.Errorf("unexpected verification result: %T", tt)
+			}
+
+			ts[i] = t
+		}
+
+		switch tt := t.(type) {
+		case *FailedMacaroon:
+			id := tt.UnsafeMac.Nonce.UUID()
+			res.Failures[id] = tt.Err
+			errs = append(errs, fmt.Errorf("token %s: %w", id, tt.Err))
+		case *VerifiedMacaroon:
+			if res.Decision == Allowed {
+				continue
+			}
+
+			res.Decision = Forbidden
+
+			err := tt.Caveats.Validate(accesses...)
+
+			if err != nil {
+				id := tt.UnsafeMac.Nonce.UUID()
+				res.Failures[id] = err
+				errs = append(errs, fmt.Errorf("token %s: %w", id, err))
+				continue
+			}
+
+			res.Decision = Allowed
+			res.Macaroon = tt
+			res.Caveats = tt.Caveats
+		}
+	}
+
+	switch res.Decision {
+	case Allowed:
+		return res, nil
+	case Forbidden:
+		return res, errors.Join(append([]error{errors.New("no authorized tokens")}, errs...)...)
+	default:
+		return res, errors.Join(append([]error{errors.New("no verified tokens")}, errs...)...)
+	}
+}
@@ -2,7 +2,7 @@ package bundle
 
 import (
 	"context"
-	"sync"
+	"fmt"
 
 	"github.com/superfly/macaroon"
 )
@@ -17,19 +17,75 @@ const (
 	pfxDelim             = "_"
 )
 
+// Token prefixes. The legacy fm1r and fm1a prefixes explicitly identify
+// permission and discharge tokens respectively. The fm2 prefix is used for
+// both.
+const (
+	PrefixPermission = permissionTokenLabel
+	PrefixDischarge  = dischargeTokenLabel
+	PrefixV2         = v2TokenLabel
+)
+
 // Bundle is a collection of tokens parsed from an Authorization header. It is
 // safe for concurrent use.
 type Bundle struct {
 	IsPermissionToken Predicate
-	m                 *sync.RWMutex
+	m                 *bundleState
+	gen               uint64
 	ts                tokens
+	defensive         bool
+	failFast          bool
+	verifierLocation  string
+}
+
+// ParseOption configures a Bundle returned by ParseBundle,
+// ParseBundleWithFilter, or ParseBundleWithPredicate.
+type ParseOption func(*Bundle)
+
+// WithDefensiveCopies causes the UnsafeMacaroon and UnsafeCaveats methods of
+// the Bundle's macaroons to return deep copies rather than the live objects.
+// Callers can then modify the returned values without corrupting the Bundle.
+// This is intended for passing Bundles to code that can't be trusted to
+// follow the rules around the unsafe accessors and comes at the cost of an
+// allocation on every call.
+func WithDefensiveCopies() ParseOption {
+	return func(b *Bundle) {
+		b.defensive = true
+	}
 }
 
+// WithFailFastValidation causes Validate to stop evaluating a token's caveats
+// against an access after the first one that prohibits it. See
+// macaroon.CaveatSet.ValidateFailFast. This saves work when access is denied,
+// but errors only describe the first failure for each token and access.
+func WithFailFastValidation() ParseOption {
+	return func(b *Bundle) {
+		b.failFast = true
+	}
+}
+
+// WithVerifierLocation sets the location of the service verifying the Bundle's
+// tokens (e.g. "https://api.machines.dev"), which macaroon.ScopedToLocation
+// caveats are evaluated against. Validate, ValidateWithAudit, and Authorize
+// validate copies of accesses that implement macaroon.LocationAwareAccess but
+// don't specify a location, with this location filled in. The caller's
+// accesses aren't modified. Without this option, accesses are validated as
+// provided.
+func WithVerifierLocation(loc string) ParseOption {
+	return func(b *Bundle) {
+		b.verifierLocation = loc
+	}
+}
+
+// DefaultSource is the source that tokens parsed by ParseBundle and its
+// variants or added with AddTokens are tagged with. See SourceOf.
+const DefaultSource = "header"
+
 // ParseBundle is the same as ParseBundleWithFilter, but uses the DefaultFilter.
-func ParseBundle(permissionLocation, hdr string) (*Bundle, error) {
+func ParseBundle(permissionLocation, hdr string, opts ...ParseOption) (*Bundle, error) {
 	f := DefaultFilter(LocationFilter(permissionLocation).Predicate())
 
-	return ParseBundleWithFilter(permissionLocation, hdr, f)
+	return ParseBundleWithFilter(permissionLocation, hdr, f, opts...)
 }
 
 // ParseBundleWithFilter parses a FlyV1 Authorization header into a Bundle. The
@@ -37,17 +93,28 @@ func ParseBundle(permissionLocation, hdr string) (*Bundle, error) {
 // filter is applied to the parsed tokens. The returned error is constructed
 // before the tokens are filtered and will contain information about invalid
 // tokens that may be filtered.
-func ParseBundleWithFilter(permissionLocation, hdr string, filter Filter) (*Bundle, error) {
+func ParseBundleWithFilter(permissionLocation, hdr string, filter Filter, opts ...ParseOption) (*Bundle, error) {
+	return ParseBundleWithPredicate(LocationFilter(permissionLocation).Predicate(), hdr, filter, opts...)
+}
+
+// ParseBundleWithPredicate is the same as ParseBundleWithFilter, but
+// identifies permission tokens with isPerm rather than by location.
+func ParseBundleWithPredicate(isPerm Predicate, hdr string, filter Filter, opts ...ParseOption) (*Bundle, error) {
+	b := &Bundle{
+		IsPermissionToken: isPerm,
+		m:                 new(bundleState),
+	}
+
+	for _, opt := range opts {
+		opt(b)
+	}
+
 	var (
-		ts  = parseToks(hdr)
+		ts  = parseToks(hdr, DefaultSource, b.defensive)
 		err = ts.Error()
 	)
 
-	b := &Bundle{
-		IsPermissionToken: LocationFilter(permissionLocation).Predicate(),
-		m:                 new(sync.RWMutex),
-		ts:                filter.Apply(ts),
-	}
+	b.ts = filter.Apply(ts)
 
 	return b, err
 }
@@ -55,7 +122,15 @@ func ParseBundleWithFilter(permissionLocation, hdr string, filter Filter) (*Bund
 // AddTokens parses the provided header and adds the tokens to the Bundle. If an
 // error occurs during parsing, the Bundle remains unchanged.
 func (b *Bundle) AddTokens(hdr string) error {
-	ts := parseToks(hdr)
+	return b.AddTokensWithSource(DefaultSource, hdr)
+}
+
+// AddTokensWithSource is like AddTokens, but tags the added tokens with the
+// provided source (e.g. "cookie"). This is useful when merging tokens from
+// several places into one Bundle. The source of a token can be retrieved with
+// SourceOf and is included in errors about the token.
+func (b *Bundle) AddTokensWithSource(source, hdr string) error {
+	ts := parseToks(hdr, source, b.defensive)
 
 	if err := ts.Error(); err != nil {
 		return err
@@ -64,21 +139,87 @@ func (b *Bundle) AddTokens(hdr string) error {
 	b.m.Lock()
 	defer b.m.Unlock()
 
+	b.checkInvariants()
+	b.mutated()
+
 	b.ts = append(b.ts, ts...)
 
 	return nil
 }
 
+// FromMacaroons builds a Bundle from already-decoded macaroons, such as those
+// just minted by an issuer, without going through a header. Permission tokens
+// are identified by location, as with ParseBundle. The Bundle takes ownership
+// of the macaroons, so they must not be modified by the caller afterwards.
+// Unlike ParseBundle, no filter is applied.
+func FromMacaroons(permLocation string, macs ...*macaroon.Macaroon) (*Bundle, error) {
+	b := &Bundle{
+		IsPermissionToken: LocationFilter(permLocation).Predicate(),
+		m:                 new(bundleState),
+		ts:                make(tokens, 0, len(macs)),
+	}
+
+	for _, mac := range macs {
+		um, err := newUnverifiedMacaroon(mac)
+		if err != nil {
+			return nil, err
+		}
+
+		b.ts = append(b.ts, um)
+	}
+
+	return b, nil
+}
+
+// Append adds an already-decoded macaroon to the Bundle. The Bundle takes
+// ownership of the macaroon, so it must not be modified by the caller
+// afterwards.
+func (b *Bundle) Append(mac *macaroon.Macaroon) error {
+	um, err := newUnverifiedMacaroon(mac)
+	if err != nil {
+		return err
+	}
+
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	b.checkInvariants()
+	b.mutated()
+
+	um.defensive = b.defensive
+	b.ts = append(b.ts, um)
+
+	return nil
+}
+
+func newUnverifiedMacaroon(mac *macaroon.Macaroon) (*UnverifiedMacaroon, error) {
+	str, err := mac.String()
+	if err != nil {
+		return nil, fmt.Errorf("encode token %s: %w", mac.Nonce.UUID(), err)
+	}
+
+	return &UnverifiedMacaroon{Str: str, UnsafeMac: mac}, nil
+}
+
 // Select returns a new Bundle containing only the tokens matching the filter. The
 // underlying Tokens are the same.
 func (b *Bundle) Select(f Filter) *Bundle {
 	b.m.RLock()
 	defer b.m.RUnlock()
 
+	b.checkInvariants()
+	b.handOut(b.ts)
+	ts := b.ts.Select(f)
+	b.checkReturned(ts)
+
 	return &Bundle{
 		IsPermissionToken: b.IsPermissionToken,
 		m:                 b.m,
-		ts:                b.ts.Select(f),
+		gen:               b.gen,
+		ts:                ts,
+		defensive:         b.defensive,
+		failFast:          b.failFast,
+		verifierLocation:  b.verifierLocation,
 	}
 }
 
@@ -88,7 +229,12 @@ func (b *Bundle) Filter(f Filter) {
 	b.m.Lock()
 	defer b.m.Unlock()
 
-	b.ts = f.Apply(b.ts)
+	b.checkInvariants()
+	b.mutated()
+	b.handOut(b.ts)
+	ts := f.Apply(b.ts)
+	b.checkReturned(ts)
+	b.ts = ts
 }
 
 // IsMissingDischarge returns a Filter that selects only permission tokens that
@@ -107,6 +253,8 @@ func (b *Bundle) Header() string {
 	b.m.RLock()
 	defer b.m.RUnlock()
 
+	b.checkInvariants()
+
 	return b.ts.Header()
 }
 
@@ -115,6 +263,8 @@ func (b *Bundle) String() string {
 	b.m.RLock()
 	defer b.m.RUnlock()
 
+	b.checkInvariants()
+
 	return b.ts.String()
 }
 
@@ -124,6 +274,8 @@ func (b *Bundle) Error() error {
 	b.m.RLock()
 	defer b.m.RUnlock()
 
+	b.checkInvariants()
+
 	return b.ts.Error()
 }
 
@@ -132,6 +284,8 @@ func (b *Bundle) Len() int {
 	b.m.RLock()
 	defer b.m.RUnlock()
 
+	b.checkInvariants()
+
 	return len(b.ts)
 }
 
@@ -140,15 +294,15 @@ func (b *Bundle) IsEmpty() bool {
 	b.m.RLock()
 	defer b.m.RUnlock()
 
+	b.checkInvariants()
+
 	return len(b.ts) == 0
 }
 
 // Any returns true if any of the tokens in the Bundle match the filter.
 func (b *Bundle) Any(f Filter) bool {
-	b.m.RLock()
-	defer b.m.RUnlock()
-
-	return b.Count(f) > 0
+	_, found := First(b, f)
+	return found
 }
 
 // Count returns the number of tokens in the Bundle that match the filter.
@@ -175,6 +329,9 @@ func (b *Bundle) Verify(ctx context.Context, v Verifier) ([]*macaroon.CaveatSet,
 	b.m.Lock()
 	defer b.m.Unlock()
 
+	b.checkInvariants()
+	b.mutated()
+
 	return b.ts.Verify(ctx, b.IsPermissionToken, v)
 }
 
@@ -185,7 +342,54 @@ func (b *Bundle) Validate(accesses ...macaroon.Access) error {
 	b.m.RLock()
 	defer b.m.RUnlock()
 
-	return b.ts.Validate(accesses...)
+	b.checkInvariants()
+
+	return b.ts.Validate(b.failFast, withVerifierLocation(b.verifierLocation, accesses)...)
+}
+
+// AuditRecord describes how Bundle.ValidateWithAudit reached an authorization
+// decision. It is suitable for JSON-encoding into audit logs and doesn't
+// contain any secret material.
+type AuditRecord struct {
+	// Allowed is whether any token allowed all the accesses.
+	Allowed bool `json:"allowed"`
+
+	// Error is the validation error, if any.
+	Error string `json:"error,omitempty"`
+
+	// Tokens has an entry for each verified token that was evaluated, in
+	// order. Evaluation stops at the first token that allows all the accesses.
+	Tokens []*TokenAudit `json:"tokens"`
+}
+
+// TokenAudit describes the evaluation of a single verified token.
+type TokenAudit struct {
+	// ID is the token's UUID. See macaroon.Nonce.UUID.
+	ID string `json:"id"`
+
+	// Location is the token's location.
+	Location string `json:"location"`
+
+	// Source is where the token came from. See SourceOf.
+	Source string `json:"source,omitempty"`
+
+	// Authorized is whether this is the token that allowed the accesses.
+	Authorized bool `json:"authorized"`
+
+	// Record describes the evaluation of the token's verified caveats.
+	Record *macaroon.AuditRecord `json:"record"`
+}
+
+// ValidateWithAudit is like Validate, but also returns an AuditRecord
+// describing how each verified token was evaluated and which one (if any)
+// authorized the accesses.
+func (b *Bundle) ValidateWithAudit(accesses ...macaroon.Access) (*AuditRecord, error) {
+	b.m.RLock()
+	defer b.m.RUnlock()
+
+	b.checkInvariants()
+
+	return b.ts.ValidateWithAudit(withVerifierLocation(b.verifierLocation, accesses)...)
 }
 
 // UndischargedThirdPartyTickets returns a map of third-party locations to their
@@ -194,6 +398,8 @@ func (b *Bundle) UndischargedThirdPartyTickets() map[string][][]byte {
 	b.m.RLock()
 	defer b.m.RUnlock()
 
+	b.checkInvariants()
+
 	return b.ts.undischargedTicketsByLocation(b.IsPermissionToken)
 }
 
@@ -216,21 +422,107 @@ type Discharger func([]macaroon.Caveat) ([]macaroon.Caveat, error)
 
 // Discharge attempts to discharge any third-party caveats for tpLocation. The
 // provided callback (cb) is invoked to validate any caveats in tickets and to
-// provide discharge macaroons.
+// provide discharge macaroons. If any part of this fails, the bundle remains
+// unchanged. See DischargeCtx.
 func (b *Bundle) Discharge(tpLocation string, tpKey macaroon.EncryptionKey, cb Discharger) error {
+	return b.DischargeCtx(context.Background(), tpLocation, tpKey, cb)
+}
+
+// DischargeCtx is like Discharge, but gives up if ctx is done before every
+// ticket is discharged, leaving the bundle unchanged. Tickets are discharged
+// without holding the Bundle's lock, so cb may use the Bundle and other
+// goroutines can use it in the meantime. Discharges for tickets that were
+// discharged or removed from the Bundle in the meantime are dropped.
+func (b *Bundle) DischargeCtx(ctx context.Context, tpLocation string, tpKey macaroon.EncryptionKey, cb Discharger) error {
+	version, ubl := func() (uint64, map[string][][]byte) {
+		b.m.RLock()
+		defer b.m.RUnlock()
+
+		b.checkInvariants()
+
+		return b.m.version, b.ts.undischargedTicketsByLocation(b.IsPermissionToken)
+	}()
+
+	newDiss, err := dischargeTickets(ctx, ubl, tpLocation, tpKey, cb, b.defensive)
+	if err != nil {
+		return err
+	}
+
 	b.m.Lock()
 	defer b.m.Unlock()
 
-	return b.ts.Discharge(b.IsPermissionToken, tpLocation, tpKey, cb)
+	if b.m.version != version {
+		newDiss = stillUndischarged(b.ts.undischargedTicketsByLocation(b.IsPermissionToken), newDiss)
+	}
+
+	b.mutated()
+	b.ts = append(b.ts, newDiss...)
+
+	return nil
 }
 
-// Attenuate adds caveats to the permission macaroons in the Bundle. If any part
-// of this fails, the bundle remains unchanged.
+// Attenuate adds caveats to the permission macaroons in the Bundle. Caveats
+// with a Validate method (e.g. flyio.Organization) are validated first. If any
+// part of this fails, the bundle remains unchanged. See AttenuateCtx.
 func (b *Bundle) Attenuate(caveats ...macaroon.Caveat) error {
+	return b.AttenuateCtx(context.Background(), caveats...)
+}
+
+// AttenuateCtx is like Attenuate, but gives up if ctx is done before every
+// permission macaroon is attenuated, leaving the bundle unchanged. Attenuated
+// copies of the macaroons are prepared while holding only the Bundle's read
+// lock, and the write lock is only taken to swap them in. If the Bundle is
+// modified in the meantime, the copies are discarded and prepared again.
+func (b *Bundle) AttenuateCtx(ctx context.Context, caveats ...macaroon.Caveat) error {
+	for _, c := range caveats {
+		if vc, ok := c.(validatingCaveat); ok {
+			if err := vc.Validate(); err != nil {
+				return fmt.Errorf("invalid %s caveat: %w", c.Name(), err)
+			}
+		}
+	}
+
+	for {
+		version, at := func() (uint64, attenuation) {
+			b.m.RLock()
+			defer b.m.RUnlock()
+
+			b.checkInvariants()
+
+			return b.m.version, b.ts.attenuationTargets(b.IsPermissionToken)
+		}()
+
+		if err := at.stage(ctx, caveats...); err != nil {
+			return err
+		}
+
+		if b.commit(version, at.apply) {
+			return nil
+		}
+	}
+}
+
+// commit calls apply with the write lock held and reports whether it did so.
+// It doesn't if the Bundle's tokens have been modified since version.
+func (b *Bundle) commit(version uint64, apply func()) bool {
 	b.m.Lock()
 	defer b.m.Unlock()
 
-	return b.ts.Attenuate(b.IsPermissionToken, caveats...)
+	if b.m.version != version {
+		return false
+	}
+
+	b.mutated()
+	apply()
+
+	return true
+}
+
+// validatingCaveat is implemented by caveats that can check themselves for
+// mistakes before being added to a token.
+type validatingCaveat interface {
+	macaroon.Caveat
+	Validate() error
 }
 
 // Clone returns a deep copy of the Bundle by serializing and re-parsing it.
@@ -238,10 +530,24 @@ func (b *Bundle) Clone() *Bundle {
 	b.m.RLock()
 	defer b.m.RUnlock()
 
+	b.checkInvariants()
+
+	ts := parseToks(b.Header(), "", b.defensive)
+
+	// re-parsing preserves the order of tokens, so we can copy sources over
+	for i := range ts {
+		if i < len(b.ts) {
+			setSource(ts[i], SourceOf(b.ts[i]))
+		}
+	}
+
 	return &Bundle{
 		IsPermissionToken: b.IsPermissionToken,
-		m:                 new(sync.RWMutex),
-		ts:                parseToks(b.Header()),
+		m:                 new(bundleState),
+		ts:                ts,
+		defensive:         b.defensive,
+		failFast:          b.failFast,
+		verifierLocation:  b.verifierLocation,
 	}
 }
 
@@ -250,6 +556,9 @@ func ForEach[T Token](b *Bundle, cb func(T)) {
 	b.m.RLock()
 	defer b.m.RUnlock()
 
+	b.checkInvariants()
+	b.handOut(b.ts)
+
 	for _, t := range b.ts {
 		if tt, ok := t.(T); ok {
 			cb(tt)
@@ -257,12 +566,74 @@ func ForEach[T Token](b *Bundle, cb func(T)) {
 	}
 }
 
+// ForEachUntil calls the provided callback for each token in the Bundle, in
+// order, until it returns false.
+func ForEachUntil[T Token](b *Bundle, cb func(T) bool) {
+	b.m.RLock()
+	defer b.m.RUnlock()
+
+	b.checkInvariants()
+	b.handOut(b.ts)
+
+	for _, t := range b.ts {
+		if tt, ok := t.(T); ok && !cb(tt) {
+			return
+		}
+	}
+}
+
+// Find returns the first token in the Bundle satisfying the predicate. Tokens
+// after it aren't considered.
+func Find[T Token](b *Bundle, pred func(T) bool) (T, bool) {
+	var (
+		ret   T
+		found bool
+	)
+
+	ForEachUntil(b, func(t T) bool {
+		if pred(t) {
+			ret, found = t, true
+		}
+
+		return !found
+	})
+
+	return ret, found
+}
+
+// First returns the first token in the Bundle matching the filter. If the
+// filter is a Predicate, tokens after the first match aren't considered.
+// Otherwise, the filter is applied to all the tokens.
+func First(b *Bundle, f Filter) (Token, bool) {
+	// avoid copying the slice if the filter is a Predicate
+	if pred, ok := f.(Predicate); ok {
+		return Find[Token](b, pred)
+	}
+
+	b.m.RLock()
+	defer b.m.RUnlock()
+
+	b.checkInvariants()
+	b.handOut(b.ts)
+	ts := b.ts.Select(f)
+	b.checkReturned(ts)
+
+	if len(ts) == 0 {
+		return nil, false
+	}
+
+	return ts[0], true
+}
+
 // Map applies the callback to each token in the Bundle and returns a slice of
 // the callback's return values.
 func Map[R any, T Token](b *Bundle, cb func(T) R) []R {
 	b.m.RLock()
 	defer b.m.RUnlock()
 
+	b.checkInvariants()
+	b.handOut(b.ts)
+
 	var ret []R
 	for _, t := range b.ts {
 		if tt, ok := t.(T); ok {
@@ -279,6 +650,9 @@ func Reduce[A any, T Token](b *Bundle, cb func(A, T) A) A {
 	b.m.RLock()
 	defer b.m.RUnlock()
 
+	b.checkInvariants()
+	b.handOut(b.ts)
+
 	var acc A
 	for _, t := range b.ts {
 		if tt, ok := t.(T); ok {
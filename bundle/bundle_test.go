@@ -2,13 +2,17 @@ package bundle
 
 import (
 	"context"
+	"encoding/base64"
+	"encoding/json"
 	"errors"
-	"reflect"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/alecthomas/assert/v2"
 	"github.com/superfly/macaroon"
+	"github.com/superfly/macaroon/resset"
+	"golang.org/x/exp/slices"
 )
 
 func TestParseBundle(t *testing.T) {
@@ -122,6 +126,118 @@ func TestAddTokens(t *testing.T) {
 	})
 }
 
+func TestFromMacaroons(t *testing.T) {
+	t.Parallel()
+
+	perm, err := macaroon.New(permKID, permLoc, permKey)
+	assert.NoError(t, err)
+	assert.NoError(t, perm.Add(&macaroon.ValidityWindow{NotBefore: 1, NotAfter: 2}))
+	assert.NoError(t, perm.Add3P(tpKey, tpLoc))
+
+	ticket, err := perm.ThirdPartyTicket(tpLoc)
+	assert.NoError(t, err)
+	_, dis, err := macaroon.DischargeTicket(tpKey, tpLoc, ticket)
+	assert.NoError(t, err)
+
+	b, err := FromMacaroons(permLoc, perm)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, b.Count(b.IsPermissionToken))
+	assert.Equal(t, 1, len(b.UndischargedThirdPartyTickets()))
+
+	assert.NoError(t, b.Append(dis))
+	assert.Equal(t, 2, b.Len())
+	assert.Equal(t, 1, b.Count(b.IsPermissionToken))
+	assert.Equal(t, 0, len(b.UndischargedThirdPartyTickets()))
+
+	// same as if it had been parsed
+	parsed, err := ParseBundle(permLoc, b.Header())
+	assert.NoError(t, err)
+	assert.Equal(t, b.String(), parsed.String())
+	assert.Equal(t, parsed.Count(parsed.IsPermissionToken), b.Count(b.IsPermissionToken))
+
+	permStr, err := perm.String()
+	assert.NoError(t, err)
+	disStr, err := dis.String()
+	assert.NoError(t, err)
+	assert.Equal(t, permStr+","+disStr, b.String())
+
+	_, err = b.Verify(context.Background(), WithKey(permKID, permKey, nil))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, b.Count(IsVerifiedMacaroon))
+}
+
+func TestSources(t *testing.T) {
+	t.Parallel()
+
+	var (
+		hdrToks    = macOpts{}.tokens(t)
+		cookieToks = macOpts{}.tokens(t)
+		svcToks    = macOpts{tpOpts: []tpOpt{{discharge: true}}}.tokens(t)
+	)
+
+	newBundle := func(t *testing.T) *Bundle {
+		t.Helper()
+
+		b, err := ParseBundle(permLoc, hdrToks.String())
+		assert.NoError(t, err)
+		assert.NoError(t, b.AddTokensWithSource("cookie", cookieToks.String()))
+		assert.NoError(t, b.AddTokensWithSource("service", svcToks.String()))
+
+		return b
+	}
+
+	t.Run("filters", func(t *testing.T) {
+		t.Parallel()
+
+		b := newBundle(t)
+		assert.Equal(t, hdrToks.String(), b.Select(BySource(DefaultSource)).String())
+		assert.Equal(t, cookieToks.String(), b.Select(BySource("cookie")).String())
+		assert.Equal(t, svcToks.String(), b.Select(BySource("service")).String())
+		assert.Equal(t, 0, b.Count(BySource("other")))
+		assert.Equal(t, "service", SourceOf(b.Select(BySource("service")).ts[1]))
+		assert.Equal(t, "", SourceOf(NonMacaroon("foo")))
+	})
+
+	t.Run("clone preserves sources", func(t *testing.T) {
+		t.Parallel()
+
+		b := newBundle(t).Clone()
+		assert.Equal(t, cookieToks.String(), b.Select(BySource("cookie")).String())
+		assert.Equal(t, svcToks.String(), b.Select(BySource("service")).String())
+	})
+
+	t.Run("parse errors", func(t *testing.T) {
+		t.Parallel()
+
+		_, err := ParseBundle(permLoc, hdrToks.String()+",fm2_xxx")
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "from header: ")
+	})
+
+	t.Run("verification errors", func(t *testing.T) {
+		t.Parallel()
+
+		b := newBundle(t)
+
+		_, err := b.Verify(context.Background(), testVerifier(func(ctx context.Context, dischargesByPermission map[Macaroon][]Macaroon) map[Macaroon]VerificationResult {
+			ret := make(map[Macaroon]VerificationResult, len(dischargesByPermission))
+			for perm := range dischargesByPermission {
+				if SourceOf(perm) == "cookie" {
+					ret[perm] = &FailedMacaroon{perm.Unverified(), errors.New("hi")}
+				} else {
+					ret[perm] = &VerifiedMacaroon{perm.Unverified(), perm.UnsafeCaveats()}
+				}
+			}
+			return ret
+		}))
+		assert.NoError(t, err)
+
+		assert.Equal(t, 2, b.Count(And(IsVerifiedMacaroon, Not(BySource("cookie")))))
+		assert.EqualError(t, b.Error(), "from cookie: hi")
+		assert.Equal(t, "cookie", SourceOf(b.Select(IsFailedMacaroon).ts[0]))
+	})
+}
+
 func TestSelect(t *testing.T) {
 	t.Parallel()
 
@@ -151,6 +267,83 @@ func TestSelect(t *testing.T) {
 	})
 }
 
+func TestEarlyExit(t *testing.T) {
+	t.Parallel()
+
+	b, err := ParseBundle(permLoc, "a,b,c,d")
+	assert.NoError(t, err)
+
+	var (
+		calls  int
+		isB    Predicate
+		isNone Predicate
+	)
+
+	isB = func(t Token) bool {
+		calls++
+		return t.String() == "b"
+	}
+
+	isNone = func(t Token) bool {
+		calls++
+		return false
+	}
+
+	t.Run("ForEachUntil", func(t *testing.T) {
+		calls = 0
+		ForEachUntil(b, func(t Token) bool { return !isB(t) })
+		assert.Equal(t, 2, calls)
+
+		calls = 0
+		ForEachUntil(b, func(t Token) bool { return !isNone(t) })
+		assert.Equal(t, 4, calls)
+
+		calls = 0
+		ForEachUntil(b, func(m Macaroon) bool {
+			calls++
+			return true
+		})
+		assert.Equal(t, 0, calls)
+	})
+
+	t.Run("Find", func(t *testing.T) {
+		calls = 0
+		tok, ok := Find[Token](b, isB)
+		assert.True(t, ok)
+		assert.Equal(t, "b", tok.String())
+		assert.Equal(t, 2, calls)
+
+		calls = 0
+		tok, ok = Find[Token](b, isNone)
+		assert.False(t, ok)
+		assert.Zero(t, tok)
+		assert.Equal(t, 4, calls)
+	})
+
+	t.Run("First", func(t *testing.T) {
+		calls = 0
+		tok, ok := First(b, isB)
+		assert.True(t, ok)
+		assert.Equal(t, "b", tok.String())
+		assert.Equal(t, 2, calls)
+
+		calls = 0
+		assert.True(t, b.Any(isB))
+		assert.Equal(t, 2, calls)
+
+		// filters that aren't Predicates see all the tokens
+		calls = 0
+		tok, ok = First(b, filterFunc(isB.Apply))
+		assert.True(t, ok)
+		assert.Equal(t, "b", tok.String())
+		assert.Equal(t, 4, calls)
+
+		_, ok = First(b, filterFunc(isNone.Apply))
+		assert.False(t, ok)
+		assert.False(t, b.Any(filterFunc(isNone.Apply)))
+	})
+}
+
 func TestIsMissingDischarge(t *testing.T) {
 	t.Parallel()
 
@@ -263,6 +456,142 @@ func TestWithDischarges(t *testing.T) {
 	})
 }
 
+func TestDifferenceXor(t *testing.T) {
+	t.Parallel()
+
+	b, err := ParseBundle(permLoc, "a,b,c")
+	assert.NoError(t, err)
+
+	is := func(s string) Predicate {
+		return func(t Token) bool { return t.String() == s }
+	}
+
+	assert.Equal(t, "a,c", b.Select(Difference(KeepAll, is("b"))).String())
+	assert.Equal(t, "", b.Select(Difference(is("b"), KeepAll)).String())
+	assert.Equal(t, "a,c", b.Select(Xor(Or(is("a"), is("b")), Or(is("b"), is("c")))).String())
+}
+
+func TestExplain(t *testing.T) {
+	t.Parallel()
+
+	var (
+		withDischarge    = macOpts{tpOpts: []tpOpt{{discharge: true}}}.tokens(t)
+		missingDischarge = macOpts{tpOpts: []tpOpt{{}}}.tokens(t)
+		hdr              = Header[Token](withDischarge[0], withDischarge[1], missingDischarge[0], NonMacaroon("junk"))
+	)
+
+	bun, err := ParseBundleWithFilter(permLoc, hdr, KeepAll)
+	assert.NoError(t, err)
+
+	f := Named("usable", Difference(
+		Named("perm", And(
+			NamedPredicate("macaroon", IsWellFormedMacaroon),
+			NamedPredicate("location", LocationFilter(permLoc).Predicate()),
+		)),
+		Named("missing", bun.IsMissingDischarge(tpLoc)),
+	))
+
+	assert.Equal(t, withDischarge[0].String(), bun.Select(f).String())
+
+	decision := func(names ...string) []FilterDecision {
+		ret := make([]FilterDecision, 0, 5)
+		for _, name := range []string{"usable", "usable/perm", "usable/perm/macaroon", "usable/perm/location", "usable/missing"} {
+			ret = append(ret, FilterDecision{Name: name, Selected: slices.Contains(names, name)})
+		}
+		return ret
+	}
+
+	explained := bun.Explain(f)
+	assert.Equal(t, 4, len(explained))
+
+	assert.Equal(t, withDischarge[0].String(), explained[0].Token.String())
+	assert.True(t, explained[0].Selected)
+	assert.Equal(t, decision("usable", "usable/perm", "usable/perm/macaroon", "usable/perm/location"), explained[0].Filters)
+
+	assert.Equal(t, withDischarge[1].String(), explained[1].Token.String())
+	assert.False(t, explained[1].Selected)
+	assert.Equal(t, decision("usable/perm/macaroon"), explained[1].Filters)
+
+	assert.Equal(t, missingDischarge[0].String(), explained[2].Token.String())
+	assert.False(t, explained[2].Selected)
+	assert.Equal(t, decision("usable/perm", "usable/perm/macaroon", "usable/perm/location", "usable/missing"), explained[2].Filters)
+
+	assert.Equal(t, "junk", explained[3].Token.String())
+	assert.False(t, explained[3].Selected)
+	assert.Equal(t, decision(), explained[3].Filters)
+
+	// explaining doesn't change the outcome
+	assert.Equal(t, withDischarge[0].String(), bun.Select(f).String())
+}
+
+func TestTrimToBudget(t *testing.T) {
+	t.Parallel()
+
+	var (
+		toks  = macOpts{tpOpts: []tpOpt{{discharge: true}}}.tokens(t)
+		extra = macOpts{tpOpts: []tpOpt{{discharge: true}}}.tokens(t)[1]
+		junk1 = NonMacaroon("junk1")
+		junk2 = NonMacaroon("junk2")
+		hdr   = Header[Token](toks[0], toks[1], junk1, extra, junk2)
+	)
+
+	parse := func() *Bundle {
+		bun, err := ParseBundleWithFilter(permLoc, hdr, KeepAll)
+		assert.NoError(t, err)
+		return bun
+	}
+
+	bun := parse()
+	keep := Difference(DefaultFilter(bun.IsPermissionToken), IsNonMacaroon)
+
+	assert.Equal(t, len(bun.String()), bun.EncodedSize())
+	empty, err := FromMacaroons(permLoc)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, empty.EncodedSize())
+	assert.True(t, empty.FitsHeaderBudget(0))
+	assert.True(t, bun.FitsHeaderBudget(len(hdr)))
+	assert.False(t, bun.FitsHeaderBudget(len(hdr)-1))
+
+	t.Run("already fits", func(t *testing.T) {
+		bun := parse()
+		removed, err := bun.TrimToBudget(len(hdr), keep)
+		assert.NoError(t, err)
+		assert.Zero(t, removed)
+		assert.Equal(t, hdr, bun.Header())
+	})
+
+	t.Run("trims from the end", func(t *testing.T) {
+		bun := parse()
+		limit := len(hdr) - len(junk2) - len(extra.String()) - 2*len(tokDelim)
+
+		removed, err := bun.TrimToBudget(limit, keep)
+		assert.NoError(t, err)
+		assert.Equal(t, String[Token](junk2, extra), String(removed...))
+		assert.Equal(t, Header[Token](toks[0], toks[1], junk1), bun.Header())
+		assert.True(t, bun.FitsHeaderBudget(limit))
+	})
+
+	t.Run("trims everything it can", func(t *testing.T) {
+		bun := parse()
+		limit := len(Header[Token](toks[0], toks[1]))
+
+		removed, err := bun.TrimToBudget(limit, keep)
+		assert.NoError(t, err)
+		assert.Equal(t, String[Token](junk2, extra, junk1), String(removed...))
+		assert.Equal(t, toks.Header(), bun.Header())
+	})
+
+	t.Run("kept tokens exceed budget", func(t *testing.T) {
+		bun := parse()
+		limit := len(Header[Token](toks[0], toks[1])) - 1
+
+		removed, err := bun.TrimToBudget(limit, keep)
+		assert.IsError(t, err, ErrOverBudget)
+		assert.Zero(t, removed)
+		assert.Equal(t, hdr, bun.Header())
+	})
+}
+
 type testVerifier func(ctx context.Context, dischargesByPermission map[Macaroon][]Macaroon) map[Macaroon]VerificationResult
 
 func (f testVerifier) Verify(ctx context.Context, dischargesByPermission map[Macaroon][]Macaroon) map[Macaroon]VerificationResult {
@@ -327,8 +656,8 @@ func TestVerify(t *testing.T) {
 
 		failed := bun.Select(Predicate(isType[*FailedMacaroon]))
 		assert.Equal(t, 2, failed.Len())
-		assert.EqualError(t, failed.ts[:1].Error(), "hi")
-		assert.EqualError(t, failed.ts[1:].Error(), "hi")
+		assert.EqualError(t, failed.ts[:1].Error(), "from header: hi")
+		assert.EqualError(t, failed.ts[1:].Error(), "from header: hi")
 	})
 
 	t.Run("returns ok if any verified", func(t *testing.T) {
@@ -359,8 +688,270 @@ func TestVerify(t *testing.T) {
 
 		failed := bun.Select(Predicate(isType[*FailedMacaroon]))
 		assert.Equal(t, 1, failed.Len())
-		assert.EqualError(t, failed.Error(), "hi")
+		assert.EqualError(t, failed.Error(), "from header: hi")
+	})
+}
+
+func TestAuthorize(t *testing.T) {
+	t.Parallel()
+
+	var (
+		now     = time.Now()
+		valid   = &macaroon.ValidityWindow{NotBefore: now.Add(-time.Hour).Unix(), NotAfter: now.Add(time.Hour).Unix()}
+		expired = &macaroon.ValidityWindow{NotBefore: now.Add(-2 * time.Hour).Unix(), NotAfter: now.Add(-time.Hour).Unix()}
+		access  = testAccess(now)
+		kr      = WithKey(permKID, permKey, nil)
+	)
+
+	t.Run("allowed", func(t *testing.T) {
+		t.Parallel()
+
+		bad := macOpts{cavs: []macaroon.Caveat{expired}, tpOpts: []tpOpt{{discharge: true}}}.tokens(t)
+		good := macOpts{cavs: []macaroon.Caveat{valid}, tpOpts: []tpOpt{{discharge: true}}}.tokens(t)
+
+		bun, err := ParseBundle(permLoc, append(bad, good...).String())
+		assert.NoError(t, err)
+
+		res, err := bun.Authorize(context.Background(), kr, access)
+		assert.NoError(t, err)
+		assert.Equal(t, Allowed, res.Decision)
+		assert.Equal(t, good[0].String(), res.Macaroon.String())
+		assert.True(t, res.Caveats == res.Macaroon.Caveats)
+		assert.Equal(t, 1, len(res.Failures))
+		assert.NotZero(t, res.Failures[bad[0].(Macaroon).Nonce().UUID()])
+	})
+
+	t.Run("forbidden", func(t *testing.T) {
+		t.Parallel()
+
+		toks := macOpts{cavs: []macaroon.Caveat{expired}, tpOpts: []tpOpt{{discharge: true}}}.tokens(t)
+
+		bun, err := ParseBundle(permLoc, toks.String())
+		assert.NoError(t, err)
+
+		res, err := bun.Authorize(context.Background(), kr, access)
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "no authorized tokens")
+		assert.Equal(t, Forbidden, res.Decision)
+		assert.Zero(t, res.Macaroon)
+		assert.Zero(t, res.Caveats)
+		assert.IsError(t, res.Failures[toks[0].(Macaroon).Nonce().UUID()], macaroon.ErrUnauthorized)
+	})
+
+	t.Run("unauthenticated", func(t *testing.T) {
+		t.Parallel()
+
+		undischarged := macOpts{cavs: []macaroon.Caveat{valid}, tpOpts: []tpOpt{{}}}.tokens(t)
+		wrongKey := macOpts{key: macaroon.NewSigningKey(), cavs: []macaroon.Caveat{valid}}.tokens(t)
+
+		bun, err := ParseBundle(permLoc, append(undischarged, wrongKey...).String())
+		assert.NoError(t, err)
+
+		res, err := bun.Authorize(context.Background(), kr, access)
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "no verified tokens")
+		assert.Equal(t, Unauthenticated, res.Decision)
+		assert.Equal(t, 2, len(res.Failures))
+
+		// no tokens at all
+		bun, _ = ParseBundle(permLoc, "")
+		res, err = bun.Authorize(context.Background(), kr, access)
+		assert.Error(t, err)
+		assert.Equal(t, Unauthenticated, res.Decision)
 	})
+
+	t.Run("skips verified tokens", func(t *testing.T) {
+		t.Parallel()
+
+		toks := macOpts{cavs: []macaroon.Caveat{valid}, tpOpts: []tpOpt{{discharge: true}}}.tokens(t)
+
+		bun, err := ParseBundle(permLoc, toks.String())
+		assert.NoError(t, err)
+
+		_, err = bun.Verify(context.Background(), kr)
+		assert.NoError(t, err)
+
+		res, err := bun.Authorize(context.Background(), testVerifier(func(ctx context.Context, dischargesByPermission map[Macaroon][]Macaroon) map[Macaroon]VerificationResult {
+			t.Fatal("verifier shouldn't be called")
+			return nil
+		}), access)
+		assert.NoError(t, err)
+		assert.Equal(t, Allowed, res.Decision)
+	})
+}
+
+type testAccess time.Time
+
+func (a testAccess) Now() time.Time  { return time.Time(a) }
+func (a testAccess) Validate() error { return nil }
+
+func TestValidateWithAudit(t *testing.T) {
+	t.Parallel()
+
+	var (
+		now     = time.Now()
+		valid   = &macaroon.ValidityWindow{NotBefore: now.Add(-time.Hour).Unix(), NotAfter: now.Add(time.Hour).Unix()}
+		expired = &macaroon.ValidityWindow{NotBefore: now.Add(-2 * time.Hour).Unix(), NotAfter: now.Add(-time.Hour).Unix()}
+		access  = testAccess(now)
+		kr      = WithKey(permKID, permKey, nil)
+	)
+
+	bad := macOpts{cavs: []macaroon.Caveat{expired}, tpOpts: []tpOpt{{discharge: true}}}.tokens(t)
+	good := macOpts{cavs: []macaroon.Caveat{valid}, tpOpts: []tpOpt{{discharge: true}}}.tokens(t)
+
+	bun, err := ParseBundle(permLoc, append(bad, good...).String())
+	assert.NoError(t, err)
+	_, err = bun.Verify(context.Background(), kr)
+	assert.NoError(t, err)
+
+	rec, err := bun.ValidateWithAudit(access)
+	assert.Equal(t, bun.Validate(access), err)
+	assert.True(t, rec.Allowed)
+	assert.Equal(t, 2, len(rec.Tokens))
+
+	badRec, goodRec := rec.Tokens[0], rec.Tokens[1]
+	assert.Equal(t, bad[0].(Macaroon).Nonce().UUID().String(), badRec.ID)
+	assert.Equal(t, permLoc, badRec.Location)
+	assert.Equal(t, DefaultSource, badRec.Source)
+	assert.False(t, badRec.Authorized)
+	assert.False(t, badRec.Record.Allowed)
+	assert.Equal(t, 1, len(badRec.Record.Accesses))
+	assert.Equal(t, "ValidityWindow", badRec.Record.Accesses[0].Caveats[0].Name)
+	assert.False(t, badRec.Record.Accesses[0].Caveats[0].Allowed)
+
+	assert.Equal(t, good[0].(Macaroon).Nonce().UUID().String(), goodRec.ID)
+	assert.True(t, goodRec.Authorized)
+	assert.True(t, goodRec.Record.Allowed)
+
+	// no secret material
+	buf, err := json.Marshal(rec)
+	assert.NoError(t, err)
+	for _, tok := range append(bad, good...) {
+		mac := tok.(Macaroon).UnsafeMacaroon()
+		assert.NotContains(t, string(buf), base64.StdEncoding.EncodeToString(mac.Tail))
+		assert.NotContains(t, string(buf), base64.StdEncoding.EncodeToString(mac.Nonce.KID))
+	}
+
+	// denied
+	bun, err = ParseBundle(permLoc, bad.String())
+	assert.NoError(t, err)
+	_, err = bun.Verify(context.Background(), kr)
+	assert.NoError(t, err)
+
+	rec, err = bun.ValidateWithAudit(access)
+	assert.Error(t, err)
+	assert.False(t, rec.Allowed)
+	assert.Equal(t, err.Error(), rec.Error)
+	assert.Equal(t, 1, len(rec.Tokens))
+	assert.False(t, rec.Tokens[0].Authorized)
+}
+
+func TestFailFastValidation(t *testing.T) {
+	t.Parallel()
+
+	var (
+		now      = time.Now()
+		expired1 = &macaroon.ValidityWindow{NotBefore: now.Add(-2 * time.Hour).Unix(), NotAfter: now.Add(-time.Hour).Unix()}
+		expired2 = &macaroon.ValidityWindow{NotBefore: now.Add(-2 * time.Hour).Unix(), NotAfter: now.Add(-time.Minute).Unix()}
+		access   = testAccess(now)
+		kr       = WithKey(permKID, permKey, nil)
+	)
+
+	toks := macOpts{cavs: []macaroon.Caveat{expired1, expired2}}.tokens(t)
+
+	validate := func(opts ...ParseOption) error {
+		bun, err := ParseBundle(permLoc, toks.String(), opts...)
+		assert.NoError(t, err)
+		_, err = bun.Verify(context.Background(), kr)
+		assert.NoError(t, err)
+
+		err = bun.Validate(access)
+		assert.IsError(t, err, macaroon.ErrUnauthorized)
+		return err
+	}
+
+	exhaustive := validate()
+	failFast := validate(WithFailFastValidation())
+
+	assert.Equal(t, 2, strings.Count(exhaustive.Error(), "token only valid until"))
+	assert.Equal(t, 1, strings.Count(failFast.Error(), "token only valid until"))
+}
+
+type locationAccess struct {
+	testAccess
+	loc string
+}
+
+func (a *locationAccess) GetVerifierLocation() string { return a.loc }
+
+func (a *locationAccess) WithVerifierLocation(loc string) macaroon.Access {
+	return &locationAccess{testAccess: a.testAccess, loc: loc}
+}
+
+func TestVerifierLocation(t *testing.T) {
+	t.Parallel()
+
+	const (
+		apiLoc   = "https://api.example"
+		flapsLoc = "https://flaps.example"
+	)
+
+	var (
+		now     = time.Now()
+		expired = &macaroon.ValidityWindow{NotBefore: now.Add(-2 * time.Hour).Unix(), NotAfter: now.Add(-time.Hour).Unix()}
+		kr      = WithKey(permKID, permKey, nil)
+		toks    = macOpts{cavs: []macaroon.Caveat{&macaroon.ScopedToLocation{
+			Locations: []string{flapsLoc},
+			Caveats:   macaroon.NewCaveatSet(expired),
+		}}}.tokens(t)
+	)
+
+	bundleAt := func(opts ...ParseOption) *Bundle {
+		bun, err := ParseBundle(permLoc, toks.String(), opts...)
+		assert.NoError(t, err)
+		_, err = bun.Verify(context.Background(), kr)
+		assert.NoError(t, err)
+
+		return bun
+	}
+
+	var (
+		flaps = bundleAt(WithVerifierLocation(flapsLoc))
+		api   = bundleAt(WithVerifierLocation(apiLoc))
+
+		// the token's own location isn't the verifier's, so the scoped
+		// caveats apply without the option.
+		unknown = bundleAt()
+	)
+
+	access := &locationAccess{testAccess: testAccess(now)}
+
+	assert.IsError(t, flaps.Validate(access), macaroon.ErrUnauthorized)
+	assert.IsError(t, unknown.Validate(access), macaroon.ErrUnauthorized)
+	assert.NoError(t, api.Validate(access))
+
+	rec, err := flaps.ValidateWithAudit(access)
+	assert.Error(t, err)
+	assert.False(t, rec.Allowed)
+	_, err = api.ValidateWithAudit(access)
+	assert.NoError(t, err)
+
+	res, err := flaps.Authorize(context.Background(), kr, access)
+	assert.Error(t, err)
+	assert.Equal(t, Forbidden, res.Decision)
+	res, err = api.Authorize(context.Background(), kr, access)
+	assert.NoError(t, err)
+	assert.Equal(t, Allowed, res.Decision)
+
+	// the option propagates to derived bundles
+	assert.NoError(t, api.Select(IsVerifiedMacaroon).Validate(access))
+
+	// the caller's access isn't modified
+	assert.Equal(t, "", access.loc)
+
+	// locations set by the caller aren't overridden
+	assert.NoError(t, flaps.Validate(&locationAccess{testAccess: testAccess(now), loc: apiLoc}))
+	assert.Equal(t, 1, flaps.Count(AllowsAccess(&locationAccess{testAccess: testAccess(now), loc: apiLoc})))
 }
 
 func TestUndischargedThirdPartyTickets(t *testing.T) {
@@ -416,6 +1007,560 @@ func TestAttenuate(t *testing.T) {
 	assert.True(t, hasCav(toks[0]))
 	assert.False(t, hasCav(toks[1]))
 	assert.True(t, hasCav(toks[2]))
+
+	t.Run("too many caveats", func(t *testing.T) {
+		t.Parallel()
+
+		cavs := make([]macaroon.Caveat, macaroon.MaxCaveats)
+		for i := range cavs {
+			cavs[i] = &macaroon.ValidityWindow{NotBefore: int64(i), NotAfter: int64(i + 1)}
+		}
+
+		full := macOpts{cavs: cavs}.tokens(t)
+		toks := append(macOpts{}.tokens(t), full...)
+
+		extra := &macaroon.ValidityWindow{NotBefore: 3, NotAfter: 1}
+		err := toks.Attenuate(isPerm, extra)
+		assert.IsError(t, err, macaroon.ErrTooManyCaveats)
+		assert.Contains(t, err.Error(), full[0].(Macaroon).Nonce().UUID().String())
+
+		// changes aren't applied if any token fails
+		assert.False(t, hasCaveat(extra)(toks[0]))
+	})
+
+	t.Run("verified caveats match re-verification", func(t *testing.T) {
+		t.Parallel()
+
+		var (
+			permCav = &macaroon.ValidityWindow{NotBefore: 1, NotAfter: 10}
+			disCav  = &macaroon.ValidityWindow{NotBefore: 2, NotAfter: 20}
+			newCav  = &macaroon.ValidityWindow{NotBefore: 3, NotAfter: 30}
+			kr      = WithKey(permKID, permKey, nil)
+		)
+
+		toks := macOpts{
+			cavs:   []macaroon.Caveat{permCav},
+			tpOpts: []tpOpt{{discharge: true, dcavs: []macaroon.Caveat{disCav}}},
+		}.tokens(t)
+
+		_, err := toks.Verify(context.Background(), isPerm, kr)
+		assert.NoError(t, err)
+
+		// permCav is skipped by Add, but disCav is only in the discharge, so
+		// it's added to the permission token
+		assert.NoError(t, toks.Attenuate(isPerm, newCav, permCav, disCav, newCav))
+
+		vm, ok := toks[0].(*VerifiedMacaroon)
+		assert.True(t, ok)
+
+		fresh, err := vm.UnsafeMac.VerifyParsed(permKey, []*macaroon.Macaroon{toks[1].(Macaroon).UnsafeMacaroon()}, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, fresh, vm.Caveats)
+		assert.Equal(t, macaroon.NewCaveatSet(permCav, newCav, disCav, disCav), vm.Caveats)
+	})
+}
+
+func TestAttenuateCtx(t *testing.T) {
+	t.Parallel()
+
+	var (
+		cav    = &macaroon.ValidityWindow{NotBefore: 1, NotAfter: 2}
+		hasCav = hasCaveat(cav)
+		toks   tokens
+	)
+
+	for i := 0; i < 40; i++ {
+		toks = append(toks, macOpts{tpOpts: []tpOpt{{discharge: true}}}.tokens(t)...)
+	}
+
+	t.Run("canceled", func(t *testing.T) {
+		t.Parallel()
+
+		bun, err := ParseBundle(permLoc, toks.Header())
+		assert.NoError(t, err)
+		_, err = bun.Verify(context.Background(), WithKey(permKID, permKey, nil))
+		assert.NoError(t, err)
+		before := bun.Header()
+
+		ctx := &hookCtx{Context: context.Background(), hook: func(n int) error {
+			if n > 20 {
+				return context.Canceled
+			}
+			return nil
+		}}
+
+		assert.IsError(t, bun.AttenuateCtx(ctx, cav), context.Canceled)
+		assert.Equal(t, before, bun.Header())
+		assert.False(t, bun.Any(hasCav))
+		assert.NoError(t, bun.Validate())
+	})
+
+	t.Run("modified while staging", func(t *testing.T) {
+		t.Parallel()
+
+		bun, err := ParseBundle(permLoc, toks.Header())
+		assert.NoError(t, err)
+
+		ctx := &hookCtx{Context: context.Background(), hook: func(n int) error {
+			if n == 1 {
+				assert.NoError(t, bun.AddTokens(macOpts{}.tokens(t).Header()))
+			}
+			return nil
+		}}
+
+		assert.NoError(t, bun.AttenuateCtx(ctx, cav))
+		assert.Equal(t, 41, bun.Count(bun.IsPermissionToken))
+		assert.Equal(t, 41, bun.Count(hasCav))
+	})
+}
+
+func TestDischargeCtx(t *testing.T) {
+	t.Parallel()
+
+	var toks tokens
+	for i := 0; i < 40; i++ {
+		toks = append(toks, macOpts{tpOpts: []tpOpt{{}}}.tokens(t)...)
+	}
+
+	noCavs := func([]macaroon.Caveat) ([]macaroon.Caveat, error) { return nil, nil }
+
+	t.Run("canceled", func(t *testing.T) {
+		t.Parallel()
+
+		bun, err := ParseBundle(permLoc, toks.Header())
+		assert.NoError(t, err)
+		before := bun.Header()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		n := 0
+		err = bun.DischargeCtx(ctx, tpLoc, tpKey, func([]macaroon.Caveat) ([]macaroon.Caveat, error) {
+			if n++; n == 20 {
+				cancel()
+			}
+			return nil, nil
+		})
+		assert.IsError(t, err, context.Canceled)
+		assert.Equal(t, 20, n)
+		assert.Equal(t, before, bun.Header())
+		assert.Equal(t, 40, len(bun.UndischargedTicketsForThirdParty(tpLoc)))
+	})
+
+	t.Run("modified while discharging", func(t *testing.T) {
+		t.Parallel()
+
+		bun, err := ParseBundle(permLoc, toks.Header())
+		assert.NoError(t, err)
+
+		// the callback isn't called with the lock held, so it can discharge
+		// the tickets itself.
+		first := true
+		err = bun.DischargeCtx(context.Background(), tpLoc, tpKey, func([]macaroon.Caveat) ([]macaroon.Caveat, error) {
+			if first {
+				first = false
+				assert.NoError(t, bun.Discharge(tpLoc, tpKey, noCavs))
+			}
+			return nil, nil
+		})
+		assert.NoError(t, err)
+
+		// discharges for tickets discharged in the meantime are dropped
+		assert.Equal(t, 80, bun.Len())
+		assert.Equal(t, 0, len(bun.UndischargedThirdPartyTickets()))
+
+		vcavs, err := bun.Verify(context.Background(), WithKey(permKID, permKey, nil))
+		assert.NoError(t, err)
+		assert.Equal(t, 40, len(vcavs))
+	})
+}
+
+// hookCtx calls hook with the number of calls so far each time its Err method
+// is called, and returns its result.
+type hookCtx struct {
+	context.Context
+	hook func(n int) error
+	n    int
+}
+
+func (c *hookCtx) Err() error {
+	c.n++
+	return c.hook(c.n)
+}
+
+func TestDefensiveCopies(t *testing.T) {
+	var (
+		toks   = macOpts{}.tokens(t)
+		hdr    = toks.Header()
+		kr     = WithKey(permKID, permKey, nil)
+		extra  = &macaroon.ValidityWindow{NotBefore: 1, NotAfter: 2}
+		mutate = func(m Macaroon) {
+			assert.NoError(t, m.UnsafeMacaroon().Add(extra))
+			m.UnsafeCaveats().Caveats = append(m.UnsafeCaveats().Caveats, extra)
+		}
+	)
+
+	t.Run("default", func(t *testing.T) {
+		bun, err := ParseBundle(permLoc, hdr)
+		assert.NoError(t, err)
+
+		ForEach(bun, func(m Macaroon) {
+			assert.True(t, m.UnsafeMacaroon() == m.UnsafeMacaroon())
+		})
+	})
+
+	t.Run("defensive", func(t *testing.T) {
+		bun, err := ParseBundle(permLoc, hdr, WithDefensiveCopies())
+		assert.NoError(t, err)
+
+		ForEach(bun, mutate)
+		assert.Equal(t, hdr, bun.Header())
+
+		cavs, err := bun.Verify(context.Background(), kr)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, len(cavs))
+		assert.Equal(t, 0, len(cavs[0].Caveats))
+
+		// verified macaroons are still protected
+		ForEach(bun, mutate)
+		assert.Equal(t, hdr, bun.Header())
+		ForEach(bun, func(m Macaroon) {
+			assert.Equal(t, 0, len(m.UnsafeCaveats().Caveats))
+		})
+
+		// as are tokens added later or in clones
+		assert.NoError(t, bun.AddTokens(macOpts{}.tokens(t).Header()))
+		clone := bun.Clone()
+		ForEach(clone, mutate)
+		assert.Equal(t, bun.Header(), clone.Header())
+	})
+}
+
+func TestSplitByLocation(t *testing.T) {
+	t.Parallel()
+
+	const otherLoc = "other-loc"
+
+	var (
+		perm  = macOpts{tpOpts: []tpOpt{{discharge: true}}}.tokens(t)
+		other = macOpts{loc: otherLoc, tpOpts: []tpOpt{{discharge: true}}}.tokens(t)
+
+		// a discharge for a ticket that isn't in the bundle
+		extra = macOpts{loc: "third-loc", tpOpts: []tpOpt{{discharge: true}}}.tokens(t)[1]
+	)
+
+	bun, err := ParseBundle(permLoc, tokens{perm[0], NonMacaroon("foo"), extra, perm[1]}.Header())
+	assert.NoError(t, err)
+	assert.NoError(t, bun.AddTokensWithSource("cookie", other.Header()))
+	hdr := bun.Header()
+
+	split := bun.SplitByLocation([]string{permLoc, otherLoc, "nowhere"})
+	assert.Equal(t, 3, len(split))
+	assert.Equal(t, perm.String(), split[permLoc].String())
+	assert.Equal(t, other.String(), split[otherLoc].String())
+	assert.True(t, split["nowhere"].IsEmpty())
+
+	assert.Equal(t, perm.Header(), bun.HeaderFor(permLoc))
+	assert.Equal(t, other.Header(), bun.HeaderFor(otherLoc))
+	assert.Equal(t, "", bun.HeaderFor("nowhere"))
+
+	// sub-bundles identify permission tokens by their location
+	assert.Equal(t, 1, split[otherLoc].Count(split[otherLoc].IsPermissionToken))
+
+	ForEach(split[otherLoc], func(m Macaroon) {
+		assert.Equal(t, "cookie", SourceOf(m))
+	})
+
+	t.Run("non-macaroons", func(t *testing.T) {
+		t.Parallel()
+
+		split := bun.SplitByLocation([]string{permLoc}, IncludeNonMacaroons())
+		assert.Equal(t, tokens{perm[0], NonMacaroon("foo"), perm[1]}.String(), split[permLoc].String())
+	})
+
+	t.Run("isolation", func(t *testing.T) {
+		t.Parallel()
+
+		split := bun.SplitByLocation([]string{permLoc, otherLoc})
+
+		ForEach(split[permLoc], func(m Macaroon) {
+			ForEach(bun, func(m2 Macaroon) {
+				assert.False(t, m.UnsafeMacaroon() == m2.UnsafeMacaroon())
+			})
+		})
+
+		assert.NoError(t, split[permLoc].Attenuate(&macaroon.ValidityWindow{NotBefore: 1, NotAfter: 2}))
+		assert.NotEqual(t, perm.String(), split[permLoc].String())
+		assert.Equal(t, other.String(), split[otherLoc].String())
+		assert.Equal(t, hdr, bun.Header())
+
+		cavs, err := split[otherLoc].Verify(context.Background(), WithKey(permKID, permKey, map[string][]macaroon.EncryptionKey{tpLoc: {tpKey}}))
+		assert.NoError(t, err)
+		assert.Equal(t, 1, len(cavs))
+		assert.Equal(t, hdr, bun.Header())
+	})
+}
+
+func TestExpiringDischarges(t *testing.T) {
+	t.Parallel()
+
+	const soonLoc = "soon-loc"
+
+	var (
+		soonKey = macaroon.NewEncryptionKey()
+		soon    = &macaroon.ValidityWindow{NotBefore: time.Now().Unix(), NotAfter: time.Now().Add(30 * time.Second).Unix()}
+		later   = &macaroon.ValidityWindow{NotBefore: time.Now().Unix(), NotAfter: time.Now().Add(time.Hour).Unix()}
+
+		toks = macOpts{tpOpts: []tpOpt{
+			{loc: soonLoc, key: soonKey, discharge: true, dcavs: []macaroon.Caveat{soon}},
+			{discharge: true, dcavs: []macaroon.Caveat{later}},
+			{loc: "undischarged"},
+		}}.tokens(t)
+
+		soonTicket = toks[0].(Macaroon).TicketsForThirdParty(soonLoc)[0]
+	)
+
+	bun, err := ParseBundle(permLoc, tokens{toks[0], toks[1], NonMacaroon("foo"), toks[2]}.Header())
+	assert.NoError(t, err)
+
+	// only discharges are considered
+	assert.NoError(t, bun.Attenuate(&macaroon.ValidityWindow{NotBefore: 1, NotAfter: time.Now().Add(time.Second).Unix()}))
+
+	assert.Equal(t, map[string][][]byte{}, bun.ExpiringDischarges(RefreshPolicy{}))
+	assert.Equal(t, map[string][][]byte{soonLoc: {soonTicket}}, bun.ExpiringDischarges(RefreshPolicy{ExpiringWithin: time.Minute}))
+
+	all := bun.ExpiringDischarges(RefreshPolicy{ExpiringWithin: 2 * time.Hour})
+	assert.Equal(t, 2, len(all))
+	assert.Equal(t, 1, len(all[tpLoc]))
+	assert.Equal(t, 0, len(all["undischarged"]))
+}
+
+func TestReplaceDischarge(t *testing.T) {
+	t.Parallel()
+
+	const soonLoc = "soon-loc"
+
+	var (
+		soonKey = macaroon.NewEncryptionKey()
+		soon    = &macaroon.ValidityWindow{NotBefore: time.Now().Unix(), NotAfter: time.Now().Add(30 * time.Second).Unix()}
+		later   = &macaroon.ValidityWindow{NotBefore: time.Now().Unix(), NotAfter: time.Now().Add(time.Hour).Unix()}
+
+		toks = macOpts{tpOpts: []tpOpt{
+			{loc: soonLoc, key: soonKey, discharge: true, dcavs: []macaroon.Caveat{soon}},
+			{discharge: true},
+		}}.tokens(t)
+
+		perm, oldDis, otherDis = toks[0], toks[1], toks[2]
+	)
+
+	_, dm, err := macaroon.DischargeTicket(soonKey, soonLoc, perm.(Macaroon).TicketsForThirdParty(soonLoc)[0])
+	assert.NoError(t, err)
+	assert.NoError(t, dm.Add(later))
+	newDis, err := dm.String()
+	assert.NoError(t, err)
+
+	parse := func(t *testing.T) *Bundle {
+		t.Helper()
+
+		bun, err := ParseBundle(permLoc, tokens{perm, NonMacaroon("foo")}.Header())
+		assert.NoError(t, err)
+		assert.NoError(t, bun.AddTokensWithSource("cookie", tokens{oldDis, otherDis}.Header()))
+
+		return bun
+	}
+
+	t.Run("replace", func(t *testing.T) {
+		t.Parallel()
+
+		bun := parse(t)
+		assert.NoError(t, bun.ReplaceDischarge(oldDis.String(), newDis))
+		assert.Equal(t, tokens{perm, NonMacaroon("foo"), &UnverifiedMacaroon{Str: newDis}, otherDis}.String(), bun.String())
+		assert.Equal(t, 0, len(bun.ExpiringDischarges(RefreshPolicy{ExpiringWithin: time.Minute})))
+		assert.Equal(t, 2, bun.Count(BySource("cookie")))
+
+		_, err := bun.Verify(context.Background(), WithKey(permKID, permKey, nil))
+		assert.NoError(t, err)
+	})
+
+	t.Run("remove", func(t *testing.T) {
+		t.Parallel()
+
+		bun := parse(t)
+		assert.NoError(t, bun.ReplaceDischarge(oldDis.String(), ""))
+		assert.Equal(t, tokens{perm, NonMacaroon("foo"), otherDis}.String(), bun.String())
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		t.Parallel()
+
+		bun := parse(t)
+		hdr := bun.Header()
+
+		assert.IsError(t, bun.ReplaceDischarge(newDis, newDis), ErrTokenNotFound)
+		assert.IsError(t, bun.ReplaceDischarge(perm.String(), newDis), ErrTokenNotFound)
+		assert.IsError(t, bun.ReplaceDischarge("foo", newDis), ErrTokenNotFound)
+		assert.Error(t, bun.ReplaceDischarge(oldDis.String(), "fm2_bad"))
+		assert.Error(t, bun.ReplaceDischarge(oldDis.String(), perm.String()))
+		assert.Equal(t, hdr, bun.Header())
+	})
+}
+
+func TestThirdPartyTicketsMemoized(t *testing.T) {
+	t.Parallel()
+
+	toks := macOpts{tpOpts: []tpOpt{
+		{loc: "b", discharge: true},
+		{loc: "a"},
+		{loc: "c", discharge: true},
+	}}.tokens(t)
+
+	var (
+		perm = toks[0].(*UnverifiedMacaroon)
+		mac  = perm.UnsafeMac
+	)
+
+	assert.Equal(t, mac.AllThirdPartyTickets(), perm.ThirdPartyTickets())
+	assert.Equal(t, mac.TicketsForThirdParty("a"), perm.TicketsForThirdParty("a"))
+	assert.Equal(t, 0, len(perm.TicketsForThirdParty("d")))
+	assert.NotZero(t, perm.tickets.Load())
+
+	t.Run("not exposed", func(t *testing.T) {
+		perm.ThirdPartyTickets()["a"][0][0] ^= 0xff
+		perm.TicketsForThirdParty("b")[0][0] ^= 0xff
+
+		assert.Equal(t, mac.AllThirdPartyTickets(), perm.ThirdPartyTickets())
+	})
+
+	t.Run("invalidated by attenuation", func(t *testing.T) {
+		toks := append(tokens{}, toks...)
+		assert.NoError(t, toks.Attenuate(isPerm, &macaroon.ValidityWindow{NotBefore: 1, NotAfter: 2}))
+		assert.Zero(t, perm.tickets.Load())
+		assert.NotEqual(t, mac, perm.UnsafeMac)
+
+		assert.Equal(t, mac.AllThirdPartyTickets(), perm.ThirdPartyTickets())
+		assert.Equal(t, 1, len(toks.Select(isMissingDischarge(isPerm, "a"))))
+		assert.Equal(t, 0, len(toks.Select(isMissingDischarge(isPerm, "b"))))
+	})
+
+	t.Run("not used for a different macaroon", func(t *testing.T) {
+		um := &UnverifiedMacaroon{UnsafeMac: mac}
+		assert.Equal(t, 3, len(um.thirdPartyTickets()))
+
+		mac2, err := mac.Clone()
+		assert.NoError(t, err)
+		assert.NoError(t, mac2.Add3P(tpKey, "d"))
+
+		um.UnsafeMac = mac2
+		assert.Equal(t, 1, len(um.TicketsForThirdParty("d")))
+	})
+}
+
+func TestThirdPartyLocations(t *testing.T) {
+	t.Parallel()
+
+	ifPresent := &resset.IfPresent{
+		Ifs:  macaroon.NewCaveatSet(&macaroon.ValidityWindow{NotBefore: 1, NotAfter: 2}),
+		Else: resset.ActionRead,
+	}
+
+	toks := macOpts{
+		cavs: []macaroon.Caveat{ifPresent},
+		tpOpts: []tpOpt{
+			{loc: "b", discharge: true},
+			{loc: "a"},
+		},
+	}.tokens(t)
+
+	perm := toks[0].(*UnverifiedMacaroon)
+	assert.Equal(t, []string{"a", "b"}, perm.ThirdPartyLocations())
+	assert.Equal(t, perm.UnsafeMac.ThirdPartyLocations(), perm.ThirdPartyLocations())
+	assert.True(t, perm.HasThirdParty("a"))
+	assert.False(t, perm.HasThirdParty("c"))
+	assert.Equal(t, []macaroon.CaveatType{macaroon.CavValidityWindow, macaroon.Cav3P, macaroon.CavIfPresent}, perm.CaveatTypes())
+
+	dis := toks[1].(*UnverifiedMacaroon)
+	assert.Equal(t, 0, len(dis.ThirdPartyLocations()))
+	assert.False(t, dis.HasThirdParty("a"))
+}
+
+func BenchmarkFilters(b *testing.B) {
+	// 10 permission tokens, each with two discharged third-party caveats and
+	// one undischarged one.
+	var toks tokens
+	for i := 0; i < 10; i++ {
+		toks = append(toks, macOpts{tpOpts: []tpOpt{
+			{loc: "a", discharge: true},
+			{loc: "b", discharge: true},
+			{loc: "c"},
+		}}.tokens(b)...)
+	}
+
+	assert.Equal(b, 30, len(toks))
+
+	bun, err := ParseBundle(permLoc, toks.Header())
+	assert.NoError(b, err)
+
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		bun.Select(DefaultFilter(isPerm))
+		bun.Any(isMissingDischarge(isPerm, "c"))
+		bun.Select(withDischarges(isPerm, hasCaveat(&macaroon.ValidityWindow{})))
+		bun.UndischargedThirdPartyTickets()
+	}
+}
+
+// BenchmarkAttenuateLockHold measures how long attenuating a 40-token Bundle
+// holds its write lock, blocking other goroutines. The time per op is the
+// lock hold time: Attenuate used to hold the lock for the whole attenuation,
+// while AttenuateCtx only holds it to swap in the attenuated macaroons.
+func BenchmarkAttenuateLockHold(b *testing.B) {
+	var toks tokens
+	for i := 0; i < 40; i++ {
+		toks = append(toks, macOpts{tpOpts: []tpOpt{{discharge: true}}}.tokens(b)...)
+	}
+
+	orig, err := ParseBundle(permLoc, toks.Header())
+	assert.NoError(b, err)
+
+	var (
+		cav   = &macaroon.ValidityWindow{NotBefore: 1, NotAfter: 2}
+		clone = func(b *testing.B) *Bundle {
+			b.Helper()
+
+			bun := orig.Clone()
+			_, err := bun.Verify(context.Background(), WithKey(permKID, permKey, nil))
+			assert.NoError(b, err)
+
+			return bun
+		}
+	)
+
+	b.Run("whole attenuation", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			b.StopTimer()
+			bun := clone(b)
+			b.StartTimer()
+
+			bun.m.Lock()
+			bun.mutated()
+			err := bun.ts.Attenuate(bun.IsPermissionToken, cav)
+			bun.m.Unlock()
+			assert.NoError(b, err)
+		}
+	})
+
+	b.Run("AttenuateCtx commit", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			b.StopTimer()
+			bun := clone(b)
+			at := bun.ts.attenuationTargets(bun.IsPermissionToken)
+			assert.NoError(b, at.stage(context.Background(), cav))
+			b.StartTimer()
+
+			assert.True(b, bun.commit(bun.m.version, at.apply))
+		}
+	})
 }
 
 func hasCaveat(c macaroon.Caveat) Predicate {
@@ -434,7 +1579,7 @@ func hasCaveat(c macaroon.Caveat) Predicate {
 
 func cavsHasCaveat(cavs []macaroon.Caveat, caveat macaroon.Caveat) bool {
 	for _, c := range cavs {
-		if c == caveat || reflect.DeepEqual(c, caveat) {
+		if macaroon.EqualCaveat(c, caveat) {
 			return true
 		}
 	}
@@ -0,0 +1,253 @@
+package bundle
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"github.com/superfly/macaroon"
+)
+
+// BundleDiff describes the differences between two Bundles. See Diff. It
+// doesn't contain the tokens themselves, which are secrets, so it is safe to
+// log.
+type BundleDiff struct {
+	// Added are tokens in the second Bundle but not the first.
+	Added []*DiffToken `json:"added"`
+
+	// Removed are tokens in the first Bundle but not the second.
+	Removed []*DiffToken `json:"removed"`
+
+	// Modified are macaroons with the same nonce UUID in both Bundles, but
+	// that are otherwise different (e.g. because they were attenuated).
+	Modified []*ModifiedToken `json:"modified"`
+}
+
+// DiffToken identifies a token in a BundleDiff.
+type DiffToken struct {
+	// UUID is the UUID of the macaroon's nonce. It is empty for tokens that
+	// aren't macaroons.
+	UUID string `json:"uuid,omitempty"`
+
+	// Location is the macaroon's location.
+	Location string `json:"location,omitempty"`
+
+	// Permission is whether the token is a permission token, according to
+	// its Bundle's IsPermissionToken.
+	Permission bool `json:"permission"`
+
+	// Digest is a prefix of the SHA256 digest of the token's string,
+	// distinguishing tokens without revealing them.
+	Digest string `json:"digest"`
+}
+
+// ModifiedToken describes a macaroon that changed between two Bundles.
+type ModifiedToken struct {
+	Before *DiffToken `json:"before"`
+	After  *DiffToken `json:"after"`
+
+	// AddedCaveats are caveats in the macaroon after but not before.
+	AddedCaveats *macaroon.CaveatSet `json:"added_caveats"`
+
+	// RemovedCaveats are caveats in the macaroon before but not after.
+	RemovedCaveats *macaroon.CaveatSet `json:"removed_caveats"`
+}
+
+// Diff describes how after differs from before, e.g. to debug middleware
+// that modifies Authorization headers. Macaroons are matched by nonce UUID
+// and other tokens by their string. Discharges have a new nonce each time
+// they're issued, so refreshed discharges are reported as removed and added.
+// The order of tokens is disregarded.
+func Diff(before, after *Bundle) *BundleDiff {
+	var (
+		ret = &BundleDiff{
+			Added:    []*DiffToken{},
+			Removed:  []*DiffToken{},
+			Modified: []*ModifiedToken{},
+		}
+		bts      = before.snapshot()
+		ats      = after.snapshot()
+		byKey    = map[string][]Token{}
+		unpaired = make(map[Token]bool, len(bts))
+	)
+
+	for _, t := range bts {
+		byKey[diffKey(t)] = append(byKey[diffKey(t)], t)
+		unpaired[t] = true
+	}
+
+	// identical tokens are paired first, so that duplicates don't show up as
+	// modifications.
+	var rest []Token
+	for _, at := range ats {
+		if bt := takeMatch(byKey, at, true); bt != nil {
+			delete(unpaired, bt)
+			continue
+		}
+		rest = append(rest, at)
+	}
+
+	for _, at := range rest {
+		bt := takeMatch(byKey, at, false)
+		if bt == nil {
+			ret.Added = append(ret.Added, newDiffToken(after, at))
+			continue
+		}
+
+		delete(unpaired, bt)
+		ret.Modified = append(ret.Modified, newModifiedToken(before, after, bt.(Macaroon), at.(Macaroon)))
+	}
+
+	for _, bt := range bts {
+		if unpaired[bt] {
+			ret.Removed = append(ret.Removed, newDiffToken(before, bt))
+		}
+	}
+
+	return ret
+}
+
+// IsEmpty returns whether the Bundles were the same, disregarding order.
+func (d *BundleDiff) IsEmpty() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Modified) == 0
+}
+
+// String describes the differences, one per line.
+func (d *BundleDiff) String() string {
+	if d.IsEmpty() {
+		return "no changes"
+	}
+
+	var lines []string
+
+	for _, t := range d.Added {
+		lines = append(lines, "added "+t.String())
+	}
+
+	for _, t := range d.Removed {
+		lines = append(lines, "removed "+t.String())
+	}
+
+	for _, mt := range d.Modified {
+		lines = append(lines, "modified "+mt.After.String())
+
+		for _, c := range mt.AddedCaveats.Caveats {
+			lines = append(lines, "  + "+macaroon.DescribeCaveat(c))
+		}
+
+		for _, c := range mt.RemovedCaveats.Caveats {
+			lines = append(lines, "  - "+macaroon.DescribeCaveat(c))
+		}
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// String describes the token.
+func (t *DiffToken) String() string {
+	switch {
+	case t.UUID == "":
+		return fmt.Sprintf("non-macaroon token %s", t.Digest)
+	case t.Permission:
+		return fmt.Sprintf("permission token %s (%s)", t.UUID, t.Location)
+	default:
+		return fmt.Sprintf("discharge token %s (%s)", t.UUID, t.Location)
+	}
+}
+
+func (b *Bundle) snapshot() tokens {
+	b.m.RLock()
+	defer b.m.RUnlock()
+
+	b.checkInvariants()
+
+	return append(tokens{}, b.ts...)
+}
+
+// diffKey is the key that tokens are matched by in Diff.
+func diffKey(t Token) string {
+	if m, ok := t.(Macaroon); ok {
+		return "uuid:" + m.Nonce().UUID().String()
+	}
+
+	return "str:" + t.String()
+}
+
+// takeMatch removes and returns a token from byKey matching t, or nil if there
+// isn't one. If exact is set, the token's string must also match.
+func takeMatch(byKey map[string][]Token, t Token, exact bool) Token {
+	key := diffKey(t)
+	candidates := byKey[key]
+
+	for i, c := range candidates {
+		if exact && c.String() != t.String() {
+			continue
+		}
+
+		byKey[key] = append(candidates[:i:i], candidates[i+1:]...)
+		return c
+	}
+
+	return nil
+}
+
+func newDiffToken(b *Bundle, t Token) *DiffToken {
+	d := sha256.Sum256([]byte(t.String()))
+
+	dt := &DiffToken{
+		Permission: b.IsPermissionToken(t),
+		Digest:     hex.EncodeToString(d[:8]),
+	}
+
+	if m, ok := t.(Macaroon); ok {
+		dt.UUID = m.Nonce().UUID().String()
+		dt.Location = m.Location()
+	}
+
+	return dt
+}
+
+func newModifiedToken(before, after *Bundle, bm, am Macaroon) *ModifiedToken {
+	bcavs, acavs := bm.UnsafeCaveats().Caveats, am.UnsafeCaveats().Caveats
+
+	return &ModifiedToken{
+		Before:         newDiffToken(before, bm),
+		After:          newDiffToken(after, am),
+		AddedCaveats:   caveatDifference(acavs, bcavs),
+		RemovedCaveats: caveatDifference(bcavs, acavs),
+	}
+}
+
+// caveatDifference returns the caveats in a that aren't in b, comparing their
+// encodings. Repeated caveats are counted.
+func caveatDifference(a, b []macaroon.Caveat) *macaroon.CaveatSet {
+	counts := make(map[string]int, len(b))
+	for _, c := range b {
+		counts[caveatEncoding(c)]++
+	}
+
+	ret := macaroon.NewCaveatSet()
+	for _, c := range a {
+		enc := caveatEncoding(c)
+		if counts[enc] > 0 {
+			counts[enc]--
+			continue
+		}
+
+		ret.Caveats = append(ret.Caveats, c)
+	}
+
+	return ret
+}
+
+func caveatEncoding(c macaroon.Caveat) string {
+	enc, err := macaroon.NewCaveatSet(c).MarshalMsgpack()
+	if err != nil {
+		// shouldn't happen for caveats from decoded macaroons. fall back to
+		// treating every such caveat as distinct.
+		return fmt.Sprintf("unencodable:%p", c)
+	}
+
+	return string(enc)
+}
@@ -0,0 +1,103 @@
+package bundle
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alecthomas/assert/v2"
+	"github.com/superfly/macaroon"
+)
+
+func TestDiff(t *testing.T) {
+	t.Parallel()
+
+	var (
+		toks = macOpts{tpOpts: []tpOpt{{discharge: true}}}.tokens(t)
+		junk = NonMacaroon("junk")
+	)
+
+	parse := func(tb testing.TB, ts ...Token) *Bundle {
+		tb.Helper()
+
+		bun, err := ParseBundleWithFilter(permLoc, Header(ts...), KeepAll)
+		assert.NoError(tb, err)
+		return bun
+	}
+
+	t.Run("reordering", func(t *testing.T) {
+		t.Parallel()
+
+		d := Diff(parse(t, toks[0], toks[1], junk), parse(t, junk, toks[1], toks[0]))
+		assert.True(t, d.IsEmpty())
+		assert.Equal(t, "no changes", d.String())
+	})
+
+	t.Run("attenuation", func(t *testing.T) {
+		t.Parallel()
+
+		expiry := &macaroon.ValidityWindow{NotBefore: 1, NotAfter: time.Now().Add(time.Hour).Unix()}
+
+		before := parse(t, toks...)
+		after := parse(t, toks...)
+		assert.NoError(t, after.Attenuate(expiry))
+
+		d := Diff(before, after)
+		assert.Equal(t, 0, len(d.Added))
+		assert.Equal(t, 0, len(d.Removed))
+		assert.Equal(t, 1, len(d.Modified))
+
+		mt := d.Modified[0]
+		assert.True(t, mt.After.Permission)
+		assert.Equal(t, mt.Before.UUID, mt.After.UUID)
+		assert.NotEqual(t, mt.Before.Digest, mt.After.Digest)
+		assert.Equal(t, []macaroon.Caveat{expiry}, mt.AddedCaveats.Caveats)
+		assert.Equal(t, 0, len(mt.RemovedCaveats.Caveats))
+
+		assert.True(t, strings.HasPrefix(d.String(), "modified permission token "+mt.After.UUID))
+		assert.Contains(t, d.String(), "  + "+macaroon.DescribeCaveat(expiry))
+
+		buf, err := json.Marshal(d)
+		assert.NoError(t, err)
+		assert.NotContains(t, string(buf), toks[0].String())
+	})
+
+	t.Run("discharge refresh", func(t *testing.T) {
+		t.Parallel()
+
+		perm := toks[0].(*UnverifiedMacaroon)
+		ticket := perm.TicketsForThirdParty(tpLoc)[0]
+
+		_, dm, err := macaroon.DischargeTicket(tpKey, tpLoc, ticket)
+		assert.NoError(t, err)
+		dmStr, err := dm.String()
+		assert.NoError(t, err)
+		refreshed := &UnverifiedMacaroon{UnsafeMac: dm, Str: dmStr}
+
+		d := Diff(parse(t, toks...), parse(t, perm, refreshed))
+		assert.Equal(t, 0, len(d.Modified))
+		assert.Equal(t, 1, len(d.Added))
+		assert.Equal(t, 1, len(d.Removed))
+
+		assert.False(t, d.Added[0].Permission)
+		assert.Equal(t, tpLoc, d.Added[0].Location)
+		assert.Equal(t, tpLoc, d.Removed[0].Location)
+		assert.NotEqual(t, d.Added[0].UUID, d.Removed[0].UUID)
+
+		assert.Equal(t, strings.Join([]string{
+			"added discharge token " + d.Added[0].UUID + " (" + tpLoc + ")",
+			"removed discharge token " + d.Removed[0].UUID + " (" + tpLoc + ")",
+		}, "\n"), d.String())
+	})
+
+	t.Run("non-macaroons", func(t *testing.T) {
+		t.Parallel()
+
+		d := Diff(parse(t, toks[0], junk), parse(t, toks[0], junk, junk, NonMacaroon("other")))
+		assert.Equal(t, 2, len(d.Added))
+		assert.Equal(t, 0, len(d.Removed))
+		assert.Equal(t, "", d.Added[0].UUID)
+		assert.True(t, strings.HasPrefix(d.String(), "added non-macaroon token "))
+	})
+}
@@ -0,0 +1,147 @@
+package bundle
+
+import "strings"
+
+// Named returns a Filter that behaves like f, but whose decisions are reported
+// under name by Bundle.Explain. Named filters may be nested within each other
+// and within the combinators in this package (And, Or, Not, Xor, Difference,
+// Bundle.WithDischarges, etc.), in which case their names are joined with "/".
+// If f is a Predicate, the returned Filter is also a Predicate. See
+// NamedPredicate.
+func Named(name string, f Filter) Filter {
+	if p, ok := f.(Predicate); ok {
+		return NamedPredicate(name, p)
+	}
+
+	return &namedFilter{name: name, Filter: f}
+}
+
+// NamedPredicate is like Named, but returns a Predicate so that it can be
+// passed to And, Or, Not, and Xor.
+func NamedPredicate(name string, p Predicate) Predicate {
+	return func(t Token) bool {
+		if probe, ok := t.(*explainProbe); ok {
+			probe.visit(name, p)
+			return false
+		}
+
+		return p(t)
+	}
+}
+
+type namedFilter struct {
+	name string
+	Filter
+}
+
+// String returns the filter's name.
+func (f *namedFilter) String() string {
+	return f.name
+}
+
+// TokenDecision describes how a Filter passed to Bundle.Explain treated a
+// single token.
+type TokenDecision struct {
+	// Token is the token.
+	Token Token
+
+	// Selected is whether the Filter selected the token.
+	Selected bool
+
+	// Filters has an entry for each named filter within the Filter, in the
+	// order they were found.
+	Filters []FilterDecision
+}
+
+// FilterDecision describes whether a named filter selected a token.
+type FilterDecision struct {
+	// Name is the filter's name, prefixed by the names of any named filters
+	// it's nested within, separated by "/".
+	Name string
+
+	// Selected is whether the named filter selected the token.
+	Selected bool
+}
+
+// Explain reports, for each token in the Bundle, whether f selects it and
+// whether each of the named filters within f (see Named) selects it. This is
+// intended for debugging and logging complex filters.
+//
+// Each named filter is evaluated on its own against the whole Bundle, so
+// decisions are reported even for filters f wouldn't have needed to evaluate
+// (e.g. because And short-circuited). Custom Predicates within f may be called
+// with an unexported Token type while Explain is looking for named filters and
+// should return false for Tokens they don't recognize.
+func (b *Bundle) Explain(f Filter) []TokenDecision {
+	b.m.RLock()
+	defer b.m.RUnlock()
+
+	b.checkInvariants()
+
+	probe := new(explainProbe)
+	probe.discover(f)
+
+	selected := filterPredicate(f, b.ts)
+	nodeSelected := make([]Predicate, len(probe.nodes))
+	for i, n := range probe.nodes {
+		nodeSelected[i] = filterPredicate(n.f, b.ts)
+	}
+
+	ret := make([]TokenDecision, 0, len(b.ts))
+	for _, t := range b.ts {
+		td := TokenDecision{
+			Token:    t,
+			Selected: selected(t),
+			Filters:  make([]FilterDecision, 0, len(probe.nodes)),
+		}
+
+		for i, n := range probe.nodes {
+			td.Filters = append(td.Filters, FilterDecision{
+				Name:     n.name,
+				Selected: nodeSelected[i](t),
+			})
+		}
+
+		ret = append(ret, td)
+	}
+
+	return ret
+}
+
+// explainProbe is a fake Token that Bundle.Explain passes to Predicates to find
+// the named filters within them. Combinators pass it along to each of their
+// children, without short-circuiting.
+type explainProbe struct {
+	path  []string
+	nodes []explainNode
+}
+
+type explainNode struct {
+	name string
+	f    Filter
+}
+
+var _ Token = (*explainProbe)(nil)
+
+func (p *explainProbe) String() string { return "" }
+func (p *explainProbe) isToken()       {}
+
+func (p *explainProbe) visit(name string, f Filter) {
+	p.path = append(p.path, name)
+	p.nodes = append(p.nodes, explainNode{name: strings.Join(p.path, "/"), f: f})
+	p.discover(f)
+	p.path = p.path[:len(p.path)-1]
+}
+
+func (p *explainProbe) discover(f Filter) {
+	switch ff := f.(type) {
+	case *namedFilter:
+		p.visit(ff.name, ff.Filter)
+	case *composedFilter:
+		for _, c := range ff.children {
+			p.discover(c)
+		}
+	case Predicate:
+		ff(p)
+	}
+}
@@ -17,10 +17,21 @@ func (f filterFunc) Apply(ts []Token) []Token {
 	return f(ts)
 }
 
+// composedFilter is a Filter built from other Filters. The children are
+// recorded so that Bundle.Explain can find named filters within them.
+type composedFilter struct {
+	Filter
+	children []Filter
+}
+
+func compose(f Filter, children ...Filter) Filter {
+	return &composedFilter{Filter: f, children: children}
+}
+
 // DefaultFilter rejects malformed macaroons and discharge tokens that aren't
 // associated with any permission token.
 func DefaultFilter(isPerm Predicate) Filter {
-	return filterFunc(func(ts []Token) []Token {
+	return compose(filterFunc(func(ts []Token) []Token {
 		pbd := tokens(ts).permissionsByDischarge(isPerm)
 
 		notExtraneous := MacaroonPredicate(func(t Macaroon) bool {
@@ -32,16 +43,16 @@ func DefaultFilter(isPerm Predicate) Filter {
 			isPerm,
 			notExtraneous,
 		).Apply(ts)
-	})
+	}), isPerm)
 }
 
 func isMissingDischarge(isPerm Predicate, tpLocation string) Filter {
-	return filterFunc(func(ts []Token) []Token {
+	return compose(filterFunc(func(ts []Token) []Token {
 		dbt, _, _ := tokens(ts).dischargesByTicket(isPerm)
 
 		pred := And(isPerm, MacaroonPredicate(func(m Macaroon) bool {
-			for _, ticket := range m.TicketsForThirdParty(tpLocation) {
-				if len(dbt[string(ticket)]) == 0 {
+			for _, tpt := range ticketsForLocation(m.Unverified().thirdPartyTickets(), tpLocation) {
+				if len(dbt[string(tpt.ticket)]) == 0 {
 					return true
 				}
 			}
@@ -50,11 +61,11 @@ func isMissingDischarge(isPerm Predicate, tpLocation string) Filter {
 		}))
 
 		return pred.Apply(ts)
-	})
+	}), isPerm)
 }
 
 func withDischarges(isPerm Predicate, f Filter) Filter {
-	return filterFunc(func(ts []Token) []Token {
+	return compose(filterFunc(func(ts []Token) []Token {
 		fPred := filterPredicate(f, ts)
 		pbd := tokens(ts).permissionsByDischarge(isPerm)
 
@@ -69,7 +80,18 @@ func withDischarges(isPerm Predicate, f Filter) Filter {
 		}))
 
 		return pred.Apply(ts)
-	})
+	}), isPerm, f)
+}
+
+// Difference returns a Filter selecting tokens that are selected by a but not
+// by b.
+func Difference(a, b Filter) Filter {
+	return compose(filterFunc(func(ts []Token) []Token {
+		inA := filterPredicate(a, ts)
+		inB := filterPredicate(b, ts)
+
+		return And(inA, Not(inB)).Apply(ts)
+	}), a, b)
 }
 
 func filterPredicate(f Filter, ts tokens) Predicate {
@@ -90,7 +112,10 @@ type Predicate func(Token) bool
 // TypedPredicate returns a Predicate for a function operating on a concrete
 // Token type.
 func TypedPredicate[T Token](p func(T) bool) Predicate {
-	return And(isType[T], func(t Token) bool { return p(t.(T)) })
+	return func(t Token) bool {
+		tt, ok := t.(T)
+		return ok && p(tt)
+	}
 }
 
 // HasCaveat returns a Predicate that selects Tokens with caveats of the given
@@ -103,9 +128,25 @@ func HasCaveat[C macaroon.Caveat](t Token) bool {
 	return false
 }
 
+// BySource returns a Predicate that selects Tokens with the given source. See
+// SourceOf.
+func BySource(source string) Predicate {
+	return Predicate(func(t Token) bool {
+		return SourceOf(t) == source
+	})
+}
+
 // And returns a Predicate requiring all of ps to be true.
 func And(ps ...Predicate) Predicate {
 	return func(t Token) bool {
+		// don't short-circuit while looking for named filters
+		if probe, ok := t.(*explainProbe); ok {
+			for _, p := range ps {
+				probe.discover(p)
+			}
+			return false
+		}
+
 		for _, p := range ps {
 			if !p(t) {
 				return false
@@ -119,6 +160,13 @@ func And(ps ...Predicate) Predicate {
 // Or returns a Predicate requiring one of ps to be true.
 func Or(ps ...Predicate) Predicate {
 	return func(t Token) bool {
+		if probe, ok := t.(*explainProbe); ok {
+			for _, p := range ps {
+				probe.discover(p)
+			}
+			return false
+		}
+
 		for _, p := range ps {
 			if p(t) {
 				return true
@@ -132,15 +180,28 @@ func Or(ps ...Predicate) Predicate {
 // Not returns a Predicate requiring the opposite of p.
 func Not(p Predicate) Predicate {
 	return func(t Token) bool {
+		if probe, ok := t.(*explainProbe); ok {
+			probe.discover(p)
+			return false
+		}
+
 		return !p(t)
 	}
 }
 
+// Xor returns a Predicate requiring exactly one of a and b to be true.
+func Xor(a, b Predicate) Predicate {
+	return func(t Token) bool {
+		return a(t) != b(t)
+	}
+}
+
 // AllowsAccess returns a Predicate that selects verified macaroons allowing the
-// given accesses.
+// given accesses. Unlike Bundle's validation methods, it doesn't fill in the
+// location configured with WithVerifierLocation.
 func AllowsAccess(accesses ...macaroon.Access) Predicate {
 	return VerifiedMacaroonPredicate(func(vm *VerifiedMacaroon) bool {
-		return vm.Caveats.Validate(accesses...) == nil
+		return vm.Caveats.ValidateFailFast(accesses...) == nil
 	})
 }
 
@@ -203,3 +264,17 @@ func (l LocationFilter) Predicate() Predicate {
 		return m.Location() == string(l)
 	})
 }
+
+// PrefixPredicate returns a Predicate that selects macaroons encoded with one
+// of the given prefixes (e.g. PrefixDischarge).
+func PrefixPredicate(prefixes ...string) Predicate {
+	return MacaroonPredicate(func(m Macaroon) bool {
+		pfx := m.Unverified().Prefix()
+		for _, p := range prefixes {
+			if pfx == p {
+				return true
+			}
+		}
+		return false
+	})
+}
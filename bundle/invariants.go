@@ -0,0 +1,143 @@
+package bundle
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// EnableInvariantChecks turns on checks for common misuse of Bundles. It is
+// intended for development and tests and should be called before any Bundles
+// are created (e.g. from TestMain). With checks enabled, Bundle methods panic
+// with an error wrapping ErrInvariantViolation when they detect that
+//
+//   - a Bundle returned by Select is used after the Bundle it was selected from
+//     (or another Bundle selected from the same one) was modified. Select
+//     returns a snapshot, so modifications like Verify aren't reflected in it.
+//   - a Filter passed to Select or Filter returns a Token that wasn't handed to
+//     it, such as one retained from an earlier call to ForEach or Map that has
+//     since been replaced by verification.
+//   - a Macaroon's Str no longer matches its UnsafeMac, meaning the
+//     macaroon.Macaroon was modified directly.
+//
+// Checking is expensive, re-encoding every token on every method call. When
+// checks are disabled, the only cost is testing a flag.
+func EnableInvariantChecks() {
+	invariantChecks = true
+}
+
+var invariantChecks = false
+
+// ErrInvariantViolation is wrapped by the errors Bundle methods panic with
+// when misuse is detected. See EnableInvariantChecks.
+var ErrInvariantViolation = errors.New("bundle invariant violated")
+
+// bundleState is shared by a Bundle and the Bundles selected from it.
+type bundleState struct {
+	sync.RWMutex
+
+	// gen is incremented every time the tokens of any of the Bundles sharing
+	// this state are modified. It is only maintained when invariant checks
+	// are enabled.
+	gen uint64
+
+	// version is like gen, but is always maintained. Methods that prepare
+	// changes without holding the write lock (e.g. AttenuateCtx) use it to
+	// check that the tokens weren't modified in the meantime.
+	version uint64
+}
+
+// mutated records a modification of the Bundle's tokens, making other Bundles
+// sharing its state stale. It must be called with the write lock held.
+func (b *Bundle) mutated() {
+	b.m.version++
+
+	if !invariantChecks {
+		return
+	}
+
+	b.m.gen++
+	b.gen = b.m.gen
+}
+
+// checkInvariants panics if the Bundle is stale or if any of its macaroons has
+// been modified directly. It must be called with the lock held.
+func (b *Bundle) checkInvariants() {
+	if !invariantChecks {
+		return
+	}
+
+	if b.gen != b.m.gen {
+		invariantViolation("Bundle from generation %d used at generation %d: Bundles returned by Select must not be used after the Bundle they were selected from is modified", b.gen, b.m.gen)
+	}
+
+	for _, t := range b.ts {
+		m, ok := t.(Macaroon)
+		if !ok {
+			continue
+		}
+
+		um := m.Unverified()
+		uuid := um.UnsafeMac.Nonce.UUID()
+
+		str, err := um.UnsafeMac.String()
+		if err != nil {
+			invariantViolation("token %s: encode UnsafeMac: %s", uuid, err)
+		}
+
+		_, want, _ := strings.Cut(str, pfxDelim)
+		if _, got, _ := strings.Cut(um.Str, pfxDelim); got != want {
+			invariantViolation("token %s: Str doesn't match UnsafeMac: the macaroon.Macaroon must not be modified directly", uuid)
+		}
+	}
+}
+
+// handOut stamps the macaroons in ts with the Bundle's generation before they
+// are passed to callers.
+func (b *Bundle) handOut(ts []Token) {
+	if !invariantChecks {
+		return
+	}
+
+	for _, t := range ts {
+		if m, ok := t.(Macaroon); ok {
+			m.Unverified().gen.Store(b.m.gen)
+		}
+	}
+}
+
+// checkReturned panics if any of the macaroons returned by a Filter weren't
+// handed to it from the Bundle's current tokens. It must be called with the
+// lock held.
+func (b *Bundle) checkReturned(ret []Token) {
+	if !invariantChecks {
+		return
+	}
+
+	current := make(map[Token]bool, len(b.ts))
+	for _, t := range b.ts {
+		current[t] = true
+	}
+
+	for _, t := range ret {
+		m, ok := t.(Macaroon)
+		if !ok {
+			continue
+		}
+
+		uuid := m.Unverified().UnsafeMac.Nonce.UUID()
+
+		if gen := m.Unverified().gen.Load(); gen != b.m.gen {
+			invariantViolation("token %s from generation %d returned by Filter at generation %d: Tokens must not be retained across modifications of their Bundle", uuid, gen, b.m.gen)
+		}
+
+		if !current[t] {
+			invariantViolation("token %s (%T) returned by Filter isn't in the Bundle: it may have been replaced by verification", uuid, t)
+		}
+	}
+}
+
+func invariantViolation(format string, args ...any) {
+	panic(fmt.Errorf("%w: %s", ErrInvariantViolation, fmt.Sprintf(format, args...)))
+}
@@ -0,0 +1,150 @@
+package bundle
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alecthomas/assert/v2"
+	"github.com/superfly/macaroon"
+)
+
+// tests in this file toggle a global, so they mustn't be run in parallel.
+
+func TestInvariantChecks(t *testing.T) {
+	var (
+		ctx    = context.Background()
+		now    = time.Now()
+		access = testAccess(now)
+		kr     = WithKey(permKID, permKey, map[string][]macaroon.EncryptionKey{tpLoc: {tpKey}})
+		hdr    = macOpts{tpOpts: []tpOpt{{discharge: true}}}.tokens(t).Header()
+		cav    = &macaroon.ValidityWindow{NotBefore: now.Add(-time.Hour).Unix(), NotAfter: now.Add(time.Hour).Unix()}
+	)
+
+	parse := func(t *testing.T) *Bundle {
+		t.Helper()
+
+		bun, err := ParseBundle(permLoc, hdr)
+		assert.NoError(t, err)
+
+		return bun
+	}
+
+	t.Run("disabled", func(t *testing.T) {
+		bun := parse(t)
+		sel := bun.Select(bun.IsPermissionToken)
+
+		_, err := bun.Verify(ctx, kr)
+		assert.NoError(t, err)
+
+		// the stale Bundle silently has no verified tokens
+		assert.Error(t, sel.Validate(access))
+	})
+
+	enableInvariantChecks(t)
+
+	t.Run("normal use", func(t *testing.T) {
+		bun := parse(t)
+
+		ids := Map(bun.Select(bun.IsPermissionToken), func(m Macaroon) string { return m.Nonce().UUID().String() })
+		assert.Equal(t, 1, len(ids))
+
+		_, err := bun.Verify(ctx, kr)
+		assert.NoError(t, err)
+		assert.NoError(t, bun.Validate(access))
+
+		assert.NoError(t, bun.Attenuate(cav))
+		assert.NoError(t, bun.Validate(access))
+		assert.Equal(t, 1, bun.Select(IsVerifiedMacaroon).Len())
+
+		bun.Filter(bun.WithDischarges(IsVerifiedMacaroon))
+		assert.Equal(t, 2, bun.Len())
+
+		ForEach(bun, func(m Macaroon) { assert.NotZero(t, m.UnsafeCaveats()) })
+		assert.Equal(t, bun.Header(), bun.Clone().Header())
+
+		authz, err := parse(t).Authorize(ctx, kr, access)
+		assert.NoError(t, err)
+		assert.Equal(t, Allowed, authz.Decision)
+	})
+
+	t.Run("stale Select", func(t *testing.T) {
+		bun := parse(t)
+		sel := bun.Select(bun.IsPermissionToken)
+
+		_, err := bun.Verify(ctx, kr)
+		assert.NoError(t, err)
+
+		assertInvariantViolation(t, "Bundles returned by Select must not be used", func() { sel.Validate(access) })
+
+		// modifying the selected Bundle makes the original stale
+		sel = bun.Select(bun.IsPermissionToken)
+		assert.NoError(t, sel.Attenuate(cav))
+		assertInvariantViolation(t, "Bundles returned by Select must not be used", func() { bun.Header() })
+	})
+
+	t.Run("retained token", func(t *testing.T) {
+		bun := parse(t)
+
+		var retained Macaroon
+		ForEach(bun, func(m Macaroon) {
+			if bun.IsPermissionToken(m) {
+				retained = m
+			}
+		})
+
+		_, err := bun.Verify(ctx, kr)
+		assert.NoError(t, err)
+
+		keepRetained := filterFunc(func([]Token) []Token { return []Token{retained} })
+		assertInvariantViolation(t, "returned by Filter isn't in the Bundle", func() { bun.Filter(keepRetained) })
+	})
+
+	t.Run("token from another generation", func(t *testing.T) {
+		var (
+			bun   = parse(t)
+			other = parse(t)
+		)
+
+		var foreign Macaroon
+		ForEach(other, func(m Macaroon) { foreign = m })
+
+		_, err := bun.Verify(ctx, kr)
+		assert.NoError(t, err)
+
+		keepForeign := filterFunc(func([]Token) []Token { return []Token{foreign} })
+		assertInvariantViolation(t, "from generation 0 returned by Filter at generation 1", func() { bun.Select(keepForeign) })
+	})
+
+	t.Run("modified UnsafeMac", func(t *testing.T) {
+		bun := parse(t)
+
+		ForEach(bun, func(m Macaroon) {
+			if bun.IsPermissionToken(m) {
+				assert.NoError(t, m.UnsafeMacaroon().Add(cav))
+			}
+		})
+
+		assertInvariantViolation(t, "Str doesn't match UnsafeMac", func() { bun.Validate(access) })
+	})
+}
+
+func enableInvariantChecks(tb testing.TB) {
+	invariantChecks = true
+	tb.Cleanup(func() { invariantChecks = false })
+}
+
+func assertInvariantViolation(tb testing.TB, contains string, fn func()) {
+	tb.Helper()
+
+	defer func() {
+		tb.Helper()
+
+		err, ok := recover().(error)
+		assert.True(tb, ok, "expected panic")
+		assert.IsError(tb, err, ErrInvariantViolation)
+		assert.Contains(tb, err.Error(), contains)
+	}()
+
+	fn()
+}
@@ -0,0 +1,157 @@
+package bundle
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/superfly/macaroon"
+)
+
+// StreamingVerifier returns a Verifier that verifies each permission token
+// with a separate, concurrent call to inner and collects results as they
+// arrive. If ctx is done before every call has returned, the results that
+// have arrived are returned and the remaining tokens are omitted, leaving
+// them unverified. Use it with Bundle.VerifyPartial to make use of tokens
+// verified before a deadline.
+func StreamingVerifier(inner Verifier) Verifier {
+	return streamingVerifier{inner}
+}
+
+type streamingVerifier struct {
+	inner Verifier
+}
+
+func (sv streamingVerifier) Verify(ctx context.Context, dissByPerm map[Macaroon][]Macaroon) map[Macaroon]VerificationResult {
+	// buffered so that abandoned calls don't block
+	results := make(chan map[Macaroon]VerificationResult, len(dissByPerm))
+
+	for perm, diss := range dissByPerm {
+		go func(perm Macaroon, diss []Macaroon) {
+			results <- sv.inner.Verify(ctx, map[Macaroon][]Macaroon{perm: diss})
+		}(perm, diss)
+	}
+
+	ret := make(map[Macaroon]VerificationResult, len(dissByPerm))
+
+	for range dissByPerm {
+		select {
+		case res := <-results:
+			for perm, r := range res {
+				ret[perm] = r
+			}
+		case <-ctx.Done():
+			return ret
+		}
+	}
+
+	return ret
+}
+
+// PartialResult describes the outcome of Bundle.VerifyPartial.
+type PartialResult struct {
+	// Verified is the verified caveats of each permission token that was
+	// successfully verified.
+	Verified []*macaroon.CaveatSet
+
+	// Completed is the permission tokens that got a result, whether
+	// verified or failed.
+	Completed []Macaroon
+
+	// Abandoned is the permission tokens that didn't get a result, because
+	// the context was done before the Verifier returned one. They remain
+	// unverified in the Bundle. See ResumeVerify.
+	Abandoned []Macaroon
+
+	bundle *Bundle
+}
+
+// VerifyPartial is like Verify, but tolerates the Verifier not returning
+// results for every permission token (e.g. a StreamingVerifier whose context
+// hits its deadline). Tokens that did get results are updated in the Bundle
+// as with Verify. Only permission tokens that haven't already been verified
+// are passed to the Verifier. The PartialResult is returned even if err is
+// non-nil. The error wraps the context's error if any tokens were abandoned.
+func (b *Bundle) VerifyPartial(ctx context.Context, v Verifier) (*PartialResult, error) {
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	b.checkInvariants()
+	b.mutated()
+
+	return b.ts.verifyPartial(ctx, b, And(b.IsPermissionToken, IsUnverifiedMacaroon), v)
+}
+
+// ResumeVerify retries verification of the Abandoned permission tokens,
+// without re-verifying completed ones. It returns a new PartialResult
+// describing only the resumed tokens.
+func (pr *PartialResult) ResumeVerify(ctx context.Context, v Verifier) (*PartialResult, error) {
+	if pr.bundle == nil {
+		return nil, errors.New("no bundle to resume")
+	}
+
+	abandoned := make(map[Macaroon]bool, len(pr.Abandoned))
+	for _, m := range pr.Abandoned {
+		abandoned[m] = true
+	}
+
+	isAbandoned := Predicate(func(t Token) bool {
+		m, ok := t.(Macaroon)
+		return ok && abandoned[m]
+	})
+
+	b := pr.bundle
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	b.checkInvariants()
+	b.mutated()
+
+	return b.ts.verifyPartial(ctx, b, And(b.IsPermissionToken, IsUnverifiedMacaroon, isAbandoned), v)
+}
+
+func (ts tokens) verifyPartial(ctx context.Context, b *Bundle, isPerm Predicate, v Verifier) (*PartialResult, error) {
+	var (
+		pr  = &PartialResult{bundle: b}
+		dbp = ts.dischargesByPermission(isPerm)
+		res = v.Verify(ctx, dbp)
+	)
+
+	for i, t := range ts {
+		m, ok := t.(Macaroon)
+		if !ok {
+			continue
+		}
+
+		if _, requested := dbp[m]; !requested {
+			continue
+		}
+
+		resT, ok := res[m]
+		if !ok {
+			pr.Abandoned = append(pr.Abandoned, m)
+			continue
+		}
+
+		ts[i] = resT
+		pr.Completed = append(pr.Completed, resT)
+
+		switch tt := resT.(type) {
+		case *VerifiedMacaroon:
+			pr.Verified = append(pr.Verified, tt.Caveats)
+		case *FailedMacaroon:
+		default:
+			return pr, fmt.Errorf("unexpected verification result: %T", tt)
+		}
+	}
+
+	if len(pr.Abandoned) != 0 {
+		err := ctx.Err()
+		if err == nil {
+			err = errors.New("no result from verifier")
+		}
+		return pr, fmt.Errorf("%d tokens abandoned: %w", len(pr.Abandoned), err)
+	}
+
+	return pr, nil
+}
@@ -0,0 +1,81 @@
+package bundle
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alecthomas/assert/v2"
+	"github.com/superfly/macaroon"
+)
+
+func TestVerifyPartial(t *testing.T) {
+	t.Parallel()
+
+	var (
+		fast = macOpts{}.tokens(t)
+		slow = macOpts{}.tokens(t)
+		kr   = WithKey(permKID, permKey, nil)
+
+		m     sync.Mutex
+		calls = map[string]int{}
+		delay = true
+	)
+
+	inner := VerifierFunc(func(ctx context.Context, perm Macaroon, diss []Macaroon) VerificationResult {
+		m.Lock()
+		calls[perm.String()]++
+		wait := delay && perm.String() == slow.String()
+		m.Unlock()
+
+		if wait {
+			<-ctx.Done()
+		}
+
+		return kr.VerifyOne(ctx, perm, diss)
+	})
+
+	bun, err := ParseBundle(permLoc, append(fast, slow...).String())
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	pr, err := bun.VerifyPartial(ctx, StreamingVerifier(inner))
+	assert.IsError(t, err, context.DeadlineExceeded)
+	assert.Equal(t, 1, len(pr.Verified))
+	assert.Equal(t, []string{fast.String()}, tokStrings(pr.Completed))
+	assert.Equal(t, []string{slow.String()}, tokStrings(pr.Abandoned))
+	assert.Equal(t, 1, bun.Count(IsVerifiedMacaroon))
+	assert.Equal(t, 1, bun.Count(IsUnverifiedMacaroon))
+
+	m.Lock()
+	delay = false
+	m.Unlock()
+
+	pr, err = pr.ResumeVerify(context.Background(), StreamingVerifier(inner))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(pr.Verified))
+	assert.Equal(t, []string{slow.String()}, tokStrings(pr.Completed))
+	assert.Equal(t, 0, len(pr.Abandoned))
+	assert.Equal(t, 2, bun.Count(IsVerifiedMacaroon))
+
+	// everything is verified, so there's nothing left to do
+	pr, err = bun.VerifyPartial(context.Background(), StreamingVerifier(inner))
+	assert.NoError(t, err)
+	assert.Equal(t, []*macaroon.CaveatSet(nil), pr.Verified)
+
+	// completed tokens weren't re-verified
+	m.Lock()
+	defer m.Unlock()
+	assert.Equal(t, map[string]int{fast.String(): 1, slow.String(): 2}, calls)
+}
+
+func tokStrings(ms []Macaroon) []string {
+	ret := make([]string, len(ms))
+	for i, m := range ms {
+		ret[i] = m.String()
+	}
+	return ret
+}
@@ -0,0 +1,112 @@
+package bundle
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrTokenNotFound is returned by ReplaceDischarge when the token to be
+// replaced isn't a discharge token in the Bundle.
+var ErrTokenNotFound = errors.New("discharge token not found in bundle")
+
+// RefreshPolicy determines which discharges ExpiringDischarges reports.
+type RefreshPolicy struct {
+	// ExpiringWithin is how soon a discharge must expire for it to be
+	// refreshed. Discharges that have already expired are included too.
+	ExpiringWithin time.Duration
+}
+
+// ExpiringDischarges returns a map of third-party locations to the tickets of
+// the Bundle's permission tokens whose discharges expire within the policy's
+// window. Expiry is determined from the discharges' unverified ValidityWindow
+// caveats. Tickets without discharges aren't included; see
+// UndischargedThirdPartyTickets for those.
+func (b *Bundle) ExpiringDischarges(policy RefreshPolicy) map[string][][]byte {
+	b.m.RLock()
+	defer b.m.RUnlock()
+
+	b.checkInvariants()
+
+	var (
+		cutoff    = time.Now().Add(policy.ExpiringWithin)
+		dbt, _, _ = b.ts.dischargesByTicket(b.IsPermissionToken)
+		seen      = make(map[string]bool)
+		ret       = make(map[string][][]byte)
+	)
+
+	for _, t := range b.ts.Select(b.IsPermissionToken) {
+		for _, tpt := range t.(Macaroon).Unverified().thirdPartyTickets() {
+			if seen[string(tpt.ticket)] {
+				continue
+			}
+
+			for _, dis := range dbt[string(tpt.ticket)] {
+				if expiration(dis.UnsafeCaveats()).Before(cutoff) {
+					seen[string(tpt.ticket)] = true
+					ret[tpt.location] = append(ret[tpt.location], bytes.Clone(tpt.ticket))
+					break
+				}
+			}
+		}
+	}
+
+	return ret
+}
+
+// ReplaceDischarge replaces the discharge token whose string representation is
+// oldStr with the tokens parsed from newHdr, typically its refreshed
+// replacement. The new tokens take the place of the old one in the Bundle and
+// inherit its source. If newHdr is empty, the old token is just removed. If an
+// error occurs, the Bundle remains unchanged.
+func (b *Bundle) ReplaceDischarge(oldStr string, newHdr string) error {
+	var ts tokens
+	if newHdr != "" {
+		ts = parseToks(newHdr, "", b.defensive)
+		if err := ts.Error(); err != nil {
+			return err
+		}
+	}
+
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	b.checkInvariants()
+
+	i := b.ts.indexOfDischarge(b.IsPermissionToken, oldStr)
+	if i < 0 {
+		return ErrTokenNotFound
+	}
+
+	for _, t := range ts {
+		if b.IsPermissionToken(t) {
+			return fmt.Errorf("replacement for discharge %s is a permission token", b.ts[i].(Macaroon).Nonce().UUID())
+		}
+	}
+
+	b.mutated()
+
+	for _, t := range ts {
+		setSource(t, SourceOf(b.ts[i]))
+	}
+
+	ret := make(tokens, 0, len(b.ts)-1+len(ts))
+	ret = append(ret, b.ts[:i]...)
+	ret = append(ret, ts...)
+	b.ts = append(ret, b.ts[i+1:]...)
+
+	return nil
+}
+
+// indexOfDischarge returns the index of the well-formed discharge token whose
+// string representation is str, or -1.
+func (ts tokens) indexOfDischarge(isPerm Predicate, str string) int {
+	for i, t := range ts {
+		if IsWellFormedMacaroon(t) && !isPerm(t) && t.String() == str {
+			return i
+		}
+	}
+
+	return -1
+}
@@ -0,0 +1,108 @@
+package bundle
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrOverBudget is returned by Bundle.TrimToBudget when the tokens it was told
+// to keep don't fit within the budget by themselves.
+var ErrOverBudget = errors.New("bundle exceeds header size budget")
+
+// EncodedSize returns the length in bytes of the Bundle's String
+// representation, without building the string.
+func (b *Bundle) EncodedSize() int {
+	b.m.RLock()
+	defer b.m.RUnlock()
+
+	b.checkInvariants()
+
+	return b.ts.encodedSize()
+}
+
+// FitsHeaderBudget returns true if the Bundle's Header representation
+// (including the authorization scheme) is no longer than limit bytes. Proxies
+// and browsers commonly limit headers to 8-16KB.
+func (b *Bundle) FitsHeaderBudget(limit int) bool {
+	b.m.RLock()
+	defer b.m.RUnlock()
+
+	b.checkInvariants()
+
+	return b.ts.headerSize() <= limit
+}
+
+// TrimToBudget removes tokens not selected by keep from the Bundle until its
+// Header representation is no longer than limit bytes, returning the removed
+// tokens. Tokens are removed starting from the end of the Bundle. If the Bundle
+// can't be made to fit without removing tokens selected by keep, ErrOverBudget
+// is returned and the Bundle isn't modified.
+//
+// For example, Difference(DefaultFilter(b.IsPermissionToken), IsNonMacaroon)
+// keeps permission tokens and their discharges, while allowing non-macaroon and
+// extraneous tokens to be removed.
+func (b *Bundle) TrimToBudget(limit int, keep Filter) (removed []Token, err error) {
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	b.checkInvariants()
+	b.mutated()
+
+	var (
+		kept      = filterPredicate(keep, b.ts)
+		size      = b.ts.headerSize()
+		remaining = len(b.ts)
+		drop      = make(map[int]bool)
+	)
+
+	for i := len(b.ts) - 1; i >= 0 && size > limit; i-- {
+		t := b.ts[i]
+		if kept(t) {
+			continue
+		}
+
+		removed = append(removed, t)
+		drop[i] = true
+
+		if remaining--; remaining == 0 {
+			size = 0
+		} else {
+			size -= len(t.String()) + len(tokDelim)
+		}
+	}
+
+	if size > limit {
+		return nil, fmt.Errorf("%w: %d bytes after trimming, limit is %d", ErrOverBudget, size, limit)
+	}
+
+	ts := make(tokens, 0, remaining)
+	for i, t := range b.ts {
+		if !drop[i] {
+			ts = append(ts, t)
+		}
+	}
+	b.ts = ts
+
+	return removed, nil
+}
+
+func (ts tokens) encodedSize() int {
+	if len(ts) == 0 {
+		return 0
+	}
+
+	size := (len(ts) - 1) * len(tokDelim)
+	for _, t := range ts {
+		size += len(t.String())
+	}
+
+	return size
+}
+
+func (ts tokens) headerSize() int {
+	if len(ts) == 0 {
+		return 0
+	}
+
+	return len(flyV1Scheme) + 1 + ts.encodedSize()
+}
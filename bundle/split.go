@@ -0,0 +1,101 @@
+package bundle
+
+// SplitOption configures Bundle.SplitByLocation.
+type SplitOption func(*splitConfig)
+
+type splitConfig struct {
+	nonMacaroons bool
+}
+
+// IncludeNonMacaroons causes SplitByLocation to include the Bundle's
+// NonMacaroon tokens in every sub-bundle. By default, they are left out, since
+// there's no telling which location they are meant for.
+func IncludeNonMacaroons() SplitOption {
+	return func(c *splitConfig) {
+		c.nonMacaroons = true
+	}
+}
+
+// SplitByLocation returns a Bundle for each of the locations, containing the
+// Bundle's permission tokens for that location and the discharges for their
+// third-party caveats. This is intended for gateways that forward requests to
+// several backends, each of which should only receive its own tokens. Tokens
+// that aren't needed for any of the locations, including malformed tokens, are
+// left out. Permission tokens in the returned Bundles are identified by
+// location. Their tokens are deep copies, so they don't share state with b or
+// with each other.
+func (b *Bundle) SplitByLocation(locations []string, opts ...SplitOption) map[string]*Bundle {
+	c := new(splitConfig)
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	b.m.RLock()
+	defer b.m.RUnlock()
+
+	b.checkInvariants()
+
+	ret := make(map[string]*Bundle, len(locations))
+	for _, loc := range locations {
+		var (
+			isPerm = LocationFilter(loc).Predicate()
+			sel    = b.ts.forLocation(isPerm, c.nonMacaroons)
+			ts     = tokens{}
+		)
+
+		if len(sel) > 0 {
+			ts = parseToks(sel.String(), "", b.defensive)
+		}
+
+		// re-parsing preserves the order of tokens, so we can copy sources over
+		for i := range ts {
+			setSource(ts[i], SourceOf(sel[i]))
+		}
+
+		ret[loc] = &Bundle{
+			IsPermissionToken: isPerm,
+			m:                 new(bundleState),
+			ts:                ts,
+			defensive:         b.defensive,
+			failFast:          b.failFast,
+			verifierLocation:  b.verifierLocation,
+		}
+	}
+
+	return ret
+}
+
+// HeaderFor returns the Authorization header value for just the tokens that
+// SplitByLocation would return for the location. An empty string is returned
+// if the Bundle has no permission tokens for the location.
+func (b *Bundle) HeaderFor(location string) string {
+	b.m.RLock()
+	defer b.m.RUnlock()
+
+	b.checkInvariants()
+
+	return b.ts.forLocation(LocationFilter(location).Predicate(), false).Header()
+}
+
+// forLocation returns the permission tokens matching isPerm and their
+// discharges, in their original order.
+func (ts tokens) forLocation(isPerm Predicate, nonMacaroons bool) tokens {
+	keep := make(map[Token]bool)
+	for perm, diss := range ts.dischargesByPermission(isPerm) {
+		keep[perm] = true
+		for _, dis := range diss {
+			keep[dis] = true
+		}
+	}
+
+	ret := make(tokens, 0, len(keep))
+	for _, t := range ts {
+		_, isNonMacaroon := t.(NonMacaroon)
+
+		if keep[t] || (nonMacaroons && isNonMacaroon) {
+			ret = append(ret, t)
+		}
+	}
+
+	return ret
+}
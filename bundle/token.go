@@ -1,6 +1,11 @@
 package bundle
 
 import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/superfly/macaroon"
@@ -20,7 +25,8 @@ type Macaroon interface {
 
 	// UnsafeMacaroon returns the parsed macaroon.Macaroon. It is not safe to
 	// access this when another goroutine is accessing the Bundle it came from.
-	// It is never safe to modify this directly.
+	// It is never safe to modify this directly, unless the Bundle was parsed
+	// with WithDefensiveCopies, in which case a deep copy is returned.
 	UnsafeMacaroon() *macaroon.Macaroon
 
 	// Location returns the location of this macaroon.
@@ -29,7 +35,8 @@ type Macaroon interface {
 	// Nonce returns the nonce of this macaroon.
 	Nonce() macaroon.Nonce
 
-	// UnsafeCaveats returns the unverified caveats from this macaroon.
+	// UnsafeCaveats returns the unverified caveats from this macaroon. The
+	// same rules apply as for UnsafeMacaroon.
 	UnsafeCaveats() *macaroon.CaveatSet
 
 	// ThirdPartyTickets returns all third party tickets in this macaroon.
@@ -37,6 +44,18 @@ type Macaroon interface {
 
 	// TicketsForThirdParty returns the tickets for a given third party location.
 	TicketsForThirdParty(string) [][]byte
+
+	// ThirdPartyLocations returns the sorted, deduplicated locations of the
+	// third party caveats in this macaroon.
+	ThirdPartyLocations() []string
+
+	// HasThirdParty returns whether this macaroon has a third party caveat for
+	// the given location.
+	HasThirdParty(string) bool
+
+	// CaveatTypes returns the sorted, deduplicated types of the caveats in
+	// this macaroon, including wrapped caveats.
+	CaveatTypes() []macaroon.CaveatType
 }
 
 // UnverifiedMacaroon is a Macaroon that hasn't been verified yet.
@@ -51,6 +70,20 @@ type UnverifiedMacaroon struct {
 	// references to this Macaroon and use them directly if other goroutines
 	// might be accessing the Bundle it came from concurrently.
 	UnsafeMac *macaroon.Macaroon
+
+	// whether UnsafeMacaroon and UnsafeCaveats should return copies. See
+	// WithDefensiveCopies.
+	defensive bool
+
+	// where the token came from. See SourceOf.
+	source string
+
+	// the generation of the Bundle when the token was last handed out. See
+	// EnableInvariantChecks.
+	gen atomic.Uint64
+
+	// memoized third-party tickets. See thirdPartyTickets.
+	tickets atomic.Pointer[ticketCache]
 }
 
 var (
@@ -63,21 +96,142 @@ func (t *UnverifiedMacaroon) String() string { return t.Str }
 func (t *UnverifiedMacaroon) isToken()       {}
 
 // implement Macaroon
-func (t *UnverifiedMacaroon) Unverified() *UnverifiedMacaroon    { return t }
-func (t *UnverifiedMacaroon) UnsafeMacaroon() *macaroon.Macaroon { return t.UnsafeMac }
-func (t *UnverifiedMacaroon) Location() string                   { return t.UnsafeMac.Location }
-func (t *UnverifiedMacaroon) Nonce() macaroon.Nonce              { return t.UnsafeMac.Nonce }
+func (t *UnverifiedMacaroon) Unverified() *UnverifiedMacaroon { return t }
+func (t *UnverifiedMacaroon) Location() string                { return t.UnsafeMac.Location }
+func (t *UnverifiedMacaroon) Nonce() macaroon.Nonce           { return t.UnsafeMac.Nonce }
+
+func (t *UnverifiedMacaroon) UnsafeMacaroon() *macaroon.Macaroon {
+	if !t.defensive {
+		return t.UnsafeMac
+	}
+
+	mac, err := t.UnsafeMac.Clone()
+	if err != nil {
+		// the macaroon was decoded from or encoded to Str, so this can't
+		// happen.
+		panic(fmt.Sprintf("clone token %s: %s", t.UnsafeMac.Nonce.UUID(), err))
+	}
+
+	return mac
+}
+
+// Prefix returns the prefix the token was encoded with (e.g. "fm2"). See
+// PrefixPermission, PrefixDischarge, and PrefixV2.
+func (t *UnverifiedMacaroon) Prefix() string {
+	pfx, _, _ := strings.Cut(t.Str, pfxDelim)
+	return pfx
+}
 
 func (t *UnverifiedMacaroon) UnsafeCaveats() *macaroon.CaveatSet {
-	return &t.UnsafeMac.UnsafeCaveats
+	if !t.defensive {
+		return &t.UnsafeMac.UnsafeCaveats
+	}
+
+	cavs, err := t.UnsafeMac.UnsafeCaveats.Clone()
+	if err != nil {
+		// the caveats were decoded from or encoded to Str, so this can't
+		// happen.
+		panic(fmt.Sprintf("clone caveats %s: %s", t.UnsafeMac.Nonce.UUID(), err))
+	}
+
+	return cavs
 }
 
+// ThirdPartyTickets returns a new map of the tickets in the macaroon, keyed by
+// third-party location.
 func (t *UnverifiedMacaroon) ThirdPartyTickets() map[string][][]byte {
-	return t.UnsafeMac.AllThirdPartyTickets()
+	ret := map[string][][]byte{}
+	for _, tpt := range t.thirdPartyTickets() {
+		ret[tpt.location] = append(ret[tpt.location], bytes.Clone(tpt.ticket))
+	}
+
+	return ret
 }
 
 func (t *UnverifiedMacaroon) TicketsForThirdParty(loc string) [][]byte {
-	return t.UnsafeMac.TicketsForThirdParty(loc)
+	var ret [][]byte
+	for _, tpt := range ticketsForLocation(t.thirdPartyTickets(), loc) {
+		ret = append(ret, bytes.Clone(tpt.ticket))
+	}
+
+	return ret
+}
+
+func (t *UnverifiedMacaroon) ThirdPartyLocations() []string {
+	var ret []string
+	for _, tpt := range t.thirdPartyTickets() {
+		if len(ret) == 0 || ret[len(ret)-1] != tpt.location {
+			ret = append(ret, tpt.location)
+		}
+	}
+
+	return ret
+}
+
+func (t *UnverifiedMacaroon) HasThirdParty(loc string) bool {
+	return len(ticketsForLocation(t.thirdPartyTickets(), loc)) > 0
+}
+
+func (t *UnverifiedMacaroon) CaveatTypes() []macaroon.CaveatType {
+	return t.UnsafeMac.CaveatTypes()
+}
+
+// setMac replaces the token's macaroon, e.g. after attenuating it. It must be
+// used rather than assigning UnsafeMac, so that memoized state is cleared.
+func (t *UnverifiedMacaroon) setMac(str string, mac *macaroon.Macaroon) {
+	t.Str = str
+	t.UnsafeMac = mac
+	t.tickets.Store(nil)
+}
+
+// thirdPartyTicket is a ticket from one of a macaroon's third-party caveats.
+type thirdPartyTicket struct {
+	location string
+	ticket   []byte
+}
+
+// ticketCache is the memoized result of thirdPartyTickets for a macaroon.
+type ticketCache struct {
+	mac     *macaroon.Macaroon
+	tickets []thirdPartyTicket
+}
+
+// thirdPartyTickets returns the macaroon's tickets, sorted by location, and in
+// caveat order for each location. The tickets are computed once per macaroon.
+// Filters and predicates call this for every token on every evaluation, so it
+// avoids building maps. The returned slice and tickets must not be modified.
+func (t *UnverifiedMacaroon) thirdPartyTickets() []thirdPartyTicket {
+	// the cache is also keyed by the macaroon, so that it isn't used if
+	// UnsafeMac is assigned without setMac.
+	if tc := t.tickets.Load(); tc != nil && tc.mac == t.UnsafeMac {
+		return tc.tickets
+	}
+
+	var tickets []thirdPartyTicket
+	for _, c3p := range macaroon.GetCaveats[*macaroon.Caveat3P](&t.UnsafeMac.UnsafeCaveats) {
+		tickets = append(tickets, thirdPartyTicket{c3p.Location, c3p.Ticket})
+	}
+
+	sort.SliceStable(tickets, func(i, j int) bool {
+		return tickets[i].location < tickets[j].location
+	})
+
+	t.tickets.Store(&ticketCache{mac: t.UnsafeMac, tickets: tickets})
+
+	return tickets
+}
+
+// ticketsForLocation returns the subslice of tickets, as returned by
+// thirdPartyTickets, for the given location.
+func ticketsForLocation(tickets []thirdPartyTicket, loc string) []thirdPartyTicket {
+	i := sort.Search(len(tickets), func(i int) bool { return tickets[i].location >= loc })
+
+	j := i
+	for j < len(tickets) && tickets[j].location == loc {
+		j++
+	}
+
+	return tickets[i:j]
 }
 
 // VerifiedMacaroon is a Macaroon that passed signature verification.
@@ -99,9 +253,14 @@ var maxTime = time.Unix(1<<63-62135596801, 999999999)
 
 // Expiration calculates when this macaroon will expire
 func (t *VerifiedMacaroon) Expiration() time.Time {
+	return expiration(t.Caveats)
+}
+
+// expiration calculates the earliest NotAfter of the ValidityWindow caveats.
+func expiration(cavs *macaroon.CaveatSet) time.Time {
 	ret := maxTime
 
-	for _, vw := range macaroon.GetCaveats[*macaroon.ValidityWindow](t.Caveats) {
+	for _, vw := range macaroon.GetCaveats[*macaroon.ValidityWindow](cavs) {
 		if na := time.Unix(vw.NotAfter, 0); na.Before(ret) {
 			ret = na
 		}
@@ -141,6 +300,9 @@ type MalformedMacaroon struct {
 
 	// Err is the error that occurred while parsing the token.
 	Err error
+
+	// where the token came from. See SourceOf.
+	source string
 }
 
 var _ Token = (*MalformedMacaroon)(nil)
@@ -151,6 +313,41 @@ func (t *MalformedMacaroon) Error() error { return t.Err }
 func (t *MalformedMacaroon) String() string { return t.Str }
 func (t *MalformedMacaroon) isToken()       {}
 
+// SourceOf returns the source that t was added to its Bundle from (e.g.
+// DefaultSource or the source passed to AddTokensWithSource). An empty string
+// is returned for NonMacaroons, which don't carry a source, and for tokens
+// that weren't parsed from a header (e.g. discharges added by
+// Bundle.Discharge). Verification results have the same source as the token
+// they were verified from.
+func SourceOf(t Token) string {
+	switch tt := t.(type) {
+	case Macaroon:
+		return tt.Unverified().source
+	case *MalformedMacaroon:
+		return tt.source
+	default:
+		return ""
+	}
+}
+
+func setSource(t Token, source string) {
+	switch tt := t.(type) {
+	case Macaroon:
+		tt.Unverified().source = source
+	case *MalformedMacaroon:
+		tt.source = source
+	}
+}
+
+// withSource annotates err with the source of t, if it has one.
+func withSource(t Token, err error) error {
+	if src := SourceOf(t); src != "" {
+		return fmt.Errorf("from %s: %w", src, err)
+	}
+
+	return err
+}
+
 // NonMacaroon is a token that doesn't look like a macaroon.
 type NonMacaroon string
 
@@ -1,6 +1,7 @@
 package bundle
 
 import (
+	"bytes"
 	"context"
 	"encoding/base64"
 	"errors"
@@ -13,7 +14,7 @@ import (
 // tokens does the heavy lifting for Bundle.
 type tokens []Token
 
-func parseToks(hdr string) tokens {
+func parseToks(hdr, source string, defensive bool) tokens {
 	hdr, _ = macaroon.StripAuthorizationScheme(hdr)
 
 	var (
@@ -38,8 +39,9 @@ func parseToks(hdr string) tokens {
 		raw, err := base64.StdEncoding.DecodeString(b64)
 		if err != nil {
 			ts = append(ts, &MalformedMacaroon{
-				Str: part,
-				Err: fmt.Errorf("%w: bad base64: %w", macaroon.ErrUnrecognizedToken, err),
+				Str:    part,
+				Err:    fmt.Errorf("%w: bad base64: %w", macaroon.ErrUnrecognizedToken, err),
+				source: source,
 			})
 
 			continue
@@ -48,8 +50,9 @@ func parseToks(hdr string) tokens {
 		mac, err := macaroon.Decode(raw)
 		if err != nil {
 			ts = append(ts, &MalformedMacaroon{
-				Str: part,
-				Err: fmt.Errorf("bad macaroon: %w", err),
+				Str:    part,
+				Err:    fmt.Errorf("bad macaroon: %w", err),
+				source: source,
 			})
 
 			continue
@@ -58,6 +61,8 @@ func parseToks(hdr string) tokens {
 		ts = append(ts, &UnverifiedMacaroon{
 			Str:       part,
 			UnsafeMac: mac,
+			defensive: defensive,
+			source:    source,
 		})
 	}
 
@@ -117,7 +122,7 @@ func (ts tokens) Error() error {
 
 	for _, t := range ts {
 		if bt, ok := t.(badToken); ok {
-			merr = errors.Join(merr, bt.Error())
+			merr = errors.Join(merr, withSource(bt, bt.Error()))
 		}
 	}
 
@@ -153,9 +158,9 @@ func (ts tokens) Verify(ctx context.Context, isPerm Predicate, v Verifier) ([]*m
 		case *VerifiedMacaroon:
 			verified = append(verified, tt.Caveats)
 		case *FailedMacaroon:
-			merr = errors.Join(merr,
+			merr = errors.Join(merr, withSource(tt,
 				fmt.Errorf("token %s: %w", tt.UnsafeMac.Nonce.UUID(), tt.Err),
-			)
+			))
 		default:
 			return nil, fmt.Errorf("unexpected verification result: %T", tt)
 		}
@@ -168,14 +173,21 @@ func (ts tokens) Verify(ctx context.Context, isPerm Predicate, v Verifier) ([]*m
 	return verified, nil
 }
 
-func (ts tokens) Validate(accesses ...macaroon.Access) error {
+func (ts tokens) Validate(failFast bool, accesses ...macaroon.Access) error {
 	merr := errors.New("no authorized tokens")
 
+	validate := (*macaroon.CaveatSet).Validate
+	if failFast {
+		validate = (*macaroon.CaveatSet).ValidateFailFast
+	}
+
 	for _, t := range ts.Select(IsVerifiedMacaroon) {
 		vm := t.(*VerifiedMacaroon)
 
-		if err := vm.Caveats.Validate(accesses...); err != nil {
-			merr = errors.Join(merr, fmt.Errorf("token %s: %w", vm.UnsafeMac.Nonce.UUID(), err))
+		err := validate(vm.Caveats, accesses...)
+
+		if err != nil {
+			merr = errors.Join(merr, withSource(vm, fmt.Errorf("token %s: %w", vm.UnsafeMac.Nonce.UUID(), err)))
 		} else {
 			return nil
 		}
@@ -184,17 +196,102 @@ func (ts tokens) Validate(accesses ...macaroon.Access) error {
 	return merr
 }
 
-func (ts *tokens) Discharge(isPerm Predicate, tpLocation string, tpKey macaroon.EncryptionKey, cb Discharger) error {
+// verifierLocator is implemented by accesses (e.g. flyio.Access) that can be
+// copied with a verifier location filled in. See WithVerifierLocation.
+type verifierLocator interface {
+	macaroon.LocationAwareAccess
+	WithVerifierLocation(string) macaroon.Access
+}
+
+// withVerifierLocation returns accesses, replacing those that don't specify a
+// verifier location with copies located at loc. The provided slice and
+// accesses aren't modified.
+func withVerifierLocation(loc string, accesses []macaroon.Access) []macaroon.Access {
+	if loc == "" {
+		return accesses
+	}
+
+	var ret []macaroon.Access
+	for i, a := range accesses {
+		vl, ok := a.(verifierLocator)
+		if !ok || vl.GetVerifierLocation() != "" {
+			continue
+		}
+
+		if ret == nil {
+			ret = append([]macaroon.Access(nil), accesses...)
+		}
+		ret[i] = vl.WithVerifierLocation(loc)
+	}
+
+	if ret == nil {
+		return accesses
+	}
+
+	return ret
+}
+
+func (ts tokens) ValidateWithAudit(accesses ...macaroon.Access) (*AuditRecord, error) {
+	var (
+		merr = errors.New("no authorized tokens")
+		rec  = &AuditRecord{Tokens: []*TokenAudit{}}
+	)
+
+	for _, t := range ts.Select(IsVerifiedMacaroon) {
+		vm := t.(*VerifiedMacaroon)
+
+		cavRec, err := vm.Caveats.ValidateWithAudit(accesses...)
+
+		rec.Tokens = append(rec.Tokens, &TokenAudit{
+			ID:         vm.UnsafeMac.Nonce.UUID().String(),
+			Location:   vm.Location(),
+			Source:     SourceOf(vm),
+			Authorized: err == nil,
+			Record:     cavRec,
+		})
+
+		if err != nil {
+			merr = errors.Join(merr, withSource(vm, fmt.Errorf("token %s: %w", vm.UnsafeMac.Nonce.UUID(), err)))
+		} else {
+			rec.Allowed = true
+			return rec, nil
+		}
+	}
+
+	rec.Error = merr.Error()
+
+	return rec, merr
+}
+
+func (ts *tokens) Discharge(isPerm Predicate, tpLocation string, tpKey macaroon.EncryptionKey, cb Discharger, defensive bool) error {
+	newDiss, err := dischargeTickets(context.Background(), ts.undischargedTicketsByLocation(isPerm), tpLocation, tpKey, cb, defensive)
+	if err != nil {
+		return err
+	}
+
+	*ts = append(*ts, newDiss...)
+
+	return nil
+}
+
+// dischargeTickets issues discharges for the tickets in ubl, a map of
+// third-party locations to undischarged tickets, without modifying any
+// tokens. It returns an error if any ticket can't be discharged or if ctx is
+// done before every ticket has been discharged.
+func dischargeTickets(ctx context.Context, ubl map[string][][]byte, tpLocation string, tpKey macaroon.EncryptionKey, cb Discharger, defensive bool) ([]Token, error) {
 	var (
 		merr    error
 		newDiss []Token
-		ubl     = ts.undischargedTicketsByLocation(isPerm)
 	)
 
 	for tLoc, tickets := range ubl {
 		tpErr := func(err error) error { return fmt.Errorf("location %s: %w", tLoc, err) }
 
 		for _, ticket := range tickets {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+
 			tCavs, dm, err := macaroon.DischargeTicket(tpKey, tpLocation, ticket)
 			if err != nil {
 				merr = errors.Join(merr, tpErr(err))
@@ -221,6 +318,7 @@ func (ts *tokens) Discharge(isPerm Predicate, tpLocation string, tpKey macaroon.
 			dum := &UnverifiedMacaroon{
 				Str:       dmStr,
 				UnsafeMac: dm,
+				defensive: defensive,
 			}
 
 			newDiss = append(newDiss, dum)
@@ -228,94 +326,190 @@ func (ts *tokens) Discharge(isPerm Predicate, tpLocation string, tpKey macaroon.
 	}
 
 	if merr != nil {
-		return merr
+		return nil, merr
 	}
 
-	*ts = append(*ts, newDiss...)
+	return newDiss, nil
+}
 
-	return nil
+// stillUndischarged returns the discharges in diss whose tickets are in ubl,
+// a map of third-party locations to undischarged tickets.
+func stillUndischarged(ubl map[string][][]byte, diss []Token) []Token {
+	undischarged := map[string]bool{}
+	for _, tickets := range ubl {
+		for _, ticket := range tickets {
+			undischarged[string(ticket)] = true
+		}
+	}
+
+	var ret []Token
+	for _, t := range diss {
+		if ticket := string(t.(Macaroon).Nonce().KID); undischarged[ticket] {
+			// only one discharge per ticket
+			delete(undischarged, ticket)
+			ret = append(ret, t)
+		}
+	}
+
+	return ret
 }
 
 func (ts tokens) Attenuate(isPerm Predicate, caveats ...macaroon.Caveat) error {
-	type replacement struct {
-		m   Macaroon
-		mac *macaroon.Macaroon
-		vcs *macaroon.CaveatSet
-		str string
+	at := ts.attenuationTargets(isPerm)
+	if err := at.stage(context.Background(), caveats...); err != nil {
+		return err
 	}
 
-	var (
-		merr error
+	at.apply()
 
-		// we stage all our updates in a separate slice, so we can skip applying
-		// any changes if there are errors.
-		replacements []*replacement
-	)
+	return nil
+}
+
+// attenuation is an Attenuate of the permission tokens in a Bundle, staged in
+// three steps so that the expensive one needn't hold the Bundle's lock:
+// attenuationTargets reads the tokens with the lock held, stage clones and
+// attenuates their macaroons without modifying the tokens, and apply replaces
+// the tokens' macaroons with the write lock held.
+type attenuation []*attenuatedToken
+
+type attenuatedToken struct {
+	m        Macaroon
+	src      *macaroon.Macaroon
+	verified *macaroon.CaveatSet
+
+	// set by stage
+	mac *macaroon.Macaroon
+	vcs *macaroon.CaveatSet
+	str string
+}
+
+func (ts tokens) attenuationTargets(isPerm Predicate) attenuation {
+	var ret attenuation
 
 	for _, t := range ts.Select(isPerm) {
+		m := t.(Macaroon)
+		at := &attenuatedToken{m: m, src: m.Unverified().UnsafeMac}
+
+		if vm, ok := t.(*VerifiedMacaroon); ok {
+			at.verified = vm.Caveats
+		}
+
+		ret = append(ret, at)
+	}
+
+	return ret
+}
+
+// stage attenuates clones of the targets' macaroons. It returns an error if
+// any of them can't be attenuated or if ctx is done before all of them have
+// been.
+func (a attenuation) stage(ctx context.Context, caveats ...macaroon.Caveat) error {
+	var merr error
+
+	for _, at := range a {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
 		var (
-			m    = t.(Macaroon)
-			uuid = m.Nonce().UUID()
-			r    = replacement{m: m}
+			uuid = at.src.Nonce.UUID()
 			err  error
 		)
 
-		r.mac, err = m.UnsafeMacaroon().Clone()
+		at.mac, err = at.src.Clone()
 		if err != nil {
 			merr = errors.Join(merr, fmt.Errorf("clone token %s: %w", uuid, err))
 			continue
 		}
 
-		cavsBefore := r.mac.UnsafeCaveats.Caveats
-		if err = r.mac.Add(caveats...); err != nil {
+		cavsBefore := at.mac.UnsafeCaveats.Caveats
+		if err = at.mac.Add(caveats...); err != nil {
 			merr = errors.Join(merr, fmt.Errorf("attenuate token %s: %w", uuid, err))
 			continue
 		}
 
-		if vm, ok := t.(*VerifiedMacaroon); ok {
-			r.vcs, err = vm.Caveats.Clone()
+		if at.verified != nil {
+			at.vcs, err = attenuatedCaveats(at.verified, cavsBefore, at.mac.UnsafeCaveats.Caveats)
 			if err != nil {
 				merr = errors.Join(merr, fmt.Errorf("clone verified caveats %s: %w", uuid, err))
 				continue
 			}
-
-			// m.Add() might skip duplicate caveats, so we figure out for
-			// ourselves which ones were added and put them in the
-			// VerifiedCaveats field.
-			added := r.mac.UnsafeCaveats.Caveats[len(cavsBefore):]
-			r.vcs.Caveats = append(r.vcs.Caveats, added...)
 		}
 
-		if r.str, err = r.mac.String(); err != nil {
+		if at.str, err = at.mac.String(); err != nil {
 			merr = errors.Join(merr, fmt.Errorf("encode token %s: %w", uuid, err))
 			continue
 		}
-
-		replacements = append(replacements, &r)
 	}
 
-	if merr != nil {
-		return merr
-	}
+	return merr
+}
 
-	for _, r := range replacements {
-		switch tt := r.m.(type) {
+// apply replaces the targets' macaroons with the staged ones.
+func (a attenuation) apply() {
+	for _, at := range a {
+		switch tt := at.m.(type) {
 		case *UnverifiedMacaroon:
-			tt.Str = r.str
-			tt.UnsafeMac = r.mac
+			tt.setMac(at.str, at.mac)
 		case *VerifiedMacaroon:
-			tt.Str = r.str
-			tt.UnsafeMac = r.mac
-			tt.Caveats = r.vcs
+			tt.setMac(at.str, at.mac)
+			tt.Caveats = at.vcs
 		case *FailedMacaroon:
-			tt.Str = r.str
-			tt.UnsafeMac = r.mac
+			tt.setMac(at.str, at.mac)
 		default:
 			panic(fmt.Sprintf("unexpected token type: %T", tt))
 		}
 	}
+}
 
-	return nil
+// attenuatedCaveats returns the caveats that re-verifying an attenuated token
+// would return, given the verified caveats from before it was attenuated and
+// the token's caveats before and after. Add skips caveats the token already
+// has, so the added caveats are identified by value. Verification returns the
+// token's own caveats followed by those from its discharges, so the added
+// caveats go after the token's own caveats rather than at the end.
+func attenuatedCaveats(verified *macaroon.CaveatSet, before, after []macaroon.Caveat) (*macaroon.CaveatSet, error) {
+	ret, err := verified.Clone()
+	if err != nil {
+		return nil, err
+	}
+
+	var added []macaroon.Caveat
+	for _, c := range after {
+		if !containsCaveat(before, c) {
+			added = append(added, c)
+		}
+	}
+
+	var own []macaroon.Caveat
+	for _, c := range before {
+		switch c.(type) {
+		case *macaroon.Caveat3P, *macaroon.BindToParentToken:
+		default:
+			own = append(own, c)
+		}
+	}
+
+	// if the verified caveats didn't come from Macaroon.Verify (e.g. a remote
+	// Verifier), we don't know their order and just add to the end.
+	at := len(own)
+	if at > len(ret.Caveats) || !macaroon.NewCaveatSet(own...).Equal(macaroon.NewCaveatSet(ret.Caveats[:at]...)) {
+		at = len(ret.Caveats)
+	}
+
+	ret.Caveats = append(ret.Caveats[:at], append(added, ret.Caveats[at:]...)...)
+
+	return ret, nil
+}
+
+func containsCaveat(cavs []macaroon.Caveat, c macaroon.Caveat) bool {
+	for _, cc := range cavs {
+		if macaroon.EqualCaveat(cc, c) {
+			return true
+		}
+	}
+
+	return false
 }
 
 func (ts tokens) dischargesByPermission(isPerm Predicate) map[Macaroon][]Macaroon {
@@ -326,13 +520,11 @@ func (ts tokens) dischargesByPermission(isPerm Predicate) map[Macaroon][]Macaroo
 
 	for _, t := range ts.Select(isPerm) {
 		m := t.(Macaroon)
-		tpts := m.ThirdPartyTickets()
+		tpts := m.Unverified().thirdPartyTickets()
 		dbp[m] = make([]Macaroon, 0, len(tpts))
 
-		for _, tickets := range tpts {
-			for _, ticket := range tickets {
-				dbp[m] = append(dbp[m], dbt[string(ticket)]...)
-			}
+		for _, tpt := range tpts {
+			dbp[m] = append(dbp[m], dbt[string(tpt.ticket)]...)
 		}
 	}
 
@@ -348,11 +540,9 @@ func (ts tokens) permissionsByDischarge(isPerm Predicate) map[Macaroon][]Macaroo
 	for _, t := range ts.Select(isPerm) {
 		m := t.(Macaroon)
 
-		for _, tickets := range m.ThirdPartyTickets() {
-			for _, ticket := range tickets {
-				for _, dis := range dbt[string(ticket)] {
-					pbd[dis] = append(pbd[dis], m)
-				}
+		for _, tpt := range m.Unverified().thirdPartyTickets() {
+			for _, dis := range dbt[string(tpt.ticket)] {
+				pbd[dis] = append(pbd[dis], m)
 			}
 		}
 	}
@@ -369,11 +559,9 @@ func (ts tokens) undischargedTicketsByLocation(isPerm Predicate) map[string][][]
 	for _, t := range ts.Select(isPerm) {
 		m := t.(Macaroon)
 
-		for tLoc, tickets := range m.ThirdPartyTickets() {
-			for _, ticket := range tickets {
-				if len(dbt[string(ticket)]) == 0 {
-					ubl[tLoc] = append(ubl[tLoc], ticket)
-				}
+		for _, tpt := range m.Unverified().thirdPartyTickets() {
+			if len(dbt[string(tpt.ticket)]) == 0 {
+				ubl[tpt.location] = append(ubl[tpt.location], bytes.Clone(tpt.ticket))
 			}
 		}
 	}
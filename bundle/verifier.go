@@ -2,8 +2,11 @@ package bundle
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"slices"
@@ -37,17 +40,152 @@ func WithKey(kid []byte, key macaroon.SigningKey, trustedTPs map[string][]macaro
 	return WithKeys(map[string]macaroon.SigningKey{string(kid): key}, trustedTPs)
 }
 
-// WithKeys returns a KeyResolver for authorities with multiple keys.
+// WithKeys returns a KeyResolver for authorities with multiple keys. The keys
+// are copied, so callers may zero them afterwards. If any key has the wrong
+// length, the resolver returns a *macaroon.KeyLengthError for every token.
 func WithKeys(keyByKID map[string]macaroon.SigningKey, trustedTPs map[string][]macaroon.EncryptionKey) KeyResolver {
+	var (
+		keys    = make(map[string]macaroon.SigningKey, len(keyByKID))
+		tpKeys  = make(map[string][]macaroon.EncryptionKey, len(trustedTPs))
+		keysErr error
+	)
+
+	for kid, key := range keyByKID {
+		cp, err := macaroon.NewSigningKeyFromBytes(key)
+		if err != nil {
+			keysErr = errors.Join(keysErr, fmt.Errorf("key for KID %x: %w", kid, err))
+		}
+		keys[kid] = cp
+	}
+
+	for loc, tpks := range trustedTPs {
+		for _, tpk := range tpks {
+			cp, err := macaroon.NewEncryptionKeyFromBytes(tpk)
+			if err != nil {
+				keysErr = errors.Join(keysErr, fmt.Errorf("trusted key for %s: %w", loc, err))
+			}
+			tpKeys[loc] = append(tpKeys[loc], cp)
+		}
+	}
+
+	if trustedTPs == nil {
+		tpKeys = nil
+	}
+
 	return func(_ context.Context, nonce macaroon.Nonce) (macaroon.SigningKey, map[string][]macaroon.EncryptionKey, error) {
-		key, ok := keyByKID[string(nonce.KID)]
+		if keysErr != nil {
+			return nil, nil, keysErr
+		}
+
+		key, ok := keys[string(nonce.KID)]
 		if !ok {
 			return nil, nil, fmt.Errorf("unknown KID %x", nonce.KID)
 		}
 
+		return key, tpKeys, nil
+	}
+}
+
+// SigningKeyResolver looks up the signing key for the given nonce's KID. See
+// [ResolverChain].
+type SigningKeyResolver func(context.Context, macaroon.Nonce) (macaroon.SigningKey, error)
+
+// TrustedTPResolver looks up the third parties whose attestations should be
+// trusted when verifying the token with the given nonce. See [ResolverChain].
+type TrustedTPResolver func(context.Context, macaroon.Nonce) (map[string][]macaroon.EncryptionKey, error)
+
+// ResolverChainOption configures a KeyResolver returned by [ResolverChain].
+type ResolverChainOption func(*resolverChain)
+
+// WithStrictTrustedTPs causes errors from the TrustedTPResolver to fail
+// verification of the token outright. By default, such errors only affect
+// whether attestations from third parties are trusted.
+func WithStrictTrustedTPs() ResolverChainOption {
+	return func(rc *resolverChain) {
+		rc.strict = true
+	}
+}
+
+type resolverChain struct {
+	signing SigningKeyResolver
+	trusted TrustedTPResolver
+	strict  bool
+}
+
+// ResolverChain returns a KeyResolver that gets signing keys from one source
+// and trusted third parties from another. This is useful when the set of
+// trusted third parties changes at runtime (e.g. is tenant-dependent).
+//
+// By default, an error from the trusted lookup doesn't fail the token.
+// Verification proceeds as though no third parties were trusted, meaning
+// that signatures are still checked but attestations from discharge tokens
+// are dropped. Use [WithStrictTrustedTPs] to fail the token instead.
+func ResolverChain(signing SigningKeyResolver, trusted TrustedTPResolver, opts ...ResolverChainOption) KeyResolver {
+	rc := &resolverChain{
+		signing: signing,
+		trusted: trusted,
+	}
+
+	for _, opt := range opts {
+		opt(rc)
+	}
+
+	return rc.resolve
+}
+
+func (rc *resolverChain) resolve(ctx context.Context, nonce macaroon.Nonce) (macaroon.SigningKey, map[string][]macaroon.EncryptionKey, error) {
+	key, err := rc.signing(ctx, nonce)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if rc.trusted == nil {
+		return key, nil, nil
+	}
+
+	trustedTPs, err := rc.trusted(ctx, nonce)
+	switch {
+	case err == nil:
 		return key, trustedTPs, nil
+	case rc.strict:
+		return nil, nil, fmt.Errorf("resolve trusted third parties: %w", err)
+	default:
+		return key, map[string][]macaroon.EncryptionKey{}, nil
+	}
+}
+
+// CacheTrustedTPs wraps a TrustedTPResolver, caching successful lookups by
+// KID for the specified ttl. Errors aren't cached.
+func CacheTrustedTPs(trusted TrustedTPResolver, ttl time.Duration, size int) TrustedTPResolver {
+	cache, err := lru.New[string, *trustedTPsCacheEntry](size)
+	if err != nil {
+		panic(err)
 	}
 
+	return func(ctx context.Context, nonce macaroon.Nonce) (map[string][]macaroon.EncryptionKey, error) {
+		skid := string(nonce.KID)
+
+		if v, ok := cache.Get(skid); ok && v.expiration.After(time.Now()) {
+			return v.trustedTPs, nil
+		}
+
+		trustedTPs, err := trusted(ctx, nonce)
+		if err != nil {
+			return nil, err
+		}
+
+		cache.Add(skid, &trustedTPsCacheEntry{
+			trustedTPs,
+			time.Now().Add(ttl),
+		})
+
+		return trustedTPs, nil
+	}
+}
+
+type trustedTPsCacheEntry struct {
+	trustedTPs map[string][]macaroon.EncryptionKey
+	expiration time.Time
 }
 
 func (kr KeyResolver) Verify(ctx context.Context, dissByPerm map[Macaroon][]Macaroon) map[Macaroon]VerificationResult {
@@ -63,10 +201,10 @@ func (kr KeyResolver) VerifyOne(ctx context.Context, perm Macaroon, diss []Macar
 
 	disMacs := make([]*macaroon.Macaroon, 0, len(diss))
 	for _, d := range diss {
-		disMacs = append(disMacs, d.UnsafeMacaroon())
+		disMacs = append(disMacs, d.Unverified().UnsafeMac)
 	}
 
-	if cavs, err := perm.UnsafeMacaroon().VerifyParsed(key, disMacs, trustedTPs); err != nil {
+	if cavs, err := perm.Unverified().UnsafeMac.VerifyParsed(key, disMacs, trustedTPs); err != nil {
 		return &FailedMacaroon{perm.Unverified(), err}
 	} else {
 		return &VerifiedMacaroon{perm.Unverified(), cavs}
@@ -74,10 +212,14 @@ func (kr KeyResolver) VerifyOne(ctx context.Context, perm Macaroon, diss []Macar
 }
 
 // VerificationCache is a Verifier that caches successful verification results.
+// Use WithBypassCache to force fresh verification for security-sensitive
+// requests and WithCacheStatus to find out which results came from the cache.
 type VerificationCache struct {
 	verifier Verifier
 	ttl      time.Duration
 	cache    *lru.Cache[string, *cacheEntry]
+
+	hits, misses, bypassed atomic.Uint64
 }
 
 func NewVerificationCache(verifier Verifier, ttl time.Duration, size int) *VerificationCache {
@@ -101,6 +243,8 @@ type cacheEntry struct {
 func (vc *VerificationCache) Verify(ctx context.Context, dissByPerm map[Macaroon][]Macaroon) map[Macaroon]VerificationResult {
 	ret := make(map[Macaroon]VerificationResult, len(dissByPerm))
 	hdrByPerm := make(map[Macaroon]string)
+	bypass := bypassCache(ctx)
+	status := cacheStatusFromContext(ctx)
 
 	for perm, diss := range dissByPerm {
 		// sort discharges so we'll get the same cache key regardless of order
@@ -108,11 +252,22 @@ func (vc *VerificationCache) Verify(ctx context.Context, dissByPerm map[Macaroon
 
 		hdr := String(append(diss, perm)...)
 
+		if bypass {
+			vc.bypassed.Add(1)
+			hdrByPerm[perm] = hdr
+			status.record(perm, false)
+			continue
+		}
+
 		if v, ok := vc.cache.Get(hdr); ok && v.expiration.After(time.Now()) {
+			vc.hits.Add(1)
 			ret[perm] = v.vm
 			delete(dissByPerm, perm)
+			status.record(perm, true)
 		} else {
+			vc.misses.Add(1)
 			hdrByPerm[perm] = hdr
+			status.record(perm, false)
 		}
 	}
 
@@ -134,6 +289,92 @@ func (vc *VerificationCache) Purge() {
 	vc.cache.Purge()
 }
 
+// VerificationCacheStats are counts of the permission tokens passed to
+// VerificationCache.Verify.
+type VerificationCacheStats struct {
+	// Hits are tokens with cached results.
+	Hits uint64
+
+	// Misses are tokens without cached results (including expired ones).
+	Misses uint64
+
+	// Bypassed are tokens verified with WithBypassCache, which aren't
+	// counted as hits or misses.
+	Bypassed uint64
+}
+
+// Stats returns the cache's hit and miss counts since it was created.
+func (vc *VerificationCache) Stats() VerificationCacheStats {
+	return VerificationCacheStats{
+		Hits:     vc.hits.Load(),
+		Misses:   vc.misses.Load(),
+		Bypassed: vc.bypassed.Load(),
+	}
+}
+
+type contextKey string
+
+const (
+	contextKeyBypassCache = contextKey("bypass-cache")
+	contextKeyCacheStatus = contextKey("cache-status")
+)
+
+// WithBypassCache returns a context that causes VerificationCache to skip
+// cache lookups, so that every token is verified afresh. The fresh results are
+// still cached. This is meant for security-sensitive requests (e.g. revoking
+// tokens) that shouldn't rely on earlier verification.
+func WithBypassCache(ctx context.Context) context.Context {
+	return context.WithValue(ctx, contextKeyBypassCache, true)
+}
+
+func bypassCache(ctx context.Context) bool {
+	bypass, _ := ctx.Value(contextKeyBypassCache).(bool)
+	return bypass
+}
+
+// WithCacheStatus returns a context in which VerificationCache records
+// whether each permission token's result came from the cache. Use WasCached to
+// check after verifying.
+func WithCacheStatus(ctx context.Context) context.Context {
+	return context.WithValue(ctx, contextKeyCacheStatus, &cacheStatus{cached: map[string]bool{}})
+}
+
+// WasCached returns whether VerificationCache used a cached result for the
+// permission token m. It is always false unless ctx came from WithCacheStatus
+// and was used to verify m.
+func WasCached(ctx context.Context, m Macaroon) bool {
+	status := cacheStatusFromContext(ctx)
+	if status == nil {
+		return false
+	}
+
+	status.m.Lock()
+	defer status.m.Unlock()
+
+	return status.cached[m.String()]
+}
+
+type cacheStatus struct {
+	m      sync.Mutex
+	cached map[string]bool
+}
+
+func cacheStatusFromContext(ctx context.Context) *cacheStatus {
+	status, _ := ctx.Value(contextKeyCacheStatus).(*cacheStatus)
+	return status
+}
+
+func (cs *cacheStatus) record(perm Macaroon, cached bool) {
+	if cs == nil {
+		return
+	}
+
+	cs.m.Lock()
+	defer cs.m.Unlock()
+
+	cs.cached[perm.String()] = cached
+}
+
 type VerifierFunc func(ctx context.Context, perm Macaroon, diss []Macaroon) VerificationResult
 
 func (vf VerifierFunc) Verify(ctx context.Context, dissByPerm map[Macaroon][]Macaroon) map[Macaroon]VerificationResult {
@@ -145,3 +386,154 @@ func (vf VerifierFunc) Verify(ctx context.Context, dissByPerm map[Macaroon][]Mac
 
 	return ret
 }
+
+// ChunkedVerifierOption configures a Verifier returned by [ChunkedVerifier].
+type ChunkedVerifierOption func(*chunkedVerifier)
+
+// WithConcurrency allows up to n batches to be verified in parallel. By
+// default, batches are verified sequentially.
+func WithConcurrency(n int) ChunkedVerifierOption {
+	return func(cv *chunkedVerifier) {
+		if n > 0 {
+			cv.concurrency = n
+		}
+	}
+}
+
+type chunkedVerifier struct {
+	inner       Verifier
+	maxPerms    int
+	concurrency int
+}
+
+// ChunkedVerifier returns a Verifier that splits the permission tokens into
+// batches of at most maxPermsPerCall, each of which is passed to inner along
+// with its discharges. This is useful for remote verifiers, which might
+// otherwise have to verify very large bundles in a single request. Results
+// from all batches are merged. Permission tokens in a batch that inner doesn't
+// return results for are omitted, so a failed batch only fails its own tokens.
+func ChunkedVerifier(inner Verifier, maxPermsPerCall int, opts ...ChunkedVerifierOption) Verifier {
+	if maxPermsPerCall < 1 {
+		maxPermsPerCall = 1
+	}
+
+	cv := &chunkedVerifier{
+		inner:       inner,
+		maxPerms:    maxPermsPerCall,
+		concurrency: 1,
+	}
+
+	for _, opt := range opts {
+		opt(cv)
+	}
+
+	return cv
+}
+
+func (cv *chunkedVerifier) Verify(ctx context.Context, dissByPerm map[Macaroon][]Macaroon) map[Macaroon]VerificationResult {
+	if len(dissByPerm) <= cv.maxPerms {
+		return cv.inner.Verify(ctx, dissByPerm)
+	}
+
+	// sort permission tokens so batches are deterministic
+	perms := make([]Macaroon, 0, len(dissByPerm))
+	for perm := range dissByPerm {
+		perms = append(perms, perm)
+	}
+	slices.SortFunc(perms, func(a, b Macaroon) int { return strings.Compare(a.String(), b.String()) })
+
+	var (
+		ret = make(map[Macaroon]VerificationResult, len(dissByPerm))
+		m   sync.Mutex
+		wg  sync.WaitGroup
+		sem = make(chan struct{}, cv.concurrency)
+	)
+
+	for start := 0; start < len(perms); start += cv.maxPerms {
+		end := start + cv.maxPerms
+		if end > len(perms) {
+			end = len(perms)
+		}
+
+		batch := make(map[Macaroon][]Macaroon, end-start)
+		for _, perm := range perms[start:end] {
+			batch[perm] = dissByPerm[perm]
+		}
+
+		sem <- struct{}{}
+		wg.Add(1)
+
+		go func() {
+			defer func() { <-sem }()
+			defer wg.Done()
+
+			res := cv.inner.Verify(ctx, batch)
+
+			m.Lock()
+			defer m.Unlock()
+
+			for perm, r := range res {
+				ret[perm] = r
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	return ret
+}
+
+// ErrNotPreverified is the error for permission tokens that a Verifier
+// returned by [PreverifiedVerifier] has no results for.
+var ErrNotPreverified = errors.New("no preverified result for token")
+
+// PreverifiedOption configures a Verifier returned by [PreverifiedVerifier].
+type PreverifiedOption func(*preverifiedVerifier)
+
+// AllowInsecurePreverified acknowledges that a Verifier returned by
+// [PreverifiedVerifier] does no cryptographic verification. It is required.
+func AllowInsecurePreverified() PreverifiedOption {
+	return func(pv *preverifiedVerifier) {
+		pv.allowInsecure = true
+	}
+}
+
+type preverifiedVerifier struct {
+	results       map[string]*macaroon.CaveatSet
+	allowInsecure bool
+}
+
+// PreverifiedVerifier returns a Verifier that doesn't verify anything.
+// Instead, permission tokens whose string representation is a key in results
+// are marked as verified, with the corresponding caveat set as their verified
+// caveats. Other permission tokens fail with ErrNotPreverified. Discharge
+// tokens are ignored.
+//
+// THIS DOES NO CRYPTOGRAPHIC VERIFICATION. It is only safe if results came
+// from a party that did verify the tokens and if results reached the caller
+// through a channel that is itself authenticated (e.g. a signed assertion from
+// an upstream gateway). Whoever controls results controls authorization. The
+// caveat sets in results are trusted as-is, so they must include any
+// discharge caveats and attestations. Because of this, PreverifiedVerifier
+// panics unless the AllowInsecurePreverified option is provided.
+func PreverifiedVerifier(results map[string]*macaroon.CaveatSet, opts ...PreverifiedOption) Verifier {
+	pv := &preverifiedVerifier{results: results}
+
+	for _, opt := range opts {
+		opt(pv)
+	}
+
+	if !pv.allowInsecure {
+		panic("PreverifiedVerifier requires the AllowInsecurePreverified option")
+	}
+
+	return VerifierFunc(pv.verifyOne)
+}
+
+func (pv *preverifiedVerifier) verifyOne(_ context.Context, perm Macaroon, _ []Macaroon) VerificationResult {
+	if cavs, ok := pv.results[perm.String()]; ok && cavs != nil {
+		return &VerifiedMacaroon{perm.Unverified(), cavs}
+	}
+
+	return &FailedMacaroon{perm.Unverified(), ErrNotPreverified}
+}
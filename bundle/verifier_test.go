@@ -0,0 +1,399 @@
+package bundle
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alecthomas/assert/v2"
+	"github.com/superfly/macaroon"
+	"github.com/superfly/macaroon/auth"
+)
+
+func TestResolverChain(t *testing.T) {
+	t.Parallel()
+
+	attestation := macaroon.Caveat(ptr(auth.FlyioUserID(123)))
+	toks := macOpts{tpOpts: []tpOpt{{discharge: true, dcavs: []macaroon.Caveat{attestation}}}}.tokens(t)
+
+	signing := func(_ context.Context, nonce macaroon.Nonce) (macaroon.SigningKey, error) {
+		if string(nonce.KID) != string(permKID) {
+			return nil, errors.New("bad kid")
+		}
+		return permKey, nil
+	}
+
+	verify := func(tb testing.TB, kr KeyResolver) ([]*macaroon.CaveatSet, error) {
+		tb.Helper()
+
+		bun, err := ParseBundle(permLoc, toks.String())
+		assert.NoError(tb, err)
+
+		return bun.Verify(context.Background(), kr)
+	}
+
+	t.Run("dynamic trusted set", func(t *testing.T) {
+		t.Parallel()
+
+		trustedTPs := map[string][]macaroon.EncryptionKey{}
+		kr := ResolverChain(signing, func(context.Context, macaroon.Nonce) (map[string][]macaroon.EncryptionKey, error) {
+			return trustedTPs, nil
+		})
+
+		vcavs, err := verify(t, kr)
+		assert.NoError(t, err)
+		assert.False(t, cavsHasCaveat(vcavs[0].Caveats, attestation))
+
+		trustedTPs = map[string][]macaroon.EncryptionKey{tpLoc: {tpKey}}
+
+		vcavs, err = verify(t, kr)
+		assert.NoError(t, err)
+		assert.True(t, cavsHasCaveat(vcavs[0].Caveats, attestation))
+	})
+
+	t.Run("signing error", func(t *testing.T) {
+		t.Parallel()
+
+		kr := ResolverChain(func(context.Context, macaroon.Nonce) (macaroon.SigningKey, error) {
+			return nil, errors.New("no key")
+		}, nil)
+
+		_, err := verify(t, kr)
+		assert.Error(t, err)
+	})
+
+	t.Run("lenient trusted error", func(t *testing.T) {
+		t.Parallel()
+
+		kr := ResolverChain(signing, func(context.Context, macaroon.Nonce) (map[string][]macaroon.EncryptionKey, error) {
+			return nil, errors.New("tenant db down")
+		})
+
+		vcavs, err := verify(t, kr)
+		assert.NoError(t, err)
+		assert.False(t, cavsHasCaveat(vcavs[0].Caveats, attestation))
+	})
+
+	t.Run("strict trusted error", func(t *testing.T) {
+		t.Parallel()
+
+		kr := ResolverChain(signing, func(context.Context, macaroon.Nonce) (map[string][]macaroon.EncryptionKey, error) {
+			return nil, errors.New("tenant db down")
+		}, WithStrictTrustedTPs())
+
+		_, err := verify(t, kr)
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "tenant db down")
+	})
+}
+
+func TestCacheTrustedTPs(t *testing.T) {
+	t.Parallel()
+
+	var (
+		calls   int
+		fail    bool
+		nonce   = macaroon.Nonce{}
+		trusted = map[string][]macaroon.EncryptionKey{tpLoc: {tpKey}}
+	)
+
+	cached := CacheTrustedTPs(func(context.Context, macaroon.Nonce) (map[string][]macaroon.EncryptionKey, error) {
+		calls++
+		if fail {
+			return nil, errors.New("fail")
+		}
+		return trusted, nil
+	}, time.Hour, 10)
+
+	fail = true
+	_, err := cached(context.Background(), nonce)
+	assert.Error(t, err)
+	assert.Equal(t, 1, calls)
+
+	// errors aren't cached
+	fail = false
+	res, err := cached(context.Background(), nonce)
+	assert.NoError(t, err)
+	assert.Equal(t, trusted, res)
+	assert.Equal(t, 2, calls)
+
+	res, err = cached(context.Background(), nonce)
+	assert.NoError(t, err)
+	assert.Equal(t, trusted, res)
+	assert.Equal(t, 2, calls)
+
+	// expired entries are refreshed
+	expiring := CacheTrustedTPs(func(context.Context, macaroon.Nonce) (map[string][]macaroon.EncryptionKey, error) {
+		calls++
+		return trusted, nil
+	}, -time.Second, 10)
+
+	_, err = expiring(context.Background(), nonce)
+	assert.NoError(t, err)
+	_, err = expiring(context.Background(), nonce)
+	assert.NoError(t, err)
+	assert.Equal(t, 4, calls)
+}
+
+func TestChunkedVerifier(t *testing.T) {
+	t.Parallel()
+
+	var toks tokens
+	for i := 0; i < 7; i++ {
+		toks = append(toks, macOpts{tpOpts: []tpOpt{{discharge: true}}}.tokens(t)...)
+	}
+
+	verify := func(tb testing.TB, v Verifier) (verified, failed int) {
+		tb.Helper()
+
+		bun, err := ParseBundle(permLoc, toks.String())
+		assert.NoError(tb, err)
+
+		bun.Verify(context.Background(), v)
+
+		return bun.Count(IsVerifiedMacaroon), bun.Count(IsFailedMacaroon)
+	}
+
+	kr := WithKey(permKID, permKey, nil)
+
+	t.Run("sequential", func(t *testing.T) {
+		t.Parallel()
+
+		var batchSizes []int
+		inner := verifierFunc(func(ctx context.Context, dissByPerm map[Macaroon][]Macaroon) map[Macaroon]VerificationResult {
+			batchSizes = append(batchSizes, len(dissByPerm))
+
+			// fail the second batch
+			if len(batchSizes) == 2 {
+				ret := make(map[Macaroon]VerificationResult, len(dissByPerm))
+				for perm := range dissByPerm {
+					ret[perm] = &FailedMacaroon{perm.Unverified(), errors.New("batch failed")}
+				}
+				return ret
+			}
+
+			return kr.Verify(ctx, dissByPerm)
+		})
+
+		verified, failed := verify(t, ChunkedVerifier(inner, 3))
+		assert.Equal(t, []int{3, 3, 1}, batchSizes)
+		assert.Equal(t, 4, verified)
+		assert.Equal(t, 3, failed)
+	})
+
+	t.Run("concurrent", func(t *testing.T) {
+		t.Parallel()
+
+		var (
+			m          sync.Mutex
+			batchSizes []int
+		)
+		inner := verifierFunc(func(ctx context.Context, dissByPerm map[Macaroon][]Macaroon) map[Macaroon]VerificationResult {
+			m.Lock()
+			batchSizes = append(batchSizes, len(dissByPerm))
+			m.Unlock()
+
+			return kr.Verify(ctx, dissByPerm)
+		})
+
+		verified, failed := verify(t, ChunkedVerifier(inner, 2, WithConcurrency(3)))
+		sort.Ints(batchSizes)
+		assert.Equal(t, []int{1, 2, 2, 2}, batchSizes)
+		assert.Equal(t, 7, verified)
+		assert.Equal(t, 0, failed)
+	})
+
+	t.Run("small bundle", func(t *testing.T) {
+		t.Parallel()
+
+		var calls int
+		inner := verifierFunc(func(ctx context.Context, dissByPerm map[Macaroon][]Macaroon) map[Macaroon]VerificationResult {
+			calls++
+			return kr.Verify(ctx, dissByPerm)
+		})
+
+		verified, _ := verify(t, ChunkedVerifier(inner, 10))
+		assert.Equal(t, 1, calls)
+		assert.Equal(t, 7, verified)
+	})
+}
+
+func TestWithKeyLength(t *testing.T) {
+	t.Parallel()
+
+	toks := macOpts{tpOpts: []tpOpt{{discharge: true}}}.tokens(t)
+
+	verify := func(tb testing.TB, kr KeyResolver) error {
+		tb.Helper()
+
+		bun, err := ParseBundle(permLoc, toks.String())
+		assert.NoError(tb, err)
+
+		_, err = bun.Verify(context.Background(), kr)
+		return err
+	}
+
+	t.Run("zero after use", func(t *testing.T) {
+		key := append(macaroon.SigningKey{}, permKey...)
+		kr := WithKey(permKID, key, nil)
+
+		for i := range key {
+			key[i] = 0
+		}
+
+		assert.NoError(t, verify(t, kr))
+	})
+
+	t.Run("short signing key", func(t *testing.T) {
+		err := verify(t, WithKey(permKID, permKey[:16], nil))
+		assert.IsError(t, err, macaroon.ErrBadKeyLength)
+	})
+
+	t.Run("long trusted key", func(t *testing.T) {
+		tpKey := append(macaroon.NewEncryptionKey(), 0)
+		err := verify(t, WithKey(permKID, permKey, map[string][]macaroon.EncryptionKey{"https://tp": {tpKey}}))
+
+		var kle *macaroon.KeyLengthError
+		assert.True(t, errors.As(err, &kle))
+		assert.Equal(t, "encryption", kle.Kind)
+		assert.Equal(t, macaroon.EncryptionKeySize+1, kle.Have)
+	})
+}
+
+type verifierFunc func(context.Context, map[Macaroon][]Macaroon) map[Macaroon]VerificationResult
+
+func (vf verifierFunc) Verify(ctx context.Context, dissByPerm map[Macaroon][]Macaroon) map[Macaroon]VerificationResult {
+	return vf(ctx, dissByPerm)
+}
+
+func TestVerificationCache(t *testing.T) {
+	t.Parallel()
+
+	var (
+		toks1 = macOpts{}.tokens(t)
+		toks2 = macOpts{tpOpts: []tpOpt{{discharge: true}}}.tokens(t)
+		kr    = WithKey(permKID, permKey, nil)
+		calls int
+	)
+
+	vc := NewVerificationCache(verifierFunc(func(ctx context.Context, dissByPerm map[Macaroon][]Macaroon) map[Macaroon]VerificationResult {
+		calls += len(dissByPerm)
+		return kr.Verify(ctx, dissByPerm)
+	}), time.Hour, 10)
+
+	verify := func(tb testing.TB, ctx context.Context, toks tokens) *Bundle {
+		tb.Helper()
+
+		bun, err := ParseBundle(permLoc, toks.String())
+		assert.NoError(tb, err)
+
+		_, err = bun.Verify(ctx, vc)
+		assert.NoError(tb, err)
+
+		return bun
+	}
+
+	perm := func(bun *Bundle) Macaroon {
+		return bun.Select(bun.IsPermissionToken).ts[0].(Macaroon)
+	}
+
+	ctx := WithCacheStatus(context.Background())
+	bun := verify(t, ctx, toks1)
+	assert.False(t, WasCached(ctx, perm(bun)))
+	assert.Equal(t, 1, calls)
+	assert.Equal(t, VerificationCacheStats{Misses: 1}, vc.Stats())
+
+	ctx = WithCacheStatus(context.Background())
+	bun = verify(t, ctx, toks1)
+	assert.True(t, WasCached(ctx, perm(bun)))
+	assert.Equal(t, 1, calls)
+	assert.Equal(t, VerificationCacheStats{Hits: 1, Misses: 1}, vc.Stats())
+
+	// results are only recorded for tokens verified with the context
+	bun2 := verify(t, ctx, toks2)
+	assert.False(t, WasCached(ctx, perm(bun2)))
+	assert.True(t, WasCached(ctx, perm(bun)))
+	assert.False(t, WasCached(context.Background(), perm(bun)))
+	assert.Equal(t, 2, calls)
+	assert.Equal(t, VerificationCacheStats{Hits: 1, Misses: 2}, vc.Stats())
+
+	// bypassing verifies afresh
+	ctx = WithCacheStatus(WithBypassCache(context.Background()))
+	bun = verify(t, ctx, toks1)
+	assert.False(t, WasCached(ctx, perm(bun)))
+	assert.Equal(t, 3, calls)
+	assert.Equal(t, VerificationCacheStats{Hits: 1, Misses: 2, Bypassed: 1}, vc.Stats())
+
+	// fresh results from bypassed calls are still cached
+	vc.Purge()
+	verify(t, WithBypassCache(context.Background()), toks2)
+	assert.Equal(t, 4, calls)
+
+	ctx = WithCacheStatus(context.Background())
+	bun2 = verify(t, ctx, toks2)
+	assert.True(t, WasCached(ctx, perm(bun2)))
+	assert.Equal(t, 4, calls)
+	assert.Equal(t, VerificationCacheStats{Hits: 2, Misses: 2, Bypassed: 2}, vc.Stats())
+}
+
+func TestPreverifiedVerifier(t *testing.T) {
+	t.Parallel()
+
+	var (
+		toksA = macOpts{}.tokens(t)
+		toksB = macOpts{}.tokens(t)
+		cavs  = macaroon.NewCaveatSet(ptr(auth.FlyioUserID(123)))
+	)
+
+	assert.Panics(t, func() { PreverifiedVerifier(nil) })
+
+	// tamper with A's caveats without updating its signature
+	tampered, err := toksA[0].(*UnverifiedMacaroon).UnsafeMac.Clone()
+	assert.NoError(t, err)
+	tampered.UnsafeCaveats = *macaroon.NewCaveatSet(ptr(auth.FlyioUserID(456)))
+	tamperedStr, err := tampered.String()
+	assert.NoError(t, err)
+
+	v := PreverifiedVerifier(map[string]*macaroon.CaveatSet{toksA.String(): cavs}, AllowInsecurePreverified())
+
+	t.Run("matched", func(t *testing.T) {
+		bun, err := ParseBundle(permLoc, toksA.String())
+		assert.NoError(t, err)
+
+		vcavs, err := bun.Verify(context.Background(), v)
+		assert.NoError(t, err)
+		assert.Equal(t, []*macaroon.CaveatSet{cavs}, vcavs)
+	})
+
+	t.Run("unmatched", func(t *testing.T) {
+		bun, err := ParseBundle(permLoc, String(toksA[0], toksB[0]))
+		assert.NoError(t, err)
+
+		vcavs, err := bun.Verify(context.Background(), v)
+		assert.NoError(t, err)
+		assert.Equal(t, []*macaroon.CaveatSet{cavs}, vcavs)
+
+		errs := Map(bun, func(fm *FailedMacaroon) error { return fm.Err })
+		assert.Equal(t, 1, len(errs))
+		assert.IsError(t, errs[0], ErrNotPreverified)
+	})
+
+	t.Run("tampered", func(t *testing.T) {
+		bun, err := ParseBundle(permLoc, tamperedStr)
+		assert.NoError(t, err)
+
+		_, err = bun.Verify(context.Background(), v)
+		assert.Error(t, err)
+
+		errs := Map(bun, func(fm *FailedMacaroon) error { return fm.Err })
+		assert.Equal(t, 1, len(errs))
+		assert.IsError(t, errs[0], ErrNotPreverified)
+	})
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
@@ -0,0 +1,165 @@
+package macaroon
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"reflect"
+
+	"github.com/vmihailenco/msgpack/v5"
+	"golang.org/x/exp/constraints"
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
+)
+
+// CanonicalMap is a map whose msgpack encoding is deterministic. Go randomizes
+// map iteration order, so a caveat containing a plain map encodes differently
+// from one run to the next, giving the same logical caveat different
+// signatures. Caveats with map fields should use CanonicalMap (or implement
+// their own canonical encoding). Entries are encoded in key order. The JSON
+// encoding is that of a plain map, which encoding/json already sorts by key.
+type CanonicalMap[K constraints.Ordered, V any] map[K]V
+
+var _ msgpack.CustomEncoder = CanonicalMap[string, string](nil)
+
+// Implements msgpack.CustomEncoder
+func (m CanonicalMap[K, V]) EncodeMsgpack(enc *msgpack.Encoder) error {
+	if m == nil {
+		return enc.EncodeNil()
+	}
+
+	if err := enc.EncodeMapLen(len(m)); err != nil {
+		return err
+	}
+
+	keys := maps.Keys(m)
+	slices.Sort(keys)
+
+	for _, k := range keys {
+		if err := enc.Encode(k); err != nil {
+			return err
+		}
+		if err := enc.Encode(m[k]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// DebugCaveatEncoding causes caveat registration to panic if the caveat type's
+// msgpack encoding isn't deterministic. See CheckCanonicalEncoding. Because
+// most caveats are registered from init functions, this is mostly useful for
+// caveat types registered later, e.g. in tests. It shouldn't be set in
+// production.
+var DebugCaveatEncoding = false
+
+// checkCanonicalEncodingRounds is how many times the randomly populated caveat
+// is encoded. A map with several entries is unlikely to be iterated in the
+// same order this many times.
+const checkCanonicalEncodingRounds = 16
+
+// CheckCanonicalEncoding checks that caveats of the same type as zeroValue
+// encode deterministically. It encodes the zero value twice and then encodes a
+// new caveat, with its exported fields randomly populated via reflection,
+// several times, returning an error if any of the encodings differ. Random
+// values that the caveat refuses to encode are ignored. Passing this check
+// doesn't prove that an encoding is canonical, but it catches the common
+// mistake of including a plain map in a caveat. Users may call this from
+// tests of their caveat types.
+func CheckCanonicalEncoding(zeroValue Caveat) error {
+	if err := checkDeterministic(zeroValue, 2); err != nil {
+		return err
+	}
+
+	return checkDeterministic(randomCaveat(zeroValue), checkCanonicalEncodingRounds)
+}
+
+func checkDeterministic(c Caveat, rounds int) error {
+	first, err := encode(NewCaveatSet(c))
+	if err != nil {
+		return nil
+	}
+
+	for i := 1; i < rounds; i++ {
+		again, err := encode(NewCaveatSet(c))
+		if err != nil {
+			return nil
+		}
+		if !bytes.Equal(first, again) {
+			return fmt.Errorf("%w: %s caveat has non-deterministic encoding", ErrBadCaveat, c.Name())
+		}
+	}
+
+	return nil
+}
+
+// randomCaveat allocates a new caveat of the same type as zeroValue and
+// populates its exported fields with random values.
+func randomCaveat(zeroValue Caveat) Caveat {
+	ct := reflect.TypeOf(zeroValue)
+	if ct.Kind() == reflect.Pointer {
+		v := reflect.New(ct.Elem())
+		randomize(v.Elem(), 0)
+		return v.Interface().(Caveat)
+	}
+
+	v := reflect.New(ct).Elem()
+	randomize(v, 0)
+	return v.Interface().(Caveat)
+}
+
+const (
+	randomizeMaxDepth = 4
+	randomizeMaxLen   = 8
+)
+
+func randomize(v reflect.Value, depth int) {
+	if depth > randomizeMaxDepth || !v.CanSet() {
+		return
+	}
+
+	switch v.Kind() {
+	case reflect.Bool:
+		v.SetBool(rand.Intn(2) == 1)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		v.SetInt(rand.Int63n(128))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		v.SetUint(uint64(rand.Int63n(128)))
+	case reflect.Float32, reflect.Float64:
+		v.SetFloat(rand.Float64())
+	case reflect.String:
+		v.SetString(fmt.Sprintf("%x", rand.Int63()))
+	case reflect.Pointer:
+		p := reflect.New(v.Type().Elem())
+		randomize(p.Elem(), depth+1)
+		v.Set(p)
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			randomize(v.Field(i), depth+1)
+		}
+	case reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			randomize(v.Index(i), depth+1)
+		}
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Interface {
+			return
+		}
+		s := reflect.MakeSlice(v.Type(), randomizeMaxLen, randomizeMaxLen)
+		for i := 0; i < s.Len(); i++ {
+			randomize(s.Index(i), depth+1)
+		}
+		v.Set(s)
+	case reflect.Map:
+		m := reflect.MakeMap(v.Type())
+		for i := 0; i < randomizeMaxLen; i++ {
+			k := reflect.New(v.Type().Key()).Elem()
+			e := reflect.New(v.Type().Elem()).Elem()
+			randomize(k, depth+1)
+			randomize(e, depth+1)
+			m.SetMapIndex(k, e)
+		}
+		v.Set(m)
+	}
+}
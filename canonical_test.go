@@ -0,0 +1,82 @@
+package macaroon
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/alecthomas/assert/v2"
+)
+
+type testMapCaveat struct {
+	Labels CanonicalMap[string, string] `json:"labels"`
+	Counts CanonicalMap[int, []string]  `json:"counts"`
+}
+
+func (c *testMapCaveat) CaveatType() CaveatType   { return CavMinUserDefined + 2000 }
+func (c *testMapCaveat) Name() string             { return "TestMap" }
+func (c *testMapCaveat) Prohibits(f Access) error { return nil }
+
+type testPlainMapCaveat struct {
+	Labels map[string]string `json:"labels"`
+}
+
+func (c *testPlainMapCaveat) CaveatType() CaveatType   { return CavMinUserDefined + 2001 }
+func (c *testPlainMapCaveat) Name() string             { return "TestPlainMap" }
+func (c *testPlainMapCaveat) Prohibits(f Access) error { return nil }
+
+func TestCanonicalMap(t *testing.T) {
+	RegisterCaveatType(&testMapCaveat{})
+	t.Cleanup(func() { unregisterCaveatType(&testMapCaveat{}) })
+
+	c := &testMapCaveat{
+		Labels: CanonicalMap[string, string]{"c": "3", "a": "1", "b": "2", "e": "5", "d": "4"},
+		Counts: CanonicalMap[int, []string]{3: {"x"}, 1: {"y", "z"}, 2: nil},
+	}
+	cs := NewCaveatSet(c)
+
+	first, err := cs.MarshalMsgpack()
+	assert.NoError(t, err)
+	for i := 0; i < 16; i++ {
+		again, err := cs.MarshalMsgpack()
+		assert.NoError(t, err)
+		assert.Equal(t, first, again)
+	}
+
+	cs2, err := DecodeCaveats(first)
+	assert.NoError(t, err)
+	assert.Equal(t, cs, cs2)
+
+	j, err := json.Marshal(cs)
+	assert.NoError(t, err)
+	cs2 = NewCaveatSet()
+	assert.NoError(t, json.Unmarshal(j, cs2))
+	assert.Equal(t, cs, cs2)
+
+	// nil maps survive
+	cs = NewCaveatSet(&testMapCaveat{})
+	b, err := cs.MarshalMsgpack()
+	assert.NoError(t, err)
+	cs2, err = DecodeCaveats(b)
+	assert.NoError(t, err)
+	assert.Equal(t, cs, cs2)
+}
+
+func TestCheckCanonicalEncoding(t *testing.T) {
+	assert.NoError(t, CheckCanonicalEncoding(&testMapCaveat{}))
+	assert.NoError(t, CheckCanonicalEncoding(&testCaveatParentResource{}))
+	assert.IsError(t, CheckCanonicalEncoding(&testPlainMapCaveat{}), ErrBadCaveat)
+
+	for typ, newCaveat := range t2c {
+		assert.NoError(t, CheckCanonicalEncoding(newCaveat()), "%d", typ)
+	}
+
+	DebugCaveatEncoding = true
+	t.Cleanup(func() { DebugCaveatEncoding = false })
+
+	assert.Panics(t, func() { RegisterCaveatType(&testPlainMapCaveat{}) })
+	_, registered := t2c[(&testPlainMapCaveat{}).CaveatType()]
+	assert.False(t, registered)
+
+	RegisterCaveatType(&testMapCaveat{})
+	unregisterCaveatType(&testMapCaveat{})
+}
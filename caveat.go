@@ -1,8 +1,13 @@
 package macaroon
 
 import (
+	"encoding/json"
+	"fmt"
 	"reflect"
 	"strconv"
+	"strings"
+
+	"golang.org/x/exp/slices"
 )
 
 // A numeric identifier for caveat types. Values less than
@@ -44,6 +49,24 @@ const (
 	CavFlyioAppFeatureSet
 	CavFlyioStorageObjects
 	CavAllowedRoles
+	CavFlyioOrgSlug
+	CavFlyioAppNames
+	CavFlyioSourceNetworks
+	CavRequire
+	CavFlyioOIDCAudiences
+	CavFlyioQueries
+	CavAuthConfineMachine
+	AttestationFlyioMachineIdentity
+	CavFlyioMaxSpendCents
+	CavAuthConfineAnyOf
+	CavScopedToLocation
+	CavFlyioReadOnly
+	CavFlyioAppVolumes
+	CavFlyioAppMachines
+	CavUsageLimit
+	CavFlyioFeatureDependency
+	CavFlyioRequire3PForActions
+	AttestationFlyioApproval
 
 	// allocate internal blocks of size 255 here
 	block255Min    CaveatType = 1 << 16
@@ -64,6 +87,12 @@ const (
 )
 
 // Caveat is the interface implemented by all caveats.
+//
+// Caveats are signed in their msgpack encoding, so a caveat's encoding must be
+// canonical: the same caveat must always encode to the same bytes. Beware of
+// map fields, which msgpack encodes in Go's random iteration order. Use
+// CanonicalMap instead, or implement msgpack.CustomEncoder. See
+// CheckCanonicalEncoding.
 type Caveat interface {
 	// The numeric caveat type identifier.
 	CaveatType() CaveatType
@@ -102,13 +131,144 @@ type WrapperCaveat interface {
 }
 
 var (
-	t2c = map[CaveatType]Caveat{}
+	t2c = map[CaveatType]func() Caveat{}
 	s2t = map[string]CaveatType{}
 	t2s = map[CaveatType]string{}
+
+	// JSON names to emit instead of the canonical name. See
+	// SetCaveatJSONEmitName.
+	t2e = map[CaveatType]string{}
 )
 
-// Register a caveat type for use with this library.
+// RegisterCaveatType registers a caveat type for use with this library. The
+// caveat type must be in the user-defined range (CavMinUserDefined through
+// CavMaxUserDefined). Globally-recognized types must be registered with
+// RegisterGlobalCaveatType. This panics if the type is outside of the
+// user-defined range or if it has already been registered.
 func RegisterCaveatType(zeroValue Caveat) {
+	checkUserCaveatType(zeroValue)
+	registerCaveatType(zeroValue, reflectConstructor(zeroValue))
+}
+
+func checkUserCaveatType(zeroValue Caveat) {
+	typ := zeroValue.CaveatType()
+
+	switch {
+	case typ >= CavMinUserDefined && typ <= CavMaxUserDefined:
+	case typ >= CavMinUserRegisterable && typ <= CavMaxUserRegisterable:
+		panic(fmt.Sprintf("caveat type %d (%s) is globally-recognized; register it with RegisterGlobalCaveatType", typ, zeroValue.Name()))
+	case typ < CavMinUserRegisterable:
+		panic(fmt.Sprintf("caveat type %d (%s) is reserved for fly.io; register it with RegisterReservedCaveatType", typ, zeroValue.Name()))
+	default:
+		panic(fmt.Sprintf("caveat type %d (%s) is not registerable", typ, zeroValue.Name()))
+	}
+}
+
+// RegisterGlobalCaveatType registers a globally-recognized caveat type. The
+// caveat type must be in the user-registerable range (CavMinUserRegisterable
+// through CavMaxUserRegisterable) and should have been allocated via a pull
+// request to this repository. This panics if the type is outside of the
+// user-registerable range or if it has already been registered.
+func RegisterGlobalCaveatType(zeroValue Caveat) {
+	checkGlobalCaveatType(zeroValue)
+	registerCaveatType(zeroValue, reflectConstructor(zeroValue))
+}
+
+func checkGlobalCaveatType(zeroValue Caveat) {
+	if typ := zeroValue.CaveatType(); typ < CavMinUserRegisterable || typ > CavMaxUserRegisterable {
+		panic(fmt.Sprintf("caveat type %d (%s) is not in the user-registerable range", typ, zeroValue.Name()))
+	}
+}
+
+// RegisterReservedCaveatType registers a caveat type from the range reserved
+// for fly.io (below CavMinUserRegisterable). Types below the internal blocks
+// may only be registered by packages in this module. Types in the internal
+// blocks may only be registered by fly.io packages. This panics if those
+// conditions aren't met or if the type has already been registered.
+func RegisterReservedCaveatType(zeroValue Caveat) {
+	checkReservedCaveatType(zeroValue)
+	registerCaveatType(zeroValue, reflectConstructor(zeroValue))
+}
+
+func checkReservedCaveatType(zeroValue Caveat) {
+	typ := zeroValue.CaveatType()
+	pkg := caveatPkgPath(zeroValue)
+
+	switch {
+	case typ < block255Min:
+		if !hasPathPrefix(pkg, modulePath) {
+			panic(fmt.Sprintf("caveat type %d (%s) is reserved for %s, not %s", typ, zeroValue.Name(), modulePath, pkg))
+		}
+	case typ <= block255Max:
+		if !hasPathPrefix(pkg, flyioPathPrefix) {
+			panic(fmt.Sprintf("caveat type %d (%s) is reserved for fly.io, not %s", typ, zeroValue.Name(), pkg))
+		}
+	default:
+		panic(fmt.Sprintf("caveat type %d (%s) is not in the reserved range", typ, zeroValue.Name()))
+	}
+}
+
+// RegisterLegacyCaveatType registers a caveat type from either the
+// user-registerable or user-defined ranges. It exists to ease migration for
+// callers that previously used RegisterCaveatType for both.
+//
+// Deprecated: use RegisterCaveatType or RegisterGlobalCaveatType.
+func RegisterLegacyCaveatType(zeroValue Caveat) {
+	if typ := zeroValue.CaveatType(); typ >= CavMinUserRegisterable && typ <= CavMaxUserRegisterable {
+		RegisterGlobalCaveatType(zeroValue)
+	} else {
+		RegisterCaveatType(zeroValue)
+	}
+}
+
+const (
+	modulePath      = "github.com/superfly/macaroon"
+	flyioPathPrefix = "github.com/superfly"
+)
+
+func caveatPkgPath(c Caveat) string {
+	t := reflect.TypeOf(c)
+	if t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	return t.PkgPath()
+}
+
+func hasPathPrefix(path, prefix string) bool {
+	return path == prefix || strings.HasPrefix(path, prefix+"/")
+}
+
+// RegisterCaveatConstructor registers a caveat type, using newCaveat to
+// construct values of the type when decoding. The type is registered according
+// to its range, as with RegisterCaveatType, RegisterGlobalCaveatType, and
+// RegisterReservedCaveatType. Unlike those functions, it doesn't rely on
+// reflection to allocate caveats, making it suitable for use with TinyGo.
+func RegisterCaveatConstructor(newCaveat func() Caveat) {
+	zeroValue := newCaveat()
+
+	switch typ := zeroValue.CaveatType(); {
+	case typ < CavMinUserRegisterable:
+		checkReservedCaveatType(zeroValue)
+	case typ <= CavMaxUserRegisterable:
+		checkGlobalCaveatType(zeroValue)
+	default:
+		checkUserCaveatType(zeroValue)
+	}
+
+	registerCaveatType(zeroValue, newCaveat)
+}
+
+// reflectConstructor returns a function allocating new caveats of the same
+// type as zeroValue.
+func reflectConstructor(zeroValue Caveat) func() Caveat {
+	ct := reflect.TypeOf(zeroValue)
+	if ct.Kind() == reflect.Pointer {
+		return func() Caveat { return reflect.New(ct.Elem()).Interface().(Caveat) }
+	}
+	return func() Caveat { return reflect.Zero(ct).Interface().(Caveat) }
+}
+
+func registerCaveatType(zeroValue Caveat, newCaveat func() Caveat) {
 	typ := zeroValue.CaveatType()
 	name := zeroValue.Name()
 
@@ -121,8 +281,13 @@ func RegisterCaveatType(zeroValue Caveat) {
 	if _, dup := s2t[name]; dup {
 		panic("duplicate caveat type")
 	}
+	if DebugCaveatEncoding {
+		if err := CheckCanonicalEncoding(newCaveat()); err != nil {
+			panic(err.Error())
+		}
+	}
 
-	t2c[typ] = zeroValue
+	t2c[typ] = newCaveat
 	t2s[typ] = name
 	s2t[name] = typ
 }
@@ -131,7 +296,9 @@ func unregisterCaveatType(zeroValue Caveat) {
 	typ := zeroValue.CaveatType()
 	name := zeroValue.Name()
 	delete(t2c, typ)
+	delete(t2v, typ)
 	delete(t2s, typ)
+	delete(t2e, typ)
 	delete(s2t, name)
 }
 
@@ -148,20 +315,44 @@ func RegisterCaveatJSONAlias(typ CaveatType, alias string) {
 }
 
 func unegisterCaveatJSONAlias(alias string) {
+	if typ, ok := s2t[alias]; ok && t2e[typ] == alias {
+		delete(t2e, typ)
+	}
 	delete(s2t, alias)
 }
 
+// SetCaveatJSONEmitName sets the name used for the caveat type when encoding
+// JSON. The name must be the type's canonical name or an alias registered with
+// RegisterCaveatJSONAlias. This allows a caveat to keep being encoded under a
+// legacy name while consumers of the JSON are migrated to the new one. Both
+// names are still recognized when decoding. Passing the canonical name restores
+// the default. User-defined caveat types are always encoded by number, so this
+// panics for them, as well as for unregistered types or names.
+func SetCaveatJSONEmitName(typ CaveatType, name string) {
+	if typ >= CavMinUserDefined {
+		panic("user-defined caveat types are encoded by number")
+	}
+	if _, exist := t2s[typ]; !exist {
+		panic("unregistered caveat type")
+	}
+	if t, ok := s2t[name]; !ok || t != typ {
+		panic("unregistered caveat name")
+	}
+
+	if name == t2s[typ] {
+		delete(t2e, typ)
+	} else {
+		t2e[typ] = name
+	}
+}
+
 func typeToCaveat(t CaveatType) Caveat {
-	cav, ok := t2c[t]
+	newCaveat, ok := t2c[t]
 	if !ok {
 		return &UnregisteredCaveat{Type: t}
 	}
 
-	ct := reflect.TypeOf(cav)
-	if ct.Kind() == reflect.Pointer {
-		return reflect.New(ct.Elem()).Interface().(Caveat)
-	}
-	return reflect.Zero(ct).Interface().(Caveat)
+	return newCaveat()
 }
 
 func caveatTypeFromString(s string) CaveatType {
@@ -176,8 +367,115 @@ func caveatTypeFromString(s string) CaveatType {
 }
 
 func caveatTypeToString(t CaveatType) string {
+	if s, ok := t2e[t]; ok && t < CavMinUserDefined {
+		return s
+	}
 	if s, ok := t2s[t]; ok && t < CavMinUserDefined {
 		return s
 	}
 	return strconv.FormatUint(uint64(t), 10)
 }
+
+// Caveat type ranges reported in CaveatInfo.Range.
+const (
+	// CaveatRangeReserved is types below CavMinUserRegisterable, which are
+	// reserved for fly.io.
+	CaveatRangeReserved = "reserved"
+
+	// CaveatRangeGlobal is types from CavMinUserRegisterable through
+	// CavMaxUserRegisterable.
+	CaveatRangeGlobal = "global"
+
+	// CaveatRangeUser is types from CavMinUserDefined through
+	// CavMaxUserDefined.
+	CaveatRangeUser = "user"
+)
+
+// CaveatInfo describes a registered caveat type. See RegisteredCaveats.
+type CaveatInfo struct {
+	Type CaveatType `json:"type"`
+
+	// Name is the caveat's JSON name, as returned by Caveat.Name.
+	Name string `json:"name"`
+
+	// Aliases are alternate names recognized when decoding JSON. See
+	// RegisterCaveatJSONAlias.
+	Aliases []string `json:"aliases,omitempty"`
+
+	// IsAttestation is whether the zero value of the caveat is an
+	// Attestation.
+	IsAttestation bool `json:"is_attestation"`
+
+	// Range is the range the type belongs to: CaveatRangeReserved,
+	// CaveatRangeGlobal, or CaveatRangeUser.
+	Range string `json:"range"`
+
+	// GoType is the Go type of the caveat (e.g. "*flyio.Organization").
+	GoType string `json:"go_type"`
+
+	// ZeroValue is the JSON encoding of the caveat's zero value, giving a
+	// sketch of its body's fields. It's empty if the zero value can't be
+	// encoded.
+	ZeroValue json.RawMessage `json:"zero_value,omitempty"`
+}
+
+// RegisteredCaveats returns information about every registered caveat type,
+// sorted by type. It is intended for tooling (e.g. documentation generators)
+// that needs to enumerate the caveats known to this binary.
+func RegisteredCaveats() []CaveatInfo {
+	aliases := make(map[CaveatType][]string)
+	for name, typ := range s2t {
+		if name != t2s[typ] {
+			aliases[typ] = append(aliases[typ], name)
+		}
+	}
+
+	infos := make([]CaveatInfo, 0, len(t2c))
+	for typ, newCaveat := range t2c {
+		c := newCaveat()
+
+		info := CaveatInfo{
+			Type:          typ,
+			Name:          t2s[typ],
+			Aliases:       aliases[typ],
+			IsAttestation: IsAttestation(c),
+			Range:         caveatRange(typ),
+			GoType:        reflect.TypeOf(c).String(),
+		}
+		slices.Sort(info.Aliases)
+
+		if j, err := json.Marshal(c); err == nil {
+			info.ZeroValue = j
+		}
+
+		infos = append(infos, info)
+	}
+
+	slices.SortFunc(infos, func(a, b CaveatInfo) bool { return a.Type < b.Type })
+
+	return infos
+}
+
+func caveatRange(typ CaveatType) string {
+	switch {
+	case typ < CavMinUserRegisterable:
+		return CaveatRangeReserved
+	case typ <= CavMaxUserRegisterable:
+		return CaveatRangeGlobal
+	default:
+		return CaveatRangeUser
+	}
+}
+
+// LookupCaveatName returns the JSON name of a registered caveat type.
+func LookupCaveatName(t CaveatType) (string, bool) {
+	name, ok := t2s[t]
+	return name, ok
+}
+
+// LookupCaveatType returns the registered caveat type with the JSON name or
+// alias.
+func LookupCaveatType(name string) (CaveatType, bool) {
+	typ, ok := s2t[name]
+	return typ, ok
+}
@@ -1,17 +1,33 @@
 package macaroon
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"reflect"
 
 	"github.com/superfly/macaroon/internal/merr"
 	msgpack "github.com/vmihailenco/msgpack/v5"
 )
 
-// CaveatSet is how a set of caveats is serailized/encoded.
+// CaveatSet is how a set of caveats is serailized/encoded. Its methods don't
+// modify it unless documented otherwise, so it's safe to use from several
+// goroutines as long as none of them modify it.
+//
+// Despite the name, Caveats is ordered, and the order matters: a macaroon's
+// signature covers its caveats in order. Caveats are kept in the order they
+// were added or decoded in, and are encoded in the same order. Index i of a
+// macaroon's UnsafeCaveats is covered by value i+1 of its signature chain.
+// See Macaroon.SignatureChain.
 type CaveatSet struct {
 	Caveats []Caveat
+
+	// attestedBy maps attestations from trusted discharges to the locations
+	// of the discharges. It is only set on caveat sets returned by
+	// Macaroon.Verify and its variants. See AttestationLocation.
+	attestedBy map[Caveat]string
 }
 
 var (
@@ -22,10 +38,10 @@ var (
 
 // Create a new CaveatSet comprised of the specified caveats.
 func NewCaveatSet(caveats ...Caveat) *CaveatSet {
-	return &CaveatSet{append([]Caveat{}, caveats...)}
+	return &CaveatSet{Caveats: append([]Caveat{}, caveats...)}
 }
 
-// Decodes a set of serialized caveats.
+// Decodes a set of serialized caveats. A nil array decodes to an empty set.
 func DecodeCaveats(buf []byte) (*CaveatSet, error) {
 	cavs := new(CaveatSet)
 
@@ -33,9 +49,53 @@ func DecodeCaveats(buf []byte) (*CaveatSet, error) {
 		return nil, err
 	}
 
+	if cavs.Caveats == nil {
+		cavs.Caveats = []Caveat{}
+	}
+
 	return cavs, nil
 }
 
+// AttestationLocation returns the location of the trusted third party whose
+// discharge contained the attestation cav, if c was returned by
+// Macaroon.Verify or one of its variants. Attestations can't vouch for their
+// own origin, so caveats relying on a particular third party's attestation
+// (e.g. flyio.Require3PForActions) should check this. It returns false if cav
+// isn't a verified attestation in c, including when c was decoded, cloned, or
+// constructed rather than verified.
+func (c *CaveatSet) AttestationLocation(cav Caveat) (string, bool) {
+	if c == nil || !isComparable(cav) {
+		return "", false
+	}
+
+	loc, ok := c.attestedBy[cav]
+	return loc, ok
+}
+
+// attest records that the attestation cav, which must be in c, is from a
+// trusted discharge at loc. Upgraded attestations are recorded under the
+// caveat they were upgraded to as well, since that's what RequireAttestation
+// returns.
+func (c *CaveatSet) attest(cav Caveat, loc string) {
+	if uc, upgraded := cav.(*UpgradedCaveat); upgraded {
+		c.attest(uc.Caveat, loc)
+	}
+
+	if !isComparable(cav) {
+		return
+	}
+
+	if c.attestedBy == nil {
+		c.attestedBy = map[Caveat]string{}
+	}
+
+	c.attestedBy[cav] = loc
+}
+
+func isComparable(cav Caveat) bool {
+	return cav != nil && reflect.TypeOf(cav).Comparable()
+}
+
 // Clone creates a deep copy of the CaveatSet by serializing and re-parsing it.
 func (c *CaveatSet) Clone() (*CaveatSet, error) {
 	buf, err := c.MarshalMsgpack()
@@ -46,13 +106,36 @@ func (c *CaveatSet) Clone() (*CaveatSet, error) {
 	return DecodeCaveats(buf)
 }
 
-// Validates that the caveat set permits the specified accesses.
+// Validates that the caveat set permits the specified accesses. Every caveat
+// is evaluated against every access and the returned error combines all the
+// failures. See ValidateFailFast.
 func (c *CaveatSet) Validate(accesses ...Access) error {
 	return Validate(c, accesses...)
 }
 
+// ValidateFailFast is like Validate, but stops evaluating caveats against an
+// access after the first one that prohibits it. Every access is still
+// checked. This is cheaper when access is denied, but the returned error only
+// describes the first failure for each access.
+func (c *CaveatSet) ValidateFailFast(accesses ...Access) error {
+	return validate(c, validateFailFast, accesses...)
+}
+
 // Helper for validating concretely-typed accesses.
 func Validate[A Access](cs *CaveatSet, accesses ...A) error {
+	return validate(cs, validateExhaustive, accesses...)
+}
+
+// validationMode determines whether validation continues after a caveat
+// prohibits an access.
+type validationMode int
+
+const (
+	validateExhaustive validationMode = iota
+	validateFailFast
+)
+
+func validate[A Access](cs *CaveatSet, mode validationMode, accesses ...A) error {
 	var err error
 	for _, access := range accesses {
 		if ferr := access.Validate(); ferr != nil {
@@ -60,20 +143,72 @@ func Validate[A Access](cs *CaveatSet, accesses ...A) error {
 			continue
 		}
 
-		err = merr.Append(err, cs.validateAccess(access))
+		err = merr.Append(err, cs.validateAccess(carryValidation(access, cs, mode), mode))
 	}
 
 	return err
 }
 
-func (c *CaveatSet) validateAccess(access Access) error {
+// CaveatSetCarrier is implemented by Accesses (e.g. flyio.Access) that can
+// carry the Validation they're part of. Caveats can't see the other caveats in
+// their set, so caveats that depend on them (e.g. flyio.FeatureDependency)
+// validate derived accesses against the carried Validation instead.
+// CaveatSet's validation methods validate copies of accesses that don't
+// already carry a Validation, leaving the caller's access untouched. Caveats
+// validating derived accesses must guard against unbounded recursion.
+type CaveatSetCarrier interface {
+	Access
+
+	// GetValidation returns the carried Validation, or nil.
+	GetValidation() *Validation
+
+	// WithValidation returns a shallow copy of the access carrying v.
+	WithValidation(v *Validation) Access
+}
+
+// Validation is an in-progress validation of accesses against a caveat set,
+// carried by accesses implementing CaveatSetCarrier.
+type Validation struct {
+	caveats *CaveatSet
+	mode    validationMode
+}
+
+// CaveatSet returns the caveat set being validated against.
+func (v *Validation) CaveatSet() *CaveatSet {
+	return v.caveats
+}
+
+// Validate validates an access derived from the one being validated against
+// the same caveat set, in the same mode (e.g. fail-fast).
+func (v *Validation) Validate(access Access) error {
+	return validate(v.caveats, v.mode, access)
+}
+
+// carryValidation returns a copy of access carrying a Validation against cs,
+// if it is a CaveatSetCarrier that doesn't already carry one.
+func carryValidation(access Access, cs *CaveatSet, mode validationMode) Access {
+	csc, ok := access.(CaveatSetCarrier)
+	if !ok || csc.GetValidation() != nil {
+		return access
+	}
+
+	return csc.WithValidation(&Validation{caveats: cs, mode: mode})
+}
+
+func (c *CaveatSet) validateAccess(access Access, mode validationMode) error {
 	var err error
 	for _, caveat := range c.Caveats {
 		if IsAttestation(caveat) {
 			continue
 		}
 
-		err = merr.Append(err, caveat.Prohibits(access))
+		if cerr := caveat.Prohibits(access); cerr != nil {
+			err = merr.Append(err, &CaveatError{Caveat: caveat, Access: access, Err: cerr})
+
+			if mode == validateFailFast {
+				return err
+			}
+		}
 	}
 
 	return err
@@ -82,6 +217,10 @@ func (c *CaveatSet) validateAccess(access Access) error {
 // GetCaveats gets any caveats of type T, including those nested within
 // IfPresent caveats.
 func GetCaveats[T Caveat](c *CaveatSet) (ret []T) {
+	if c == nil {
+		return nil
+	}
+
 	for _, cav := range c.Caveats {
 		if typed, ok := cav.(T); ok {
 			ret = append(ret, typed)
@@ -94,6 +233,85 @@ func GetCaveats[T Caveat](c *CaveatSet) (ret []T) {
 	return ret
 }
 
+// RequireAttestation returns the single attestation of type T from the
+// caveat set. ErrMissingAttestation is returned if there is none and
+// ErrDuplicateAttestation is returned if there are several (e.g. from
+// discharges from different third parties), since it would be ambiguous which
+// one to trust.
+func RequireAttestation[T Attestation](cs *CaveatSet) (T, error) {
+	var (
+		ret   T
+		found bool
+	)
+
+	for _, cav := range cs.Caveats {
+		if uc, upgraded := cav.(*UpgradedCaveat); upgraded {
+			cav = uc.Caveat
+		}
+
+		typed, ok := cav.(T)
+		if !ok || !typed.IsAttestation() {
+			continue
+		}
+
+		if found {
+			return ret, fmt.Errorf("%w: %s", ErrDuplicateAttestation, typed.Name())
+		}
+
+		ret, found = typed, true
+	}
+
+	if !found {
+		return ret, fmt.Errorf("%w: %s", ErrMissingAttestation, attestationName[T]())
+	}
+
+	return ret, nil
+}
+
+func attestationName[T Attestation]() string {
+	var zero T
+
+	switch t := reflect.TypeOf(&zero).Elem(); t.Kind() {
+	case reflect.Pointer:
+		// avoid calling methods on a nil pointer by finding the registered
+		// constructor for T.
+		for _, newCaveat := range t2c {
+			if cav, ok := newCaveat().(T); ok {
+				return cav.Name()
+			}
+		}
+		return t.String()
+	case reflect.Interface:
+		return t.String()
+	default:
+		return zero.Name()
+	}
+}
+
+// AttestationsOnly returns a new CaveatSet containing only the attestations
+// from cs.
+func AttestationsOnly(cs *CaveatSet) *CaveatSet {
+	ret := NewCaveatSet()
+	for _, cav := range cs.Caveats {
+		if IsAttestation(cav) {
+			ret.Caveats = append(ret.Caveats, cav)
+		}
+	}
+	return ret
+}
+
+// WithoutAttestations returns a new CaveatSet containing all but the
+// attestations from cs.
+func WithoutAttestations(cs *CaveatSet) *CaveatSet {
+	ret := NewCaveatSet()
+	for _, cav := range cs.Caveats {
+		if !IsAttestation(cav) {
+			ret.Caveats = append(ret.Caveats, cav)
+		}
+	}
+	return ret
+}
+
 // Implements msgpack.Marshaler
 func (c CaveatSet) MarshalMsgpack() ([]byte, error) {
 	return encode(c)
@@ -110,7 +328,7 @@ func (c CaveatSet) EncodeMsgpack(enc *msgpack.Encoder) error {
 			return err
 		}
 
-		if err := enc.Encode(cav); err != nil {
+		if err := encodeCaveatBody(enc, cav); err != nil {
 			return err
 		}
 	}
@@ -121,15 +339,23 @@ func (c CaveatSet) EncodeMsgpack(enc *msgpack.Encoder) error {
 // Implements msgpack.CustomDecoder
 func (c *CaveatSet) DecodeMsgpack(dec *msgpack.Decoder) error {
 	aLen, err := dec.DecodeArrayLen()
-	if err != nil {
+	switch {
+	case err != nil:
 		return err
-	}
-	if aLen%2 != 0 {
+	case aLen == -1:
+		// nil array is treated the same as an empty one
+		aLen = 0
+	case aLen%2 != 0:
 		return errors.New("bad caveat container")
 	}
 
 	nCavs := aLen / 2
 
+	// check before allocating, since the length comes from untrusted input
+	if err := checkMaxCaveats(len(c.Caveats) + nCavs); err != nil {
+		return err
+	}
+
 	if c.Caveats == nil {
 		c.Caveats = make([]Caveat, 0, nCavs)
 	}
@@ -140,9 +366,16 @@ func (c *CaveatSet) DecodeMsgpack(dec *msgpack.Decoder) error {
 			return err
 		}
 
-		cav := typeToCaveat(CaveatType(t))
-		if err := dec.Decode(cav); err != nil {
-			return err
+		var cav Caveat
+		if decoders, versioned := t2v[CaveatType(t)]; versioned {
+			if cav, err = decodeVersionedCaveat(CaveatType(t), decoders, dec); err != nil {
+				return err
+			}
+		} else {
+			cav = typeToCaveat(CaveatType(t))
+			if err := dec.Decode(cav); err != nil {
+				return err
+			}
 		}
 
 		c.Caveats = append(c.Caveats, cav)
@@ -176,27 +409,134 @@ func (c CaveatSet) MarshalJSON() ([]byte, error) {
 	return json.Marshal(jcavs)
 }
 
+// UnmarshalJSON implements json.Unmarshaler. Both null and an empty array
+// decode to an empty (non-nil) set.
 func (c *CaveatSet) UnmarshalJSON(b []byte) error {
-	jcavs := []jsonCaveat{}
+	var (
+		d    = NewCaveatSetJSONDecoder(bytes.NewReader(b))
+		cavs = []Caveat{}
+	)
 
-	if err := json.Unmarshal(b, &jcavs); err != nil {
-		return err
+	for {
+		cav, err := d.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		cavs = append(cavs, cav)
 	}
 
-	c.Caveats = make([]Caveat, len(jcavs))
-	for i := range jcavs {
-		t := caveatTypeFromString(jcavs[i].Type)
+	if _, err := d.dec.Token(); err != io.EOF {
+		return errors.New("unexpected data after caveat set")
+	}
 
-		c.Caveats[i] = typeToCaveat(t)
-		if err := json.Unmarshal(jcavs[i].Body, &c.Caveats[i]); err != nil {
-			return err
+	c.Caveats = cavs
+
+	return nil
+}
+
+// CaveatSetJSONDecoder decodes the JSON encoding of a CaveatSet one caveat at
+// a time, so that very large sets needn't be held in memory at once. Caveats
+// are decoded as by CaveatSet.UnmarshalJSON, with unknown types decoded as
+// UnregisteredCaveats.
+type CaveatSetJSONDecoder struct {
+	dec     *json.Decoder
+	started bool
+	err     error
+}
+
+// NewCaveatSetJSONDecoder returns a CaveatSetJSONDecoder reading a JSON
+// encoded CaveatSet from r. It doesn't read past the end of the set.
+func NewCaveatSetJSONDecoder(r io.Reader) *CaveatSetJSONDecoder {
+	return &CaveatSetJSONDecoder{dec: json.NewDecoder(r)}
+}
+
+// Next returns the next caveat in the set. After the last caveat, it returns
+// io.EOF. A null set has no caveats. Once Next returns an error, it keeps
+// returning the same error.
+func (d *CaveatSetJSONDecoder) Next() (Caveat, error) {
+	if d.err != nil {
+		return nil, d.err
+	}
+
+	cav, err := d.next()
+	if err != nil {
+		d.err = err
+	}
+
+	return cav, err
+}
+
+func (d *CaveatSetJSONDecoder) next() (Caveat, error) {
+	if !d.started {
+		d.started = true
+
+		tok, err := d.dec.Token()
+		switch {
+		case err == io.EOF:
+			return nil, io.ErrUnexpectedEOF
+		case err != nil:
+			return nil, err
+		case tok == nil:
+			return nil, io.EOF
+		case tok != json.Delim('['):
+			return nil, fmt.Errorf("unexpected %v in caveat set, expected array", tok)
 		}
 	}
 
-	return nil
+	if !d.dec.More() {
+		// consume the closing bracket
+		switch _, err := d.dec.Token(); err {
+		case nil:
+			return nil, io.EOF
+		case io.EOF:
+			return nil, io.ErrUnexpectedEOF
+		default:
+			return nil, err
+		}
+	}
+
+	var jc jsonCaveat
+	if err := d.dec.Decode(&jc); err != nil {
+		return nil, err
+	}
+
+	return jc.caveat()
+}
+
+// DecodeCaveatsJSONStream calls fn with each caveat in the JSON encoded
+// CaveatSet read from r, stopping at the first error returned by fn.
+func DecodeCaveatsJSONStream(r io.Reader, fn func(Caveat) error) error {
+	d := NewCaveatSetJSONDecoder(r)
+
+	for {
+		cav, err := d.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if err := fn(cav); err != nil {
+			return err
+		}
+	}
 }
 
 type jsonCaveat struct {
 	Type string          `json:"type"`
 	Body json.RawMessage `json:"body"`
 }
+
+func (jc *jsonCaveat) caveat() (Caveat, error) {
+	cav := typeToCaveat(caveatTypeFromString(jc.Type))
+	if err := json.Unmarshal(jc.Body, &cav); err != nil {
+		return nil, err
+	}
+
+	return cav, nil
+}
@@ -1,7 +1,13 @@
 package macaroon
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
 	"testing"
 
 	"github.com/alecthomas/assert/v2"
@@ -43,3 +49,354 @@ func TestCaveatSerialization(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, cs, cs2)
 }
+
+func TestCaveatSetOrder(t *testing.T) {
+	// the order of caveats is signed, so it must survive every encoding
+	cavs := []Caveat{
+		cavParent(ActionRead, 3),
+		cavParent(ActionRead, 1),
+		&ValidityWindow{NotBefore: 123, NotAfter: 234},
+		cavParent(ActionRead, 2),
+	}
+
+	cs := NewCaveatSet(cavs[:2]...)
+	cs.Caveats = append(cs.Caveats, cavs[2:]...)
+
+	packed, err := cs.MarshalMsgpack()
+	assert.NoError(t, err)
+	fromPack, err := DecodeCaveats(packed)
+	assert.NoError(t, err)
+	assert.Equal(t, cavs, fromPack.Caveats)
+
+	js, err := json.Marshal(cs)
+	assert.NoError(t, err)
+	fromJSON := NewCaveatSet()
+	assert.NoError(t, json.Unmarshal(js, fromJSON))
+	assert.Equal(t, cavs, fromJSON.Caveats)
+
+	key := NewSigningKey()
+	m, err := New(rbuf(10), "loc", key)
+	assert.NoError(t, err)
+	for _, c := range cavs {
+		assert.NoError(t, m.Add(c))
+	}
+	assert.Equal(t, cavs, m.UnsafeCaveats.Caveats)
+
+	tok, err := m.Encode()
+	assert.NoError(t, err)
+	dm, err := Decode(tok)
+	assert.NoError(t, err)
+	assert.Equal(t, cavs, dm.UnsafeCaveats.Caveats)
+
+	verified, err := dm.Verify(key, nil, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, cavs, verified.Caveats)
+}
+
+func TestEmptyCaveatSet(t *testing.T) {
+	for name, b := range map[string][]byte{
+		"nil":   {0xc0},
+		"empty": {0x90},
+	} {
+		t.Run("msgpack "+name, func(t *testing.T) {
+			cs, err := DecodeCaveats(b)
+			assert.NoError(t, err)
+			assert.Equal(t, NewCaveatSet(), cs)
+			assert.True(t, cs.Caveats != nil)
+		})
+	}
+
+	for _, j := range []string{"null", "[]"} {
+		t.Run("json "+j, func(t *testing.T) {
+			cs := new(CaveatSet)
+			assert.NoError(t, json.Unmarshal([]byte(j), cs))
+			assert.Equal(t, NewCaveatSet(), cs)
+			assert.True(t, cs.Caveats != nil)
+
+			m := new(Macaroon)
+			assert.NoError(t, json.Unmarshal([]byte(`{"location":"loc","caveats":`+j+`}`), m))
+			assert.Equal(t, NewCaveatSet(), &m.UnsafeCaveats)
+		})
+	}
+
+	assert.Zero(t, GetCaveats[*ValidityWindow](nil))
+}
+
+// largeCaveatSetJSON returns the JSON encoding of a large CaveatSet, including
+// unregistered caveats.
+func largeCaveatSetJSON(tb testing.TB, n int) []byte {
+	tb.Helper()
+
+	var buf bytes.Buffer
+	buf.WriteByte('[')
+
+	for i := 0; i < n; i++ {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+
+		switch i % 4 {
+		case 0:
+			fmt.Fprintf(&buf, `{"type":"ValidityWindow","body":{"not_before":%d,"not_after":%d}}`, i, i+1)
+		case 1:
+			fmt.Fprintf(&buf, `{"body":"%s","type":"BindToParentToken"}`, strings.Repeat("AQID", i%100))
+		case 2:
+			fmt.Fprintf(&buf, `{"type":"%d","body":{"i":%d}}`, CavMinUserDefined+1234, i)
+		case 3:
+			fmt.Fprintf(&buf, `{"type":"SomeFutureCaveat","body":[%d]}`, i)
+		}
+	}
+
+	buf.WriteByte(']')
+
+	return buf.Bytes()
+}
+
+func TestCaveatSetJSONDecoder(t *testing.T) {
+	j := largeCaveatSetJSON(t, 5000)
+
+	batch := new(CaveatSet)
+	assert.NoError(t, json.Unmarshal(j, batch))
+	assert.Equal(t, 5000, len(batch.Caveats))
+
+	d := NewCaveatSetJSONDecoder(bytes.NewReader(j))
+	for i := range batch.Caveats {
+		cav, err := d.Next()
+		assert.NoError(t, err)
+		assert.Equal(t, batch.Caveats[i], cav, "caveat %d", i)
+	}
+
+	_, err := d.Next()
+	assert.Equal(t, io.EOF, err)
+	_, err = d.Next()
+	assert.Equal(t, io.EOF, err)
+
+	uc, ok := batch.Caveats[2].(*UnregisteredCaveat)
+	assert.True(t, ok)
+	assert.Equal(t, CavMinUserDefined+1234, uc.Type)
+
+	uc, ok = batch.Caveats[3].(*UnregisteredCaveat)
+	assert.True(t, ok)
+	assert.Equal(t, CavUnregistered, uc.Type)
+
+	t.Run("DecodeCaveatsJSONStream", func(t *testing.T) {
+		var cavs []Caveat
+		assert.NoError(t, DecodeCaveatsJSONStream(bytes.NewReader(j), func(c Caveat) error {
+			cavs = append(cavs, c)
+			return nil
+		}))
+		assert.Equal(t, batch.Caveats, cavs)
+
+		stop := errors.New("stop")
+		n := 0
+		assert.Equal(t, stop, DecodeCaveatsJSONStream(bytes.NewReader(j), func(Caveat) error {
+			if n++; n == 3 {
+				return stop
+			}
+			return nil
+		}))
+		assert.Equal(t, 3, n)
+	})
+
+	t.Run("stops at end of set", func(t *testing.T) {
+		r := strings.NewReader(`[{"type":"ValidityWindow","body":{"not_before":1,"not_after":2}}] {"more":"data"}`)
+
+		d := NewCaveatSetJSONDecoder(r)
+		_, err := d.Next()
+		assert.NoError(t, err)
+		_, err = d.Next()
+		assert.Equal(t, io.EOF, err)
+	})
+
+	t.Run("null", func(t *testing.T) {
+		_, err := NewCaveatSetJSONDecoder(strings.NewReader("null")).Next()
+		assert.Equal(t, io.EOF, err)
+	})
+
+	for name, j := range map[string]string{
+		"empty input":   ``,
+		"not an array":  `{"type":"ValidityWindow"}`,
+		"truncated":     `[{"type":"ValidityWindow","body":{"not_before":1,"not_after":2}}`,
+		"bad element":   `[1]`,
+		"bad body":      `[{"type":"ValidityWindow","body":"nope"}]`,
+		"missing body":  `[{"type":"ValidityWindow"}]`,
+		"trailing data": `[] []`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			cs := new(CaveatSet)
+			batchErr := cs.UnmarshalJSON([]byte(j))
+			assert.Error(t, batchErr)
+
+			if name == "trailing data" {
+				return
+			}
+
+			streamErr := DecodeCaveatsJSONStream(strings.NewReader(j), func(Caveat) error { return nil })
+			assert.Error(t, streamErr)
+			assert.Equal(t, batchErr, streamErr)
+		})
+	}
+}
+
+func BenchmarkCaveatSetJSON(b *testing.B) {
+	j := largeCaveatSetJSON(b, 5000)
+
+	b.Run("batch", func(b *testing.B) {
+		b.ReportAllocs()
+
+		for i := 0; i < b.N; i++ {
+			if err := json.Unmarshal(j, new(CaveatSet)); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("stream", func(b *testing.B) {
+		b.ReportAllocs()
+
+		for i := 0; i < b.N; i++ {
+			err := DecodeCaveatsJSONStream(bytes.NewReader(j), func(Caveat) error { return nil })
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestValidateFailFast(t *testing.T) {
+	cs := NewCaveatSet(
+		cavParent(ActionAll, 1),
+		cavParent(ActionRead, 1),
+		cavChild(ActionRead, 3),
+	)
+
+	var (
+		allowed = &testAccess{action: ActionRead, parentResource: ptr(uint64(1)), childResource: ptr(uint64(3))}
+		denied  = &testAccess{action: ActionRead, parentResource: ptr(uint64(3)), childResource: ptr(uint64(4))}
+	)
+
+	assert.NoError(t, cs.Validate(allowed, allowed))
+	assert.NoError(t, cs.ValidateFailFast(allowed, allowed))
+
+	// exhaustive validation reports all three failures
+	err := cs.Validate(denied)
+	assert.IsError(t, err, ErrUnauthorized)
+	assert.Equal(t, "unauthorized for resource; unauthorized for resource; unauthorized for resource", err.Error())
+
+	// fail-fast validation only reports the first
+	err = cs.ValidateFailFast(denied)
+	assert.IsError(t, err, ErrUnauthorized)
+	assert.Equal(t, "unauthorized for resource", err.Error())
+
+	// every access is still checked
+	err = cs.ValidateFailFast(denied, allowed, &testAccess{action: ActionWrite, parentResource: ptr(uint64(1))})
+	assert.Equal(t, "unauthorized for resource; unauthorized for action", err.Error())
+}
+
+type carrierAccess struct {
+	testAccess
+	v *Validation
+}
+
+var _ CaveatSetCarrier = (*carrierAccess)(nil)
+
+func (a *carrierAccess) GetValidation() *Validation { return a.v }
+
+func (a *carrierAccess) WithValidation(v *Validation) Access {
+	cp := *a
+	cp.v = v
+	return &cp
+}
+
+// carriedCaveat records the validations carried by the accesses it's
+// validated against.
+type carriedCaveat struct {
+	mu   sync.Mutex
+	seen []*Validation
+}
+
+func (c *carriedCaveat) CaveatType() CaveatType { return CavMinUserDefined }
+func (c *carriedCaveat) Name() string           { return "Carried" }
+
+func (c *carriedCaveat) Prohibits(f Access) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.seen = append(c.seen, f.(CaveatSetCarrier).GetValidation())
+	return nil
+}
+
+func TestCaveatSetCarrier(t *testing.T) {
+	var (
+		cav    = new(carriedCaveat)
+		cs     = NewCaveatSet(cav)
+		access = new(carrierAccess)
+	)
+
+	assert.NoError(t, cs.Validate(access))
+	assert.NoError(t, cs.ValidateFailFast(access))
+	_, err := cs.ValidateWithAudit(access)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, len(cav.seen))
+	assert.Equal(t, []validationMode{validateExhaustive, validateFailFast, validateExhaustive}, []validationMode{cav.seen[0].mode, cav.seen[1].mode, cav.seen[2].mode})
+	for _, v := range cav.seen {
+		assert.True(t, v.CaveatSet() == cs)
+	}
+
+	// the caller's access isn't modified
+	assert.Zero(t, access.v)
+
+	// validations already carried are left alone
+	other := &Validation{caveats: NewCaveatSet()}
+	access.v = other
+	cav.seen = nil
+	assert.NoError(t, cs.Validate(access))
+	assert.True(t, cav.seen[0] == other)
+}
+
+func TestCaveatSetCarrierConcurrent(t *testing.T) {
+	var (
+		cav    = new(carriedCaveat)
+		cs     = NewCaveatSet(cav)
+		access = new(carrierAccess)
+		wg     sync.WaitGroup
+	)
+
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, cs.Validate(access))
+		}()
+	}
+
+	wg.Wait()
+	assert.Equal(t, 8, len(cav.seen))
+	assert.Zero(t, access.v)
+}
+
+func BenchmarkValidate(b *testing.B) {
+	cavs := make([]Caveat, 50)
+	for i := range cavs {
+		cavs[i] = cavParent(ActionRead, 1)
+	}
+
+	// fails early
+	cavs[1] = cavParent(ActionRead, 2)
+
+	var (
+		cs     = NewCaveatSet(cavs...)
+		access = &testAccess{action: ActionRead, parentResource: ptr(uint64(1))}
+	)
+
+	b.Run("exhaustive", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			_ = cs.Validate(access)
+		}
+	})
+
+	b.Run("fail fast", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			_ = cs.ValidateFailFast(access)
+		}
+	})
+}
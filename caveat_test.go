@@ -29,4 +29,151 @@ func TestCaveatRegistry(t *testing.T) {
 	assert.NoError(t, json.Unmarshal(j2, cs))
 	assert.Equal(t, 1, len(cs.Caveats))
 	assert.Equal(t, c, cs.Caveats[0])
+
+	// user-defined types are encoded by number
+	assert.Panics(t, func() { SetCaveatJSONEmitName(cavTestParentResource, "Foobar") })
+}
+
+func TestRegisteredCaveats(t *testing.T) {
+	RegisterCaveatJSONAlias(cavTestParentResource, "Foobar")
+	t.Cleanup(func() { unegisterCaveatJSONAlias("Foobar") })
+
+	infos := RegisteredCaveats()
+	assert.Equal(t, len(t2c), len(infos))
+
+	for i := 1; i < len(infos); i++ {
+		assert.True(t, infos[i-1].Type < infos[i].Type)
+	}
+
+	byType := make(map[CaveatType]CaveatInfo, len(infos))
+	for _, info := range infos {
+		byType[info.Type] = info
+	}
+
+	assert.Equal(t, CaveatInfo{
+		Type:      cavTestParentResource,
+		Name:      "ParentResource",
+		Aliases:   []string{"Foobar"},
+		Range:     CaveatRangeUser,
+		GoType:    "*macaroon.testCaveatParentResource",
+		ZeroValue: json.RawMessage(`{"ID":0,"Permission":0}`),
+	}, byType[cavTestParentResource])
+
+	assert.Equal(t, "ValidityWindow", byType[CavValidityWindow].Name)
+	assert.Equal(t, CaveatRangeReserved, byType[CavValidityWindow].Range)
+	assert.False(t, byType[CavValidityWindow].IsAttestation)
+
+	name, ok := LookupCaveatName(cavTestParentResource)
+	assert.True(t, ok)
+	assert.Equal(t, "ParentResource", name)
+	_, ok = LookupCaveatName(CavMaxUserDefined)
+	assert.False(t, ok)
+
+	typ, ok := LookupCaveatType("Foobar")
+	assert.True(t, ok)
+	assert.Equal(t, cavTestParentResource, typ)
+	_, ok = LookupCaveatType("NoSuchCaveat")
+	assert.False(t, ok)
+}
+
+type rangeTestCaveat struct{ typ CaveatType }
+
+func (c *rangeTestCaveat) CaveatType() CaveatType   { return c.typ }
+func (c *rangeTestCaveat) Name() string             { return "RangeTest" }
+func (c *rangeTestCaveat) Prohibits(f Access) error { return nil }
+
+func TestCaveatTypeRanges(t *testing.T) {
+	register := func(tb testing.TB, fn func(Caveat), typ CaveatType) (panicked bool) {
+		tb.Helper()
+
+		c := &rangeTestCaveat{typ}
+		defer func() {
+			if recover() != nil {
+				panicked = true
+			} else {
+				unregisterCaveatType(c)
+			}
+		}()
+
+		fn(c)
+		return false
+	}
+
+	// existing in-repo registrations
+	assert.Equal(t, "3P", t2s[Cav3P])
+	assert.Equal(t, "ValidityWindow", t2s[CavValidityWindow])
+	assert.Equal(t, "BindToParentToken", t2s[CavBindToParentToken])
+
+	t.Run("RegisterCaveatType", func(t *testing.T) {
+		assert.False(t, register(t, RegisterCaveatType, CavMinUserDefined+1000))
+		assert.False(t, register(t, RegisterCaveatType, CavMaxUserDefined))
+		assert.True(t, register(t, RegisterCaveatType, CavUnregistered))
+		assert.True(t, register(t, RegisterCaveatType, CavMaxUserRegisterable))
+		assert.True(t, register(t, RegisterCaveatType, CavMinUserRegisterable))
+		assert.True(t, register(t, RegisterCaveatType, 1000))
+	})
+
+	t.Run("RegisterGlobalCaveatType", func(t *testing.T) {
+		assert.False(t, register(t, RegisterGlobalCaveatType, CavMinUserRegisterable))
+		assert.False(t, register(t, RegisterGlobalCaveatType, CavMaxUserRegisterable))
+		assert.True(t, register(t, RegisterGlobalCaveatType, CavMinUserDefined))
+		assert.True(t, register(t, RegisterGlobalCaveatType, 1000))
+	})
+
+	t.Run("RegisterReservedCaveatType", func(t *testing.T) {
+		assert.False(t, register(t, RegisterReservedCaveatType, 1000))
+		assert.False(t, register(t, RegisterReservedCaveatType, BlockPetsemMin))
+		assert.True(t, register(t, RegisterReservedCaveatType, CavMinUserRegisterable))
+		assert.True(t, register(t, RegisterReservedCaveatType, CavMinUserDefined))
+
+		// duplicates still panic
+		assert.True(t, register(t, RegisterReservedCaveatType, Cav3P))
+
+		assert.True(t, hasPathPrefix("github.com/superfly/macaroon/flyio", modulePath))
+		assert.True(t, hasPathPrefix("github.com/superfly/macaroon", modulePath))
+		assert.False(t, hasPathPrefix("github.com/superfly/macaroon-evil", modulePath))
+		assert.False(t, hasPathPrefix("github.com/evil/macaroon", modulePath))
+		assert.Equal(t, modulePath, caveatPkgPath(&rangeTestCaveat{}))
+	})
+
+	t.Run("RegisterLegacyCaveatType", func(t *testing.T) {
+		assert.False(t, register(t, RegisterLegacyCaveatType, CavMinUserRegisterable))
+		assert.False(t, register(t, RegisterLegacyCaveatType, CavMinUserDefined+1000))
+		assert.True(t, register(t, RegisterLegacyCaveatType, 1000))
+	})
+
+	t.Run("RegisterCaveatConstructor", func(t *testing.T) {
+		constructor := func(c Caveat) {
+			typ := c.CaveatType()
+			RegisterCaveatConstructor(func() Caveat { return &rangeTestCaveat{typ} })
+		}
+
+		assert.False(t, register(t, constructor, CavMinUserDefined+1000))
+		assert.False(t, register(t, constructor, CavMinUserRegisterable))
+		assert.False(t, register(t, constructor, 1000))
+		assert.True(t, register(t, constructor, Cav3P))
+		assert.True(t, register(t, constructor, CavMaxUserDefined+1))
+
+		// the constructor is used when decoding
+		var (
+			typ   = CavMinUserDefined + 1000
+			calls int
+		)
+
+		RegisterCaveatConstructor(func() Caveat {
+			calls++
+			return &rangeTestCaveat{typ}
+		})
+		t.Cleanup(func() { unregisterCaveatType(&rangeTestCaveat{typ}) })
+
+		buf, err := NewCaveatSet(&rangeTestCaveat{typ}).MarshalMsgpack()
+		assert.NoError(t, err)
+		calls = 0
+
+		cs, err := DecodeCaveats(buf)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, calls)
+		_, ok := cs.Caveats[0].(*rangeTestCaveat)
+		assert.True(t, ok)
+	})
 }
@@ -0,0 +1,196 @@
+package macaroon
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	msgpack "github.com/vmihailenco/msgpack/v5"
+	"github.com/vmihailenco/msgpack/v5/msgpcode"
+)
+
+// VersionedCaveat is implemented by caveats whose schema has changed over
+// time. CaveatVersion returns the current version of the caveat's schema.
+// UpgradeFrom populates the caveat from a value returned by one of the
+// decoders passed to RegisterCaveatTypeVersions.
+//
+// Version 0 caveats are encoded exactly like unversioned caveats. Later
+// versions are encoded as a msgpack extension carrying the version number and
+// the caveat body.
+type VersionedCaveat interface {
+	Caveat
+	CaveatVersion() int
+	UpgradeFrom(old any) error
+}
+
+// VersionDecoder decodes the body of an old version of a caveat.
+type VersionDecoder func(dec *msgpack.Decoder) (Caveat, error)
+
+const caveatVersionExtID int8 = 1
+
+var t2v = map[CaveatType]map[int]VersionDecoder{}
+
+// RegisterCaveatTypeVersions registers a VersionedCaveat type along with
+// decoders for its previous versions. The type is registered according to its
+// range, as with RegisterCaveatType, RegisterGlobalCaveatType, and
+// RegisterReservedCaveatType.
+//
+// Caveats encoded with a previous version are decoded with the corresponding
+// decoder and upgraded to the current version. The upgraded caveat is what
+// Prohibits and GetCaveats see, but the original encoding is retained so that
+// signatures over old tokens remain valid.
+func RegisterCaveatTypeVersions(zeroValue Caveat, decoders map[int]VersionDecoder) {
+	vc, ok := zeroValue.(VersionedCaveat)
+	if !ok {
+		panic(fmt.Sprintf("caveat type %s doesn't implement VersionedCaveat", zeroValue.Name()))
+	}
+	if _, dup := decoders[vc.CaveatVersion()]; dup {
+		panic(fmt.Sprintf("decoder specified for current version of caveat type %s", zeroValue.Name()))
+	}
+
+	switch typ := zeroValue.CaveatType(); {
+	case typ < CavMinUserRegisterable:
+		RegisterReservedCaveatType(zeroValue)
+	case typ <= CavMaxUserRegisterable:
+		RegisterGlobalCaveatType(zeroValue)
+	default:
+		RegisterCaveatType(zeroValue)
+	}
+
+	t2v[zeroValue.CaveatType()] = decoders
+}
+
+// UpgradedCaveat is a caveat that was decoded from a previous version of its
+// schema. It behaves like the upgraded caveat, but encodes to its original
+// bytes. GetCaveats will find the upgraded caveat.
+type UpgradedCaveat struct {
+	Caveat
+
+	// Version is the version the caveat was encoded with.
+	Version int
+
+	raw []byte
+}
+
+var (
+	_ WrapperCaveat     = (*UpgradedCaveat)(nil)
+	_ DescribableCaveat = (*UpgradedCaveat)(nil)
+	_ msgpack.Marshaler = (*UpgradedCaveat)(nil)
+	_ json.Marshaler    = (*UpgradedCaveat)(nil)
+)
+
+// Unwrap implements WrapperCaveat.
+func (c *UpgradedCaveat) Unwrap() *CaveatSet {
+	return NewCaveatSet(c.Caveat)
+}
+
+// IsAttestation implements Attestation.
+func (c *UpgradedCaveat) IsAttestation() bool {
+	return IsAttestation(c.Caveat)
+}
+
+// Describe implements DescribableCaveat, describing the upgraded caveat.
+func (c *UpgradedCaveat) Describe() string {
+	return DescribeCaveat(c.Caveat)
+}
+
+// MarshalMsgpack implements msgpack.Marshaler. It returns the original
+// encoding of the caveat.
+func (c *UpgradedCaveat) MarshalMsgpack() ([]byte, error) {
+	return c.raw, nil
+}
+
+// MarshalJSON implements json.Marshaler. It returns the JSON encoding of the
+// upgraded caveat.
+func (c *UpgradedCaveat) MarshalJSON() ([]byte, error) {
+	return json.Marshal(c.Caveat)
+}
+
+func encodeCaveatBody(enc *msgpack.Encoder, cav Caveat) error {
+	vc, ok := cav.(VersionedCaveat)
+	if !ok || vc.CaveatVersion() == 0 {
+		return enc.Encode(cav)
+	}
+
+	ver, err := encode(uint64(vc.CaveatVersion()))
+	if err != nil {
+		return err
+	}
+
+	body, err := encode(cav)
+	if err != nil {
+		return err
+	}
+
+	if err := enc.EncodeExtHeader(caveatVersionExtID, len(ver)+len(body)); err != nil {
+		return err
+	}
+
+	w := enc.Writer()
+	if _, err := w.Write(ver); err != nil {
+		return err
+	}
+	_, err = w.Write(body)
+	return err
+}
+
+func decodeVersionedCaveat(typ CaveatType, decoders map[int]VersionDecoder, dec *msgpack.Decoder) (Caveat, error) {
+	raw, err := dec.DecodeRaw()
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		version int
+		body    = []byte(raw)
+	)
+
+	if len(raw) != 0 && msgpcode.IsExt(raw[0]) {
+		rd := msgpack.NewDecoder(bytes.NewReader(raw))
+
+		extID, _, err := rd.DecodeExtHeader()
+		if err != nil {
+			return nil, err
+		}
+		if extID != caveatVersionExtID {
+			return nil, fmt.Errorf("bad caveat version extension: %d", extID)
+		}
+
+		v, err := rd.DecodeUint()
+		if err != nil {
+			return nil, err
+		}
+		version = int(v)
+
+		if body, err = rd.DecodeRaw(); err != nil {
+			return nil, err
+		}
+	}
+
+	cav := typeToCaveat(typ)
+	vc := cav.(VersionedCaveat)
+
+	if version == vc.CaveatVersion() {
+		if err := msgpack.Unmarshal(body, cav); err != nil {
+			return nil, err
+		}
+
+		return cav, nil
+	}
+
+	decoder, ok := decoders[version]
+	if !ok {
+		return nil, fmt.Errorf("unknown version %d for caveat type %s", version, cav.Name())
+	}
+
+	old, err := decoder(msgpack.NewDecoder(bytes.NewReader(body)))
+	if err != nil {
+		return nil, err
+	}
+
+	if err := vc.UpgradeFrom(old); err != nil {
+		return nil, fmt.Errorf("upgrade %s from version %d: %w", cav.Name(), version, err)
+	}
+
+	return &UpgradedCaveat{Caveat: cav, Version: version, raw: raw}, nil
+}
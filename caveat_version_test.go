@@ -0,0 +1,155 @@
+package macaroon
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/alecthomas/assert/v2"
+	msgpack "github.com/vmihailenco/msgpack/v5"
+)
+
+// testVersionedV0 is the original schema of testVersioned. It only allowed
+// restricting access to a single resource.
+type testVersionedV0 struct {
+	ID uint64
+}
+
+func (c *testVersionedV0) CaveatType() CaveatType   { return cavTestVersioned }
+func (c *testVersionedV0) Name() string             { return "TestVersioned" }
+func (c *testVersionedV0) Prohibits(a Access) error { return ErrBadCaveat }
+
+// testVersioned is the current (v1) schema, which added Permission.
+type testVersioned struct {
+	ID         uint64
+	Permission int
+}
+
+func init() {
+	RegisterCaveatTypeVersions(&testVersioned{}, map[int]VersionDecoder{
+		0: func(dec *msgpack.Decoder) (Caveat, error) {
+			old := new(testVersionedV0)
+			return old, dec.Decode(old)
+		},
+	})
+}
+
+func (c *testVersioned) CaveatType() CaveatType { return cavTestVersioned }
+func (c *testVersioned) Name() string           { return "TestVersioned" }
+func (c *testVersioned) CaveatVersion() int     { return 1 }
+
+func (c *testVersioned) UpgradeFrom(old any) error {
+	switch o := old.(type) {
+	case *testVersionedV0:
+		c.ID = o.ID
+		c.Permission = ActionAll
+		return nil
+	default:
+		return fmt.Errorf("unexpected type %T", old)
+	}
+}
+
+func (c *testVersioned) Prohibits(a Access) error {
+	ta := a.(*testAccess)
+	if ta.parentResource == nil || *ta.parentResource != c.ID {
+		return fmt.Errorf("%w resource", ErrUnauthorized)
+	}
+	if ta.action&c.Permission != ta.action {
+		return fmt.Errorf("%w action", ErrUnauthorized)
+	}
+	return nil
+}
+
+func TestVersionedCaveat(t *testing.T) {
+	var (
+		kid = rbuf(10)
+		key = NewSigningKey()
+		loc = "https://api.fly.io"
+	)
+
+	mint := func(tb testing.TB, cav Caveat) []byte {
+		tb.Helper()
+
+		m, err := New(kid, loc, key)
+		assert.NoError(tb, err)
+		assert.NoError(tb, m.Add(cav))
+
+		tok, err := m.Encode()
+		assert.NoError(tb, err)
+
+		return tok
+	}
+
+	t.Run("v0 encoding is unchanged", func(t *testing.T) {
+		v0, err := NewCaveatSet(&testVersionedV0{ID: 123}).MarshalMsgpack()
+		assert.NoError(t, err)
+
+		plain, err := encode([]any{uint64(cavTestVersioned), &testVersionedV0{ID: 123}})
+		assert.NoError(t, err)
+		assert.Equal(t, plain, v0)
+	})
+
+	t.Run("old tokens", func(t *testing.T) {
+		// tokens minted before the caveat was versioned
+		tok := mint(t, &testVersionedV0{ID: 123})
+
+		m, err := Decode(tok)
+		assert.NoError(t, err)
+
+		upgraded, ok := m.UnsafeCaveats.Caveats[0].(*UpgradedCaveat)
+		assert.True(t, ok)
+		assert.Equal(t, 0, upgraded.Version)
+		assert.Equal(t, &testVersioned{ID: 123, Permission: ActionAll}, GetCaveats[*testVersioned](&m.UnsafeCaveats)[0])
+
+		// re-encoding is byte-identical and signatures remain valid
+		tok2, err := m.Encode()
+		assert.NoError(t, err)
+		assert.Equal(t, tok, tok2)
+
+		cs, err := m.Verify(key, nil, nil)
+		assert.NoError(t, err)
+		assert.NoError(t, cs.Validate(&testAccess{parentResource: ptr(uint64(123)), action: ActionWrite}))
+		assert.Error(t, cs.Validate(&testAccess{parentResource: ptr(uint64(234)), action: ActionRead}))
+
+		// attenuating old tokens
+		assert.NoError(t, m.Add(&testVersioned{ID: 123, Permission: ActionRead}))
+		tok3, err := m.Encode()
+		assert.NoError(t, err)
+		m, err = Decode(tok3)
+		assert.NoError(t, err)
+
+		cs, err = m.Verify(key, nil, nil)
+		assert.NoError(t, err)
+		assert.NoError(t, cs.Validate(&testAccess{parentResource: ptr(uint64(123)), action: ActionRead}))
+		assert.Error(t, cs.Validate(&testAccess{parentResource: ptr(uint64(123)), action: ActionWrite}))
+	})
+
+	t.Run("new tokens", func(t *testing.T) {
+		tok := mint(t, &testVersioned{ID: 123, Permission: ActionRead})
+
+		m, err := Decode(tok)
+		assert.NoError(t, err)
+		assert.Equal[Caveat](t, &testVersioned{ID: 123, Permission: ActionRead}, m.UnsafeCaveats.Caveats[0])
+
+		tok2, err := m.Encode()
+		assert.NoError(t, err)
+		assert.Equal(t, tok, tok2)
+
+		cs, err := m.Verify(key, nil, nil)
+		assert.NoError(t, err)
+		assert.NoError(t, cs.Validate(&testAccess{parentResource: ptr(uint64(123)), action: ActionRead}))
+		assert.Error(t, cs.Validate(&testAccess{parentResource: ptr(uint64(123)), action: ActionWrite}))
+	})
+
+	t.Run("unknown version", func(t *testing.T) {
+		buf, err := NewCaveatSet(&futureVersioned{testVersioned{ID: 123}}).MarshalMsgpack()
+		assert.NoError(t, err)
+
+		_, err = DecodeCaveats(buf)
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "unknown version 2")
+	})
+}
+
+type futureVersioned struct{ testVersioned }
+
+func (c *futureVersioned) CaveatVersion() int { return 2 }
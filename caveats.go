@@ -3,12 +3,15 @@ package macaroon
 import (
 	"encoding/json"
 	"fmt"
+	"strings"
 	"time"
 
 	msgpack "github.com/vmihailenco/msgpack/v5"
+	"golang.org/x/exp/slices"
 )
 
 // Caveat3P is a requirement that the token be presented along with a 3P discharge token.
+// Caveat3Ps can't be usefully constructed by hand. Use [Macaroon.Add3P] instead.
 type Caveat3P struct {
 	Location    string
 	VerifierKey []byte // used by the initial issuer to verify discharge macaroon
@@ -18,7 +21,7 @@ type Caveat3P struct {
 	rn []byte `msgpack:"-"`
 }
 
-func init()                                { RegisterCaveatType(&Caveat3P{}) }
+func init()                                { RegisterCaveatConstructor(func() Caveat { return &Caveat3P{} }) }
 func (c *Caveat3P) CaveatType() CaveatType { return Cav3P }
 func (c *Caveat3P) Name() string           { return "3P" }
 
@@ -28,13 +31,17 @@ func (c *Caveat3P) Prohibits(f Access) error {
 	return fmt.Errorf("%w (3rd party caveat)", ErrBadCaveat)
 }
 
+func (c *Caveat3P) Describe() string {
+	return fmt.Sprintf("Requires a discharge token from %s", c.Location)
+}
+
 // ValidityWindow establishes the window of time the token is valid for.
 type ValidityWindow struct {
 	NotBefore int64 `json:"not_before"`
 	NotAfter  int64 `json:"not_after"`
 }
 
-func init()                                      { RegisterCaveatType(&ValidityWindow{}) }
+func init()                                      { RegisterCaveatConstructor(func() Caveat { return &ValidityWindow{} }) }
 func (c *ValidityWindow) CaveatType() CaveatType { return CavValidityWindow }
 func (c *ValidityWindow) Name() string           { return "ValidityWindow" }
 
@@ -52,6 +59,14 @@ func (c *ValidityWindow) Prohibits(f Access) error {
 	return nil
 }
 
+func (c *ValidityWindow) Describe() string {
+	return fmt.Sprintf(
+		"Valid from %s until %s",
+		time.Unix(c.NotBefore, 0).UTC().Format(time.RFC3339),
+		time.Unix(c.NotAfter, 0).UTC().Format(time.RFC3339),
+	)
+}
+
 // BindToParentToken is used by discharge tokens to state that they may only
 // be used to discharge 3P caveats for a specific root token or further
 // attenuated versions of that token. This prevents a discharge token from
@@ -64,7 +79,7 @@ func (c *ValidityWindow) Prohibits(f Access) error {
 // token's signature.
 type BindToParentToken []byte
 
-func init()                                         { RegisterCaveatType(&BindToParentToken{}) }
+func init()                                         { RegisterCaveatConstructor(func() Caveat { return &BindToParentToken{} }) }
 func (c *BindToParentToken) CaveatType() CaveatType { return CavBindToParentToken }
 func (c *BindToParentToken) Name() string           { return "BindToParentToken" }
 
@@ -74,6 +89,77 @@ func (c *BindToParentToken) Prohibits(f Access) error {
 	return fmt.Errorf("%w (bind-to-parent)", ErrBadCaveat)
 }
 
+func (c *BindToParentToken) Describe() string {
+	return fmt.Sprintf("Binds discharge to parent token %x", []byte(*c))
+}
+
+// LocationAwareAccess is implemented by Accesses that know the location of
+// the service verifying the token (e.g. "https://api.fly.io"). It is consulted
+// by ScopedToLocation.
+type LocationAwareAccess interface {
+	Access
+
+	// GetVerifierLocation returns the location of the verifying service, or
+	// an empty string if it isn't known.
+	GetVerifierLocation() string
+}
+
+// ScopedToLocation applies the wrapped caveats only when the token is verified
+// at one of the listed locations. This is useful for tokens honored by several
+// services, where some caveats (e.g. flyio.Commands) are only meaningful to
+// one of them. The Access must implement LocationAwareAccess for the wrapped
+// caveats to be skipped. If it doesn't, or if its location isn't known, the
+// wrapped caveats are applied.
+//
+// When the location isn't listed, ScopedToLocation allows the access, so
+// resset.IfPresent considers it relevant and doesn't apply its Else
+// permission. To scope an IfPresent to a location, wrap the IfPresent in a
+// ScopedToLocation rather than the other way around.
+type ScopedToLocation struct {
+	Locations []string   `json:"locations"`
+	Caveats   *CaveatSet `json:"caveats"`
+}
+
+var (
+	_ WrapperCaveat     = (*ScopedToLocation)(nil)
+	_ DescribableCaveat = (*ScopedToLocation)(nil)
+	_ DenialExplainer   = (*ScopedToLocation)(nil)
+)
+
+func init()                                        { RegisterCaveatConstructor(func() Caveat { return &ScopedToLocation{} }) }
+func (c *ScopedToLocation) CaveatType() CaveatType { return CavScopedToLocation }
+func (c *ScopedToLocation) Name() string           { return "ScopedToLocation" }
+
+func (c *ScopedToLocation) Prohibits(f Access) error {
+	if la, ok := f.(LocationAwareAccess); ok {
+		if loc := la.GetVerifierLocation(); loc != "" && !slices.Contains(c.Locations, loc) {
+			return nil
+		}
+	}
+
+	if c.Caveats == nil {
+		return nil
+	}
+
+	return c.Caveats.validateAccess(f, validateExhaustive)
+}
+
+// Describe implements DescribableCaveat. The wrapped caveats are described
+// separately by DescribeCaveatSet.
+func (c *ScopedToLocation) Describe() string {
+	return fmt.Sprintf("Applies the following when verified at %s", strings.Join(c.Locations, ", "))
+}
+
+// ExplainDenial implements DenialExplainer by explaining the denials of the
+// wrapped caveats.
+func (c *ScopedToLocation) ExplainDenial(err *CaveatError, resolve NameResolver) string {
+	return strings.Join(ExplainDenial(err.Err, resolve), " ")
+}
+
+func (c *ScopedToLocation) Unwrap() *CaveatSet {
+	return c.Caveats
+}
+
 type UnregisteredCaveat struct {
 	Type       CaveatType
 	Body       any
@@ -88,6 +174,10 @@ func (c *UnregisteredCaveat) Prohibits(f Access) error {
 	return fmt.Errorf("%w (unregistered)", ErrBadCaveat)
 }
 
+func (c *UnregisteredCaveat) Describe() string {
+	return fmt.Sprintf("Unregistered caveat type %d", c.Type)
+}
+
 func (c UnregisteredCaveat) MarshalMsgpack() ([]byte, error) {
 	// JSON is just for user-readability, but msgpack is what's used for
 	// signature verification. With struct tags, etc, it's lossy to encode
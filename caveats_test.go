@@ -241,6 +241,82 @@ func TestUnregisteredCaveatMsgpack(t *testing.T) {
 	assert.Equal(t, c, mucs[0])
 }
 
+type locationAccess struct {
+	testAccess
+	loc string
+}
+
+var _ LocationAwareAccess = (*locationAccess)(nil)
+
+func (a *locationAccess) GetVerifierLocation() string { return a.loc }
+
+func TestScopedToLocation(t *testing.T) {
+	var (
+		now     = time.Now()
+		expired = &ValidityWindow{NotBefore: now.Add(-2 * time.Hour).Unix(), NotAfter: now.Add(-time.Hour).Unix()}
+		scoped  = &ScopedToLocation{
+			Locations: []string{"a", "b"},
+			Caveats:   NewCaveatSet(expired),
+		}
+	)
+
+	access := func(loc string) *locationAccess {
+		return &locationAccess{testAccess{parentResource: ptr(uint64(1)), action: ActionRead}, loc}
+	}
+
+	t.Run("serialization", func(t *testing.T) {
+		cs := NewCaveatSet(scoped)
+
+		b, err := json.Marshal(cs)
+		assert.NoError(t, err)
+		cs2 := NewCaveatSet()
+		assert.NoError(t, json.Unmarshal(b, cs2))
+		assert.Equal(t, cs, cs2)
+
+		b, err = cs.MarshalMsgpack()
+		assert.NoError(t, err)
+		cs2, err = DecodeCaveats(b)
+		assert.NoError(t, err)
+		assert.Equal(t, cs, cs2)
+
+		assert.NoError(t, CheckCanonicalEncoding(scoped))
+		assert.Equal(t, []*ValidityWindow{expired}, GetCaveats[*ValidityWindow](cs))
+	})
+
+	t.Run("evaluation", func(t *testing.T) {
+		cs := NewCaveatSet(scoped)
+
+		assert.IsError(t, cs.Validate(access("a")), ErrUnauthorized)
+		assert.IsError(t, cs.Validate(access("b")), ErrUnauthorized)
+		assert.NoError(t, cs.Validate(access("c")))
+
+		// unknown location
+		assert.IsError(t, cs.Validate(access("")), ErrUnauthorized)
+		assert.IsError(t, cs.Validate(&testAccess{parentResource: ptr(uint64(1)), action: ActionRead}), ErrUnauthorized)
+
+		// empty
+		assert.NoError(t, NewCaveatSet(&ScopedToLocation{Locations: []string{"a"}}).Validate(access("a")))
+	})
+
+	t.Run("nested", func(t *testing.T) {
+		cs := NewCaveatSet(&ScopedToLocation{
+			Locations: []string{"a", "b"},
+			Caveats:   NewCaveatSet(&ScopedToLocation{Locations: []string{"b"}, Caveats: NewCaveatSet(expired)}),
+		})
+
+		assert.NoError(t, cs.Validate(access("a")))
+		assert.IsError(t, cs.Validate(access("b")), ErrUnauthorized)
+		assert.NoError(t, cs.Validate(access("c")))
+	})
+
+	t.Run("denial", func(t *testing.T) {
+		err := NewCaveatSet(scoped).Validate(access("a"))
+		assert.Equal(t, []string{"Your token has expired."}, ExplainDenial(err, nil))
+		assert.Equal(t, 1, len(CaveatErrors(err)))
+		assert.Equal(t, Caveat(scoped), CaveatErrors(err)[0].Caveat)
+	})
+}
+
 func ptr[T any](t T) *T {
 	return &t
 }
@@ -1,6 +1,8 @@
 package macaroon
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 
 	msgpack "github.com/vmihailenco/msgpack/v5"
@@ -16,6 +18,76 @@ import (
 type wireTicket struct {
 	DischargeKey []byte
 	Caveats      CaveatSet
+
+	// Location is the third-party location that the ticket's caveat was added
+	// for. It is only recorded by Add3PWithTicketLocation, and is empty for
+	// other tickets.
+	Location string
+}
+
+var (
+	_ msgpack.CustomDecoder = new(wireTicket)
+	_ msgpack.CustomEncoder = new(wireTicket)
+)
+
+// number of fields in the array encoding of a wireTicket without a Location
+const wireTicketNumFields = 2
+
+// DecodeMsgpack implements [msgpack.CustomDecoder]. Tickets are encoded as an
+// array of their fields. The Location field is optional and fields beyond
+// those known to this version of the library are skipped.
+func (t *wireTicket) DecodeMsgpack(d *msgpack.Decoder) error {
+	nFields, err := d.DecodeArrayLen()
+	switch {
+	case err != nil:
+		return err
+	case nFields < wireTicketNumFields:
+		return fmt.Errorf("unknown ticket format: %d fields", nFields)
+	}
+
+	*t = wireTicket{}
+
+	if err := d.DecodeMulti(&t.DischargeKey, &t.Caveats); err != nil {
+		return err
+	}
+
+	if nFields > wireTicketNumFields {
+		if err := d.Decode(&t.Location); err != nil {
+			return err
+		}
+	}
+
+	for i := wireTicketNumFields + 1; i < nFields; i++ {
+		if err := d.Skip(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// EncodeMsgpack implements [msgpack.CustomEncoder]. The Location field is
+// left out if it's empty, so such tickets are encoded as before it was added
+// and can be decoded by third parties using older versions of this package.
+func (t *wireTicket) EncodeMsgpack(e *msgpack.Encoder) error {
+	nFields := wireTicketNumFields
+	if t.Location != "" {
+		nFields++
+	}
+
+	if err := e.EncodeArrayLen(nFields); err != nil {
+		return err
+	}
+
+	if err := e.EncodeMulti(t.DischargeKey, t.Caveats); err != nil {
+		return err
+	}
+
+	if t.Location != "" {
+		return e.EncodeString(t.Location)
+	}
+
+	return nil
 }
 
 // Checks the macaroon for a third party caveat for the specified location.
@@ -43,25 +115,102 @@ func ThirdPartyTicket(encodedMacaroon []byte, thirdPartyLocation string) ([]byte
 // caveats, if any, must be validated before issuing the discharge token to the
 // user.
 func DischargeTicket(ka EncryptionKey, location string, ticket []byte) ([]Caveat, *Macaroon, error) {
+	_, caveats, dm, err := dischargeTicket(ka, location, ticket, true)
+	return caveats, dm, err
+}
+
+// DischargeTicketWithLocation is like DischargeTicket, but also returns the
+// location that the ticket's third-party caveat was added for, as recorded in
+// the ticket by Add3PWithTicketLocation. Third parties can compare it with the
+// location they expect to be discharging tickets for, to catch
+// misconfigurations. It is empty for tickets added with Add3P or by older
+// versions of this package.
+func DischargeTicketWithLocation(ka EncryptionKey, location string, ticket []byte) (string, []Caveat, *Macaroon, error) {
 	return dischargeTicket(ka, location, ticket, true)
 }
 
 // discharge macaroons will be proofs moving forward, but we need to be able to test the old non-proof dms too
-func dischargeTicket(ka EncryptionKey, location string, ticket []byte, issueProof bool) ([]Caveat, *Macaroon, error) {
+func dischargeTicket(ka EncryptionKey, location string, ticket []byte, issueProof bool) (string, []Caveat, *Macaroon, error) {
+	tWire, err := recoverTicket(ka, ticket)
+	if err != nil {
+		return "", nil, nil, err
+	}
+
+	dm, err := newMacaroon(ticket, location, tWire.DischargeKey, issueProof, nil)
+	if err != nil {
+		return "", nil, nil, err
+	}
+
+	return tWire.Location, tWire.Caveats.Caveats, dm, nil
+}
+
+func recoverTicket(ka EncryptionKey, ticket []byte) (*wireTicket, error) {
+	if err := checkEncryptionKey(ka); err != nil {
+		return nil, fmt.Errorf("recover for discharge: %w", err)
+	}
+
 	tRaw, err := unseal(ka, ticket)
 	if err != nil {
-		return nil, nil, fmt.Errorf("recover for discharge: ticket decrypt: %w", err)
+		return nil, fmt.Errorf("recover for discharge: ticket decrypt: %w", err)
 	}
 
 	tWire := &wireTicket{}
 	if err = msgpack.Unmarshal(tRaw, tWire); err != nil {
-		return nil, nil, fmt.Errorf("recover for discharge: ticket decode: %w", err)
+		return nil, fmt.Errorf("recover for discharge: ticket decode: %w", err)
 	}
 
-	dm, err := newMacaroon(ticket, location, tWire.DischargeKey, issueProof)
+	return tWire, nil
+}
+
+// ReissueProof lets the third party that issued a discharge proof for ticket
+// mint a replacement with additional attestations (e.g. ones that weren't
+// available when the original was issued), without repeating the discharge
+// flow. Proofs can't be attenuated once finalized, but the third party can
+// recover the discharge key from the ticket, so this re-mints the proof rather
+// than adding to it. The original must verify against that key, so it must be
+// as issued, before being bound to a permission token. The returned proof is
+// finalized, with the original's caveats followed by extra, each of which must
+// be an attestation. The original remains valid.
+func ReissueProof(ka EncryptionKey, loc string, ticket []byte, original *Macaroon, extra ...Caveat) (*Macaroon, error) {
+	for _, cav := range extra {
+		if !IsAttestation(cav) {
+			return nil, fmt.Errorf("reissue proof: %s caveat isn't an attestation", cav.Name())
+		}
+	}
+
+	switch {
+	case !original.Nonce.Proof:
+		return nil, errors.New("reissue proof: original isn't a proof")
+	case !bytes.Equal(original.Nonce.KID, ticket):
+		return nil, errors.New("reissue proof: original isn't a discharge for ticket")
+	}
+
+	tWire, err := recoverTicket(ka, ticket)
 	if err != nil {
-		return nil, nil, err
+		return nil, fmt.Errorf("reissue proof: %w", err)
+	}
+
+	if _, err := original.Verify(tWire.DischargeKey, nil, nil); err != nil {
+		return nil, fmt.Errorf("reissue proof: %w", err)
+	}
+
+	cp, err := original.Clone()
+	if err != nil {
+		return nil, fmt.Errorf("reissue proof: %w", err)
+	}
+
+	m, err := newMacaroon(ticket, loc, tWire.DischargeKey, true, nil)
+	if err != nil {
+		return nil, fmt.Errorf("reissue proof: %w", err)
+	}
+
+	if err := m.add(append(cp.UnsafeCaveats.Caveats, extra...)...); err != nil {
+		return nil, fmt.Errorf("reissue proof: %w", err)
+	}
+
+	if err := m.finalize(); err != nil {
+		return nil, fmt.Errorf("reissue proof: %w", err)
 	}
 
-	return tWire.Caveats.Caveats, dm, nil
+	return m, nil
 }
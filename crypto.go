@@ -2,61 +2,79 @@ package macaroon
 
 import (
 	"bytes"
-	"crypto/hmac"
 	"crypto/rand"
 	"crypto/sha256"
 	"fmt"
+	"io"
 	"log"
 
-	"golang.org/x/crypto/chacha20poly1305"
+	mcrypto "github.com/superfly/macaroon/crypto"
 )
 
 const (
-	nonceLen          = 12
-	EncryptionKeySize = 32
+	nonceLen          = mcrypto.NonceLength
+	SigningKeySize    = sha256.Size
+	EncryptionKeySize = mcrypto.KeyLength
 )
 
 type SigningKey []byte
 type EncryptionKey []byte
 
 func NewSigningKey() SigningKey {
-	return SigningKey(rbuf(sha256.Size))
+	return SigningKey(rbuf(SigningKeySize))
 }
 
 func NewEncryptionKey() EncryptionKey {
 	return EncryptionKey(rbuf(EncryptionKeySize))
 }
 
-func seal(key EncryptionKey, buf []byte) []byte {
-	aead, err := chacha20poly1305.New([]byte(key))
-	if err != nil {
-		log.Panicf("seal: bad input for key: %s", err)
+// NewSigningKeyFromBytes returns a copy of buf as a SigningKey, e.g. for keys
+// loaded from external storage. The caller may zero buf afterwards. It returns
+// a *KeyLengthError if buf isn't SigningKeySize bytes.
+func NewSigningKeyFromBytes(buf []byte) (SigningKey, error) {
+	if err := checkSigningKey(buf); err != nil {
+		return nil, err
 	}
 
-	nonce := sealNonce()
+	return SigningKey(bytes.Clone(buf)), nil
+}
 
-	rct := aead.Seal(nil, nonce, buf, nil)
+// NewEncryptionKeyFromBytes returns a copy of buf as an EncryptionKey, e.g. for
+// keys loaded from external storage. The caller may zero buf afterwards. It
+// returns a *KeyLengthError if buf isn't EncryptionKeySize bytes.
+func NewEncryptionKeyFromBytes(buf []byte) (EncryptionKey, error) {
+	if err := checkEncryptionKey(buf); err != nil {
+		return nil, err
+	}
 
-	ct := &bytes.Buffer{}
-	ct.Write(nonce)
-	ct.Write(rct)
-	return ct.Bytes()
+	return EncryptionKey(bytes.Clone(buf)), nil
 }
 
-func unseal(key EncryptionKey, buf []byte) ([]byte, error) {
-	if len(buf) < nonceLen+1 {
-		return nil, fmt.Errorf("unseal: malformed input")
+func checkSigningKey(k []byte) error {
+	if len(k) != SigningKeySize {
+		return &KeyLengthError{Kind: "signing", Have: len(k), Need: SigningKeySize}
 	}
+	return nil
+}
 
-	aead, err := chacha20poly1305.New([]byte(key))
+func checkEncryptionKey(k []byte) error {
+	if len(k) != EncryptionKeySize {
+		return &KeyLengthError{Kind: "encryption", Have: len(k), Need: EncryptionKeySize}
+	}
+	return nil
+}
+
+func seal(key EncryptionKey, buf []byte) []byte {
+	ct, err := mcrypto.Seal(key, buf)
 	if err != nil {
-		return nil, fmt.Errorf("unseal: bad input for key: %s", err)
+		log.Panicf("%s", err)
 	}
 
-	nonce := buf[:nonceLen]
-	ct := buf[nonceLen:]
+	return ct
+}
 
-	return aead.Open(nil, nonce, ct, nil)
+func unseal(key EncryptionKey, buf []byte) ([]byte, error) {
+	return mcrypto.Unseal(key, buf)
 }
 
 func digest(buf []byte) []byte {
@@ -66,9 +84,7 @@ func digest(buf []byte) []byte {
 }
 
 func sign(key SigningKey, buf []byte) []byte {
-	mac := hmac.New(sha256.New, []byte(key))
-	mac.Write(buf)
-	return mac.Sum(nil)
+	return mcrypto.Sign(key, buf)
 }
 
 func sealNonce() []byte {
@@ -83,3 +99,32 @@ func rbuf(sz int) []byte {
 
 	return buf
 }
+
+// randBytes reads sz bytes from r, or from crypto/rand if r is nil.
+func randBytes(r io.Reader, sz int) ([]byte, error) {
+	if r == nil {
+		return rbuf(sz), nil
+	}
+
+	buf := make([]byte, sz)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, fmt.Errorf("read randomness: %w", err)
+	}
+
+	return buf, nil
+}
+
+// sealWithRand is like seal, but draws the nonce from r, or from crypto/rand
+// if r is nil.
+func sealWithRand(r io.Reader, key EncryptionKey, buf []byte) ([]byte, error) {
+	if r == nil {
+		return seal(key, buf), nil
+	}
+
+	nonce, err := randBytes(r, nonceLen)
+	if err != nil {
+		return nil, err
+	}
+
+	return mcrypto.SealWithNonce(key, nonce, buf)
+}
@@ -0,0 +1,121 @@
+// Package crypto exposes the cryptographic primitives used to sign and seal
+// macaroons. The macaroon package calls through these functions, so they
+// define exactly what the implementation does. They're documented for the
+// benefit of implementations in other languages and cross-language test
+// harnesses. Most users should use the macaroon package instead.
+//
+// All algorithms are fixed. There is no algorithm agility.
+package crypto
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+const (
+	// SignatureLength is the length of signatures returned by Sign and
+	// FinalizeProofSignature.
+	SignatureLength = sha256.Size
+
+	// KeyLength is the length of keys used with Seal and Unseal.
+	KeyLength = chacha20poly1305.KeySize
+
+	// NonceLength is the length of the nonce prepended to sealed boxes.
+	NonceLength = chacha20poly1305.NonceSize
+
+	// BindingIDLength is the length of binding IDs returned by BindingID.
+	// The HMAC spec lets us truncate to half of the digest length, so it
+	// seems reasonable to do here also.
+	BindingIDLength = sha256.Size / 2
+)
+
+// ErrMalformedBox is returned by Unseal when the box is too short to contain
+// a nonce and authentication tag.
+var ErrMalformedBox = errors.New("unseal: malformed input")
+
+// Sign returns HMAC-SHA256(key, data). The result is SignatureLength bytes and
+// is not truncated. Macaroon tails are computed by signing the encoded nonce
+// with the root key and then signing each msgpack-encoded caveat (as a
+// single-element caveat set) with the previous tail as the key.
+func Sign(key, data []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+// Seal encrypts plaintext with ChaCha20-Poly1305 (RFC 8439) under key, which
+// must be KeyLength bytes. A random NonceLength byte nonce is generated and
+// the result is nonce || ciphertext || tag. No additional data is
+// authenticated.
+func Seal(key, plaintext []byte) ([]byte, error) {
+	nonce := make([]byte, NonceLength)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("seal: generate nonce: %w", err)
+	}
+
+	return SealWithNonce(key, nonce, plaintext)
+}
+
+// SealWithNonce is like Seal, but uses the provided nonce, which must be
+// NonceLength bytes. Reusing a nonce with the same key is catastrophic. This
+// exists for known-answer tests.
+func SealWithNonce(key, nonce, plaintext []byte) ([]byte, error) {
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return nil, fmt.Errorf("seal: bad input for key: %w", err)
+	}
+
+	if len(nonce) != NonceLength {
+		return nil, fmt.Errorf("seal: bad nonce length: %d", len(nonce))
+	}
+
+	box := &bytes.Buffer{}
+	box.Write(nonce)
+	box.Write(aead.Seal(nil, nonce, plaintext, nil))
+	return box.Bytes(), nil
+}
+
+// Unseal reverses Seal. The first NonceLength bytes of box are taken as the
+// nonce and the remainder as the ciphertext and tag. ErrMalformedBox is
+// returned if box isn't longer than NonceLength.
+func Unseal(key, box []byte) ([]byte, error) {
+	if len(box) < NonceLength+1 {
+		return nil, ErrMalformedBox
+	}
+
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return nil, fmt.Errorf("unseal: bad input for key: %w", err)
+	}
+
+	return aead.Open(nil, box[:NonceLength], box[NonceLength:], nil)
+}
+
+// BindingID returns the first BindingIDLength bytes of SHA256(tail). Discharge
+// tokens are bound to their parent token by adding a BindToParentToken caveat
+// containing the binding ID of the parent's tail. Verifiers compare it as a
+// prefix of the full SHA256 digest.
+func BindingID(tail []byte) []byte {
+	h := sha256.Sum256(tail)
+	return h[:BindingIDLength]
+}
+
+// proofFinalizationKey is the HMAC key used by FinalizeProofSignature.
+const proofFinalizationKey = "proof-signature-finalization"
+
+// FinalizeProofSignature returns HMAC-SHA256("proof-signature-finalization",
+// tail). The tail of a proof macaroon is finalized when it's encoded, so nobody
+// (including the issuer) can add caveats to it afterwards.
+//
+// This could conceptually just hash the macaroon tail. We're already using the
+// truncated tail hash for token binding though. It wouldn't actually be bad to
+// use the hash here, but HMAC feels better.
+func FinalizeProofSignature(tail []byte) []byte {
+	return Sign([]byte(proofFinalizationKey), tail)
+}
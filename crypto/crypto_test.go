@@ -0,0 +1,75 @@
+package crypto
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/alecthomas/assert/v2"
+)
+
+// Known-answer tests. Other implementations can copy these verbatim. They are
+// also included in the output of internal/test-vectors.
+var (
+	katKey   = unhex("000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f")
+	katNonce = unhex("000000000000004a00000000")
+	katData  = []byte("macaroon")
+)
+
+func TestKnownAnswers(t *testing.T) {
+	assert.Equal(t,
+		"f3379f6db028cfcb7daf1672dedd2b44982bd9e09071fe5fa496fbfae29ed5ea",
+		hex.EncodeToString(Sign(katKey, katData)),
+	)
+
+	box, err := SealWithNonce(katKey, katNonce, katData)
+	assert.NoError(t, err)
+	assert.Equal(t,
+		"000000000000004a000000004f2e32923274b68fb90cb99b1a87c48759c69f8fb135c4c5",
+		hex.EncodeToString(box),
+	)
+
+	pt, err := Unseal(katKey, box)
+	assert.NoError(t, err)
+	assert.Equal(t, katData, pt)
+
+	assert.Equal(t,
+		"3b67143e130acdca72f55bc7acb21770",
+		hex.EncodeToString(BindingID(katData)),
+	)
+
+	assert.Equal(t,
+		"90704726323b6d82b047869a9460ecf19322a110ffee219b9a5e12d5f8b88c78",
+		hex.EncodeToString(FinalizeProofSignature(katData)),
+	)
+}
+
+func TestSeal(t *testing.T) {
+	box, err := Seal(katKey, katData)
+	assert.NoError(t, err)
+	assert.Equal(t, NonceLength+len(katData)+16, len(box))
+
+	pt, err := Unseal(katKey, box)
+	assert.NoError(t, err)
+	assert.Equal(t, katData, pt)
+
+	box[len(box)-1] ^= 1
+	_, err = Unseal(katKey, box)
+	assert.Error(t, err)
+
+	_, err = Unseal(katKey, box[:NonceLength])
+	assert.IsError(t, err, ErrMalformedBox)
+
+	_, err = Seal(katKey[:16], katData)
+	assert.Error(t, err)
+
+	_, err = SealWithNonce(katKey, katNonce[:8], katData)
+	assert.Error(t, err)
+}
+
+func unhex(s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
@@ -0,0 +1,88 @@
+package macaroon
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/alecthomas/assert/v2"
+)
+
+func TestKeyLength(t *testing.T) {
+	var (
+		key = NewSigningKey()
+		ka  = NewEncryptionKey()
+		loc = "https://tp"
+	)
+
+	m, err := New(rbuf(10), "loc", key)
+	assert.NoError(t, err)
+	assert.NoError(t, m.Add3P(ka, loc))
+
+	ticket, err := m.ThirdPartyTicket(loc)
+	assert.NoError(t, err)
+
+	_, dm, err := DischargeTicket(ka, loc, ticket)
+	assert.NoError(t, err)
+	dtok, err := dm.Encode()
+	assert.NoError(t, err)
+
+	checkErr := func(t *testing.T, err error, kind string, have, need int) {
+		t.Helper()
+
+		var kle *KeyLengthError
+		assert.True(t, errors.As(err, &kle))
+		assert.IsError(t, err, ErrBadKeyLength)
+		assert.Equal(t, kind, kle.Kind)
+		assert.Equal(t, have, kle.Have)
+		assert.Equal(t, need, kle.Need)
+	}
+
+	for name, n := range map[string]int{"short": 16, "long": 64, "nil": 0} {
+		t.Run(name, func(t *testing.T) {
+			var (
+				badSK SigningKey
+				badEK EncryptionKey
+			)
+			if n != 0 {
+				badSK, badEK = rbuf(n), rbuf(n)
+			}
+
+			_, err := New(rbuf(10), "loc", badSK)
+			checkErr(t, err, "signing", n, SigningKeySize)
+
+			_, err = NewProof(rbuf(10), "loc", badSK)
+			checkErr(t, err, "signing", n, SigningKeySize)
+
+			_, err = m.Verify(badSK, [][]byte{dtok}, nil)
+			checkErr(t, err, "signing", n, SigningKeySize)
+
+			_, err = m.Verify(key, [][]byte{dtok}, map[string][]EncryptionKey{loc: {badEK}})
+			checkErr(t, err, "encryption", n, EncryptionKeySize)
+
+			checkErr(t, m.Add3P(badEK, loc), "encryption", n, EncryptionKeySize)
+
+			_, _, err = DischargeTicket(badEK, loc, ticket)
+			checkErr(t, err, "encryption", n, EncryptionKeySize)
+
+			_, err = NewSigningKeyFromBytes(badSK)
+			checkErr(t, err, "signing", n, SigningKeySize)
+
+			_, err = NewEncryptionKeyFromBytes(badEK)
+			checkErr(t, err, "encryption", n, EncryptionKeySize)
+		})
+	}
+
+	t.Run("zero after use", func(t *testing.T) {
+		buf := append([]byte{}, key...)
+
+		sk, err := NewSigningKeyFromBytes(buf)
+		assert.NoError(t, err)
+
+		for i := range buf {
+			buf[i] = 0
+		}
+
+		_, err = m.Verify(sk, [][]byte{dtok}, nil)
+		assert.NoError(t, err)
+	})
+}
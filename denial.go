@@ -0,0 +1,104 @@
+package macaroon
+
+import (
+	"errors"
+	"time"
+)
+
+// CaveatError is a caveat's refusal of an access. The errors returned by
+// CaveatSet.Validate wrap a CaveatError for each caveat that prohibited an
+// access. Its message is that of the caveat's error.
+type CaveatError struct {
+	// Caveat is the caveat that prohibited the access.
+	Caveat Caveat
+
+	// Access is the access that was prohibited.
+	Access Access
+
+	// Err is the error returned by the caveat's Prohibits method.
+	Err error
+}
+
+func (e *CaveatError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *CaveatError) Unwrap() error {
+	return e.Err
+}
+
+// CaveatErrors returns the CaveatErrors wrapped by err, in order.
+func CaveatErrors(err error) []*CaveatError {
+	var ret []*CaveatError
+
+	var walk func(error)
+	walk = func(err error) {
+		switch e := err.(type) {
+		case nil:
+		case *CaveatError:
+			ret = append(ret, e)
+		case interface{ Unwrap() []error }:
+			for _, ee := range e.Unwrap() {
+				walk(ee)
+			}
+		case interface{ Unwrap() error }:
+			walk(e.Unwrap())
+		}
+	}
+
+	walk(err)
+
+	return ret
+}
+
+// NameResolver looks up the human-readable name of a resource (e.g. an app's
+// name) given its kind and ID, for use in messages shown to users. It returns
+// an empty string if the name isn't known.
+type NameResolver func(kind, id string) string
+
+// DenialExplainer is implemented by caveats that can explain to end users why
+// they prohibited an access. ExplainDenial returns an actionable message (e.g.
+// "Your token doesn't allow write access to app 'my-app'.") for the caveat's
+// error, or an empty string if it can't explain it. Like DescribableCaveat,
+// this has no bearing on verification.
+type DenialExplainer interface {
+	Caveat
+	ExplainDenial(err *CaveatError, resolve NameResolver) string
+}
+
+// ExplainDenial returns the user-facing explanations for the CaveatErrors
+// wrapped by err whose caveats implement DenialExplainer, skipping duplicates.
+// Callers are expected to provide a generic message if none are returned.
+func ExplainDenial(err error, resolve NameResolver) []string {
+	var (
+		ret  []string
+		seen = map[string]bool{}
+	)
+
+	for _, cerr := range CaveatErrors(err) {
+		de, ok := cerr.Caveat.(DenialExplainer)
+		if !ok {
+			continue
+		}
+
+		if msg := de.ExplainDenial(cerr, resolve); msg != "" && !seen[msg] {
+			seen[msg] = true
+			ret = append(ret, msg)
+		}
+	}
+
+	return ret
+}
+
+// ExplainDenial implements DenialExplainer.
+func (c *ValidityWindow) ExplainDenial(err *CaveatError, resolve NameResolver) string {
+	if !errors.Is(err, ErrUnauthorized) {
+		return ""
+	}
+
+	if err.Access.Now().After(time.Unix(c.NotAfter, 0)) {
+		return "Your token has expired."
+	}
+
+	return "Your token isn't valid yet."
+}
@@ -0,0 +1,42 @@
+package macaroon
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/alecthomas/assert/v2"
+)
+
+func TestCaveatErrors(t *testing.T) {
+	var (
+		parent  = cavParent(ActionRead, 123)
+		expired = &ValidityWindow{NotBefore: time.Now().Add(-2 * time.Hour).Unix(), NotAfter: time.Now().Add(-time.Hour).Unix()}
+		future  = &ValidityWindow{NotBefore: time.Now().Add(time.Hour).Unix(), NotAfter: time.Now().Add(2 * time.Hour).Unix()}
+		a1      = &testAccess{action: ActionRead, parentResource: ptr(uint64(234))}
+		a2      = &testAccess{action: ActionWrite, parentResource: ptr(uint64(123))}
+	)
+
+	err := NewCaveatSet(parent, expired).Validate(a1, a2)
+	assert.IsError(t, err, ErrUnauthorized)
+	assert.Equal(t, "unauthorized for resource; unauthorized: token only valid until "+time.Unix(expired.NotAfter, 0).String()+"; unauthorized for action; unauthorized: token only valid until "+time.Unix(expired.NotAfter, 0).String(), err.Error())
+
+	cerrs := CaveatErrors(err)
+	assert.Equal(t, 4, len(cerrs))
+	assert.Equal(t, parent, cerrs[0].Caveat)
+	assert.Equal(t, Access(a1), cerrs[0].Access)
+	assert.Equal(t, Caveat(expired), cerrs[1].Caveat)
+	assert.Equal(t, Access(a2), cerrs[2].Access)
+
+	var cerr *CaveatError
+	assert.True(t, errors.As(err, &cerr))
+	assert.Equal(t, parent, cerr.Caveat)
+
+	// only caveats implementing DenialExplainer are explained, once each
+	assert.Equal(t, []string{"Your token has expired."}, ExplainDenial(err, nil))
+	assert.Equal(t, []string{"Your token isn't valid yet."}, ExplainDenial(NewCaveatSet(future).Validate(a1), nil))
+	assert.Zero(t, ExplainDenial(NewCaveatSet(parent).Validate(a1), nil))
+
+	assert.Zero(t, CaveatErrors(nil))
+	assert.Zero(t, CaveatErrors(errors.New("other")))
+}
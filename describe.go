@@ -0,0 +1,55 @@
+package macaroon
+
+import (
+	"fmt"
+)
+
+// DescribableCaveat is implemented by caveats that can describe themselves
+// for humans. Describe returns a one-line summary of the caveat with its
+// parameters filled in (e.g. "Restricts access to apps 123 (read)"). This is
+// intended for tooling like token inspectors and has no bearing on
+// verification.
+type DescribableCaveat interface {
+	Caveat
+	Describe() string
+}
+
+// DescribeCaveat returns a human description of the caveat, falling back to
+// "<Name> (no description)" for caveats that don't implement
+// DescribableCaveat.
+func DescribeCaveat(c Caveat) string {
+	if dc, ok := c.(DescribableCaveat); ok {
+		return dc.Describe()
+	}
+	return fmt.Sprintf("%s (no description)", c.Name())
+}
+
+// DescribeCaveatSet returns a human description of each caveat in the set.
+// Caveats wrapped by a WrapperCaveat (e.g. resset.IfPresent) are described on
+// the lines following the wrapper, indented by two spaces per level.
+func DescribeCaveatSet(cs *CaveatSet) []string {
+	return describeCaveatSet(cs, "")
+}
+
+func describeCaveatSet(cs *CaveatSet, indent string) []string {
+	if cs == nil {
+		return nil
+	}
+
+	ret := make([]string, 0, len(cs.Caveats))
+
+	for _, cav := range cs.Caveats {
+		ret = append(ret, indent+DescribeCaveat(cav))
+
+		// upgraded caveats describe themselves as the caveat they wrap
+		if _, upgraded := cav.(*UpgradedCaveat); upgraded {
+			continue
+		}
+
+		if wc, isWrapper := cav.(WrapperCaveat); isWrapper {
+			ret = append(ret, describeCaveatSet(wc.Unwrap(), indent+"  ")...)
+		}
+	}
+
+	return ret
+}
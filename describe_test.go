@@ -0,0 +1,33 @@
+package macaroon
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alecthomas/assert/v2"
+)
+
+func TestDescribeCaveatSet(t *testing.T) {
+	cs := NewCaveatSet(
+		&ValidityWindow{
+			NotBefore: time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC).Unix(),
+			NotAfter:  time.Date(2024, 1, 3, 3, 4, 5, 0, time.UTC).Unix(),
+		},
+		&Caveat3P{Location: "https://auth.fly.io"},
+		ptr(BindToParentToken{0xde, 0xad, 0xbe, 0xef}),
+		&UnregisteredCaveat{Type: 1234},
+		cavParent(ActionRead, 123),
+		&UpgradedCaveat{Caveat: &ValidityWindow{}},
+	)
+
+	assert.Equal(t, []string{
+		"Valid from 2024-01-02T03:04:05Z until 2024-01-03T03:04:05Z",
+		"Requires a discharge token from https://auth.fly.io",
+		"Binds discharge to parent token deadbeef",
+		"Unregistered caveat type 1234",
+		"ParentResource (no description)",
+		"Valid from 1970-01-01T00:00:00Z until 1970-01-01T00:00:00Z",
+	}, DescribeCaveatSet(cs))
+
+	assert.Zero(t, DescribeCaveatSet(nil))
+}
@@ -0,0 +1,107 @@
+package macaroon
+
+import (
+	"bytes"
+
+	msgpack "github.com/vmihailenco/msgpack/v5"
+)
+
+// EquatableCaveat is implemented by caveats that can compare themselves to
+// other caveats more efficiently or accurately than by comparing their
+// encodings. Equal should return false if other is a different type.
+type EquatableCaveat interface {
+	Caveat
+	Equal(other Caveat) bool
+}
+
+// EqualCaveat reports whether a and b are the same caveat. Caveats
+// implementing EquatableCaveat are compared using their Equal method.
+// Otherwise, caveats are considered equal if their canonical msgpack
+// encodings match.
+func EqualCaveat(a, b Caveat) bool {
+	switch {
+	case a == nil || b == nil:
+		return a == nil && b == nil
+	case a.CaveatType() != b.CaveatType():
+		return false
+	}
+
+	if ea, ok := a.(EquatableCaveat); ok {
+		return ea.Equal(b)
+	}
+
+	pa, err := NewCaveatSet(a).MarshalMsgpack()
+	if err != nil {
+		return false
+	}
+
+	pb, err := NewCaveatSet(b).MarshalMsgpack()
+	if err != nil {
+		return false
+	}
+
+	return bytes.Equal(pa, pb)
+}
+
+// Equal reports whether c and other contain the same caveats in the same
+// order. Caveats are compared with EqualCaveat.
+func (c *CaveatSet) Equal(other *CaveatSet) bool {
+	if c == nil || other == nil {
+		return c == other
+	}
+
+	if len(c.Caveats) != len(other.Caveats) {
+		return false
+	}
+
+	for i := range c.Caveats {
+		if !EqualCaveat(c.Caveats[i], other.Caveats[i]) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Equal reports whether m and other have the same nonce, location, caveats,
+// and tail signature, as well as the same unknown fields from newer formats.
+func (m *Macaroon) Equal(other *Macaroon) bool {
+	if m == nil || other == nil {
+		return m == other
+	}
+
+	return m.Location == other.Location &&
+		bytes.Equal(m.Nonce.KID, other.Nonce.KID) &&
+		bytes.Equal(m.Nonce.Rnd, other.Nonce.Rnd) &&
+		m.Nonce.Proof == other.Nonce.Proof &&
+		m.Nonce.version == other.Nonce.version &&
+		equalRaw(m.Nonce.extra, other.Nonce.extra) &&
+		bytes.Equal(m.Tail, other.Tail) &&
+		m.UnsafeCaveats.Equal(&other.UnsafeCaveats) &&
+		equalRaw(m.extra, other.extra)
+}
+
+func equalRaw(a, b []msgpack.RawMessage) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if !bytes.Equal(a[i], b[i]) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// containsCaveat reports whether cavs contains a caveat equal to c.
+func containsCaveat(cavs []Caveat, c Caveat) bool {
+	for _, cc := range cavs {
+		if EqualCaveat(cc, c) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,47 @@
+package macaroon
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alecthomas/assert/v2"
+)
+
+func TestEqualCaveat(t *testing.T) {
+	vw := func(nbf, exp int64) *ValidityWindow { return &ValidityWindow{NotBefore: nbf, NotAfter: exp} }
+
+	assert.True(t, EqualCaveat(vw(1, 2), vw(1, 2)))
+	assert.False(t, EqualCaveat(vw(1, 2), vw(1, 3)))
+	assert.False(t, EqualCaveat(vw(1, 2), cavParent(ActionRead, 1)))
+	assert.False(t, EqualCaveat(vw(1, 2), nil))
+	assert.True(t, EqualCaveat(nil, nil))
+	assert.True(t, EqualCaveat(cavParent(ActionRead, 1), cavParent(ActionRead, 1)))
+	assert.False(t, EqualCaveat(cavParent(ActionRead, 1), cavParent(ActionWrite, 1)))
+
+	cs := NewCaveatSet(vw(1, 2), cavParent(ActionRead, 1))
+	assert.True(t, cs.Equal(NewCaveatSet(vw(1, 2), cavParent(ActionRead, 1))))
+	assert.False(t, cs.Equal(NewCaveatSet(cavParent(ActionRead, 1), vw(1, 2))))
+	assert.False(t, cs.Equal(NewCaveatSet(vw(1, 2))))
+	assert.False(t, cs.Equal(nil))
+}
+
+func TestMacaroonEqual(t *testing.T) {
+	m, err := New([]byte("kid"), "loc", NewSigningKey())
+	assert.NoError(t, err)
+	assert.NoError(t, m.Add(&ValidityWindow{NotBefore: time.Now().Unix(), NotAfter: time.Now().Add(time.Hour).Unix()}))
+
+	tok, err := m.Encode()
+	assert.NoError(t, err)
+	m2, err := Decode(tok)
+	assert.NoError(t, err)
+	assert.True(t, m.Equal(m2))
+
+	assert.NoError(t, m2.Add(cavParent(ActionRead, 1)))
+	assert.False(t, m.Equal(m2))
+
+	// duplicate caveats aren't added
+	m3, err := Decode(tok)
+	assert.NoError(t, err)
+	assert.NoError(t, m3.Add(m.UnsafeCaveats.Caveats...))
+	assert.True(t, m.Equal(m3))
+}
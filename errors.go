@@ -5,9 +5,116 @@ import (
 	"fmt"
 )
 
+// Errors from caveats fall into three distinct classes, which callers should
+// handle differently:
+//
+//   - Denials wrap ErrUnauthorized. The token is fine, but doesn't allow the
+//     access. See IsDenial.
+//   - Access bugs wrap ErrInvalidAccess. The caller built an Access that the
+//     caveats can't evaluate. See IsAccessBug.
+//   - Token bugs wrap ErrBadCaveat or ErrUnrecognizedToken. The token is
+//     malformed or has caveats that don't belong in it. See IsTokenBug.
+//
+// Access and token bugs are never denials, though an error joining several
+// caveats' errors may fall into more than one class.
 var (
 	ErrUnrecognizedToken = errors.New("bad token")
 	ErrUnauthorized      = errors.New("unauthorized")
-	ErrInvalidAccess     = fmt.Errorf("%w: bad data for token verification", ErrUnauthorized)
-	ErrBadCaveat         = fmt.Errorf("%w: bad caveat", ErrUnauthorized)
+	ErrInvalidAccess     = errors.New("bad data for token verification")
+	ErrBadCaveat         = errors.New("bad caveat")
+
+	// ErrResourceUnspecified is a denial from a caveat constraining access to
+	// something that the Access doesn't specify. resset.IfPresent treats it as
+	// the caveat not applying.
+	ErrResourceUnspecified = fmt.Errorf("%w: must specify", ErrUnauthorized)
+
+	ErrMissingAttestation   = fmt.Errorf("%w: missing attestation", ErrUnauthorized)
+	ErrDuplicateAttestation = fmt.Errorf("%w: multiple attestations", ErrUnauthorized)
+
+	ErrDischargeNestingNotSupported = fmt.Errorf("%w: third-party caveat in discharge exceeds nesting depth", ErrUnauthorized)
+	ErrUntrustedDischarge           = fmt.Errorf("%w: discharge doesn't match trusted third-party ticket", ErrUnauthorized)
+
+	// ErrTooManyCaveats is returned when adding caveats to or decoding a
+	// macaroon with more than MaxCaveats caveats.
+	ErrTooManyCaveats = errors.New("too many caveats")
+
+	// ErrUnknownKey should be returned (or wrapped) by VerifyToken resolvers
+	// when they don't recognize a token's KID.
+	ErrUnknownKey = errors.New("unknown key")
+
+	// ErrInvalidSignature is returned from verification when a macaroon's
+	// signature doesn't match the key it was verified with.
+	ErrInvalidSignature = errors.New("invalid signature")
+
+	// ErrMissingDischarge is returned from verification when there is no
+	// discharge for one of a macaroon's third-party caveats.
+	ErrMissingDischarge = errors.New("no matching discharge token")
+
+	// ErrReencodedCaveat is returned when encoding a macaroon with msgpack
+	// would change the encoding of a caveat decoded from an alternate wire
+	// format, invalidating the macaroon's signature.
+	ErrReencodedCaveat = errors.New("re-encoding caveat would invalidate signature")
+
+	// ErrBadKeyLength is wrapped by *KeyLengthError, which is returned when a
+	// key of the wrong length is used.
+	ErrBadKeyLength = errors.New("bad key length")
 )
+
+// IsDenial returns whether err is a token refusing an access. See
+// ErrUnauthorized.
+func IsDenial(err error) bool {
+	return errors.Is(err, ErrUnauthorized)
+}
+
+// IsAccessBug returns whether err is the result of an Access that caveats
+// can't evaluate (e.g. the wrong type, or missing required fields). See
+// ErrInvalidAccess.
+func IsAccessBug(err error) bool {
+	return errors.Is(err, ErrInvalidAccess)
+}
+
+// IsTokenBug returns whether err is the result of a malformed token or caveats
+// that shouldn't be in it. See ErrBadCaveat and ErrUnrecognizedToken.
+func IsTokenBug(err error) bool {
+	return errors.Is(err, ErrBadCaveat) || errors.Is(err, ErrUnrecognizedToken)
+}
+
+// DebugVerification causes verification errors that are otherwise
+// deliberately vague to carry details about which step failed. See
+// DischargeTrustError. It shouldn't be set in production.
+var DebugVerification = false
+
+// KeyLengthError is returned when a SigningKey or EncryptionKey has the wrong
+// length. It wraps ErrBadKeyLength.
+type KeyLengthError struct {
+	// Kind is "signing" or "encryption".
+	Kind string
+
+	Have, Need int
+}
+
+func (e *KeyLengthError) Error() string {
+	return fmt.Sprintf("bad %s key length: have %d, need %d", e.Kind, e.Have, e.Need)
+}
+
+func (e *KeyLengthError) Unwrap() error {
+	return ErrBadKeyLength
+}
+
+// DischargeTrustError is returned when a discharge's ticket can be unsealed by
+// a trusted third-party key, but can't be decoded or doesn't match the
+// third-party caveat it is meant to discharge. The same error is returned
+// regardless of which step failed. It wraps ErrUntrustedDischarge.
+type DischargeTrustError struct {
+	// Debug describes which step failed for each key. It is only populated
+	// when DebugVerification is set.
+	Debug string
+}
+
+func (e *DischargeTrustError) Error() string {
+	return ErrUntrustedDischarge.Error()
+}
+
+func (e *DischargeTrustError) Unwrap() error {
+	return ErrUntrustedDischarge
+}
@@ -0,0 +1,76 @@
+//go:build js && wasm
+
+// This example shows how to inspect and check Fly.io tokens in a browser. It
+// exposes a checkToken(header, access) function to JavaScript, which decodes
+// the permission token from the Authorization header and checks whether its
+// caveats allow the JSON-encoded flyio.Access. Signatures can't be verified
+// without the signing key, so this is only useful for explaining what a token
+// can do.
+//
+// Build it with:
+//
+//	GOOS=js GOARCH=wasm go build -o main.wasm ./examples/wasm
+//
+// or with TinyGo:
+//
+//	tinygo build -o main.wasm -target wasm ./examples/wasm
+package main
+
+import (
+	"encoding/json"
+	"syscall/js"
+
+	"github.com/superfly/macaroon"
+	"github.com/superfly/macaroon/flyio"
+)
+
+func main() {
+	js.Global().Set("checkToken", js.FuncOf(func(this js.Value, args []js.Value) any {
+		if len(args) != 2 {
+			return result(nil, "usage: checkToken(header, access)")
+		}
+
+		descriptions, err := checkToken(args[0].String(), args[1].String())
+		if err != nil {
+			return result(descriptions, err.Error())
+		}
+
+		return result(descriptions, "")
+	}))
+
+	// keep the exported function around
+	select {}
+}
+
+func checkToken(header, accessJSON string) ([]string, error) {
+	perm, _, err := flyio.ParsePermissionAndDischargeTokens(header)
+	if err != nil {
+		return nil, err
+	}
+
+	m, err := macaroon.Decode(perm)
+	if err != nil {
+		return nil, err
+	}
+
+	descriptions := macaroon.DescribeCaveatSet(&m.UnsafeCaveats)
+
+	var access flyio.Access
+	if err := json.Unmarshal([]byte(accessJSON), &access); err != nil {
+		return descriptions, err
+	}
+
+	return descriptions, m.UnsafeCaveats.Validate(&access)
+}
+
+func result(descriptions []string, err string) map[string]any {
+	cavs := make([]any, 0, len(descriptions))
+	for _, d := range descriptions {
+		cavs = append(cavs, d)
+	}
+
+	return map[string]any{
+		"caveats": cavs,
+		"error":   err,
+	}
+}
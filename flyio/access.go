@@ -2,6 +2,7 @@ package flyio
 
 import (
 	"fmt"
+	"net/netip"
 	"strings"
 	"time"
 
@@ -12,17 +13,40 @@ import (
 type Access struct {
 	Action         resset.Action  `json:"action,omitempty"`
 	OrgID          *uint64        `json:"orgid,omitempty"`
+	OrgSlug        *string        `json:"org_slug,omitempty"`
 	AppID          *uint64        `json:"appid,omitempty"`
+	AppName        *string        `json:"app_name,omitempty"`
 	AppFeature     *string        `json:"app_feature,omitempty"`
 	Feature        *string        `json:"feature,omitempty"`
 	Volume         *string        `json:"volume,omitempty"`
 	Machine        *string        `json:"machine,omitempty"`
 	MachineFeature *string        `json:"machine_feature,omitempty"`
 	Mutation       *string        `json:"mutation,omitempty"`
+	Query          *string        `json:"query,omitempty"`
 	SourceMachine  *string        `json:"sourceMachine,omitempty"`
 	Cluster        *string        `json:"cluster,omitempty"`
 	Command        []string       `json:"command,omitempty"`
 	StorageObject  *resset.Prefix `json:"storage_object,omitempty"`
+	SourceIP       *netip.Addr    `json:"source_ip,omitempty"`
+	Audience       *string        `json:"audience,omitempty"`
+
+	// ProjectedSpendCents is the organization's projected spend, in cents,
+	// if the access is allowed. See MaxSpendCents.
+	ProjectedSpendCents *uint64 `json:"projected_spend_cents,omitempty"`
+
+	// VerifierLocation is the location of the service verifying the token.
+	// See macaroon.ScopedToLocation. If it is empty, bundle.Bundle's
+	// validation methods validate a copy with the location configured by
+	// bundle.WithVerifierLocation.
+	VerifierLocation string `json:"verifier_location,omitempty"`
+
+	// validation is the validation the access is part of. See
+	// macaroon.CaveatSetCarrier.
+	validation *macaroon.Validation
+
+	// depth is the number of FeatureDependency caveats that derived the
+	// access from another.
+	depth int
 }
 
 var (
@@ -45,14 +69,21 @@ func (a *Access) Now() time.Time {
 // and volume are mutually exclusive).
 //
 // This ensure that a Access represents a single action taken on a single object.
+//
+// Organizations and apps may be identified by numeric ID, by name, or by both.
 func (f *Access) Validate() error {
-	if f.OrgID == nil {
-		return fmt.Errorf("%w org", resset.ErrResourceUnspecified)
+	if f.OrgID == nil && f.OrgSlug == nil {
+		return fmt.Errorf("%w: must specify org", macaroon.ErrInvalidAccess)
+	}
+
+	// a graphql operation is either a mutation or a query
+	if f.Mutation != nil && f.Query != nil {
+		return fmt.Errorf("%w: mutation, query", resset.ErrResourcesMutuallyExclusive)
 	}
 
 	// org-level resources = apps, features, storage objects
 	var orgResources []string
-	if f.AppID != nil {
+	if f.AppID != nil || f.AppName != nil {
 		orgResources = append(orgResources, "app")
 	}
 	if f.Feature != nil {
@@ -76,8 +107,8 @@ func (f *Access) Validate() error {
 	if f.AppFeature != nil {
 		appResources = append(appResources, *f.AppFeature)
 	}
-	if len(appResources) != 0 && f.AppID == nil {
-		return fmt.Errorf("%w app if app-owned resource is specified", resset.ErrResourceUnspecified)
+	if len(appResources) != 0 && f.AppID == nil && f.AppName == nil {
+		return fmt.Errorf("%w: must specify app if app-owned resource is specified", macaroon.ErrInvalidAccess)
 	}
 	if len(appResources) > 1 {
 		return fmt.Errorf("%w: %s", resset.ErrResourcesMutuallyExclusive, strings.Join(appResources, ", "))
@@ -86,7 +117,7 @@ func (f *Access) Validate() error {
 	// lfsc feature-level resource = clusters
 	if f.Cluster != nil {
 		if f.Feature == nil {
-			return fmt.Errorf("%w %s feature if clusters are specified", resset.ErrResourceUnspecified, FeatureLFSC)
+			return fmt.Errorf("%w: must specify %s feature if clusters are specified", macaroon.ErrInvalidAccess, FeatureLFSC)
 		}
 
 		if *f.Feature != FeatureLFSC {
@@ -103,12 +134,21 @@ func (f *Access) Validate() error {
 		machineResources = append(machineResources, *f.MachineFeature)
 	}
 	if len(machineResources) != 0 && f.Machine == nil {
-		return fmt.Errorf("%w machine ", resset.ErrResourceUnspecified)
+		return fmt.Errorf("%w: must specify machine if machine feature is specified", macaroon.ErrInvalidAccess)
 	}
 	if len(machineResources) > 1 {
 		return fmt.Errorf("%w: %s", resset.ErrResourcesMutuallyExclusive, strings.Join(machineResources, ", "))
 	}
 
+	// oidc machine feature requires audience
+	isOIDC := f.MachineFeature != nil && *f.MachineFeature == MachineFeatureOIDC
+	if isOIDC && f.Audience == nil {
+		return fmt.Errorf("%w: must specify audience for %s machine feature", macaroon.ErrInvalidAccess, MachineFeatureOIDC)
+	}
+	if !isOIDC && f.Audience != nil {
+		return fmt.Errorf("%w: audience requires the %s machine feature", macaroon.ErrInvalidAccess, MachineFeatureOIDC)
+	}
+
 	return nil
 }
 
@@ -127,6 +167,10 @@ const (
 	FeatureAuthentication  = "authentication"
 )
 
+const (
+	MachineFeatureOIDC = "oidc"
+)
+
 var (
 	// MemberFeatures describes the level of access that non-admins are allowed
 	// for various org features.
@@ -146,6 +190,22 @@ var (
 		FeatureDeletion:        resset.ActionNone,
 		FeatureDocumentSigning: resset.ActionNone,
 	}
+
+	// FeatureMaxActions bounds the access that FeatureSet caveats should
+	// grant on specific org features. An organization has a single billing
+	// account, which can be viewed and updated but not created or deleted on
+	// its own. Other features (e.g. membership, where removing a member is a
+	// delete) aren't bounded. See FeatureSet.Validate.
+	FeatureMaxActions = map[string]resset.Action{
+		FeatureBilling: resset.ActionRead | resset.ActionWrite,
+	}
+
+	// MachineFeatureMaxActions bounds the access that MachineFeatureSet
+	// caveats should grant on specific machine features. OIDC tokens can only
+	// be read. See MachineFeatureSet.Validate.
+	MachineFeatureMaxActions = map[string]resset.Action{
+		MachineFeatureOIDC: resset.ActionRead,
+	}
 )
 
 // PermittedRolesGetter is an interface for Accesses capable of indicating what
@@ -187,6 +247,18 @@ var _ OrgIDGetter = (*Access)(nil)
 // GetOrgID implements OrgIDGetter.
 func (a *Access) GetOrgID() *uint64 { return a.OrgID }
 
+// OrgSlugGetter is an interface allowing other packages to implement Accesses
+// that work with Caveats defined in this package.
+type OrgSlugGetter interface {
+	resset.Access
+	GetOrgSlug() *string
+}
+
+var _ OrgSlugGetter = (*Access)(nil)
+
+// GetOrgSlug implements OrgSlugGetter.
+func (a *Access) GetOrgSlug() *string { return a.OrgSlug }
+
 // AppIDGetter is an interface allowing other packages to implement Accesses
 // that work with Caveats defined in this package.
 type AppIDGetter interface {
@@ -199,6 +271,18 @@ var _ AppIDGetter = (*Access)(nil)
 // GetAppID implements AppIDGetter.
 func (a *Access) GetAppID() *uint64 { return a.AppID }
 
+// AppNameGetter is an interface allowing other packages to implement Accesses
+// that work with Caveats defined in this package.
+type AppNameGetter interface {
+	resset.Access
+	GetAppName() *string
+}
+
+var _ AppNameGetter = (*Access)(nil)
+
+// GetAppName implements AppNameGetter.
+func (a *Access) GetAppName() *string { return a.AppName }
+
 // AppFeatureGetter is an interface allowing other packages to implement
 // Accesses that work with Caveats defined in this package.
 type AppFeatureGetter interface {
@@ -271,6 +355,18 @@ var _ MutationGetter = (*Access)(nil)
 // GetMutation implements MutationGetter.
 func (a *Access) GetMutation() *string { return a.Mutation }
 
+// QueryGetter is an interface allowing other packages to implement Accesses
+// that work with Caveats defined in this package.
+type QueryGetter interface {
+	macaroon.Access
+	GetQuery() *string
+}
+
+var _ QueryGetter = (*Access)(nil)
+
+// GetQuery implements QueryGetter.
+func (a *Access) GetQuery() *string { return a.Query }
+
 // SourceMachineGetter is an interface allowing other packages to implement
 // Accesses that work with Caveats defined in this package.
 type SourceMachineGetter interface {
@@ -283,6 +379,48 @@ var _ SourceMachineGetter = (*Access)(nil)
 // GetSourceMachine implements SourceMachineGetter.
 func (a *Access) GetSourceMachine() *string { return a.SourceMachine }
 
+// SourceIPGetter is an interface allowing other packages to implement
+// Accesses that work with Caveats defined in this package.
+type SourceIPGetter interface {
+	macaroon.Access
+	GetSourceIP() netip.Addr
+}
+
+var _ SourceIPGetter = (*Access)(nil)
+
+// GetSourceIP implements SourceIPGetter. The zero Addr is returned if SourceIP
+// isn't set.
+func (a *Access) GetSourceIP() netip.Addr {
+	if a.SourceIP == nil {
+		return netip.Addr{}
+	}
+	return *a.SourceIP
+}
+
+// SpendGetter is an interface allowing other packages to implement Accesses
+// that work with Caveats defined in this package.
+type SpendGetter interface {
+	resset.Access
+	GetProjectedSpendCents() *uint64
+}
+
+var _ SpendGetter = (*Access)(nil)
+
+// GetProjectedSpendCents implements SpendGetter.
+func (a *Access) GetProjectedSpendCents() *uint64 { return a.ProjectedSpendCents }
+
+// AudienceGetter is an interface allowing other packages to implement Accesses
+// that work with Caveats defined in this package.
+type AudienceGetter interface {
+	resset.Access
+	GetAudience() *string
+}
+
+var _ AudienceGetter = (*Access)(nil)
+
+// GetAudience implements AudienceGetter.
+func (a *Access) GetAudience() *string { return a.Audience }
+
 // ClusterGetter is an interface allowing other packages to implement Accesses
 // that work with Caveats defined in this package.
 type ClusterGetter interface {
@@ -318,3 +456,28 @@ var _ StorageObjectGetter = (*Access)(nil)
 
 // GetStorageObject implements StorageObjectGetter.
 func (a *Access) GetStorageObject() *resset.Prefix { return a.StorageObject }
+
+var _ macaroon.LocationAwareAccess = (*Access)(nil)
+
+// GetVerifierLocation implements macaroon.LocationAwareAccess.
+func (a *Access) GetVerifierLocation() string { return a.VerifierLocation }
+
+// WithVerifierLocation returns a shallow copy of the access with
+// VerifierLocation set to loc.
+func (a *Access) WithVerifierLocation(loc string) macaroon.Access {
+	cp := *a
+	cp.VerifierLocation = loc
+	return &cp
+}
+
+var _ macaroon.CaveatSetCarrier = (*Access)(nil)
+
+// GetValidation implements macaroon.CaveatSetCarrier.
+func (a *Access) GetValidation() *macaroon.Validation { return a.validation }
+
+// WithValidation implements macaroon.CaveatSetCarrier.
+func (a *Access) WithValidation(v *macaroon.Validation) macaroon.Access {
+	cp := *a
+	cp.validation = v
+	return &cp
+}
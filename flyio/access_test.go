@@ -13,7 +13,7 @@ func TestAccess(t *testing.T) {
 	var noError error
 
 	// orgid required
-	assertError(t, resset.ErrResourceUnspecified, (&Access{}).Validate())
+	assertError(t, macaroon.ErrInvalidAccess, (&Access{}).Validate())
 	assertError(t, noError, (&Access{
 		OrgID: uptr(1),
 	}).Validate())
@@ -37,8 +37,20 @@ func TestAccess(t *testing.T) {
 		Feature: ptr("x"),
 	}).Validate())
 
+	// orgs and apps may be identified by name
+	assertError(t, noError, (&Access{
+		OrgSlug: ptr("my-org"),
+		AppName: ptr("my-app"),
+		Machine: ptr("123"),
+	}).Validate())
+	assertError(t, resset.ErrResourcesMutuallyExclusive, (&Access{
+		OrgSlug: ptr("my-org"),
+		AppName: ptr("my-app"),
+		Feature: ptr("x"),
+	}).Validate())
+
 	// can't specify clusters without litefs-cloud feature
-	assertError(t, resset.ErrResourceUnspecified, (&Access{
+	assertError(t, macaroon.ErrInvalidAccess, (&Access{
 		OrgID:   uptr(1),
 		Cluster: ptr("foo"),
 	}).Validate())
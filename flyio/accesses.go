@@ -0,0 +1,114 @@
+package flyio
+
+import (
+	"github.com/superfly/macaroon"
+	"github.com/superfly/macaroon/resset"
+)
+
+// The AccessesFor* functions return the complete set of accesses that must
+// all be allowed for common operations. Handlers should pass the result
+// directly to CaveatSet.Validate or Bundle.Validate rather than building
+// accesses by hand, which makes it easy to leave out a resource (e.g. checking
+// the machine but not the command) and silently widen access. Each access
+// fully specifies its parent resources and passes Access.Validate.
+
+// AccessesForMachineExec returns the accesses for executing cmd on a machine.
+func AccessesForMachineExec(orgID, appID uint64, machineID string, cmd []string, action resset.Action) []macaroon.Access {
+	if cmd == nil {
+		cmd = []string{}
+	}
+
+	return []macaroon.Access{
+		&Access{Action: action, OrgID: &orgID, AppID: &appID, Machine: &machineID, Command: cmd},
+	}
+}
+
+// AccessesForMachineFeature returns the accesses for using a machine feature
+// (e.g. "oidc") on a machine.
+func AccessesForMachineFeature(orgID, appID uint64, machineID, feature string, action resset.Action) []macaroon.Access {
+	return []macaroon.Access{
+		&Access{Action: action, OrgID: &orgID, AppID: &appID, Machine: &machineID, MachineFeature: &feature},
+	}
+}
+
+// AccessesForVolume returns the accesses for an operation on a volume.
+func AccessesForVolume(orgID, appID uint64, volumeID string, action resset.Action) []macaroon.Access {
+	return []macaroon.Access{
+		&Access{Action: action, OrgID: &orgID, AppID: &appID, Volume: &volumeID},
+	}
+}
+
+// AccessesForVolumeAttach returns the accesses for attaching a volume to a
+// machine. This requires action on the machine as well as the volume, which
+// can't be expressed in a single Access.
+func AccessesForVolumeAttach(orgID, appID uint64, machineID, volumeID string, action resset.Action) []macaroon.Access {
+	return []macaroon.Access{
+		&Access{Action: action, OrgID: &orgID, AppID: &appID, Machine: &machineID},
+		&Access{Action: action, OrgID: &orgID, AppID: &appID, Volume: &volumeID},
+	}
+}
+
+// AccessesForAppFeature returns the accesses for using an app feature.
+func AccessesForAppFeature(orgID, appID uint64, feature string, action resset.Action) []macaroon.Access {
+	return []macaroon.Access{
+		&Access{Action: action, OrgID: &orgID, AppID: &appID, AppFeature: &feature},
+	}
+}
+
+// AccessesForStorageObject returns the accesses for an operation on a storage
+// object.
+func AccessesForStorageObject(orgID uint64, object resset.Prefix, action resset.Action) []macaroon.Access {
+	return []macaroon.Access{
+		&Access{Action: action, OrgID: &orgID, StorageObject: &object},
+	}
+}
+
+// TestingTB is the subset of testing.TB used by AssertCoversHierarchy.
+type TestingTB interface {
+	Helper()
+	Errorf(format string, args ...any)
+}
+
+// AssertCoversHierarchy fails the test if any of the accesses isn't an *Access,
+// specifies a child resource without its parents (e.g. a machine without its
+// app), or disagrees with the others about which organization or app is
+// being accessed. It is intended for testing handlers that build their own
+// accesses, and takes a *testing.T or testing.TB without this package
+// importing "testing".
+func AssertCoversHierarchy(tb TestingTB, accesses []macaroon.Access) {
+	tb.Helper()
+
+	var (
+		orgID *uint64
+		appID *uint64
+	)
+
+	for i, a := range accesses {
+		fa, ok := a.(*Access)
+		if !ok {
+			tb.Errorf("access %d: not a flyio.Access: %T", i, a)
+			continue
+		}
+
+		if err := fa.Validate(); err != nil {
+			tb.Errorf("access %d: %v", i, err)
+			continue
+		}
+
+		switch {
+		case fa.OrgID == nil:
+		case orgID == nil:
+			orgID = fa.OrgID
+		case *orgID != *fa.OrgID:
+			tb.Errorf("access %d: organization %d doesn't match %d", i, *fa.OrgID, *orgID)
+		}
+
+		switch {
+		case fa.AppID == nil:
+		case appID == nil:
+			appID = fa.AppID
+		case *appID != *fa.AppID:
+			tb.Errorf("access %d: app %d doesn't match %d", i, *fa.AppID, *appID)
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package flyio
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/alecthomas/assert/v2"
+	"github.com/superfly/macaroon"
+	"github.com/superfly/macaroon/resset"
+)
+
+func TestAccessesFor(t *testing.T) {
+	var (
+		org  = &Organization{ID: 1, Mask: resset.ActionAll}
+		app  = &Apps{Apps: resset.New[uint64](resset.ActionAll, 2)}
+		m1   = &Machines{Machines: resset.New(resset.ActionAll, "m1")}
+		vol  = &Volumes{Volumes: resset.New(resset.ActionRead, "v1")}
+		ls   = &Commands{{Args: []string{"ls"}}}
+		obj  = &StorageObjects{Prefixes: resset.New(resset.ActionRead, resset.Prefix("https://storage.fly/bucket/"))}
+		feat = &AppFeatureSet{Features: resset.New(resset.ActionRead, "images")}
+	)
+
+	check := func(t *testing.T, accesses []macaroon.Access, allowed bool, cavs ...macaroon.Caveat) {
+		t.Helper()
+
+		AssertCoversHierarchy(t, accesses)
+
+		err := macaroon.NewCaveatSet(append([]macaroon.Caveat{org}, cavs...)...).Validate(accesses...)
+		if allowed {
+			assert.NoError(t, err)
+		} else {
+			assert.IsError(t, err, macaroon.ErrUnauthorized)
+		}
+	}
+
+	t.Run("machine exec", func(t *testing.T) {
+		check(t, AccessesForMachineExec(1, 2, "m1", []string{"ls", "-l"}, resset.ActionWrite), true, app, m1, ls)
+		check(t, AccessesForMachineExec(1, 2, "m1", []string{"rm", "-rf"}, resset.ActionWrite), false, app, m1, ls)
+		check(t, AccessesForMachineExec(1, 2, "m2", []string{"ls"}, resset.ActionWrite), false, app, m1, ls)
+	})
+
+	t.Run("machine feature", func(t *testing.T) {
+		features := &MachineFeatureSet{Features: resset.New(resset.ActionRead, "metrics")}
+		check(t, AccessesForMachineFeature(1, 2, "m1", "metrics", resset.ActionRead), true, app, m1, features)
+		check(t, AccessesForMachineFeature(1, 2, "m1", "metrics", resset.ActionWrite), false, app, m1, features)
+	})
+
+	t.Run("volume", func(t *testing.T) {
+		check(t, AccessesForVolume(1, 2, "v1", resset.ActionRead), true, app, vol)
+		check(t, AccessesForVolume(1, 2, "v2", resset.ActionRead), false, app, vol)
+	})
+
+	t.Run("volume attach", func(t *testing.T) {
+		// the token needs to allow both the machine and the volume
+		ifs := &resset.IfPresent{Ifs: macaroon.NewCaveatSet(m1, vol), Else: resset.ActionNone}
+
+		accesses := AccessesForVolumeAttach(1, 2, "m1", "v1", resset.ActionRead)
+		assert.Equal(t, 2, len(accesses))
+		check(t, accesses, true, app, ifs)
+		check(t, accesses, false, app, m1)
+		check(t, AccessesForVolumeAttach(1, 2, "m1", "v2", resset.ActionRead), false, app, ifs)
+		check(t, AccessesForVolumeAttach(1, 2, "m2", "v1", resset.ActionRead), false, app, ifs)
+	})
+
+	t.Run("app feature", func(t *testing.T) {
+		check(t, AccessesForAppFeature(1, 2, "images", resset.ActionRead), true, app, feat)
+		check(t, AccessesForAppFeature(1, 2, "images", resset.ActionWrite), false, app, feat)
+	})
+
+	t.Run("storage object", func(t *testing.T) {
+		check(t, AccessesForStorageObject(1, "https://storage.fly/bucket/file", resset.ActionRead), true, obj)
+		check(t, AccessesForStorageObject(1, "https://storage.fly/other/file", resset.ActionRead), false, obj)
+		check(t, AccessesForStorageObject(3, "https://storage.fly/bucket/file", resset.ActionRead), false, obj)
+	})
+}
+
+func TestAssertCoversHierarchy(t *testing.T) {
+	var (
+		orgID, appID, otherAppID = uint64(1), uint64(2), uint64(3)
+		machineID, volumeID      = "m1", "v1"
+	)
+
+	// a handler that forgot to include the machine's app
+	rec := new(recordingTB)
+	AssertCoversHierarchy(rec, []macaroon.Access{
+		&Access{Action: resset.ActionRead, OrgID: &orgID, Machine: &machineID},
+	})
+	assert.Equal(t, 1, len(rec.errors))
+	assert.Contains(t, rec.errors[0], "app")
+
+	// a handler that mixed up apps
+	rec = new(recordingTB)
+	AssertCoversHierarchy(rec, []macaroon.Access{
+		&Access{Action: resset.ActionRead, OrgID: &orgID, AppID: &appID, Machine: &machineID},
+		&Access{Action: resset.ActionRead, OrgID: &orgID, AppID: &otherAppID, Volume: &volumeID},
+	})
+	assert.Equal(t, []string{"access 1: app 3 doesn't match 2"}, rec.errors)
+
+	// the builders get it right
+	rec = new(recordingTB)
+	AssertCoversHierarchy(rec, AccessesForVolumeAttach(orgID, appID, machineID, volumeID, resset.ActionRead))
+	assert.Equal(t, 0, len(rec.errors))
+}
+
+type recordingTB struct {
+	errors []string
+}
+
+var _ TestingTB = (*recordingTB)(nil)
+
+func (r *recordingTB) Helper() {}
+
+func (r *recordingTB) Errorf(format string, args ...any) {
+	r.errors = append(r.errors, fmt.Sprintf(format, args...))
+}
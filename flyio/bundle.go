@@ -8,10 +8,17 @@ import (
 )
 
 var (
-	IsPermissionToken = bundle.LocationFilter(LocationPermission).Predicate()
-	IsAuthToken       = bundle.LocationFilter(LocationAuthentication).Predicate()
-	IsNewAuthToken    = bundle.LocationFilter(LocationNewAuthentication).Predicate()
-	IsSecretsToken    = bundle.LocationFilter(LocationSecrets).Predicate()
+	// IsPermissionToken selects permission tokens by location. Tokens with
+	// the legacy fm1a prefix are discharges, even if they share the
+	// permission location. Prefixes are unsigned labels, so they never make a
+	// token at another location a permission token.
+	IsPermissionToken = bundle.And(
+		bundle.LocationFilter(LocationPermission).Predicate(),
+		bundle.Not(bundle.PrefixPredicate(bundle.PrefixDischarge)),
+	)
+	IsAuthToken    = bundle.LocationFilter(LocationAuthentication).Predicate()
+	IsNewAuthToken = bundle.LocationFilter(LocationNewAuthentication).Predicate()
+	IsSecretsToken = bundle.LocationFilter(LocationSecrets).Predicate()
 )
 
 // IsForOrgUnverified returns a Predicate, checking that the token is scoped to
@@ -39,12 +46,22 @@ func IsForOrg(orgID uint64) bundle.Predicate {
 	})
 }
 
+// MakeReadOnly attenuates the permission tokens in the Bundle with the
+// ReadOnly caveat, restricting them to reads.
+func MakeReadOnly(b *bundle.Bundle) error {
+	return b.Attenuate(&ReadOnly{})
+}
+
+// ParseBundle parses a FlyV1 Authorization header, identifying permission
+// tokens with IsPermissionToken.
 func ParseBundle(hdr string) (*bundle.Bundle, error) {
-	return bundle.ParseBundle(LocationPermission, hdr)
+	return bundle.ParseBundleWithPredicate(IsPermissionToken, hdr, bundle.DefaultFilter(IsPermissionToken))
 }
 
+// ParseBundleWithFilter is the same as ParseBundle, but applies the given
+// filter instead of the default.
 func ParseBundleWithFilter(hdr string, filter bundle.Filter) (*bundle.Bundle, error) {
-	return bundle.ParseBundleWithFilter(LocationPermission, hdr, filter)
+	return bundle.ParseBundleWithPredicate(IsPermissionToken, hdr, filter)
 }
 
 type CSV []string
@@ -0,0 +1,114 @@
+package flyio
+
+import (
+	"context"
+	"encoding/base64"
+	"testing"
+
+	"github.com/alecthomas/assert/v2"
+	"github.com/superfly/macaroon"
+	"github.com/superfly/macaroon/bundle"
+	"github.com/superfly/macaroon/resset"
+)
+
+func TestMakeReadOnly(t *testing.T) {
+	var (
+		kid = []byte("kid")
+		key = macaroon.NewSigningKey()
+	)
+
+	m, err := macaroon.New(kid, LocationPermission, key)
+	assert.NoError(t, err)
+	assert.NoError(t, m.Add(&Organization{ID: 123, Mask: resset.ActionAll}))
+
+	tok, err := m.Encode()
+	assert.NoError(t, err)
+
+	bun, err := ParseBundle(macaroon.ToAuthorizationHeader(tok))
+	assert.NoError(t, err)
+	assert.NoError(t, MakeReadOnly(bun))
+
+	_, err = bun.Verify(context.Background(), bundle.WithKey(kid, key, nil))
+	assert.NoError(t, err)
+
+	assert.NoError(t, bun.Validate(&Access{OrgID: uptr(123), Action: resset.ActionRead}))
+	assert.IsError(t, bun.Validate(&Access{OrgID: uptr(123), Action: resset.ActionWrite}), resset.ErrUnauthorizedForAction)
+}
+
+func TestParseBundleLegacyPrefixes(t *testing.T) {
+	var (
+		kid = []byte("kid")
+		key = macaroon.NewSigningKey()
+		tpk = macaroon.NewEncryptionKey()
+	)
+
+	legacy := func(pfx string, tok []byte) string {
+		return pfx + "_" + base64.StdEncoding.EncodeToString(tok)
+	}
+
+	t.Run("discharge with permission location", func(t *testing.T) {
+		// a third party sharing the permission token's location
+		m, err := macaroon.New(kid, LocationPermission, key)
+		assert.NoError(t, err)
+		assert.NoError(t, m.Add3P(tpk, LocationPermission))
+
+		ticket, err := m.ThirdPartyTicket(LocationPermission)
+		assert.NoError(t, err)
+		_, dm, err := macaroon.DischargeTicket(tpk, LocationPermission, ticket)
+		assert.NoError(t, err)
+
+		perm, err := m.Encode()
+		assert.NoError(t, err)
+		dis, err := dm.Encode()
+		assert.NoError(t, err)
+
+		hdr := "FlyV1 " + legacy(bundle.PrefixPermission, perm) + "," + legacy(bundle.PrefixDischarge, dis)
+
+		bun, err := ParseBundle(hdr)
+		assert.NoError(t, err)
+		assert.Equal(t, 2, bun.Len())
+		assert.Equal(t, 1, bun.Count(IsPermissionToken))
+		assert.Equal(t, 0, len(bun.UndischargedThirdPartyTickets()))
+
+		// location alone misclassifies the discharge token
+		bun, err = bundle.ParseBundle(LocationPermission, hdr)
+		assert.NoError(t, err)
+		assert.Equal(t, 2, bun.Count(bun.IsPermissionToken))
+	})
+
+	t.Run("permission with other location", func(t *testing.T) {
+		m, err := macaroon.New(kid, "https://other.fly.io", key)
+		assert.NoError(t, err)
+
+		perm, err := m.Encode()
+		assert.NoError(t, err)
+
+		hdr := "FlyV1 " + legacy(bundle.PrefixPermission, perm)
+
+		// the prefix doesn't override the location, so it's treated as an
+		// extraneous discharge and dropped
+		bun, err := ParseBundle(hdr)
+		assert.NoError(t, err)
+		assert.Equal(t, 0, bun.Count(IsPermissionToken))
+		assert.Equal(t, 0, bun.Len())
+
+		bun, err = bundle.ParseBundle(LocationPermission, hdr)
+		assert.NoError(t, err)
+		assert.Equal(t, 0, bun.Len())
+	})
+
+	t.Run("v2 tokens use location", func(t *testing.T) {
+		m, err := macaroon.New(kid, LocationPermission, key)
+		assert.NoError(t, err)
+
+		perm, err := m.Encode()
+		assert.NoError(t, err)
+
+		bun, err := ParseBundle(macaroon.ToAuthorizationHeader(perm))
+		assert.NoError(t, err)
+		assert.Equal(t, 1, bun.Count(IsPermissionToken))
+		assert.Equal(t, []string{bundle.PrefixV2}, bundle.Map(bun, func(m bundle.Macaroon) string {
+			return m.Unverified().Prefix()
+		}))
+	})
+}
@@ -3,6 +3,7 @@ package flyio
 import (
 	"errors"
 	"fmt"
+	"time"
 
 	"golang.org/x/exp/slices"
 
@@ -172,6 +173,132 @@ func AppsAllowing(cs *macaroon.CaveatSet, action resset.Action) (uint64, []uint6
 	return orgScope, ret, nil
 }
 
+// IsEffectivelyEmpty reports whether the caveats contradict each other such
+// that no Access could ever be allowed. Human readable reasons are returned
+// for each contradiction found. This is intended for finding dead tokens and
+// shouldn't be used for authorization decisions.
+//
+// Only structural contradictions between top-level caveats are detected:
+//
+//   - ValidityWindows that have expired by now or that don't overlap
+//   - Organization caveats for different organizations
+//   - Resource set caveats of the same type (e.g. Apps) with no resources in
+//     common, including those allowing no resources at all
+//   - Mutations, Queries, and Commands caveats allowing nothing
+//
+// There are known false negatives. Caveats nested in IfPresent aren't
+// considered. Contradictions between different caveat types (e.g. Apps and
+// AppNames caveats referring to different apps, or an Apps caveat for an app
+// in a different organization) aren't detected, nor are contradictions
+// involving IsUser, attestations, or AllowedRoles. Caveats allowing
+// resources only with no actions aren't considered empty. StorageObjects
+// prefixes are intersected approximately.
+func IsEffectivelyEmpty(cs *macaroon.CaveatSet, now time.Time) (bool, []string) {
+	var reasons []string
+
+	var (
+		latestNotBefore   int64
+		earliestNotAfter  int64
+		hasValidityWindow bool
+	)
+
+	for _, vw := range topLevelCaveats[*macaroon.ValidityWindow](cs) {
+		if now.After(time.Unix(vw.NotAfter, 0)) {
+			reasons = append(reasons, fmt.Sprintf("expired at %s", time.Unix(vw.NotAfter, 0).UTC().Format(time.RFC3339)))
+		}
+
+		if !hasValidityWindow || vw.NotBefore > latestNotBefore {
+			latestNotBefore = vw.NotBefore
+		}
+		if !hasValidityWindow || vw.NotAfter < earliestNotAfter {
+			earliestNotAfter = vw.NotAfter
+		}
+		hasValidityWindow = true
+	}
+
+	if hasValidityWindow && latestNotBefore > earliestNotAfter {
+		reasons = append(reasons, "validity windows don't overlap")
+	}
+
+	var orgIDs []uint64
+	for _, org := range topLevelCaveats[*Organization](cs) {
+		if org.ID != resset.ZeroID[uint64]() && !slices.Contains(orgIDs, org.ID) {
+			orgIDs = append(orgIDs, org.ID)
+		}
+	}
+
+	if len(orgIDs) > 1 {
+		reasons = append(reasons, fmt.Sprintf("restricted to multiple organizations %v", orgIDs))
+	}
+
+	reasons = appendDisjointReason(reasons, cs, "apps", func(c *Apps) resset.ResourceSet[uint64, resset.Action] { return c.Apps })
+	reasons = appendDisjointReason(reasons, cs, "app names", func(c *AppNames) resset.ResourceSet[string, resset.Action] { return c.Apps })
+	reasons = appendDisjointReason(reasons, cs, "volumes", func(c *Volumes) resset.ResourceSet[string, resset.Action] { return c.Volumes })
+	reasons = appendDisjointReason(reasons, cs, "machines", func(c *Machines) resset.ResourceSet[string, resset.Action] { return c.Machines })
+	reasons = appendDisjointReason(reasons, cs, "machine features", func(c *MachineFeatureSet) resset.ResourceSet[string, resset.Action] { return c.Features })
+	reasons = appendDisjointReason(reasons, cs, "org features", func(c *FeatureSet) resset.ResourceSet[string, resset.Action] { return c.Features })
+	reasons = appendDisjointReason(reasons, cs, "app features", func(c *AppFeatureSet) resset.ResourceSet[string, resset.Action] { return c.Features })
+	reasons = appendDisjointReason(reasons, cs, "clusters", func(c *Clusters) resset.ResourceSet[string, resset.Action] { return c.Clusters })
+	reasons = appendDisjointReason(reasons, cs, "storage objects", func(c *StorageObjects) resset.ResourceSet[resset.Prefix, resset.Action] { return c.Prefixes })
+
+	for _, m := range topLevelCaveats[*Mutations](cs) {
+		if len(m.Mutations) == 0 {
+			reasons = append(reasons, "allows no mutations")
+			break
+		}
+	}
+
+	for _, q := range topLevelCaveats[*Queries](cs) {
+		if len(q.Queries) == 0 {
+			reasons = append(reasons, "allows no queries")
+			break
+		}
+	}
+
+	for _, c := range topLevelCaveats[*Commands](cs) {
+		if len(*c) == 0 {
+			reasons = append(reasons, "allows no commands")
+			break
+		}
+	}
+
+	return len(reasons) != 0, reasons
+}
+
+// appendDisjointReason appends a reason to reasons if the resource sets from
+// the top-level caveats of type T have no resources in common.
+func appendDisjointReason[T macaroon.Caveat, I resset.ID](reasons []string, cs *macaroon.CaveatSet, resourceType string, getRS func(T) resset.ResourceSet[I, resset.Action]) []string {
+	cavs := topLevelCaveats[T](cs)
+	if len(cavs) == 0 {
+		return reasons
+	}
+
+	rs := getRS(cavs[0])
+	for _, cav := range cavs[1:] {
+		rs = resset.Intersect(rs, getRS(cav))
+	}
+
+	switch {
+	case len(rs) != 0:
+		return reasons
+	case len(cavs) == 1:
+		return append(reasons, "allows no "+resourceType)
+	default:
+		return append(reasons, "no "+resourceType+" in common")
+	}
+}
+
+// topLevelCaveats is like macaroon.GetCaveats, but doesn't return caveats
+// nested in wrapper caveats.
+func topLevelCaveats[T macaroon.Caveat](cs *macaroon.CaveatSet) (ret []T) {
+	for _, cav := range cs.Caveats {
+		if typed, ok := cav.(T); ok {
+			ret = append(ret, typed)
+		}
+	}
+	return ret
+}
+
 // DangerousUserID iterates over the caveats to determine the associated user
 // ID. This identity should only be used for logging and auditing. It should
 // not be used for making authorization decisions.
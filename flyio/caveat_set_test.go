@@ -3,6 +3,7 @@ package flyio
 import (
 	"errors"
 	"testing"
+	"time"
 
 	"github.com/alecthomas/assert/v2"
 	"github.com/superfly/macaroon"
@@ -275,6 +276,63 @@ func TestAppsAllowing(t *testing.T) {
 	assert.Equal(t, []uint64{123, 234}, appIDs)
 }
 
+func TestIsEffectivelyEmpty(t *testing.T) {
+	var (
+		now  = time.Now()
+		past = now.Add(-time.Hour)
+		org  = &Organization{ID: 123, Mask: resset.ActionAll}
+		apps = func(ids ...uint64) *Apps { return &Apps{resset.New(resset.ActionAll, ids...)} }
+		vw   = func(nbf, exp time.Time) *macaroon.ValidityWindow {
+			return &macaroon.ValidityWindow{NotBefore: nbf.Unix(), NotAfter: exp.Unix()}
+		}
+	)
+
+	check := func(expected []string, cavs ...macaroon.Caveat) {
+		t.Helper()
+
+		empty, reasons := IsEffectivelyEmpty(macaroon.NewCaveatSet(cavs...), now)
+		assert.Equal(t, len(expected) != 0, empty)
+		assert.Equal(t, expected, reasons)
+	}
+
+	// healthy
+	check(nil, org, apps(1, 2), apps(2, 3), vw(past, now.Add(time.Hour)), &Commands{{}})
+	check(nil, org, apps(0), apps(2), &Organization{ID: 0, Mask: resset.ActionRead})
+	check(nil, &resset.IfPresent{Ifs: macaroon.NewCaveatSet(apps())}) // IfPresent isn't considered
+
+	// validity windows
+	check([]string{"expired at " + past.UTC().Format(time.RFC3339)}, org, vw(past.Add(-time.Hour), past))
+	check([]string{"validity windows don't overlap"}, org,
+		vw(now.Add(-time.Hour), now.Add(time.Minute)),
+		vw(now.Add(2*time.Minute), now.Add(time.Hour)),
+	)
+
+	// organizations
+	check([]string{"restricted to multiple organizations [123 234]"}, org, &Organization{ID: 234, Mask: resset.ActionAll})
+
+	// resource sets
+	check([]string{"allows no apps"}, org, apps())
+	check([]string{"no apps in common"}, org, apps(1, 2), apps(3))
+	check([]string{"no machines in common"}, org,
+		&Machines{resset.New(resset.ActionAll, "m1")},
+		&Machines{resset.New(resset.ActionAll, "m2")},
+	)
+	check(nil, org,
+		&StorageObjects{resset.New[resset.Prefix](resset.ActionAll, "https://storage.fly/bucket")},
+		&StorageObjects{resset.New[resset.Prefix](resset.ActionAll, "https://storage.fly/bucket/file")},
+	)
+	check([]string{"no storage objects in common"}, org,
+		&StorageObjects{resset.New[resset.Prefix](resset.ActionAll, "https://storage.fly/a")},
+		&StorageObjects{resset.New[resset.Prefix](resset.ActionAll, "https://storage.fly/b")},
+	)
+
+	// mutations, queries, and commands
+	check([]string{"allows no mutations", "allows no queries", "allows no commands"}, org, &Mutations{}, &Queries{}, &Commands{})
+
+	// multiple reasons
+	check([]string{"expired at " + past.UTC().Format(time.RFC3339), "no apps in common"}, org, vw(past, past), apps(1), apps(2))
+}
+
 func TestDangerousUserID(t *testing.T) {
 	_, err := DangerousUserID(macaroon.NewCaveatSet())
 	assert.Error(t, err)
@@ -2,37 +2,53 @@ package flyio
 
 import (
 	"fmt"
+	"net/netip"
 	"strings"
 
+	"golang.org/x/exp/maps"
 	"golang.org/x/exp/slices"
 
 	"github.com/superfly/macaroon"
 	"github.com/superfly/macaroon/resset"
+	msgpack "github.com/vmihailenco/msgpack/v5"
 )
 
 const (
-	CavOrganization      = macaroon.CavFlyioOrganization
-	CavVolumes           = macaroon.CavFlyioVolumes
-	CavApps              = macaroon.CavFlyioApps
-	CavFeatureSet        = macaroon.CavFlyioFeatureSet
-	CavMutations         = macaroon.CavFlyioMutations
-	CavMachines          = macaroon.CavFlyioMachines
-	CavIsUser            = macaroon.CavFlyioIsUser
-	CavMachineFeatureSet = macaroon.CavFlyioMachineFeatureSet
-	CavFromMachineSource = macaroon.CavFlyioFromMachineSource
-	CavClusters          = macaroon.CavFlyioClusters
-	CavIsMember          = macaroon.CavFlyioIsMember
-	CavCommands          = macaroon.CavFlyioCommands
-	CavAppFeatureSet     = macaroon.CavFlyioAppFeatureSet
-	CavStorageObjects    = macaroon.CavFlyioStorageObjects
-	CavAllowedRoles      = macaroon.CavAllowedRoles
+	CavOrganization        = macaroon.CavFlyioOrganization
+	CavVolumes             = macaroon.CavFlyioVolumes
+	CavApps                = macaroon.CavFlyioApps
+	CavFeatureSet          = macaroon.CavFlyioFeatureSet
+	CavMutations           = macaroon.CavFlyioMutations
+	CavMachines            = macaroon.CavFlyioMachines
+	CavIsUser              = macaroon.CavFlyioIsUser
+	CavMachineFeatureSet   = macaroon.CavFlyioMachineFeatureSet
+	CavFromMachineSource   = macaroon.CavFlyioFromMachineSource
+	CavClusters            = macaroon.CavFlyioClusters
+	CavIsMember            = macaroon.CavFlyioIsMember
+	CavCommands            = macaroon.CavFlyioCommands
+	CavAppFeatureSet       = macaroon.CavFlyioAppFeatureSet
+	CavStorageObjects      = macaroon.CavFlyioStorageObjects
+	CavAllowedRoles        = macaroon.CavAllowedRoles
+	CavOrgSlug             = macaroon.CavFlyioOrgSlug
+	CavAppNames            = macaroon.CavFlyioAppNames
+	CavSourceNetworks      = macaroon.CavFlyioSourceNetworks
+	CavOIDCAudiences       = macaroon.CavFlyioOIDCAudiences
+	CavQueries             = macaroon.CavFlyioQueries
+	AttestationMachineID   = macaroon.AttestationFlyioMachineIdentity
+	CavMaxSpendCents       = macaroon.CavFlyioMaxSpendCents
+	CavReadOnly            = macaroon.CavFlyioReadOnly
+	CavAppVolumes          = macaroon.CavFlyioAppVolumes
+	CavAppMachines         = macaroon.CavFlyioAppMachines
+	CavFeatureDependency   = macaroon.CavFlyioFeatureDependency
+	CavRequire3PForActions = macaroon.CavFlyioRequire3PForActions
+	AttestationApproval    = macaroon.AttestationFlyioApproval
 )
 
 type FromMachine struct {
 	ID string `json:"id"`
 }
 
-func init()                                            { macaroon.RegisterCaveatType(&FromMachine{}) }
+func init()                                            { macaroon.RegisterCaveatConstructor(func() macaroon.Caveat { return &FromMachine{} }) }
 func (c *FromMachine) CaveatType() macaroon.CaveatType { return CavFromMachineSource }
 func (c *FromMachine) Name() string                    { return "FromMachineSource" }
 
@@ -43,7 +59,8 @@ func (c *FromMachine) Prohibits(a macaroon.Access) error {
 	case !isFlyioAccess:
 		return fmt.Errorf("%w: access isnt SourceMachineGetter", macaroon.ErrInvalidAccess)
 	case f.GetSourceMachine() == nil:
-		return fmt.Errorf("%w missing SourceMachine", macaroon.ErrInvalidAccess)
+		// not ErrResourceUnspecified, which IfPresent would skip over.
+		return fmt.Errorf("%w: missing source machine", macaroon.ErrUnauthorized)
 	case c.ID != *f.GetSourceMachine():
 		return fmt.Errorf("%w: unauthorized source, expected from machine %s, but got %s", macaroon.ErrUnauthorized, c.ID, *f.GetSourceMachine())
 	default:
@@ -51,14 +68,89 @@ func (c *FromMachine) Prohibits(a macaroon.Access) error {
 	}
 }
 
-// Organization is an orgid, plus RWX-style access control.
+func (c *FromMachine) Describe() string {
+	return fmt.Sprintf("Restricts requests to those from machine %s", c.ID)
+}
+
+// MachineIdentity attests that a discharge was requested by the specified
+// Fly.io machine. Third parties add it to discharges for tickets with an
+// auth.ConfineMachine caveat after authenticating the machine. Like other
+// attestations, it is only meaningful when the discharge was issued by a
+// trusted third party. See MachineFromVerifiedCaveats.
+type MachineIdentity struct {
+	MachineID string `json:"machine_id"`
+	AppID     uint64 `json:"app_id"`
+	OrgID     uint64 `json:"org_id"`
+}
+
+func init() {
+	macaroon.RegisterCaveatConstructor(func() macaroon.Caveat { return &MachineIdentity{} })
+}
+func (c *MachineIdentity) CaveatType() macaroon.CaveatType   { return AttestationMachineID }
+func (c *MachineIdentity) Name() string                      { return "MachineIdentity" }
+func (c *MachineIdentity) Prohibits(a macaroon.Access) error { return macaroon.ErrBadCaveat }
+func (c *MachineIdentity) IsAttestation() bool               { return true }
+
+func (c *MachineIdentity) Describe() string {
+	return fmt.Sprintf("Attests Fly.io machine %s (app %d, organization %d)", c.MachineID, c.AppID, c.OrgID)
+}
+
+// MachineFromVerifiedCaveats returns the machine attested to by the single
+// MachineIdentity attestation in the verified caveat set. It returns false if
+// there is no such attestation or if there are several.
+func MachineFromVerifiedCaveats(cs *macaroon.CaveatSet) (*MachineIdentity, bool) {
+	mi, err := macaroon.RequireAttestation[*MachineIdentity](cs)
+	if err != nil {
+		return nil, false
+	}
+	return mi, true
+}
+
+// Organization is an orgid, plus RWX-style access control. Tokens minted by
+// parties that don't know numeric IDs should use OrgSlug instead.
+//
+// An ID of 0 is a wildcard, allowing access to any organization. Since that is
+// also what an uninitialized ID looks like, constructing Organization caveats
+// directly is discouraged. Use OrgRestriction or AnyOrgRestriction instead.
 type Organization struct {
 	ID   uint64        `json:"id"`
 	Mask resset.Action `json:"mask"`
+
+	// set by AnyOrgRestriction. Not serialized.
+	anyOrg bool
+}
+
+// OrgRestriction returns an Organization caveat restricting access to the
+// given organization. ErrZeroOrgID is returned if id is 0.
+func OrgRestriction(id uint64, mask resset.Action) (*Organization, error) {
+	if id == resset.ZeroID[uint64]() {
+		return nil, ErrZeroOrgID
+	}
+
+	return &Organization{ID: id, Mask: mask}, nil
+}
+
+// AnyOrgRestriction returns an Organization caveat allowing access to any
+// organization, restricted only by mask.
+func AnyOrgRestriction(mask resset.Action) *Organization {
+	return &Organization{Mask: mask, anyOrg: true}
+}
+
+// Validate checks that the caveat wasn't accidentally constructed with an ID of
+// 0. Issuers should call it before adding the caveat to a token, and
+// bundle.Bundle.Attenuate calls it automatically. Wildcard caveats decoded from
+// existing tokens don't remember how they were constructed, so Validate
+// rejects them too. It doesn't affect how the caveat is evaluated.
+func (c *Organization) Validate() error {
+	if c.ID == resset.ZeroID[uint64]() && !c.anyOrg {
+		return fmt.Errorf("%w (use AnyOrgRestriction for a wildcard)", ErrZeroOrgID)
+	}
+
+	return nil
 }
 
 func init() {
-	macaroon.RegisterCaveatType(&Organization{})
+	macaroon.RegisterCaveatConstructor(func() macaroon.Caveat { return &Organization{} })
 	macaroon.RegisterCaveatJSONAlias(CavOrganization, "DeprecatedOrganization")
 }
 
@@ -82,15 +174,23 @@ func (c *Organization) Prohibits(a macaroon.Access) error {
 	}
 }
 
+func (c *Organization) Describe() string {
+	if c.ID == resset.ZeroID[uint64]() {
+		return fmt.Sprintf("Restricts access to any organization (%s)", resset.DescribeAction(c.Mask))
+	}
+	return fmt.Sprintf("Restricts access to organization %d (%s)", c.ID, resset.DescribeAction(c.Mask))
+}
+
 // Apps is a set of App caveats, with their RWX access levels. A token with this set can be used
 // only with the listed apps, regardless of what the token says. Additional Apps can be added,
 // but they can only narrow, not expand, which apps (or access levels) can be reached from the token.
+// Tokens minted by parties that don't know numeric IDs should use AppNames instead.
 type Apps struct {
 	Apps resset.ResourceSet[uint64, resset.Action] `json:"apps"`
 }
 
 func init() {
-	macaroon.RegisterCaveatType(&Apps{})
+	macaroon.RegisterCaveatConstructor(func() macaroon.Caveat { return &Apps{} })
 	macaroon.RegisterCaveatJSONAlias(CavApps, "DeprecatedApps")
 }
 
@@ -102,14 +202,107 @@ func (c *Apps) Prohibits(a macaroon.Access) error {
 	if !isFlyioAccess {
 		return fmt.Errorf("%w: access isnt AppIDGetter", macaroon.ErrInvalidAccess)
 	}
-	return c.Apps.Prohibits(f.GetAppID(), f.GetAction(), "app")
+	return resset.Named("app", c.Apps).Prohibits(f.GetAppID(), f.GetAction())
+}
+
+func (c *Apps) Describe() string {
+	return "Restricts access to " + c.Apps.Describe("apps")
+}
+
+func (c *Apps) Equal(other macaroon.Caveat) bool {
+	o, ok := other.(*Apps)
+	return ok && c.Apps.Equal(o.Apps)
+}
+
+// OrgSlug is an organization slug, plus RWX-style access control. It is the
+// name-based equivalent of the Organization caveat, for use in tokens minted by
+// parties that don't know numeric IDs. Accesses must specify the organization
+// slug (see OrgSlugGetter); an Access with only a numeric org ID populated is
+// rejected with ErrResourceUnspecified, requiring that a resolver (e.g. the
+// Machines API) fill in the slug.
+//
+// Unlike Organization, OrgSlug has no wildcard: a caveat with an empty Slug
+// prohibits every access with ErrEmptyOrgSlug.
+//
+// Mixing ID-based and name-based caveats in a single token is allowed. Both
+// must pass for the access to be allowed.
+type OrgSlug struct {
+	Slug string        `json:"slug"`
+	Mask resset.Action `json:"mask"`
+}
+
+func init()                                        { macaroon.RegisterCaveatConstructor(func() macaroon.Caveat { return &OrgSlug{} }) }
+func (c *OrgSlug) CaveatType() macaroon.CaveatType { return CavOrgSlug }
+func (c *OrgSlug) Name() string                    { return "OrgSlug" }
+
+// Validate checks that the caveat has a slug. Issuers should call it before
+// adding the caveat to a token, and bundle.Bundle.Attenuate calls it
+// automatically.
+func (c *OrgSlug) Validate() error {
+	if c.Slug == "" {
+		return ErrEmptyOrgSlug
+	}
+
+	return nil
+}
+
+func (c *OrgSlug) Prohibits(a macaroon.Access) error {
+	f, isFlyioAccess := a.(OrgSlugGetter)
+
+	switch {
+	case !isFlyioAccess:
+		return fmt.Errorf("%w: access isnt OrgSlugGetter", macaroon.ErrInvalidAccess)
+	case c.Slug == "":
+		return ErrEmptyOrgSlug
+	case f.GetOrgSlug() == nil:
+		return fmt.Errorf("%w org slug", resset.ErrResourceUnspecified)
+	case c.Slug != *f.GetOrgSlug():
+		return fmt.Errorf("%w org %s, only %s", resset.ErrUnauthorizedForResource, *f.GetOrgSlug(), c.Slug)
+	case !resset.IsSubsetOf(f.GetAction(), c.Mask):
+		return fmt.Errorf("%w access %s (%s not allowed)", resset.ErrUnauthorizedForAction, f.GetAction(), resset.Remove(f.GetAction(), c.Mask))
+	default:
+		return nil
+	}
+}
+
+func (c *OrgSlug) Describe() string {
+	return fmt.Sprintf("Restricts access to organization %s (%s)", c.Slug, resset.DescribeAction(c.Mask))
+}
+
+// AppNames is the name-based equivalent of the Apps caveat. Accesses must
+// specify the app name (see AppNameGetter); an Access with only a numeric app
+// ID populated is rejected with ErrResourceUnspecified. See OrgSlug for notes
+// on mixing ID-based and name-based caveats.
+type AppNames struct {
+	Apps resset.ResourceSet[string, resset.Action] `json:"apps"`
+}
+
+func init()                                         { macaroon.RegisterCaveatConstructor(func() macaroon.Caveat { return &AppNames{} }) }
+func (c *AppNames) CaveatType() macaroon.CaveatType { return CavAppNames }
+func (c *AppNames) Name() string                    { return "AppNames" }
+
+func (c *AppNames) Prohibits(a macaroon.Access) error {
+	f, isFlyioAccess := a.(AppNameGetter)
+	if !isFlyioAccess {
+		return fmt.Errorf("%w: access isnt AppNameGetter", macaroon.ErrInvalidAccess)
+	}
+	return resset.Named("app name", c.Apps).Prohibits(f.GetAppName(), f.GetAction())
+}
+
+func (c *AppNames) Describe() string {
+	return "Restricts access to " + c.Apps.Describe("apps")
+}
+
+func (c *AppNames) Equal(other macaroon.Caveat) bool {
+	o, ok := other.(*AppNames)
+	return ok && c.Apps.Equal(o.Apps)
 }
 
 type Volumes struct {
 	Volumes resset.ResourceSet[string, resset.Action] `json:"volumes"`
 }
 
-func init()                                        { macaroon.RegisterCaveatType(&Volumes{}) }
+func init()                                        { macaroon.RegisterCaveatConstructor(func() macaroon.Caveat { return &Volumes{} }) }
 func (c *Volumes) CaveatType() macaroon.CaveatType { return CavVolumes }
 func (c *Volumes) Name() string                    { return "Volumes" }
 
@@ -118,14 +311,23 @@ func (c *Volumes) Prohibits(a macaroon.Access) error {
 	if !isFlyioAccess {
 		return fmt.Errorf("%w: access isnt VolumeGetter", macaroon.ErrInvalidAccess)
 	}
-	return c.Volumes.Prohibits(f.GetVolume(), f.GetAction(), "volume")
+	return resset.Named("volume", c.Volumes).Prohibits(f.GetVolume(), f.GetAction())
+}
+
+func (c *Volumes) Describe() string {
+	return "Restricts access to " + c.Volumes.Describe("volumes")
+}
+
+func (c *Volumes) Equal(other macaroon.Caveat) bool {
+	o, ok := other.(*Volumes)
+	return ok && c.Volumes.Equal(o.Volumes)
 }
 
 type Machines struct {
 	Machines resset.ResourceSet[string, resset.Action] `json:"machines"`
 }
 
-func init()                                         { macaroon.RegisterCaveatType(&Machines{}) }
+func init()                                         { macaroon.RegisterCaveatConstructor(func() macaroon.Caveat { return &Machines{} }) }
 func (c *Machines) CaveatType() macaroon.CaveatType { return CavMachines }
 func (c *Machines) Name() string                    { return "Machines" }
 
@@ -134,23 +336,315 @@ func (c *Machines) Prohibits(a macaroon.Access) error {
 	if !isFlyioAccess {
 		return fmt.Errorf("%w: access isnt MachineGetter", macaroon.ErrInvalidAccess)
 	}
-	return c.Machines.Prohibits(f.GetMachine(), f.GetAction(), "machine")
+	return resset.Named("machine", c.Machines).Prohibits(f.GetMachine(), f.GetAction())
+}
+
+func (c *Machines) Describe() string {
+	return "Restricts access to " + c.Machines.Describe("machines")
+}
+
+func (c *Machines) Equal(other macaroon.Caveat) bool {
+	o, ok := other.(*Machines)
+	return ok && c.Machines.Equal(o.Machines)
+}
+
+// ScopedToApp returns the equivalent AppVolumes caveat, restricting access to
+// the volumes in the specified app.
+func (c *Volumes) ScopedToApp(appID uint64) *AppVolumes {
+	return &AppVolumes{AppID: appID, Volumes: maps.Clone(c.Volumes)}
+}
+
+// ScopedToApp returns the equivalent AppMachines caveat, restricting access to
+// the machines in the specified app.
+func (c *Machines) ScopedToApp(appID uint64) *AppMachines {
+	return &AppMachines{AppID: appID, Machines: maps.Clone(c.Machines)}
+}
+
+// AppVolumes is the app-scoped equivalent of the Volumes caveat. Volume IDs
+// are supposed to be globally unique, but this doesn't rely on it: accesses
+// must be for the specified app as well as for one of the listed volumes.
+// Accesses that don't specify the app are rejected with
+// ErrResourceUnspecified.
+type AppVolumes struct {
+	AppID   uint64                                    `json:"app_id"`
+	Volumes resset.ResourceSet[string, resset.Action] `json:"volumes"`
+}
+
+func init()                                           { macaroon.RegisterCaveatConstructor(func() macaroon.Caveat { return &AppVolumes{} }) }
+func (c *AppVolumes) CaveatType() macaroon.CaveatType { return CavAppVolumes }
+func (c *AppVolumes) Name() string                    { return "AppVolumes" }
+
+func (c *AppVolumes) Prohibits(a macaroon.Access) error {
+	f, isFlyioAccess := a.(interface {
+		AppIDGetter
+		VolumeGetter
+	})
+	if !isFlyioAccess {
+		return fmt.Errorf("%w: access isnt AppIDGetter and VolumeGetter", macaroon.ErrInvalidAccess)
+	}
+	if err := prohibitsOtherApps(c.AppID, f.GetAppID()); err != nil {
+		return err
+	}
+	return resset.Named("volume", c.Volumes).Prohibits(f.GetVolume(), f.GetAction())
+}
+
+func (c *AppVolumes) Describe() string {
+	return fmt.Sprintf("Restricts access to %s in app %d", c.Volumes.Describe("volumes"), c.AppID)
+}
+
+func (c *AppVolumes) Equal(other macaroon.Caveat) bool {
+	o, ok := other.(*AppVolumes)
+	return ok && c.AppID == o.AppID && c.Volumes.Equal(o.Volumes)
+}
+
+// AppMachines is the app-scoped equivalent of the Machines caveat. See
+// AppVolumes.
+type AppMachines struct {
+	AppID    uint64                                    `json:"app_id"`
+	Machines resset.ResourceSet[string, resset.Action] `json:"machines"`
+}
+
+func init()                                            { macaroon.RegisterCaveatConstructor(func() macaroon.Caveat { return &AppMachines{} }) }
+func (c *AppMachines) CaveatType() macaroon.CaveatType { return CavAppMachines }
+func (c *AppMachines) Name() string                    { return "AppMachines" }
+
+func (c *AppMachines) Prohibits(a macaroon.Access) error {
+	f, isFlyioAccess := a.(interface {
+		AppIDGetter
+		MachineGetter
+	})
+	if !isFlyioAccess {
+		return fmt.Errorf("%w: access isnt AppIDGetter and MachineGetter", macaroon.ErrInvalidAccess)
+	}
+	if err := prohibitsOtherApps(c.AppID, f.GetAppID()); err != nil {
+		return err
+	}
+	return resset.Named("machine", c.Machines).Prohibits(f.GetMachine(), f.GetAction())
+}
+
+func (c *AppMachines) Describe() string {
+	return fmt.Sprintf("Restricts access to %s in app %d", c.Machines.Describe("machines"), c.AppID)
+}
+
+func (c *AppMachines) Equal(other macaroon.Caveat) bool {
+	o, ok := other.(*AppMachines)
+	return ok && c.AppID == o.AppID && c.Machines.Equal(o.Machines)
+}
+
+// maxFeatureDependencyDepth limits how many FeatureDependency caveats may
+// derive accesses from one another while validating a single access.
+const maxFeatureDependencyDepth = 4
+
+// FeatureDependency makes access to an app feature depend on an org feature:
+// accesses to AppFeature are only allowed if the token also allows Mask access
+// to RequiresOrgFeature in the app's organization (e.g. registry pushes only
+// where the builder feature is granted). Accesses to other resources aren't
+// affected.
+//
+// Caveats can't see the other caveats in their set, so FeatureDependency
+// validates a derived org feature access against the validation carried by
+// the access, in the same mode (see macaroon.CaveatSetCarrier). Both the derived access and the
+// app feature access must be allowed by all the token's caveats, so caveats
+// restricting only one of them (e.g. the FeatureSet granting
+// RequiresOrgFeature, or Apps) must be wrapped in resset.IfPresent.
+type FeatureDependency struct {
+	AppFeature         string        `json:"app_feature"`
+	RequiresOrgFeature string        `json:"requires_org_feature"`
+	Mask               resset.Action `json:"mask"`
+}
+
+func init() {
+	macaroon.RegisterCaveatConstructor(func() macaroon.Caveat { return &FeatureDependency{} })
+}
+
+func (c *FeatureDependency) CaveatType() macaroon.CaveatType { return CavFeatureDependency }
+func (c *FeatureDependency) Name() string                    { return "FeatureDependency" }
+
+func (c *FeatureDependency) Prohibits(a macaroon.Access) error {
+	f, isFlyioAccess := a.(*Access)
+	switch {
+	case !isFlyioAccess:
+		return fmt.Errorf("%w: access isnt *flyio.Access", macaroon.ErrInvalidAccess)
+	case f.AppFeature == nil || *f.AppFeature != c.AppFeature:
+		return nil
+	case f.validation == nil:
+		return fmt.Errorf("%w: access doesn't carry its caveat set", macaroon.ErrInvalidAccess)
+	case f.depth >= maxFeatureDependencyDepth:
+		return fmt.Errorf("%w: feature dependencies nested too deeply", macaroon.ErrBadCaveat)
+	}
+
+	orgAccess := &Access{
+		Action:              c.Mask,
+		OrgID:               f.OrgID,
+		OrgSlug:             f.OrgSlug,
+		Feature:             &c.RequiresOrgFeature,
+		SourceIP:            f.SourceIP,
+		ProjectedSpendCents: f.ProjectedSpendCents,
+		VerifierLocation:    f.VerifierLocation,
+		validation:          f.validation,
+		depth:               f.depth + 1,
+	}
+
+	if err := f.validation.Validate(orgAccess); err != nil {
+		return fmt.Errorf("app feature %s requires org feature %s: %w", c.AppFeature, c.RequiresOrgFeature, err)
+	}
+
+	return nil
+}
+
+func (c *FeatureDependency) Describe() string {
+	return fmt.Sprintf("Requires org feature %s (%s) for app feature %s", c.RequiresOrgFeature, resset.DescribeAction(c.Mask), c.AppFeature)
+}
+
+func (c *FeatureDependency) Equal(other macaroon.Caveat) bool {
+	o, ok := other.(*FeatureDependency)
+	return ok && *c == *o
+}
+
+// Require3PForActions is a "break-glass" caveat: accesses for any of Actions
+// (e.g. resset.ActionDelete) additionally require an ApprovalAttestation from
+// the third party at Location, while other accesses are unaffected. Unlike a
+// third-party caveat, which must always be discharged, the approval is only
+// needed for the actions it guards. To get one, the holder adds a third-party
+// caveat for Location to a copy of the token, and the third party attests its
+// approval in the discharge.
+//
+// Caveats can't see the other caveats in their set, so Require3PForActions
+// looks for the attestation in the verified caveat set carried by the access
+// (see macaroon.CaveatSetCarrier). Attestations are only included in verified
+// caveats if their discharge was issued by a trusted third party, so Location
+// must be among the verifier's trusted third parties. Any trusted third party
+// can issue an ApprovalAttestation, so only those from a discharge at
+// Location count (see macaroon.CaveatSet.AttestationLocation).
+type Require3PForActions struct {
+	Location string        `json:"location"`
+	Actions  resset.Action `json:"actions"`
+}
+
+func init() {
+	macaroon.RegisterCaveatConstructor(func() macaroon.Caveat { return &Require3PForActions{} })
+}
+
+func (c *Require3PForActions) CaveatType() macaroon.CaveatType { return CavRequire3PForActions }
+func (c *Require3PForActions) Name() string                    { return "Require3PForActions" }
+
+func (c *Require3PForActions) Prohibits(a macaroon.Access) error {
+	f, isFlyioAccess := a.(*Access)
+	switch {
+	case !isFlyioAccess:
+		return fmt.Errorf("%w: access isnt *flyio.Access", macaroon.ErrInvalidAccess)
+	case f.Action&c.Actions == 0:
+		return nil
+	case f.validation == nil:
+		return fmt.Errorf("%w: access doesn't carry its caveat set", macaroon.ErrInvalidAccess)
+	}
+
+	cs := f.validation.CaveatSet()
+	for _, cav := range cs.Caveats {
+		aa, ok := cav.(*ApprovalAttestation)
+		if !ok || aa.Location != c.Location {
+			continue
+		}
+
+		if loc, ok := cs.AttestationLocation(aa); ok && loc == c.Location {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("%w: %s requires approval from %s", macaroon.ErrMissingAttestation, resset.DescribeAction(f.Action&c.Actions), c.Location)
+}
+
+func (c *Require3PForActions) Describe() string {
+	return fmt.Sprintf("Requires approval from %s for %s", c.Location, resset.DescribeAction(c.Actions))
+}
+
+func (c *Require3PForActions) Equal(other macaroon.Caveat) bool {
+	o, ok := other.(*Require3PForActions)
+	return ok && *c == *o
+}
+
+// ApprovalAttestation attests that the third party at Location approved
+// actions guarded by a Require3PForActions caveat. Third parties add it to
+// their discharges after getting approval (e.g. from an administrator).
+// Nonce identifies the approval, e.g. for audit logs. The discharge should
+// expire soon, so that approvals are fresh. Like other attestations, it is
+// only meaningful when the discharge was issued by a trusted third party.
+// Location is self-reported, so Require3PForActions also checks that the
+// discharge was issued at Location.
+type ApprovalAttestation struct {
+	Location string `json:"location"`
+	Nonce    []byte `json:"nonce"`
+}
+
+func init() {
+	macaroon.RegisterCaveatConstructor(func() macaroon.Caveat { return &ApprovalAttestation{} })
+}
+func (c *ApprovalAttestation) CaveatType() macaroon.CaveatType   { return AttestationApproval }
+func (c *ApprovalAttestation) Name() string                      { return "ApprovalAttestation" }
+func (c *ApprovalAttestation) Prohibits(a macaroon.Access) error { return macaroon.ErrBadCaveat }
+func (c *ApprovalAttestation) IsAttestation() bool               { return true }
+
+func (c *ApprovalAttestation) Describe() string {
+	return fmt.Sprintf("Attests approval from %s", c.Location)
+}
+
+func prohibitsOtherApps(allowed uint64, appID *uint64) error {
+	switch {
+	case appID == nil:
+		return fmt.Errorf("%w app", resset.ErrResourceUnspecified)
+	case *appID != allowed:
+		return fmt.Errorf("%w app %d, only %d", resset.ErrUnauthorizedForResource, *appID, allowed)
+	default:
+		return nil
+	}
 }
 
 type MachineFeatureSet struct {
 	Features resset.ResourceSet[string, resset.Action] `json:"features"`
 }
 
-func init()                                                  { macaroon.RegisterCaveatType(&MachineFeatureSet{}) }
+func init() {
+	macaroon.RegisterCaveatConstructor(func() macaroon.Caveat { return &MachineFeatureSet{} })
+}
 func (c *MachineFeatureSet) CaveatType() macaroon.CaveatType { return CavMachineFeatureSet }
 func (c *MachineFeatureSet) Name() string                    { return "MachineFeatureSet" }
 
+// NewMachineFeatureSet returns a MachineFeatureSet caveat allowing m on
+// features. It returns an error wrapping resset.ErrExceedsMaxAction if m
+// exceeds MachineFeatureMaxActions for any of the features.
+func NewMachineFeatureSet(m resset.Action, features ...string) (*MachineFeatureSet, error) {
+	c := &MachineFeatureSet{Features: resset.New(m, features...)}
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// Validate checks that the caveat doesn't grant more than
+// MachineFeatureMaxActions. Issuers should call it before adding the caveat
+// to a token, and bundle.Bundle.Attenuate calls it automatically. It doesn't
+// affect how the caveat is evaluated, so existing tokens exceeding the
+// maximums keep working.
+func (c *MachineFeatureSet) Validate() error {
+	return boundedFeatures(c.Features, MachineFeatureMaxActions).Validate()
+}
+
 func (c *MachineFeatureSet) Prohibits(a macaroon.Access) error {
 	f, isFlyioAccess := a.(MachineFeatureGetter)
 	if !isFlyioAccess {
 		return fmt.Errorf("%w: access isnt MachineFeatureGetter", macaroon.ErrInvalidAccess)
 	}
-	return c.Features.Prohibits(f.GetMachineFeature(), f.GetAction(), "machine feature")
+	return resset.Named("machine feature", c.Features).Prohibits(f.GetMachineFeature(), f.GetAction())
+}
+
+func (c *MachineFeatureSet) Describe() string {
+	return "Restricts access to " + c.Features.Describe("machine features")
+}
+
+func (c *MachineFeatureSet) Equal(other macaroon.Caveat) bool {
+	o, ok := other.(*MachineFeatureSet)
+	return ok && c.Features.Equal(o.Features)
 }
 
 // FeatureSet is a collection of organization-level "features" that are managed
@@ -162,16 +656,55 @@ type FeatureSet struct {
 	Features resset.ResourceSet[string, resset.Action] `json:"features"`
 }
 
-func init()                                           { macaroon.RegisterCaveatType(&FeatureSet{}) }
+func init()                                           { macaroon.RegisterCaveatConstructor(func() macaroon.Caveat { return &FeatureSet{} }) }
 func (c *FeatureSet) CaveatType() macaroon.CaveatType { return CavFeatureSet }
 func (c *FeatureSet) Name() string                    { return "FeatureSet" }
 
+// NewFeatureSet returns a FeatureSet caveat allowing m on features. It returns
+// an error wrapping resset.ErrExceedsMaxAction if m exceeds FeatureMaxActions
+// for any of the features.
+func NewFeatureSet(m resset.Action, features ...string) (*FeatureSet, error) {
+	c := &FeatureSet{Features: resset.New(m, features...)}
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// Validate checks that the caveat doesn't grant more than FeatureMaxActions.
+// Issuers should call it before adding the caveat to a token, and
+// bundle.Bundle.Attenuate calls it automatically. It doesn't affect how the
+// caveat is evaluated, so existing tokens exceeding the maximums keep working.
+func (c *FeatureSet) Validate() error {
+	return boundedFeatures(c.Features, FeatureMaxActions).Validate()
+}
+
+// boundedFeatures bounds the features in rs by max. Features without bounds,
+// including the wildcard, are unbounded.
+func boundedFeatures(rs resset.ResourceSet[string, resset.Action], max map[string]resset.Action) resset.BoundedResourceSet[string] {
+	return resset.BoundedResourceSet[string]{
+		ResourceSet:  rs,
+		MaxAction:    resset.ActionAll,
+		IDMaxActions: max,
+	}
+}
+
 func (c *FeatureSet) Prohibits(a macaroon.Access) error {
 	f, isFlyioAccess := a.(FeatureGetter)
 	if !isFlyioAccess {
 		return fmt.Errorf("%w: access isnt FeatureGetter", macaroon.ErrInvalidAccess)
 	}
-	return c.Features.Prohibits(f.GetFeature(), f.GetAction(), "org feature")
+	return resset.Named("org feature", c.Features).Prohibits(f.GetFeature(), f.GetAction())
+}
+
+func (c *FeatureSet) Describe() string {
+	return "Restricts access to " + c.Features.Describe("org features")
+}
+
+func (c *FeatureSet) Equal(other macaroon.Caveat) bool {
+	o, ok := other.(*FeatureSet)
+	return ok && c.Features.Equal(o.Features)
 }
 
 // Mutations is a set of GraphQL mutations allowed by this token.
@@ -179,7 +712,7 @@ type Mutations struct {
 	Mutations []string `json:"mutations"`
 }
 
-func init()                                          { macaroon.RegisterCaveatType(&Mutations{}) }
+func init()                                          { macaroon.RegisterCaveatConstructor(func() macaroon.Caveat { return &Mutations{} }) }
 func (c *Mutations) CaveatType() macaroon.CaveatType { return CavMutations }
 func (c *Mutations) Name() string                    { return "Mutations" }
 
@@ -208,12 +741,52 @@ func (c *Mutations) Prohibits(a macaroon.Access) error {
 	return nil
 }
 
+func (c *Mutations) Describe() string {
+	if len(c.Mutations) == 0 {
+		return "Prohibits all GraphQL mutations"
+	}
+	return "Restricts GraphQL mutations to " + strings.Join(c.Mutations, ", ")
+}
+
+// Queries is a set of GraphQL queries allowed by this token.
+type Queries struct {
+	Queries []string `json:"queries"`
+}
+
+func init()                                        { macaroon.RegisterCaveatConstructor(func() macaroon.Caveat { return &Queries{} }) }
+func (c *Queries) CaveatType() macaroon.CaveatType { return CavQueries }
+func (c *Queries) Name() string                    { return "Queries" }
+
+func (c *Queries) Prohibits(a macaroon.Access) error {
+	f, isFlyioAccess := a.(QueryGetter)
+	if !isFlyioAccess {
+		return fmt.Errorf("%w: access isnt QueryGetter", macaroon.ErrInvalidAccess)
+	}
+
+	if f.GetQuery() == nil {
+		return fmt.Errorf("%w: only authorized for graphql queries", resset.ErrResourceUnspecified)
+	}
+
+	if !slices.Contains(c.Queries, *f.GetQuery()) {
+		return fmt.Errorf("%w query %s", resset.ErrUnauthorizedForResource, *f.GetQuery())
+	}
+
+	return nil
+}
+
+func (c *Queries) Describe() string {
+	if len(c.Queries) == 0 {
+		return "Prohibits all GraphQL queries"
+	}
+	return "Restricts GraphQL queries to " + strings.Join(c.Queries, ", ")
+}
+
 // deprecated in favor of auth.FlyioUserID
 type IsUser struct {
 	ID uint64 `json:"uint64"`
 }
 
-func init()                                       { macaroon.RegisterCaveatType(&IsUser{}) }
+func init()                                       { macaroon.RegisterCaveatConstructor(func() macaroon.Caveat { return &IsUser{} }) }
 func (c *IsUser) CaveatType() macaroon.CaveatType { return CavIsUser }
 func (c *IsUser) Name() string                    { return "IsUser" }
 
@@ -222,13 +795,17 @@ func (c *IsUser) Prohibits(a macaroon.Access) error {
 	return nil
 }
 
+func (c *IsUser) Describe() string {
+	return fmt.Sprintf("Issued to user %d", c.ID)
+}
+
 // Clusters is a set of Cluster caveats, with their RWX access levels. Clusters
 // belong to the "litefs-cloud" org-feature.
 type Clusters struct {
 	Clusters resset.ResourceSet[string, resset.Action] `json:"clusters"`
 }
 
-func init()                                         { macaroon.RegisterCaveatType(&Clusters{}) }
+func init()                                         { macaroon.RegisterCaveatConstructor(func() macaroon.Caveat { return &Clusters{} }) }
 func (c *Clusters) CaveatType() macaroon.CaveatType { return CavClusters }
 func (c *Clusters) Name() string                    { return "Clusters" }
 
@@ -238,7 +815,85 @@ func (c *Clusters) Prohibits(a macaroon.Access) error {
 		return fmt.Errorf("%w: access isnt ClusterGetter", macaroon.ErrInvalidAccess)
 	}
 
-	return c.Clusters.Prohibits(f.GetCluster(), f.GetAction(), "cluster")
+	return resset.Named("cluster", c.Clusters).Prohibits(f.GetCluster(), f.GetAction())
+}
+
+func (c *Clusters) Describe() string {
+	return "Restricts access to " + c.Clusters.Describe("clusters")
+}
+
+func (c *Clusters) Equal(other macaroon.Caveat) bool {
+	o, ok := other.(*Clusters)
+	return ok && c.Clusters.Equal(o.Clusters)
+}
+
+// MaxSpendCents limits the organization's projected spend, in cents, over
+// Window (e.g. "month") when creating or controlling resources. Computing the
+// projected spend is up to the service handling the request, which provides
+// it via SpendGetter. Accesses for other actions aren't restricted.
+type MaxSpendCents struct {
+	Amount uint64 `json:"amount"`
+	Window string `json:"window"`
+}
+
+func init()                                              { macaroon.RegisterCaveatConstructor(func() macaroon.Caveat { return &MaxSpendCents{} }) }
+func (c *MaxSpendCents) CaveatType() macaroon.CaveatType { return CavMaxSpendCents }
+func (c *MaxSpendCents) Name() string                    { return "MaxSpendCents" }
+
+func (c *MaxSpendCents) Prohibits(a macaroon.Access) error {
+	f, isFlyioAccess := a.(SpendGetter)
+	if !isFlyioAccess {
+		return fmt.Errorf("%w: access isnt SpendGetter", macaroon.ErrInvalidAccess)
+	}
+
+	if f.GetAction()&(resset.ActionCreate|resset.ActionControl) == 0 {
+		return nil
+	}
+
+	spend := f.GetProjectedSpendCents()
+	switch {
+	case spend == nil:
+		return fmt.Errorf("%w: projected spend", resset.ErrResourceUnspecified)
+	case *spend > c.Amount:
+		return fmt.Errorf("%w: projected spend of %s per %s exceeds limit of %s", macaroon.ErrUnauthorized, formatCents(*spend), c.Window, formatCents(c.Amount))
+	default:
+		return nil
+	}
+}
+
+func (c *MaxSpendCents) Describe() string {
+	return fmt.Sprintf("Restricts creating or controlling resources to a projected spend of %s per %s", formatCents(c.Amount), c.Window)
+}
+
+func formatCents(cents uint64) string {
+	return fmt.Sprintf("$%d.%02d", cents/100, cents%100)
+}
+
+// ReadOnly prohibits any access other than reading, regardless of the
+// resource being accessed. It composes with any other caveats, making it an
+// easy way to restrict an existing token to reads without understanding its
+// caveats. See MakeReadOnly.
+type ReadOnly struct{}
+
+func init()                                         { macaroon.RegisterCaveatConstructor(func() macaroon.Caveat { return &ReadOnly{} }) }
+func (c *ReadOnly) CaveatType() macaroon.CaveatType { return CavReadOnly }
+func (c *ReadOnly) Name() string                    { return "ReadOnly" }
+
+func (c *ReadOnly) Prohibits(a macaroon.Access) error {
+	f, isFlyioAccess := a.(resset.Access)
+	if !isFlyioAccess {
+		return fmt.Errorf("%w: access isnt resset.Access", macaroon.ErrInvalidAccess)
+	}
+
+	if action := f.GetAction(); !resset.IsSubsetOf(action, resset.ActionRead) {
+		return fmt.Errorf("%w access %s (%s not allowed, token is read-only)", resset.ErrUnauthorizedForAction, action, resset.Remove(action, resset.ActionRead))
+	}
+
+	return nil
+}
+
+func (c *ReadOnly) Describe() string {
+	return "Restricts access to reads"
 }
 
 // Role is used by the AllowedRoles and IsMember caveats.
@@ -300,7 +955,7 @@ func (r Role) String() string {
 // [GetPermittedRoles] matches the mask.
 type AllowedRoles Role
 
-func init()                                             { macaroon.RegisterCaveatType(new(AllowedRoles)) }
+func init()                                             { macaroon.RegisterCaveatConstructor(func() macaroon.Caveat { return new(AllowedRoles) }) }
 func (c *AllowedRoles) CaveatType() macaroon.CaveatType { return CavAllowedRoles }
 func (c *AllowedRoles) Name() string                    { return "AllowedRoles" }
 
@@ -320,12 +975,16 @@ func (c *AllowedRoles) Prohibits(a macaroon.Access) error {
 	return fmt.Errorf("%w: allowed roles (%v) not permitted (%v)", ErrUnauthorizedForRole, *c, permittedRoles)
 }
 
+func (c *AllowedRoles) Describe() string {
+	return fmt.Sprintf("Restricts roles to %s", Role(*c))
+}
+
 // IsMember is an alias for RoleMask(RoleMember). It used to be called
 // NoAdminFeatures.
 type IsMember struct{}
 
 func init() {
-	macaroon.RegisterCaveatType(&IsMember{})
+	macaroon.RegisterCaveatConstructor(func() macaroon.Caveat { return &IsMember{} })
 	macaroon.RegisterCaveatJSONAlias(CavIsMember, "NoAdminFeatures")
 }
 
@@ -337,6 +996,10 @@ func (c *IsMember) Prohibits(a macaroon.Access) error {
 	return ar.Prohibits(a)
 }
 
+func (c *IsMember) Describe() string {
+	return fmt.Sprintf("Restricts roles to %s", RoleMember)
+}
+
 // Commands is a list of commands allowed by this token.
 // The zero value rejects any command.
 type Commands []Command
@@ -349,7 +1012,7 @@ type Command struct {
 	Exact bool     `json:"exact,omitempty"`
 }
 
-func init()                                         { macaroon.RegisterCaveatType(&Commands{}) }
+func init()                                         { macaroon.RegisterCaveatConstructor(func() macaroon.Caveat { return &Commands{} }) }
 func (c *Commands) CaveatType() macaroon.CaveatType { return CavCommands }
 func (c *Commands) Name() string                    { return "Commands" }
 
@@ -388,11 +1051,31 @@ func (c *Commands) Prohibits(a macaroon.Access) error {
 	return nil
 }
 
+func (c *Commands) Describe() string {
+	if len(*c) == 0 {
+		return "Prohibits all commands"
+	}
+
+	cmds := make([]string, 0, len(*c))
+	for _, cmd := range *c {
+		switch {
+		case len(cmd.Args) == 0:
+			cmds = append(cmds, "any command")
+		case cmd.Exact:
+			cmds = append(cmds, fmt.Sprintf("%q (exact)", strings.Join(cmd.Args, " ")))
+		default:
+			cmds = append(cmds, fmt.Sprintf("%q (prefix)", strings.Join(cmd.Args, " ")))
+		}
+	}
+
+	return "Restricts commands to " + strings.Join(cmds, ", ")
+}
+
 type AppFeatureSet struct {
 	Features resset.ResourceSet[string, resset.Action] `json:"features"`
 }
 
-func init()                                              { macaroon.RegisterCaveatType(&AppFeatureSet{}) }
+func init()                                              { macaroon.RegisterCaveatConstructor(func() macaroon.Caveat { return &AppFeatureSet{} }) }
 func (c *AppFeatureSet) CaveatType() macaroon.CaveatType { return CavAppFeatureSet }
 func (c *AppFeatureSet) Name() string                    { return "AppFeatureSet" }
 
@@ -401,7 +1084,16 @@ func (c *AppFeatureSet) Prohibits(a macaroon.Access) error {
 	if !isFlyioAccess {
 		return fmt.Errorf("%w: access isnt AppFeatureGetter", macaroon.ErrInvalidAccess)
 	}
-	return c.Features.Prohibits(f.GetAppFeature(), f.GetAction(), "app feature")
+	return resset.Named("app feature", c.Features).Prohibits(f.GetAppFeature(), f.GetAction())
+}
+
+func (c *AppFeatureSet) Describe() string {
+	return "Restricts access to " + c.Features.Describe("app features")
+}
+
+func (c *AppFeatureSet) Equal(other macaroon.Caveat) bool {
+	o, ok := other.(*AppFeatureSet)
+	return ok && c.Features.Equal(o.Features)
 }
 
 // StorageObjects limits what storage objects can be accessed. Objects are
@@ -414,7 +1106,7 @@ type StorageObjects struct {
 }
 
 func init() {
-	macaroon.RegisterCaveatType(&StorageObjects{})
+	macaroon.RegisterCaveatConstructor(func() macaroon.Caveat { return &StorageObjects{} })
 }
 
 func (c *StorageObjects) CaveatType() macaroon.CaveatType { return CavStorageObjects }
@@ -425,5 +1117,167 @@ func (c *StorageObjects) Prohibits(a macaroon.Access) error {
 	if !isFlyioAccess {
 		return fmt.Errorf("%w: access isnt StorageObjectGetter", macaroon.ErrInvalidAccess)
 	}
-	return c.Prefixes.Prohibits(f.GetStorageObject(), f.GetAction(), "storage object")
+	return resset.Named("storage object", c.Prefixes).Prohibits(f.GetStorageObject(), f.GetAction())
+}
+
+func (c *StorageObjects) Describe() string {
+	return "Restricts access to " + c.Prefixes.Describe("storage objects")
+}
+
+func (c *StorageObjects) Equal(other macaroon.Caveat) bool {
+	o, ok := other.(*StorageObjects)
+	return ok && c.Prefixes.Equal(o.Prefixes)
+}
+
+// SourceNetworks restricts the token to requests originating from IP addresses
+// within one of the listed CIDR ranges (e.g. a CI provider's egress range).
+// It should be constructed with NewSourceNetworks, which rejects malformed
+// ranges. The zero value rejects every request.
+type SourceNetworks struct {
+	Networks []string `json:"networks"`
+}
+
+// NewSourceNetworks returns a SourceNetworks caveat allowing requests from any
+// of the given CIDR ranges. IPv4 and IPv6 ranges may be mixed. Ranges are
+// normalized (e.g. "10.1.2.3/8" becomes "10.0.0.0/8"), sorted, and
+// deduplicated so the caveat's encoding is canonical.
+func NewSourceNetworks(cidrs ...string) (*SourceNetworks, error) {
+	prefixes := make([]netip.Prefix, 0, len(cidrs))
+
+	for _, cidr := range cidrs {
+		p, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", macaroon.ErrBadCaveat, err)
+		}
+
+		prefixes = append(prefixes, p)
+	}
+
+	return &SourceNetworks{Networks: canonicalNetworks(prefixes)}, nil
+}
+
+func init() {
+	macaroon.RegisterCaveatConstructor(func() macaroon.Caveat { return &SourceNetworks{} })
+}
+
+func (c *SourceNetworks) CaveatType() macaroon.CaveatType { return CavSourceNetworks }
+func (c *SourceNetworks) Name() string                    { return "SourceNetworks" }
+
+func (c *SourceNetworks) Prohibits(a macaroon.Access) error {
+	f, isFlyioAccess := a.(SourceIPGetter)
+	if !isFlyioAccess {
+		return fmt.Errorf("%w: access isnt SourceIPGetter", macaroon.ErrInvalidAccess)
+	}
+
+	ip := f.GetSourceIP().Unmap()
+	if !ip.IsValid() {
+		return fmt.Errorf("%w source IP", resset.ErrResourceUnspecified)
+	}
+
+	for _, network := range c.Networks {
+		// malformed networks can't be minted with NewSourceNetworks. Those
+		// from other implementations don't allow anything.
+		if p, err := netip.ParsePrefix(network); err == nil && p.Contains(ip) {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("%w: source IP %s not in allowed networks", macaroon.ErrUnauthorized, ip)
+}
+
+func (c *SourceNetworks) Describe() string {
+	if len(c.Networks) == 0 {
+		return "Prohibits requests from all networks"
+	}
+
+	return "Restricts requests to those from " + strings.Join(c.Networks, ", ")
+}
+
+func (c *SourceNetworks) Equal(other macaroon.Caveat) bool {
+	o, ok := other.(*SourceNetworks)
+	return ok && slices.Equal(c.Networks, o.Networks)
+}
+
+// EncodeMsgpack implements msgpack.CustomEncoder. Networks are encoded in
+// canonical form, so that equivalent caveats have the same encoding.
+func (c SourceNetworks) EncodeMsgpack(enc *msgpack.Encoder) error {
+	prefixes := make([]netip.Prefix, 0, len(c.Networks))
+
+	for _, network := range c.Networks {
+		p, err := netip.ParsePrefix(network)
+		if err != nil {
+			return fmt.Errorf("%w: %w", macaroon.ErrBadCaveat, err)
+		}
+
+		prefixes = append(prefixes, p)
+	}
+
+	if err := enc.EncodeArrayLen(1); err != nil {
+		return err
+	}
+
+	return enc.Encode(canonicalNetworks(prefixes))
+}
+
+// canonicalNetworks masks, sorts, and deduplicates prefixes.
+func canonicalNetworks(prefixes []netip.Prefix) []string {
+	for i := range prefixes {
+		prefixes[i] = prefixes[i].Masked()
+	}
+
+	slices.SortFunc(prefixes, func(a, b netip.Prefix) bool {
+		if c := a.Addr().Compare(b.Addr()); c != 0 {
+			return c < 0
+		}
+		return a.Bits() < b.Bits()
+	})
+
+	prefixes = slices.Compact(prefixes)
+
+	ret := make([]string, len(prefixes))
+	for i, p := range prefixes {
+		ret[i] = p.String()
+	}
+
+	return ret
+}
+
+// OIDCAudiences limits the audiences for which OIDC tokens can be requested
+// using the "oidc" machine feature. Audiences are matched by URL prefix, so
+// `https://example.com/` allows `https://example.com/foo`. Accesses not
+// involving the "oidc" machine feature aren't affected.
+type OIDCAudiences struct {
+	Audiences resset.ResourceSet[resset.Prefix, resset.Action] `json:"audiences"`
+}
+
+func init() {
+	macaroon.RegisterCaveatConstructor(func() macaroon.Caveat { return &OIDCAudiences{} })
+}
+
+func (c *OIDCAudiences) CaveatType() macaroon.CaveatType { return CavOIDCAudiences }
+func (c *OIDCAudiences) Name() string                    { return "OIDCAudiences" }
+
+func (c *OIDCAudiences) Prohibits(a macaroon.Access) error {
+	f, isFlyioAccess := a.(AudienceGetter)
+	if !isFlyioAccess {
+		return fmt.Errorf("%w: access isnt AudienceGetter", macaroon.ErrInvalidAccess)
+	}
+
+	if f.GetAudience() == nil {
+		mf, ok := a.(MachineFeatureGetter)
+		if !ok || mf.GetMachineFeature() == nil || *mf.GetMachineFeature() != MachineFeatureOIDC {
+			return nil
+		}
+	}
+
+	return resset.Named("oidc audience", c.Audiences).Prohibits((*resset.Prefix)(f.GetAudience()), f.GetAction())
+}
+
+func (c *OIDCAudiences) Describe() string {
+	return "Restricts OIDC tokens to " + c.Audiences.Describe("audiences")
+}
+
+func (c *OIDCAudiences) Equal(other macaroon.Caveat) bool {
+	o, ok := other.(*OIDCAudiences)
+	return ok && c.Audiences.Equal(o.Audiences)
 }
@@ -0,0 +1,144 @@
+package flyio
+
+import (
+	"fmt"
+	"net/netip"
+
+	"golang.org/x/exp/slices"
+
+	"github.com/superfly/macaroon"
+	"github.com/superfly/macaroon/resset"
+)
+
+// CaveatsForAccess returns the caveats for a token that allows the access,
+// constraining every resource the access specifies to exactly its ID and
+// exactly the access's action. Adding them to a token that allows the access
+// (e.g. an organization admin's token) results in a token that allows the
+// access but not the same access with a broader action or different
+// resources.
+//
+// Only the resources the access specifies are constrained: a token for an
+// organization-level access also allows the same action on the
+// organization's apps. Storage objects and OIDC audiences are constrained by
+// prefix, so objects and audiences starting with the access's are also
+// allowed. The access's ProjectedSpendCents and VerifierLocation are
+// ignored.
+//
+// ErrAmbiguousAccess is returned for accesses that can't be granted exactly,
+// such as those with zero or empty IDs, which caveats treat as wildcards.
+func CaveatsForAccess(a *Access) ([]macaroon.Caveat, error) {
+	if err := a.Validate(); err != nil {
+		return nil, err
+	}
+
+	if !resset.IsSubsetOf(a.Action, resset.ActionAll) {
+		return nil, fmt.Errorf("%w: unknown action bits %d", ErrAmbiguousAccess, resset.Remove(a.Action, resset.ActionAll))
+	}
+
+	var (
+		cavs   []macaroon.Caveat
+		action = a.Action
+	)
+
+	if a.OrgID != nil {
+		if *a.OrgID == 0 {
+			return nil, fmt.Errorf("%w: organization ID is 0", ErrAmbiguousAccess)
+		}
+		cavs = append(cavs, &Organization{ID: *a.OrgID, Mask: action})
+	}
+
+	if a.OrgSlug != nil {
+		if *a.OrgSlug == "" {
+			return nil, fmt.Errorf("%w: organization slug is empty", ErrAmbiguousAccess)
+		}
+		cavs = append(cavs, &OrgSlug{Slug: *a.OrgSlug, Mask: action})
+	}
+
+	if a.AppID != nil {
+		if *a.AppID == 0 {
+			return nil, fmt.Errorf("%w: app ID is 0", ErrAmbiguousAccess)
+		}
+		cavs = append(cavs, &Apps{Apps: resset.New(action, *a.AppID)})
+	}
+
+	for name, id := range map[string]*string{
+		"app name":        a.AppName,
+		"feature":         a.Feature,
+		"app feature":     a.AppFeature,
+		"volume":          a.Volume,
+		"machine":         a.Machine,
+		"machine feature": a.MachineFeature,
+		"cluster":         a.Cluster,
+		"storage object":  (*string)(a.StorageObject),
+		"audience":        a.Audience,
+	} {
+		if id != nil && *id == "" {
+			return nil, fmt.Errorf("%w: %s is empty", ErrAmbiguousAccess, name)
+		}
+	}
+
+	if a.AppName != nil {
+		cavs = append(cavs, &AppNames{Apps: resset.New(action, *a.AppName)})
+	}
+
+	if a.Feature != nil {
+		cavs = append(cavs, &FeatureSet{Features: resset.New(action, *a.Feature)})
+	}
+
+	if a.AppFeature != nil {
+		cavs = append(cavs, &AppFeatureSet{Features: resset.New(action, *a.AppFeature)})
+	}
+
+	if a.Volume != nil {
+		cavs = append(cavs, &Volumes{Volumes: resset.New(action, *a.Volume)})
+	}
+
+	if a.Machine != nil {
+		cavs = append(cavs, &Machines{Machines: resset.New(action, *a.Machine)})
+	}
+
+	if a.MachineFeature != nil {
+		cavs = append(cavs, &MachineFeatureSet{Features: resset.New(action, *a.MachineFeature)})
+	}
+
+	if a.Cluster != nil {
+		cavs = append(cavs, &Clusters{Clusters: resset.New(action, *a.Cluster)})
+	}
+
+	if a.StorageObject != nil {
+		cavs = append(cavs, &StorageObjects{Prefixes: resset.New(action, *a.StorageObject)})
+	}
+
+	if a.Audience != nil {
+		cavs = append(cavs, &OIDCAudiences{Audiences: resset.New(action, resset.Prefix(*a.Audience))})
+	}
+
+	if a.Mutation != nil {
+		cavs = append(cavs, &Mutations{Mutations: []string{*a.Mutation}})
+	}
+
+	if a.Query != nil {
+		cavs = append(cavs, &Queries{Queries: []string{*a.Query}})
+	}
+
+	if a.Command != nil {
+		if len(a.Command) == 0 {
+			return nil, fmt.Errorf("%w: command is empty", ErrAmbiguousAccess)
+		}
+		cavs = append(cavs, &Commands{{Args: slices.Clone(a.Command), Exact: true}})
+	}
+
+	if a.SourceMachine != nil {
+		cavs = append(cavs, &FromMachine{ID: *a.SourceMachine})
+	}
+
+	if a.SourceIP != nil {
+		ip := a.SourceIP.Unmap()
+		if !ip.IsValid() {
+			return nil, fmt.Errorf("%w: invalid source IP", ErrAmbiguousAccess)
+		}
+		cavs = append(cavs, &SourceNetworks{Networks: []string{netip.PrefixFrom(ip, ip.BitLen()).String()}})
+	}
+
+	return cavs, nil
+}
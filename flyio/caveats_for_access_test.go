@@ -0,0 +1,140 @@
+package flyio
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/alecthomas/assert/v2"
+	"github.com/superfly/macaroon"
+	"github.com/superfly/macaroon/resset"
+)
+
+func TestCaveatsForAccess(t *testing.T) {
+	ip := netip.MustParseAddr("10.1.2.3")
+
+	cases := map[string]*Access{
+		"org":             {OrgID: uptr(5), Action: resset.ActionRead},
+		"org slug":        {OrgID: uptr(5), OrgSlug: ptr("my-org"), Action: resset.ActionRead | resset.ActionWrite},
+		"app":             {OrgID: uptr(5), AppID: uptr(42), Action: resset.ActionWrite},
+		"app name":        {OrgSlug: ptr("my-org"), AppName: ptr("my-app"), Action: resset.ActionRead},
+		"no action":       {OrgID: uptr(5), AppID: uptr(42), Action: resset.ActionNone},
+		"machine":         {OrgID: uptr(5), AppID: uptr(42), Machine: ptr("m1"), Action: resset.ActionControl},
+		"volume":          {OrgID: uptr(5), AppID: uptr(42), Volume: ptr("vol_1"), Action: resset.ActionDelete},
+		"app feature":     {OrgID: uptr(5), AppID: uptr(42), AppFeature: ptr("images"), Action: resset.ActionRead},
+		"feature":         {OrgID: uptr(5), Feature: ptr(FeatureWireGuard), Action: resset.ActionCreate},
+		"cluster":         {OrgID: uptr(5), Feature: ptr(FeatureLFSC), Cluster: ptr("c1"), Action: resset.ActionRead},
+		"storage object":  {OrgID: uptr(5), StorageObject: ptr(resset.Prefix("https://storage.fly/b/o")), Action: resset.ActionRead},
+		"command":         {OrgID: uptr(5), AppID: uptr(42), Machine: ptr("m1"), Command: []string{"ls", "-l"}, Action: resset.ActionWrite},
+		"oidc":            {OrgID: uptr(5), AppID: uptr(42), Machine: ptr("m1"), MachineFeature: ptr(MachineFeatureOIDC), Audience: ptr("https://a.example"), Action: resset.ActionRead},
+		"mutation":        {OrgID: uptr(5), Mutation: ptr("addCertificate"), Action: resset.ActionWrite},
+		"query":           {OrgID: uptr(5), Query: ptr("appStatus"), Action: resset.ActionRead},
+		"source":          {OrgID: uptr(5), AppID: uptr(42), SourceMachine: ptr("m2"), SourceIP: &ip, Action: resset.ActionRead},
+		"all the actions": {OrgID: uptr(5), AppID: uptr(42), Action: resset.ActionAll},
+	}
+
+	// broaden returns accesses that a token for a shouldn't allow.
+	broaden := func(a *Access) map[string]*Access {
+		ret := map[string]*Access{}
+
+		with := func(name string, f func(*Access)) {
+			cp := *a
+			f(&cp)
+			ret[name] = &cp
+		}
+
+		for _, bit := range []resset.Action{resset.ActionRead, resset.ActionWrite, resset.ActionCreate, resset.ActionDelete, resset.ActionControl} {
+			if a.Action&bit == 0 {
+				with("extra "+bit.String(), func(cp *Access) { cp.Action |= bit })
+			}
+		}
+
+		if a.OrgID != nil {
+			with("other org", func(cp *Access) { cp.OrgID = uptr(6) })
+		}
+		if a.OrgSlug != nil {
+			with("other org slug", func(cp *Access) { cp.OrgSlug = ptr("other-org") })
+		}
+		if a.AppID != nil {
+			with("other app", func(cp *Access) { cp.AppID = uptr(43) })
+		}
+		if a.AppName != nil {
+			with("other app name", func(cp *Access) { cp.AppName = ptr("other-app") })
+		}
+		if a.Machine != nil {
+			with("other machine", func(cp *Access) { cp.Machine = ptr("other") })
+		}
+		if a.Volume != nil {
+			with("other volume", func(cp *Access) { cp.Volume = ptr("other") })
+		}
+		if a.AppFeature != nil {
+			with("other app feature", func(cp *Access) { cp.AppFeature = ptr("other") })
+		}
+		if a.Feature != nil && a.Cluster == nil {
+			with("other feature", func(cp *Access) { cp.Feature = ptr("other") })
+		}
+		if a.Cluster != nil {
+			with("other cluster", func(cp *Access) { cp.Cluster = ptr("other") })
+		}
+		if a.StorageObject != nil {
+			with("other storage object", func(cp *Access) { cp.StorageObject = ptr(resset.Prefix("https://storage.fly/b/x")) })
+		}
+		if a.Command != nil {
+			with("other command", func(cp *Access) { cp.Command = []string{"rm", "-rf"} })
+			with("more args", func(cp *Access) { cp.Command = append(a.Command[:len(a.Command):len(a.Command)], "-a") })
+		}
+		if a.Audience != nil {
+			with("other audience", func(cp *Access) { cp.Audience = ptr("https://b.example") })
+		}
+		if a.Mutation != nil {
+			with("other mutation", func(cp *Access) { cp.Mutation = ptr("deleteApp") })
+		}
+		if a.Query != nil {
+			with("other query", func(cp *Access) { cp.Query = ptr("viewer") })
+		}
+		if a.SourceMachine != nil {
+			with("other source machine", func(cp *Access) { cp.SourceMachine = ptr("other") })
+		}
+		if a.SourceIP != nil {
+			with("other source IP", func(cp *Access) { cp.SourceIP = ptr(netip.MustParseAddr("10.1.2.4")) })
+		}
+
+		return ret
+	}
+
+	for name, a := range cases {
+		a := a
+
+		t.Run(name, func(t *testing.T) {
+			cavs, err := CaveatsForAccess(a)
+			assert.NoError(t, err)
+
+			cs := macaroon.NewCaveatSet(cavs...)
+			assert.NoError(t, cs.Validate(a))
+
+			broader := broaden(a)
+			assert.NotZero(t, len(broader))
+
+			for bname, b := range broader {
+				assert.Error(t, cs.Validate(b), bname)
+			}
+		})
+	}
+
+	t.Run("ambiguous", func(t *testing.T) {
+		for name, a := range map[string]*Access{
+			"zero org":      {OrgID: uptr(0), Action: resset.ActionRead},
+			"zero app":      {OrgID: uptr(5), AppID: uptr(0), Action: resset.ActionRead},
+			"empty machine": {OrgID: uptr(5), AppID: uptr(42), Machine: ptr(""), Action: resset.ActionRead},
+			"empty command": {OrgID: uptr(5), AppID: uptr(42), Machine: ptr("m1"), Command: []string{}, Action: resset.ActionRead},
+			"unknown bits":  {OrgID: uptr(5), Action: resset.ActionAll + 1},
+		} {
+			_, err := CaveatsForAccess(a)
+			assert.IsError(t, err, ErrAmbiguousAccess, name)
+		}
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		_, err := CaveatsForAccess(&Access{AppID: uptr(42), Action: resset.ActionRead})
+		assert.IsError(t, err, macaroon.ErrInvalidAccess)
+	})
+}
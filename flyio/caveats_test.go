@@ -2,10 +2,12 @@ package flyio
 
 import (
 	"encoding/json"
+	"net/netip"
 	"testing"
 
 	"github.com/alecthomas/assert/v2"
 	"github.com/superfly/macaroon"
+	"github.com/superfly/macaroon/auth"
 	"github.com/superfly/macaroon/resset"
 )
 
@@ -17,13 +19,27 @@ func TestCaveatSerialization(t *testing.T) {
 		&Volumes{Volumes: resset.New(resset.ActionRead, "123")},
 		&Machines{Machines: resset.New(resset.ActionRead, "123")},
 		&Mutations{Mutations: []string{"123"}},
+		&Queries{Queries: []string{"123"}},
 		&IsUser{ID: 123},
 		&MachineFeatureSet{Features: resset.New(resset.ActionRead, "123")},
 		&FromMachine{ID: "asdf"},
+		&MachineIdentity{MachineID: "asdf", AppID: 123, OrgID: 234},
 		&Clusters{Clusters: resset.New(resset.ActionRead, "123")},
 		&IsMember{},
 		ptr(AllowedRoles(RoleAdmin)),
 		&Commands{Command{[]string{"123"}, true}},
+		&OrgSlug{Slug: "my-org", Mask: resset.ActionRead},
+		&AppNames{Apps: resset.New(resset.ActionRead, "my-app")},
+		&SourceNetworks{Networks: []string{"10.0.0.0/8", "2001:db8::/32"}},
+		&OIDCAudiences{Audiences: resset.New(resset.ActionRead, resset.Prefix("https://example.com/"))},
+		&MaxSpendCents{Amount: 10000, Window: "month"},
+		&ReadOnly{},
+		&AppVolumes{AppID: 123, Volumes: resset.New(resset.ActionRead, "123")},
+		&AppMachines{AppID: 123, Machines: resset.New(resset.ActionRead, "123")},
+		&FeatureDependency{AppFeature: "registry", RequiresOrgFeature: FeatureRemoteBuilders, Mask: resset.ActionRead},
+		&Require3PForActions{Location: "https://approvals.example", Actions: resset.ActionDelete},
+		&ApprovalAttestation{Location: "https://approvals.example", Nonce: []byte("approval")},
+		&macaroon.ScopedToLocation{Locations: []string{LocationPermission}, Caveats: macaroon.NewCaveatSet(&Mutations{Mutations: []string{"123"}})},
 	)
 
 	b, err := json.Marshal(cs)
@@ -41,6 +57,94 @@ func TestCaveatSerialization(t *testing.T) {
 	assert.Equal(t, cs, cs2)
 }
 
+func TestCaveatJSONEmitName(t *testing.T) {
+	var (
+		cs  = macaroon.NewCaveatSet(&Organization{ID: 123, Mask: resset.ActionRead})
+		old = []byte(`[{"type":"DeprecatedOrganization","body":{"id":123,"mask":"r"}}]`)
+		cur = []byte(`[{"type":"Organization","body":{"id":123,"mask":"r"}}]`)
+	)
+
+	pack, err := cs.MarshalMsgpack()
+	assert.NoError(t, err)
+
+	macaroon.SetCaveatJSONEmitName(CavOrganization, "DeprecatedOrganization")
+	t.Cleanup(func() { macaroon.SetCaveatJSONEmitName(CavOrganization, "Organization") })
+
+	b, err := json.Marshal(cs)
+	assert.NoError(t, err)
+	assert.Equal(t, string(old), string(b))
+
+	// both names are still accepted
+	for _, j := range [][]byte{old, cur} {
+		cs2 := macaroon.NewCaveatSet()
+		assert.NoError(t, json.Unmarshal(j, cs2))
+		assert.Equal(t, cs, cs2)
+	}
+
+	// msgpack is unaffected
+	b, err = cs.MarshalMsgpack()
+	assert.NoError(t, err)
+	assert.Equal(t, pack, b)
+
+	macaroon.SetCaveatJSONEmitName(CavOrganization, "Organization")
+
+	b, err = json.Marshal(cs)
+	assert.NoError(t, err)
+	assert.Equal(t, string(cur), string(b))
+
+	assert.Panics(t, func() { macaroon.SetCaveatJSONEmitName(CavOrganization, "DeprecatedApps") })
+	assert.Panics(t, func() { macaroon.SetCaveatJSONEmitName(CavOrganization, "NoSuchCaveat") })
+}
+
+func TestNameBasedCaveats(t *testing.T) {
+	yes := func(cs *macaroon.CaveatSet, access *Access) {
+		t.Helper()
+		assert.NoError(t, cs.Validate(access))
+	}
+
+	no := func(cs *macaroon.CaveatSet, access *Access, target error) {
+		t.Helper()
+		err := cs.Validate(access)
+		assert.Error(t, err)
+		assert.IsError(t, err, target)
+	}
+
+	names := macaroon.NewCaveatSet(
+		&OrgSlug{Slug: "my-org", Mask: resset.ActionAll},
+		&AppNames{Apps: resset.New(resset.ActionRead, "my-app")},
+	)
+
+	yes(names, &Access{OrgSlug: ptr("my-org"), AppName: ptr("my-app"), Action: resset.ActionRead})
+	no(names, &Access{OrgSlug: ptr("other-org"), AppName: ptr("my-app"), Action: resset.ActionRead}, resset.ErrUnauthorizedForResource)
+	no(names, &Access{OrgSlug: ptr("my-org"), AppName: ptr("other-app"), Action: resset.ActionRead}, resset.ErrUnauthorizedForResource)
+	no(names, &Access{OrgSlug: ptr("my-org"), AppName: ptr("my-app"), Action: resset.ActionWrite}, resset.ErrUnauthorizedForAction)
+
+	// numeric IDs alone aren't enough
+	no(names, &Access{OrgID: uptr(1), AppID: uptr(2), Action: resset.ActionRead}, resset.ErrResourceUnspecified)
+	no(names, &Access{OrgID: uptr(1), OrgSlug: ptr("my-org"), AppID: uptr(2), Action: resset.ActionRead}, resset.ErrResourceUnspecified)
+
+	// mixed ID-based and name-based caveats must both pass
+	mixed := macaroon.NewCaveatSet(
+		&Organization{ID: 1, Mask: resset.ActionAll},
+		&OrgSlug{Slug: "my-org", Mask: resset.ActionRead},
+		&Apps{Apps: resset.New[uint64](resset.ActionAll, 2)},
+		&AppNames{Apps: resset.New(resset.ActionAll, "my-app")},
+	)
+
+	yes(mixed, &Access{OrgID: uptr(1), OrgSlug: ptr("my-org"), AppID: uptr(2), AppName: ptr("my-app"), Action: resset.ActionRead})
+	no(mixed, &Access{OrgID: uptr(1), OrgSlug: ptr("my-org"), AppID: uptr(2), AppName: ptr("my-app"), Action: resset.ActionWrite}, resset.ErrUnauthorizedForAction)
+	no(mixed, &Access{OrgID: uptr(3), OrgSlug: ptr("my-org"), AppID: uptr(2), AppName: ptr("my-app"), Action: resset.ActionRead}, resset.ErrUnauthorizedForResource)
+	no(mixed, &Access{OrgSlug: ptr("my-org"), AppName: ptr("my-app"), Action: resset.ActionRead}, resset.ErrResourceUnspecified)
+	no(mixed, &Access{OrgID: uptr(1), AppID: uptr(2), Action: resset.ActionRead}, resset.ErrResourceUnspecified)
+
+	// an empty slug isn't a wildcard
+	empty := &OrgSlug{Mask: resset.ActionAll}
+	no(macaroon.NewCaveatSet(empty), &Access{OrgSlug: ptr("my-org"), Action: resset.ActionRead}, ErrEmptyOrgSlug)
+	no(macaroon.NewCaveatSet(empty), &Access{OrgSlug: ptr(""), Action: resset.ActionRead}, macaroon.ErrBadCaveat)
+	assert.IsError(t, empty.Validate(), ErrEmptyOrgSlug)
+	assert.NoError(t, (&OrgSlug{Slug: "my-org"}).Validate())
+}
+
 func TestAllowedRoles(t *testing.T) {
 	csMember := macaroon.NewCaveatSet(&IsMember{})
 	csAdmin := macaroon.NewCaveatSet(ptr(AllowedRoles(RoleAdmin)))
@@ -144,6 +248,59 @@ func TestRole(t *testing.T) {
 	assert.False(t, RoleMember.HasAllRoles(RoleBillingManager))
 }
 
+func TestOrganizationRestriction(t *testing.T) {
+	access := func(orgID uint64) *Access {
+		return &Access{OrgID: &orgID, Action: resset.ActionRead}
+	}
+
+	_, err := OrgRestriction(0, resset.ActionAll)
+	assert.IsError(t, err, ErrZeroOrgID)
+
+	org, err := OrgRestriction(123, resset.ActionRead)
+	assert.NoError(t, err)
+	assert.NoError(t, org.Validate())
+	assert.NoError(t, org.Prohibits(access(123)))
+	assert.IsError(t, org.Prohibits(access(234)), resset.ErrUnauthorizedForResource)
+
+	// deliberate wildcard
+	anyOrg := AnyOrgRestriction(resset.ActionRead)
+	assert.NoError(t, anyOrg.Validate())
+	assert.NoError(t, anyOrg.Prohibits(access(123)))
+	assert.NoError(t, anyOrg.Prohibits(access(234)))
+	assert.IsError(t, anyOrg.Prohibits(&Access{OrgID: uptr(123), Action: resset.ActionWrite}), resset.ErrUnauthorizedForAction)
+
+	// accidental wildcard
+	accidental := &Organization{Mask: resset.ActionRead}
+	assert.IsError(t, accidental.Validate(), ErrZeroOrgID)
+
+	// existing wildcard tokens evaluate the same and encode identically
+	b, err := macaroon.NewCaveatSet(anyOrg).MarshalMsgpack()
+	assert.NoError(t, err)
+	b2, err := macaroon.NewCaveatSet(accidental).MarshalMsgpack()
+	assert.NoError(t, err)
+	assert.Equal(t, b, b2)
+
+	cs, err := macaroon.DecodeCaveats(b)
+	assert.NoError(t, err)
+	assert.NoError(t, cs.Validate(access(123)))
+	assert.NoError(t, cs.Validate(access(234)))
+
+	// Bundle.Attenuate validates caveats
+	m, err := macaroon.New([]byte("kid"), LocationPermission, macaroon.NewSigningKey())
+	assert.NoError(t, err)
+	tok, err := m.Encode()
+	assert.NoError(t, err)
+
+	bun, err := ParseBundle(macaroon.ToAuthorizationHeader(tok))
+	assert.NoError(t, err)
+	hdr := bun.Header()
+
+	assert.IsError(t, bun.Attenuate(accidental), ErrZeroOrgID)
+	assert.Equal(t, hdr, bun.Header())
+	assert.NoError(t, bun.Attenuate(anyOrg))
+	assert.NotEqual(t, hdr, bun.Header())
+}
+
 func TestCommands(t *testing.T) {
 	yes := func(cs *macaroon.CaveatSet, access *Access) {
 		t.Helper()
@@ -271,3 +428,710 @@ func TestCommands(t *testing.T) {
 		Action:  resset.ActionWrite,
 	}, resset.ErrUnauthorizedForAction)
 }
+
+func TestFromMachine(t *testing.T) {
+	fm := &FromMachine{ID: "m1"}
+
+	assert.NoError(t, fm.Prohibits(&Access{OrgID: uptr(1), SourceMachine: ptr("m1")}))
+	assert.IsError(t, fm.Prohibits(&Access{OrgID: uptr(1), SourceMachine: ptr("m2")}), macaroon.ErrUnauthorized)
+	assert.IsError(t, fm.Prohibits(&Access{OrgID: uptr(1)}), macaroon.ErrUnauthorized)
+
+	// IfPresent mustn't fall through to Else for requests without a source
+	// machine.
+	ifp := &resset.IfPresent{Ifs: macaroon.NewCaveatSet(fm), Else: resset.ActionAll}
+	assert.IsError(t, ifp.Prohibits(&Access{OrgID: uptr(1), Action: resset.ActionRead}), macaroon.ErrUnauthorized)
+	assert.NoError(t, ifp.Prohibits(&Access{OrgID: uptr(1), Action: resset.ActionRead, SourceMachine: ptr("m1")}))
+}
+
+func TestSourceNetworks(t *testing.T) {
+	access := func(ip string) *Access {
+		return &Access{OrgID: uptr(1), SourceIP: ptr(netip.MustParseAddr(ip))}
+	}
+
+	_, err := NewSourceNetworks("10.0.0.0/8", "bogus")
+	assert.IsError(t, err, macaroon.ErrBadCaveat)
+	_, err = NewSourceNetworks("10.0.0.0/33")
+	assert.IsError(t, err, macaroon.ErrBadCaveat)
+
+	// normalized, sorted, and deduplicated
+	sn, err := NewSourceNetworks("2001:db8:1::/48", "10.1.2.3/8", "10.0.0.0/16", "10.0.0.0/8", "192.168.1.1/32")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"10.0.0.0/8", "10.0.0.0/16", "192.168.1.1/32", "2001:db8:1::/48"}, sn.Networks)
+
+	assert.NoError(t, sn.Prohibits(access("10.200.0.1")))
+	assert.NoError(t, sn.Prohibits(access("10.0.0.1")))
+	assert.NoError(t, sn.Prohibits(access("192.168.1.1")))
+	assert.NoError(t, sn.Prohibits(access("::ffff:192.168.1.1")))
+	assert.NoError(t, sn.Prohibits(access("2001:db8:1:2::1")))
+	assert.IsError(t, sn.Prohibits(access("192.168.1.2")), macaroon.ErrUnauthorized)
+	assert.IsError(t, sn.Prohibits(access("2001:db8:2::1")), macaroon.ErrUnauthorized)
+	assert.IsError(t, sn.Prohibits(&Access{OrgID: uptr(1)}), resset.ErrResourceUnspecified)
+	assert.IsError(t, (&SourceNetworks{}).Prohibits(access("10.0.0.1")), macaroon.ErrUnauthorized)
+
+	// encoding is canonical regardless of how the caveat was built
+	b, err := macaroon.NewCaveatSet(sn).MarshalMsgpack()
+	assert.NoError(t, err)
+	b2, err := macaroon.NewCaveatSet(&SourceNetworks{Networks: []string{"192.168.1.1/32", "2001:db8:1::/48", "10.0.0.0/16", "10.0.0.0/8"}}).MarshalMsgpack()
+	assert.NoError(t, err)
+	assert.Equal(t, b, b2)
+
+	cs, err := macaroon.DecodeCaveats(b)
+	assert.NoError(t, err)
+	assert.Equal(t, macaroon.NewCaveatSet(sn), cs)
+
+	_, err = macaroon.NewCaveatSet(&SourceNetworks{Networks: []string{"bogus"}}).MarshalMsgpack()
+	assert.IsError(t, err, macaroon.ErrBadCaveat)
+}
+
+func TestOIDCAudiences(t *testing.T) {
+	oidc := func(aud *string) *Access {
+		return &Access{
+			OrgID:          uptr(1),
+			AppID:          uptr(2),
+			Machine:        ptr("m1"),
+			MachineFeature: ptr(MachineFeatureOIDC),
+			Audience:       aud,
+			Action:         resset.ActionRead,
+		}
+	}
+
+	cav := &OIDCAudiences{Audiences: resset.New(resset.ActionRead, resset.Prefix("https://example.com/"), resset.Prefix("sts.amazonaws.com"))}
+
+	assert.NoError(t, cav.Prohibits(oidc(ptr("https://example.com/"))))
+	assert.NoError(t, cav.Prohibits(oidc(ptr("https://example.com/foo"))))
+	assert.NoError(t, cav.Prohibits(oidc(ptr("sts.amazonaws.com"))))
+	assert.IsError(t, cav.Prohibits(oidc(ptr("https://example.org/"))), resset.ErrUnauthorizedForResource)
+	assert.IsError(t, cav.Prohibits(oidc(ptr("https://example.co"))), resset.ErrUnauthorizedForResource)
+	assert.IsError(t, cav.Prohibits(oidc(nil)), resset.ErrResourceUnspecified)
+
+	// other accesses are unaffected
+	assert.NoError(t, cav.Prohibits(&Access{OrgID: uptr(1), AppID: uptr(2), Machine: ptr("m1"), MachineFeature: ptr("metadata")}))
+	assert.NoError(t, cav.Prohibits(&Access{OrgID: uptr(1)}))
+
+	// validation
+	assert.NoError(t, oidc(ptr("https://example.com/")).Validate())
+	assert.IsError(t, oidc(nil).Validate(), macaroon.ErrInvalidAccess)
+	assert.IsError(t, (&Access{OrgID: uptr(1), Audience: ptr("https://example.com/")}).Validate(), macaroon.ErrInvalidAccess)
+}
+
+func TestQueries(t *testing.T) {
+	access := func(action resset.Action, query, mutation *string) *Access {
+		return &Access{OrgID: uptr(123), Action: action, Query: query, Mutation: mutation}
+	}
+
+	cav := &Queries{Queries: []string{"appStatus"}}
+	assert.NoError(t, cav.Prohibits(access(resset.ActionRead, ptr("appStatus"), nil)))
+	assert.IsError(t, cav.Prohibits(access(resset.ActionRead, ptr("viewerOrganizations"), nil)), resset.ErrUnauthorizedForResource)
+	assert.IsError(t, cav.Prohibits(access(resset.ActionRead, nil, nil)), resset.ErrResourceUnspecified)
+	assert.IsError(t, cav.Prohibits(access(resset.ActionWrite, nil, ptr("addCertificate"))), resset.ErrResourceUnspecified)
+
+	// queries and mutations are mutually exclusive
+	assert.NoError(t, access(resset.ActionRead, ptr("appStatus"), nil).Validate())
+	assert.NoError(t, access(resset.ActionWrite, nil, ptr("addCertificate")).Validate())
+	assert.IsError(t, access(resset.ActionRead, ptr("appStatus"), ptr("addCertificate")).Validate(), resset.ErrResourcesMutuallyExclusive)
+
+	// one query plus read-only access to the org
+	cs := macaroon.NewCaveatSet(
+		&Organization{ID: 123, Mask: resset.ActionRead},
+		&resset.IfPresent{Ifs: macaroon.NewCaveatSet(cav), Else: resset.ActionRead},
+	)
+	assert.NoError(t, cs.Validate(access(resset.ActionRead, ptr("appStatus"), nil)))
+	assert.NoError(t, cs.Validate(access(resset.ActionRead, nil, nil)))
+	assert.IsError(t, cs.Validate(access(resset.ActionRead, ptr("viewerOrganizations"), nil)), resset.ErrUnauthorizedForResource)
+	assert.IsError(t, cs.Validate(access(resset.ActionWrite, nil, nil)), resset.ErrUnauthorizedForAction)
+	assert.IsError(t, cs.Validate(access(resset.ActionWrite, nil, ptr("addCertificate"))), resset.ErrUnauthorizedForAction)
+}
+
+func TestMaxSpendCents(t *testing.T) {
+	access := func(action resset.Action, spend *uint64) *Access {
+		return &Access{OrgID: uptr(123), AppID: uptr(234), Action: action, ProjectedSpendCents: spend}
+	}
+
+	cav := &MaxSpendCents{Amount: 10000, Window: "month"}
+	assert.NoError(t, cav.Prohibits(access(resset.ActionCreate, uptr(10000))))
+	assert.NoError(t, cav.Prohibits(access(resset.ActionControl, uptr(0))))
+	assert.IsError(t, cav.Prohibits(access(resset.ActionCreate, uptr(10001))), macaroon.ErrUnauthorized)
+	assert.IsError(t, cav.Prohibits(access(resset.ActionRead|resset.ActionControl, uptr(10001))), macaroon.ErrUnauthorized)
+	assert.IsError(t, cav.Prohibits(access(resset.ActionCreate, nil)), resset.ErrResourceUnspecified)
+	assert.IsError(t, cav.Prohibits(access(resset.ActionControl, nil)), resset.ErrResourceUnspecified)
+
+	// other actions ignore spend
+	assert.NoError(t, cav.Prohibits(access(resset.ActionRead, nil)))
+	assert.NoError(t, cav.Prohibits(access(resset.ActionWrite|resset.ActionDelete, uptr(10001))))
+
+	// capped creates plus read-only access to the org
+	cs := macaroon.NewCaveatSet(
+		&Organization{ID: 123, Mask: resset.ActionAll},
+		&resset.IfPresent{Ifs: macaroon.NewCaveatSet(cav), Else: resset.ActionRead},
+	)
+	assert.NoError(t, cs.Validate(access(resset.ActionCreate, uptr(5000))))
+	assert.NoError(t, cs.Validate(access(resset.ActionRead, nil)))
+	assert.IsError(t, cs.Validate(access(resset.ActionCreate, uptr(20000))), macaroon.ErrUnauthorized)
+	assert.IsError(t, cs.Validate(access(resset.ActionCreate, nil)), resset.ErrUnauthorizedForAction)
+}
+
+func TestReadOnly(t *testing.T) {
+	var (
+		cav     = &ReadOnly{}
+		org     = &Access{OrgID: uptr(123)}
+		app     = &Access{OrgID: uptr(123), AppID: uptr(234)}
+		machine = &Access{OrgID: uptr(123), AppID: uptr(234), Machine: ptr("m1")}
+		storage = &Access{OrgID: uptr(123), StorageObject: ptr(resset.Prefix("https://storage.fly/bucket/obj"))}
+	)
+
+	for name, access := range map[string]*Access{"org": org, "app": app, "machine": machine, "storage": storage} {
+		t.Run(name, func(t *testing.T) {
+			access.Action = resset.ActionRead
+			assert.NoError(t, cav.Prohibits(access))
+
+			access.Action = resset.ActionNone
+			assert.NoError(t, cav.Prohibits(access))
+
+			for _, action := range []resset.Action{resset.ActionWrite, resset.ActionCreate, resset.ActionDelete, resset.ActionControl, resset.ActionAll} {
+				access.Action = action
+				assert.IsError(t, cav.Prohibits(access), resset.ErrUnauthorizedForAction)
+			}
+		})
+	}
+
+	assert.IsError(t, cav.Prohibits(macaroon.Access(nil)), macaroon.ErrInvalidAccess)
+
+	// composes with other caveats, regardless of the resources they allow
+	cs := macaroon.NewCaveatSet(
+		&Organization{ID: 123, Mask: resset.ActionAll},
+		&Apps{Apps: resset.ResourceSet[uint64, resset.Action]{234: resset.ActionAll}},
+		cav,
+	)
+	assert.NoError(t, cs.Validate(&Access{OrgID: uptr(123), AppID: uptr(234), Action: resset.ActionRead}))
+	assert.IsError(t, cs.Validate(&Access{OrgID: uptr(123), AppID: uptr(234), Action: resset.ActionWrite}), resset.ErrUnauthorizedForAction)
+	assert.IsError(t, cs.Validate(&Access{OrgID: uptr(123), AppID: uptr(345), Action: resset.ActionRead}), resset.ErrUnauthorizedForResource)
+}
+
+func TestAppScopedResources(t *testing.T) {
+	var (
+		machines = &Machines{Machines: resset.New(resset.ActionRead, "m1")}
+		volumes  = &Volumes{Volumes: resset.New(resset.ActionRead, "v1")}
+		access   = func(appID *uint64, machine, volume *string) *Access {
+			return &Access{OrgID: uptr(1), AppID: appID, Machine: machine, Volume: volume, Action: resset.ActionRead}
+		}
+	)
+
+	t.Run("machines", func(t *testing.T) {
+		cav := machines.ScopedToApp(123)
+		assert.Equal(t, &AppMachines{AppID: 123, Machines: resset.New(resset.ActionRead, "m1")}, cav)
+
+		assert.NoError(t, cav.Prohibits(access(uptr(123), ptr("m1"), nil)))
+		assert.IsError(t, cav.Prohibits(access(uptr(234), ptr("m1"), nil)), resset.ErrUnauthorizedForResource)
+		assert.IsError(t, cav.Prohibits(access(uptr(123), ptr("m2"), nil)), resset.ErrUnauthorizedForResource)
+		assert.IsError(t, cav.Prohibits(access(nil, ptr("m1"), nil)), resset.ErrResourceUnspecified)
+		assert.IsError(t, cav.Prohibits(access(uptr(123), nil, nil)), resset.ErrResourceUnspecified)
+		assert.IsError(t, cav.Prohibits(macaroon.Access(nil)), macaroon.ErrInvalidAccess)
+
+		// the legacy caveat doesn't care about the app
+		assert.NoError(t, machines.Prohibits(access(uptr(234), ptr("m1"), nil)))
+	})
+
+	t.Run("volumes", func(t *testing.T) {
+		cav := volumes.ScopedToApp(123)
+		assert.Equal(t, &AppVolumes{AppID: 123, Volumes: resset.New(resset.ActionRead, "v1")}, cav)
+
+		assert.NoError(t, cav.Prohibits(access(uptr(123), nil, ptr("v1"))))
+		assert.IsError(t, cav.Prohibits(access(uptr(234), nil, ptr("v1"))), resset.ErrUnauthorizedForResource)
+		assert.IsError(t, cav.Prohibits(access(uptr(123), nil, ptr("v2"))), resset.ErrUnauthorizedForResource)
+		assert.IsError(t, cav.Prohibits(access(nil, nil, ptr("v1"))), resset.ErrResourceUnspecified)
+		assert.IsError(t, cav.Prohibits(macaroon.Access(nil)), macaroon.ErrInvalidAccess)
+
+		// the legacy caveat doesn't care about the app
+		assert.NoError(t, volumes.Prohibits(access(uptr(234), nil, ptr("v1"))))
+	})
+
+	t.Run("conversion copies", func(t *testing.T) {
+		cav := machines.ScopedToApp(123)
+		cav.Machines["m2"] = resset.ActionAll
+		assert.Equal(t, resset.New(resset.ActionRead, "m1"), machines.Machines)
+	})
+
+	t.Run("mixed", func(t *testing.T) {
+		cs := macaroon.NewCaveatSet(
+			&Organization{ID: 1, Mask: resset.ActionAll},
+			&Machines{Machines: resset.New(resset.ActionAll, "m1", "m2")},
+			&AppMachines{AppID: 123, Machines: resset.New(resset.ActionRead, "m1", "m3")},
+		)
+
+		assert.NoError(t, cs.Validate(access(uptr(123), ptr("m1"), nil)))
+		assert.IsError(t, cs.Validate(access(uptr(234), ptr("m1"), nil)), resset.ErrUnauthorizedForResource)
+		assert.IsError(t, cs.Validate(access(uptr(123), ptr("m2"), nil)), resset.ErrUnauthorizedForResource)
+		assert.IsError(t, cs.Validate(access(uptr(123), ptr("m3"), nil)), resset.ErrUnauthorizedForResource)
+
+		write := access(uptr(123), ptr("m1"), nil)
+		write.Action = resset.ActionWrite
+		assert.IsError(t, cs.Validate(write), resset.ErrUnauthorizedForAction)
+	})
+}
+
+func TestMachineIdentity(t *testing.T) {
+	var (
+		kid     = []byte("kid")
+		key     = macaroon.NewSigningKey()
+		tpKey   = macaroon.NewEncryptionKey()
+		authLoc = "https://auth.fly.io"
+		mi      = &MachineIdentity{MachineID: "m1", AppID: 123, OrgID: 234}
+	)
+
+	// first party confines the ticket to a machine
+	m, err := macaroon.New(kid, LocationPermission, key)
+	assert.NoError(t, err)
+	assert.NoError(t, m.Add(&Organization{ID: 234, Mask: resset.ActionAll}))
+	assert.NoError(t, m.Add3P(tpKey, authLoc, auth.RequireMachine("m1")))
+
+	ticket, err := m.ThirdPartyTicket(authLoc)
+	assert.NoError(t, err)
+
+	// third party checks the authenticated machine and attests it
+	discharge := func(dr *auth.DischargeRequest) ([]byte, error) {
+		cavs, dm, err := macaroon.DischargeTicket(tpKey, authLoc, ticket)
+		assert.NoError(t, err)
+
+		if err := macaroon.NewCaveatSet(cavs...).Validate(dr); err != nil {
+			return nil, err
+		}
+
+		assert.NoError(t, dm.Add(mi))
+		return dm.Encode()
+	}
+
+	_, err = discharge(&auth.DischargeRequest{})
+	assert.EqualError(t, err, "must authenticate from Fly.io machine m1")
+
+	_, err = discharge(&auth.DischargeRequest{Machine: []*auth.MachineAuth{{MachineID: "m2", AppID: 123, OrgID: 234}}})
+	assert.Error(t, err)
+
+	dBuf, err := discharge(&auth.DischargeRequest{Machine: []*auth.MachineAuth{{MachineID: "m1", AppID: 123, OrgID: 234}}})
+	assert.NoError(t, err)
+
+	// relying party reads the attestation from a trusted third party
+	cs, err := m.Verify(key, [][]byte{dBuf}, map[string][]macaroon.EncryptionKey{authLoc: {tpKey}})
+	assert.NoError(t, err)
+
+	got, ok := MachineFromVerifiedCaveats(cs)
+	assert.True(t, ok)
+	assert.Equal(t, mi, got)
+
+	// but not from an untrusted one
+	cs, err = m.Verify(key, [][]byte{dBuf}, nil)
+	assert.NoError(t, err)
+
+	_, ok = MachineFromVerifiedCaveats(cs)
+	assert.False(t, ok)
+}
+
+func TestScopedToLocation(t *testing.T) {
+	const (
+		apiLoc   = "https://api.fly.io"
+		flapsLoc = "https://api.machines.dev"
+	)
+
+	var (
+		mutation = &Access{OrgID: uptr(1), Action: resset.ActionWrite, Mutation: ptr("addCertificate")}
+		command  = &Access{OrgID: uptr(1), AppID: uptr(1), Machine: ptr("m1"), Action: resset.ActionWrite, Command: []string{"ls", "-l"}}
+		rm       = &Access{OrgID: uptr(1), AppID: uptr(1), Machine: ptr("m1"), Action: resset.ActionWrite, Command: []string{"rm", "-rf"}}
+		read     = &Access{OrgID: uptr(1), AppID: uptr(1), Action: resset.ActionRead}
+	)
+
+	at := func(a *Access, loc string) *Access {
+		cp := *a
+		cp.VerifierLocation = loc
+		return &cp
+	}
+
+	cs := macaroon.NewCaveatSet(
+		&macaroon.ScopedToLocation{Locations: []string{apiLoc}, Caveats: macaroon.NewCaveatSet(&Mutations{Mutations: []string{"addCertificate"}})},
+		&macaroon.ScopedToLocation{Locations: []string{flapsLoc}, Caveats: macaroon.NewCaveatSet(&Commands{{Args: []string{"ls"}}})},
+	)
+
+	assert.NoError(t, cs.Validate(at(mutation, apiLoc)))
+	assert.NoError(t, cs.Validate(at(command, flapsLoc)))
+
+	otherMutation := at(mutation, apiLoc)
+	otherMutation.Mutation = ptr("deleteApp")
+	assert.IsError(t, cs.Validate(otherMutation), resset.ErrUnauthorizedForResource)
+
+	assert.IsError(t, cs.Validate(at(rm, flapsLoc)), resset.ErrUnauthorizedForResource)
+
+	// the caveats for each location don't apply at the other, where their
+	// resources would be unspecified
+	assert.IsError(t, cs.Validate(at(command, apiLoc)), resset.ErrResourceUnspecified)
+	assert.IsError(t, cs.Validate(at(mutation, flapsLoc)), resset.ErrResourceUnspecified)
+	assert.NoError(t, cs.Validate(at(read, "https://example.com")))
+
+	// both apply if the location isn't known
+	assert.IsError(t, cs.Validate(mutation), resset.ErrResourceUnspecified)
+	assert.IsError(t, cs.Validate(command), resset.ErrResourceUnspecified)
+
+	t.Run("wrapping IfPresent", func(t *testing.T) {
+		cs := macaroon.NewCaveatSet(&macaroon.ScopedToLocation{
+			Locations: []string{flapsLoc},
+			Caveats: macaroon.NewCaveatSet(&resset.IfPresent{
+				Ifs:  macaroon.NewCaveatSet(&Commands{{Args: []string{"ls"}}}),
+				Else: resset.ActionRead,
+			}),
+		})
+
+		assert.NoError(t, cs.Validate(at(read, flapsLoc)))
+		assert.NoError(t, cs.Validate(at(command, flapsLoc)))
+		assert.IsError(t, cs.Validate(at(rm, flapsLoc)), resset.ErrUnauthorizedForResource)
+		assert.NoError(t, cs.Validate(at(rm, apiLoc)))
+		assert.NoError(t, cs.Validate(at(mutation, apiLoc)))
+		assert.IsError(t, cs.Validate(at(mutation, flapsLoc)), resset.ErrUnauthorizedForAction)
+	})
+
+	t.Run("inside IfPresent", func(t *testing.T) {
+		cs := macaroon.NewCaveatSet(&resset.IfPresent{
+			Ifs: macaroon.NewCaveatSet(&macaroon.ScopedToLocation{
+				Locations: []string{flapsLoc},
+				Caveats:   macaroon.NewCaveatSet(&Commands{{Args: []string{"ls"}}}),
+			}),
+			Else: resset.ActionRead,
+		})
+
+		// the wrapped caveat's resource is unspecified, so Else applies
+		assert.NoError(t, cs.Validate(at(read, flapsLoc)))
+		assert.IsError(t, cs.Validate(at(mutation, flapsLoc)), resset.ErrUnauthorizedForAction)
+		assert.NoError(t, cs.Validate(at(command, flapsLoc)))
+		assert.IsError(t, cs.Validate(at(rm, flapsLoc)), resset.ErrUnauthorizedForResource)
+
+		// elsewhere, ScopedToLocation allows the access, so Else doesn't apply
+		assert.NoError(t, cs.Validate(at(mutation, apiLoc)))
+	})
+
+	t.Run("denial", func(t *testing.T) {
+		err := cs.Validate(at(rm, flapsLoc))
+		assert.Equal(t, "Your token doesn't allow this request. "+denialAdvice, ExplainDenial(err, nil))
+
+		err = macaroon.NewCaveatSet(&macaroon.ScopedToLocation{
+			Locations: []string{apiLoc},
+			Caveats:   macaroon.NewCaveatSet(&Apps{Apps: resset.New(resset.ActionRead, uint64(1))}),
+		}).Validate(at(&Access{OrgID: uptr(1), AppID: uptr(2), Action: resset.ActionRead}, apiLoc))
+		assert.Equal(t, "Your token doesn't allow access to app 2. "+denialAdvice, ExplainDenial(err, nil))
+	})
+}
+
+func TestDescribe(t *testing.T) {
+	// Changes to these descriptions are user-visible. Update them
+	// deliberately.
+	cases := []struct {
+		cav  macaroon.Caveat
+		desc string
+	}{
+		{&FromMachine{ID: "abc123"}, "Restricts requests to those from machine abc123"},
+		{&MachineIdentity{MachineID: "abc123", AppID: 123, OrgID: 234}, "Attests Fly.io machine abc123 (app 123, organization 234)"},
+		{&SourceNetworks{Networks: []string{"10.0.0.0/8", "2001:db8::/32"}}, "Restricts requests to those from 10.0.0.0/8, 2001:db8::/32"},
+		{&SourceNetworks{}, "Prohibits requests from all networks"},
+		{&Organization{ID: 123, Mask: resset.ActionRead}, "Restricts access to organization 123 (read)"},
+		{&Organization{Mask: resset.ActionAll}, "Restricts access to any organization (all)"},
+		{&OrgSlug{Slug: "my-org", Mask: resset.ActionRead | resset.ActionWrite}, "Restricts access to organization my-org (read-write)"},
+		{&Apps{Apps: resset.ResourceSet[uint64, resset.Action]{123: resset.ActionRead, 456: resset.ActionRead | resset.ActionWrite}}, "Restricts access to apps 123 (read), 456 (read-write)"},
+		{&AppNames{Apps: resset.New(resset.ActionControl, "my-app")}, "Restricts access to apps my-app (control)"},
+		{&Volumes{Volumes: resset.New(resset.ActionDelete, "vol_123")}, "Restricts access to volumes vol_123 (delete)"},
+		{&Machines{Machines: resset.New(resset.ActionRead|resset.ActionControl, "m1", "m2")}, "Restricts access to machines m1 (read-control), m2 (read-control)"},
+		{&MachineFeatureSet{Features: resset.New(resset.ActionRead, "exec")}, "Restricts access to machine features exec (read)"},
+		{&FeatureSet{Features: resset.New(resset.ActionCreate, "wg")}, "Restricts access to org features wg (create)"},
+		{&AppFeatureSet{Features: resset.New(resset.ActionRead, "")}, "Restricts access to app features * (read)"},
+		{&Clusters{Clusters: resset.ResourceSet[string, resset.Action]{}}, "Restricts access to no clusters"},
+		{&StorageObjects{Prefixes: resset.New(resset.ActionRead, resset.Prefix("https://storage.fly/bucket/"))}, "Restricts access to storage objects https://storage.fly/bucket/ (read)"},
+		{&OIDCAudiences{Audiences: resset.New(resset.ActionRead, resset.Prefix("https://example.com/"))}, "Restricts OIDC tokens to audiences https://example.com/ (read)"},
+		{&Mutations{Mutations: []string{"addCertificate", "deleteCertificate"}}, "Restricts GraphQL mutations to addCertificate, deleteCertificate"},
+		{&Mutations{}, "Prohibits all GraphQL mutations"},
+		{&Queries{Queries: []string{"viewerOrganizations", "appStatus"}}, "Restricts GraphQL queries to viewerOrganizations, appStatus"},
+		{&Queries{}, "Prohibits all GraphQL queries"},
+		{&MaxSpendCents{Amount: 10050, Window: "month"}, "Restricts creating or controlling resources to a projected spend of $100.50 per month"},
+		{&ReadOnly{}, "Restricts access to reads"},
+		{&AppVolumes{AppID: 123, Volumes: resset.New(resset.ActionRead, "vol_123")}, "Restricts access to volumes vol_123 (read) in app 123"},
+		{&AppMachines{AppID: 123, Machines: resset.New(resset.ActionControl, "m1")}, "Restricts access to machines m1 (control) in app 123"},
+		{&IsUser{ID: 123}, "Issued to user 123"},
+		{ptr(AllowedRoles(RoleMember | RoleBillingManager)), "Restricts roles to billing_manager+member"},
+		{&IsMember{}, "Restricts roles to member"},
+		{&Commands{{Args: []string{"ls", "-l"}}, {Args: []string{"cat", "/etc/hosts"}, Exact: true}, {}}, `Restricts commands to "ls -l" (prefix), "cat /etc/hosts" (exact), any command`},
+		{&Commands{}, "Prohibits all commands"},
+		{&macaroon.ScopedToLocation{Locations: []string{"https://api.fly.io", "https://api.machines.dev"}}, "Applies the following when verified at https://api.fly.io, https://api.machines.dev"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.cav.Name(), func(t *testing.T) {
+			assert.Equal(t, tc.desc, macaroon.DescribeCaveatSet(macaroon.NewCaveatSet(tc.cav))[0])
+		})
+	}
+}
+
+func TestFeatureMaxActions(t *testing.T) {
+	_, err := NewFeatureSet(resset.ActionRead|resset.ActionDelete, FeatureWireGuard, FeatureBilling)
+	assert.IsError(t, err, resset.ErrExceedsMaxAction)
+	assert.IsError(t, err, macaroon.ErrBadCaveat)
+	assert.Contains(t, err.Error(), FeatureBilling)
+
+	// wildcards aren't bounded
+	fs, err := NewFeatureSet(resset.ActionAll, resset.ZeroID[string]())
+	assert.NoError(t, err)
+	assert.NoError(t, fs.Validate())
+
+	_, err = NewMachineFeatureSet(resset.ActionRead|resset.ActionWrite, MachineFeatureOIDC)
+	assert.IsError(t, err, resset.ErrExceedsMaxAction)
+
+	fs, err = NewFeatureSet(resset.ActionAll, FeatureWireGuard, FeatureMembership)
+	assert.NoError(t, err)
+	assert.Equal(t, resset.New(resset.ActionAll, FeatureWireGuard, FeatureMembership), fs.Features)
+
+	mfs, err := NewMachineFeatureSet(resset.ActionRead, MachineFeatureOIDC)
+	assert.NoError(t, err)
+	assert.NoError(t, mfs.Validate())
+
+	// tokens issued before the maximums existed still decode and are
+	// evaluated as before.
+	cs := macaroon.NewCaveatSet(
+		&FeatureSet{Features: resset.New(resset.ActionAll, FeatureBilling)},
+		&MachineFeatureSet{Features: resset.New(resset.ActionAll, MachineFeatureOIDC)},
+	)
+
+	b, err := cs.MarshalMsgpack()
+	assert.NoError(t, err)
+	cs, err = macaroon.DecodeCaveats(b)
+	assert.NoError(t, err)
+
+	decodedFS := macaroon.GetCaveats[*FeatureSet](cs)[0]
+	assert.NoError(t, decodedFS.Prohibits(&Access{
+		Action:  resset.ActionDelete,
+		OrgID:   ptr(uint64(123)),
+		Feature: ptr(FeatureBilling),
+	}))
+	assert.IsError(t, decodedFS.Validate(), resset.ErrExceedsMaxAction)
+
+	decodedMFS := macaroon.GetCaveats[*MachineFeatureSet](cs)[0]
+	assert.NoError(t, decodedMFS.Prohibits(&Access{
+		Action:         resset.ActionWrite,
+		OrgID:          ptr(uint64(123)),
+		MachineFeature: ptr(MachineFeatureOIDC),
+	}))
+	assert.IsError(t, decodedMFS.Validate(), resset.ErrExceedsMaxAction)
+
+	// Bundle.Attenuate rejects caveats exceeding the maximums, but not
+	// wildcards
+	m, err := macaroon.New([]byte("kid"), LocationPermission, macaroon.NewSigningKey())
+	assert.NoError(t, err)
+	tok, err := m.Encode()
+	assert.NoError(t, err)
+
+	bun, err := ParseBundle(macaroon.ToAuthorizationHeader(tok))
+	assert.NoError(t, err)
+
+	assert.IsError(t, bun.Attenuate(&FeatureSet{Features: resset.New(resset.ActionAll, FeatureBilling)}), resset.ErrExceedsMaxAction)
+	assert.NoError(t, bun.Attenuate(&FeatureSet{Features: resset.New(resset.ActionAll, resset.ZeroID[string]())}))
+}
+
+func TestFeatureDependency(t *testing.T) {
+	var (
+		dep = &FeatureDependency{AppFeature: "registry", RequiresOrgFeature: FeatureRemoteBuilders, Mask: resset.ActionRead}
+		org = &Organization{ID: 123, Mask: resset.ActionAll}
+
+		features = func(m resset.Action, features ...string) macaroon.Caveat {
+			return &resset.IfPresent{
+				Ifs:  macaroon.NewCaveatSet(&FeatureSet{Features: resset.New(m, features...)}),
+				Else: resset.ActionAll,
+			}
+		}
+
+		access = func(appFeature string) *Access {
+			return &Access{
+				Action:     resset.ActionWrite,
+				OrgID:      ptr(uint64(123)),
+				AppID:      ptr(uint64(234)),
+				AppFeature: ptr(appFeature),
+			}
+		}
+	)
+
+	t.Run("satisfied", func(t *testing.T) {
+		cs := macaroon.NewCaveatSet(org, dep, features(resset.ActionRead, FeatureRemoteBuilders))
+
+		a := access("registry")
+		assert.NoError(t, cs.Validate(a))
+		assert.Zero(t, a.GetValidation())
+
+		_, err := cs.ValidateWithAudit(a)
+		assert.NoError(t, err)
+	})
+
+	t.Run("missing org feature", func(t *testing.T) {
+		cs := macaroon.NewCaveatSet(org, dep, features(resset.ActionRead, FeatureWireGuard))
+
+		err := cs.Validate(access("registry"))
+		assert.IsError(t, err, resset.ErrUnauthorizedForResource)
+		assert.Contains(t, err.Error(), "app feature registry requires org feature builder")
+
+		// the org feature is granted, but not with enough access
+		cs = macaroon.NewCaveatSet(org, dep, features(resset.ActionWrite, FeatureRemoteBuilders))
+		assert.IsError(t, cs.Validate(access("registry")), resset.ErrUnauthorizedForAction)
+
+		// Apps restricts the derived access too
+		cs = macaroon.NewCaveatSet(org, dep, features(resset.ActionRead, FeatureRemoteBuilders), &Apps{Apps: resset.New(resset.ActionAll, uint64(234))})
+		assert.IsError(t, cs.Validate(access("registry")), resset.ErrResourceUnspecified)
+	})
+
+	t.Run("other resources", func(t *testing.T) {
+		cs := macaroon.NewCaveatSet(org, dep)
+
+		assert.NoError(t, cs.Validate(access("other")))
+		assert.NoError(t, cs.Validate(&Access{Action: resset.ActionRead, OrgID: ptr(uint64(123)), AppID: ptr(uint64(234))}))
+		assert.NoError(t, cs.Validate(&Access{Action: resset.ActionRead, OrgID: ptr(uint64(123)), Feature: ptr(FeatureRemoteBuilders)}))
+	})
+
+	t.Run("caveat set not carried", func(t *testing.T) {
+		assert.IsError(t, dep.Prohibits(access("registry")), macaroon.ErrInvalidAccess)
+		assert.NoError(t, dep.Prohibits(access("other")))
+	})
+
+	t.Run("recursion guard", func(t *testing.T) {
+		// derived accesses don't specify app features, so this can't happen
+		// with FeatureDependency alone.
+		cs := macaroon.NewCaveatSet(org, dep)
+
+		a := access("registry")
+		a.depth = maxFeatureDependencyDepth
+		assert.IsError(t, cs.Validate(a), macaroon.ErrBadCaveat)
+
+		a.depth = maxFeatureDependencyDepth - 1
+		assert.NoError(t, cs.Validate(a))
+	})
+
+	t.Run("validation mode", func(t *testing.T) {
+		// the derived access is denied by both the FeatureSet and Apps
+		cs := macaroon.NewCaveatSet(org, dep, features(resset.ActionRead, FeatureWireGuard), &Apps{Apps: resset.New(resset.ActionAll, uint64(234))})
+
+		err := cs.Validate(access("registry"))
+		assert.IsError(t, err, resset.ErrUnauthorizedForResource)
+		assert.IsError(t, err, resset.ErrResourceUnspecified)
+
+		err = cs.ValidateFailFast(access("registry"))
+		assert.IsError(t, err, resset.ErrUnauthorizedForResource)
+		assert.NotIsError(t, err, resset.ErrResourceUnspecified)
+	})
+
+	assert.Equal(t, "Requires org feature builder (read) for app feature registry", macaroon.DescribeCaveat(dep))
+}
+
+func TestRequire3PForActions(t *testing.T) {
+	var (
+		kid         = []byte("kid")
+		key         = macaroon.NewSigningKey()
+		approvalKey = macaroon.NewEncryptionKey()
+		approvalLoc = "https://approvals.example"
+		trusted     = map[string][]macaroon.EncryptionKey{approvalLoc: {approvalKey}}
+		breakGlass  = &Require3PForActions{Location: approvalLoc, Actions: resset.ActionDelete}
+		approval    = &ApprovalAttestation{Location: approvalLoc, Nonce: []byte("approval-1")}
+
+		access = func(action resset.Action) *Access {
+			return &Access{Action: action, OrgID: ptr(uint64(123)), AppID: ptr(uint64(234))}
+		}
+	)
+
+	m, err := macaroon.New(kid, LocationPermission, key)
+	assert.NoError(t, err)
+	assert.NoError(t, m.Add(&Organization{ID: 123, Mask: resset.ActionAll}, breakGlass))
+
+	// routine accesses don't need approval
+	cs, err := m.Verify(key, nil, trusted)
+	assert.NoError(t, err)
+	assert.NoError(t, cs.Validate(access(resset.ActionRead)))
+	assert.NoError(t, cs.Validate(access(resset.ActionWrite)))
+
+	// destructive ones do
+	err = cs.Validate(access(resset.ActionDelete))
+	assert.IsError(t, err, macaroon.ErrMissingAttestation)
+	assert.Contains(t, err.Error(), "delete requires approval from https://approvals.example")
+	assert.IsError(t, cs.Validate(access(resset.ActionRead|resset.ActionDelete)), macaroon.ErrMissingAttestation)
+
+	// the holder asks the approval third party to discharge a copy of the
+	// token, and it attests its approval.
+	approved, err := m.Clone()
+	assert.NoError(t, err)
+	assert.NoError(t, approved.Add3P(approvalKey, approvalLoc))
+
+	ticket, err := approved.ThirdPartyTicket(approvalLoc)
+	assert.NoError(t, err)
+
+	discharge := func(t *testing.T, cavs ...macaroon.Caveat) []byte {
+		t.Helper()
+
+		_, dm, err := macaroon.DischargeTicket(approvalKey, approvalLoc, ticket)
+		assert.NoError(t, err)
+		assert.NoError(t, dm.Add(cavs...))
+
+		dBuf, err := dm.Encode()
+		assert.NoError(t, err)
+
+		return dBuf
+	}
+
+	t.Run("approved", func(t *testing.T) {
+		cs, err := approved.Verify(key, [][]byte{discharge(t, approval)}, trusted)
+		assert.NoError(t, err)
+		assert.NoError(t, cs.Validate(access(resset.ActionDelete)))
+		assert.NoError(t, cs.Validate(access(resset.ActionRead)))
+	})
+
+	t.Run("untrusted third party", func(t *testing.T) {
+		cs, err := approved.Verify(key, [][]byte{discharge(t, approval)}, nil)
+		assert.NoError(t, err)
+		assert.IsError(t, cs.Validate(access(resset.ActionDelete)), macaroon.ErrMissingAttestation)
+	})
+
+	t.Run("no attestation", func(t *testing.T) {
+		cs, err := approved.Verify(key, [][]byte{discharge(t)}, trusted)
+		assert.NoError(t, err)
+		assert.IsError(t, cs.Validate(access(resset.ActionDelete)), macaroon.ErrMissingAttestation)
+	})
+
+	t.Run("other location", func(t *testing.T) {
+		cs, err := approved.Verify(key, [][]byte{discharge(t, &ApprovalAttestation{Location: "https://other.example"})}, trusted)
+		assert.NoError(t, err)
+		assert.IsError(t, cs.Validate(access(resset.ActionDelete)), macaroon.ErrMissingAttestation)
+	})
+
+	t.Run("other trusted third party", func(t *testing.T) {
+		var (
+			otherKey = macaroon.NewEncryptionKey()
+			otherLoc = "https://other.example"
+			trusted  = map[string][]macaroon.EncryptionKey{approvalLoc: {approvalKey}, otherLoc: {otherKey}}
+		)
+
+		approved, err := m.Clone()
+		assert.NoError(t, err)
+		assert.NoError(t, approved.Add3P(otherKey, otherLoc))
+
+		ticket, err := approved.ThirdPartyTicket(otherLoc)
+		assert.NoError(t, err)
+		_, dm, err := macaroon.DischargeTicket(otherKey, otherLoc, ticket)
+		assert.NoError(t, err)
+		assert.NoError(t, dm.Add(approval))
+		dBuf, err := dm.Encode()
+		assert.NoError(t, err)
+
+		// the attestation is trusted, but wasn't issued by approvalLoc
+		cs, err := approved.Verify(key, [][]byte{dBuf}, trusted)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, len(macaroon.GetCaveats[*ApprovalAttestation](cs)))
+		assert.IsError(t, cs.Validate(access(resset.ActionDelete)), macaroon.ErrMissingAttestation)
+	})
+
+	t.Run("unverified caveat set", func(t *testing.T) {
+		cs := macaroon.NewCaveatSet(&Organization{ID: 123, Mask: resset.ActionAll}, breakGlass, approval)
+		assert.IsError(t, cs.Validate(access(resset.ActionDelete)), macaroon.ErrMissingAttestation)
+	})
+
+	t.Run("caveat set not carried", func(t *testing.T) {
+		assert.IsError(t, breakGlass.Prohibits(access(resset.ActionDelete)), macaroon.ErrInvalidAccess)
+		assert.NoError(t, breakGlass.Prohibits(access(resset.ActionRead)))
+	})
+
+	assert.Equal(t, "Requires approval from https://approvals.example for delete", macaroon.DescribeCaveat(breakGlass))
+	assert.Equal(t, "Attests approval from https://approvals.example", macaroon.DescribeCaveat(approval))
+}
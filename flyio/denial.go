@@ -0,0 +1,216 @@
+package flyio
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/superfly/macaroon"
+	"github.com/superfly/macaroon/resset"
+)
+
+const (
+	denialGeneric = "Your token doesn't allow this request."
+	denialAdvice  = "Ask an organization admin to mint a token with broader access, or create one with 'fly tokens create'."
+)
+
+// ExplainDenial returns a message suitable for showing to users when err, as
+// returned by validating a token's caveats, denied a request. Messages from
+// the caveats that prohibited the request are combined and followed by advice
+// on getting a broader token. A generic message is used if none of the
+// caveats can explain themselves. An empty string is returned if err is nil.
+//
+// The resolver is used to show organizations and apps by name. It is called
+// with a kind of "org" or "app" and the decimal ID. It may be nil.
+func ExplainDenial(err error, resolve macaroon.NameResolver) string {
+	if err == nil {
+		return ""
+	}
+
+	msgs := macaroon.ExplainDenial(err, resolve)
+	if len(msgs) == 0 {
+		msgs = []string{denialGeneric}
+	}
+
+	return strings.Join(append(msgs, denialAdvice), " ")
+}
+
+// ExplainDenial implements macaroon.DenialExplainer.
+func (c *Organization) ExplainDenial(err *macaroon.CaveatError, resolve macaroon.NameResolver) string {
+	f, ok := err.Access.(OrgIDGetter)
+	if !ok {
+		return ""
+	}
+
+	return explainResourceDenial(err, "organization", f.GetAction(), func() string {
+		return resolvedName(resolve, "org", "organization", *f.GetOrgID())
+	})
+}
+
+// ExplainDenial implements macaroon.DenialExplainer.
+func (c *OrgSlug) ExplainDenial(err *macaroon.CaveatError, resolve macaroon.NameResolver) string {
+	f, ok := err.Access.(OrgSlugGetter)
+	if !ok {
+		return ""
+	}
+
+	return explainResourceDenial(err, "organization", f.GetAction(), func() string {
+		return fmt.Sprintf("organization '%s'", *f.GetOrgSlug())
+	})
+}
+
+// ExplainDenial implements macaroon.DenialExplainer.
+func (c *Apps) ExplainDenial(err *macaroon.CaveatError, resolve macaroon.NameResolver) string {
+	f, ok := err.Access.(AppIDGetter)
+	if !ok {
+		return ""
+	}
+
+	return explainResourceDenial(err, "app", f.GetAction(), func() string {
+		return resolvedName(resolve, "app", "app", *f.GetAppID())
+	})
+}
+
+// ExplainDenial implements macaroon.DenialExplainer.
+func (c *AppNames) ExplainDenial(err *macaroon.CaveatError, resolve macaroon.NameResolver) string {
+	f, ok := err.Access.(AppNameGetter)
+	if !ok {
+		return ""
+	}
+
+	return explainResourceDenial(err, "app", f.GetAction(), func() string {
+		return fmt.Sprintf("app '%s'", *f.GetAppName())
+	})
+}
+
+// ExplainDenial implements macaroon.DenialExplainer.
+func (c *Volumes) ExplainDenial(err *macaroon.CaveatError, resolve macaroon.NameResolver) string {
+	f, ok := err.Access.(VolumeGetter)
+	if !ok {
+		return ""
+	}
+
+	return explainResourceDenial(err, "volume", f.GetAction(), func() string {
+		return "volume " + *f.GetVolume()
+	})
+}
+
+// ExplainDenial implements macaroon.DenialExplainer.
+func (c *Machines) ExplainDenial(err *macaroon.CaveatError, resolve macaroon.NameResolver) string {
+	f, ok := err.Access.(MachineGetter)
+	if !ok {
+		return ""
+	}
+
+	return explainResourceDenial(err, "machine", f.GetAction(), func() string {
+		return "machine " + *f.GetMachine()
+	})
+}
+
+// ExplainDenial implements macaroon.DenialExplainer.
+func (c *AppVolumes) ExplainDenial(err *macaroon.CaveatError, resolve macaroon.NameResolver) string {
+	f, ok := err.Access.(interface {
+		AppIDGetter
+		VolumeGetter
+	})
+	if !ok {
+		return ""
+	}
+
+	return explainResourceDenial(err, "volume", f.GetAction(), func() string {
+		return appScopedName(resolve, "volume", f.GetVolume(), *f.GetAppID())
+	})
+}
+
+// ExplainDenial implements macaroon.DenialExplainer.
+func (c *AppMachines) ExplainDenial(err *macaroon.CaveatError, resolve macaroon.NameResolver) string {
+	f, ok := err.Access.(interface {
+		AppIDGetter
+		MachineGetter
+	})
+	if !ok {
+		return ""
+	}
+
+	return explainResourceDenial(err, "machine", f.GetAction(), func() string {
+		return appScopedName(resolve, "machine", f.GetMachine(), *f.GetAppID())
+	})
+}
+
+// appScopedName returns e.g. "machine abc in app 'my-app'", or just the app if
+// the access doesn't specify the resource.
+func appScopedName(resolve macaroon.NameResolver, noun string, id *string, appID uint64) string {
+	app := resolvedName(resolve, "app", "app", appID)
+	if id == nil {
+		return app
+	}
+
+	return fmt.Sprintf("%s %s in %s", noun, *id, app)
+}
+
+// ExplainDenial implements macaroon.DenialExplainer.
+func (c *FeatureSet) ExplainDenial(err *macaroon.CaveatError, resolve macaroon.NameResolver) string {
+	f, ok := err.Access.(FeatureGetter)
+	if !ok {
+		return ""
+	}
+
+	return explainResourceDenial(err, "organization feature", f.GetAction(), func() string {
+		return fmt.Sprintf("the '%s' organization feature", *f.GetFeature())
+	})
+}
+
+// ExplainDenial implements macaroon.DenialExplainer.
+func (c *ReadOnly) ExplainDenial(err *macaroon.CaveatError, resolve macaroon.NameResolver) string {
+	f, ok := err.Access.(resset.Access)
+	if !ok || !errors.Is(err, resset.ErrUnauthorizedForAction) {
+		return ""
+	}
+
+	return fmt.Sprintf("Your token is read-only and doesn't allow %s access.", joinVerbs(resset.Remove(f.GetAction(), resset.ActionRead).Verbs()))
+}
+
+// explainResourceDenial explains the errors returned by caveats restricting
+// access to resources. The resource is only called if the access specified
+// one.
+func explainResourceDenial(err error, kind string, action resset.Action, resource func() string) string {
+	switch {
+	case errors.Is(err, resset.ErrResourceUnspecified):
+		return fmt.Sprintf("Your token is limited to specific %ss and can't be used for this request.", kind)
+	case errors.Is(err, resset.ErrUnauthorizedForResource):
+		return fmt.Sprintf("Your token doesn't allow access to %s.", resource())
+	case errors.Is(err, resset.ErrUnauthorizedForAction):
+		return fmt.Sprintf("Your token doesn't allow %s access to %s.", joinVerbs(action.Verbs()), resource())
+	default:
+		return ""
+	}
+}
+
+// resolvedName returns e.g. "app 'my-app'" if the resolver knows the name of
+// the resource or "app 123" otherwise.
+func resolvedName(resolve macaroon.NameResolver, kind, noun string, id uint64) string {
+	sid := strconv.FormatUint(id, 10)
+
+	if resolve != nil {
+		if name := resolve(kind, sid); name != "" {
+			return fmt.Sprintf("%s '%s'", noun, name)
+		}
+	}
+
+	return noun + " " + sid
+}
+
+// joinVerbs joins verbs as in "read, write, and delete".
+func joinVerbs(verbs []string) string {
+	switch len(verbs) {
+	case 0:
+		return "any"
+	case 1:
+		return verbs[0]
+	case 2:
+		return verbs[0] + " and " + verbs[1]
+	default:
+		return strings.Join(verbs[:len(verbs)-1], ", ") + ", and " + verbs[len(verbs)-1]
+	}
+}
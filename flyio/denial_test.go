@@ -0,0 +1,169 @@
+package flyio
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alecthomas/assert/v2"
+	"github.com/superfly/macaroon"
+	"github.com/superfly/macaroon/resset"
+)
+
+func TestExplainDenial(t *testing.T) {
+	resolve := func(kind, id string) string {
+		switch kind + " " + id {
+		case "org 1":
+			return "my-org"
+		case "app 123":
+			return "my-app"
+		default:
+			return ""
+		}
+	}
+
+	const advice = " Ask an organization admin to mint a token with broader access, or create one with 'fly tokens create'."
+
+	tests := []struct {
+		name   string
+		cavs   []macaroon.Caveat
+		access *Access
+		expect string
+	}{
+		{
+			name:   "wrong org",
+			cavs:   []macaroon.Caveat{&Organization{ID: 1, Mask: resset.ActionAll}},
+			access: &Access{OrgID: ptr(uint64(2)), Action: resset.ActionRead},
+			expect: "Your token doesn't allow access to organization 2.",
+		},
+		{
+			name:   "org action",
+			cavs:   []macaroon.Caveat{&Organization{ID: 1, Mask: resset.ActionRead}},
+			access: &Access{OrgID: ptr(uint64(1)), Action: resset.ActionWrite | resset.ActionDelete},
+			expect: "Your token doesn't allow write and delete access to organization 'my-org'.",
+		},
+		{
+			name:   "org slug",
+			cavs:   []macaroon.Caveat{&OrgSlug{Slug: "my-org", Mask: resset.ActionAll}},
+			access: &Access{OrgID: ptr(uint64(1)), OrgSlug: ptr("other-org"), Action: resset.ActionRead},
+			expect: "Your token doesn't allow access to organization 'other-org'.",
+		},
+		{
+			name: "app action",
+			cavs: []macaroon.Caveat{
+				&Organization{ID: 1, Mask: resset.ActionAll},
+				&Apps{Apps: resset.ResourceSet[uint64, resset.Action]{123: resset.ActionRead}},
+			},
+			access: &Access{OrgID: ptr(uint64(1)), AppID: ptr(uint64(123)), Action: resset.ActionWrite},
+			expect: "Your token doesn't allow write access to app 'my-app'.",
+		},
+		{
+			name:   "unknown app",
+			cavs:   []macaroon.Caveat{&Apps{Apps: resset.ResourceSet[uint64, resset.Action]{123: resset.ActionAll}}},
+			access: &Access{OrgID: ptr(uint64(1)), AppID: ptr(uint64(456)), Action: resset.ActionRead},
+			expect: "Your token doesn't allow access to app 456.",
+		},
+		{
+			name:   "app names",
+			cavs:   []macaroon.Caveat{&AppNames{Apps: resset.New(resset.ActionRead, "my-app")}},
+			access: &Access{OrgID: ptr(uint64(1)), AppName: ptr("my-app"), Action: resset.ActionRead | resset.ActionWrite | resset.ActionCreate},
+			expect: "Your token doesn't allow read, write, and create access to app 'my-app'.",
+		},
+		{
+			name:   "org-level request with app token",
+			cavs:   []macaroon.Caveat{&Apps{Apps: resset.ResourceSet[uint64, resset.Action]{123: resset.ActionAll}}},
+			access: &Access{OrgID: ptr(uint64(1)), Action: resset.ActionRead},
+			expect: "Your token is limited to specific apps and can't be used for this request.",
+		},
+		{
+			name: "machine",
+			cavs: []macaroon.Caveat{&Machines{Machines: resset.New(resset.ActionAll, "abc")}},
+			access: &Access{
+				OrgID:   ptr(uint64(1)),
+				AppID:   ptr(uint64(123)),
+				Machine: ptr("def"),
+				Action:  resset.ActionControl,
+			},
+			expect: "Your token doesn't allow access to machine def.",
+		},
+		{
+			name:   "volume",
+			cavs:   []macaroon.Caveat{&Volumes{Volumes: resset.New(resset.ActionRead, "vol_123")}},
+			access: &Access{OrgID: ptr(uint64(1)), AppID: ptr(uint64(123)), Volume: ptr("vol_123"), Action: resset.ActionDelete},
+			expect: "Your token doesn't allow delete access to volume vol_123.",
+		},
+		{
+			name:   "app machine",
+			cavs:   []macaroon.Caveat{&AppMachines{AppID: 123, Machines: resset.New(resset.ActionRead, "abc")}},
+			access: &Access{OrgID: ptr(uint64(1)), AppID: ptr(uint64(123)), Machine: ptr("abc"), Action: resset.ActionControl},
+			expect: "Your token doesn't allow control access to machine abc in app 'my-app'.",
+		},
+		{
+			name:   "app machine other app",
+			cavs:   []macaroon.Caveat{&AppMachines{AppID: 123, Machines: resset.New(resset.ActionAll, "abc")}},
+			access: &Access{OrgID: ptr(uint64(1)), AppID: ptr(uint64(456)), Machine: ptr("abc"), Action: resset.ActionRead},
+			expect: "Your token doesn't allow access to machine abc in app 456.",
+		},
+		{
+			name:   "feature",
+			cavs:   []macaroon.Caveat{&FeatureSet{Features: resset.New(resset.ActionRead, "wg")}},
+			access: &Access{OrgID: ptr(uint64(1)), Feature: ptr("builder"), Action: resset.ActionRead},
+			expect: "Your token doesn't allow access to the 'builder' organization feature.",
+		},
+		{
+			name: "if present",
+			cavs: []macaroon.Caveat{&resset.IfPresent{
+				Ifs:  macaroon.NewCaveatSet(&Apps{Apps: resset.ResourceSet[uint64, resset.Action]{123: resset.ActionRead}}),
+				Else: resset.ActionAll,
+			}},
+			access: &Access{OrgID: ptr(uint64(1)), AppID: ptr(uint64(123)), Action: resset.ActionWrite},
+			expect: "Your token doesn't allow write access to app 'my-app'.",
+		},
+		{
+			name:   "read-only",
+			cavs:   []macaroon.Caveat{&ReadOnly{}},
+			access: &Access{OrgID: ptr(uint64(1)), AppID: ptr(uint64(123)), Action: resset.ActionRead | resset.ActionWrite | resset.ActionDelete},
+			expect: "Your token is read-only and doesn't allow write and delete access.",
+		},
+		{
+			name: "expired",
+			cavs: []macaroon.Caveat{&macaroon.ValidityWindow{
+				NotBefore: time.Now().Add(-2 * time.Hour).Unix(),
+				NotAfter:  time.Now().Add(-time.Hour).Unix(),
+			}},
+			access: &Access{OrgID: ptr(uint64(1)), Action: resset.ActionRead},
+			expect: "Your token has expired.",
+		},
+		{
+			name: "several",
+			cavs: []macaroon.Caveat{
+				&Organization{ID: 1, Mask: resset.ActionRead},
+				&Apps{Apps: resset.ResourceSet[uint64, resset.Action]{123: resset.ActionRead}},
+				&AppNames{Apps: resset.New(resset.ActionRead, "other-app")},
+			},
+			access: &Access{OrgID: ptr(uint64(1)), AppID: ptr(uint64(123)), AppName: ptr("my-app"), Action: resset.ActionWrite},
+			expect: "Your token doesn't allow write access to organization 'my-org'. " +
+				"Your token doesn't allow write access to app 'my-app'. " +
+				"Your token doesn't allow access to app 'my-app'.",
+		},
+		{
+			name:   "generic",
+			cavs:   []macaroon.Caveat{&Mutations{Mutations: []string{"deployImage"}}},
+			access: &Access{OrgID: ptr(uint64(1)), Mutation: ptr("deleteApp"), Action: resset.ActionRead},
+			expect: "Your token doesn't allow this request.",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := macaroon.NewCaveatSet(tt.cavs...).Validate(tt.access)
+			assert.Error(t, err)
+			assert.Equal(t, tt.expect+advice, ExplainDenial(err, resolve))
+		})
+	}
+
+	// names fall back to IDs without a resolver
+	err := macaroon.NewCaveatSet(&Organization{ID: 1, Mask: resset.ActionRead}).Validate(&Access{OrgID: ptr(uint64(1)), Action: resset.ActionWrite})
+	assert.Equal(t, "Your token doesn't allow write access to organization 1."+advice, ExplainDenial(err, nil))
+
+	assert.Equal(t, "", ExplainDenial(nil, resolve))
+}
@@ -0,0 +1,16 @@
+//go:build !tinygo
+
+// The tp package depends on net/http and logrus, which aren't usable with
+// TinyGo.
+
+package flyio
+
+import (
+	"github.com/superfly/macaroon/tp"
+)
+
+// DischargeClient returns a *tp.Client suitable for discharging third party
+// caveats in fly.io permission tokens.
+func DischargeClient(opts ...tp.ClientOption) *tp.Client {
+	return tp.NewClient(LocationPermission, opts...)
+}
@@ -8,4 +8,17 @@ import (
 
 var (
 	ErrUnauthorizedForRole = fmt.Errorf("%w for role", macaroon.ErrUnauthorized)
+
+	// ErrZeroOrgID is returned when an Organization caveat is built with ID 0
+	// other than by AnyOrgRestriction. See Organization.Validate.
+	ErrZeroOrgID = fmt.Errorf("%w: organization ID is 0", macaroon.ErrBadCaveat)
+
+	// ErrEmptyOrgSlug is returned when an OrgSlug caveat has an empty slug.
+	// See OrgSlug.Validate.
+	ErrEmptyOrgSlug = fmt.Errorf("%w: organization slug is empty", macaroon.ErrBadCaveat)
+
+	// ErrAmbiguousAccess is returned by CaveatsForAccess for accesses that
+	// can't be granted exactly (e.g. zero IDs, which caveats treat as
+	// wildcards).
+	ErrAmbiguousAccess = fmt.Errorf("%w: ambiguous access", macaroon.ErrInvalidAccess)
 )
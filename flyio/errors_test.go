@@ -0,0 +1,180 @@
+package flyio
+
+import (
+	"errors"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/alecthomas/assert/v2"
+	"github.com/superfly/macaroon"
+	"github.com/superfly/macaroon/auth"
+	"github.com/superfly/macaroon/resset"
+)
+
+// TestErrorClassification checks that the errors from caveats in the macaroon,
+// resset, flyio, and auth packages fall into exactly one of the classes
+// described by macaroon.ErrUnauthorized.
+func TestErrorClassification(t *testing.T) {
+	const (
+		denial    = "denial"
+		accessBug = "access bug"
+		tokenBug  = "token bug"
+	)
+
+	var (
+		org     = &Access{OrgID: uptr(1), Action: resset.ActionRead}
+		app     = &Access{OrgID: uptr(1), AppID: uptr(2), Action: resset.ActionRead}
+		machine = &Access{OrgID: uptr(1), AppID: uptr(2), Machine: ptr("m1"), Action: resset.ActionRead}
+		create  = &Access{OrgID: uptr(1), Action: resset.ActionCreate}
+		other   = new(otherAccess)
+		dr      = &auth.DischargeRequest{Flyio: []*auth.FlyioAuth{{UserID: 1, OrganizationIDs: []uint64{1}}}}
+		emptyDR = new(auth.DischargeRequest)
+
+		rs       = resset.New[uint64](resset.ActionRead, 2)
+		readOnly = resset.ActionRead
+		noRoles  = AllowedRoles(0)
+		ip       = netip.MustParseAddr("192.0.2.1")
+	)
+
+	sn, err := NewSourceNetworks("10.0.0.0/8")
+	assert.NoError(t, err)
+
+	_, policyErr := auth.PolicyFromCaveats([]macaroon.Caveat{&Organization{ID: 1}})
+
+	cases := map[string]struct {
+		err   error
+		class string
+	}{
+		// macaroon
+		"ValidityWindow expired":   {(&macaroon.ValidityWindow{NotBefore: 1, NotAfter: 2}).Prohibits(org), denial},
+		"Caveat3P checked":         {new(macaroon.Caveat3P).Prohibits(org), tokenBug},
+		"BindToParentToken":        {new(macaroon.BindToParentToken).Prohibits(org), tokenBug},
+		"unrecognized token":       {macaroon.ErrUnrecognizedToken, tokenBug},
+		"missing attestation":      {macaroon.ErrMissingAttestation, denial},
+		"untrusted discharge":      {&macaroon.DischargeTrustError{}, denial},
+		"ResourceSet unspecified":  {rs.Prohibits(nil, resset.ActionRead, "app"), denial},
+		"ResourceSet resource":     {rs.Prohibits(uptr(3), resset.ActionRead, "app"), denial},
+		"ResourceSet action":       {rs.Prohibits(uptr(2), resset.ActionWrite, "app"), denial},
+		"ResourceSet zero + other": {resset.ResourceSet[uint64, resset.Action]{0: resset.ActionRead, 2: resset.ActionRead}.Prohibits(uptr(2), resset.ActionRead, "app"), tokenBug},
+
+		// resset
+		"Action wrong access":    {readOnly.Prohibits(other), accessBug},
+		"Action":                 {readOnly.Prohibits(create), denial},
+		"IfPresent wrong access": {(&resset.IfPresent{Ifs: macaroon.NewCaveatSet(), Else: resset.ActionRead}).Prohibits(other), accessBug},
+		"IfPresent else":         {(&resset.IfPresent{Ifs: macaroon.NewCaveatSet(&Apps{Apps: rs}), Else: resset.ActionRead}).Prohibits(create), denial},
+		"IfPresent ifs":          {(&resset.IfPresent{Ifs: macaroon.NewCaveatSet(&Apps{Apps: rs}), Else: resset.ActionAll}).Prohibits(&Access{OrgID: uptr(1), AppID: uptr(3)}), denial},
+		"Require wrong access":   {(&resset.Require{Caveats: macaroon.NewCaveatSet()}).Prohibits(other), accessBug},
+		"Require unspecified":    {(&resset.Require{Caveats: macaroon.NewCaveatSet(&Apps{Apps: rs})}).Prohibits(org), denial},
+
+		// flyio
+		"Access no org":                {(&Access{}).Validate(), accessBug},
+		"Access mutually exclusive":    {(&Access{OrgID: uptr(1), AppID: uptr(2), Feature: ptr("x")}).Validate(), accessBug},
+		"Access no app":                {(&Access{OrgID: uptr(1), Machine: ptr("m1")}).Validate(), accessBug},
+		"Access no machine":            {(&Access{OrgID: uptr(1), AppID: uptr(2), Command: []string{"ls"}}).Validate(), accessBug},
+		"Access cluster":               {(&Access{OrgID: uptr(1), Feature: ptr("x"), Cluster: ptr("c")}).Validate(), accessBug},
+		"Access no audience":           {(&Access{OrgID: uptr(1), AppID: uptr(2), Machine: ptr("m1"), MachineFeature: ptr(MachineFeatureOIDC)}).Validate(), accessBug},
+		"ambiguous access":             {ErrAmbiguousAccess, accessBug},
+		"zero org ID":                  {(&Organization{ID: 0}).Validate(), tokenBug},
+		"Organization wrong access":    {(&Organization{ID: 1}).Prohibits(other), accessBug},
+		"Organization resource":        {(&Organization{ID: 2, Mask: resset.ActionAll}).Prohibits(org), denial},
+		"Organization action":          {(&Organization{ID: 1, Mask: resset.ActionRead}).Prohibits(create), denial},
+		"OrgSlug wrong access":         {(&OrgSlug{Slug: "x"}).Prohibits(other), accessBug},
+		"OrgSlug unspecified":          {(&OrgSlug{Slug: "x", Mask: resset.ActionAll}).Prohibits(org), denial},
+		"Apps wrong access":            {(&Apps{Apps: rs}).Prohibits(other), accessBug},
+		"Apps unspecified":             {(&Apps{Apps: rs}).Prohibits(org), denial},
+		"Apps resource":                {(&Apps{Apps: rs}).Prohibits(&Access{OrgID: uptr(1), AppID: uptr(3)}), denial},
+		"AppNames wrong access":        {(&AppNames{Apps: resset.New(resset.ActionRead, "a")}).Prohibits(other), accessBug},
+		"Volumes wrong access":         {(&Volumes{Volumes: resset.New(resset.ActionRead, "v")}).Prohibits(other), accessBug},
+		"Machines wrong access":        {(&Machines{Machines: resset.New(resset.ActionRead, "m")}).Prohibits(other), accessBug},
+		"Machines unspecified":         {(&Machines{Machines: resset.New(resset.ActionRead, "m")}).Prohibits(app), denial},
+		"AppVolumes wrong access":      {(&AppVolumes{AppID: 2, Volumes: resset.New(resset.ActionRead, "v")}).Prohibits(other), accessBug},
+		"AppMachines wrong access":     {(&AppMachines{AppID: 2, Machines: resset.New(resset.ActionRead, "m")}).Prohibits(other), accessBug},
+		"AppMachines unspecified":      {(&AppMachines{AppID: 2, Machines: resset.New(resset.ActionRead, "m")}).Prohibits(org), denial},
+		"AppMachines resource":         {(&AppMachines{AppID: 3, Machines: resset.New(resset.ActionRead, "m")}).Prohibits(machine), denial},
+		"MachineFeatureSet":            {(&MachineFeatureSet{Features: resset.New(resset.ActionRead, "f")}).Prohibits(machine), denial},
+		"FeatureSet wrong access":      {(&FeatureSet{Features: resset.New(resset.ActionRead, "f")}).Prohibits(other), accessBug},
+		"AppFeatureSet wrong access":   {(&AppFeatureSet{Features: resset.New(resset.ActionRead, "f")}).Prohibits(other), accessBug},
+		"Clusters wrong access":        {(&Clusters{Clusters: resset.New(resset.ActionRead, "c")}).Prohibits(other), accessBug},
+		"StorageObjects wrong access":  {(&StorageObjects{Prefixes: resset.New(resset.ActionRead, resset.Prefix("p"))}).Prohibits(other), accessBug},
+		"OIDCAudiences wrong access":   {(&OIDCAudiences{Audiences: resset.New(resset.ActionRead, resset.Prefix("a"))}).Prohibits(other), accessBug},
+		"Mutations wrong access":       {(&Mutations{Mutations: []string{"m"}}).Prohibits(other), accessBug},
+		"Mutations unspecified":        {(&Mutations{Mutations: []string{"m"}}).Prohibits(org), denial},
+		"Mutations resource":           {(&Mutations{Mutations: []string{"m"}}).Prohibits(&Access{OrgID: uptr(1), Mutation: ptr("n")}), denial},
+		"Queries wrong access":         {(&Queries{Queries: []string{"q"}}).Prohibits(other), accessBug},
+		"Queries unspecified":          {(&Queries{Queries: []string{"q"}}).Prohibits(org), denial},
+		"Commands wrong access":        {(&Commands{{Args: []string{"ls"}}}).Prohibits(other), accessBug},
+		"Commands unspecified":         {(&Commands{{Args: []string{"ls"}}}).Prohibits(machine), denial},
+		"FromMachine wrong access":     {(&FromMachine{ID: "m1"}).Prohibits(other), accessBug},
+		"FromMachine unspecified":      {(&FromMachine{ID: "m1"}).Prohibits(org), denial},
+		"FromMachine other":            {(&FromMachine{ID: "m1"}).Prohibits(&Access{OrgID: uptr(1), SourceMachine: ptr("m2")}), denial},
+		"MachineIdentity checked":      {new(MachineIdentity).Prohibits(org), tokenBug},
+		"MaxSpendCents wrong access":   {(&MaxSpendCents{Amount: 1, Window: "month"}).Prohibits(other), accessBug},
+		"MaxSpendCents unspecified":    {(&MaxSpendCents{Amount: 1, Window: "month"}).Prohibits(create), denial},
+		"MaxSpendCents exceeded":       {(&MaxSpendCents{Amount: 1, Window: "month"}).Prohibits(&Access{OrgID: uptr(1), Action: resset.ActionCreate, ProjectedSpendCents: uptr(2)}), denial},
+		"ReadOnly wrong access":        {(&ReadOnly{}).Prohibits(other), accessBug},
+		"ReadOnly":                     {(&ReadOnly{}).Prohibits(create), denial},
+		"AllowedRoles wrong access":    {noRoles.Prohibits(other), accessBug},
+		"AllowedRoles":                 {noRoles.Prohibits(org), denial},
+		"SourceNetworks wrong access":  {sn.Prohibits(other), accessBug},
+		"SourceNetworks unspecified":   {sn.Prohibits(org), denial},
+		"SourceNetworks other":         {sn.Prohibits(&Access{OrgID: uptr(1), SourceIP: &ip}), denial},
+		"NewSourceNetworks bad CIDR":   {func() error { _, err := NewSourceNetworks("nope"); return err }(), tokenBug},
+		"ScopedToLocation":             {(&macaroon.ScopedToLocation{Locations: []string{"here"}, Caveats: macaroon.NewCaveatSet(&Apps{Apps: rs})}).Prohibits(org), denial},
+		"no public storage objects":    {(*PublicReadPolicy)(nil).AllowsAnonymous(org), denial},
+		"token not constrained to org": {func() error { _, err := OrganizationScope(macaroon.NewCaveatSet()); return err }(), denial},
+
+		// auth
+		"ConfineOrganization wrong access": {auth.RequireOrganization(1).Prohibits(org), accessBug},
+		"ConfineOrganization missing":      {auth.RequireOrganization(1).Prohibits(emptyDR), denial},
+		"ConfineOrganization other":        {auth.RequireOrganization(2).Prohibits(dr), denial},
+		"ConfineUser missing":              {auth.RequireUser(1).Prohibits(emptyDR), denial},
+		"ConfineUser other":                {auth.RequireUser(2).Prohibits(dr), denial},
+		"ConfineMachine wrong access":      {auth.RequireMachine("m1").Prohibits(org), accessBug},
+		"ConfineMachine missing":           {auth.RequireMachine("m1").Prohibits(emptyDR), denial},
+		"ConfineGoogleHD missing":          {auth.RequireGoogleHD("example.com").Prohibits(emptyDR), denial},
+		"ConfineGitHubOrg missing":         {auth.RequireGitHubOrg(1).Prohibits(emptyDR), denial},
+		"ConfineAnyOf wrong access":        {auth.RequireAnyOf().Prohibits(org), accessBug},
+		"ConfineAnyOf empty":               {auth.RequireAnyOf().Prohibits(dr), denial},
+		"ConfineAnyOf":                     {auth.RequireAnyOf(auth.RequireUser(2)).Prohibits(dr), denial},
+		"MaxValidity wrong access":         {new(auth.MaxValidity).Prohibits(org), accessBug},
+		"MaxValidity":                      {new(auth.MaxValidity).Prohibits(&auth.DischargeRequest{Expiry: time.Now().Add(time.Hour)}), denial},
+		"FlyioUserID checked":              {new(auth.FlyioUserID).Prohibits(dr), tokenBug},
+		"GitHubUserID checked":             {new(auth.GitHubUserID).Prohibits(dr), tokenBug},
+		"GoogleUserID checked":             {new(auth.GoogleUserID).Prohibits(dr), tokenBug},
+		"unsupported ticket caveat":        {policyErr, tokenBug},
+		"exceeds max validity":             {auth.ErrExceedsMaxValidity, denial},
+	}
+
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			assert.Error(t, c.err)
+
+			var classes []string
+			if macaroon.IsDenial(c.err) {
+				classes = append(classes, denial)
+			}
+			if macaroon.IsAccessBug(c.err) {
+				classes = append(classes, accessBug)
+			}
+			if macaroon.IsTokenBug(c.err) {
+				classes = append(classes, tokenBug)
+			}
+
+			assert.Equal(t, []string{c.class}, classes, c.err.Error())
+		})
+	}
+
+	t.Run("sentinels", func(t *testing.T) {
+		assert.False(t, errors.Is(macaroon.ErrInvalidAccess, macaroon.ErrUnauthorized))
+		assert.False(t, errors.Is(macaroon.ErrBadCaveat, macaroon.ErrUnauthorized))
+		assert.False(t, macaroon.IsDenial(nil) || macaroon.IsAccessBug(nil) || macaroon.IsTokenBug(nil))
+	})
+}
+
+// otherAccess is an Access that none of the flyio or auth caveats can
+// evaluate.
+type otherAccess struct{}
+
+func (*otherAccess) Now() time.Time  { return time.Now() }
+func (*otherAccess) Validate() error { return nil }
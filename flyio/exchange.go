@@ -0,0 +1,119 @@
+package flyio
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/superfly/macaroon"
+	"github.com/superfly/macaroon/resset"
+)
+
+// Exchange mints a new token that is narrower than orig, whose verified caveat
+// set is in. This is the issuer side of "token exchange", where a client presents a broad
+// token and asks for a narrower, independently-revocable token rather than
+// simply attenuating the one they have.
+//
+// Every requested caveat is checked against in. Organization, Apps and
+// FeatureSet caveats must be at least as restrictive as in and caveats that
+// can't be added by clients (attestations, third-party caveats, etc.) are
+// rejected. Regardless of these checks, the non-attestation caveats from in are
+// copied to the new token, so it can never allow more than the original.
+//
+// The mint callback returns a fresh token (new nonce/KID). Third-party caveats
+// aren't part of the verified caveat set and are cryptographically bound to
+// the original token, so mint must add third-party caveats for each of orig's
+// third-party locations (e.g. authentication), which only the issuer has the
+// keys for. The exchange fails if it doesn't, rather than minting a token that
+// no longer requires them.
+func Exchange(orig *macaroon.Macaroon, in *macaroon.CaveatSet, req []macaroon.Caveat, mint func() (*macaroon.Macaroon, error)) (*macaroon.Macaroon, error) {
+	for _, cav := range req {
+		if err := checkExchangeCaveat(in, cav); err != nil {
+			return nil, fmt.Errorf("exchange: %s caveat: %w", cav.Name(), err)
+		}
+	}
+
+	m, err := mint()
+	if err != nil {
+		return nil, fmt.Errorf("exchange: mint: %w", err)
+	}
+
+	for _, loc := range orig.ThirdPartyLocations() {
+		if !m.HasThirdParty(loc) {
+			return nil, fmt.Errorf("exchange: minted token lacks the third-party caveat for %s required by the original token", loc)
+		}
+	}
+
+	cavs := make([]macaroon.Caveat, 0, len(in.Caveats)+len(req))
+	for _, cav := range in.Caveats {
+		if !macaroon.IsAttestation(cav) {
+			cavs = append(cavs, cav)
+		}
+	}
+	cavs = append(cavs, req...)
+
+	if err := m.Add(cavs...); err != nil {
+		return nil, fmt.Errorf("exchange: %w", err)
+	}
+
+	return m, nil
+}
+
+func checkExchangeCaveat(in *macaroon.CaveatSet, cav macaroon.Caveat) error {
+	if macaroon.IsAttestation(cav) {
+		return fmt.Errorf("%w: attestations can't be requested", macaroon.ErrBadCaveat)
+	}
+
+	switch typed := cav.(type) {
+	case *macaroon.Caveat3P, *macaroon.BindToParentToken:
+		return fmt.Errorf("%w: can't be requested", macaroon.ErrBadCaveat)
+	case *Organization:
+		return allowsIgnoringUnspecified(in, &Access{OrgID: &typed.ID, Action: typed.Mask})
+	case *Apps:
+		orgID, err := OrganizationScope(in)
+		if err != nil {
+			return err
+		}
+
+		for appID, mask := range typed.Apps {
+			appID := appID
+			if err := allowsIgnoringUnspecified(in, &Access{OrgID: &orgID, AppID: &appID, Action: mask}); err != nil {
+				return err
+			}
+		}
+	case *FeatureSet:
+		orgID, err := OrganizationScope(in)
+		if err != nil {
+			return err
+		}
+
+		for feature, mask := range typed.Features {
+			feature := feature
+			if err := allowsIgnoringUnspecified(in, &Access{OrgID: &orgID, Feature: &feature, Action: mask}); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// allowsIgnoringUnspecified checks that no caveat in cs prohibits the access,
+// disregarding caveats that constrain resources not specified by the access.
+// Those caveats are copied into the exchanged token anyway.
+func allowsIgnoringUnspecified(cs *macaroon.CaveatSet, access *Access) error {
+	if err := access.Validate(); err != nil {
+		return err
+	}
+
+	for _, cav := range cs.Caveats {
+		if macaroon.IsAttestation(cav) {
+			continue
+		}
+
+		if err := cav.Prohibits(access); err != nil && !errors.Is(err, resset.ErrResourceUnspecified) {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,110 @@
+package flyio
+
+import (
+	"testing"
+
+	"github.com/alecthomas/assert/v2"
+	"github.com/superfly/macaroon"
+	"github.com/superfly/macaroon/auth"
+	"github.com/superfly/macaroon/resset"
+)
+
+func TestExchange(t *testing.T) {
+	var (
+		kid = []byte("new-kid")
+		key = macaroon.NewSigningKey()
+	)
+
+	mint := func() (*macaroon.Macaroon, error) {
+		return macaroon.New(kid, LocationPermission, key)
+	}
+
+	in := macaroon.NewCaveatSet(
+		&Organization{ID: 1, Mask: resset.ActionAll},
+		&Apps{Apps: resset.ResourceSet[uint64, resset.Action]{10: resset.ActionRead | resset.ActionWrite, 11: resset.ActionRead}},
+		ptr(auth.FlyioUserID(123)),
+	)
+
+	orig, err := macaroon.New([]byte("orig-kid"), LocationPermission, macaroon.NewSigningKey())
+	assert.NoError(t, err)
+
+	t.Run("narrowing", func(t *testing.T) {
+		m, err := Exchange(orig, in, []macaroon.Caveat{
+			&Apps{Apps: resset.New[uint64](resset.ActionRead, 10)},
+		}, mint)
+		assert.NoError(t, err)
+
+		tok, err := m.Encode()
+		assert.NoError(t, err)
+
+		decoded, err := macaroon.Decode(tok)
+		assert.NoError(t, err)
+		assert.Equal(t, kid, decoded.Nonce.KID)
+
+		cs, err := decoded.Verify(key, nil, nil)
+		assert.NoError(t, err)
+
+		// attestations aren't copied
+		assert.Zero(t, len(macaroon.GetCaveats[*auth.FlyioUserID](cs)))
+
+		assert.NoError(t, cs.Validate(&Access{OrgID: uptr(1), AppID: uptr(10), Action: resset.ActionRead}))
+		assert.IsError(t, cs.Validate(&Access{OrgID: uptr(1), AppID: uptr(10), Action: resset.ActionWrite}), resset.ErrUnauthorizedForAction)
+		assert.IsError(t, cs.Validate(&Access{OrgID: uptr(1), AppID: uptr(11), Action: resset.ActionRead}), resset.ErrUnauthorizedForResource)
+	})
+
+	t.Run("unrelated caveats are allowed", func(t *testing.T) {
+		_, err := Exchange(orig, in, []macaroon.Caveat{
+			&macaroon.ValidityWindow{NotBefore: 1, NotAfter: 2},
+			&Machines{Machines: resset.New(resset.ActionRead, "abc")},
+		}, mint)
+		assert.NoError(t, err)
+	})
+
+	t.Run("escalation", func(t *testing.T) {
+		for name, req := range map[string]macaroon.Caveat{
+			"broader action": &Apps{Apps: resset.New[uint64](resset.ActionAll, 10)},
+			"other app":      &Apps{Apps: resset.New[uint64](resset.ActionRead, 12)},
+			"wildcard app":   &Apps{Apps: resset.New[uint64](resset.ActionRead, 0)},
+			"other org":      &Organization{ID: 2, Mask: resset.ActionRead},
+		} {
+			t.Run(name, func(t *testing.T) {
+				_, err := Exchange(orig, in, []macaroon.Caveat{req}, mint)
+				assert.IsError(t, err, macaroon.ErrUnauthorized)
+			})
+		}
+	})
+
+	t.Run("attestation", func(t *testing.T) {
+		_, err := Exchange(orig, in, []macaroon.Caveat{ptr(auth.FlyioUserID(456))}, mint)
+		assert.IsError(t, err, macaroon.ErrBadCaveat)
+		assert.False(t, macaroon.IsDenial(err))
+	})
+	t.Run("third-party caveats", func(t *testing.T) {
+		var (
+			authKey = macaroon.NewEncryptionKey()
+			authLoc = "https://auth.example"
+		)
+
+		orig, err := orig.Clone()
+		assert.NoError(t, err)
+		assert.NoError(t, orig.Add3P(authKey, authLoc))
+
+		req := []macaroon.Caveat{&Apps{Apps: resset.New[uint64](resset.ActionRead, 10)}}
+
+		// the exchanged token must still require authentication
+		_, err = Exchange(orig, in, req, mint)
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), authLoc)
+
+		m, err := Exchange(orig, in, req, func() (*macaroon.Macaroon, error) {
+			m, err := mint()
+			if err != nil {
+				return nil, err
+			}
+
+			return m, m.Add3P(authKey, authLoc)
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, []string{authLoc}, m.ThirdPartyLocations())
+	})
+}
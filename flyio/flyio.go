@@ -4,7 +4,6 @@ import (
 	"fmt"
 
 	"github.com/superfly/macaroon"
-	"github.com/superfly/macaroon/tp"
 )
 
 const (
@@ -21,12 +20,6 @@ func ParsePermissionAndDischargeTokens(header string) ([]byte, [][]byte, error)
 	return macaroon.ParsePermissionAndDischargeTokens(header, LocationPermission)
 }
 
-// DischargeClient returns a *tp.Client suitable for discharging third party
-// caveats in fly.io permission tokens.
-func DischargeClient(opts ...tp.ClientOption) *tp.Client {
-	return tp.NewClient(LocationPermission, opts...)
-}
-
 // NonceEmail is a pseudo-email address for a nonce. It's useful when we want an
 // email address associated with a token.
 func NonceEmail(n macaroon.Nonce) string {
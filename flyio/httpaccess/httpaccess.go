@@ -0,0 +1,252 @@
+// Package httpaccess maps HTTP requests to machinesapi.Accesses, for
+// authorizing plain HTTP requests (e.g. in a reverse proxy) against Fly.io
+// tokens. A Mapper is built from a table of routes:
+//
+//	m, err := httpaccess.NewMapper(
+//		httpaccess.Rule{"GET", "/v1/apps/{app_name}", resset.ActionNone, httpaccess.AppResource},
+//		httpaccess.Rule{"POST", "/v1/apps/{app_name}/machines/{machine_id}/stop", resset.ActionControl, httpaccess.MachineResource},
+//	)
+//
+// Requests that don't match any route are denied.
+package httpaccess
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/superfly/macaroon"
+	"github.com/superfly/macaroon/flyio/machinesapi"
+	"github.com/superfly/macaroon/resset"
+)
+
+// ErrUnmappedRoute is returned by Mapper.Access for requests that don't match
+// any of the Mapper's rules.
+var ErrUnmappedRoute = fmt.Errorf("%w: unmapped route", macaroon.ErrUnauthorized)
+
+// Resource is the kind of resource that a route accesses. It determines which
+// path variables the route's pattern must include.
+type Resource int
+
+const (
+	// OrgResource routes must include {org_slug}.
+	OrgResource Resource = iota + 1
+
+	// OrgFeatureResource routes must include {org_slug} and {org_feature}.
+	OrgFeatureResource
+
+	// AppResource routes must include {app_name}.
+	AppResource
+
+	// AppFeatureResource routes must include {app_name} and {app_feature}.
+	AppFeatureResource
+
+	// VolumeResource routes must include {app_name} and {volume_id}.
+	VolumeResource
+
+	// MachineResource routes must include {app_name} and {machine_id}.
+	MachineResource
+
+	// MachineFeatureResource routes must include {app_name}, {machine_id}, and
+	// {machine_feature}.
+	MachineFeatureResource
+)
+
+// Path variables, named after the machinesapi.Access fields they populate.
+const (
+	VarOrgSlug        = "org_slug"
+	VarOrgFeature     = "org_feature"
+	VarAppName        = "app_name"
+	VarAppFeature     = "app_feature"
+	VarVolumeID       = "volume_id"
+	VarMachineID      = "machine_id"
+	VarMachineFeature = "machine_feature"
+)
+
+var requiredVars = map[Resource][]string{
+	OrgResource:            {VarOrgSlug},
+	OrgFeatureResource:     {VarOrgSlug, VarOrgFeature},
+	AppResource:            {VarAppName},
+	AppFeatureResource:     {VarAppName, VarAppFeature},
+	VolumeResource:         {VarAppName, VarVolumeID},
+	MachineResource:        {VarAppName, VarMachineID},
+	MachineFeatureResource: {VarAppName, VarMachineID, VarMachineFeature},
+}
+
+// Rule maps requests with the given method and path pattern to an Access.
+// Path segments of the form {name} are variables, which match any non-empty
+// segment and populate the machinesapi.Access field of the same name (see the
+// Var constants). If Action is ActionNone, it is derived from the method:
+// GET and HEAD are read, PUT and PATCH are write, and DELETE is delete. POST
+// rules must specify the Action, since POST is used both to create resources
+// and to modify or control them. Rules for GET also match HEAD requests.
+type Rule struct {
+	Method   string
+	Pattern  string
+	Action   resset.Action
+	Resource Resource
+}
+
+// Mapper maps HTTP requests to machinesapi.Accesses according to a table of
+// Rules.
+type Mapper struct {
+	routes []route
+}
+
+type route struct {
+	method   string
+	segments []string
+	action   resset.Action
+}
+
+// NewMapper returns a Mapper for the rules. Requests are matched against the
+// rules in order. It returns an error if any rule is malformed.
+func NewMapper(rules ...Rule) (*Mapper, error) {
+	m := &Mapper{routes: make([]route, 0, len(rules))}
+
+	for _, rule := range rules {
+		rt, err := newRoute(rule)
+		if err != nil {
+			return nil, fmt.Errorf("bad rule %s %s: %w", rule.Method, rule.Pattern, err)
+		}
+
+		m.routes = append(m.routes, rt)
+	}
+
+	return m, nil
+}
+
+func newRoute(rule Rule) (route, error) {
+	rt := route{
+		method:   strings.ToUpper(rule.Method),
+		segments: splitPath(rule.Pattern),
+		action:   rule.Action,
+	}
+
+	if rt.action == resset.ActionNone {
+		switch rt.method {
+		case http.MethodGet, http.MethodHead:
+			rt.action = resset.ActionRead
+		case http.MethodPut, http.MethodPatch:
+			rt.action = resset.ActionWrite
+		case http.MethodDelete:
+			rt.action = resset.ActionDelete
+		default:
+			return route{}, fmt.Errorf("action required for method %s", rt.method)
+		}
+	}
+
+	required, ok := requiredVars[rule.Resource]
+	if !ok {
+		return route{}, fmt.Errorf("unknown resource %d", rule.Resource)
+	}
+
+	vars := map[string]bool{}
+	for _, seg := range rt.segments {
+		name, isVar := varName(seg)
+		if !isVar {
+			continue
+		}
+
+		if setVar(&machinesapi.Access{}, name, "") != nil {
+			return route{}, fmt.Errorf("unknown variable {%s}", name)
+		}
+		if vars[name] {
+			return route{}, fmt.Errorf("duplicate variable {%s}", name)
+		}
+
+		vars[name] = true
+	}
+
+	for _, name := range required {
+		if !vars[name] {
+			return route{}, fmt.Errorf("missing variable {%s}", name)
+		}
+	}
+
+	return rt, nil
+}
+
+// Access returns the machinesapi.Access for the request. The Access includes
+// the names from the request's path, which the Machines API resolves to IDs.
+// An error wrapping ErrUnmappedRoute is returned if no rule matches.
+func (m *Mapper) Access(r *http.Request) (*machinesapi.Access, error) {
+	segments := splitPath(r.URL.EscapedPath())
+
+	for _, rt := range m.routes {
+		if access, ok := rt.match(r.Method, segments); ok {
+			return access, nil
+		}
+	}
+
+	return nil, fmt.Errorf("%w: %s %s", ErrUnmappedRoute, r.Method, r.URL.EscapedPath())
+}
+
+func (rt *route) match(method string, segments []string) (*machinesapi.Access, bool) {
+	if method != rt.method && !(method == http.MethodHead && rt.method == http.MethodGet) {
+		return nil, false
+	}
+
+	if len(segments) != len(rt.segments) {
+		return nil, false
+	}
+
+	access := &machinesapi.Access{Action: rt.action}
+
+	for i, seg := range rt.segments {
+		name, isVar := varName(seg)
+		if !isVar {
+			if seg != segments[i] {
+				return nil, false
+			}
+			continue
+		}
+
+		value, err := url.PathUnescape(segments[i])
+		if err != nil || value == "" {
+			return nil, false
+		}
+
+		if err := setVar(access, name, value); err != nil {
+			return nil, false
+		}
+	}
+
+	return access, true
+}
+
+func setVar(access *machinesapi.Access, name, value string) error {
+	switch name {
+	case VarOrgSlug:
+		access.OrgSlug = &value
+	case VarOrgFeature:
+		access.OrgFeature = &value
+	case VarAppName:
+		access.AppName = &value
+	case VarAppFeature:
+		access.AppFeature = &value
+	case VarVolumeID:
+		access.VolumeID = &value
+	case VarMachineID:
+		access.MachineID = &value
+	case VarMachineFeature:
+		access.MachineFeature = &value
+	default:
+		return fmt.Errorf("unknown variable {%s}", name)
+	}
+
+	return nil
+}
+
+func varName(segment string) (string, bool) {
+	if len(segment) < 2 || segment[0] != '{' || segment[len(segment)-1] != '}' {
+		return "", false
+	}
+
+	return segment[1 : len(segment)-1], true
+}
+
+func splitPath(path string) []string {
+	return strings.Split(strings.TrimPrefix(path, "/"), "/")
+}
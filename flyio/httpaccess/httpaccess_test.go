@@ -0,0 +1,158 @@
+package httpaccess
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/alecthomas/assert/v2"
+	"github.com/superfly/macaroon"
+	"github.com/superfly/macaroon/flyio"
+	"github.com/superfly/macaroon/flyio/machinesapi"
+	"github.com/superfly/macaroon/resset"
+)
+
+var rules = []Rule{
+	{"GET", "/v1/apps/{app_name}", resset.ActionNone, AppResource},
+	{"DELETE", "/v1/apps/{app_name}", resset.ActionNone, AppResource},
+	{"GET", "/v1/apps/{app_name}/machines", resset.ActionNone, AppResource},
+	{"POST", "/v1/apps/{app_name}/machines", resset.ActionCreate, AppResource},
+	{"GET", "/v1/apps/{app_name}/machines/{machine_id}", resset.ActionRead, MachineResource},
+	{"POST", "/v1/apps/{app_name}/machines/{machine_id}", resset.ActionWrite, MachineResource},
+	{"DELETE", "/v1/apps/{app_name}/machines/{machine_id}", resset.ActionNone, MachineResource},
+	{"POST", "/v1/apps/{app_name}/machines/{machine_id}/stop", resset.ActionControl, MachineResource},
+	{"GET", "/v1/apps/{app_name}/machines/{machine_id}/{machine_feature}", resset.ActionNone, MachineFeatureResource},
+	{"PUT", "/v1/apps/{app_name}/volumes/{volume_id}", resset.ActionNone, VolumeResource},
+	{"GET", "/v1/orgs/{org_slug}/{org_feature}", resset.ActionNone, OrgFeatureResource},
+}
+
+func TestMapper(t *testing.T) {
+	m, err := NewMapper(rules...)
+	assert.NoError(t, err)
+
+	tests := []struct {
+		method string
+		path   string
+		expect *machinesapi.Access
+	}{
+		{"GET", "/v1/apps/my-app", &machinesapi.Access{Action: resset.ActionRead, AppName: ptr("my-app")}},
+		{"HEAD", "/v1/apps/my-app", &machinesapi.Access{Action: resset.ActionRead, AppName: ptr("my-app")}},
+		{"DELETE", "/v1/apps/my-app", &machinesapi.Access{Action: resset.ActionDelete, AppName: ptr("my-app")}},
+		{"GET", "/v1/apps/my-app/machines", &machinesapi.Access{Action: resset.ActionRead, AppName: ptr("my-app")}},
+		{"POST", "/v1/apps/my-app/machines", &machinesapi.Access{Action: resset.ActionCreate, AppName: ptr("my-app")}},
+		{"GET", "/v1/apps/my-app/machines/abc123", &machinesapi.Access{Action: resset.ActionRead, AppName: ptr("my-app"), MachineID: ptr("abc123")}},
+		{"POST", "/v1/apps/my-app/machines/abc123", &machinesapi.Access{Action: resset.ActionWrite, AppName: ptr("my-app"), MachineID: ptr("abc123")}},
+		{"DELETE", "/v1/apps/my-app/machines/abc123", &machinesapi.Access{Action: resset.ActionDelete, AppName: ptr("my-app"), MachineID: ptr("abc123")}},
+		{"POST", "/v1/apps/my-app/machines/abc123/stop", &machinesapi.Access{Action: resset.ActionControl, AppName: ptr("my-app"), MachineID: ptr("abc123")}},
+		{"GET", "/v1/apps/my-app/machines/abc123/metadata", &machinesapi.Access{Action: resset.ActionRead, AppName: ptr("my-app"), MachineID: ptr("abc123"), MachineFeature: ptr("metadata")}},
+		{"PUT", "/v1/apps/my-app/volumes/vol_123", &machinesapi.Access{Action: resset.ActionWrite, AppName: ptr("my-app"), VolumeID: ptr("vol_123")}},
+		{"GET", "/v1/orgs/my-org/wg", &machinesapi.Access{Action: resset.ActionRead, OrgSlug: ptr("my-org"), OrgFeature: ptr("wg")}},
+		{"GET", "/v1/apps/my%2Fapp", &machinesapi.Access{Action: resset.ActionRead, AppName: ptr("my/app")}},
+
+		// unmapped
+		{"GET", "/v1/apps/my-app/secrets/foo/bar", nil},
+		{"PATCH", "/v1/apps/my-app/machines/abc123", nil},
+		{"POST", "/v1/apps/my-app/machines/abc123/start", nil},
+		{"GET", "/v1/apps/my-app/", nil},
+		{"GET", "/v1/apps//machines", nil},
+		{"GET", "/", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.path, func(t *testing.T) {
+			access, err := m.Access(httptest.NewRequest(tt.method, tt.path, nil))
+			if tt.expect == nil {
+				assert.IsError(t, err, ErrUnmappedRoute)
+				assert.IsError(t, err, macaroon.ErrUnauthorized)
+				assert.Zero(t, access)
+				return
+			}
+
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expect, access)
+		})
+	}
+}
+
+func TestNewMapper(t *testing.T) {
+	tests := []struct {
+		rule   Rule
+		expect string
+	}{
+		{Rule{"POST", "/v1/apps/{app_name}", resset.ActionNone, AppResource}, "action required for method POST"},
+		{Rule{"GET", "/v1/apps/{app_name}/{foo}", resset.ActionNone, AppResource}, "unknown variable {foo}"},
+		{Rule{"GET", "/v1/apps/{app_name}/{app_name}", resset.ActionNone, AppResource}, "duplicate variable {app_name}"},
+		{Rule{"GET", "/v1/apps/{app_name}", resset.ActionNone, MachineResource}, "missing variable {machine_id}"},
+		{Rule{"GET", "/v1/apps/{app_name}", resset.ActionNone, Resource(0)}, "unknown resource 0"},
+	}
+
+	for _, tt := range tests {
+		_, err := NewMapper(tt.rule)
+		assert.EqualError(t, err, "bad rule "+tt.rule.Method+" "+tt.rule.Pattern+": "+tt.expect)
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	m, err := NewMapper(rules...)
+	assert.NoError(t, err)
+
+	var (
+		fa        = &flyio.Access{Action: resset.ActionRead, OrgID: ptr(uint64(1)), AppID: ptr(uint64(2))}
+		gotAccess *machinesapi.Access
+		gotFA     *flyio.Access
+	)
+
+	authz := authorizerFunc(func(ctx context.Context, header string, access *machinesapi.Access) (*flyio.Access, error) {
+		gotAccess = access
+		if header != "good" {
+			return nil, errors.New("bad token")
+		}
+		return fa, nil
+	})
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotFA = AccessFromContext(r.Context())
+	})
+
+	do := func(method, path, hdr string) int {
+		gotAccess, gotFA = nil, nil
+
+		r := httptest.NewRequest(method, path, nil)
+		if hdr != "" {
+			r.Header.Set("Authorization", hdr)
+		}
+
+		w := httptest.NewRecorder()
+		Authorize(m, authz)(next).ServeHTTP(w, r)
+
+		return w.Code
+	}
+
+	assert.Equal(t, http.StatusOK, do("GET", "/v1/apps/my-app/machines/abc123", "good"))
+	assert.Equal(t, &machinesapi.Access{Action: resset.ActionRead, AppName: ptr("my-app"), MachineID: ptr("abc123")}, gotAccess)
+	assert.Equal(t, fa, gotFA)
+
+	assert.Equal(t, http.StatusForbidden, do("GET", "/v1/apps/my-app/machines/abc123", "bad"))
+	assert.NotZero(t, gotAccess)
+	assert.Zero(t, gotFA)
+
+	assert.Equal(t, http.StatusUnauthorized, do("GET", "/v1/apps/my-app/machines/abc123", ""))
+	assert.Zero(t, gotAccess)
+
+	// unmapped routes are denied without checking the token
+	assert.Equal(t, http.StatusForbidden, do("GET", "/v1/apps/my-app/secrets", "good"))
+	assert.Zero(t, gotAccess)
+	assert.Zero(t, gotFA)
+}
+
+type authorizerFunc func(context.Context, string, *machinesapi.Access) (*flyio.Access, error)
+
+func (f authorizerFunc) Authorize(ctx context.Context, header string, access *machinesapi.Access) (*flyio.Access, error) {
+	return f(ctx, header, access)
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
@@ -0,0 +1,89 @@
+package httpaccess
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"github.com/superfly/macaroon/flyio"
+	"github.com/superfly/macaroon/flyio/machinesapi"
+	"github.com/superfly/macaroon/httpmw"
+)
+
+// Authorizer checks whether the tokens in an Authorization header are
+// authorized for an Access. It is implemented by *machinesapi.Client.
+type Authorizer interface {
+	Authorize(ctx context.Context, header string, access *machinesapi.Access) (*flyio.Access, error)
+}
+
+var _ Authorizer = (*machinesapi.Client)(nil)
+
+// Option configures the Authorize middleware.
+type Option func(*config)
+
+// WithErrorResponder specifies a function for writing error responses. By
+// default, a JSON body of the form {"error": "..."} is written.
+func WithErrorResponder(er httpmw.ErrorResponder) Option {
+	return func(c *config) {
+		c.respondError = er
+	}
+}
+
+type config struct {
+	respondError httpmw.ErrorResponder
+}
+
+// Authorize returns middleware that maps each request to a machinesapi.Access
+// with m and authorizes the request's Authorization header for it with a.
+// Requests without an Authorization header are failed with a 401 and requests
+// that don't match a route or aren't authorized are failed with a 403. The
+// authorized flyio.Access is made available to the next handler via
+// AccessFromContext.
+func Authorize(m *Mapper, a Authorizer, opts ...Option) func(http.Handler) http.Handler {
+	c := &config{respondError: defaultErrorResponder}
+
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			access, err := m.Access(r)
+			if err != nil {
+				c.respondError(w, r, http.StatusForbidden, err)
+				return
+			}
+
+			hdr := r.Header.Get("Authorization")
+			if hdr == "" {
+				c.respondError(w, r, http.StatusUnauthorized, httpmw.ErrMissingToken)
+				return
+			}
+
+			fa, err := a.Authorize(r.Context(), hdr, access)
+			if err != nil {
+				c.respondError(w, r, http.StatusForbidden, err)
+				return
+			}
+
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), contextKeyAccess, fa)))
+		})
+	}
+}
+
+// AccessFromContext returns the flyio.Access authorized by the Authorize
+// middleware.
+func AccessFromContext(ctx context.Context) *flyio.Access {
+	fa, _ := ctx.Value(contextKeyAccess).(*flyio.Access)
+	return fa
+}
+
+type contextKey string
+
+const contextKeyAccess = contextKey("access")
+
+func defaultErrorResponder(w http.ResponseWriter, r *http.Request, statusCode int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(map[string]string{"error": http.StatusText(statusCode)})
+}
@@ -0,0 +1,268 @@
+package flyio
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/superfly/macaroon"
+	"github.com/superfly/macaroon/bundle"
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
+)
+
+// IntrospectionVersion is the version of the Introspection document. It is
+// incremented when fields are removed or their meaning changes. Fields may be
+// added without changing the version.
+const IntrospectionVersion = 1
+
+// Introspection describes the permission tokens in a Bundle, e.g. for display
+// in a dashboard. It is intended to be JSON-encoded. It isn't suitable for
+// making authorization decisions. See Introspect.
+type Introspection struct {
+	Version int                   `json:"version"`
+	Tokens  []*TokenIntrospection `json:"tokens"`
+}
+
+// TokenIntrospection describes a single permission token. Fields that can't
+// be derived from the token are null.
+type TokenIntrospection struct {
+	// UUID is the UUID of the token's nonce.
+	UUID string `json:"uuid"`
+
+	// Location is the token's location.
+	Location string `json:"location"`
+
+	// Verified is whether the token was verified. Other fields of unverified
+	// tokens are derived from their unverified caveats and those of their
+	// discharges, so attestations in particular can't be trusted.
+	Verified bool `json:"verified"`
+
+	// Error is why the token failed verification, if it did.
+	Error string `json:"error,omitempty"`
+
+	// Kind is a rough classification of the token. See TokenKind.
+	Kind TokenKind `json:"kind"`
+
+	// OrgID is the organization the token is scoped to. See
+	// OrganizationScope.
+	OrgID *uint64 `json:"org_id"`
+
+	// AppIDs are the apps the token is scoped to, or null if it isn't scoped
+	// to specific apps. See AppScope.
+	AppIDs []uint64 `json:"app_ids"`
+
+	// Clusters are the clusters the token is scoped to, or null if it isn't
+	// scoped to specific clusters. See ClusterScope.
+	Clusters []string `json:"clusters"`
+
+	// Expiry is when the token or its discharges expire, or null if they
+	// don't.
+	Expiry *time.Time `json:"expiry"`
+
+	// ThirdParties are the token's third-party caveats, sorted by location.
+	ThirdParties []*ThirdPartyIntrospection `json:"third_parties"`
+
+	// Attestations are the attestations (e.g. user identities) from the
+	// token's discharges.
+	Attestations []*CaveatIntrospection `json:"attestations"`
+
+	// Caveats are the token's other caveats, including those added by its
+	// discharges, in order.
+	Caveats []*CaveatIntrospection `json:"caveats"`
+}
+
+// ThirdPartyIntrospection describes a third-party caveat.
+type ThirdPartyIntrospection struct {
+	Location   string `json:"location"`
+	Discharged bool   `json:"discharged"`
+}
+
+// CaveatIntrospection describes a single caveat.
+type CaveatIntrospection struct {
+	Type        string          `json:"type"`
+	Description string          `json:"description"`
+	Body        json.RawMessage `json:"body"`
+}
+
+// TokenKind is a rough classification of a permission token, based on its
+// caveats.
+type TokenKind string
+
+const (
+	// KindUnknown tokens aren't scoped to an organization.
+	KindUnknown TokenKind = "unknown"
+
+	// KindMachineExec tokens are restricted to running commands on
+	// machines.
+	KindMachineExec TokenKind = "machine-exec"
+
+	// KindReadOnly tokens are restricted to reads with the ReadOnly caveat.
+	KindReadOnly TokenKind = "read-only"
+
+	// KindDeploy tokens are scoped to specific apps.
+	KindDeploy TokenKind = "deploy"
+
+	// KindOrg tokens are scoped to an organization, but not to specific
+	// apps.
+	KindOrg TokenKind = "org"
+)
+
+// Introspect describes the permission tokens in b, which may or may not have
+// been verified. See Introspection.
+func Introspect(b *bundle.Bundle) (*Introspection, error) {
+	var (
+		ret          = &Introspection{Version: IntrospectionVersion, Tokens: []*TokenIntrospection{}}
+		undischarged = map[string]bool{}
+		discharges   = map[string][]bundle.Macaroon{}
+		perms        []bundle.Macaroon
+		errs         = map[bundle.Macaroon]error{}
+	)
+
+	for _, tickets := range b.UndischargedThirdPartyTickets() {
+		for _, ticket := range tickets {
+			undischarged[string(ticket)] = true
+		}
+	}
+
+	bundle.ForEach(b, func(t bundle.Token) {
+		m, ok := t.(bundle.Macaroon)
+		switch {
+		case !ok:
+			return
+		case b.IsPermissionToken(t):
+			perms = append(perms, m)
+		default:
+			kid := string(m.Nonce().KID)
+			discharges[kid] = append(discharges[kid], m)
+		}
+
+		if fm, ok := t.(*bundle.FailedMacaroon); ok {
+			errs[m] = fm.Err
+		}
+	})
+
+	for _, m := range perms {
+		ti := &TokenIntrospection{
+			UUID:         m.Nonce().UUID().String(),
+			Location:     m.Location(),
+			ThirdParties: []*ThirdPartyIntrospection{},
+			Attestations: []*CaveatIntrospection{},
+			Caveats:      []*CaveatIntrospection{},
+		}
+
+		if err := errs[m]; err != nil {
+			ti.Error = err.Error()
+		}
+
+		tickets := m.ThirdPartyTickets()
+		locs := maps.Keys(tickets)
+		slices.Sort(locs)
+
+		for _, loc := range locs {
+			for _, ticket := range tickets[loc] {
+				ti.ThirdParties = append(ti.ThirdParties, &ThirdPartyIntrospection{
+					Location:   loc,
+					Discharged: !undischarged[string(ticket)],
+				})
+			}
+		}
+
+		var cs *macaroon.CaveatSet
+		if vm, ok := m.(*bundle.VerifiedMacaroon); ok {
+			ti.Verified = true
+			cs = vm.Caveats
+		} else {
+			cs = unverifiedCaveats(m, locs, discharges)
+		}
+
+		for _, cav := range cs.Caveats {
+			ci, err := introspectCaveat(cav)
+			if err != nil {
+				return nil, err
+			}
+
+			if macaroon.IsAttestation(cav) {
+				ti.Attestations = append(ti.Attestations, ci)
+			} else {
+				ti.Caveats = append(ti.Caveats, ci)
+			}
+		}
+
+		if orgID, err := OrganizationScope(cs); err == nil {
+			ti.OrgID = &orgID
+		}
+		ti.AppIDs = AppScope(cs)
+		ti.Clusters = ClusterScope(cs)
+		ti.Kind = tokenKind(cs)
+
+		if vws := macaroon.GetCaveats[*macaroon.ValidityWindow](cs); len(vws) != 0 {
+			expiry := time.Unix(vws[0].NotAfter, 0).UTC()
+			for _, vw := range vws[1:] {
+				if na := time.Unix(vw.NotAfter, 0).UTC(); na.Before(expiry) {
+					expiry = na
+				}
+			}
+			ti.Expiry = &expiry
+		}
+
+		ret.Tokens = append(ret.Tokens, ti)
+	}
+
+	return ret, nil
+}
+
+// unverifiedCaveats approximates the caveats that verifying m would return,
+// from the unverified caveats of m and its discharges, in location order.
+func unverifiedCaveats(m bundle.Macaroon, locs []string, discharges map[string][]bundle.Macaroon) *macaroon.CaveatSet {
+	ret := macaroon.NewCaveatSet()
+
+	add := func(cs *macaroon.CaveatSet) {
+		for _, cav := range cs.Caveats {
+			switch cav.(type) {
+			case *macaroon.Caveat3P, *macaroon.BindToParentToken:
+			default:
+				ret.Caveats = append(ret.Caveats, cav)
+			}
+		}
+	}
+
+	add(m.UnsafeCaveats())
+
+	for _, loc := range locs {
+		for _, ticket := range m.TicketsForThirdParty(loc) {
+			if ds := discharges[string(ticket)]; len(ds) != 0 {
+				add(ds[0].UnsafeCaveats())
+			}
+		}
+	}
+
+	return ret
+}
+
+func introspectCaveat(cav macaroon.Caveat) (*CaveatIntrospection, error) {
+	body, err := json.Marshal(cav)
+	if err != nil {
+		return nil, err
+	}
+
+	return &CaveatIntrospection{
+		Type:        cav.Name(),
+		Description: macaroon.DescribeCaveat(cav),
+		Body:        body,
+	}, nil
+}
+
+func tokenKind(cs *macaroon.CaveatSet) TokenKind {
+	switch {
+	case len(macaroon.GetCaveats[*Organization](cs)) == 0:
+		return KindUnknown
+	case len(macaroon.GetCaveats[*Commands](cs)) != 0:
+		return KindMachineExec
+	case len(macaroon.GetCaveats[*ReadOnly](cs)) != 0:
+		return KindReadOnly
+	case AppScope(cs) != nil:
+		return KindDeploy
+	default:
+		return KindOrg
+	}
+}
@@ -0,0 +1,245 @@
+package flyio
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/alecthomas/assert/v2"
+	"github.com/superfly/macaroon"
+	"github.com/superfly/macaroon/auth"
+	"github.com/superfly/macaroon/bundle"
+	"github.com/superfly/macaroon/resset"
+)
+
+func TestIntrospect(t *testing.T) {
+	var (
+		kid      = []byte("kid")
+		key      = macaroon.NewSigningKey()
+		authKey  = macaroon.NewEncryptionKey()
+		otherKey = macaroon.NewEncryptionKey()
+		otherLoc = "https://other-tp"
+	)
+
+	m, err := macaroon.New(kid, LocationPermission, key)
+	assert.NoError(t, err)
+	assert.NoError(t, m.Add(
+		&Organization{ID: 123, Mask: resset.ActionAll},
+		&Apps{Apps: resset.ResourceSet[uint64, resset.Action]{456: resset.ActionAll}},
+		&macaroon.ValidityWindow{NotBefore: 1700000000, NotAfter: 2000000000},
+	))
+	assert.NoError(t, m.Add3P(authKey, LocationAuthentication))
+	assert.NoError(t, m.Add3P(otherKey, otherLoc))
+
+	perm, err := m.Encode()
+	assert.NoError(t, err)
+
+	discharge := func(t *testing.T, ka macaroon.EncryptionKey, loc string, cavs ...macaroon.Caveat) []byte {
+		t.Helper()
+
+		ticket, err := m.ThirdPartyTicket(loc)
+		assert.NoError(t, err)
+
+		_, dm, err := macaroon.DischargeTicket(ka, loc, ticket)
+		assert.NoError(t, err)
+		assert.NoError(t, dm.Add(cavs...))
+
+		tok, err := dm.Encode()
+		assert.NoError(t, err)
+
+		return tok
+	}
+
+	authDischarge := discharge(t, authKey, LocationAuthentication,
+		ptr(auth.FlyioUserID(789)),
+		&macaroon.ValidityWindow{NotBefore: 1700000000, NotAfter: 1800000000},
+	)
+
+	introspect := func(t *testing.T, b *bundle.Bundle) string {
+		t.Helper()
+
+		in, err := Introspect(b)
+		assert.NoError(t, err)
+
+		// nonces are random
+		for _, ti := range in.Tokens {
+			assert.NotZero(t, ti.UUID)
+			ti.UUID = ""
+		}
+
+		buf, err := json.MarshalIndent(in, "", "  ")
+		assert.NoError(t, err)
+
+		return string(buf)
+	}
+
+	trusted := map[string][]macaroon.EncryptionKey{LocationAuthentication: {authKey}}
+
+	t.Run("parsed", func(t *testing.T) {
+		b, err := ParseBundle(macaroon.ToAuthorizationHeader(perm, authDischarge))
+		assert.NoError(t, err)
+
+		assert.Equal(t, `{
+  "version": 1,
+  "tokens": [
+    {
+      "uuid": "",
+      "location": "https://api.fly.io/v1",
+      "verified": false,
+      "kind": "deploy",
+      "org_id": 123,
+      "app_ids": [
+        456
+      ],
+      "clusters": null,
+      "expiry": "2027-01-15T08:00:00Z",
+      "third_parties": [
+        {
+          "location": "https://api.fly.io/aaa/v1",
+          "discharged": true
+        },
+        {
+          "location": "https://other-tp",
+          "discharged": false
+        }
+      ],
+      "attestations": [
+        {
+          "type": "FlyioUserID",
+          "description": "Attests Fly.io user 789",
+          "body": 789
+        }
+      ],
+      "caveats": [
+        {
+          "type": "Organization",
+          "description": "Restricts access to organization 123 (all)",
+          "body": {
+            "id": 123,
+            "mask": "rwcdC"
+          }
+        },
+        {
+          "type": "Apps",
+          "description": "Restricts access to apps 456 (all)",
+          "body": {
+            "apps": {
+              "456": "rwcdC"
+            }
+          }
+        },
+        {
+          "type": "ValidityWindow",
+          "description": "Valid from 2023-11-14T22:13:20Z until 2033-05-18T03:33:20Z",
+          "body": {
+            "not_before": 1700000000,
+            "not_after": 2000000000
+          }
+        },
+        {
+          "type": "ValidityWindow",
+          "description": "Valid from 2023-11-14T22:13:20Z until 2027-01-15T08:00:00Z",
+          "body": {
+            "not_before": 1700000000,
+            "not_after": 1800000000
+          }
+        }
+      ]
+    }
+  ]
+}`, introspect(t, b))
+	})
+
+	t.Run("verification failed", func(t *testing.T) {
+		b, err := ParseBundle(macaroon.ToAuthorizationHeader(perm, authDischarge))
+		assert.NoError(t, err)
+
+		_, err = b.Verify(context.Background(), bundle.WithKey(kid, key, trusted))
+		assert.Error(t, err)
+
+		in, err := Introspect(b)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, len(in.Tokens))
+		assert.False(t, in.Tokens[0].Verified)
+		assert.Contains(t, in.Tokens[0].Error, macaroon.ErrMissingDischarge.Error())
+		assert.Equal(t, KindDeploy, in.Tokens[0].Kind)
+	})
+
+	t.Run("verified", func(t *testing.T) {
+		b, err := ParseBundle(macaroon.ToAuthorizationHeader(perm, authDischarge, discharge(t, otherKey, otherLoc)))
+		assert.NoError(t, err)
+
+		_, err = b.Verify(context.Background(), bundle.WithKey(kid, key, trusted))
+		assert.NoError(t, err)
+
+		assert.Equal(t, `{
+  "version": 1,
+  "tokens": [
+    {
+      "uuid": "",
+      "location": "https://api.fly.io/v1",
+      "verified": true,
+      "kind": "deploy",
+      "org_id": 123,
+      "app_ids": [
+        456
+      ],
+      "clusters": null,
+      "expiry": "2027-01-15T08:00:00Z",
+      "third_parties": [
+        {
+          "location": "https://api.fly.io/aaa/v1",
+          "discharged": true
+        },
+        {
+          "location": "https://other-tp",
+          "discharged": true
+        }
+      ],
+      "attestations": [
+        {
+          "type": "FlyioUserID",
+          "description": "Attests Fly.io user 789",
+          "body": 789
+        }
+      ],
+      "caveats": [
+        {
+          "type": "Organization",
+          "description": "Restricts access to organization 123 (all)",
+          "body": {
+            "id": 123,
+            "mask": "rwcdC"
+          }
+        },
+        {
+          "type": "Apps",
+          "description": "Restricts access to apps 456 (all)",
+          "body": {
+            "apps": {
+              "456": "rwcdC"
+            }
+          }
+        },
+        {
+          "type": "ValidityWindow",
+          "description": "Valid from 2023-11-14T22:13:20Z until 2033-05-18T03:33:20Z",
+          "body": {
+            "not_before": 1700000000,
+            "not_after": 2000000000
+          }
+        },
+        {
+          "type": "ValidityWindow",
+          "description": "Valid from 2023-11-14T22:13:20Z until 2027-01-15T08:00:00Z",
+          "body": {
+            "not_before": 1700000000,
+            "not_after": 1800000000
+          }
+        }
+      ]
+    }
+  ]
+}`, introspect(t, b))
+	})
+}
@@ -0,0 +1,80 @@
+package machinesapi
+
+import (
+	"crypto/sha256"
+	"sync"
+
+	lru "github.com/hashicorp/golang-lru/v2"
+	"github.com/superfly/macaroon/bundle"
+)
+
+// TokenAnnotations is context about a verified permission token that the
+// Machines API resolved while verifying it. It is intended for request
+// logging. Older versions of the API don't provide it.
+type TokenAnnotations struct {
+	// OrgSlug is the slug of the organization the token is scoped to.
+	OrgSlug string `json:"org_slug,omitempty"`
+
+	// AppNames are the names of the apps the token is scoped to, if any.
+	AppNames []string `json:"app_names,omitempty"`
+
+	// TokenKind is the kind of token (e.g. "deploy").
+	TokenKind string `json:"token_kind,omitempty"`
+}
+
+func (ta *TokenAnnotations) isEmpty() bool {
+	return ta.OrgSlug == "" && len(ta.AppNames) == 0 && ta.TokenKind == ""
+}
+
+// annotationsCacheSize is the number of permission tokens whose annotations
+// are remembered after verification.
+const annotationsCacheSize = 4096
+
+// annotationCache maps permission tokens to the annotations received when they
+// were last verified by the Machines API. Tokens are credentials, so they're
+// keyed by digest rather than kept around. The zero value is ready to use.
+type annotationCache struct {
+	once  sync.Once
+	cache *lru.Cache[[sha256.Size]byte, *TokenAnnotations]
+}
+
+func (ac *annotationCache) entries() *lru.Cache[[sha256.Size]byte, *TokenAnnotations] {
+	ac.once.Do(func() {
+		ac.cache, _ = lru.New[[sha256.Size]byte, *TokenAnnotations](annotationsCacheSize)
+	})
+
+	return ac.cache
+}
+
+func annotationKey(m bundle.Macaroon) [sha256.Size]byte {
+	return sha256.Sum256([]byte(m.String()))
+}
+
+// AnnotationsFor returns the annotations the Machines API provided when m was
+// verified by this Client. It returns nil if m isn't a verified permission
+// token in bun, if m was verified by some other Verifier, or if the Machines
+// API didn't provide annotations. Annotations for only the most recently
+// verified tokens are remembered, so call this soon after verification.
+func (c *Client) AnnotationsFor(bun *bundle.Bundle, m bundle.Macaroon) *TokenAnnotations {
+	var found bool
+	bundle.ForEach(bun, func(vm *bundle.VerifiedMacaroon) {
+		found = found || vm.String() == m.String()
+	})
+
+	if !found {
+		return nil
+	}
+
+	ta, _ := c.annotations.entries().Get(annotationKey(m))
+	return ta
+}
+
+func (ac *annotationCache) record(perm bundle.Macaroon, resp *verifyResult) {
+	if resp.TokenAnnotations.isEmpty() {
+		ac.entries().Remove(annotationKey(perm))
+		return
+	}
+
+	ta := resp.TokenAnnotations
+	ac.entries().Add(annotationKey(perm), &ta)
+}
@@ -0,0 +1,93 @@
+package machinesapi
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/alecthomas/assert/v2"
+	"github.com/superfly/macaroon"
+	"github.com/superfly/macaroon/bundle"
+	"github.com/superfly/macaroon/flyio"
+	"github.com/superfly/macaroon/resset"
+)
+
+func TestAnnotationsFor(t *testing.T) {
+	var (
+		ctx = context.Background()
+		key = macaroon.NewSigningKey()
+
+		// the server includes annotations in responses if set
+		ta *TokenAnnotations
+	)
+
+	m, err := macaroon.New([]byte("kid"), flyio.LocationPermission, key)
+	assert.NoError(t, err)
+	assert.NoError(t, m.Add(&flyio.Organization{ID: 123, Mask: resset.ActionAll}))
+	tok, err := m.Encode()
+	assert.NoError(t, err)
+	hdr := macaroon.ToAuthorizationHeader(tok)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, authenticatePath, r.URL.Path)
+
+		res := map[string]any{
+			"caveats":          &m.UnsafeCaveats,
+			"permission_token": tok,
+		}
+
+		if ta != nil {
+			res["org_slug"] = ta.OrgSlug
+			res["app_names"] = ta.AppNames
+			res["token_kind"] = ta.TokenKind
+		}
+
+		json.NewEncoder(w).Encode([]any{res})
+	}))
+	t.Cleanup(srv.Close)
+
+	baseURL, err := url.Parse(srv.URL)
+	assert.NoError(t, err)
+	client := &Client{HTTP: http.DefaultTransport, BaseURL: baseURL}
+
+	verify := func(t *testing.T) (*bundle.Bundle, bundle.Macaroon) {
+		t.Helper()
+
+		bun, err := flyio.ParseBundle(hdr)
+		assert.NoError(t, err)
+
+		cavs, err := bun.Verify(ctx, client)
+		assert.NoError(t, err)
+		assert.Equal(t, []*macaroon.CaveatSet{&m.UnsafeCaveats}, cavs)
+
+		perms := bundle.Map(bun, func(vm *bundle.VerifiedMacaroon) bundle.Macaroon { return vm })
+		assert.Equal(t, 1, len(perms))
+
+		return bun, perms[0]
+	}
+
+	t.Run("with annotations", func(t *testing.T) {
+		ta = &TokenAnnotations{OrgSlug: "my-org", AppNames: []string{"my-app"}, TokenKind: "deploy"}
+
+		bun, perm := verify(t)
+		assert.Equal(t, ta, client.AnnotationsFor(bun, perm))
+
+		// annotations are per-client
+		assert.Zero(t, (&Client{HTTP: http.DefaultTransport, BaseURL: baseURL}).AnnotationsFor(bun, perm))
+
+		// unverified tokens have no annotations
+		unverified, err := flyio.ParseBundle(hdr)
+		assert.NoError(t, err)
+		assert.Zero(t, client.AnnotationsFor(unverified, perm))
+	})
+
+	t.Run("without annotations", func(t *testing.T) {
+		ta = nil
+
+		bun, perm := verify(t)
+		assert.Zero(t, client.AnnotationsFor(bun, perm))
+	})
+}
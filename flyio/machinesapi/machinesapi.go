@@ -7,6 +7,7 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"net/netip"
 	"net/url"
 	"os"
 	"sync"
@@ -31,19 +32,47 @@ var (
 const (
 	authenticatePath = "/v1/tokens/authenticate"
 	authorizePath    = "/v1/tokens/authorize"
+
+	// DefaultVerifyChunkSize is the maximum number of permission tokens
+	// Client.Verify sends to the Machines API in a single request, unless
+	// Client.VerifyChunkSize is set.
+	DefaultVerifyChunkSize = 16
 )
 
 // Client is a client for the Machines API tokens API. It implements
 // bundle.Verifier for token verification. It also allows for authorization
 // checking by external clients.
 type Client struct {
-	HTTP            http.RoundTripper
-	BaseURL         *url.URL
+	HTTP    http.RoundTripper
+	BaseURL *url.URL
+
+	// VerifyChunkSize is the maximum number of permission tokens to verify
+	// per request. Larger bundles are verified over multiple requests.
+	// Defaults to DefaultVerifyChunkSize.
+	VerifyChunkSize int
+
 	setDefaultsOnce sync.Once
+	annotations     annotationCache
 }
 
-// Verify implements bundle.Verifier using the Fly.io Machines API.
+// Verify implements bundle.Verifier using the Fly.io Machines API. Bundles with
+// many permission tokens are verified in chunks. See VerifyChunkSize.
 func (v *Client) Verify(ctx context.Context, dissByPerm map[bundle.Macaroon][]bundle.Macaroon) map[bundle.Macaroon]bundle.VerificationResult {
+	chunkSize := v.VerifyChunkSize
+	if chunkSize <= 0 {
+		chunkSize = DefaultVerifyChunkSize
+	}
+
+	return bundle.ChunkedVerifier(verifierFunc(v.verifyChunk), chunkSize).Verify(ctx, dissByPerm)
+}
+
+type verifierFunc func(context.Context, map[bundle.Macaroon][]bundle.Macaroon) map[bundle.Macaroon]bundle.VerificationResult
+
+func (vf verifierFunc) Verify(ctx context.Context, dissByPerm map[bundle.Macaroon][]bundle.Macaroon) map[bundle.Macaroon]bundle.VerificationResult {
+	return vf(ctx, dissByPerm)
+}
+
+func (v *Client) verifyChunk(ctx context.Context, dissByPerm map[bundle.Macaroon][]bundle.Macaroon) map[bundle.Macaroon]bundle.VerificationResult {
 	allMacs := make([]bundle.Macaroon, 0, len(dissByPerm)*2)
 	for perm, diss := range dissByPerm {
 		allMacs = append(allMacs, perm)
@@ -66,7 +95,7 @@ func (v *Client) Verify(ctx context.Context, dissByPerm map[bundle.Macaroon][]bu
 		return ret
 	}
 
-	ret := resultsVerifier(respBody).Verify(ctx, dissByPerm)
+	ret := resultsVerifier{respBody, &v.annotations}.Verify(ctx, dissByPerm)
 
 	// resultsVerifier deletes successfully verified tokens from dissByPerm, so
 	// the remaining ones are failed.
@@ -166,6 +195,13 @@ type Access struct {
 	// SourceMachine is the machine ID of the actor attempting access.
 	SourceMachine *string `json:"source_machine,omitempty"`
 
+	// SourceIP is the IP address the request originated from.
+	SourceIP *netip.Addr `json:"source_ip,omitempty"`
+
+	// Audience is the audience of the OIDC token being requested. It must be
+	// set if and only if MachineFeature is "oidc".
+	Audience *string `json:"audience,omitempty"`
+
 	// Command is the command being executed on a machine. If this is specified,
 	// the Machine must be set.
 	Command []string `json:"command,omitempty"`
@@ -173,6 +209,11 @@ type Access struct {
 	// StorageObject is the storage object being accessed. If this is specified,
 	// the OrgSlug must be set.
 	StorageObject *resset.Prefix `json:"storage_object,omitempty"`
+
+	// ProjectedSpendCents is the organization's projected spend, in cents, if
+	// the access is allowed. It should be set for create and control actions
+	// on billable resources and is checked by the flyio.MaxSpendCents caveat.
+	ProjectedSpendCents *uint64 `json:"projected_spend_cents,omitempty"`
 }
 
 // Authorize checks if the tokens in the provided header are authorized for the
@@ -186,23 +227,106 @@ func (c *Client) Authorize(ctx context.Context, header string, access *Access) (
 	return c.AuthorizeBundle(ctx, bun, access)
 }
 
+// AuthorizeOption configures Client.AuthorizeBundle.
+type AuthorizeOption func(*authorizeOpts)
+
+type authorizeOpts struct {
+	resolver *Resolver
+	kr       bundle.KeyResolver
+}
+
+// WithResolver records the mappings learned from successful authorizations
+// in the Resolver.
+func WithResolver(r *Resolver) AuthorizeOption {
+	return func(o *authorizeOpts) {
+		o.resolver = r
+	}
+}
+
+// WithOfflineAuthorization records the mappings learned from successful
+// authorizations in the Resolver. If the Machines API can't be reached or
+// returns a server error, the Access is resolved from the Resolver's cache and
+// the bundle is verified with kr and validated locally instead.
+func WithOfflineAuthorization(r *Resolver, kr bundle.KeyResolver) AuthorizeOption {
+	return func(o *authorizeOpts) {
+		o.resolver = r
+		o.kr = kr
+	}
+}
+
 // AuthorizeBundle is the same as Authorize, but works on an already parsed Bundle of tokens.
-func (c *Client) AuthorizeBundle(ctx context.Context, bun *bundle.Bundle, access *Access) (*flyio.Access, error) {
+func (c *Client) AuthorizeBundle(ctx context.Context, bun *bundle.Bundle, access *Access, opts ...AuthorizeOption) (*flyio.Access, error) {
+	var o authorizeOpts
+	for _, opt := range opts {
+		opt(&o)
+	}
+
 	reqBody := authorizeRequest{Header: bun.String(), Access: access}
 	respBody := authorizeResponse{}
 
 	if err := c.post(ctx, authorizePath, &reqBody, &respBody); err != nil {
-		return nil, err
+		if o.kr == nil || !isUnavailable(ctx, err) {
+			return nil, err
+		}
+
+		fa, offlineErr := authorizeOffline(ctx, bun, access, o.resolver, o.kr)
+		if offlineErr != nil {
+			return nil, errors.Join(err, fmt.Errorf("offline authorization: %w", offlineErr))
+		}
+
+		return fa, nil
 	}
 
 	// mark the authorized token as verified too
-	if _, err := bun.Verify(ctx, resultsVerifier{respBody.VerifiedToken}); err != nil {
+	if _, err := bun.Verify(ctx, resultsVerifier{[]*verifyResult{respBody.VerifiedToken}, &c.annotations}); err != nil {
 		return nil, err
 	}
 
+	if o.resolver != nil {
+		o.resolver.record(access, respBody.Access)
+	}
+
 	return respBody.Access, nil
 }
 
+func authorizeOffline(ctx context.Context, bun *bundle.Bundle, access *Access, r *Resolver, kr bundle.KeyResolver) (*flyio.Access, error) {
+	fa, err := r.ResolveAccess(ctx, access)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := bun.Verify(ctx, kr); err != nil {
+		return nil, err
+	}
+
+	if err := bun.Validate(fa); err != nil {
+		return nil, err
+	}
+
+	return fa, nil
+}
+
+// errSend wraps errors sending requests to the Machines API, such as network
+// errors.
+var errSend = errors.New("failed to send request")
+
+// isUnavailable returns whether err indicates that the Machines API couldn't
+// answer, as opposed to rejecting the request. Only network errors and server
+// errors count. Malformed responses don't, and neither do requests abandoned
+// because ctx is done.
+func isUnavailable(ctx context.Context, err error) bool {
+	var se *ServerError
+
+	switch {
+	case ctx.Err() != nil, errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return false
+	case errors.As(err, &se):
+		return se.StatusCode >= http.StatusInternalServerError
+	default:
+		return errors.Is(err, errSend)
+	}
+}
+
 type authorizeRequest struct {
 	Header string  `json:"header"`
 	Access *Access `json:"access"`
@@ -220,6 +344,9 @@ type verifyRequest struct {
 type verifyResult struct {
 	Caveats         *macaroon.CaveatSet `json:"caveats"`
 	PermissionToken []byte              `json:"permission_token"`
+
+	// optional fields provided by newer servers
+	TokenAnnotations
 }
 
 func (c *Client) post(ctx context.Context, path string, req any, resp any) error {
@@ -258,25 +385,26 @@ func (c *Client) post(ctx context.Context, path string, req any, resp any) error
 
 	httpResp, err := c.HTTP.RoundTrip(httpReq)
 	if err != nil {
-		return fmt.Errorf("failed to send request: %w", err)
+		return fmt.Errorf("%w: %w", errSend, err)
 	}
 	defer httpResp.Body.Close()
 
-	serverError := &ServerError{StatusCode: httpResp.StatusCode}
-	target := resp
-
 	if httpResp.StatusCode != http.StatusOK {
-		target = serverError
-	}
+		serverError := &ServerError{StatusCode: httpResp.StatusCode}
 
-	if err := json.NewDecoder(httpResp.Body).Decode(target); err != nil {
-		return fmt.Errorf("failed to decode response: %w", err)
-	}
+		// proxies in front of the Machines API may respond without a JSON
+		// error.
+		if err := json.NewDecoder(httpResp.Body).Decode(serverError); err != nil {
+			serverError.Err = fmt.Sprintf("unexpected status %d", httpResp.StatusCode)
+		}
 
-	if httpResp.StatusCode != http.StatusOK {
 		return serverError
 	}
 
+	if err := json.NewDecoder(httpResp.Body).Decode(resp); err != nil {
+		return fmt.Errorf("failed to decode response: %w", err)
+	}
+
 	return nil
 }
 
@@ -290,7 +418,12 @@ func (e *ServerError) Error() string {
 	return e.Err
 }
 
-type resultsVerifier []*verifyResult
+// resultsVerifier implements bundle.Verifier with results from the Machines
+// API, recording their annotations.
+type resultsVerifier struct {
+	results     []*verifyResult
+	annotations *annotationCache
+}
 
 func (rv resultsVerifier) Verify(ctx context.Context, dissByPerm map[bundle.Macaroon][]bundle.Macaroon) map[bundle.Macaroon]bundle.VerificationResult {
 	ret := make(map[bundle.Macaroon]bundle.VerificationResult, len(dissByPerm))
@@ -316,7 +449,7 @@ func (rv resultsVerifier) Verify(ctx context.Context, dissByPerm map[bundle.Maca
 		permByTok[string(toks[0])] = perm
 	}
 
-	for _, resp := range rv {
+	for _, resp := range rv.results {
 		perm, ok := permByTok[string(resp.PermissionToken)]
 		if !ok {
 			continue
@@ -327,6 +460,8 @@ func (rv resultsVerifier) Verify(ctx context.Context, dissByPerm map[bundle.Maca
 			UnverifiedMacaroon: perm.Unverified(),
 			Caveats:            resp.Caveats,
 		}
+
+		rv.annotations.record(perm, resp)
 	}
 
 	return ret
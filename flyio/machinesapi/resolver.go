@@ -0,0 +1,200 @@
+package machinesapi
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru/v2"
+	"github.com/superfly/macaroon/flyio"
+)
+
+// ErrNotResolved is returned by Resolver.ResolveAccess when the Access can't be
+// resolved from the cache.
+var ErrNotResolved = errors.New("access not resolvable from cache")
+
+// Resolver caches the name to ID mappings learned from Machines API
+// authorization responses (org slug to org ID, app name to app ID and org, and
+// machine ID to app). This allows Accesses to be resolved to flyio.Accesses
+// locally, so that authorization can fall back to local verification while the
+// Machines API is unavailable. See WithOfflineAuthorization.
+type Resolver struct {
+	client   *Client
+	ttl      time.Duration
+	orgs     *lru.Cache[string, *resolverEntry[uint64]]
+	apps     *lru.Cache[string, *resolverEntry[resolvedApp]]
+	machines *lru.Cache[string, *resolverEntry[string]]
+	now      func() time.Time
+}
+
+type resolvedApp struct {
+	id      uint64
+	orgID   uint64
+	orgSlug string
+}
+
+type resolverEntry[T any] struct {
+	val        T
+	expiration time.Time
+}
+
+// NewResolver returns a Resolver wrapping the client. Mappings are cached for
+// ttl. Each type of mapping is cached separately, with up to size entries.
+func NewResolver(client *Client, ttl time.Duration, size int) *Resolver {
+	return &Resolver{
+		client:   client,
+		ttl:      ttl,
+		orgs:     newResolverCache[uint64](size),
+		apps:     newResolverCache[resolvedApp](size),
+		machines: newResolverCache[string](size),
+		now:      time.Now,
+	}
+}
+
+func newResolverCache[T any](size int) *lru.Cache[string, *resolverEntry[T]] {
+	cache, err := lru.New[string, *resolverEntry[T]](size)
+	if err != nil {
+		panic(err)
+	}
+	return cache
+}
+
+// Authorize is the same as Client.Authorize, but records the resolved Access
+// in the cache. It doesn't fall back to the cache when the Machines API is
+// unavailable. Use WithOfflineAuthorization for that.
+func (r *Resolver) Authorize(ctx context.Context, header string, access *Access) (*flyio.Access, error) {
+	bun, err := flyio.ParseBundle(header)
+	if err != nil {
+		return nil, err
+	}
+
+	return r.client.AuthorizeBundle(ctx, bun, access, WithResolver(r))
+}
+
+// ResolveAccess resolves the Access to a flyio.Access using cached mappings.
+// ErrNotResolved is returned if any of the resources in the Access haven't
+// been resolved by a previous authorization or if their mappings have expired.
+// Organizations and apps are identified by both ID and name in the returned
+// Access.
+func (r *Resolver) ResolveAccess(ctx context.Context, access *Access) (*flyio.Access, error) {
+	appName := access.AppName
+	if appName == nil && access.MachineID != nil {
+		name, ok := get(r, r.machines, *access.MachineID)
+		if !ok {
+			return nil, ErrNotResolved
+		}
+		appName = &name
+	}
+
+	var (
+		orgID   uint64
+		orgSlug = access.OrgSlug
+		appID   *uint64
+	)
+
+	switch {
+	case appName != nil:
+		app, ok := get(r, r.apps, *appName)
+		if !ok {
+			return nil, ErrNotResolved
+		}
+
+		// let the Machines API decide about inconsistent accesses
+		if orgSlug != nil && !r.orgMatches(*orgSlug, app) {
+			return nil, ErrNotResolved
+		}
+
+		orgID, appID = app.orgID, &app.id
+		if app.orgSlug != "" {
+			orgSlug = &app.orgSlug
+		}
+	case access.VolumeID != nil:
+		// we don't learn which app volumes belong to
+		return nil, ErrNotResolved
+	case orgSlug != nil:
+		var ok bool
+		if orgID, ok = get(r, r.orgs, *orgSlug); !ok {
+			return nil, ErrNotResolved
+		}
+	default:
+		return nil, ErrNotResolved
+	}
+
+	return &flyio.Access{
+		Action:         access.Action,
+		OrgID:          &orgID,
+		OrgSlug:        orgSlug,
+		AppID:          appID,
+		AppName:        appName,
+		AppFeature:     access.AppFeature,
+		Feature:        access.OrgFeature,
+		Volume:         access.VolumeID,
+		Machine:        access.MachineID,
+		MachineFeature: access.MachineFeature,
+		Mutation:       access.Mutation,
+		SourceMachine:  access.SourceMachine,
+		SourceIP:       access.SourceIP,
+		Audience:       access.Audience,
+		Command:        access.Command,
+		StorageObject:  access.StorageObject,
+
+		ProjectedSpendCents: access.ProjectedSpendCents,
+	}, nil
+}
+
+// orgMatches returns whether the org slug is known to identify app's org. The
+// app may have been recorded without a slug, in which case the slug is
+// resolved to an ID instead.
+func (r *Resolver) orgMatches(slug string, app resolvedApp) bool {
+	if app.orgSlug != "" {
+		return slug == app.orgSlug
+	}
+
+	orgID, ok := get(r, r.orgs, slug)
+	return ok && orgID == app.orgID
+}
+
+// record caches the mappings learned from a successful authorization of
+// access, which the Machines API resolved to fa.
+func (r *Resolver) record(access *Access, fa *flyio.Access) {
+	if fa == nil || fa.OrgID == nil {
+		return
+	}
+
+	exp := r.now().Add(r.ttl)
+
+	var orgSlug string
+	switch {
+	case access.OrgSlug != nil:
+		orgSlug = *access.OrgSlug
+	case fa.OrgSlug != nil:
+		orgSlug = *fa.OrgSlug
+	}
+
+	if orgSlug != "" {
+		r.orgs.Add(orgSlug, &resolverEntry[uint64]{*fa.OrgID, exp})
+	}
+
+	if access.AppName == nil || fa.AppID == nil {
+		return
+	}
+
+	r.apps.Add(*access.AppName, &resolverEntry[resolvedApp]{resolvedApp{*fa.AppID, *fa.OrgID, orgSlug}, exp})
+
+	if access.MachineID != nil {
+		r.machines.Add(*access.MachineID, &resolverEntry[string]{*access.AppName, exp})
+	}
+}
+
+func get[T any](r *Resolver, cache *lru.Cache[string, *resolverEntry[T]], key string) (ret T, ok bool) {
+	entry, ok := cache.Get(key)
+	switch {
+	case !ok:
+		return ret, false
+	case r.now().After(entry.expiration):
+		cache.Remove(key)
+		return ret, false
+	default:
+		return entry.val, true
+	}
+}
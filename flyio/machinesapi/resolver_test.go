@@ -0,0 +1,212 @@
+package machinesapi
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/alecthomas/assert/v2"
+	"github.com/superfly/macaroon"
+	"github.com/superfly/macaroon/bundle"
+	"github.com/superfly/macaroon/flyio"
+	"github.com/superfly/macaroon/resset"
+)
+
+func TestResolver(t *testing.T) {
+	var (
+		ctx = context.Background()
+		kid = []byte("kid")
+		key = macaroon.NewSigningKey()
+		kr  = bundle.WithKey(kid, key, nil)
+
+		orgID, appID = uint64(123), uint64(234)
+
+		// the server resolves the access and responds with this status code
+		status = http.StatusOK
+
+		// if set, the server responds with this body instead
+		rawBody string
+	)
+
+	m, err := macaroon.New(kid, flyio.LocationPermission, key)
+	assert.NoError(t, err)
+	assert.NoError(t, m.Add(
+		&flyio.Organization{ID: orgID, Mask: resset.ActionAll},
+		&flyio.Apps{Apps: resset.New(resset.ActionRead, appID)},
+	))
+	tok, err := m.Encode()
+	assert.NoError(t, err)
+	hdr := macaroon.ToAuthorizationHeader(tok)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if rawBody != "" {
+			w.WriteHeader(status)
+			w.Write([]byte(rawBody))
+			return
+		}
+
+		if status != http.StatusOK {
+			w.WriteHeader(status)
+			json.NewEncoder(w).Encode(&ServerError{Err: http.StatusText(status)})
+			return
+		}
+
+		var req authorizeRequest
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+
+		fa := &flyio.Access{Action: req.Access.Action, OrgID: &orgID, Machine: req.Access.MachineID}
+		if req.Access.AppName != nil {
+			fa.AppID = &appID
+		}
+
+		json.NewEncoder(w).Encode(&authorizeResponse{
+			Access:        fa,
+			VerifiedToken: &verifyResult{Caveats: &m.UnsafeCaveats, PermissionToken: tok},
+		})
+	}))
+	t.Cleanup(srv.Close)
+
+	baseURL, err := url.Parse(srv.URL)
+	assert.NoError(t, err)
+
+	var (
+		client   = &Client{HTTP: http.DefaultTransport, BaseURL: baseURL}
+		resolver = NewResolver(client, time.Minute, 10)
+		now      = time.Now()
+		access   = &Access{OrgSlug: ptr("my-org"), AppName: ptr("my-app"), MachineID: ptr("m1"), Action: resset.ActionRead}
+	)
+
+	resolver.now = func() time.Time { return now }
+
+	t.Run("miss", func(t *testing.T) {
+		_, err := resolver.ResolveAccess(ctx, access)
+		assert.IsError(t, err, ErrNotResolved)
+	})
+
+	t.Run("hit", func(t *testing.T) {
+		_, err := resolver.Authorize(ctx, hdr, access)
+		assert.NoError(t, err)
+
+		fa, err := resolver.ResolveAccess(ctx, &Access{MachineID: ptr("m1"), Action: resset.ActionRead})
+		assert.NoError(t, err)
+		assert.Equal(t, &flyio.Access{
+			Action:  resset.ActionRead,
+			OrgID:   &orgID,
+			OrgSlug: ptr("my-org"),
+			AppID:   &appID,
+			AppName: ptr("my-app"),
+			Machine: ptr("m1"),
+		}, fa)
+
+		fa, err = resolver.ResolveAccess(ctx, &Access{OrgSlug: ptr("my-org"), OrgFeature: ptr("wg")})
+		assert.NoError(t, err)
+		assert.Equal(t, &flyio.Access{OrgID: &orgID, OrgSlug: ptr("my-org"), Feature: ptr("wg")}, fa)
+
+		// inconsistent with cache
+		_, err = resolver.ResolveAccess(ctx, &Access{OrgSlug: ptr("other-org"), AppName: ptr("my-app")})
+		assert.IsError(t, err, ErrNotResolved)
+
+		// not cached
+		_, err = resolver.ResolveAccess(ctx, &Access{OrgSlug: ptr("my-org"), AppName: ptr("other-app")})
+		assert.IsError(t, err, ErrNotResolved)
+		_, err = resolver.ResolveAccess(ctx, &Access{OrgSlug: ptr("my-org"), VolumeID: ptr("vol_123")})
+		assert.IsError(t, err, ErrNotResolved)
+	})
+
+	t.Run("offline", func(t *testing.T) {
+		status = http.StatusServiceUnavailable
+		t.Cleanup(func() { status = http.StatusOK })
+
+		authorize := func(access *Access, opts ...AuthorizeOption) (*flyio.Access, error) {
+			bun, err := flyio.ParseBundle(hdr)
+			assert.NoError(t, err)
+			return client.AuthorizeBundle(ctx, bun, access, opts...)
+		}
+
+		// no fallback by default
+		_, err := authorize(access)
+		assert.Error(t, err)
+
+		fa, err := authorize(access, WithOfflineAuthorization(resolver, kr))
+		assert.NoError(t, err)
+		assert.Equal(t, appID, *fa.AppID)
+
+		// locally validated
+		_, err = authorize(&Access{AppName: ptr("my-app"), Action: resset.ActionWrite}, WithOfflineAuthorization(resolver, kr))
+		assert.IsError(t, err, resset.ErrUnauthorizedForAction)
+
+		// cache miss
+		_, err = authorize(&Access{AppName: ptr("other-app"), Action: resset.ActionRead}, WithOfflineAuthorization(resolver, kr))
+		assert.IsError(t, err, ErrNotResolved)
+
+		// client errors aren't retried offline
+		status = http.StatusForbidden
+		_, err = authorize(access, WithOfflineAuthorization(resolver, kr))
+		var se *ServerError
+		assert.True(t, errors.As(err, &se))
+		assert.False(t, errors.Is(err, ErrNotResolved))
+
+		// server errors from proxies without a JSON body are
+		status, rawBody = http.StatusBadGateway, "<html>bad gateway</html>"
+		t.Cleanup(func() { rawBody = "" })
+		_, err = authorize(access, WithOfflineAuthorization(resolver, kr))
+		assert.NoError(t, err)
+
+		// malformed responses aren't
+		status, rawBody = http.StatusOK, "{"
+		_, err = authorize(access, WithOfflineAuthorization(resolver, kr))
+		assert.Error(t, err)
+		assert.False(t, errors.Is(err, ErrNotResolved))
+		rawBody = ""
+
+		// requests abandoned by the caller aren't
+		cctx, cancel := context.WithCancel(ctx)
+		cancel()
+		bun, err := flyio.ParseBundle(hdr)
+		assert.NoError(t, err)
+		_, err = client.AuthorizeBundle(cctx, bun, access, WithOfflineAuthorization(resolver, kr))
+		assert.IsError(t, err, context.Canceled)
+		assert.False(t, errors.Is(err, ErrNotResolved))
+
+		// network errors are
+		closed := httptest.NewServer(http.NotFoundHandler())
+		closed.Close()
+		closedURL, err := url.Parse(closed.URL)
+		assert.NoError(t, err)
+		bun, err = flyio.ParseBundle(hdr)
+		assert.NoError(t, err)
+		fa, err = (&Client{HTTP: http.DefaultTransport, BaseURL: closedURL}).AuthorizeBundle(ctx, bun, access, WithOfflineAuthorization(resolver, kr))
+		assert.NoError(t, err)
+		assert.Equal(t, appID, *fa.AppID)
+	})
+
+	t.Run("app recorded without org slug", func(t *testing.T) {
+		_, err := resolver.Authorize(ctx, hdr, &Access{AppName: ptr("slugless-app"), Action: resset.ActionRead})
+		assert.NoError(t, err)
+
+		fa, err := resolver.ResolveAccess(ctx, &Access{OrgSlug: ptr("my-org"), AppName: ptr("slugless-app"), Action: resset.ActionRead})
+		assert.NoError(t, err)
+		assert.Equal(t, appID, *fa.AppID)
+		assert.Equal(t, "my-org", *fa.OrgSlug)
+
+		// unknown or inconsistent slugs are left to the Machines API
+		_, err = resolver.ResolveAccess(ctx, &Access{OrgSlug: ptr("other-org"), AppName: ptr("slugless-app")})
+		assert.IsError(t, err, ErrNotResolved)
+	})
+
+	t.Run("expiry", func(t *testing.T) {
+		now = now.Add(time.Minute + time.Second)
+
+		_, err := resolver.ResolveAccess(ctx, access)
+		assert.IsError(t, err, ErrNotResolved)
+	})
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
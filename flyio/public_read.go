@@ -0,0 +1,47 @@
+package flyio
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/superfly/macaroon"
+	"github.com/superfly/macaroon/bundle"
+	"github.com/superfly/macaroon/resset"
+)
+
+// PublicReadPolicy describes storage objects that may be read without a
+// token. It is consulted by CheckTokenOrAnonymous.
+type PublicReadPolicy struct {
+	// Prefixes identifies the publicly readable storage objects. See
+	// StorageObjects for the prefix format.
+	Prefixes []resset.Prefix
+}
+
+// AllowsAnonymous checks whether the policy allows the access to be made
+// without a token. Only reads of storage objects under one of the policy's
+// prefixes are allowed.
+func (p *PublicReadPolicy) AllowsAnonymous(access *Access) error {
+	if p == nil || len(p.Prefixes) == 0 {
+		return fmt.Errorf("%w: no public storage objects", macaroon.ErrUnauthorized)
+	}
+
+	return resset.Named("public storage object", resset.New(resset.ActionRead, p.Prefixes...)).Prohibits(access.StorageObject, access.Action)
+}
+
+// CheckTokenOrAnonymous authorizes the access using the tokens in the
+// Authorization header. If the header is empty or contains no tokens that can
+// be verified, the access is only allowed if the policy allows it
+// anonymously. If any token is verified, the access is authorized against the
+// tokens as usual and the policy is not consulted.
+func CheckTokenOrAnonymous(ctx context.Context, v bundle.Verifier, header string, access *Access, policy *PublicReadPolicy) error {
+	if header != "" {
+		bun, _ := ParseBundle(header)
+
+		res, err := bun.Authorize(ctx, v, access)
+		if res.Decision != bundle.Unauthenticated {
+			return err
+		}
+	}
+
+	return policy.AllowsAnonymous(access)
+}
@@ -0,0 +1,59 @@
+package flyio
+
+import (
+	"context"
+	"testing"
+
+	"github.com/alecthomas/assert/v2"
+	"github.com/superfly/macaroon"
+	"github.com/superfly/macaroon/bundle"
+	"github.com/superfly/macaroon/resset"
+)
+
+func TestCheckTokenOrAnonymous(t *testing.T) {
+	var (
+		ctx    = context.Background()
+		kid    = []byte("kid")
+		key    = macaroon.NewSigningKey()
+		v      = bundle.WithKey(kid, key, nil)
+		policy = &PublicReadPolicy{Prefixes: []resset.Prefix{"https://storage.fly/public/"}}
+	)
+
+	access := func(obj string, action resset.Action) *Access {
+		return &Access{OrgID: uptr(1), StorageObject: ptr(resset.Prefix(obj)), Action: action}
+	}
+
+	token := func(tb testing.TB, cavs ...macaroon.Caveat) string {
+		tb.Helper()
+
+		m, err := macaroon.New(kid, LocationPermission, key)
+		assert.NoError(tb, err)
+		assert.NoError(tb, m.Add(cavs...))
+
+		tok, err := m.Encode()
+		assert.NoError(tb, err)
+
+		return macaroon.ToAuthorizationHeader(tok)
+	}
+
+	// anonymous reads allowed/denied by prefix
+	assert.NoError(t, CheckTokenOrAnonymous(ctx, v, "", access("https://storage.fly/public/a.png", resset.ActionRead), policy))
+	assert.IsError(t, CheckTokenOrAnonymous(ctx, v, "", access("https://storage.fly/private/a.png", resset.ActionRead), policy), resset.ErrUnauthorizedForResource)
+	assert.IsError(t, CheckTokenOrAnonymous(ctx, v, "", access("https://storage.fly/public/a.png", resset.ActionRead), nil), macaroon.ErrUnauthorized)
+
+	// anonymous writes always denied
+	assert.IsError(t, CheckTokenOrAnonymous(ctx, v, "", access("https://storage.fly/public/a.png", resset.ActionWrite), policy), resset.ErrUnauthorizedForAction)
+
+	// invalid tokens are treated as anonymous
+	bad := macaroon.NewSigningKey()
+	m, err := macaroon.New(kid, LocationPermission, bad)
+	assert.NoError(t, err)
+	badTok, err := m.Encode()
+	assert.NoError(t, err)
+	assert.NoError(t, CheckTokenOrAnonymous(ctx, v, macaroon.ToAuthorizationHeader(badTok), access("https://storage.fly/public/a.png", resset.ActionRead), policy))
+
+	// valid tokens are evaluated as usual and not weakened by the policy
+	hdr := token(t, &Organization{ID: 1, Mask: resset.ActionAll}, &StorageObjects{Prefixes: resset.New[resset.Prefix](resset.ActionAll, "https://storage.fly/private/")})
+	assert.NoError(t, CheckTokenOrAnonymous(ctx, v, hdr, access("https://storage.fly/private/a.png", resset.ActionWrite), policy))
+	assert.IsError(t, CheckTokenOrAnonymous(ctx, v, hdr, access("https://storage.fly/public/a.png", resset.ActionRead), policy), resset.ErrUnauthorizedForResource)
+}
@@ -0,0 +1,199 @@
+// Package httpmw provides HTTP middleware for verifying macaroon tokens in
+// request Authorization headers.
+package httpmw
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/superfly/macaroon"
+	"github.com/superfly/macaroon/bundle"
+)
+
+var (
+	// ErrMissingToken is passed to the ErrorResponder when the request has no
+	// Authorization header.
+	ErrMissingToken = errors.New("missing token")
+
+	// ErrVerifierUnavailable is passed to the ErrorResponder when the Verifier
+	// couldn't be reached.
+	ErrVerifierUnavailable = errors.New("verifier unavailable")
+)
+
+// ErrorResponder writes an error response for a request that failed
+// verification.
+type ErrorResponder func(w http.ResponseWriter, r *http.Request, statusCode int, err error)
+
+type Option func(*config)
+
+// WithFailOpen causes requests to be passed to the next handler without
+// verified caveats if the Verifier couldn't be reached. By default, such
+// requests are failed with a 503.
+func WithFailOpen() Option {
+	return func(c *config) {
+		c.failOpen = true
+	}
+}
+
+// WithRequireVerified causes requests without at least one verified permission
+// token, or with an Authorization header that can't be parsed, to be failed
+// with a 401. By default, such requests are passed to the next handler, which
+// can check CaveatsFromContext.
+func WithRequireVerified() Option {
+	return func(c *config) {
+		c.requireVerified = true
+	}
+}
+
+// WithErrorResponder specifies a function for writing error responses. By
+// default, a JSON body of the form {"error": "..."} is written.
+func WithErrorResponder(er ErrorResponder) Option {
+	return func(c *config) {
+		c.respondError = er
+	}
+}
+
+// WithTokenIDHeader causes the middleware to set the named response header to
+// a comma-separated list of the IDs of the request's permission tokens. This
+// is useful for correlating requests and tokens in logs.
+func WithTokenIDHeader(name string) Option {
+	return func(c *config) {
+		c.tokenIDHeader = name
+	}
+}
+
+// WithTransportErrorClassifier specifies a function for determining whether a
+// verification error was caused by failure to reach the Verifier rather than
+// by a bad token. By default, errors wrapping a net.Error are considered
+// transport errors.
+func WithTransportErrorClassifier(isTransport func(error) bool) Option {
+	return func(c *config) {
+		c.isTransportError = isTransport
+	}
+}
+
+type config struct {
+	failOpen         bool
+	requireVerified  bool
+	respondError     ErrorResponder
+	tokenIDHeader    string
+	isTransportError func(error) bool
+}
+
+// Verify returns middleware that parses the request's Authorization header
+// into a bundle.Bundle and verifies it with v. The Bundle and verified caveats
+// are made available to the next handler via BundleFromContext and
+// CaveatsFromContext.
+func Verify(v bundle.Verifier, permLocation string, opts ...Option) func(http.Handler) http.Handler {
+	c := &config{
+		respondError:     defaultErrorResponder,
+		isTransportError: isNetError,
+	}
+
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			hdr := r.Header.Get("Authorization")
+			if hdr == "" {
+				if c.requireVerified {
+					c.respondError(w, r, http.StatusUnauthorized, ErrMissingToken)
+					return
+				}
+
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			// the Bundle is usable even if some tokens couldn't be parsed
+			bun, err := bundle.ParseBundle(permLocation, hdr)
+			if err != nil && c.requireVerified {
+				c.respondError(w, r, http.StatusUnauthorized, err)
+				return
+			}
+
+			if c.tokenIDHeader != "" {
+				setTokenIDHeader(w, bun, c.tokenIDHeader)
+			}
+
+			ctx := context.WithValue(r.Context(), contextKeyBundle, bun)
+
+			cavs, err := bun.Verify(ctx, v)
+			if err != nil {
+				if c.isTransport(bun) {
+					if !c.failOpen {
+						c.respondError(w, r, http.StatusServiceUnavailable, errors.Join(ErrVerifierUnavailable, err))
+						return
+					}
+				} else if c.requireVerified {
+					c.respondError(w, r, http.StatusUnauthorized, err)
+					return
+				}
+			} else {
+				ctx = context.WithValue(ctx, contextKeyCaveats, cavs)
+			}
+
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// BundleFromContext returns the Bundle parsed by the Verify middleware. It
+// returns nil if the request had no Authorization header.
+func BundleFromContext(ctx context.Context) *bundle.Bundle {
+	bun, _ := ctx.Value(contextKeyBundle).(*bundle.Bundle)
+	return bun
+}
+
+// CaveatsFromContext returns the caveat sets of the permission tokens verified
+// by the Verify middleware. It returns nil if no tokens were verified.
+func CaveatsFromContext(ctx context.Context) []*macaroon.CaveatSet {
+	cavs, _ := ctx.Value(contextKeyCaveats).([]*macaroon.CaveatSet)
+	return cavs
+}
+
+type contextKey string
+
+const (
+	contextKeyBundle  = contextKey("bundle")
+	contextKeyCaveats = contextKey("caveats")
+)
+
+// isTransport checks whether any permission token failed verification because
+// of a transport error.
+func (c *config) isTransport(bun *bundle.Bundle) bool {
+	var transport bool
+
+	bundle.ForEach(bun, func(fm *bundle.FailedMacaroon) {
+		transport = transport || c.isTransportError(fm.Err)
+	})
+
+	return transport
+}
+
+func isNetError(err error) bool {
+	var ne net.Error
+	return errors.As(err, &ne)
+}
+
+func setTokenIDHeader(w http.ResponseWriter, bun *bundle.Bundle, name string) {
+	ids := bundle.Map(bun.Select(bun.IsPermissionToken), func(m bundle.Macaroon) string {
+		return m.Nonce().UUID().String()
+	})
+
+	if len(ids) != 0 {
+		w.Header().Set(name, strings.Join(ids, ","))
+	}
+}
+
+func defaultErrorResponder(w http.ResponseWriter, r *http.Request, statusCode int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(map[string]string{"error": http.StatusText(statusCode)})
+}
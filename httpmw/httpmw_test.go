@@ -0,0 +1,161 @@
+package httpmw
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/alecthomas/assert/v2"
+	"github.com/superfly/macaroon"
+	"github.com/superfly/macaroon/bundle"
+)
+
+var (
+	permLoc = "perm-loc"
+	permKID = []byte("perm-kid")
+	permKey = macaroon.NewSigningKey()
+)
+
+func TestVerify(t *testing.T) {
+	var (
+		kr   = bundle.WithKey(permKID, permKey, nil)
+		down = bundle.VerifierFunc(func(ctx context.Context, perm bundle.Macaroon, diss []bundle.Macaroon) bundle.VerificationResult {
+			return &bundle.FailedMacaroon{
+				UnverifiedMacaroon: perm.Unverified(),
+				Err:                &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")},
+			}
+		})
+
+		good, goodID = genToken(t, permKey)
+		bad, _       = genToken(t, macaroon.NewSigningKey())
+
+		handled bool
+		gotBun  *bundle.Bundle
+		gotCavs []*macaroon.CaveatSet
+	)
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handled = true
+		gotBun = BundleFromContext(r.Context())
+		gotCavs = CaveatsFromContext(r.Context())
+	})
+
+	do := func(v bundle.Verifier, hdr string, opts ...Option) *httptest.ResponseRecorder {
+		handled, gotBun, gotCavs = false, nil, nil
+
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		if hdr != "" {
+			r.Header.Set("Authorization", hdr)
+		}
+
+		w := httptest.NewRecorder()
+		Verify(v, permLoc, opts...)(next).ServeHTTP(w, r)
+
+		return w
+	}
+
+	t.Run("valid bundle", func(t *testing.T) {
+		w := do(kr, good, WithRequireVerified(), WithTokenIDHeader("Fly-Token-IDs"))
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.True(t, handled)
+		assert.NotZero(t, gotBun)
+		assert.Equal(t, 1, len(gotCavs))
+		assert.Equal(t, goodID, w.Header().Get("Fly-Token-IDs"))
+	})
+
+	t.Run("missing header", func(t *testing.T) {
+		w := do(kr, "")
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.True(t, handled)
+		assert.Zero(t, gotBun)
+		assert.Zero(t, gotCavs)
+
+		w = do(kr, "", WithRequireVerified())
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+		assert.False(t, handled)
+		assert.Equal(t, `{"error":"Unauthorized"}`+"\n", w.Body.String())
+	})
+
+	t.Run("malformed token", func(t *testing.T) {
+		w := do(kr, "FlyV1 fm2_!!!")
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.True(t, handled)
+		assert.NotZero(t, gotBun)
+		assert.Zero(t, gotCavs)
+
+		w = do(kr, "FlyV1 fm2_!!!", WithRequireVerified())
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+		assert.False(t, handled)
+
+		// valid tokens alongside a malformed one
+		mixed := good + ",fm2_!!!"
+
+		w = do(kr, mixed)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.True(t, handled)
+		assert.NotZero(t, gotBun)
+		assert.Equal(t, 1, len(gotCavs))
+
+		var gotErr error
+		w = do(kr, mixed, WithRequireVerified(), WithErrorResponder(func(w http.ResponseWriter, r *http.Request, statusCode int, err error) {
+			gotErr = err
+			w.WriteHeader(statusCode)
+		}))
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+		assert.False(t, handled)
+		assert.IsError(t, gotErr, macaroon.ErrUnrecognizedToken)
+	})
+
+	t.Run("bad signature", func(t *testing.T) {
+		w := do(kr, bad, WithRequireVerified())
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+		assert.False(t, handled)
+	})
+
+	t.Run("verifier unreachable fail closed", func(t *testing.T) {
+		w := do(down, good)
+		assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+		assert.False(t, handled)
+	})
+
+	t.Run("verifier unreachable fail open", func(t *testing.T) {
+		w := do(down, good, WithFailOpen())
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.True(t, handled)
+		assert.NotZero(t, gotBun)
+		assert.Zero(t, gotCavs)
+	})
+
+	t.Run("custom error responder", func(t *testing.T) {
+		var gotErr error
+
+		w := do(down, good, WithErrorResponder(func(w http.ResponseWriter, r *http.Request, statusCode int, err error) {
+			gotErr = err
+			w.WriteHeader(http.StatusTeapot)
+		}))
+		assert.Equal(t, http.StatusTeapot, w.Code)
+		assert.IsError(t, gotErr, ErrVerifierUnavailable)
+	})
+
+	t.Run("custom transport classifier", func(t *testing.T) {
+		w := do(down, good, WithTransportErrorClassifier(func(error) bool { return false }))
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.True(t, handled)
+		assert.Zero(t, gotCavs)
+	})
+}
+
+func genToken(tb testing.TB, key macaroon.SigningKey) (string, string) {
+	tb.Helper()
+
+	m, err := macaroon.New(permKID, permLoc, key)
+	assert.NoError(tb, err)
+
+	tok, err := m.Encode()
+	assert.NoError(tb, err)
+
+	return macaroon.ToAuthorizationHeader(tok), m.Nonce.UUID().String()
+}
@@ -14,6 +14,7 @@ import (
 
 	"github.com/superfly/macaroon"
 	"github.com/superfly/macaroon/auth"
+	mcrypto "github.com/superfly/macaroon/crypto"
 	"github.com/superfly/macaroon/flyio"
 	"github.com/superfly/macaroon/resset"
 	msgpack "github.com/vmihailenco/msgpack/v5"
@@ -58,7 +59,7 @@ func main() {
 	aBaseHdr := macaroon.ToAuthorizationHeader(otherTok, aBaseTok, otherTok)
 	v.Attenuation[aBaseHdr] = map[string]string{}
 	for _, c := range caveats.Caveats {
-		cpy := ptr(*aBase)
+		cpy, _ := aBase.Clone()
 		cpy.UnsafeCaveats = *macaroon.NewCaveatSet()
 		cpy.Add(c)
 		cavsPacked, _ := cpy.UnsafeCaveats.MarshalMsgpack()
@@ -74,7 +75,7 @@ func main() {
 	v.Caveats["smallUint64Caveat"] = pack(ptr(uint64Caveat(1)))
 	v.Caveats["bigUint64Caveat"] = pack(ptr(uint64Caveat(math.MaxUint64)))
 
-	withTP := ptr(*aBase)
+	withTP, _ := aBase.Clone()
 	withTP.UnsafeCaveats = *macaroon.NewCaveatSet()
 	withTP.Add3P(v.TPKey, "discharged")
 	withTP.Add3P(v.TPKey, "undischarged")
@@ -84,6 +85,9 @@ func main() {
 	permTok, _ := withTP.Encode()
 	v.WithTPs = macaroon.ToAuthorizationHeader(permTok, dmTok)
 
+	v.Crypto = cryptoKATs()
+	v.Registry = macaroon.RegisteredCaveats()
+
 	enc := json.NewEncoder(os.Stdout)
 	enc.SetIndent("", "  ")
 
@@ -101,6 +105,41 @@ type vectors struct {
 	Attenuation map[string]map[string]string `json:"attenuation"`
 	Caveats     map[string][]byte            `json:"caveats"`
 	WithTPs     string                       `json:"with_tps"`
+	Crypto      *cryptoVectors               `json:"crypto"`
+	Registry    []macaroon.CaveatInfo        `json:"registry"`
+}
+
+// cryptoVectors are known-answer tests for the primitives in the crypto
+// package. Inputs are fixed, so these are the same on every run. They match
+// the KATs in crypto/crypto_test.go.
+type cryptoVectors struct {
+	Key                    []byte `json:"key"`
+	Nonce                  []byte `json:"nonce"`
+	Data                   []byte `json:"data"`
+	Sign                   []byte `json:"sign"`
+	Seal                   []byte `json:"seal"`
+	BindingID              []byte `json:"binding_id"`
+	FinalizeProofSignature []byte `json:"finalize_proof_signature"`
+}
+
+func cryptoKATs() *cryptoVectors {
+	v := &cryptoVectors{
+		Key:   []byte{0x00, 0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08, 0x09, 0x0a, 0x0b, 0x0c, 0x0d, 0x0e, 0x0f, 0x10, 0x11, 0x12, 0x13, 0x14, 0x15, 0x16, 0x17, 0x18, 0x19, 0x1a, 0x1b, 0x1c, 0x1d, 0x1e, 0x1f},
+		Nonce: []byte{0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x4a, 0x00, 0x00, 0x00, 0x00},
+		Data:  []byte("macaroon"),
+	}
+
+	seal, err := mcrypto.SealWithNonce(v.Key, v.Nonce, v.Data)
+	if err != nil {
+		panic(err)
+	}
+
+	v.Sign = mcrypto.Sign(v.Key, v.Data)
+	v.Seal = seal
+	v.BindingID = mcrypto.BindingID(v.Data)
+	v.FinalizeProofSignature = mcrypto.FinalizeProofSignature(v.Data)
+
+	return v
 }
 
 var caveats = macaroon.NewCaveatSet(
@@ -127,6 +166,8 @@ var caveats = macaroon.NewCaveatSet(
 	auth.RequireOrganization(123),
 	auth.RequireGoogleHD("123"),
 	auth.RequireGitHubOrg(123),
+	auth.RequireMachine("123"),
+	auth.RequireAnyOf(auth.RequireGoogleHD("123"), auth.RequireGitHubOrg(123)),
 	ptr(auth.FlyioUserID(123)),
 	ptr(auth.GitHubUserID(123)),
 	(*auth.GoogleUserID)(new(big.Int).SetBytes([]byte{
@@ -135,7 +176,20 @@ var caveats = macaroon.NewCaveatSet(
 		123,
 	})),
 	&flyio.IsMember{},
+	&flyio.MachineIdentity{MachineID: "123", AppID: 123, OrgID: 123},
+	&flyio.MaxSpendCents{Amount: 10000, Window: "month"},
 	&flyio.Organization{ID: 123, Mask: resset.ActionAll},
+	&flyio.Queries{Queries: []string{"appStatus", "viewerOrganizations"}},
+	&flyio.ReadOnly{},
+	&flyio.AppVolumes{AppID: 123, Volumes: resset.ResourceSet[string, resset.Action]{"vol_b": resset.ActionAll, "vol_a": resset.ActionRead}},
+	&flyio.AppMachines{AppID: 123, Machines: resset.ResourceSet[string, resset.Action]{"m_b": resset.ActionAll, "m_a": resset.ActionRead}},
+	&flyio.SourceNetworks{Networks: []string{"10.0.0.0/8", "192.168.0.0/16", "2001:db8::/32"}},
+	&flyio.OIDCAudiences{Audiences: resset.ResourceSet[resset.Prefix, resset.Action]{"https://c.example/": resset.ActionAll, "https://a.example/": resset.ActionAll, "https://b.example/": resset.ActionAll}},
+	&macaroon.ScopedToLocation{Locations: []string{"https://b.example/", "https://a.example/"}, Caveats: macaroon.NewCaveatSet(&flyio.Queries{Queries: []string{"appStatus"}})},
+	&flyio.FeatureDependency{AppFeature: "registry", RequiresOrgFeature: "builder", Mask: resset.ActionRead},
+	&macaroon.UsageLimit{Max: 5, CounterID: []byte("counter")},
+	&flyio.Require3PForActions{Location: "https://approvals.example/", Actions: resset.ActionDelete},
+	&flyio.ApprovalAttestation{Location: "https://approvals.example/", Nonce: []byte("approval")},
 )
 
 const (
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"encoding/hex"
 	"encoding/json"
 	"testing"
 
@@ -24,3 +25,79 @@ func TestCaveatSerialization(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, caveats, cs2)
 }
+
+func TestCryptoKATs(t *testing.T) {
+	v := cryptoKATs()
+	assert.Equal(t, "f3379f6db028cfcb7daf1672dedd2b44982bd9e09071fe5fa496fbfae29ed5ea", hex.EncodeToString(v.Sign))
+	assert.Equal(t, "000000000000004a000000004f2e32923274b68fb90cb99b1a87c48759c69f8fb135c4c5", hex.EncodeToString(v.Seal))
+	assert.Equal(t, "3b67143e130acdca72f55bc7acb21770", hex.EncodeToString(v.BindingID))
+	assert.Equal(t, "90704726323b6d82b047869a9460ecf19322a110ffee219b9a5e12d5f8b88c78", hex.EncodeToString(v.FinalizeProofSignature))
+}
+
+func TestRegisteredCaveats(t *testing.T) {
+	byName := map[string]macaroon.CaveatInfo{}
+	for _, info := range macaroon.RegisteredCaveats() {
+		byName[info.Name] = info
+	}
+
+	// every caveat in the vectors is registered
+	for _, cav := range caveats.Caveats {
+		info, ok := byName[cav.Name()]
+		assert.True(t, ok, cav.Name())
+		assert.Equal(t, cav.CaveatType(), info.Type, cav.Name())
+		assert.Equal(t, macaroon.IsAttestation(cav), info.IsAttestation, cav.Name())
+	}
+
+	attestations := []string{"FlyioUserID", "GitHubUserID", "GoogleUserID", "MachineIdentity"}
+	for _, name := range attestations {
+		assert.True(t, byName[name].IsAttestation, name)
+		assert.Equal(t, macaroon.CaveatRangeReserved, byName[name].Range, name)
+	}
+
+	assert.Equal(t, "*flyio.Organization", byName["Organization"].GoType)
+	assert.False(t, byName["Organization"].IsAttestation)
+	assert.Equal(t, "*resset.IfPresent", byName["IfPresent"].GoType)
+	assert.Equal(t, []string{"NoAdminFeatures"}, byName["IsMember"].Aliases)
+	assert.Equal(t, macaroon.CaveatRangeUser, byName["String"].Range)
+}
+
+func TestCanonicalEncoding(t *testing.T) {
+	for _, cav := range caveats.Caveats {
+		assert.NoError(t, macaroon.CheckCanonicalEncoding(cav), cav.Name())
+	}
+}
+
+func TestPeek(t *testing.T) {
+	key := macaroon.NewSigningKey()
+
+	for _, cav := range caveats.Caveats {
+		var (
+			m   *macaroon.Macaroon
+			err error
+		)
+
+		// attestations are only allowed in proofs
+		if macaroon.IsAttestation(cav) {
+			m, err = macaroon.NewProof([]byte{1, 2, 3}, "loc", key, cav)
+			assert.NoError(t, err)
+		} else {
+			m, err = macaroon.New([]byte{1, 2, 3}, "loc", key)
+			assert.NoError(t, err)
+			assert.NoError(t, m.Add(cav))
+		}
+		assert.NoError(t, m.Add3P(macaroon.NewEncryptionKey(), "tp"))
+
+		tok, err := m.Encode()
+		assert.NoError(t, err)
+
+		decoded, err := macaroon.Decode(tok)
+		assert.NoError(t, err)
+
+		ts, err := macaroon.Peek(tok)
+		assert.NoError(t, err, cav.Name())
+		assert.Equal(t, decoded.Nonce, ts.Nonce, cav.Name())
+		assert.Equal(t, decoded.Location, ts.Location, cav.Name())
+		assert.Equal(t, len(decoded.UnsafeCaveats.Caveats), ts.NumCaveats, cav.Name())
+		assert.Equal(t, []string{"tp"}, ts.ThirdPartyLocations, cav.Name())
+	}
+}
@@ -47,6 +47,16 @@
 //
 // We use ChaCha20/Poly1305 as the AEAD for third-party caveats.
 //
+// Verification doesn't attempt to hide whether a token is valid, but it avoids
+// revealing why a discharge failed to match a trusted third party. An attacker
+// able to submit discharges and time their verification shouldn't learn
+// whether a forged ticket failed to unseal, failed to decode, or carried the
+// wrong discharge key: each trusted key goes through every step, and a single
+// [DischargeTrustError] is returned for any mismatch. Signatures and discharge
+// keys are compared in constant time. Lookups of discharges by ticket are not
+// constant time; tickets aren't secret. Set [DebugVerification] to get details
+// about trust failures while debugging.
+//
 // # Fly Macaroon Format
 //
 // Our Macaroons are simple structs encoded with [MessagePack]. We use
@@ -71,6 +81,8 @@
 //
 //   - Create a token with [New].
 //
+//   - Create a non-attenuable proof carrying attestations with [NewProof].
+//
 //   - Add caveats ("attenuating" it) with [Macaroon.Add].
 //
 //   - Sign and encode the token with [Macaroon.Encode].
@@ -90,17 +102,29 @@ package macaroon
 
 import (
 	"bytes"
-	"crypto/hmac"
 	"crypto/sha256"
 	"crypto/subtle"
 	"encoding/hex"
 	"errors"
 	"fmt"
+	"io"
+	"strings"
+	"sync"
 	"time"
 
+	mcrypto "github.com/superfly/macaroon/crypto"
 	msgpack "github.com/vmihailenco/msgpack/v5"
+	"github.com/vmihailenco/msgpack/v5/msgpcode"
+	"golang.org/x/exp/slices"
 )
 
+// MaxCaveats is the maximum number of caveats a Macaroon (or any other
+// CaveatSet) may have. Adding caveats beyond this or decoding a Macaroon that
+// exceeds it fails with ErrTooManyCaveats. Each caveat makes tokens larger and
+// slower to verify, so this guards against runaway attenuation. Set to zero to
+// disable the check.
+var MaxCaveats = 256
+
 // Macaroon is the fully-functioning internal representation of a
 // token --- you've got a Macaroon either because you're constructing
 // a new token yourself, or because you've parsed a token from the
@@ -109,6 +133,17 @@ import (
 // Some fields in these structures are JSON-encoded because we use
 // a JSON representation of Macaroons in IPC with our Rails API, which
 // doesn't have a good FFI to talk to Go.
+//
+// A Macaroon's methods may be called concurrently. Methods that only read
+// the Macaroon (e.g. Verify, Encode, Expiration, and AllThirdPartyTickets)
+// run concurrently with each other, while methods that modify it (e.g. Add
+// and Add3P) are serialized with all of them. This doesn't extend to the
+// Macaroon's fields: modifying them directly, including the caveats in
+// UnsafeCaveats, isn't safe while other goroutines are using the Macaroon.
+// Nor does it extend to discharge macaroons passed to VerifyParsed or
+// VerifyDetailed, which mustn't be modified during verification. A CaveatSet
+// is safe to read concurrently, but not to modify concurrently with any
+// other use.
 type Macaroon struct {
 	Nonce    Nonce  `json:"-"`
 	Location string `json:"location"`
@@ -120,6 +155,104 @@ type Macaroon struct {
 	Tail          []byte    `json:"-"`
 
 	newProof bool
+
+	// source of randomness for minting, or nil for crypto/rand. See
+	// NewWithNonceRand.
+	rand io.Reader
+
+	// unknown trailing fields from a newer token format
+	extra []msgpack.RawMessage
+
+	// original encodings of caveats decoded from an alternate wire format.
+	// See SetCaveatEncodings.
+	wire [][]byte
+
+	// serializes methods that modify the Macaroon with those that read it.
+	// Exported methods take the lock, so they mustn't call each other while
+	// holding it.
+	mu sync.RWMutex
+}
+
+var (
+	_ msgpack.CustomDecoder = new(Macaroon)
+	_ msgpack.CustomEncoder = new(Macaroon)
+)
+
+// macaroonFields has Macaroon's fields without its msgpack methods.
+type macaroonFields Macaroon
+
+// number of fields in the array encoding of a Macaroon
+const macaroonNumFields = 4
+
+// DecodeMsgpack implements [msgpack.CustomDecoder]. Macaroons are encoded as
+// an array of their fields. Fields beyond those known to this version of the
+// library are from a newer format and are kept as raw msgpack, to be
+// re-encoded verbatim by EncodeMsgpack. Unlike unknown Nonce fields, these
+// aren't covered by the token's signature, so anybody handling the token can
+// add, remove, or change them.
+func (m *Macaroon) DecodeMsgpack(d *msgpack.Decoder) error {
+	c, err := d.PeekCode()
+	if err != nil {
+		return err
+	}
+	if msgpcode.IsFixedMap(c) || c == msgpcode.Map16 || c == msgpcode.Map32 {
+		return d.Decode((*macaroonFields)(m))
+	}
+
+	nFields, err := d.DecodeArrayLen()
+	switch {
+	case err != nil:
+		return err
+	case nFields <= 0:
+		*m = Macaroon{}
+		return nil
+	case nFields < macaroonNumFields:
+		return fmt.Errorf("unknown macaroon format: %d fields", nFields)
+	}
+
+	if err := d.DecodeMulti(&m.Nonce, &m.Location, &m.UnsafeCaveats, &m.Tail); err != nil {
+		return err
+	}
+
+	m.extra = nil
+	for i := macaroonNumFields; i < nFields; i++ {
+		raw, err := d.DecodeRaw()
+		if err != nil {
+			return err
+		}
+		m.extra = append(m.extra, raw)
+	}
+
+	return nil
+}
+
+// EncodeMsgpack implements [msgpack.CustomEncoder]. It is an error to encode
+// a macaroon with caveats decoded from an alternate wire format whose msgpack
+// encoding differs from their original encoding, since the signature covers
+// the original bytes. See ErrReencodedCaveat.
+func (m *Macaroon) EncodeMsgpack(e *msgpack.Encoder) error {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if err := m.checkReencoding(); err != nil {
+		return err
+	}
+
+	if err := e.EncodeArrayLen(macaroonNumFields + len(m.extra)); err != nil {
+		return err
+	}
+
+	if err := e.EncodeMulti(&m.Nonce, m.Location, m.UnsafeCaveats, m.Tail); err != nil {
+		return err
+	}
+
+	for _, raw := range m.extra {
+		if err := e.Encode(raw); err != nil {
+			return err
+		}
+	}
+
+	return nil
 }
 
 func encode(v interface{}) ([]byte, error) {
@@ -145,18 +278,75 @@ func encode(v interface{}) ([]byte, error) {
 // a database rowid somehow) and a location, which is ordinarily
 // a URL. The key is the signing secret.
 func New(kid []byte, loc string, key SigningKey) (*Macaroon, error) {
-	return newMacaroon(kid, loc, key, false)
+	return newMacaroon(kid, loc, key, false, nil)
+}
+
+// NewWithNonceRand is like New, but draws the randomness for the nonce, and
+// for third-party caveats added with [Macaroon.Add3P], from r instead of
+// crypto/rand. This makes minting reproducible (see
+// macaroontest.DeterministicRand) and is only meant for test fixtures. Tokens
+// minted from predictable or reused randomness aren't unique, and their
+// third-party tickets and discharge keys aren't secret, so this must never
+// be used in production.
+func NewWithNonceRand(kid []byte, loc string, key SigningKey, r io.Reader) (*Macaroon, error) {
+	return newMacaroon(kid, loc, key, false, r)
+}
+
+// NewProof creates a new first-party proof. A proof is a token whose signature
+// is finalized when it's encoded, so nobody (including the issuer) can add
+// caveats to it after [Macaroon.Encode] is called. Unlike ordinary tokens,
+// proofs may carry attestations, making them suitable for signed statements
+// (e.g. "machine X booted image Y at time T") that downstream services verify
+// with the shared key.
+//
+// The signing key is the trust root for first-party proofs: anybody able to
+// verify the proof's signature is trusting the proof's issuer, so attestations
+// are returned unconditionally by [Macaroon.Verify].
+func NewProof(kid []byte, loc string, key SigningKey, attestations ...Caveat) (*Macaroon, error) {
+	return newProof(kid, loc, key, nil, attestations)
+}
+
+// NewProofWithNonceRand is like NewProof, but draws randomness from r. Like
+// NewWithNonceRand, it is only meant for test fixtures.
+func NewProofWithNonceRand(kid []byte, loc string, key SigningKey, r io.Reader, attestations ...Caveat) (*Macaroon, error) {
+	return newProof(kid, loc, key, r, attestations)
 }
 
-func newMacaroon(kid []byte, loc string, key SigningKey, isProof bool) (*Macaroon, error) {
+func newProof(kid []byte, loc string, key SigningKey, r io.Reader, attestations []Caveat) (*Macaroon, error) {
+	m, err := newMacaroon(kid, loc, key, true, r)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := m.Add(attestations...); err != nil {
+		return nil, fmt.Errorf("new proof: %w", err)
+	}
+
+	return m, nil
+}
+
+func newMacaroon(kid []byte, loc string, key SigningKey, isProof bool, r io.Reader) (*Macaroon, error) {
+	if err := checkSigningKey(key); err != nil {
+		return nil, fmt.Errorf("new macaroon: %w", err)
+	}
+
 	nonce := newNonce(kid, isProof)
 
+	if r != nil {
+		rnd, err := randBytes(r, nonceRndSize)
+		if err != nil {
+			return nil, fmt.Errorf("new macaroon: %w", err)
+		}
+		nonce.Rnd = rnd
+	}
+
 	return &Macaroon{
 		Location:      loc,
 		Nonce:         nonce,
 		Tail:          sign(key, nonce.MustEncode()),
 		UnsafeCaveats: *NewCaveatSet(),
 		newProof:      isProof,
+		rand:          r,
 	}, nil
 }
 
@@ -179,6 +369,11 @@ func Decode(buf []byte) (*Macaroon, error) {
 		return nil, fmt.Errorf("macaroon decode: %w", err)
 	}
 
+	// a nil caveat array decodes to a zero CaveatSet
+	if m.UnsafeCaveats.Caveats == nil {
+		m.UnsafeCaveats.Caveats = []Caveat{}
+	}
+
 	return m, nil
 }
 
@@ -205,13 +400,21 @@ func DecodeNonce(buf []byte) (nonce Nonce, err error) {
 // the process. This is how you'd "attenuate" a token, taking a
 // read-write token and turning it into a read-only token, for instance.
 func (m *Macaroon) Add(caveats ...Caveat) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.add(caveats...)
+}
+
+func (m *Macaroon) add(caveats ...Caveat) error {
 	if m.Nonce.Proof && !m.newProof {
 		return errors.New("can't add caveats to finalized proof")
 	}
 
-	var err error
-	if caveats, err = m.dedup(caveats); err != nil {
-		return fmt.Errorf("deduplicating caveats: %w", err)
+	caveats = m.dedup(caveats)
+
+	if err := checkMaxCaveats(len(m.UnsafeCaveats.Caveats) + len(caveats)); err != nil {
+		return err
 	}
 
 	seen3P := map[string]bool{}
@@ -225,8 +428,16 @@ func (m *Macaroon) Add(caveats ...Caveat) error {
 		}
 
 		if c3p, ok := caveat.(*Caveat3P); ok {
+			if len(c3p.rn) == 0 {
+				return errors.New("third-party caveat missing discharge key; add it via Macaroon.Add3P")
+			}
+
 			// encrypt RN under the tail hmac so we can recover it during verification
-			c3p.VerifierKey = seal(EncryptionKey(m.Tail), c3p.rn)
+			vk, err := sealWithRand(m.rand, EncryptionKey(m.Tail), c3p.rn)
+			if err != nil {
+				return fmt.Errorf("m.add: %w", err)
+			}
+			c3p.VerifierKey = vk
 
 			if seen3P[c3p.Location] {
 				return fmt.Errorf("m.add: attempting to add multiple 3ps for %s", c3p.Location)
@@ -248,50 +459,90 @@ func (m *Macaroon) Add(caveats ...Caveat) error {
 	return nil
 }
 
+func checkMaxCaveats(n int) error {
+	if MaxCaveats > 0 && n > MaxCaveats {
+		return fmt.Errorf("%w: %d exceeds maximum of %d", ErrTooManyCaveats, n, MaxCaveats)
+	}
+	return nil
+}
+
 // remove elements from caveats that are already present in the macaroon or are
 // duplicates within caveats.
 //
 // TODO: ignore caveats that are subsets of existing caveats
-func (m *Macaroon) dedup(caveats []Caveat) ([]Caveat, error) {
-	seen := make(map[string]bool, len(m.UnsafeCaveats.Caveats))
-
-	for _, cav := range m.UnsafeCaveats.Caveats {
-		packed, err := NewCaveatSet(cav).MarshalMsgpack()
-		if err != nil {
-			return nil, err
-		}
-
-		seen[hex.EncodeToString(packed)] = true
-	}
-
+func (m *Macaroon) dedup(caveats []Caveat) []Caveat {
 	ret := make([]Caveat, 0, len(caveats))
 	for _, cav := range caveats {
-		packed, err := NewCaveatSet(cav).MarshalMsgpack()
-		if err != nil {
-			return nil, err
+		if !containsCaveat(m.UnsafeCaveats.Caveats, cav) && !containsCaveat(ret, cav) {
+			ret = append(ret, cav)
 		}
+	}
 
-		str := hex.EncodeToString(packed)
-		if !seen[str] {
-			ret = append(ret, cav)
-			seen[str] = true
+	return ret
+}
+
+// ApproxEncodedSize returns the approximate size in bytes of the Macaroon once
+// encoded with [Macaroon.Encode]. This allows issuers to check the size of a
+// token before encoding it. The string form of the token (see
+// [Macaroon.String]) is base64 encoded and about 4/3 of this size.
+func (m *Macaroon) ApproxEncodedSize() int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	// msgpack framing for the macaroon, nonce, location and tail
+	size := 16 + len(m.Nonce.KID) + len(m.Nonce.Rnd) + len(m.Location) + len(m.Tail)
+
+	for _, cav := range m.UnsafeCaveats.Caveats {
+		if packed, err := NewCaveatSet(cav).MarshalMsgpack(); err == nil {
+			size += len(packed)
 		}
 	}
 
-	return ret, nil
+	return size
 }
 
 // Encode encodes a Macaroon to bytes after creating it
-// or decoding it and adding more caveats.
+// or decoding it and adding more caveats. It is an error to encode a Macaroon
+// with third-party caveats that were appended to UnsafeCaveats directly rather
+// than via [Macaroon.Add3P], since such caveats can never be verified.
 func (m *Macaroon) Encode() ([]byte, error) {
-	if m.Nonce.Proof && m.newProof {
-		m.Tail = finalizeSignature(m.Tail)
-		m.newProof = false
+	if err := m.finalize(); err != nil {
+		return nil, err
 	}
 
 	return encode(m)
 }
 
+// finalize checks that the Macaroon can be encoded, finalizing its signature
+// if it's a new proof. This is the only modification made when encoding, and
+// it only happens once, so the write lock is only taken for new proofs.
+func (m *Macaroon) finalize() error {
+	m.mu.RLock()
+	for _, c3p := range GetCaveats[*Caveat3P](&m.UnsafeCaveats) {
+		if len(c3p.VerifierKey) == 0 {
+			m.mu.RUnlock()
+			return fmt.Errorf("third-party caveat for %s missing verifier key; add it via Macaroon.Add3P", c3p.Location)
+		}
+	}
+	newProof := m.Nonce.Proof && m.newProof
+	m.mu.RUnlock()
+
+	if !newProof {
+		return nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// another Encode may have finalized it in the meantime
+	if m.newProof {
+		m.Tail = mcrypto.FinalizeProofSignature(m.Tail)
+		m.newProof = false
+	}
+
+	return nil
+}
+
 // Verify checks the signature on a [Macaroon.Decode] 'ed Macaroon and returns the
 // the set of caveats that require validation against the user's request.
 //
@@ -306,7 +557,7 @@ func (m *Macaroon) Encode() ([]byte, error) {
 // a token that says "yes, this person is logged in as bob@victim.com, but
 // only allow this request to perform reads, not writes"). Those added
 // ordinary caveats WILL be returned from Verify.
-func (m *Macaroon) Verify(k SigningKey, discharges [][]byte, trusted3Ps map[string][]EncryptionKey) (*CaveatSet, error) {
+func (m *Macaroon) Verify(k SigningKey, discharges [][]byte, trusted3Ps map[string][]EncryptionKey, opts ...VerifyOption) (*CaveatSet, error) {
 	dms := make([]*Macaroon, 0, len(discharges))
 	for _, d := range discharges {
 		dm, err := Decode(d)
@@ -318,18 +569,194 @@ func (m *Macaroon) Verify(k SigningKey, discharges [][]byte, trusted3Ps map[stri
 		dms = append(dms, dm)
 	}
 
-	return m.VerifyParsed(k, dms, trusted3Ps)
+	return m.VerifyParsed(k, dms, trusted3Ps, opts...)
 }
 
-func (m *Macaroon) VerifyParsed(k SigningKey, dms []*Macaroon, trusted3Ps map[string][]EncryptionKey) (*CaveatSet, error) {
-	return m.verify(k, dms, nil, true, trusted3Ps)
+func (m *Macaroon) VerifyParsed(k SigningKey, dms []*Macaroon, trusted3Ps map[string][]EncryptionKey, opts ...VerifyOption) (*CaveatSet, error) {
+	res, err := m.VerifyDetailed(k, dms, trusted3Ps, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	return res.Caveats, nil
+}
+
+// VerifyResult is the result of Macaroon.VerifyDetailed.
+type VerifyResult struct {
+	// Caveats is the same CaveatSet that VerifyParsed would return.
+	Caveats *CaveatSet
+
+	// Satisfied is the discharge macaroon that satisfied each of the
+	// macaroon's third-party caveats, keyed by the caveat's location. If the
+	// macaroon has several third-party caveats for the same location, they
+	// are instead keyed by TicketDigest of their tickets.
+	Satisfied map[string]*Macaroon
+
+	// Trusted is whether each discharge in Satisfied was issued by one of the
+	// trusted third parties, meaning that its attestations were trusted. It
+	// has the same keys as Satisfied.
+	Trusted map[string]bool
+}
+
+// TicketDigest returns the key used in VerifyResult.Satisfied for third-party
+// caveats whose location isn't unique within a macaroon.
+func TicketDigest(ticket []byte) string {
+	return hex.EncodeToString(digest(ticket))
 }
 
-func (m *Macaroon) verify(k SigningKey, dms []*Macaroon, parentTokenBindingIds [][]byte, trustAttestations bool, trusted3Ps map[string][]EncryptionKey) (*CaveatSet, error) {
+// VerifyDetailed is like VerifyParsed, but also reports which discharge
+// macaroons satisfied the macaroon's third-party caveats. Third-party caveats
+// within discharge macaroons (see WithMaxDischargeDepth) aren't reported.
+func (m *Macaroon) VerifyDetailed(k SigningKey, dms []*Macaroon, trusted3Ps map[string][]EncryptionKey, opts ...VerifyOption) (*VerifyResult, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	vo := &verifyOpts{maxDischargeDepth: 1}
+	for _, opt := range opts {
+		opt(vo)
+	}
+
+	if obs := verifyObserver.Load(); obs != nil {
+		vo.stats = new(VerifyStats)
+		start := time.Now()
+
+		defer func() {
+			vo.stats.Duration = time.Since(start)
+			vo.stats.Outcome = verifyOutcome(vo.stats.Err)
+			(*obs)(*vo.stats)
+		}()
+	}
+
+	nByLocation := map[string]int{}
+	for _, c := range m.UnsafeCaveats.Caveats {
+		if c3p, ok := c.(*Caveat3P); ok {
+			nByLocation[c3p.Location]++
+		}
+	}
+
+	res := &VerifyResult{
+		Satisfied: map[string]*Macaroon{},
+		Trusted:   map[string]bool{},
+	}
+
+	satisfied := func(cav *Caveat3P, dm *Macaroon, trusted bool) {
+		key := cav.Location
+		if nByLocation[key] > 1 {
+			key = TicketDigest(cav.Ticket)
+		}
+
+		res.Satisfied[key] = dm
+		res.Trusted[key] = trusted
+	}
+
+	cavs, err := verifyWithKeys(m, k, dms, trusted3Ps, vo, satisfied)
+	if vo.stats != nil {
+		vo.stats.Err = err
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	res.Caveats = cavs
+
+	return res, nil
+}
+
+func verifyWithKeys(m *Macaroon, k SigningKey, dms []*Macaroon, trusted3Ps map[string][]EncryptionKey, vo *verifyOpts, satisfied func(*Caveat3P, *Macaroon, bool)) (*CaveatSet, error) {
+	if err := checkSigningKey(k); err != nil {
+		return nil, fmt.Errorf("macaroon verify: %w", err)
+	}
+
+	for loc, keys := range trusted3Ps {
+		for _, ka := range keys {
+			if err := checkEncryptionKey(ka); err != nil {
+				return nil, fmt.Errorf("macaroon verify: trusted key for %s: %w", loc, err)
+			}
+		}
+	}
+
+	return m.verify(k, dms, nil, true, trusted3Ps, 0, vo, satisfied)
+}
+
+// VerificationKeyResolver looks up the signing key and trusted third-party
+// keys for a macaroon with the given nonce. It should return an error wrapping
+// ErrUnknownKey if the nonce's KID isn't recognized.
+type VerificationKeyResolver func(Nonce) (SigningKey, map[string][]EncryptionKey, error)
+
+// VerifyToken decodes and verifies an encoded macaroon and its encoded
+// discharges in one call, using resolve to find the keys to verify with. This
+// is a shortcut for callers that have a single raw token rather than an
+// Authorization header. The returned errors can be distinguished with
+// errors.Is:
+//
+//   - ErrUnrecognizedToken if tok can't be decoded
+//   - ErrUnknownKey if resolve doesn't recognize the KID
+//   - ErrMissingDischarge if a third-party caveat isn't discharged
+//   - ErrInvalidSignature if the signature doesn't match the resolved key
+//
+// Errors returned by resolve are wrapped and returned as-is. Malformed
+// discharges are ignored, as with Macaroon.Verify.
+func VerifyToken(tok []byte, discharges [][]byte, resolve VerificationKeyResolver, opts ...VerifyOption) (*CaveatSet, error) {
+	nonce, err := DecodeNonce(tok)
+	if err != nil {
+		return nil, fmt.Errorf("%w: decode nonce: %w", ErrUnrecognizedToken, err)
+	}
+
+	key, trusted3Ps, err := resolve(nonce)
+	switch {
+	case err != nil:
+		return nil, fmt.Errorf("resolve key %x: %w", nonce.KID, err)
+	case key == nil:
+		return nil, fmt.Errorf("resolve key %x: %w", nonce.KID, ErrUnknownKey)
+	}
+
+	m, err := Decode(tok)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrUnrecognizedToken, err)
+	}
+
+	return m.Verify(key, discharges, trusted3Ps, opts...)
+}
+
+// VerifyOption configures Macaroon.Verify, Macaroon.VerifyParsed, and
+// Macaroon.VerifyDetailed.
+type VerifyOption func(*verifyOpts)
+
+// WithMaxDischargeDepth sets how deeply discharge macaroons may nest. With the
+// default of 1, discharge macaroons may not contain third-party caveats of
+// their own. With a depth of 2, discharge macaroons may contain third-party
+// caveats that are discharged by other discharge macaroons, and so on.
+func WithMaxDischargeDepth(depth int) VerifyOption {
+	return func(vo *verifyOpts) {
+		if depth < 1 {
+			depth = 1
+		}
+		vo.maxDischargeDepth = depth
+	}
+}
+
+type verifyOpts struct {
+	maxDischargeDepth int
+
+	// stats is set if there's a verify observer. See SetVerifyObserver.
+	stats *VerifyStats
+}
+
+// satisfied is called for each of m's third-party caveats with the discharge
+// that satisfied it, if it's non-nil.
+func (m *Macaroon) verify(k SigningKey, dms []*Macaroon, parentTokenBindingIds [][]byte, trustAttestations bool, trusted3Ps map[string][]EncryptionKey, depth int, opts *verifyOpts, satisfied func(*Caveat3P, *Macaroon, bool)) (*CaveatSet, error) {
 	if m.Nonce.Proof && m.newProof {
 		return nil, errors.New("can't verify unfinalized proof")
 	}
 
+	if depth >= opts.maxDischargeDepth {
+		for _, c := range m.UnsafeCaveats.Caveats {
+			if _, is3P := c.(*Caveat3P); is3P {
+				return nil, ErrDischargeNestingNotSupported
+			}
+		}
+	}
+
 	if trusted3Ps == nil {
 		trusted3Ps = map[string][]EncryptionKey{}
 	}
@@ -345,27 +772,38 @@ func (m *Macaroon) verify(k SigningKey, dms []*Macaroon, parentTokenBindingIds [
 	ret := NewCaveatSet()
 
 	type verifyParams struct {
-		m []*Macaroon
-		k SigningKey
+		m   []*Macaroon
+		k   SigningKey
+		cav *Caveat3P
 	}
 
 	dischargesToVerify := make([]*verifyParams, 0, len(dmsByTicket))
 	thisTokenBindingIds := [][]byte{digest(curMac)}
 
-	for _, c := range m.UnsafeCaveats.Caveats {
+	for i, c := range m.UnsafeCaveats.Caveats {
+		if opts.stats != nil {
+			opts.stats.Caveats++
+		}
+
 		switch cav := c.(type) {
 		case *Caveat3P:
+			if opts.stats != nil {
+				opts.stats.ThirdPartyCaveats++
+			}
+
 			discharges, ok := dmsByTicket[string(cav.Ticket)]
 			if !ok {
-				return nil, errors.New("no matching discharge token")
+				return nil, ErrMissingDischarge
 			}
 
 			dischargeKey, err := unseal(EncryptionKey(curMac), cav.VerifierKey)
 			if err != nil {
-				return nil, fmt.Errorf("macaroon verify: unseal VerifierKey for third-party caveat: %w", err)
+				// the VerifierKey is sealed with the signature so far, so this
+				// means the signing key is wrong.
+				return nil, fmt.Errorf("macaroon verify: %w: unseal VerifierKey for third-party caveat: %w", ErrInvalidSignature, err)
 			}
 
-			dischargesToVerify = append(dischargesToVerify, &verifyParams{discharges, dischargeKey})
+			dischargesToVerify = append(dischargesToVerify, &verifyParams{discharges, dischargeKey, cav})
 		case *BindToParentToken:
 			// TODO @bento: this could be optimized
 			found := false
@@ -386,9 +824,13 @@ func (m *Macaroon) verify(k SigningKey, dms []*Macaroon, parentTokenBindingIds [
 			if !IsAttestation(cav) || trustAttestations {
 				ret.Caveats = append(ret.Caveats, c)
 			}
+
+			if IsAttestation(cav) && trustAttestations {
+				ret.attest(c, m.Location)
+			}
 		}
 
-		opc, err := NewCaveatSet(c).MarshalMsgpack()
+		opc, err := m.caveatEncoding(i)
 		if err != nil {
 			return nil, err
 		}
@@ -405,39 +847,28 @@ func (m *Macaroon) verify(k SigningKey, dms []*Macaroon, parentTokenBindingIds [
 
 	dmLoop:
 		for _, dm := range vp.m {
+			if opts.stats != nil {
+				opts.stats.DischargesTried++
+			}
+
 			// If the discharge was actually created by a known third party we can
 			// trust its attestations. Verify this by comparing signing key from
 			// VerifierKey/ticket.
-			var trustedDischarge bool
-
-		trustLoop:
-			for _, ka := range trusted3Ps[dm.Location] {
-				ticketr, err := unseal(ka, dm.Nonce.KID)
-				if err != nil {
-					continue trustLoop
-				}
-
-				var ticket wireTicket
-				if err = msgpack.Unmarshal(ticketr, &ticket); err != nil {
-					dErr = errors.Join(dErr, fmt.Errorf("bad ticket in discharge: %w", err))
-					continue dmLoop
-				}
-
-				if subtle.ConstantTimeCompare(vp.k, ticket.DischargeKey) != 1 {
-					dErr = errors.Join(dErr, errors.New("discharge key from ticket/VerifierKey mismatch"))
-					continue dmLoop
-				}
-
-				trustedDischarge = true
-				break trustLoop
+			trustedDischarge, err := dischargeTrust(vp.k, dm, trusted3Ps[dm.Location])
+			if err != nil {
+				dErr = errors.Join(dErr, err)
+				continue dmLoop
 			}
 
 			dcavs, err := dm.verify(
 				vp.k,
-				nil, /* don't let them nest yet */
+				dms,
 				thisTokenBindingIds,
 				trustAttestations && trustedDischarge,
 				trusted3Ps,
+				depth+1,
+				opts,
+				nil,
 			)
 			if err != nil {
 				dErr = errors.Join(dErr, fmt.Errorf("macaroon verify: verify discharge: %w", err))
@@ -445,7 +876,14 @@ func (m *Macaroon) verify(k SigningKey, dms []*Macaroon, parentTokenBindingIds [
 			}
 
 			ret.Caveats = append(ret.Caveats, dcavs.Caveats...)
+			for cav, loc := range dcavs.attestedBy {
+				ret.attest(cav, loc)
+			}
 			discharged = true
+
+			if satisfied != nil {
+				satisfied(vp.cav, dm, trustedDischarge)
+			}
 			break dmLoop
 		}
 
@@ -455,28 +893,70 @@ func (m *Macaroon) verify(k SigningKey, dms []*Macaroon, parentTokenBindingIds [
 	}
 
 	if m.Nonce.Proof {
-		curMac = finalizeSignature(curMac)
+		curMac = mcrypto.FinalizeProofSignature(curMac)
 	}
 
 	if subtle.ConstantTimeCompare(curMac, m.Tail) != 1 {
-		return nil, fmt.Errorf("macaroon verify: invalid")
+		return nil, fmt.Errorf("macaroon verify: %w", ErrInvalidSignature)
 	}
 
 	return ret, nil
 }
 
-// finalizeSignature could conceptually just hash the macaroon tail. We're
-// already using the truncated tail hash for token binding though. It wouldn't
-// actually be bad to use the hash here, but HMAC feels better.
-func finalizeSignature(tail []byte) []byte {
-	h := hmac.New(sha256.New, []byte("proof-signature-finalization"))
-	h.Write(tail)
-	return h.Sum(nil)
+// dischargeTrust checks whether dm was issued by a third party holding one of
+// keys. Every key is tried and every step (unsealing the ticket, decoding it,
+// and comparing the discharge key) is performed regardless of whether earlier
+// steps failed, so the time taken doesn't depend on which step failed.
+//
+// A discharge that can't be unsealed with any of the keys isn't trusted, but
+// isn't an error either. A discharge whose ticket unseals but doesn't match
+// the discharge key results in a *DischargeTrustError.
+func dischargeTrust(dischargeKey []byte, dm *Macaroon, keys []EncryptionKey) (bool, error) {
+	var (
+		nTrusted int
+		nBad     int
+		debug    []string
+	)
+
+	for i, ka := range keys {
+		var (
+			ticketr, unsealErr = unseal(ka, dm.Nonce.KID)
+			ticket             wireTicket
+			decodeErr          = msgpack.Unmarshal(ticketr, &ticket)
+			keyOK              = subtle.ConstantTimeCompare(dischargeKey, ticket.DischargeKey)
+			unsealed           = subtle.ConstantTimeEq(boolToInt32(unsealErr == nil), 1)
+			decoded            = subtle.ConstantTimeEq(boolToInt32(decodeErr == nil), 1)
+			valid              = decoded & keyOK
+		)
+
+		nTrusted += unsealed & valid
+		nBad += unsealed & (valid ^ 1)
+
+		if DebugVerification {
+			switch {
+			case unsealErr != nil:
+				debug = append(debug, fmt.Sprintf("key %d: unseal: %s", i, unsealErr))
+			case decodeErr != nil:
+				debug = append(debug, fmt.Sprintf("key %d: bad ticket in discharge: %s", i, decodeErr))
+			case keyOK != 1:
+				debug = append(debug, fmt.Sprintf("key %d: discharge key from ticket/VerifierKey mismatch", i))
+			}
+		}
+	}
+
+	if nBad != 0 {
+		return false, &DischargeTrustError{Debug: strings.Join(debug, "; ")}
+	}
+
+	return nTrusted != 0, nil
 }
 
-// 16 bytes is a lot of bytes. The HMAC spec lets us truncate to half of the
-// digest length, so it seems reasonable to do here also.
-const bindingIdLength = sha256.Size / 2
+func boolToInt32(b bool) int32 {
+	if b {
+		return 1
+	}
+	return 0
+}
 
 // Bind cryptographically binds a discharge token to the "parent"
 // token it's meant to accompany. This is a convenience method
@@ -500,7 +980,10 @@ func (m *Macaroon) Bind(parent []byte) error {
 // See [Macaroon.Bind]; this is that function, but it takes a
 // parsed Macaroon.
 func (m *Macaroon) BindToParentMacaroon(parent *Macaroon) error {
-	bid := digest(parent.Tail)[0:bindingIdLength]
+	parent.mu.RLock()
+	bid := mcrypto.BindingID(parent.Tail)
+	parent.mu.RUnlock()
+
 	cav := BindToParentToken(bid)
 
 	return m.Add(&cav)
@@ -519,34 +1002,61 @@ func (m *Macaroon) BindToParentMacaroon(parent *Macaroon) error {
 //
 // Add3P takes a location, which is used to figure out which keys
 // to use to check which caveats. The location is normally a URL. The
-// authentication service has an authentication location URL.
+// authentication service has an authentication location URL. See
+// Add3PWithTicketLocation to also record the location in the ticket.
 func (m *Macaroon) Add3P(ka EncryptionKey, loc string, cs ...Caveat) error {
-	if len(ka) != EncryptionKeySize {
-		return fmt.Errorf("bad key size: have %d, need %d", len(ka), EncryptionKeySize)
+	return m.add3P(ka, loc, false, cs)
+}
+
+// Add3PWithTicketLocation is like Add3P, but also records the location in the
+// ticket, so the third party can check that it was meant for it (see
+// DischargeTicketWithLocation). Third parties using versions of this package
+// from before the location was recorded can't decode these tickets, so only
+// use this for third parties known to be up to date.
+func (m *Macaroon) Add3PWithTicketLocation(ka EncryptionKey, loc string, cs ...Caveat) error {
+	return m.add3P(ka, loc, true, cs)
+}
+
+func (m *Macaroon) add3P(ka EncryptionKey, loc string, recordLoc bool, cs []Caveat) error {
+	if err := checkEncryptionKey(ka); err != nil {
+		return fmt.Errorf("add 3p: %w", err)
 	}
 
+	// m.rand is read, so this is a modification too
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
 	// make a new root hmac key for the 3p discharge macaroon
-	rn := NewSigningKey()
+	rn, err := randBytes(m.rand, sha256.Size)
+	if err != nil {
+		return fmt.Errorf("add 3p: %w", err)
+	}
 
 	// make the ticket, which is consumed by the 3p service; then
 	// encode and encrypt it
 	ticket := &wireTicket{
-		DischargeKey: rn,
+		DischargeKey: SigningKey(rn),
 		Caveats:      *NewCaveatSet(cs...),
 	}
+	if recordLoc {
+		ticket.Location = loc
+	}
 
 	ticketBytes, err := encode(ticket)
 	if err != nil {
 		return fmt.Errorf("encoding ticket: %w", err)
 	}
 
-	m.Add(&Caveat3P{
+	sealed, err := sealWithRand(m.rand, ka, ticketBytes)
+	if err != nil {
+		return fmt.Errorf("add 3p: %w", err)
+	}
+
+	return m.add(&Caveat3P{
 		Location: loc,
-		Ticket:   seal(ka, ticketBytes),
+		Ticket:   sealed,
 		rn:       rn,
 	})
-
-	return nil
 }
 
 // AllThirdPartyTickets extracts the encrypted tickets from a token's third party
@@ -566,6 +1076,9 @@ func (m *Macaroon) Add3P(ka EncryptionKey, loc string, cs ...Caveat) error {
 //
 // Already-discharged caveats are excluded from the results.
 func (m *Macaroon) AllThirdPartyTickets(existingDischarges ...[]byte) map[string][][]byte {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
 	ret := map[string][][]byte{}
 	dischargeTickets := make(map[string]struct{}, len(existingDischarges))
 
@@ -616,11 +1129,74 @@ func (m *Macaroon) ThirdPartyTicket(location string, existingDischarges ...[]byt
 	return tps[location], nil
 }
 
+// ThirdPartyLocations returns the sorted, deduplicated locations of the
+// macaroon's third-party caveats. Unlike [Macaroon.AllThirdPartyTickets], it
+// doesn't copy or return any tickets.
+func (m *Macaroon) ThirdPartyLocations() []string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var ret []string
+	for _, cav := range GetCaveats[*Caveat3P](&m.UnsafeCaveats) {
+		ret = append(ret, cav.Location)
+	}
+
+	slices.Sort(ret)
+
+	return slices.Compact(ret)
+}
+
+// HasThirdParty returns whether the macaroon has a third-party caveat for the
+// location.
+func (m *Macaroon) HasThirdParty(location string) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for _, cav := range GetCaveats[*Caveat3P](&m.UnsafeCaveats) {
+		if cav.Location == location {
+			return true
+		}
+	}
+
+	return false
+}
+
+// CaveatTypes returns the sorted, deduplicated types of the macaroon's
+// caveats, including those wrapped by WrapperCaveats.
+func (m *Macaroon) CaveatTypes() []CaveatType {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	ret := appendCaveatTypes(nil, &m.UnsafeCaveats)
+	slices.Sort(ret)
+
+	return slices.Compact(ret)
+}
+
+func appendCaveatTypes(ret []CaveatType, cs *CaveatSet) []CaveatType {
+	if cs == nil {
+		return ret
+	}
+
+	for _, cav := range cs.Caveats {
+		ret = append(ret, cav.CaveatType())
+
+		if wc, isWrapper := cav.(WrapperCaveat); isWrapper {
+			ret = appendCaveatTypes(ret, wc.Unwrap())
+		}
+	}
+
+	return ret
+}
+
 // https://stackoverflow.com/questions/25065055/what-is-the-maximum-time-time-in-go
 var maxTime = time.Unix(1<<63-62135596801, 999999999)
 
 // Expiration calculates when this macaroon will expire
 func (m *Macaroon) Expiration() time.Time {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
 	ret := maxTime
 
 	for _, vw := range GetCaveats[*ValidityWindow](&m.UnsafeCaveats) {
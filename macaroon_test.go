@@ -2,6 +2,7 @@ package macaroon
 
 import (
 	"bytes"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -30,6 +31,7 @@ const (
 	cavTestParentResource = iota + CavMinUserDefined
 	cavTestChildResource
 	cavMyUnregistered
+	cavTestVersioned
 )
 
 type testCaveatParentResource struct {
@@ -310,23 +312,23 @@ func TestMacaroons(t *testing.T) {
 		requireDecode(t)
 
 		var tokenBindingIds [][]byte
-		_, err := decoded.verify(key, nil, tokenBindingIds, true, nil)
+		_, err := decoded.verify(key, nil, tokenBindingIds, true, nil, 0, &verifyOpts{maxDischargeDepth: 1}, nil)
 		assert.Error(t, err)
 
 		tokenBindingIds = [][]byte{{0xff}}
-		_, err = decoded.verify(key, nil, tokenBindingIds, true, nil)
+		_, err = decoded.verify(key, nil, tokenBindingIds, true, nil, 0, &verifyOpts{maxDischargeDepth: 1}, nil)
 		assert.Error(t, err)
 
 		tokenBindingIds = [][]byte{{0xde}}
-		_, err = decoded.verify(key, nil, tokenBindingIds, true, nil)
+		_, err = decoded.verify(key, nil, tokenBindingIds, true, nil, 0, &verifyOpts{maxDischargeDepth: 1}, nil)
 		assert.Error(t, err)
 
 		tokenBindingIds = [][]byte{{0xde, 0xad}}
-		_, err = decoded.verify(key, nil, tokenBindingIds, true, nil)
+		_, err = decoded.verify(key, nil, tokenBindingIds, true, nil, 0, &verifyOpts{maxDischargeDepth: 1}, nil)
 		assert.NoError(t, err)
 
 		tokenBindingIds = [][]byte{{0xde, 0xad, 0xbe, 0xef}}
-		_, err = decoded.verify(key, nil, tokenBindingIds, true, nil)
+		_, err = decoded.verify(key, nil, tokenBindingIds, true, nil, 0, &verifyOpts{maxDischargeDepth: 1}, nil)
 		assert.NoError(t, err)
 	})
 
@@ -354,10 +356,10 @@ func TestMacaroons(t *testing.T) {
 		dum, err := Decode(unboundDischarge)
 		assert.NoError(t, err)
 
-		_, err = dum.verify(wticket.DischargeKey, nil, nil, true, nil)
+		_, err = dum.verify(wticket.DischargeKey, nil, nil, true, nil, 0, &verifyOpts{maxDischargeDepth: 1}, nil)
 		assert.NoError(t, err)
 
-		_, err = dum.verify(wticket.DischargeKey, nil, [][]byte{{123}}, true, nil)
+		_, err = dum.verify(wticket.DischargeKey, nil, [][]byte{{123}}, true, nil, 0, &verifyOpts{maxDischargeDepth: 1}, nil)
 		assert.NoError(t, err)
 	})
 
@@ -475,7 +477,7 @@ func Test3pe2e(t *testing.T) {
 			tickets := rm.TicketsForThirdParty(authLoc)
 			assert.Equal(t, 1, len(tickets))
 
-			_, dm, err := dischargeTicket(ka, authLoc, tickets[0], isProof)
+			_, _, dm, err := dischargeTicket(ka, authLoc, tickets[0], isProof)
 			assert.NoError(t, err)
 
 			assert.NoError(t, dm.Add(cavExpiry(5*time.Minute)))
@@ -485,10 +487,10 @@ func Test3pe2e(t *testing.T) {
 			verifiedCavs, err := rm.Verify(key, [][]byte{aBuf}, nil)
 			assert.NoError(t, err)
 
-			_, _, err = dischargeTicket(ka, authLoc, tickets[0], isProof)
+			_, _, _, err = dischargeTicket(ka, authLoc, tickets[0], isProof)
 			assert.NoError(t, err)
 			tickets[0][10] = 0
-			_, _, err = dischargeTicket(ka, authLoc, tickets[0], isProof)
+			_, _, _, err = dischargeTicket(ka, authLoc, tickets[0], isProof)
 			assert.Error(t, err)
 
 			err = verifiedCavs.Validate(&testAccess{
@@ -556,7 +558,7 @@ func TestSimple3P(t *testing.T) {
 			tickets := decoded.TicketsForThirdParty(authLoc)
 			assert.Equal(t, 1, len(tickets))
 
-			_, dm, err := dischargeTicket(ka, authLoc, tickets[0], isProof)
+			_, _, dm, err := dischargeTicket(ka, authLoc, tickets[0], isProof)
 			assert.NoError(t, err)
 			assert.NoError(t, dm.Add(cavExpiry(5*time.Minute)))
 			aBuf, err := dm.Encode()
@@ -671,6 +673,92 @@ func TestDuplicateCaveats(t *testing.T) {
 	assert.Equal(t, 5, len(m.UnsafeCaveats.Caveats))
 }
 
+func TestZeroCaveatEncoding(t *testing.T) {
+	var (
+		key     = NewSigningKey()
+		m, err  = New([]byte("kid"), "loc", key)
+		vw      = &ValidityWindow{NotBefore: time.Now().Unix(), NotAfter: time.Now().Add(time.Hour).Unix()}
+		encoded = func(encodeCaveats func(*msgpack.Encoder) error) []byte {
+			buf := new(bytes.Buffer)
+			enc := msgpack.NewEncoder(buf)
+			assert.NoError(t, enc.EncodeArrayLen(4))
+			assert.NoError(t, enc.Encode(&m.Nonce))
+			assert.NoError(t, enc.EncodeString(m.Location))
+			assert.NoError(t, encodeCaveats(enc))
+			assert.NoError(t, enc.EncodeBytes(m.Tail))
+			return buf.Bytes()
+		}
+	)
+	assert.NoError(t, err)
+
+	tok, err := m.Encode()
+	assert.NoError(t, err)
+
+	withCav, err := m.Clone()
+	assert.NoError(t, err)
+	assert.NoError(t, withCav.Add(vw))
+	withCavTok, err := withCav.Encode()
+	assert.NoError(t, err)
+
+	for name, buf := range map[string][]byte{
+		"empty": encoded(func(enc *msgpack.Encoder) error { return enc.EncodeArrayLen(0) }),
+		"nil":   encoded(func(enc *msgpack.Encoder) error { return enc.EncodeNil() }),
+	} {
+		t.Run(name, func(t *testing.T) {
+			m2, err := Decode(buf)
+			assert.NoError(t, err)
+			assert.True(t, m2.UnsafeCaveats.Caveats != nil)
+			assert.True(t, m.Equal(m2))
+
+			_, err = m2.Verify(key, nil, nil)
+			assert.NoError(t, err)
+
+			tok2, err := m2.Encode()
+			assert.NoError(t, err)
+			assert.Equal(t, tok, tok2)
+
+			assert.NoError(t, m2.Add(vw))
+			tok2, err = m2.Encode()
+			assert.NoError(t, err)
+			assert.Equal(t, withCavTok, tok2)
+		})
+	}
+}
+
+func TestMaxCaveats(t *testing.T) {
+	defer func(max int) { MaxCaveats = max }(MaxCaveats)
+	MaxCaveats = 3
+
+	cav := func(i int) Caveat { return cavParent(ActionRead, uint64(i)) }
+
+	m, err := New([]byte("kid"), "loc", NewSigningKey())
+	assert.NoError(t, err)
+
+	assert.NoError(t, m.Add(cav(1), cav(2)))
+	assert.IsError(t, m.Add(cav(3), cav(4)), ErrTooManyCaveats)
+	assert.Equal(t, 2, len(m.UnsafeCaveats.Caveats))
+
+	// duplicates don't count
+	assert.NoError(t, m.Add(cav(1), cav(2), cav(3)))
+	assert.Equal(t, 3, len(m.UnsafeCaveats.Caveats))
+	assert.IsError(t, m.Add(cav(4)), ErrTooManyCaveats)
+
+	size := m.ApproxEncodedSize()
+	tok, err := m.Encode()
+	assert.NoError(t, err)
+	assert.True(t, size >= len(tok) && size < len(tok)+32, "approx %d, actual %d", size, len(tok))
+
+	_, err = Decode(tok)
+	assert.NoError(t, err)
+
+	MaxCaveats = 2
+	_, err = Decode(tok)
+	assert.IsError(t, err, ErrTooManyCaveats)
+
+	MaxCaveats = 0
+	assert.NoError(t, m.Add(cav(4)))
+}
+
 func TestDecodeNonce(t *testing.T) {
 	m, err := New(rbuf(10), "x", NewSigningKey())
 	assert.NoError(t, err)
@@ -705,6 +793,121 @@ func TestNonceJSON(t *testing.T) {
 	}
 }
 
+func TestUnknownFields(t *testing.T) {
+	var (
+		key = NewSigningKey()
+		kid = rbuf(10)
+		rnd = rbuf(nonceRndSize)
+	)
+
+	encoded := func(encodeFields ...func(*msgpack.Encoder) error) []byte {
+		buf := new(bytes.Buffer)
+		enc := msgpack.NewEncoder(buf)
+		enc.UseCompactInts(true)
+		assert.NoError(t, enc.EncodeArrayLen(len(encodeFields)))
+		for _, ef := range encodeFields {
+			assert.NoError(t, ef(enc))
+		}
+		return buf.Bytes()
+	}
+	raw := func(buf []byte) func(*msgpack.Encoder) error {
+		return func(enc *msgpack.Encoder) error { return enc.Encode(msgpack.RawMessage(buf)) }
+	}
+	str := func(s string) func(*msgpack.Encoder) error {
+		return func(enc *msgpack.Encoder) error { return enc.EncodeString(s) }
+	}
+	bin := func(b []byte) func(*msgpack.Encoder) error {
+		return func(enc *msgpack.Encoder) error { return enc.EncodeBytes(b) }
+	}
+
+	nonce := func(future string) []byte {
+		return encoded(bin(kid), bin(rnd), func(enc *msgpack.Encoder) error { return enc.EncodeBool(false) }, str(future))
+	}
+	token := func(nonce []byte, future string) []byte {
+		return encoded(
+			raw(nonce),
+			str("loc"),
+			func(enc *msgpack.Encoder) error { return enc.EncodeArrayLen(0) },
+			bin(sign(key, nonce)),
+			str(future),
+			func(enc *msgpack.Encoder) error { return enc.EncodeUint(42) },
+		)
+	}
+
+	tok := token(nonce("nonce-future"), "mac-future")
+
+	m, err := Decode(tok)
+	assert.NoError(t, err)
+	assert.Equal(t, kid, m.Nonce.KID)
+	assert.Equal(t, "loc", m.Location)
+	assert.Equal(t, 1, len(m.Nonce.extra))
+	assert.Equal(t, 2, len(m.extra))
+
+	_, err = m.Verify(key, nil, nil)
+	assert.NoError(t, err)
+
+	n, err := DecodeNonce(tok)
+	assert.NoError(t, err)
+	assert.Equal(t, m.Nonce, n)
+	assert.Equal(t, nonce("nonce-future"), n.MustEncode())
+
+	ts, err := Peek(tok)
+	assert.NoError(t, err)
+	assert.Equal(t, m.Nonce, ts.Nonce)
+
+	// re-encoded byte for byte
+	tok2, err := m.Encode()
+	assert.NoError(t, err)
+	assert.Equal(t, tok, tok2)
+
+	// and preserved through attenuation
+	assert.NoError(t, m.Add(cavParent(ActionRead, 123)))
+	tok2, err = m.Encode()
+	assert.NoError(t, err)
+
+	m2, err := Decode(tok2)
+	assert.NoError(t, err)
+	assert.True(t, m.Equal(m2))
+	assert.Equal(t, m.extra, m2.extra)
+
+	cavs, err := m2.Verify(key, nil, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []Caveat{cavParent(ActionRead, 123)}, cavs.Caveats)
+
+	// unknown nonce fields are covered by the signature
+	m2, err = Decode(token(nonce("nonce-changed"), "mac-future"))
+	assert.NoError(t, err)
+	m2.Tail = m.Tail
+	assert.False(t, m.Equal(m2))
+	_, err = m2.Verify(key, nil, nil)
+	assert.Error(t, err)
+
+	// unknown macaroon fields aren't
+	m2, err = Decode(token(nonce("nonce-future"), "mac-changed"))
+	assert.NoError(t, err)
+	assert.False(t, m.Equal(m2))
+	_, err = m2.Verify(key, nil, nil)
+	assert.NoError(t, err)
+
+	// current format tokens have no unknown fields
+	m, err = New(kid, "loc", key)
+	assert.NoError(t, err)
+	tok, err = m.Encode()
+	assert.NoError(t, err)
+	m2, err = Decode(tok)
+	assert.NoError(t, err)
+	assert.Zero(t, m2.extra)
+	assert.Zero(t, m2.Nonce.extra)
+	_, err = m2.Verify(key, nil, nil)
+	assert.NoError(t, err)
+
+	// missing fields are still an error
+	_, err = Decode(encoded(raw(nonce("")), str("loc")))
+	assert.Error(t, err)
+	_, err = Decode(encoded(raw(encoded(bin(kid))), str("loc"), raw([]byte{0x90}), bin(nil)))
+	assert.Error(t, err)
+}
+
 func dischargeMacaroon(ka EncryptionKey, location string, encodedMacaroon []byte) (bool, []Caveat, *Macaroon, error) {
 	tickets, err := TicketsForThirdParty(encodedMacaroon, location)
 	if err != nil {
@@ -722,10 +925,824 @@ func dischargeMacaroon(ka EncryptionKey, location string, encodedMacaroon []byte
 	return true, dcavs, dm, err
 }
 
+func TestDischargeTrust(t *testing.T) {
+	var (
+		ka    = NewEncryptionKey()
+		other = NewEncryptionKey()
+		dk    = rbuf(32)
+		keys  = []EncryptionKey{other, ka}
+	)
+
+	discharge := func(tb testing.TB, key EncryptionKey, ticket any) *Macaroon {
+		tb.Helper()
+
+		buf, ok := ticket.([]byte)
+		if !ok {
+			var err error
+			buf, err = encode(ticket)
+			assert.NoError(tb, err)
+		}
+
+		m := new(Macaroon)
+		m.Nonce.KID = seal(key, buf)
+		return m
+	}
+
+	var (
+		good     = discharge(t, ka, &wireTicket{DischargeKey: dk})
+		unknown  = discharge(t, NewEncryptionKey(), &wireTicket{DischargeKey: dk})
+		mismatch = discharge(t, ka, &wireTicket{DischargeKey: rbuf(32)})
+		badTkt   = discharge(t, ka, []byte{0xc1}) // 0xc1 is never used by msgpack
+	)
+
+	trusted, err := dischargeTrust(dk, good, keys)
+	assert.NoError(t, err)
+	assert.True(t, trusted)
+
+	trusted, err = dischargeTrust(dk, unknown, keys)
+	assert.NoError(t, err)
+	assert.False(t, trusted)
+
+	// failure modes are indistinguishable
+	_, mismatchErr := dischargeTrust(dk, mismatch, keys)
+	_, badTktErr := dischargeTrust(dk, badTkt, keys)
+	assert.IsError(t, mismatchErr, ErrUntrustedDischarge)
+	assert.Equal(t, mismatchErr, badTktErr)
+
+	// smoke test that failure modes do the same work. This isn't a strict
+	// guarantee, so only log the timings.
+	for name, dm := range map[string]*Macaroon{"unknown": unknown, "mismatch": mismatch, "bad ticket": badTkt} {
+		start := time.Now()
+		for i := 0; i < 1000; i++ {
+			dischargeTrust(dk, dm, keys)
+		}
+		t.Logf("%s: %s", name, time.Since(start))
+	}
+
+	t.Run("debug", func(t *testing.T) {
+		DebugVerification = true
+		t.Cleanup(func() { DebugVerification = false })
+
+		_, mismatchErr := dischargeTrust(dk, mismatch, keys)
+		_, badTktErr := dischargeTrust(dk, badTkt, keys)
+		assert.Equal(t, mismatchErr.Error(), badTktErr.Error())
+
+		var dte *DischargeTrustError
+		assert.True(t, errors.As(mismatchErr, &dte))
+		assert.Contains(t, dte.Debug, "key 0: unseal")
+		assert.Contains(t, dte.Debug, "key 1: discharge key from ticket/VerifierKey mismatch")
+
+		assert.True(t, errors.As(badTktErr, &dte))
+		assert.Contains(t, dte.Debug, "key 1: bad ticket in discharge")
+	})
+}
+
+func TestNestedDischarge(t *testing.T) {
+	var (
+		key  = NewSigningKey()
+		ka1  = NewEncryptionKey()
+		ka2  = NewEncryptionKey()
+		ka3  = NewEncryptionKey()
+		loc1 = "https://tp1"
+		loc2 = "https://tp2"
+		loc3 = "https://tp3"
+	)
+
+	discharge := func(tb testing.TB, m *Macaroon, ka EncryptionKey, loc string, cavs ...Caveat) *Macaroon {
+		tb.Helper()
+
+		ticket, err := m.ThirdPartyTicket(loc)
+		assert.NoError(tb, err)
+
+		_, dm, err := DischargeTicket(ka, loc, ticket)
+		assert.NoError(tb, err)
+		assert.NoError(tb, dm.Add(cavs...))
+
+		return dm
+	}
+
+	encode := func(tb testing.TB, ms ...*Macaroon) [][]byte {
+		tb.Helper()
+
+		ret := make([][]byte, 0, len(ms))
+		for _, m := range ms {
+			tok, err := m.Encode()
+			assert.NoError(tb, err)
+			ret = append(ret, tok)
+		}
+		return ret
+	}
+
+	m, err := New(rbuf(10), "https://api.fly.io", key)
+	assert.NoError(t, err)
+	assert.NoError(t, m.Add3P(ka1, loc1))
+
+	// the discharge for loc1 requires its own discharge from loc2
+	dm1 := discharge(t, m, ka1, loc1, cavParent(ActionRead, 1))
+	assert.NoError(t, dm1.Add3P(ka2, loc2))
+	dm2 := discharge(t, dm1, ka2, loc2, cavChild(ActionRead, 2))
+
+	t.Run("fails fast by default", func(t *testing.T) {
+		_, err := m.Verify(key, encode(t, dm1, dm2), nil)
+		assert.IsError(t, err, ErrDischargeNestingNotSupported)
+
+		// even without the nested discharge
+		_, err = m.Verify(key, encode(t, dm1), nil)
+		assert.IsError(t, err, ErrDischargeNestingNotSupported)
+	})
+
+	t.Run("depth 2", func(t *testing.T) {
+		cs, err := m.Verify(key, encode(t, dm1, dm2), nil, WithMaxDischargeDepth(2))
+		assert.NoError(t, err)
+		assert.Equal(t, NewCaveatSet(cavParent(ActionRead, 1), cavChild(ActionRead, 2)), cs)
+
+		_, err = m.Verify(key, encode(t, dm1), nil, WithMaxDischargeDepth(2))
+		assert.EqualError(t, err, "macaroon verify: verify discharge: no matching discharge token")
+	})
+
+	t.Run("depth 2 limit", func(t *testing.T) {
+		dm1 := discharge(t, m, ka1, loc1)
+		assert.NoError(t, dm1.Add3P(ka2, loc2))
+		dm2 := discharge(t, dm1, ka2, loc2)
+		assert.NoError(t, dm2.Add3P(ka3, loc3))
+		dm3 := discharge(t, dm2, ka3, loc3)
+
+		_, err := m.Verify(key, encode(t, dm1, dm2, dm3), nil, WithMaxDischargeDepth(2))
+		assert.IsError(t, err, ErrDischargeNestingNotSupported)
+
+		_, err = m.Verify(key, encode(t, dm1, dm2, dm3), nil, WithMaxDischargeDepth(3))
+		assert.NoError(t, err)
+	})
+}
+
+func TestVerifyDetailed(t *testing.T) {
+	var (
+		key  = NewSigningKey()
+		ka1  = NewEncryptionKey()
+		ka2  = NewEncryptionKey()
+		loc1 = "https://tp1"
+		loc2 = "https://tp2"
+	)
+
+	m, err := New(rbuf(10), "https://api.fly.io", key)
+	assert.NoError(t, err)
+	assert.NoError(t, m.Add3P(ka1, loc1))
+	assert.NoError(t, m.Add3P(ka2, loc2))
+
+	discharge := func(ka EncryptionKey, loc string, cavs ...Caveat) *Macaroon {
+		ticket, err := m.ThirdPartyTicket(loc)
+		assert.NoError(t, err)
+
+		_, dm, err := DischargeTicket(ka, loc, ticket)
+		assert.NoError(t, err)
+		assert.NoError(t, dm.Add(cavs...))
+
+		// finalize the proof
+		tok, err := dm.Encode()
+		assert.NoError(t, err)
+		dm, err = Decode(tok)
+		assert.NoError(t, err)
+
+		return dm
+	}
+
+	var (
+		dm1 = discharge(ka1, loc1, cavParent(ActionRead, 1))
+		dm2 = discharge(ka2, loc2, cavChild(ActionRead, 2))
+
+		// candidates for loc2 that don't satisfy it
+		badSig     = discharge(ka2, loc2, cavChild(ActionRead, 3))
+		otherToken = discharge(ka2, loc2)
+	)
+
+	badSig.Tail = rbuf(32)
+	otherToken.Nonce.KID = rbuf(10)
+
+	res, err := m.VerifyDetailed(key, []*Macaroon{badSig, otherToken, dm2, dm1}, map[string][]EncryptionKey{loc1: {ka1}})
+	assert.NoError(t, err)
+	assert.Equal(t, NewCaveatSet(cavParent(ActionRead, 1), cavChild(ActionRead, 2)), res.Caveats)
+	assert.Equal(t, map[string]*Macaroon{loc1: dm1, loc2: dm2}, res.Satisfied)
+	assert.Equal(t, map[string]bool{loc1: true, loc2: false}, res.Trusted)
+
+	// Verify returns the same caveats
+	cs, err := m.VerifyParsed(key, []*Macaroon{badSig, dm2, dm1}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, res.Caveats, cs)
+
+	_, err = m.VerifyDetailed(key, []*Macaroon{badSig, dm1}, nil)
+	assert.Error(t, err)
+
+	assert.Equal(t, 64, len(TicketDigest([]byte("ticket"))))
+}
+
 type TestAttestation uint64
 
-func init()                                         { RegisterCaveatType(new(TestAttestation)) }
+func init()                                         { RegisterReservedCaveatType(new(TestAttestation)) }
 func (c *TestAttestation) CaveatType() CaveatType   { return AttestationAuthFlyioUserID }
 func (c *TestAttestation) Name() string             { return "FlyioUserID" }
 func (c *TestAttestation) Prohibits(a Access) error { return ErrBadCaveat }
 func (c *TestAttestation) IsAttestation() bool      { return true }
+
+func TestRequireAttestation(t *testing.T) {
+	var (
+		key  = NewSigningKey()
+		ka   = NewEncryptionKey()
+		ka2  = NewEncryptionKey()
+		loc  = "https://api.fly.io"
+		loc2 = "https://other.fly.io"
+	)
+
+	verify := func(tb testing.TB, ids ...uint64) *CaveatSet {
+		tb.Helper()
+
+		m, err := New(rbuf(10), loc, key)
+		assert.NoError(tb, err)
+		assert.NoError(tb, m.Add(cavParent(ActionRead, 123)))
+
+		trusted := map[string][]EncryptionKey{loc: {ka}, loc2: {ka2}}
+		tpLocs := []string{loc, loc2}
+		tpKeys := []EncryptionKey{ka, ka2}
+
+		var diss [][]byte
+		for i, id := range ids {
+			assert.NoError(tb, m.Add3P(tpKeys[i], tpLocs[i]))
+
+			ticket, err := m.ThirdPartyTicket(tpLocs[i])
+			assert.NoError(tb, err)
+
+			_, dm, err := DischargeTicket(tpKeys[i], tpLocs[i], ticket)
+			assert.NoError(tb, err)
+			assert.NoError(tb, dm.Add(ptr(TestAttestation(id))))
+
+			dtok, err := dm.Encode()
+			assert.NoError(tb, err)
+			diss = append(diss, dtok)
+		}
+
+		tok, err := m.Encode()
+		assert.NoError(tb, err)
+		m, err = Decode(tok)
+		assert.NoError(tb, err)
+
+		cs, err := m.Verify(key, diss, trusted)
+		assert.NoError(tb, err)
+
+		return cs
+	}
+
+	// zero
+	cs := verify(t)
+	_, err := RequireAttestation[*TestAttestation](cs)
+	assert.IsError(t, err, ErrMissingAttestation)
+	assert.Contains(t, err.Error(), "FlyioUserID")
+	assert.Equal(t, 0, len(AttestationsOnly(cs).Caveats))
+	assert.Equal(t, cs, WithoutAttestations(cs))
+
+	// one
+	cs = verify(t, 234)
+	att, err := RequireAttestation[*TestAttestation](cs)
+	assert.NoError(t, err)
+	assert.Equal(t, TestAttestation(234), *att)
+	assert.Equal(t, NewCaveatSet(ptr(TestAttestation(234))), AttestationsOnly(cs))
+	assert.Equal(t, NewCaveatSet(cavParent(ActionRead, 123)), WithoutAttestations(cs))
+
+	// duplicates from different discharges
+	cs = verify(t, 234, 345)
+	_, err = RequireAttestation[*TestAttestation](cs)
+	assert.IsError(t, err, ErrDuplicateAttestation)
+	assert.Equal(t, 2, len(AttestationsOnly(cs).Caveats))
+
+	// attestations decoded from an old version of their schema
+	upgraded := &UpgradedCaveat{Caveat: ptr(TestAttestation(234))}
+	cs = NewCaveatSet(cavParent(ActionRead, 123), upgraded)
+	cs.attest(upgraded, loc)
+	att, err = RequireAttestation[*TestAttestation](cs)
+	assert.NoError(t, err)
+	assert.Equal(t, TestAttestation(234), *att)
+	attLoc, ok := cs.AttestationLocation(att)
+	assert.True(t, ok)
+	assert.Equal(t, loc, attLoc)
+
+	cs = NewCaveatSet(upgraded, ptr(TestAttestation(345)))
+	_, err = RequireAttestation[*TestAttestation](cs)
+	assert.IsError(t, err, ErrDuplicateAttestation)
+}
+
+func TestVerifyToken(t *testing.T) {
+	var (
+		kid   = rbuf(10)
+		key   = NewSigningKey()
+		tpKey = NewEncryptionKey()
+		loc   = "https://api.fly.io"
+		tpLoc = "https://other.fly.io"
+	)
+
+	resolve := func(n Nonce) (SigningKey, map[string][]EncryptionKey, error) {
+		if !bytes.Equal(n.KID, kid) {
+			return nil, nil, ErrUnknownKey
+		}
+		return key, map[string][]EncryptionKey{tpLoc: {tpKey}}, nil
+	}
+
+	m, err := New(kid, loc, key)
+	assert.NoError(t, err)
+	assert.NoError(t, m.Add(cavParent(ActionRead, 123)))
+	assert.NoError(t, m.Add3P(tpKey, tpLoc))
+
+	ticket, err := m.ThirdPartyTicket(tpLoc)
+	assert.NoError(t, err)
+	_, dm, err := DischargeTicket(tpKey, tpLoc, ticket)
+	assert.NoError(t, err)
+	assert.NoError(t, dm.Add(ptr(TestAttestation(234))))
+
+	tok, err := m.Encode()
+	assert.NoError(t, err)
+	dis, err := dm.Encode()
+	assert.NoError(t, err)
+
+	// success, with attestation from trusted third party
+	cs, err := VerifyToken(tok, [][]byte{dis}, resolve)
+	assert.NoError(t, err)
+	assert.Equal(t, NewCaveatSet(cavParent(ActionRead, 123), ptr(TestAttestation(234))).Caveats, cs.Caveats)
+
+	// the attestation's origin is recorded
+	loc, ok := cs.AttestationLocation(cs.Caveats[1])
+	assert.True(t, ok)
+	assert.Equal(t, tpLoc, loc)
+	_, ok = cs.AttestationLocation(cs.Caveats[0])
+	assert.False(t, ok)
+	_, ok = NewCaveatSet(cs.Caveats...).AttestationLocation(cs.Caveats[1])
+	assert.False(t, ok)
+
+	// malformed token
+	_, err = VerifyToken([]byte("bad"), [][]byte{dis}, resolve)
+	assert.IsError(t, err, ErrUnrecognizedToken)
+
+	// unknown KID
+	other, err := New(rbuf(10), loc, key)
+	assert.NoError(t, err)
+	otherTok, err := other.Encode()
+	assert.NoError(t, err)
+	_, err = VerifyToken(otherTok, nil, resolve)
+	assert.IsError(t, err, ErrUnknownKey)
+
+	// resolver returning no key
+	_, err = VerifyToken(tok, [][]byte{dis}, func(Nonce) (SigningKey, map[string][]EncryptionKey, error) {
+		return nil, nil, nil
+	})
+	assert.IsError(t, err, ErrUnknownKey)
+
+	// missing discharge
+	_, err = VerifyToken(tok, nil, resolve)
+	assert.IsError(t, err, ErrMissingDischarge)
+
+	// bad signature
+	_, err = VerifyToken(tok, [][]byte{dis}, func(Nonce) (SigningKey, map[string][]EncryptionKey, error) {
+		return NewSigningKey(), nil, nil
+	})
+	assert.IsError(t, err, ErrInvalidSignature)
+}
+
+func TestNewProof(t *testing.T) {
+	var (
+		kid = rbuf(10)
+		key = NewSigningKey()
+		loc = "https://api.fly.io"
+	)
+
+	m, err := NewProof(kid, loc, key, ptr(TestAttestation(123)))
+	assert.NoError(t, err)
+	assert.True(t, m.Nonce.Proof)
+
+	// unfinalized proofs can't be verified
+	_, err = m.VerifyParsed(key, nil, nil)
+	assert.Error(t, err)
+
+	// caveats can be added until the proof is finalized
+	assert.NoError(t, m.Add(cavParent(ActionRead, 123)))
+
+	buf, err := m.Encode()
+	assert.NoError(t, err)
+
+	// encoding finalizes the proof
+	assert.Error(t, m.Add(cavChild(ActionRead, 234)))
+
+	decoded, err := Decode(buf)
+	assert.NoError(t, err)
+	assert.Error(t, decoded.Add(cavChild(ActionRead, 234)))
+
+	// signing key is the trust root, so attestations are returned
+	cavs, err := decoded.Verify(key, nil, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []Caveat{ptr(TestAttestation(123)), cavParent(ActionRead, 123)}, cavs.Caveats)
+
+	_, err = decoded.Verify(NewSigningKey(), nil, nil)
+	assert.Error(t, err)
+
+	// attestations are ignored during validation
+	assert.NoError(t, cavs.Validate(&testAccess{parentResource: ptr(uint64(123)), action: ActionRead}))
+
+	// non-proofs can't carry attestations
+	m, err = New(kid, loc, key)
+	assert.NoError(t, err)
+	assert.Error(t, m.Add(ptr(TestAttestation(123))))
+}
+
+func TestPending3P(t *testing.T) {
+	var (
+		kid = rbuf(10)
+		key = NewSigningKey()
+		ka  = NewEncryptionKey()
+	)
+
+	// appending a 3p caveat directly would silently produce a token that can
+	// never be verified.
+	m, err := New(kid, "https://api.fly.io", key)
+	assert.NoError(t, err)
+	m.UnsafeCaveats.Caveats = append(m.UnsafeCaveats.Caveats, &Caveat3P{
+		Location: "https://auth.fly.io",
+		Ticket:   seal(ka, []byte("ticket")),
+	})
+
+	_, err = m.Encode()
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "missing verifier key")
+
+	// hand-constructed 3p caveats are rejected by Add
+	m, err = New(kid, "https://api.fly.io", key)
+	assert.NoError(t, err)
+	assert.Error(t, m.Add(&Caveat3P{Location: "https://auth.fly.io"}))
+	assert.Equal(t, 0, len(m.UnsafeCaveats.Caveats))
+
+	// Add3P works
+	assert.NoError(t, m.Add3P(ka, "https://auth.fly.io"))
+	_, err = m.Encode()
+	assert.NoError(t, err)
+
+	// Add3P reports errors from Add
+	assert.Error(t, m.Add3P(ka, "https://auth.fly.io"))
+}
+
+func TestTicketLocation(t *testing.T) {
+	var (
+		ka  = NewEncryptionKey()
+		loc = "https://third-party"
+		cav = &ValidityWindow{NotBefore: 1, NotAfter: 2}
+	)
+
+	m, err := New(rbuf(10), "https://first-party", NewSigningKey())
+	assert.NoError(t, err)
+	assert.NoError(t, m.Add3PWithTicketLocation(ka, loc, cav))
+
+	ticketLoc, cavs, dm, err := DischargeTicketWithLocation(ka, loc, m.TicketsForThirdParty(loc)[0])
+	assert.NoError(t, err)
+	assert.Equal(t, loc, ticketLoc)
+	assert.Equal(t, []Caveat{cav}, cavs)
+	assert.Equal(t, loc, dm.Location)
+
+	t.Run("not recorded by default", func(t *testing.T) {
+		m, err := New(rbuf(10), "https://first-party", NewSigningKey())
+		assert.NoError(t, err)
+		assert.NoError(t, m.Add3P(ka, loc, cav))
+
+		// third parties on older versions decode tickets as a two-field
+		// array, so Add3P mustn't add fields.
+		raw, err := unseal(ka, m.TicketsForThirdParty(loc)[0])
+		assert.NoError(t, err)
+		n, err := msgpack.NewDecoder(bytes.NewReader(raw)).DecodeArrayLen()
+		assert.NoError(t, err)
+		assert.Equal(t, wireTicketNumFields, n)
+
+		ticketLoc, cavs, _, err := DischargeTicketWithLocation(ka, loc, m.TicketsForThirdParty(loc)[0])
+		assert.NoError(t, err)
+		assert.Equal(t, "", ticketLoc)
+		assert.Equal(t, []Caveat{cav}, cavs)
+	})
+
+	t.Run("golden legacy ticket", func(t *testing.T) {
+		// minted by a version of this package from before ticket locations
+		var (
+			goldenKey    = mustB64(t, "NT9iHxixyQBKVCqbxBIlTnaK1dIfboOLsMx2bv90KwQ=")
+			goldenTicket = mustB64(t, "8chyFsL0Rk2PnakWWC8u6Z6jnxqRKM5ogLUnnuYyJlYYMtg/KQjRa9pqveomALybP3MI4eFWaqVE7VyIJTmUP/D05Y4qei9/e5jwwA==")
+		)
+
+		ticketLoc, cavs, dm, err := DischargeTicketWithLocation(goldenKey, loc, goldenTicket)
+		assert.NoError(t, err)
+		assert.Equal(t, "", ticketLoc)
+		assert.Equal(t, []Caveat{&ValidityWindow{NotBefore: 1, NotAfter: 1 << 40}}, cavs)
+		assert.Equal(t, goldenTicket, dm.Nonce.KID)
+	})
+
+	ticket := func(fields ...any) []byte {
+		buf, err := encode(fields)
+		assert.NoError(t, err)
+		return seal(ka, buf)
+	}
+
+	dk := rbuf(SigningKeySize)
+
+	t.Run("legacy", func(t *testing.T) {
+		// tickets without a location are encoded as before it was added
+		legacy, err := encode(&wireTicket{DischargeKey: dk, Caveats: *NewCaveatSet(cav)})
+		assert.NoError(t, err)
+
+		expected, err := encode([]any{dk, NewCaveatSet(cav)})
+		assert.NoError(t, err)
+		assert.Equal(t, expected, legacy)
+
+		ticketLoc, cavs, _, err := DischargeTicketWithLocation(ka, loc, seal(ka, legacy))
+		assert.NoError(t, err)
+		assert.Equal(t, "", ticketLoc)
+		assert.Equal(t, []Caveat{cav}, cavs)
+	})
+
+	t.Run("future fields", func(t *testing.T) {
+		ticketLoc, cavs, _, err := DischargeTicketWithLocation(ka, loc, ticket(dk, NewCaveatSet(cav), loc, "future"))
+		assert.NoError(t, err)
+		assert.Equal(t, loc, ticketLoc)
+		assert.Equal(t, []Caveat{cav}, cavs)
+	})
+
+	t.Run("too few fields", func(t *testing.T) {
+		_, _, _, err := DischargeTicketWithLocation(ka, loc, ticket([]byte("key")))
+		assert.Error(t, err)
+	})
+}
+
+// These tests are most useful when run with the race detector.
+func TestConcurrentReads(t *testing.T) {
+	var (
+		kid = rbuf(10)
+		key = NewSigningKey()
+		ka  = NewEncryptionKey()
+	)
+
+	m, err := New(kid, "loc", key)
+	assert.NoError(t, err)
+	assert.NoError(t, m.Add(cavParent(ActionRead, 123), cavExpiry(time.Hour)))
+	assert.NoError(t, m.Add3P(ka, "tp"))
+
+	_, dm, err := DischargeTicket(ka, "tp", m.TicketsForThirdParty("tp")[0])
+	assert.NoError(t, err)
+	dis, err := dm.Encode()
+	assert.NoError(t, err)
+
+	tok, err := m.Encode()
+	assert.NoError(t, err)
+
+	decoded, err := Decode(tok)
+	assert.NoError(t, err)
+
+	const n = 8
+	errs := make(chan error, 5*n)
+
+	for i := 0; i < n; i++ {
+		go func() {
+			_, err := decoded.Verify(key, [][]byte{dis}, nil)
+			errs <- err
+		}()
+		go func() {
+			enc, err := decoded.Encode()
+			if err == nil && !bytes.Equal(enc, tok) {
+				err = errors.New("encoding changed")
+			}
+			errs <- err
+		}()
+		go func() {
+			if decoded.Expiration().Equal(maxTime) {
+				errs <- errors.New("no expiration")
+				return
+			}
+			errs <- nil
+		}()
+		go func() {
+			if len(decoded.AllThirdPartyTickets()["tp"]) != 1 {
+				errs <- errors.New("missing ticket")
+				return
+			}
+			errs <- nil
+		}()
+		go func() {
+			_, err := decoded.Clone()
+			errs <- err
+		}()
+	}
+
+	for i := 0; i < 5*n; i++ {
+		assert.NoError(t, <-errs)
+	}
+
+	t.Run("encode shares the read lock", func(t *testing.T) {
+		decoded.mu.RLock()
+		defer decoded.mu.RUnlock()
+
+		done := make(chan error, n)
+		for i := 0; i < n; i++ {
+			go func() {
+				_, err := decoded.Encode()
+				done <- err
+			}()
+		}
+
+		for i := 0; i < n; i++ {
+			select {
+			case err := <-done:
+				assert.NoError(t, err)
+			case <-time.After(5 * time.Second):
+				t.Fatal("Encode blocked on a read lock")
+			}
+		}
+	})
+}
+
+func TestConcurrentAdd(t *testing.T) {
+	var (
+		kid = rbuf(10)
+		key = NewSigningKey()
+	)
+
+	m, err := New(kid, "loc", key)
+	assert.NoError(t, err)
+
+	// adds are serialized with each other and with reads, so every caveat is
+	// added and the signature stays valid.
+	const n = 16
+	errs := make(chan error, 2*n)
+
+	for i := 0; i < n; i++ {
+		i := i
+		go func() {
+			errs <- m.Add(cavParent(ActionRead, uint64(i)))
+		}()
+		go func() {
+			_, err := m.Verify(key, nil, nil)
+			errs <- err
+		}()
+	}
+
+	for i := 0; i < 2*n; i++ {
+		assert.NoError(t, <-errs)
+	}
+
+	cavs, err := m.Verify(key, nil, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, n, len(cavs.Caveats))
+
+	t.Run("proof finalization", func(t *testing.T) {
+		m, err := NewProof(kid, "loc", key, ptr(TestAttestation(123)))
+		assert.NoError(t, err)
+
+		encs := make(chan []byte, n)
+		for i := 0; i < n; i++ {
+			go func() {
+				enc, _ := m.Encode()
+				encs <- enc
+			}()
+		}
+
+		first := <-encs
+		for i := 1; i < n; i++ {
+			assert.Equal(t, first, <-encs)
+		}
+
+		decoded, err := Decode(first)
+		assert.NoError(t, err)
+		_, err = decoded.Verify(key, nil, nil)
+		assert.NoError(t, err)
+	})
+}
+
+func TestReissueProof(t *testing.T) {
+	var (
+		key = NewSigningKey()
+		ka  = NewEncryptionKey()
+		loc = "https://tp"
+	)
+
+	m, err := New(rbuf(10), "https://api.fly.io", key)
+	assert.NoError(t, err)
+	assert.NoError(t, m.Add3P(ka, loc))
+
+	ticket, err := m.ThirdPartyTicket(loc)
+	assert.NoError(t, err)
+
+	discharge := func(t *testing.T) *Macaroon {
+		t.Helper()
+
+		_, dm, err := DischargeTicket(ka, loc, ticket)
+		assert.NoError(t, err)
+		assert.NoError(t, dm.Add(cavParent(ActionRead, 1), ptr(TestAttestation(123))))
+
+		tok, err := dm.Encode()
+		assert.NoError(t, err)
+		dm, err = Decode(tok)
+		assert.NoError(t, err)
+
+		return dm
+	}
+
+	verify := func(t *testing.T, dm *Macaroon) (*CaveatSet, error) {
+		t.Helper()
+
+		dtok, err := dm.Encode()
+		assert.NoError(t, err)
+
+		return m.Verify(key, [][]byte{dtok}, map[string][]EncryptionKey{loc: {ka}})
+	}
+
+	t.Run("reissue", func(t *testing.T) {
+		original := discharge(t)
+
+		reissued, err := ReissueProof(ka, loc, ticket, original, ptr(TestAttestation(234)))
+		assert.NoError(t, err)
+		assert.Error(t, reissued.Add(ptr(TestAttestation(345))))
+
+		cs, err := verify(t, reissued)
+		assert.NoError(t, err)
+		assert.Equal(t, []Caveat{cavParent(ActionRead, 1), ptr(TestAttestation(123)), ptr(TestAttestation(234))}, cs.Caveats)
+
+		cs, err = verify(t, original)
+		assert.NoError(t, err)
+		assert.Equal(t, []Caveat{cavParent(ActionRead, 1), ptr(TestAttestation(123))}, cs.Caveats)
+	})
+
+	t.Run("tampered original", func(t *testing.T) {
+		original := discharge(t)
+		original.UnsafeCaveats.Caveats[0] = cavParent(ActionAll, 1)
+
+		_, err := ReissueProof(ka, loc, ticket, original, ptr(TestAttestation(234)))
+		assert.IsError(t, err, ErrInvalidSignature)
+	})
+
+	t.Run("wrong ticket", func(t *testing.T) {
+		m2, err := New(rbuf(10), "https://api.fly.io", key)
+		assert.NoError(t, err)
+		assert.NoError(t, m2.Add3P(ka, loc))
+		ticket2, err := m2.ThirdPartyTicket(loc)
+		assert.NoError(t, err)
+
+		_, err = ReissueProof(ka, loc, ticket2, discharge(t), ptr(TestAttestation(234)))
+		assert.Error(t, err)
+	})
+
+	t.Run("non-attestation extras", func(t *testing.T) {
+		_, err := ReissueProof(ka, loc, ticket, discharge(t), ptr(TestAttestation(234)), cavParent(ActionAll, 1))
+		assert.Error(t, err)
+	})
+}
+
+func TestThirdPartyLocations(t *testing.T) {
+	var (
+		key = NewSigningKey()
+		ka  = NewEncryptionKey()
+	)
+
+	m, err := New(rbuf(10), "loc", key)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(m.ThirdPartyLocations()))
+	assert.False(t, m.HasThirdParty("tp1"))
+	assert.Equal(t, 0, len(m.CaveatTypes()))
+
+	assert.NoError(t, m.Add3P(ka, "tp2"))
+	assert.Equal(t, []string{"tp2"}, m.ThirdPartyLocations())
+	assert.True(t, m.HasThirdParty("tp2"))
+	assert.False(t, m.HasThirdParty("tp1"))
+
+	assert.NoError(t, m.Add3P(ka, "tp1"))
+	assert.Equal(t, []string{"tp1", "tp2"}, m.ThirdPartyLocations())
+
+	// Add3P won't add duplicates, but decoded tokens might have them.
+	dup := *GetCaveats[*Caveat3P](&m.UnsafeCaveats)[0]
+	m.UnsafeCaveats.Caveats = append(m.UnsafeCaveats.Caveats, &dup)
+	assert.Equal(t, []string{"tp1", "tp2"}, m.ThirdPartyLocations())
+	assert.True(t, m.HasThirdParty("tp2"))
+	assert.Equal(t, []CaveatType{Cav3P}, m.CaveatTypes())
+}
+
+func TestCaveatTypes(t *testing.T) {
+	m, err := New(rbuf(10), "loc", NewSigningKey())
+	assert.NoError(t, err)
+
+	assert.NoError(t, m.Add(
+		cavExpiry(time.Hour),
+		cavParent(ActionRead, 1),
+		&ScopedToLocation{Locations: []string{"loc"}, Caveats: NewCaveatSet(cavChild(ActionRead, 2), cavExpiry(time.Minute))},
+		cavParent(ActionRead, 2),
+	))
+
+	assert.Equal(t, []CaveatType{
+		CavValidityWindow,
+		CavScopedToLocation,
+		cavParent(ActionRead, 1).CaveatType(),
+		cavChild(ActionRead, 2).CaveatType(),
+	}, m.CaveatTypes())
+}
+
+func mustB64(tb testing.TB, s string) []byte {
+	tb.Helper()
+
+	buf, err := base64.StdEncoding.DecodeString(s)
+	assert.NoError(tb, err)
+
+	return buf
+}
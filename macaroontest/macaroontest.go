@@ -0,0 +1,203 @@
+// Package macaroontest runs a first party, a third party, and a client in one
+// process for integration tests. It is the recommended starting point for
+// testing services built on this library:
+//
+//	func TestMyService(t *testing.T) {
+//		realm := macaroontest.NewRealm(t)
+//
+//		hdr := realm.Issuer.Mint(myCaveat)
+//		hdr, err := realm.Client.FetchDischargeTokens(ctx, hdr)
+//		// ...
+//		err = realm.Verify(hdr, myAccess)
+//	}
+package macaroontest
+
+import (
+	"context"
+	"crypto/rand"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/superfly/macaroon"
+	"github.com/superfly/macaroon/bundle"
+	"github.com/superfly/macaroon/tp"
+)
+
+// DefaultIssuerLocation is the location of the first party in a Realm.
+const DefaultIssuerLocation = "https://issuer.test"
+
+// DischargePolicy decides whether the third party in a Realm discharges a
+// ticket. It returns the caveats to add to the discharge or an error, which
+// is sent to the client with a 403 status. The request's ticket caveats are
+// available from tp.CaveatsFromRequest.
+type DischargePolicy func(r *http.Request) ([]macaroon.Caveat, error)
+
+// Option configures a Realm returned by NewRealm.
+type Option func(*Realm)
+
+// WithDischargePolicy sets the Realm's initial DischargePolicy. By default,
+// every ticket is discharged without caveats.
+func WithDischargePolicy(p DischargePolicy) Option {
+	return func(r *Realm) {
+		r.policy = p
+	}
+}
+
+// WithClientOptions passes opts to tp.NewClient when creating the Realm's
+// Client.
+func WithClientOptions(opts ...tp.ClientOption) Option {
+	return func(r *Realm) {
+		r.clientOpts = append(r.clientOpts, opts...)
+	}
+}
+
+// Realm is a first party (the Issuer), a third party (the TP), and a tp.Client
+// configured to talk to them. The TP is served by an httptest.Server, which is
+// shut down when the test completes.
+type Realm struct {
+	Issuer *Issuer
+	TP     *tp.TP
+	Client *tp.Client
+
+	server     *httptest.Server
+	policy     DischargePolicy
+	clientOpts []tp.ClientOption
+	m          sync.Mutex
+}
+
+// NewRealm starts a Realm for the duration of the test.
+func NewRealm(tb testing.TB, opts ...Option) *Realm {
+	tb.Helper()
+
+	r := &Realm{
+		policy: func(*http.Request) ([]macaroon.Caveat, error) { return nil, nil },
+	}
+
+	for _, opt := range opts {
+		opt(r)
+	}
+
+	r.server = httptest.NewServer(http.HandlerFunc(r.serveHTTP))
+	tb.Cleanup(r.server.Close)
+
+	store, err := tp.NewMemoryStore(tp.PrefixMunger("/user/"), 100)
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	r.TP = &tp.TP{
+		Location: r.server.URL,
+		Key:      macaroon.NewEncryptionKey(),
+		Store:    store,
+	}
+
+	kid := make([]byte, 16)
+	if _, err := rand.Read(kid); err != nil {
+		tb.Fatal(err)
+	}
+
+	r.Issuer = &Issuer{
+		Location: DefaultIssuerLocation,
+		KID:      kid,
+		Key:      macaroon.NewSigningKey(),
+		realm:    r,
+		tb:       tb,
+	}
+
+	r.Client = tp.NewClient(r.Issuer.Location, r.clientOpts...)
+
+	return r
+}
+
+// SetDischargePolicy replaces the TP's DischargePolicy.
+func (r *Realm) SetDischargePolicy(p DischargePolicy) {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	r.policy = p
+}
+
+func (r *Realm) serveHTTP(w http.ResponseWriter, req *http.Request) {
+	switch path := req.URL.EscapedPath(); {
+	case path == tp.InitPath:
+		r.TP.InitRequestMiddleware(http.HandlerFunc(r.handleInit)).ServeHTTP(w, req)
+	case strings.HasPrefix(path, tp.PollPathPrefix):
+		r.TP.HandlePollRequest(w, req)
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+func (r *Realm) handleInit(w http.ResponseWriter, req *http.Request) {
+	r.m.Lock()
+	policy := r.policy
+	r.m.Unlock()
+
+	cavs, err := policy(req)
+	if err != nil {
+		r.TP.RespondError(w, req, http.StatusForbidden, err.Error())
+		return
+	}
+
+	r.TP.RespondDischarge(w, req, cavs...)
+}
+
+// Verify parses the FlyV1 Authorization header, verifies its tokens with the
+// Issuer's key (trusting the TP's attestations), and validates access against
+// the verified tokens.
+func (r *Realm) Verify(header string, access macaroon.Access) error {
+	bun, err := bundle.ParseBundle(r.Issuer.Location, header)
+	if err != nil {
+		return err
+	}
+
+	kr := bundle.WithKey(r.Issuer.KID, r.Issuer.Key, map[string][]macaroon.EncryptionKey{
+		r.TP.Location: {r.TP.Key},
+	})
+
+	if _, err := bun.Verify(context.Background(), kr); err != nil {
+		return err
+	}
+
+	return bun.Validate(access)
+}
+
+// Issuer is the first party in a Realm.
+type Issuer struct {
+	Location string
+	KID      []byte
+	Key      macaroon.SigningKey
+
+	realm *Realm
+	tb    testing.TB
+}
+
+// Mint returns a FlyV1 Authorization header with a new token carrying the
+// caveats and a third-party caveat for the Realm's TP. The test fails if the
+// token can't be created.
+func (i *Issuer) Mint(caveats ...macaroon.Caveat) string {
+	i.tb.Helper()
+
+	m, err := macaroon.New(i.KID, i.Location, i.Key)
+	if err != nil {
+		i.tb.Fatal(err)
+	}
+
+	if err := m.Add(caveats...); err != nil {
+		i.tb.Fatal(err)
+	}
+
+	if err := m.Add3P(i.realm.TP.Key, i.realm.TP.Location); err != nil {
+		i.tb.Fatal(err)
+	}
+
+	tok, err := m.Encode()
+	if err != nil {
+		i.tb.Fatal(err)
+	}
+
+	return macaroon.ToAuthorizationHeader(tok)
+}
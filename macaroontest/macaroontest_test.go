@@ -0,0 +1,132 @@
+package macaroontest
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/alecthomas/assert/v2"
+	"github.com/superfly/macaroon"
+)
+
+func TestRealm(t *testing.T) {
+	realm := NewRealm(t)
+	ctx := context.Background()
+
+	var (
+		now     = time.Now()
+		expired = &macaroon.ValidityWindow{NotBefore: now.Add(-time.Hour).Unix(), NotAfter: now.Add(-time.Minute).Unix()}
+	)
+
+	hdr := realm.Issuer.Mint()
+
+	// undischarged
+	assert.IsError(t, realm.Verify(hdr, access{}), macaroon.ErrMissingDischarge)
+
+	dhdr, err := realm.Client.FetchDischargeTokens(ctx, hdr)
+	assert.NoError(t, err)
+	assert.NoError(t, realm.Verify(dhdr, access{}))
+
+	// discharge caveats are enforced
+	realm.SetDischargePolicy(func(*http.Request) ([]macaroon.Caveat, error) {
+		return []macaroon.Caveat{expired}, nil
+	})
+
+	dhdr, err = realm.Client.FetchDischargeTokens(ctx, hdr)
+	assert.NoError(t, err)
+	assert.IsError(t, realm.Verify(dhdr, access{}), macaroon.ErrUnauthorized)
+
+	// refusal
+	realm.SetDischargePolicy(func(*http.Request) ([]macaroon.Caveat, error) {
+		return nil, errors.New("go away")
+	})
+
+	_, err = realm.Client.FetchDischargeTokens(ctx, hdr)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "go away")
+}
+
+type access struct{}
+
+func (access) Now() time.Time  { return time.Now() }
+func (access) Validate() error { return nil }
+
+func TestDeterministicRand(t *testing.T) {
+	var (
+		key   = macaroon.SigningKey(bytes.Repeat([]byte{1}, 32))
+		tpKey = macaroon.EncryptionKey(bytes.Repeat([]byte{2}, 32))
+		vw    = &macaroon.ValidityWindow{NotBefore: 1, NotAfter: 2}
+	)
+
+	mint := func(seed uint64) []byte {
+		t.Helper()
+
+		m, err := macaroon.NewWithNonceRand([]byte("kid"), "loc", key, DeterministicRand(seed))
+		assert.NoError(t, err)
+		assert.NoError(t, m.Add(vw))
+		assert.NoError(t, m.Add3P(tpKey, "tp-loc"))
+
+		tok, err := m.Encode()
+		assert.NoError(t, err)
+
+		return tok
+	}
+
+	assert.Equal(t, mint(1), mint(1))
+	assert.NotEqual(t, mint(1), mint(2))
+
+	// still verifies
+	tok := mint(1)
+	m, err := macaroon.Decode(tok)
+	assert.NoError(t, err)
+
+	ticket, err := macaroon.ThirdPartyTicket(tok, "tp-loc")
+	assert.NoError(t, err)
+	_, dm, err := macaroon.DischargeTicket(tpKey, "tp-loc", ticket)
+	assert.NoError(t, err)
+	dis, err := dm.Encode()
+	assert.NoError(t, err)
+
+	cs, err := m.Verify(key, [][]byte{dis}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []*macaroon.ValidityWindow{vw}, macaroon.GetCaveats[*macaroon.ValidityWindow](cs))
+
+	t.Run("proof", func(t *testing.T) {
+		proof := func(seed uint64) []byte {
+			m, err := macaroon.NewProofWithNonceRand([]byte("kid"), "loc", key, DeterministicRand(seed))
+			assert.NoError(t, err)
+
+			tok, err := m.Encode()
+			assert.NoError(t, err)
+
+			return tok
+		}
+
+		assert.Equal(t, proof(1), proof(1))
+		assert.NotEqual(t, proof(1), proof(2))
+	})
+
+	t.Run("stream", func(t *testing.T) {
+		// reads of any size see the same stream
+		a, b := make([]byte, 105), make([]byte, 105)
+		_, err := io.ReadFull(DeterministicRand(3), a)
+		assert.NoError(t, err)
+
+		r := DeterministicRand(3)
+		for i := 0; i < len(b); i += 7 {
+			_, err := io.ReadFull(r, b[i:i+7])
+			assert.NoError(t, err)
+		}
+
+		assert.Equal(t, a, b)
+	})
+
+	t.Run("short reader", func(t *testing.T) {
+		_, err := macaroon.NewWithNonceRand([]byte("kid"), "loc", key, bytes.NewReader([]byte{1, 2, 3}))
+		assert.IsError(t, err, io.ErrUnexpectedEOF)
+	})
+}
@@ -0,0 +1,44 @@
+package macaroontest
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+)
+
+// DeterministicRand returns a reader producing the same stream of bytes for
+// the same seed, for use with macaroon.NewWithNonceRand to mint reproducible
+// test fixtures. The stream is the SHA-256 digests of the seed and a counter,
+// so it doesn't depend on the Go version. It is predictable by design and
+// must never be used to mint production tokens.
+func DeterministicRand(seed uint64) io.Reader {
+	return &deterministicRand{seed: seed}
+}
+
+type deterministicRand struct {
+	seed    uint64
+	counter uint64
+	buf     []byte
+}
+
+func (r *deterministicRand) Read(p []byte) (int, error) {
+	n := 0
+
+	for n < len(p) {
+		if len(r.buf) == 0 {
+			var block [16]byte
+			binary.BigEndian.PutUint64(block[:8], r.seed)
+			binary.BigEndian.PutUint64(block[8:], r.counter)
+			r.counter++
+
+			sum := sha256.Sum256(block[:])
+			r.buf = sum[:]
+		}
+
+		c := copy(p[n:], r.buf)
+		r.buf = r.buf[c:]
+		n += c
+	}
+
+	return n, nil
+}
@@ -25,10 +25,18 @@ type nonceV1Fields struct {
 // opaque value that you, the library caller, provide when you create
 // a token; it's the database key you use to tie the Macaroon to your
 // database.
+//
+// Nonces from newer versions of this library may have fields that this version
+// doesn't know about. These are preserved and re-encoded verbatim. Since the
+// encoded nonce is the first thing signed, a token's signature still covers
+// them and verification isn't affected, but their meaning is ignored.
 type Nonce struct {
 	nonceV0Fields
 	nonceV1Fields
 	version int
+
+	// unknown trailing fields from a newer nonce format
+	extra []msgpack.RawMessage
 }
 
 var (
@@ -54,17 +62,18 @@ func (n Nonce) UUID() uuid.UUID {
 // DecodeMsgpack implements [msgpack.CustomDecoder]
 func (n *Nonce) DecodeMsgpack(d *msgpack.Decoder) error {
 	// we encode structs as arrays, so adding new fields is tricky...
-	// The Closed field was a later addition, so we handle 2 or 3 fields.
+	// The Proof field was a later addition, so we handle 2 or 3 fields. Any
+	// fields beyond those are from a newer format and are kept as raw msgpack.
 
 	nFields, err := d.DecodeArrayLen()
 	if err != nil {
 		return err
 	}
 
-	switch nFields {
-	case 2:
+	switch {
+	case nFields == 2:
 		n.version = nonceV0
-	case 3:
+	case nFields >= 3:
 		n.version = nonceV1
 	default:
 		return fmt.Errorf("unknown nonce format: %d fields", nFields)
@@ -82,6 +91,15 @@ func (n *Nonce) DecodeMsgpack(d *msgpack.Decoder) error {
 		}
 	}
 
+	n.extra = nil
+	for i := 3; i < nFields; i++ {
+		raw, err := d.DecodeRaw()
+		if err != nil {
+			return err
+		}
+		n.extra = append(n.extra, raw)
+	}
+
 	return nil
 }
 
@@ -97,6 +115,10 @@ func (n *Nonce) EncodeMsgpack(e *msgpack.Encoder) error {
 		fields = append(fields, n.Proof)
 	}
 
+	for _, raw := range n.extra {
+		fields = append(fields, raw)
+	}
+
 	return e.Encode(fields)
 }
 
@@ -145,5 +167,6 @@ func newNonce(kid []byte, isProof bool) Nonce {
 			Proof: isProof,
 		},
 		nonceVInvalid - 1,
+		nil,
 	}
 }
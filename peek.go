@@ -0,0 +1,142 @@
+package macaroon
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"github.com/vmihailenco/msgpack/v5"
+	"github.com/vmihailenco/msgpack/v5/msgpcode"
+)
+
+// TokenSummary is the unverified information about a token that Peek
+// extracts.
+type TokenSummary struct {
+	// Nonce is the token's nonce, which includes its KID and whether it is a
+	// proof.
+	Nonce Nonce
+
+	// Location is the token's location.
+	Location string
+
+	// NumCaveats is the number of caveats in the token, not counting those
+	// within wrapper caveats (e.g. resset.IfPresent).
+	NumCaveats int
+
+	// ThirdPartyLocations are the locations of the token's third-party
+	// caveats, in order.
+	ThirdPartyLocations []string
+}
+
+// Peek extracts a TokenSummary from an encoded Macaroon, skipping over caveats
+// other than third-party caveats without decoding them. This is much cheaper
+// than Decode for tokens with many caveats. It is intended for deciding how to
+// handle a token (e.g. which verifier to route it to and which discharges it
+// will need) before verifying it. Because the skipped caveats aren't checked,
+// Peek may succeed for tokens that Decode would reject. For tokens that Decode
+// accepts, the summary matches the decoded Macaroon.
+func Peek(buf []byte) (*TokenSummary, error) {
+	dec := msgpack.NewDecoder(bytes.NewReader(buf))
+
+	// Decode also accepts tokens encoded as maps, which we don't bother
+	// walking ourselves.
+	if c, err := dec.PeekCode(); err == nil && (msgpcode.IsFixedMap(c) || c == msgpcode.Map16 || c == msgpcode.Map32) {
+		m, err := Decode(buf)
+		if err != nil {
+			return nil, fmt.Errorf("macaroon peek: %w", err)
+		}
+
+		return summarize(m), nil
+	}
+
+	ts, err := peek(dec)
+	if err != nil {
+		return nil, fmt.Errorf("macaroon peek: %w", err)
+	}
+
+	return ts, nil
+}
+
+func summarize(m *Macaroon) *TokenSummary {
+	ts := &TokenSummary{
+		Nonce:               m.Nonce,
+		Location:            m.Location,
+		NumCaveats:          len(m.UnsafeCaveats.Caveats),
+		ThirdPartyLocations: []string{},
+	}
+
+	for _, c := range m.UnsafeCaveats.Caveats {
+		if c3p, ok := c.(*Caveat3P); ok {
+			ts.ThirdPartyLocations = append(ts.ThirdPartyLocations, c3p.Location)
+		}
+	}
+
+	return ts
+}
+
+func peek(dec *msgpack.Decoder) (*TokenSummary, error) {
+	ts := &TokenSummary{ThirdPartyLocations: []string{}}
+
+	// Macaroon is encoded as an array of its fields. Fields after the caveats,
+	// including unknown ones from newer formats, are ignored.
+	nFields, err := dec.DecodeArrayLen()
+	if err != nil {
+		return nil, err
+	}
+
+	if nFields < 1 {
+		return ts, nil
+	}
+	if err := dec.Decode(&ts.Nonce); err != nil {
+		return nil, err
+	}
+
+	if nFields < 2 {
+		return ts, nil
+	}
+	if ts.Location, err = dec.DecodeString(); err != nil {
+		return nil, err
+	}
+
+	if nFields < 3 {
+		return ts, nil
+	}
+
+	// see CaveatSet.DecodeMsgpack
+	aLen, err := dec.DecodeArrayLen()
+	switch {
+	case err != nil:
+		return nil, err
+	case aLen == -1:
+		aLen = 0
+	case aLen%2 != 0:
+		return nil, errors.New("bad caveat container")
+	}
+
+	ts.NumCaveats = aLen / 2
+	if err := checkMaxCaveats(ts.NumCaveats); err != nil {
+		return nil, err
+	}
+
+	for i := 0; i < ts.NumCaveats; i++ {
+		t, err := dec.DecodeUint()
+		if err != nil {
+			return nil, err
+		}
+
+		if CaveatType(t) != Cav3P {
+			if err := dec.Skip(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		var c3p Caveat3P
+		if err := dec.Decode(&c3p); err != nil {
+			return nil, err
+		}
+		ts.ThirdPartyLocations = append(ts.ThirdPartyLocations, c3p.Location)
+	}
+
+	return ts, nil
+}
@@ -0,0 +1,115 @@
+package macaroon
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/alecthomas/assert/v2"
+)
+
+func TestPeek(t *testing.T) {
+	var (
+		ka1 = NewEncryptionKey()
+		ka2 = NewEncryptionKey()
+	)
+
+	m, err := New(rbuf(10), "https://api.fly.io", NewSigningKey())
+	assert.NoError(t, err)
+	assert.NoError(t, m.Add(cavParent(ActionRead, 1), cavExpiry(time.Hour)))
+	assert.NoError(t, m.Add3P(ka1, "https://auth1.test", cavChild(ActionRead, 2)))
+	assert.NoError(t, m.Add(cavChild(ActionRead, 3)))
+	assert.NoError(t, m.Add3P(ka2, "https://auth2.test"))
+
+	tok, err := m.Encode()
+	assert.NoError(t, err)
+
+	ts, err := Peek(tok)
+	assert.NoError(t, err)
+	assert.Equal(t, &TokenSummary{
+		Nonce:               m.Nonce,
+		Location:            "https://api.fly.io",
+		NumCaveats:          5,
+		ThirdPartyLocations: []string{"https://auth1.test", "https://auth2.test"},
+	}, ts)
+	assertPeekMatchesDecode(t, tok)
+
+	_, err = Peek(tok[:len(tok)/2])
+	assert.Error(t, err)
+
+	_, err = Peek(nil)
+	assert.Error(t, err)
+}
+
+func FuzzPeek(f *testing.F) {
+	for _, n := range []int{0, 1, 10} {
+		m, err := New(rbuf(10), "x", NewSigningKey())
+		assert.NoError(f, err)
+
+		for i := 0; i < n; i++ {
+			assert.NoError(f, m.Add(cavParent(ActionRead, uint64(i))))
+			assert.NoError(f, m.Add3P(NewEncryptionKey(), fmt.Sprintf("https://auth%d.test", i), cavChild(ActionRead, uint64(i))))
+		}
+
+		tok, err := m.Encode()
+		assert.NoError(f, err)
+
+		f.Add(tok)
+		f.Add(fuzz(tok))
+	}
+
+	f.Fuzz(assertPeekMatchesDecode)
+}
+
+func BenchmarkPeek(b *testing.B) {
+	m, err := New(rbuf(10), "x", NewSigningKey())
+	assert.NoError(b, err)
+
+	for i := 0; i < 199; i++ {
+		assert.NoError(b, m.Add(cavParent(ActionRead, uint64(i))))
+	}
+	assert.NoError(b, m.Add3P(NewEncryptionKey(), "y"))
+
+	tok, err := m.Encode()
+	assert.NoError(b, err)
+
+	b.Run("peek", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			_, _ = Peek(tok)
+		}
+	})
+
+	b.Run("decode", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			_, _ = Decode(tok)
+		}
+	})
+}
+
+// assertPeekMatchesDecode checks that Peek agrees with Decode if Decode
+// succeeds.
+func assertPeekMatchesDecode(t *testing.T, tok []byte) {
+	t.Helper()
+
+	m, err := Decode(tok)
+	if err != nil {
+		return
+	}
+
+	ts, err := Peek(tok)
+	assert.NoError(t, err)
+
+	locs := []string{}
+	for _, c := range m.UnsafeCaveats.Caveats {
+		if c3p, ok := c.(*Caveat3P); ok {
+			locs = append(locs, c3p.Location)
+		}
+	}
+
+	assert.Equal(t, &TokenSummary{
+		Nonce:               m.Nonce,
+		Location:            m.Location,
+		NumCaveats:          len(m.UnsafeCaveats.Caveats),
+		ThirdPartyLocations: locs,
+	}, ts)
+}
@@ -3,8 +3,10 @@ package resset
 import (
 	"encoding/json"
 	"fmt"
+	"strings"
 
 	"github.com/superfly/macaroon"
+	msgpack "github.com/vmihailenco/msgpack/v5"
 )
 
 // Action is an RWX-style bitmap of actions that can be taken on a resource
@@ -93,7 +95,95 @@ func (a Action) String() string {
 	return string(str)
 }
 
+// DescribeAction returns a human description of the action (e.g.
+// "read-write"). See Action.String for the compact form.
+func DescribeAction(a Action) string {
+	switch {
+	case a == ActionNone:
+		return "none"
+	case IsSubsetOf(ActionAll, a):
+		return "all"
+	}
+
+	return strings.Join(a.Verbs(), "-")
+}
+
+// Verbs returns the long form of the action (e.g. ["read", "write"]). See
+// ActionFromVerbs.
+func (a Action) Verbs() []string {
+	verbs := []string{}
+
+	for _, av := range actionVerbs {
+		if a&av.action != 0 {
+			verbs = append(verbs, av.verb)
+		}
+	}
+
+	return verbs
+}
+
+// ActionFromVerbs parses the long form of an action returned by Action.Verbs.
+// Unlike ActionFromString, unrecognized verbs are an error.
+func ActionFromVerbs(verbs []string) (Action, error) {
+	var ret Action
+
+outer:
+	for _, verb := range verbs {
+		for _, av := range actionVerbs {
+			if av.verb == verb {
+				ret |= av.action
+				continue outer
+			}
+		}
+
+		return ActionNone, fmt.Errorf("unknown action verb %q", verb)
+	}
+
+	return ret, nil
+}
+
+var actionVerbs = []struct {
+	action Action
+	verb   string
+}{
+	{ActionRead, "read"},
+	{ActionWrite, "write"},
+	{ActionCreate, "create"},
+	{ActionDelete, "delete"},
+	{ActionControl, "control"},
+}
+
+// MarshalText implements encoding.TextMarshaler using the compact form (see
+// Action.String).
+func (a Action) MarshalText() ([]byte, error) {
+	return []byte(a.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler using the compact form
+// (see ActionFromString).
+func (a *Action) UnmarshalText(b []byte) error {
+	*a = ActionFromString(string(b))
+	return nil
+}
+
+// UnmarshalJSON implements json.Unmarshaler. It accepts either the compact
+// form (e.g. "rw") or an array of verbs (e.g. ["read", "write"]).
 func (a *Action) UnmarshalJSON(b []byte) error {
+	if len(b) > 0 && b[0] == '[' {
+		var verbs []string
+		if err := json.Unmarshal(b, &verbs); err != nil {
+			return err
+		}
+
+		m, err := ActionFromVerbs(verbs)
+		if err != nil {
+			return err
+		}
+
+		*a = m
+		return nil
+	}
+
 	mask := ""
 
 	if err := json.Unmarshal(b, &mask); err != nil {
@@ -106,12 +196,35 @@ func (a *Action) UnmarshalJSON(b []byte) error {
 	return nil
 }
 
+// MarshalJSON implements json.Marshaler using the compact form.
 func (a Action) MarshalJSON() ([]byte, error) {
 	return json.Marshal(a.String())
 }
 
+var (
+	_ msgpack.CustomEncoder = ActionNone
+	_ msgpack.CustomDecoder = (*Action)(nil)
+)
+
+// EncodeMsgpack implements msgpack.CustomEncoder. Actions are encoded as
+// integers. This keeps msgpack from using MarshalText.
+func (a Action) EncodeMsgpack(enc *msgpack.Encoder) error {
+	return enc.Encode(uint16(a))
+}
+
+// DecodeMsgpack implements msgpack.CustomDecoder.
+func (a *Action) DecodeMsgpack(dec *msgpack.Decoder) error {
+	var m uint16
+	if err := dec.Decode(&m); err != nil {
+		return err
+	}
+
+	*a = Action(m)
+	return nil
+}
+
 // Implements macaroon.Caveat
-func init()                                       { macaroon.RegisterCaveatType(new(Action)) }
+func init()                                       { macaroon.RegisterCaveatConstructor(func() macaroon.Caveat { return new(Action) }) }
 func (c *Action) CaveatType() macaroon.CaveatType { return macaroon.CavAction }
 func (c *Action) Name() string                    { return "Action" }
 
@@ -127,3 +240,8 @@ func (c *Action) Prohibits(a macaroon.Access) error {
 		return nil
 	}
 }
+
+// Implements macaroon.DescribableCaveat
+func (c *Action) Describe() string {
+	return fmt.Sprintf("Restricts actions to %s", DescribeAction(*c))
+}
@@ -1,10 +1,12 @@
 package resset
 
 import (
+	"encoding/json"
 	"testing"
 
 	"github.com/alecthomas/assert/v2"
 	"github.com/superfly/macaroon"
+	"github.com/vmihailenco/msgpack/v5"
 )
 
 func TestActionCaveat(t *testing.T) {
@@ -17,3 +19,62 @@ func TestActionCaveat(t *testing.T) {
 		ErrUnauthorizedForAction,
 	)
 }
+
+func TestActionVerbs(t *testing.T) {
+	assert.Equal(t, []string{"read", "write", "create", "delete", "control"}, ActionAll.Verbs())
+	assert.Equal(t, []string{}, ActionNone.Verbs())
+
+	for _, a := range []Action{ActionNone, ActionRead, ActionRead | ActionControl, ActionAll} {
+		rt, err := ActionFromVerbs(a.Verbs())
+		assert.NoError(t, err)
+		assert.Equal(t, a, rt)
+	}
+
+	_, err := ActionFromVerbs([]string{"read", "execute"})
+	assert.EqualError(t, err, `unknown action verb "execute"`)
+}
+
+func TestActionJSON(t *testing.T) {
+	var a Action
+	assert.NoError(t, json.Unmarshal([]byte(`"rwC"`), &a))
+	assert.Equal(t, ActionRead|ActionWrite|ActionControl, a)
+
+	assert.NoError(t, json.Unmarshal([]byte(`["read","control"]`), &a))
+	assert.Equal(t, ActionRead|ActionControl, a)
+
+	assert.Error(t, json.Unmarshal([]byte(`["read","bogus"]`), &a))
+	assert.Error(t, json.Unmarshal([]byte(`[1]`), &a))
+
+	// canonical form is compact
+	b, err := json.Marshal(ActionRead | ActionControl)
+	assert.NoError(t, err)
+	assert.Equal(t, `"rC"`, string(b))
+
+	// mixed forms within a caveat
+	var ip IfPresent
+	assert.NoError(t, json.Unmarshal([]byte(`{"ifs":[{"type":"Action","body":["read"]}],"else":"rw"}`), &ip))
+	assert.Equal(t, ActionRead|ActionWrite, ip.Else)
+	assert.Equal(t, []macaroon.Caveat{ptr(ActionRead)}, ip.Ifs.Caveats)
+
+	text, err := (ActionRead | ActionDelete).MarshalText()
+	assert.NoError(t, err)
+	assert.Equal(t, "rd", string(text))
+	assert.NoError(t, a.UnmarshalText([]byte("wc")))
+	assert.Equal(t, ActionWrite|ActionCreate, a)
+}
+
+func TestActionMsgpack(t *testing.T) {
+	// wire format is unchanged by MarshalText
+	for _, a := range []Action{ActionNone, ActionRead, ActionAll, 0xffff} {
+		b, err := msgpack.Marshal(struct{ A Action }{a})
+		assert.NoError(t, err)
+
+		expected, err := msgpack.Marshal(struct{ A uint16 }{uint16(a)})
+		assert.NoError(t, err)
+		assert.Equal(t, expected, b)
+
+		var rt struct{ A Action }
+		assert.NoError(t, msgpack.Unmarshal(b, &rt))
+		assert.Equal(t, a, rt.A)
+	}
+}
@@ -7,8 +7,20 @@ import (
 )
 
 var (
-	ErrResourceUnspecified        = fmt.Errorf("%w: must specify", macaroon.ErrInvalidAccess)
+	// ErrResourceUnspecified is a denial from a caveat constraining access to a
+	// type of resource that the Access doesn't specify. IfPresent treats it as
+	// the caveat not applying. It is the same as
+	// macaroon.ErrResourceUnspecified.
+	ErrResourceUnspecified = macaroon.ErrResourceUnspecified
+
+	// ErrResourcesMutuallyExclusive is an invalid Access specifying resources
+	// that can't be accessed together.
 	ErrResourcesMutuallyExclusive = fmt.Errorf("%w: resources are mutually exclusive", macaroon.ErrInvalidAccess)
-	ErrUnauthorizedForResource    = fmt.Errorf("%w for", macaroon.ErrUnauthorized)
-	ErrUnauthorizedForAction      = fmt.Errorf("%w for", macaroon.ErrUnauthorized)
+
+	// ErrExceedsMaxAction is returned when a BoundedResourceSet grants more
+	// than its MaxAction. See NewBounded.
+	ErrExceedsMaxAction = fmt.Errorf("%w: permission exceeds maximum", macaroon.ErrBadCaveat)
+
+	ErrUnauthorizedForResource = fmt.Errorf("%w for", macaroon.ErrUnauthorized)
+	ErrUnauthorizedForAction   = fmt.Errorf("%w for", macaroon.ErrUnauthorized)
 )
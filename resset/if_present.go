@@ -3,6 +3,7 @@ package resset
 import (
 	"errors"
 	"fmt"
+	"strings"
 
 	"github.com/superfly/macaroon"
 	"github.com/superfly/macaroon/internal/merr"
@@ -23,7 +24,7 @@ type IfPresent struct {
 
 var _ macaroon.WrapperCaveat = (*IfPresent)(nil)
 
-func init()                                          { macaroon.RegisterCaveatType(&IfPresent{}) }
+func init()                                          { macaroon.RegisterCaveatConstructor(func() macaroon.Caveat { return &IfPresent{} }) }
 func (c *IfPresent) CaveatType() macaroon.CaveatType { return macaroon.CavIfPresent }
 func (c *IfPresent) Name() string                    { return "IfPresent" }
 
@@ -36,11 +37,19 @@ func (c *IfPresent) Prohibits(a macaroon.Access) error {
 	var (
 		err      error
 		ifBranch bool
+		ifs      []macaroon.Caveat
 	)
 
-	for _, cc := range c.Ifs.Caveats {
+	if c.Ifs != nil {
+		ifs = c.Ifs.Caveats
+	}
+
+	for _, cc := range ifs {
 		// set err if any of the `Ifs` returns nil or a non-errResourceUnspecified error
 		if cErr := cc.Prohibits(ra); !errors.Is(cErr, ErrResourceUnspecified) {
+			if cErr != nil {
+				cErr = &macaroon.CaveatError{Caveat: cc, Access: a, Err: cErr}
+			}
 			err = merr.Append(err, cErr)
 			ifBranch = true
 		}
@@ -53,6 +62,77 @@ func (c *IfPresent) Prohibits(a macaroon.Access) error {
 	return err
 }
 
+// Describe implements macaroon.DescribableCaveat. The wrapped caveats are
+// described separately by macaroon.DescribeCaveatSet.
+func (c *IfPresent) Describe() string {
+	return fmt.Sprintf("Applies the following if their resources are specified, otherwise allows %s", DescribeAction(c.Else))
+}
+
 func (c *IfPresent) Unwrap() *macaroon.CaveatSet {
 	return c.Ifs
 }
+
+// ExplainDenial implements macaroon.DenialExplainer by explaining the denials
+// of the wrapped caveats.
+func (c *IfPresent) ExplainDenial(err *macaroon.CaveatError, resolve macaroon.NameResolver) string {
+	return strings.Join(macaroon.ExplainDenial(err.Err, resolve), " ")
+}
+
+// Require is like IfPresent, but rejects accesses that don't specify any of the
+// resources relevant to the wrapped caveats rather than falling back to an
+// Else permission. It fails with ErrResourceUnspecified in that case. This
+// makes it possible to restrict a token to accesses involving a given type of
+// resource (e.g. cluster-only tokens).
+//
+// As with IfPresent, wrapped caveats returning ErrResourceUnspecified are
+// ignored as long as at least one of the wrapped caveats' resources is
+// specified. The Access must implement the resset.Access interface.
+type Require struct {
+	Caveats *macaroon.CaveatSet `json:"caveats"`
+}
+
+var _ macaroon.WrapperCaveat = (*Require)(nil)
+
+func init()                                        { macaroon.RegisterCaveatConstructor(func() macaroon.Caveat { return &Require{} }) }
+func (c *Require) CaveatType() macaroon.CaveatType { return macaroon.CavRequire }
+func (c *Require) Name() string                    { return "Require" }
+
+func (c *Require) Prohibits(a macaroon.Access) error {
+	ra, ok := a.(Access)
+	if !ok {
+		return macaroon.ErrInvalidAccess
+	}
+
+	var (
+		err     error
+		present bool
+		cavs    []macaroon.Caveat
+	)
+
+	if c.Caveats != nil {
+		cavs = c.Caveats.Caveats
+	}
+
+	for _, cc := range cavs {
+		if cErr := cc.Prohibits(ra); !errors.Is(cErr, ErrResourceUnspecified) {
+			err = merr.Append(err, cErr)
+			present = true
+		}
+	}
+
+	if !present {
+		return fmt.Errorf("%w resources required by Require caveat", ErrResourceUnspecified)
+	}
+
+	return err
+}
+
+// Describe implements macaroon.DescribableCaveat. The wrapped caveats are
+// described separately by macaroon.DescribeCaveatSet.
+func (c *Require) Describe() string {
+	return "Applies the following and requires their resources to be specified"
+}
+
+func (c *Require) Unwrap() *macaroon.CaveatSet {
+	return c.Caveats
+}
@@ -51,4 +51,73 @@ func TestIfPresent(t *testing.T) {
 	// hit else block (failure)
 	no(ErrUnauthorizedForAction, &testAccess{ParentResource: ptr(uint64(123)), Action: ActionWrite})   // action allowed earlier, disallowed by else
 	no(ErrUnauthorizedForAction, &testAccess{ParentResource: ptr(uint64(123)), Action: ActionControl}) // action only allowed by if
+
+	// nil Ifs (e.g. decoded from a nil array) only applies else
+	cavs = []macaroon.Caveat{&IfPresent{Else: ActionRead}}
+	yes(&testAccess{ParentResource: ptr(uint64(123)), Action: ActionRead})
+	no(ErrUnauthorizedForAction, &testAccess{ParentResource: ptr(uint64(123)), Action: ActionWrite})
+}
+
+func TestRequire(t *testing.T) {
+	child := cavChild(ActionRead|ActionDelete, 234)
+
+	var (
+		ifPresent = macaroon.NewCaveatSet(&IfPresent{Ifs: macaroon.NewCaveatSet(child), Else: ActionNone})
+		require   = macaroon.NewCaveatSet(&Require{Caveats: macaroon.NewCaveatSet(child)})
+	)
+
+	// present
+	present := &testAccess{ParentResource: ptr(uint64(123)), ChildResource: ptr(uint64(234)), Action: ActionRead}
+	assert.NoError(t, ifPresent.Validate(present))
+	assert.NoError(t, require.Validate(present))
+
+	// present, but wrong action
+	wrongAction := &testAccess{ParentResource: ptr(uint64(123)), ChildResource: ptr(uint64(234)), Action: ActionWrite}
+	assert.IsError(t, ifPresent.Validate(wrongAction), ErrUnauthorizedForAction)
+	assert.IsError(t, require.Validate(wrongAction), ErrUnauthorizedForAction)
+
+	// mismatched
+	mismatched := &testAccess{ParentResource: ptr(uint64(123)), ChildResource: ptr(uint64(876)), Action: ActionRead}
+	assert.IsError(t, ifPresent.Validate(mismatched), ErrUnauthorizedForResource)
+	assert.IsError(t, require.Validate(mismatched), ErrUnauthorizedForResource)
+
+	// absent, with no action. IfPresent falls through to Else, which allows
+	// nothing, but there's nothing being asked for.
+	absent := &testAccess{ParentResource: ptr(uint64(123)), Action: ActionNone}
+	assert.NoError(t, ifPresent.Validate(absent))
+	assert.IsError(t, require.Validate(absent), ErrResourceUnspecified)
+
+	// absent, with an action
+	absent.Action = ActionRead
+	assert.IsError(t, ifPresent.Validate(absent), ErrUnauthorizedForAction)
+	assert.IsError(t, require.Validate(absent), ErrResourceUnspecified)
+
+	// only one of several resources needs to be present
+	require = macaroon.NewCaveatSet(&Require{Caveats: macaroon.NewCaveatSet(child, cavParent(ActionRead, 123))})
+	assert.NoError(t, require.Validate(&testAccess{ParentResource: ptr(uint64(123)), Action: ActionRead}))
+
+	// nil caveats require nothing that can be specified
+	require = macaroon.NewCaveatSet(&Require{})
+	assert.IsError(t, require.Validate(present), ErrResourceUnspecified)
+}
+
+func TestDescribeIfPresent(t *testing.T) {
+	cs := macaroon.NewCaveatSet(
+		ptr(ActionRead|ActionWrite),
+		&IfPresent{
+			Ifs: macaroon.NewCaveatSet(
+				cavChild(ActionRead, 234),
+				&IfPresent{Ifs: macaroon.NewCaveatSet(ptr(ActionRead)), Else: ActionNone},
+			),
+			Else: ActionAll,
+		},
+	)
+
+	assert.Equal(t, []string{
+		"Restricts actions to read-write",
+		"Applies the following if their resources are specified, otherwise allows all",
+		"  ChildResource (no description)",
+		"  Applies the following if their resources are specified, otherwise allows none",
+		"    Restricts actions to read",
+	}, macaroon.DescribeCaveatSet(cs))
 }
@@ -0,0 +1,330 @@
+package resset
+
+import (
+	"encoding/json"
+	"math/rand"
+	"reflect"
+	"testing"
+	"testing/quick"
+
+	"github.com/alecthomas/assert/v2"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Property-based tests for the laws that Action and ResourceSet operations are
+// expected to obey. Properties that the current code violates are kept, but
+// skipped with a note on the violation, rather than being weakened.
+
+var quickConfig = &quick.Config{MaxCount: 2000}
+
+func checkProperty(t *testing.T, f any) {
+	t.Helper()
+
+	if err := quick.Check(f, quickConfig); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestActionProperties(t *testing.T) {
+	t.Run("remove is disjoint from removed", func(t *testing.T) {
+		checkProperty(t, func(a, b Action) bool {
+			return Remove(a, b)&b == 0
+		})
+	})
+
+	t.Run("remove partitions", func(t *testing.T) {
+		checkProperty(t, func(a, b Action) bool {
+			return Remove(a, b)|(a&b) == a && IsSubsetOf(Remove(a, b), a)
+		})
+	})
+
+	t.Run("subset reflexive", func(t *testing.T) {
+		checkProperty(t, func(a Action) bool {
+			return IsSubsetOf(a, a) && IsSubsetOf(ActionNone, a)
+		})
+	})
+
+	t.Run("subset transitive", func(t *testing.T) {
+		checkProperty(t, func(a, x, y Action) bool {
+			b := a | x
+			c := b | y
+			return IsSubsetOf(a, b) && IsSubsetOf(b, c) && IsSubsetOf(a, c)
+		})
+	})
+
+	t.Run("subset antisymmetric", func(t *testing.T) {
+		checkProperty(t, func(a, b Action) bool {
+			return !(IsSubsetOf(a, b) && IsSubsetOf(b, a)) || a == b
+		})
+	})
+
+	t.Run("subset iff remove is empty", func(t *testing.T) {
+		checkProperty(t, func(a, b Action) bool {
+			return IsSubsetOf(a, b) == (Remove(a, b) == ActionNone)
+		})
+	})
+
+	t.Run("string round trip", func(t *testing.T) {
+		checkProperty(t, func(a knownAction) bool {
+			return ActionFromString(Action(a).String()) == Action(a)
+		})
+	})
+
+	t.Run("string round trip with unknown bits", func(t *testing.T) {
+		// Action.String only has characters for the known actions, so bits
+		// outside of ActionAll are dropped.
+		t.Skip("known violation: Action.String drops bits outside ActionAll")
+
+		checkProperty(t, func(a Action) bool {
+			return ActionFromString(a.String()) == a
+		})
+	})
+
+	t.Run("verbs round trip", func(t *testing.T) {
+		checkProperty(t, func(a knownAction) bool {
+			m, err := ActionFromVerbs(Action(a).Verbs())
+			return err == nil && m == Action(a)
+		})
+	})
+
+	t.Run("msgpack round trip", func(t *testing.T) {
+		checkProperty(t, func(a Action) bool {
+			var a2 Action
+			b, err := msgpack.Marshal(a)
+			return err == nil && msgpack.Unmarshal(b, &a2) == nil && a == a2
+		})
+	})
+
+	t.Run("json round trip", func(t *testing.T) {
+		checkProperty(t, func(a knownAction) bool {
+			var a2 Action
+			b, err := json.Marshal(Action(a))
+			return err == nil && json.Unmarshal(b, &a2) == nil && Action(a) == a2
+		})
+	})
+}
+
+func TestResourceSetProperties(t *testing.T) {
+	t.Run("uint64", testResourceSetProperties[uint64])
+	t.Run("string", testResourceSetProperties[string])
+	t.Run("prefix", testResourceSetProperties[Prefix])
+}
+
+func testResourceSetProperties[I ID](t *testing.T) {
+	allows := func(rs ResourceSet[I, Action], id I, a Action) bool {
+		return rs.Prohibits(&id, a, "thing") == nil
+	}
+
+	_, isPrefix := any(ZeroID[I]()).(Prefix)
+
+	t.Run("shrinking masks is monotonic", func(t *testing.T) {
+		checkProperty(t, func(rs validSet[I], id randID[I], a, shrink knownAction) bool {
+			shrunk := ResourceSet[I, Action]{}
+			for k, m := range rs.Set {
+				shrunk[k] = m & Action(shrink)
+			}
+
+			return allows(rs.Set, id.ID, Action(a)) || !allows(shrunk, id.ID, Action(a))
+		})
+	})
+
+	t.Run("removing ids is monotonic", func(t *testing.T) {
+		if isPrefix {
+			// The permissions of all matching prefixes are combined, so
+			// removing one prefix can widen the permission for IDs that
+			// another also matches (e.g. {"a": r, "ab": rw} allows "abc"
+			// read, while {"ab": rw} allows it read and write).
+			t.Skip("known violation: removing a prefix can widen permissions for IDs matching overlapping prefixes")
+		}
+
+		checkProperty(t, func(rs validSet[I], id randID[I], a knownAction, drop randID[I]) bool {
+			removed := ResourceSet[I, Action]{}
+			for k, m := range rs.Set {
+				if k != drop.ID {
+					removed[k] = m
+				}
+			}
+
+			return allows(rs.Set, id.ID, Action(a)) || !allows(removed, id.ID, Action(a))
+		})
+	})
+
+	t.Run("unspecified resources are prohibited", func(t *testing.T) {
+		checkProperty(t, func(rs validSet[I], a knownAction) bool {
+			return rs.Set.Prohibits(nil, Action(a), "thing") != nil
+		})
+	})
+
+	t.Run("zero id is a wildcard", func(t *testing.T) {
+		checkProperty(t, func(m knownAction, id randID[I], a knownAction) bool {
+			rs := ResourceSet[I, Action]{ZeroID[I](): Action(m)}
+			return allows(rs, id.ID, Action(a)) == IsSubsetOf(Action(a), Action(m))
+		})
+	})
+
+	t.Run("zero id with others is prohibited", func(t *testing.T) {
+		checkProperty(t, func(rs validSet[I], m knownAction, id randID[I], a knownAction) bool {
+			if len(rs.Set) == 0 || rs.hasZero() {
+				return true
+			}
+
+			withZero := ResourceSet[I, Action]{ZeroID[I](): Action(m)}
+			for k, v := range rs.Set {
+				withZero[k] = v
+			}
+
+			return !allows(withZero, id.ID, Action(a))
+		})
+	})
+
+	t.Run("prohibits agrees with permFor", func(t *testing.T) {
+		checkProperty(t, func(rs validSet[I], id randID[I], a knownAction) bool {
+			perm, found := rs.Set.permFor(id.ID)
+			return allows(rs.Set, id.ID, Action(a)) == (found && IsSubsetOf(Action(a), perm))
+		})
+	})
+
+	t.Run("intersect allows only what both allow", func(t *testing.T) {
+		checkProperty(t, func(rs1, rs2 validSet[I], id randID[I], a knownAction) bool {
+			return !allows(Intersect(rs1.Set, rs2.Set), id.ID, Action(a)) ||
+				(allows(rs1.Set, id.ID, Action(a)) && allows(rs2.Set, id.ID, Action(a)))
+		})
+	})
+
+	t.Run("msgpack round trip", func(t *testing.T) {
+		checkProperty(t, func(rs anySet[I]) bool {
+			b, err := msgpack.Marshal(rs.Set)
+			if err != nil {
+				return false
+			}
+
+			var rs2 ResourceSet[I, Action]
+			if err := msgpack.Unmarshal(b, &rs2); err != nil {
+				return false
+			}
+
+			return rs.Set.Equal(rs2)
+		})
+	})
+
+	t.Run("json round trip", func(t *testing.T) {
+		checkProperty(t, func(rs anySet[I]) bool {
+			b, err := json.Marshal(rs.Set)
+			if err != nil {
+				return false
+			}
+
+			var rs2 ResourceSet[I, Action]
+			if err := json.Unmarshal(b, &rs2); err != nil {
+				return false
+			}
+
+			return rs.Set.Equal(rs2)
+		})
+	})
+
+	t.Run("encoding is canonical", func(t *testing.T) {
+		checkProperty(t, func(rs anySet[I]) bool {
+			cp := ResourceSet[I, Action]{}
+			for k, v := range rs.Set {
+				cp[k] = v
+			}
+
+			b1, err1 := msgpack.Marshal(rs.Set)
+			b2, err2 := msgpack.Marshal(cp)
+			j1, err3 := json.Marshal(rs.Set)
+			j2, err4 := json.Marshal(cp)
+
+			return err1 == nil && err2 == nil && err3 == nil && err4 == nil &&
+				string(b1) == string(b2) && string(j1) == string(j2)
+		})
+	})
+}
+
+func TestPropertyGenerators(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+
+	for i := 0; i < 100; i++ {
+		rs := validSet[Prefix]{}.Generate(r, 0).Interface().(validSet[Prefix])
+		assert.NoError(t, rs.Set.validate())
+	}
+}
+
+// knownAction is an Action without bits outside of ActionAll.
+type knownAction Action
+
+func (knownAction) Generate(r *rand.Rand, _ int) reflect.Value {
+	return reflect.ValueOf(knownAction(r.Intn(int(ActionAll) + 1)))
+}
+
+// IDs are drawn from a small pool, so that sets, accesses, and (for
+// Prefix) prefixes overlap often.
+var idPool = []string{"", "a", "ab", "abc", "b", "b/c"}
+
+// randID is an ID drawn from the pool. It may be the zero ID.
+type randID[I ID] struct{ ID I }
+
+func (randID[I]) Generate(r *rand.Rand, _ int) reflect.Value {
+	return reflect.ValueOf(randID[I]{genID[I](r)})
+}
+
+func genID[I ID](r *rand.Rand) I {
+	var (
+		id I
+		n  = r.Intn(len(idPool))
+	)
+
+	switch p := any(&id).(type) {
+	case *uint64:
+		*p = uint64(n)
+	case *string:
+		*p = idPool[n]
+	case *Prefix:
+		*p = Prefix(idPool[n])
+	default:
+		panic("unsupported ID type")
+	}
+
+	return id
+}
+
+// validSet is a ResourceSet passing validation: either just the zero ID or
+// any number of other IDs.
+type validSet[I ID] struct{ Set ResourceSet[I, Action] }
+
+func (validSet[I]) Generate(r *rand.Rand, _ int) reflect.Value {
+	rs := ResourceSet[I, Action]{}
+
+	if r.Intn(5) == 0 {
+		rs[ZeroID[I]()] = Action(r.Intn(int(ActionAll) + 1))
+		return reflect.ValueOf(validSet[I]{rs})
+	}
+
+	for i := r.Intn(5); i > 0; i-- {
+		if id := genID[I](r); id != ZeroID[I]() {
+			rs[id] = Action(r.Intn(int(ActionAll) + 1))
+		}
+	}
+
+	return reflect.ValueOf(validSet[I]{rs})
+}
+
+func (rs validSet[I]) hasZero() bool {
+	_, ok := rs.Set[ZeroID[I]()]
+	return ok
+}
+
+// anySet is an arbitrary ResourceSet, which may not pass validation. Masks
+// only have known bits, since the JSON encoding of Action can't represent
+// others.
+type anySet[I ID] struct{ Set ResourceSet[I, Action] }
+
+func (anySet[I]) Generate(r *rand.Rand, _ int) reflect.Value {
+	rs := ResourceSet[I, Action]{}
+
+	for i := r.Intn(len(idPool) + 1); i > 0; i-- {
+		rs[genID[I](r)] = Action(r.Intn(int(ActionAll) + 1))
+	}
+
+	return reflect.ValueOf(anySet[I]{rs})
+}
@@ -1,7 +1,11 @@
 package resset
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
+	"reflect"
+	"strconv"
 	"strings"
 
 	"github.com/superfly/macaroon"
@@ -38,7 +42,7 @@ func ZeroID[I ID]() (ret I) {
 }
 
 // ResourceSet is a helper type for defining caveat types specifying
-// object->permission mappings. ResourceSets implement custom msgpack
+// object->permission mappings. ResourceSets implement custom msgpack and JSON
 // marshalling. As a result, they should be wrapped in a struct rather than
 // simply aliasing the type. For example, don't do this:
 //
@@ -104,6 +108,163 @@ func (rs ResourceSet[I, M]) Prohibits(id *I, action M, resourceType string) erro
 	return nil
 }
 
+// NamedResourceSet is a ResourceSet paired with the name of the resource type
+// it constrains, which is used in error messages. See Named.
+type NamedResourceSet[I ID, M BitMask] struct {
+	ResourceType string
+	Set          ResourceSet[I, M]
+}
+
+// Named pairs set with the name of the resource type it constrains (e.g.
+// "widget"), so that errors from Prohibits identify the resource type. Caveats
+// embedding a ResourceSet should call Prohibits through this wrapper:
+//
+//	func (c *Widgets) Prohibits(f macaroon.Access) error {
+//		// ...
+//		return resset.Named("widget", c.Widgets).Prohibits(wf.WidgetName, wf.Action)
+//	}
+func Named[I ID, M BitMask](resourceType string, set ResourceSet[I, M]) NamedResourceSet[I, M] {
+	return NamedResourceSet[I, M]{ResourceType: resourceType, Set: set}
+}
+
+// Prohibits is like ResourceSet.Prohibits, using nrs's resource type name.
+func (nrs NamedResourceSet[I, M]) Prohibits(id *I, action M) error {
+	return nrs.Set.Prohibits(id, action, nrs.ResourceType)
+}
+
+// BoundedResourceSet is a ResourceSet whose permissions shouldn't exceed
+// MaxAction, for caveat types that should never grant certain actions. The
+// bounds are only checked by NewBounded and Validate, not when evaluating the
+// set, so tokens minted before a bound was introduced keep working. It is
+// encoded like a plain ResourceSet, without the bounds.
+type BoundedResourceSet[I ID] struct {
+	ResourceSet[I, Action]
+
+	// MaxAction is the most that the set should grant on any ID.
+	MaxAction Action
+
+	// IDMaxActions optionally bounds specific IDs further. They don't apply
+	// to the zero ID, which is only bounded by MaxAction, so that sets
+	// granting access to every ID remain valid.
+	IDMaxActions map[I]Action
+}
+
+// NewBounded is like New, but returns an error wrapping ErrExceedsMaxAction
+// if m exceeds max.
+func NewBounded[I ID](max, m Action, ids ...I) (BoundedResourceSet[I], error) {
+	brs := BoundedResourceSet[I]{ResourceSet: New(m, ids...), MaxAction: max}
+	if err := brs.Validate(); err != nil {
+		return BoundedResourceSet[I]{}, err
+	}
+
+	return brs, nil
+}
+
+// Validate returns an error wrapping ErrExceedsMaxAction if any of the set's
+// permissions exceed its bounds. Issuers should call it before adding caveats
+// built from decoded or hand-assembled sets to tokens.
+func (brs BoundedResourceSet[I]) Validate() error {
+	ids := maps.Keys(brs.ResourceSet)
+	slices.Sort(ids)
+
+	for _, id := range ids {
+		if m := brs.maxAction(id); !IsSubsetOf(brs.ResourceSet[id], m) {
+			return fmt.Errorf("%w: %s on %s (max %s)", ErrExceedsMaxAction, brs.ResourceSet[id], idToString(id), m)
+		}
+	}
+
+	return nil
+}
+
+func (brs BoundedResourceSet[I]) maxAction(id I) Action {
+	if m, ok := brs.IDMaxActions[id]; ok && id != ZeroID[I]() {
+		return brs.MaxAction & m
+	}
+
+	return brs.MaxAction
+}
+
+// DecodeMsgpack implements msgpack.CustomDecoder, decoding a plain
+// ResourceSet.
+func (brs *BoundedResourceSet[I]) DecodeMsgpack(dec *msgpack.Decoder) error {
+	return dec.Decode(&brs.ResourceSet)
+}
+
+// Equal reports whether rs and other contain the same IDs with the same
+// permissions.
+func (rs ResourceSet[I, M]) Equal(other ResourceSet[I, M]) bool {
+	return maps.Equal(rs, other)
+}
+
+// Intersect returns a ResourceSet allowing only the accesses allowed by both a
+// and b. An empty result means that no resource is allowed by both. For ID
+// types that match other IDs (e.g. Prefix), only the IDs present in a or b are
+// considered, so the result may be more permissive than a and b combined.
+func Intersect[I ID, M BitMask](a, b ResourceSet[I, M]) ResourceSet[I, M] {
+	ret := ResourceSet[I, M]{}
+
+	for _, rs := range []ResourceSet[I, M]{a, b} {
+		for id := range rs {
+			aPerm, aFound := a.permFor(id)
+			bPerm, bFound := b.permFor(id)
+
+			if aFound && bFound {
+				ret[id] = aPerm & bPerm
+			}
+		}
+	}
+
+	return ret
+}
+
+// permFor returns the permission the resource set grants on id, combining the
+// permissions of all matching entries.
+func (rs ResourceSet[I, M]) permFor(id I) (perm M, found bool) {
+	var zeroM M
+	perm = zeroM - 1
+
+	for entryID, entryPerm := range rs {
+		if entryID == ZeroID[I]() || match(entryID, id) {
+			perm &= entryPerm
+			found = true
+		}
+	}
+
+	return perm, found
+}
+
+// Describe returns a human description of the resource set for use in
+// implementations of macaroon.DescribableCaveat (e.g. "apps 123 (read), 456
+// (read-write)"). The zero ID, which matches any resource, is described as
+// "*".
+func (rs ResourceSet[I, M]) Describe(resourceType string) string {
+	if len(rs) == 0 {
+		return "no " + resourceType
+	}
+
+	ids := maps.Keys(rs)
+	slices.Sort(ids)
+
+	entries := make([]string, 0, len(ids))
+	for _, id := range ids {
+		sid := idToString(id)
+		if id == ZeroID[I]() {
+			sid = "*"
+		}
+
+		entries = append(entries, fmt.Sprintf("%s (%s)", sid, describeMask(rs[id])))
+	}
+
+	return resourceType + " " + strings.Join(entries, ", ")
+}
+
+func describeMask[M BitMask](m M) string {
+	if a, ok := any(m).(Action); ok {
+		return DescribeAction(a)
+	}
+	return m.String()
+}
+
 var _ msgpack.CustomEncoder = ResourceSet[uint64, Action]{}
 var _ msgpack.CustomEncoder = ResourceSet[int32, Action]{}
 var _ msgpack.CustomEncoder = ResourceSet[string, Action]{}
@@ -130,6 +291,141 @@ func (rs ResourceSet[I, M]) EncodeMsgpack(enc *msgpack.Encoder) error {
 	return nil
 }
 
+var (
+	_ json.Marshaler   = ResourceSet[uint64, Action]{}
+	_ json.Unmarshaler = (*ResourceSet[uint64, Action])(nil)
+)
+
+// MarshalJSON implements json.Marshaler. ResourceSets are encoded as JSON
+// objects whose keys are always strings, even for integer ID types (e.g.
+// {"123":"rw"}). Values are encoded using M's own JSON encoding, which is an
+// action string for Action. Keys are sorted so the encoding is canonical.
+func (rs ResourceSet[I, M]) MarshalJSON() ([]byte, error) {
+	if rs == nil {
+		return []byte("null"), nil
+	}
+
+	ids := maps.Keys(rs)
+	slices.Sort(ids)
+
+	buf := bytes.NewBuffer([]byte{'{'})
+
+	for i, id := range ids {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+
+		key, err := json.Marshal(idToString(id))
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(key)
+		buf.WriteByte(':')
+
+		val, err := json.Marshal(rs[id])
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(val)
+	}
+
+	buf.WriteByte('}')
+
+	return buf.Bytes(), nil
+}
+
+// UnmarshalJSON implements json.Unmarshaler. It is the inverse of MarshalJSON.
+// Keys must be strings and, for integer ID types, must be base-10 integers
+// that fit in the ID type. Duplicate keys are rejected.
+func (rs *ResourceSet[I, M]) UnmarshalJSON(b []byte) error {
+	dec := json.NewDecoder(bytes.NewReader(b))
+
+	tok, err := dec.Token()
+	switch {
+	case err != nil:
+		return err
+	case tok == nil:
+		*rs = nil
+		return nil
+	case tok != json.Delim('{'):
+		return fmt.Errorf("resource set: expected object, got %v", tok)
+	}
+
+	ret := ResourceSet[I, M]{}
+
+	for dec.More() {
+		if tok, err = dec.Token(); err != nil {
+			return err
+		}
+
+		// object keys are always strings
+		key := tok.(string)
+
+		id, err := idFromString[I](key)
+		if err != nil {
+			return err
+		}
+
+		if _, dup := ret[id]; dup {
+			return fmt.Errorf("resource set: duplicate key %q", key)
+		}
+
+		var m M
+		if err := dec.Decode(&m); err != nil {
+			return err
+		}
+
+		ret[id] = m
+	}
+
+	if _, err := dec.Token(); err != nil {
+		return err
+	}
+
+	*rs = ret
+
+	return nil
+}
+
+func idToString[I ID](id I) string {
+	v := reflect.ValueOf(id)
+
+	switch {
+	case v.CanInt():
+		return strconv.FormatInt(v.Int(), 10)
+	case v.CanUint():
+		return strconv.FormatUint(v.Uint(), 10)
+	default:
+		return v.String()
+	}
+}
+
+func idFromString[I ID](s string) (I, error) {
+	var (
+		id I
+		v  = reflect.ValueOf(&id).Elem()
+	)
+
+	switch {
+	case v.CanInt():
+		n, err := strconv.ParseInt(s, 10, v.Type().Bits())
+		if err != nil {
+			return id, fmt.Errorf("resource set: bad %s key %q: %w", v.Type(), s, err)
+		}
+		v.SetInt(n)
+	case v.CanUint():
+		n, err := strconv.ParseUint(s, 10, v.Type().Bits())
+		if err != nil {
+			return id, fmt.Errorf("resource set: bad %s key %q: %w", v.Type(), s, err)
+		}
+		v.SetUint(n)
+	default:
+		v.SetString(s)
+	}
+
+	return id, nil
+}
+
 func (rs ResourceSet[ID, M]) validate() error {
 	var zeroID ID
 	if _, hasZero := rs[zeroID]; hasZero && len(rs) != 1 {
@@ -60,6 +60,76 @@ func TestResourceSetJSON(t *testing.T) {
 	assert.Equal(t, rs, rs2)
 }
 
+func TestResourceSetJSONRoundTrip(t *testing.T) {
+	// JSON->Go->msgpack must match msgpack from the original Go value
+	assertRoundTrip := func(tb testing.TB, rs any, rs2 any, expected string) {
+		tb.Helper()
+
+		rsj, err := json.Marshal(rs)
+		assert.NoError(tb, err)
+		assert.Equal(tb, expected, string(rsj))
+
+		assert.NoError(tb, json.Unmarshal(rsj, rs2))
+
+		rsm, err := encode(rs)
+		assert.NoError(tb, err)
+		rsm2, err := encode(rs2)
+		assert.NoError(tb, err)
+		assert.Equal(tb, rsm, rsm2)
+	}
+
+	assertRoundTrip(t,
+		ResourceSet[uint64, Action]{10: ActionRead, 2: ActionRead | ActionWrite, 1<<64 - 1: ActionAll},
+		&ResourceSet[uint64, Action]{},
+		`{"2":"rw","10":"r","18446744073709551615":"rwcdC"}`,
+	)
+
+	assertRoundTrip(t,
+		ResourceSet[int32, Action]{-5: ActionRead, 7: ActionWrite},
+		&ResourceSet[int32, Action]{},
+		`{"-5":"r","7":"w"}`,
+	)
+
+	assertRoundTrip(t,
+		ResourceSet[string, Action]{"b": ActionRead, "a": ActionWrite, "": ActionDelete},
+		&ResourceSet[string, Action]{},
+		`{"":"d","a":"w","b":"r"}`,
+	)
+
+	assertRoundTrip(t,
+		ResourceSet[Prefix, Action]{"foo/": ActionRead, "bar/": ActionWrite},
+		&ResourceSet[Prefix, Action]{},
+		`{"bar/":"w","foo/":"r"}`,
+	)
+
+	var rs ResourceSet[uint64, Action]
+	assert.NoError(t, json.Unmarshal([]byte(`null`), &rs))
+	assert.Zero(t, rs)
+
+	// bad keys
+	assert.Error(t, json.Unmarshal([]byte(`{"abc":"r"}`), &ResourceSet[uint64, Action]{}))
+	assert.Error(t, json.Unmarshal([]byte(`{"-1":"r"}`), &ResourceSet[uint64, Action]{}))
+	assert.Error(t, json.Unmarshal([]byte(`{"1.5":"r"}`), &ResourceSet[uint64, Action]{}))
+	assert.Error(t, json.Unmarshal([]byte(`{"4294967296":"r"}`), &ResourceSet[int32, Action]{}))
+
+	// duplicate keys
+	assert.Error(t, json.Unmarshal([]byte(`{"1":"r","1":"w"}`), &ResourceSet[uint64, Action]{}))
+	assert.Error(t, json.Unmarshal([]byte(`{"a":"r","a":"w"}`), &ResourceSet[string, Action]{}))
+
+	// not an object
+	assert.Error(t, json.Unmarshal([]byte(`["1"]`), &ResourceSet[uint64, Action]{}))
+}
+
+func TestResourceSetDescribe(t *testing.T) {
+	assert.Equal(t, "apps 123 (read), 456 (read-write)", ResourceSet[uint64, Action]{
+		456: ActionRead | ActionWrite,
+		123: ActionRead,
+	}.Describe("apps"))
+
+	assert.Equal(t, "apps * (all)", New(ActionAll, uint64(0)).Describe("apps"))
+	assert.Equal(t, "no apps", ResourceSet[uint64, Action]{}.Describe("apps"))
+}
+
 func TestResourceSetMessagePack(t *testing.T) {
 	rs := New[uint64](ActionRead, 3, 1, 2)
 
@@ -108,3 +178,121 @@ func encode(v interface{}) ([]byte, error) {
 	}
 	return buf.Bytes(), nil
 }
+
+func TestResourceSetEqual(t *testing.T) {
+	rs := New[uint64](ActionRead, 1, 2)
+
+	assert.True(t, rs.Equal(New[uint64](ActionRead, 2, 1)))
+	assert.False(t, rs.Equal(New[uint64](ActionWrite, 1, 2)))
+	assert.False(t, rs.Equal(New[uint64](ActionRead, 1)))
+	assert.True(t, ResourceSet[uint64, Action]{}.Equal(nil))
+}
+
+func TestIntersect(t *testing.T) {
+	assert.Equal(t,
+		ResourceSet[uint64, Action]{2: ActionRead},
+		Intersect(New[uint64](ActionRead|ActionWrite, 1, 2), New[uint64](ActionRead, 2, 3)),
+	)
+
+	// zero ID matches everything
+	assert.Equal(t,
+		ResourceSet[uint64, Action]{2: ActionRead, 3: ActionRead},
+		Intersect(New[uint64](ActionRead, 0), New[uint64](ActionAll, 2, 3)),
+	)
+	assert.Equal(t,
+		ResourceSet[uint64, Action]{0: ActionRead},
+		Intersect(New[uint64](ActionRead, 0), New[uint64](ActionAll, 0)),
+	)
+
+	assert.Equal(t, ResourceSet[uint64, Action]{}, Intersect(New[uint64](ActionRead, 1), New[uint64](ActionRead, 2)))
+	assert.Equal(t, ResourceSet[uint64, Action]{}, Intersect(New[uint64](ActionRead, 1), nil))
+
+	// prefixes
+	assert.Equal(t,
+		ResourceSet[Prefix, Action]{"foo/bar": ActionRead},
+		Intersect(New[Prefix](ActionRead, "foo/"), New[Prefix](ActionAll, "foo/bar", "baz")),
+	)
+}
+
+func TestNamed(t *testing.T) {
+	c := &Widgets{ResourceSet[string, Action]{"foo": ActionRead}}
+
+	err := c.Prohibits(&WidgetAccess{Action: ActionRead, WidgetName: ptr("bar")})
+	assert.IsError(t, err, ErrUnauthorizedForResource)
+	assert.Contains(t, err.Error(), "widget bar")
+
+	err = c.Prohibits(&WidgetAccess{Action: ActionWrite, WidgetName: ptr("foo")})
+	assert.IsError(t, err, ErrUnauthorizedForAction)
+	assert.Contains(t, err.Error(), "on widget")
+
+	err = c.Prohibits(&WidgetAccess{Action: ActionRead})
+	assert.IsError(t, err, ErrResourceUnspecified)
+	assert.Contains(t, err.Error(), "widget")
+
+	// same errors as the unwrapped form
+	rs := c.Widgets
+	assert.Equal(t,
+		rs.Prohibits(ptr("bar"), ActionRead, "widget").Error(),
+		Named("widget", rs).Prohibits(ptr("bar"), ActionRead).Error(),
+	)
+}
+
+func TestBoundedResourceSet(t *testing.T) {
+	brs, err := NewBounded(ActionRead|ActionWrite, ActionRead, "foo", "bar")
+	assert.NoError(t, err)
+	assert.NoError(t, brs.Validate())
+	assert.NoError(t, brs.Prohibits(ptr("foo"), ActionRead, "test resource"))
+
+	_, err = NewBounded(ActionRead|ActionWrite, ActionRead|ActionDelete, "foo")
+	assert.IsError(t, err, ErrExceedsMaxAction)
+	assert.IsError(t, err, macaroon.ErrBadCaveat)
+	assert.Contains(t, err.Error(), "foo")
+
+	// encodes like a plain ResourceSet
+	plain := New(ActionAll, "foo")
+
+	for name, codec := range map[string]struct {
+		marshal   func(any) ([]byte, error)
+		unmarshal func([]byte, any) error
+	}{
+		"msgpack": {encode, msgpack.Unmarshal},
+		"json":    {json.Marshal, json.Unmarshal},
+	} {
+		t.Run(name, func(t *testing.T) {
+			buf, err := codec.marshal(BoundedResourceSet[string]{ResourceSet: plain, MaxAction: ActionRead})
+			assert.NoError(t, err)
+
+			plainBuf, err := codec.marshal(plain)
+			assert.NoError(t, err)
+			assert.Equal(t, plainBuf, buf)
+
+			// sets exceeding the bound still decode and evaluate, but don't
+			// validate.
+			decoded := BoundedResourceSet[string]{MaxAction: ActionRead}
+			assert.NoError(t, codec.unmarshal(plainBuf, &decoded))
+			assert.Equal(t, plain, decoded.ResourceSet)
+			assert.NoError(t, decoded.Prohibits(ptr("foo"), ActionDelete, "test resource"))
+			assert.IsError(t, decoded.Validate(), ErrExceedsMaxAction)
+		})
+	}
+
+	// per-ID bounds
+	brs = BoundedResourceSet[string]{
+		ResourceSet:  ResourceSet[string, Action]{"foo": ActionAll, "bar": ActionAll},
+		MaxAction:    ActionAll,
+		IDMaxActions: map[string]Action{"bar": ActionRead, "": ActionRead},
+	}
+	err = brs.Validate()
+	assert.IsError(t, err, ErrExceedsMaxAction)
+	assert.Contains(t, err.Error(), "bar")
+
+	brs.ResourceSet["bar"] = ActionRead
+	assert.NoError(t, brs.Validate())
+
+	// the zero ID is only bounded by MaxAction
+	brs.ResourceSet[ZeroID[string]()] = ActionAll
+	assert.NoError(t, brs.Validate())
+
+	brs.MaxAction = ActionRead | ActionWrite
+	assert.IsError(t, brs.Validate(), ErrExceedsMaxAction)
+}
@@ -13,6 +13,7 @@ import (
 func TestCaveatSerialization(t *testing.T) {
 	cs := macaroon.NewCaveatSet(
 		&IfPresent{Ifs: macaroon.NewCaveatSet(&macaroon.ValidityWindow{NotBefore: 123, NotAfter: 234}), Else: ActionDelete},
+		&Require{Caveats: macaroon.NewCaveatSet(&macaroon.ValidityWindow{NotBefore: 123, NotAfter: 234})},
 		ptr(ActionRead),
 	)
 
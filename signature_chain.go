@@ -0,0 +1,119 @@
+package macaroon
+
+import (
+	"bytes"
+	"crypto/subtle"
+
+	mcrypto "github.com/superfly/macaroon/crypto"
+)
+
+// The functions in this file help the issuer of a macaroon debug signature
+// mismatches. A macaroon's signature is a chain of HMACs: the first value
+// signs the nonce with the issuer's key, and each following value signs the
+// next caveat's encoding with the value before it. Only the last value, the
+// Tail, is kept in the token, so a mismatch alone doesn't say which caveat
+// was changed.
+//
+// The intermediate values are secret. Anybody holding one can mint a token
+// with the caveats after it removed, so they must never be logged or sent
+// anywhere.
+
+// SignatureChain recomputes the signature chain of m with the issuer's key k.
+// The first value is the signature of the nonce and the i+1'th is the
+// signature after the i'th caveat, so there is one more value than there are
+// caveats. The last value is m.Tail if m is intact and k is the right key,
+// except for finalized proofs, whose Tail is derived from the last value.
+func (m *Macaroon) SignatureChain(k SigningKey) ([][]byte, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return m.signatureChain(k)
+}
+
+func (m *Macaroon) signatureChain(k SigningKey) ([][]byte, error) {
+	chain := make([][]byte, 0, len(m.UnsafeCaveats.Caveats)+1)
+	chain = append(chain, sign(k, m.Nonce.MustEncode()))
+
+	for i := range m.UnsafeCaveats.Caveats {
+		opc, err := m.caveatEncoding(i)
+		if err != nil {
+			return nil, err
+		}
+
+		chain = append(chain, sign(SigningKey(chain[i]), opc))
+	}
+
+	return chain, nil
+}
+
+// DivergencePoint recomputes the signature chain of m with the issuer's key
+// k, and returns the index of the first caveat that may have been altered
+// since m was signed, or -1 if the chain matches m.Tail.
+//
+// The chain can only be checked at a few points: the Tail, and the
+// verifier key of each third-party caveat, which is sealed with the chain
+// value before that caveat. A matching checkpoint before the i'th caveat
+// shows that the nonce and the caveats before i are intact. DivergencePoint
+// returns the index of the last third-party caveat whose checkpoint matches,
+// with no failed checkpoint before it, or 0 if there isn't one. Some caveat
+// at or after the returned index and before the first failed checkpoint was
+// altered. So the result is exact when the next checkpoint is right after
+// the returned index, but is otherwise only a lower bound. It is 0 if the
+// nonce was altered or k is the wrong key.
+func (m *Macaroon) DivergencePoint(k SigningKey) (int, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	chain, err := m.signatureChain(k)
+	if err != nil {
+		return 0, err
+	}
+
+	tail := chain[len(chain)-1]
+	if m.Nonce.Proof && !m.newProof {
+		tail = mcrypto.FinalizeProofSignature(tail)
+	}
+
+	if subtle.ConstantTimeCompare(tail, m.Tail) == 1 {
+		return -1, nil
+	}
+
+	intact := 0
+	for i, c := range m.UnsafeCaveats.Caveats {
+		c3p, ok := c.(*Caveat3P)
+		if !ok {
+			continue
+		}
+
+		if _, err := unseal(EncryptionKey(chain[i]), c3p.VerifierKey); err != nil {
+			break
+		}
+
+		intact = i
+	}
+
+	return intact, nil
+}
+
+// CompareChains returns the index of the first value that differs between
+// two signature chains (see Macaroon.SignatureChain), or -1 if they are the
+// same. If one chain is a prefix of the other, it returns the length of the
+// shorter one. Chain value i+1 covers caveat i, so a result of i+1 means that
+// the i'th caveats of the macaroons differ, and 0 means that their nonces or
+// keys do.
+func CompareChains(a, b [][]byte) int {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if !bytes.Equal(a[i], b[i]) {
+			return i
+		}
+	}
+
+	if len(a) != len(b) {
+		if len(a) < len(b) {
+			return len(a)
+		}
+		return len(b)
+	}
+
+	return -1
+}
@@ -0,0 +1,87 @@
+package macaroon
+
+import (
+	"testing"
+
+	"github.com/alecthomas/assert/v2"
+)
+
+func TestSignatureChain(t *testing.T) {
+	var (
+		key  = NewSigningKey()
+		locs = []string{"https://tp0", "https://tp1", "https://tp2"}
+	)
+
+	m, err := New(rbuf(10), "loc", key)
+	assert.NoError(t, err)
+	for _, loc := range locs {
+		assert.NoError(t, m.Add3P(NewEncryptionKey(), loc))
+	}
+	assert.NoError(t, m.Add(cavParent(ActionRead, 123)))
+
+	tok, err := m.Encode()
+	assert.NoError(t, err)
+
+	chain, err := m.SignatureChain(key)
+	assert.NoError(t, err)
+	assert.Equal(t, len(m.UnsafeCaveats.Caveats)+1, len(chain))
+	assert.Equal(t, m.Tail, chain[len(chain)-1])
+
+	// decodes tok, alters it with f, and returns its divergence point and
+	// where its chain diverges from the original's.
+	diverge := func(t *testing.T, k SigningKey, f func(*Macaroon)) (int, int) {
+		t.Helper()
+
+		dm, err := Decode(tok)
+		assert.NoError(t, err)
+		f(dm)
+
+		dp, err := dm.DivergencePoint(k)
+		assert.NoError(t, err)
+
+		dchain, err := dm.SignatureChain(k)
+		assert.NoError(t, err)
+
+		return dp, CompareChains(chain, dchain)
+	}
+
+	t.Run("intact", func(t *testing.T) {
+		dp, cmp := diverge(t, key, func(*Macaroon) {})
+		assert.Equal(t, -1, dp)
+		assert.Equal(t, -1, cmp)
+	})
+
+	t.Run("altered third-party caveat", func(t *testing.T) {
+		for k := range locs {
+			dp, cmp := diverge(t, key, func(dm *Macaroon) {
+				c3p := dm.UnsafeCaveats.Caveats[k].(*Caveat3P)
+				c3p.Ticket[0] ^= 1
+			})
+			assert.Equal(t, k, dp)
+			assert.Equal(t, k+1, cmp)
+		}
+	})
+
+	t.Run("altered last caveat", func(t *testing.T) {
+		// the last checkpoint is before the third-party caveat at index 2,
+		// so DivergencePoint can only bound the altered caveat.
+		dp, cmp := diverge(t, key, func(dm *Macaroon) {
+			dm.UnsafeCaveats.Caveats[3] = cavParent(ActionAll, 123)
+		})
+		assert.Equal(t, 2, dp)
+		assert.Equal(t, 4, cmp)
+	})
+
+	t.Run("wrong key", func(t *testing.T) {
+		dp, cmp := diverge(t, NewSigningKey(), func(*Macaroon) {})
+		assert.Equal(t, 0, dp)
+		assert.Equal(t, 0, cmp)
+	})
+
+	t.Run("CompareChains", func(t *testing.T) {
+		assert.Equal(t, -1, CompareChains(nil, nil))
+		assert.Equal(t, -1, CompareChains(chain, chain))
+		assert.Equal(t, 2, CompareChains(chain[:2], chain))
+		assert.Equal(t, 2, CompareChains(chain, chain[:2]))
+	})
+}
@@ -2,10 +2,12 @@ package tp
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"net/url"
 	"strings"
@@ -15,6 +17,8 @@ import (
 	"github.com/hashicorp/go-cleanhttp"
 	"github.com/superfly/macaroon"
 	"github.com/superfly/macaroon/bundle"
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
 )
 
 type ClientOption func(*Client)
@@ -87,9 +91,22 @@ func WithUserURLCallback(cb func(ctx context.Context, url string) error) ClientO
 	}
 }
 
+// WithPendingCallback specifies a function to call when the third party says
+// that a discharge flow is waiting for somebody else to act (e.g. an approver).
+// It is called with the third party's PendingInfo, which should be shown to
+// the user, each time the third party is polled while the flow is pending. If
+// it returns an error, the flow is aborted. (Optional)
+func WithPendingCallback(cb func(ctx context.Context, pi PendingInfo) error) ClientOption {
+	return func(c *Client) {
+		c.pendingCallback = cb
+	}
+}
+
 // WithPollingBackoff specifies a function determining how long to wait before
 // making the next request when polling the third party to see if a discharge is
-// ready. This is called the first time with a zero duration. (Optional)
+// ready. This is called the first time with a zero duration. If the third party
+// includes a Retry-After header in its response, that is honored instead.
+// (Optional)
 func WithPollingBackoff(nextBackoff func(lastBO time.Duration) (nextBO time.Duration)) ClientOption {
 	return func(c *Client) {
 		c.pollBackoffNext = nextBackoff
@@ -106,12 +123,71 @@ func WithIgnoredThirdParties(tps ...string) ClientOption {
 	}
 }
 
+// WithProtocol registers a DischargeProtocol to use for third parties
+// matching locationPattern instead of the built-in HTTP protocol. The pattern
+// either matches a third party location exactly or, if it begins with a ".",
+// matches any location whose hostname has that suffix (e.g. ".internal"
+// matches "https://auth.internal"). Exact matches take precedence over suffix
+// matches. Otherwise, patterns are consulted in the order they're registered.
+func WithProtocol(locationPattern string, p DischargeProtocol) ClientOption {
+	return func(c *Client) {
+		c.protocols = append(c.protocols, registeredProtocol{locationPattern, p})
+	}
+}
+
+// WithRequestedCaveats specifies caveats that the client would like the third
+// party at tpLocation to add to discharges it issues. This can be used to ask
+// for a shorter lived discharge, for example. Third parties are free to ignore
+// or reject requested caveats, so their presence in the discharge isn't
+// guaranteed.
+func WithRequestedCaveats(tpLocation string, cavs ...macaroon.Caveat) ClientOption {
+	return func(c *Client) {
+		if c.requestedCaveats == nil {
+			c.requestedCaveats = make(map[string][]macaroon.Caveat)
+		}
+		c.requestedCaveats[tpLocation] = append(c.requestedCaveats[tpLocation], cavs...)
+	}
+}
+
+// WithFlowStore specifies a FlowStore for persisting in-flight polling and
+// user-interactive discharge flows. If the client is interrupted (e.g. the
+// process exits) while waiting for a discharge, a later attempt to discharge
+// the same ticket resumes polling instead of starting over. Resumed
+// user-interactive flows pass the user URL to the UserURLCallback again, and
+// are dropped if it fails. If the third party no longer knows about the flow, a
+// new one is started. (Optional)
+func WithFlowStore(fs FlowStore) ClientOption {
+	return func(c *Client) {
+		c.flowStore = fs
+	}
+}
+
+// WithMaxInitRequestSize specifies the largest discharge request to send to
+// third parties. Tickets that would make requests larger are sent separately.
+// See HTTPProtocol.MaxInitRequestSize. (Optional)
+func WithMaxInitRequestSize(n int) ClientOption {
+	return func(c *Client) {
+		c.maxInitRequestSize = n
+	}
+}
+
 type Client struct {
 	firstPartyLocation string
 	http               *http.Client
 	userURLCallback    func(ctx context.Context, url string) error
+	pendingCallback    func(ctx context.Context, pi PendingInfo) error
 	pollBackoffNext    func(lastBO time.Duration) (nextBO time.Duration)
 	ignored            []string
+	protocols          []registeredProtocol
+	requestedCaveats   map[string][]macaroon.Caveat
+	flowStore          FlowStore
+	maxInitRequestSize int
+	httpProtocol       *HTTPProtocol
+}
+
+type registeredProtocol struct {
+	pattern  string
+	protocol DischargeProtocol
 }
 
 // NewClient returns a Client for discharging third party caveats in macaroons
@@ -133,6 +209,16 @@ func NewClient(firstPartyLocation string, opts ...ClientOption) *Client {
 		client.pollBackoffNext = defaultBackoff
 	}
 
+	client.httpProtocol = &HTTPProtocol{
+		HTTP:               client.http,
+		UserURLCallback:    client.userURLCallback,
+		PendingCallback:    client.pendingCallback,
+		PollingBackoff:     client.pollBackoffNext,
+		RequestedCaveats:   client.requestedCaveats,
+		FlowStore:          client.flowStore,
+		MaxInitRequestSize: client.maxInitRequestSize,
+	}
+
 	return client
 }
 
@@ -162,51 +248,119 @@ func (c *Client) FetchDischargeTokens(ctx context.Context, tokenHeader string) (
 		return "", err
 	}
 
+	var combinedErr error
+
+	c.fetchDischargeTokens(ctx, tickets, func(diss []string, err error) {
+		combinedErr = errors.Join(combinedErr, err)
+		for _, dis := range diss {
+			combinedErr = errors.Join(combinedErr, b.AddTokens(dis))
+		}
+	})
+
+	if stripped {
+		return b.Header(), combinedErr
+	} else {
+		return b.String(), combinedErr
+	}
+}
+
+// RefreshDischarges re-fetches the Bundle's discharges that expire within the
+// policy's window (see bundle.Bundle.ExpiringDischarges), replacing them in
+// place. Only the affected tickets are discharged again and other tokens are
+// left untouched. Tickets that can't be refreshed keep their old discharges,
+// and the returned error wraps a DischargeError for each of them.
+func (c *Client) RefreshDischarges(ctx context.Context, b *bundle.Bundle, policy bundle.RefreshPolicy) error {
+	tickets := b.ExpiringDischarges(policy)
+
+	for _, ignored := range c.ignored {
+		delete(tickets, ignored)
+	}
+
+	var combinedErr error
+
+	c.fetchDischargeTokens(ctx, tickets, func(diss []string, err error) {
+		combinedErr = errors.Join(combinedErr, err)
+		for _, dis := range diss {
+			combinedErr = errors.Join(combinedErr, replaceDischarge(b, dis))
+		}
+	})
+
+	return combinedErr
+}
+
+// fetchDischargeTokens discharges the tickets, calling handle with the
+// discharges and errors from each group of tickets. Calls to handle aren't
+// concurrent.
+func (c *Client) fetchDischargeTokens(ctx context.Context, tickets map[string][][]byte, handle func(diss []string, err error)) {
 	var (
-		wg          sync.WaitGroup
-		m           sync.Mutex
-		combinedErr error
+		wg sync.WaitGroup
+		m  sync.Mutex
 	)
 
-	for tpLoc, locTickets := range tickets {
-		for _, ticket := range locTickets {
-			// Do discharges sequentially if we've been given a cookie jar and a URL callback.
-			// Allowing one discharge to finish before proceeding to the next
-			// increases our chances that a session will save us from user
-			// interaction.
-			if c.http.Jar != nil && c.userURLCallback != nil {
-				if dis, err := c.fetchDischargeToken(ctx, tpLoc, ticket); err != nil {
-					combinedErr = errors.Join(combinedErr, err)
-				} else {
-					combinedErr = errors.Join(combinedErr, b.AddTokens(dis))
-				}
-			} else {
-				wg.Add(1)
-				go func(tpLoc string, ticket []byte) {
-					defer wg.Done()
-
-					dis, err := c.fetchDischargeToken(ctx, tpLoc, ticket)
-
-					m.Lock()
-					defer m.Unlock()
-
-					if err != nil {
-						combinedErr = errors.Join(combinedErr, err)
-					} else {
-						combinedErr = errors.Join(combinedErr, b.AddTokens(dis))
-					}
-				}(tpLoc, ticket)
-			}
+	for _, group := range c.groupTickets(tickets) {
+		// Do discharges sequentially if we've been given a cookie jar and a URL callback.
+		// Allowing one discharge to finish before proceeding to the next
+		// increases our chances that a session will save us from user
+		// interaction.
+		if c.http.Jar != nil && c.userURLCallback != nil {
+			handle(c.fetchDischargeTokenGroup(ctx, group))
+		} else {
+			wg.Add(1)
+			go func(group []pendingTicket) {
+				defer wg.Done()
+
+				diss, err := c.fetchDischargeTokenGroup(ctx, group)
+
+				m.Lock()
+				defer m.Unlock()
+
+				handle(diss, err)
+			}(group)
 		}
 	}
 
 	wg.Wait()
+}
 
-	if stripped {
-		return b.Header(), combinedErr
-	} else {
-		return b.String(), combinedErr
+// replaceDischarge replaces the Bundle's discharges for the ticket that dis
+// discharges with dis.
+func replaceDischarge(b *bundle.Bundle, dis string) error {
+	toks, err := macaroon.Parse(dis)
+	if err != nil {
+		return err
+	}
+	if len(toks) != 1 {
+		return fmt.Errorf("expected one discharge token, got %d", len(toks))
+	}
+
+	m, err := macaroon.Decode(toks[0])
+	if err != nil {
+		return err
+	}
+
+	var olds []string
+	b.Select(bundle.MacaroonPredicate(func(t bundle.Macaroon) bool {
+		if !b.IsPermissionToken(t) && bytes.Equal(t.Nonce().KID, m.Nonce.KID) {
+			olds = append(olds, t.String())
+		}
+		return false
+	}))
+
+	if len(olds) == 0 {
+		return b.AddTokens(dis)
 	}
+
+	if err := b.ReplaceDischarge(olds[0], dis); err != nil {
+		return err
+	}
+
+	for _, old := range olds[1:] {
+		if err := b.ReplaceDischarge(old, ""); err != nil {
+			return err
+		}
+	}
+
+	return nil
 }
 
 func (c *Client) undischargedTickets(b *bundle.Bundle) (map[string][][]byte, error) {
@@ -219,26 +373,287 @@ func (c *Client) undischargedTickets(b *bundle.Bundle) (map[string][][]byte, err
 	return tickets, nil
 }
 
+type pendingTicket struct {
+	location string
+	ticket   []byte
+}
+
+// groupTickets groups tickets that can be discharged in a single flow: those
+// for locations on the same host that use the built-in HTTP protocol and have
+// no requested caveats. Other tickets are in groups of their own.
+func (c *Client) groupTickets(tickets map[string][][]byte) [][]pendingTicket {
+	locations := maps.Keys(tickets)
+	slices.Sort(locations)
+
+	var (
+		groups [][]pendingTicket
+		byHost = map[string]int{}
+	)
+
+	for _, loc := range locations {
+		var host string
+		if u, err := url.Parse(loc); err == nil && u.Host != "" && c.canGroup(loc) {
+			host = u.Scheme + "://" + u.Host
+		}
+
+		for _, ticket := range tickets[loc] {
+			pt := pendingTicket{loc, ticket}
+
+			if i, ok := byHost[host]; ok {
+				groups[i] = append(groups[i], pt)
+				continue
+			}
+
+			if host != "" {
+				byHost[host] = len(groups)
+			}
+
+			groups = append(groups, []pendingTicket{pt})
+		}
+	}
+
+	return groups
+}
+
+func (c *Client) canGroup(thirdPartyLocation string) bool {
+	return c.protocolFor(thirdPartyLocation) == DischargeProtocol(c.httpProtocol) &&
+		len(c.requestedCaveats[thirdPartyLocation]) == 0
+}
+
+// fetchDischargeTokenGroup discharges a group of tickets from groupTickets.
+// It asks the third party to discharge them all in one flow, falling back to
+// separate flows for any it didn't discharge.
+func (c *Client) fetchDischargeTokenGroup(ctx context.Context, group []pendingTicket) ([]string, error) {
+	first, rest := group[0], group[1:]
+
+	if len(rest) == 0 {
+		dis, err := c.fetchDischargeToken(ctx, first.location, first.ticket)
+		if err != nil {
+			return nil, newDischargeError(first.location, first.ticket, err)
+		}
+		return []string{dis}, nil
+	}
+
+	additional := make([][]byte, len(rest))
+	for i, pt := range rest {
+		additional[i] = pt.ticket
+	}
+
+	var (
+		ret  []string
+		merr error
+	)
+
+	dis, additionalDiss, err := c.httpProtocol.discharge(ctx, first.location, first.ticket, additional)
+	if err != nil {
+		merr = newDischargeError(first.location, first.ticket, err)
+	} else {
+		ret = append(ret, dis)
+	}
+
+	for i, pt := range rest {
+		if i < len(additionalDiss) && additionalDiss[i] != "" {
+			ret = append(ret, additionalDiss[i])
+			continue
+		}
+
+		dis, err := c.fetchDischargeToken(ctx, pt.location, pt.ticket)
+		if err != nil {
+			merr = errors.Join(merr, newDischargeError(pt.location, pt.ticket, err))
+			continue
+		}
+
+		ret = append(ret, dis)
+	}
+
+	return ret, merr
+}
+
 func (c *Client) fetchDischargeToken(ctx context.Context, thirdPartyLocation string, ticket []byte) (string, error) {
-	jresp, err := c.doInitRequest(ctx, thirdPartyLocation, ticket)
+	return c.protocolFor(thirdPartyLocation).Discharge(ctx, thirdPartyLocation, ticket)
+}
+
+func (c *Client) protocolFor(thirdPartyLocation string) DischargeProtocol {
+	for _, rp := range c.protocols {
+		if rp.pattern == thirdPartyLocation {
+			return rp.protocol
+		}
+	}
+
+	if u, err := url.Parse(thirdPartyLocation); err == nil && u.Hostname() != "" {
+		host := u.Hostname()
+		for _, rp := range c.protocols {
+			if strings.HasPrefix(rp.pattern, ".") && strings.HasSuffix(host, rp.pattern) {
+				return rp.protocol
+			}
+		}
+	}
+
+	return c.httpProtocol
+}
+
+// DischargeProtocol fetches a discharge token from a third party for the
+// provided ticket. Third parties that don't speak the HTTP protocol
+// implemented by HTTPProtocol can be supported by registering a custom
+// DischargeProtocol with WithProtocol.
+type DischargeProtocol interface {
+	Discharge(ctx context.Context, location string, ticket []byte) (string, error)
+}
+
+// HTTPProtocol is the DischargeProtocol used by Client by default. It
+// implements the JSON-over-HTTP protocol served by TP, including polling and
+// user-interactive discharge flows.
+type HTTPProtocol struct {
+	// HTTP is the client to use for requests to third parties. If nil,
+	// a client from cleanhttp.DefaultClient is used.
+	HTTP *http.Client
+
+	// UserURLCallback is called when the third party needs to interact with
+	// the end-user directly. See WithUserURLCallback. (Optional)
+	UserURLCallback func(ctx context.Context, url string) error
+
+	// PendingCallback is called when the third party says that a flow is
+	// waiting for somebody else to act. See WithPendingCallback. (Optional)
+	PendingCallback func(ctx context.Context, pi PendingInfo) error
+
+	// PollingBackoff determines how long to wait between polling requests.
+	// See WithPollingBackoff. (Optional)
+	PollingBackoff func(lastBO time.Duration) (nextBO time.Duration)
+
+	// RequestedCaveats maps third party locations to caveats that should be
+	// requested in discharges from that third party. See
+	// WithRequestedCaveats. (Optional)
+	RequestedCaveats map[string][]macaroon.Caveat
+
+	// FlowStore persists in-flight discharge flows so they can be resumed.
+	// See WithFlowStore. (Optional)
+	FlowStore FlowStore
+
+	// MaxInitRequestSize is the largest init request body to send. If a
+	// ticket would make the request larger (e.g. because the first party put
+	// many caveats in it), the ticket is sent to the third party's
+	// InitTicketPath first and the init request refers to it. If the third
+	// party doesn't support that, the full request is sent anyway. Defaults to
+	// DefaultMaxInitRequestSize. A negative value disables this. (Optional)
+	MaxInitRequestSize int
+}
+
+// DefaultMaxInitRequestSize is the default for HTTPProtocol.MaxInitRequestSize.
+const DefaultMaxInitRequestSize = 64 << 10
+
+var _ DischargeProtocol = (*HTTPProtocol)(nil)
+
+// Discharge implements DischargeProtocol.
+func (p *HTTPProtocol) Discharge(ctx context.Context, thirdPartyLocation string, ticket []byte) (string, error) {
+	dis, _, err := p.discharge(ctx, thirdPartyLocation, ticket, nil)
+	return dis, err
+}
+
+// discharge is like Discharge, but also asks the third party to discharge the
+// additional tickets in the same flow. Third parties that support this return
+// the additional discharges along with an immediate discharge of ticket. The
+// returned slice has empty strings for additional tickets that weren't
+// discharged.
+func (p *HTTPProtocol) discharge(ctx context.Context, thirdPartyLocation string, ticket []byte, additional [][]byte) (string, []string, error) {
+	if dis, ok, err := p.resumeFlow(ctx, thirdPartyLocation, ticket); ok {
+		return dis, nil, err
+	}
+
+	jresp, err := p.doInitRequest(ctx, thirdPartyLocation, ticket, additional)
 
 	switch {
 	case err != nil:
-		return "", err
+		return "", nil, err
 	case jresp.Discharge != "":
-		return jresp.Discharge, nil
+		if !slices.Contains(jresp.Capabilities, capabilityMultipleDischarges) {
+			return jresp.Discharge, nil, nil
+		}
+		return jresp.Discharge, jresp.AdditionalDischarges, nil
 	case jresp.PollURL != "":
-		return c.doPoll(ctx, jresp.PollURL)
+		if err := p.notifyPending(ctx, jresp.Pending); err != nil {
+			return "", nil, err
+		}
+
+		p.saveFlow(ctx, &FlowState{Location: thirdPartyLocation, PollURL: jresp.PollURL}, ticket)
+		dis, err := p.doPoll(ctx, jresp.PollURL)
+		p.finishFlow(ctx, ticket, err)
+		return dis, nil, err
 	case jresp.UserInteractive != nil:
-		return c.doUserInteractive(ctx, jresp.UserInteractive)
+		dis, err := p.doUserInteractive(ctx, thirdPartyLocation, ticket, jresp.UserInteractive)
+		return dis, nil, err
 	default:
-		return "", errors.New("bad discharge response")
+		return "", nil, errors.New("bad discharge response")
+	}
+}
+
+// resumeFlow resumes polling for a flow saved in the FlowStore. The second
+// return value is false if there was no flow to resume or if the third party
+// no longer knows about the flow, in which case a new flow should be started.
+func (p *HTTPProtocol) resumeFlow(ctx context.Context, thirdPartyLocation string, ticket []byte) (string, bool, error) {
+	if p.FlowStore == nil {
+		return "", false, nil
+	}
+
+	flow, err := p.FlowStore.Load(ctx, flowKey(ticket))
+	if err != nil || flow == nil || flow.Location != thirdPartyLocation || flow.PollURL == "" {
+		return "", false, nil
+	}
+
+	// the user may not have finished with the third party before the client
+	// was interrupted.
+	if flow.UserURL != "" {
+		if p.UserURLCallback == nil {
+			return "", true, ErrMissingUserURLCallback
+		}
+
+		if err := p.openUserInteractiveURL(ctx, flow.UserURL); err != nil {
+			_ = p.FlowStore.Delete(ctx, flowKey(ticket))
+			return "", true, err
+		}
+	}
+
+	dis, err := p.doPoll(ctx, flow.PollURL)
+	p.finishFlow(ctx, ticket, err)
+
+	if isFlowGone(err) {
+		return "", false, nil
 	}
+
+	return dis, true, err
+}
+
+// saveFlow persists an in-flight flow. This is best-effort: failing to save
+// the flow only means that it can't be resumed.
+func (p *HTTPProtocol) saveFlow(ctx context.Context, flow *FlowState, ticket []byte) {
+	if p.FlowStore == nil || flow.PollURL == "" {
+		return
+	}
+
+	_ = p.FlowStore.Save(ctx, flowKey(ticket), flow)
 }
 
-func (c *Client) doInitRequest(ctx context.Context, thirdPartyLocation string, ticket []byte) (*jsonResponse, error) {
+// finishFlow removes a flow from the FlowStore once the third party has given
+// a final answer. Flows interrupted by other errors (e.g. the context being
+// canceled) are kept so they can be resumed.
+func (p *HTTPProtocol) finishFlow(ctx context.Context, ticket []byte, err error) {
+	if p.FlowStore == nil {
+		return
+	}
+
+	var tpErr *Error
+	if err == nil || errors.As(err, &tpErr) {
+		_ = p.FlowStore.Delete(ctx, flowKey(ticket))
+	}
+}
+
+func (p *HTTPProtocol) doInitRequest(ctx context.Context, thirdPartyLocation string, ticket []byte, additional [][]byte) (*jsonResponse, error) {
 	jreq := &jsonInitRequest{
-		Ticket: ticket,
+		Ticket:            ticket,
+		AdditionalTickets: additional,
+	}
+
+	if cavs := p.RequestedCaveats[thirdPartyLocation]; len(cavs) != 0 {
+		jreq.RequestedCaveats = macaroon.NewCaveatSet(cavs...)
 	}
 
 	breq, err := json.Marshal(jreq)
@@ -246,17 +661,122 @@ func (c *Client) doInitRequest(ctx context.Context, thirdPartyLocation string, t
 		return nil, err
 	}
 
+	if max := p.maxInitRequestSize(); max > 0 && len(breq) > max {
+		ref, err := p.doInitTicketRequest(ctx, thirdPartyLocation, ticket)
+
+		switch {
+		case err == nil:
+			// additional tickets are left for separate flows, since they'd
+			// make the request too large too.
+			jreq.Ticket, jreq.TicketRef, jreq.AdditionalTickets = nil, ref, nil
+
+			if breq, err = json.Marshal(jreq); err != nil {
+				return nil, err
+			}
+		case !errors.Is(err, errTicketRefUnsupported):
+			return nil, err
+		}
+	}
+
 	hreq, err := http.NewRequestWithContext(ctx, http.MethodPost, initURL(thirdPartyLocation), bytes.NewReader(breq))
 	if err != nil {
 		return nil, err
 	}
 	hreq.Header.Set("Content-Type", "application/json")
 
-	hresp, err := c.http.Do(hreq)
+	hresp, err := p.do(hreq)
 	if err != nil {
 		return nil, err
 	}
 
+	return decodeResponse(hresp)
+}
+
+// errTicketRefUnsupported is returned by doInitTicketRequest for third parties
+// that don't handle InitTicketPath.
+var errTicketRefUnsupported = errors.New("third party doesn't support ticket references")
+
+// doInitTicketRequest sends the ticket to the third party's InitTicketPath,
+// returning a reference to it for use in the init request.
+func (p *HTTPProtocol) doInitTicketRequest(ctx context.Context, thirdPartyLocation string, ticket []byte) (string, error) {
+	hreq, err := http.NewRequestWithContext(ctx, http.MethodPost, initTicketURL(thirdPartyLocation), bytes.NewReader(ticket))
+	if err != nil {
+		return "", err
+	}
+	hreq.Header.Set("Content-Type", "application/octet-stream")
+
+	hresp, err := p.do(hreq)
+	if err != nil {
+		return "", err
+	}
+
+	switch hresp.StatusCode {
+	case http.StatusNotFound, http.StatusMethodNotAllowed, http.StatusNotImplemented:
+		hresp.Body.Close()
+		return "", errTicketRefUnsupported
+	}
+
+	jresp, err := decodeResponse(hresp)
+	switch {
+	case err != nil:
+		return "", err
+	case jresp.TicketRef == "":
+		return "", fmt.Errorf("bad response (%d): missing ticket ref", hresp.StatusCode)
+	}
+
+	return jresp.TicketRef, nil
+}
+
+func (p *HTTPProtocol) maxInitRequestSize() int {
+	if p.MaxInitRequestSize == 0 {
+		return DefaultMaxInitRequestSize
+	}
+	return p.MaxInitRequestSize
+}
+
+// do sends the request, asking for the response to be compressed. Go's
+// transport only decompresses responses transparently if it added the
+// Accept-Encoding header itself, so this is done explicitly instead, making
+// compression independent of the configured http.Client.
+func (p *HTTPProtocol) do(req *http.Request) (*http.Response, error) {
+	req.Header.Set("Accept-Encoding", "gzip")
+
+	hresp, err := p.httpClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if hresp.Header.Get("Content-Encoding") == "gzip" {
+		zr, err := gzip.NewReader(hresp.Body)
+		if err != nil {
+			hresp.Body.Close()
+			return nil, fmt.Errorf("bad response (%d): %w", hresp.StatusCode, err)
+		}
+
+		hresp.Body = &gzipBody{zr, hresp.Body}
+		hresp.Header.Del("Content-Encoding")
+		hresp.Header.Del("Content-Length")
+		hresp.ContentLength = -1
+	}
+
+	return hresp, nil
+}
+
+type gzipBody struct {
+	*gzip.Reader
+	body io.ReadCloser
+}
+
+func (b *gzipBody) Close() error {
+	b.Reader.Close()
+	return b.body.Close()
+}
+
+// decodeResponse decodes and closes the body of a response from the third
+// party. Error responses are returned as an *Error.
+func decodeResponse(hresp *http.Response) (*jsonResponse, error) {
+	defer hresp.Body.Close()
+
 	var jresp jsonResponse
 	if err := json.NewDecoder(hresp.Body).Decode(&jresp); err != nil {
 		return nil, fmt.Errorf("bad response (%d): %w", hresp.StatusCode, err)
@@ -269,7 +789,7 @@ func (c *Client) doInitRequest(ctx context.Context, thirdPartyLocation string, t
 	return &jresp, nil
 }
 
-func (c *Client) doPoll(ctx context.Context, pollURL string) (string, error) {
+func (p *HTTPProtocol) doPoll(ctx context.Context, pollURL string) (string, error) {
 	if pollURL == "" {
 		return "", errors.New("bad discharge response")
 	}
@@ -279,34 +799,40 @@ func (c *Client) doPoll(ctx context.Context, pollURL string) (string, error) {
 		return "", err
 	}
 
-	var (
-		bo    time.Duration
-		jresp jsonResponse
-	)
+	var bo time.Duration
 
 pollLoop:
 	for {
-		hresp, err := c.http.Do(req)
+		hresp, err := p.do(req)
 		if err != nil {
 			return "", err
 		}
 
-		if hresp.StatusCode == http.StatusAccepted {
-			bo = c.nextBO(bo)
+		if hresp.StatusCode == http.StatusAccepted || hresp.StatusCode == http.StatusTooManyRequests {
+			err := p.notifyPending(ctx, pendingInfo(hresp))
+			hresp.Body.Close()
+			if err != nil {
+				return "", err
+			}
+
+			// the third party knows best how long we should wait
+			wait, ok := retryAfter(hresp)
+			if !ok {
+				bo = p.nextBO(bo)
+				wait = bo
+			}
 
 			select {
-			case <-time.After(bo):
+			case <-time.After(wait):
 				continue pollLoop
 			case <-ctx.Done():
 				return "", ctx.Err()
 			}
 		}
 
-		if err := json.NewDecoder(hresp.Body).Decode(&jresp); err != nil {
-			return "", fmt.Errorf("bad response (%d): %w", hresp.StatusCode, err)
-		}
-		if jresp.Error != "" {
-			return "", &Error{hresp.StatusCode, jresp.Error}
+		jresp, err := decodeResponse(hresp)
+		if err != nil {
+			return "", err
 		}
 		if jresp.Discharge == "" {
 			return "", fmt.Errorf("bad response (%d): missing discharge", hresp.StatusCode)
@@ -316,24 +842,60 @@ pollLoop:
 	}
 }
 
-func (c *Client) doUserInteractive(ctx context.Context, ui *jsonUserInteractive) (string, error) {
+// pendingInfo returns the PendingInfo from a "not ready" poll response, if
+// any. Malformed bodies are ignored, like those of older third parties.
+func pendingInfo(hresp *http.Response) *PendingInfo {
+	if hresp.StatusCode != http.StatusAccepted {
+		return nil
+	}
+
+	var jresp jsonResponse
+	if err := json.NewDecoder(hresp.Body).Decode(&jresp); err != nil {
+		return nil
+	}
+
+	return jresp.Pending
+}
+
+// notifyPending calls the PendingCallback, if there is one, with pi, if it
+// isn't nil.
+func (p *HTTPProtocol) notifyPending(ctx context.Context, pi *PendingInfo) error {
+	if pi == nil || p.PendingCallback == nil {
+		return nil
+	}
+
+	if err := p.PendingCallback(ctx, *pi); err != nil {
+		return callbackError{err}
+	}
+
+	return nil
+}
+
+// doUserInteractive sends the user to the third party and polls for the
+// discharge. The flow is only saved once the UserURLCallback succeeds, so
+// flows the user was never sent to aren't resumed.
+func (p *HTTPProtocol) doUserInteractive(ctx context.Context, thirdPartyLocation string, ticket []byte, ui *jsonUserInteractive) (string, error) {
 	if ui.PollURL == "" || ui.UserURL == "" {
 		return "", errors.New("bad discharge response")
 	}
-	if c.userURLCallback == nil {
-		return "", errors.New("missing user-url callback")
+	if p.UserURLCallback == nil {
+		return "", ErrMissingUserURLCallback
 	}
 
-	if err := c.openUserInteractiveURL(ctx, ui.UserURL); err != nil {
+	if err := p.openUserInteractiveURL(ctx, ui.UserURL); err != nil {
 		return "", err
 	}
 
-	return c.doPoll(ctx, ui.PollURL)
+	p.saveFlow(ctx, &FlowState{Location: thirdPartyLocation, PollURL: ui.PollURL, UserURL: ui.UserURL}, ticket)
+	dis, err := p.doPoll(ctx, ui.PollURL)
+	p.finishFlow(ctx, ticket, err)
+
+	return dis, err
 }
 
-func (c *Client) nextBO(lastBO time.Duration) time.Duration {
-	if c.pollBackoffNext != nil {
-		return c.pollBackoffNext(lastBO)
+func (p *HTTPProtocol) nextBO(lastBO time.Duration) time.Duration {
+	if p.PollingBackoff != nil {
+		return p.PollingBackoff(lastBO)
 	}
 	if lastBO == 0 {
 		return time.Second
@@ -341,14 +903,24 @@ func (c *Client) nextBO(lastBO time.Duration) time.Duration {
 	return 2 * lastBO
 }
 
-func (c *Client) openUserInteractiveURL(ctx context.Context, url string) error {
-	if c.userURLCallback != nil {
-		return c.userURLCallback(ctx, url)
+func (p *HTTPProtocol) openUserInteractiveURL(ctx context.Context, url string) error {
+	if p.UserURLCallback != nil {
+		if err := p.UserURLCallback(ctx, url); err != nil {
+			return callbackError{err}
+		}
+		return nil
 	}
 
 	return errors.New("client not configured for opening URLs")
 }
 
+func (p *HTTPProtocol) httpClient() *http.Client {
+	if p.HTTP == nil {
+		return cleanhttp.DefaultClient()
+	}
+	return p.HTTP
+}
+
 func initURL(location string) string {
 	if strings.HasSuffix(location, "/") {
 		return location + InitPath[1:]
@@ -356,6 +928,13 @@ func initURL(location string) string {
 	return location + InitPath
 }
 
+func initTicketURL(location string) string {
+	if strings.HasSuffix(location, "/") {
+		return location + InitTicketPath[1:]
+	}
+	return location + InitTicketPath
+}
+
 type Error struct {
 	StatusCode int
 	Msg        string
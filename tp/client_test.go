@@ -16,3 +16,19 @@ func TestClient(t *testing.T) {
 	assert.Equal(t, "bar", c1.http.Transport.(*authenticatedHTTP).auth["foo"])
 	assert.Equal(t, "baz", c2.http.Transport.(*authenticatedHTTP).auth["foo"])
 }
+
+func TestProtocolFor(t *testing.T) {
+	exact := &HTTPProtocol{}
+	suffix := &HTTPProtocol{}
+
+	c := NewClient("http://foo",
+		WithProtocol(".example.com", suffix),
+		WithProtocol("https://auth.example.com", exact),
+	)
+
+	assert.True(t, exact == c.protocolFor("https://auth.example.com"))
+	assert.True(t, suffix == c.protocolFor("https://other.example.com"))
+	assert.True(t, suffix == c.protocolFor("grpc://other.example.com:1234"))
+	assert.True(t, c.httpProtocol == c.protocolFor("https://example.com.evil"))
+	assert.True(t, c.httpProtocol == c.protocolFor("https://notexample.com"))
+}
@@ -0,0 +1,170 @@
+package tp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+)
+
+// ErrMissingUserURLCallback is returned when a third party requires user
+// interaction to discharge a ticket, but the client wasn't configured with
+// WithUserURLCallback.
+var ErrMissingUserURLCallback = errors.New("missing user-url callback")
+
+// LocationMismatchError is the refusal to discharge a ticket that the first
+// party issued for a location that the TP doesn't accept. This usually means
+// that the TP's Location is misconfigured. See TP.AcceptedLocations.
+type LocationMismatchError struct {
+	// TicketLocation is the location that the ticket was issued for.
+	TicketLocation string
+
+	// Accepted are the locations that the TP accepts.
+	Accepted []string
+}
+
+func (e *LocationMismatchError) Error() string {
+	return fmt.Sprintf("ticket is for location %q, expected one of %q", e.TicketLocation, e.Accepted)
+}
+
+// ErrorKind classifies the reason that a ticket couldn't be discharged.
+type ErrorKind int
+
+const (
+	// KindTransport is a failure to talk to the third party, or a response
+	// that couldn't be understood.
+	KindTransport ErrorKind = iota
+
+	// KindRejected is the third party refusing to discharge the ticket.
+	KindRejected
+
+	// KindUserInteractionRequired is the third party requiring user
+	// interaction when the client wasn't configured to allow it.
+	KindUserInteractionRequired
+
+	// KindAborted is the flow being canceled, either by the context or by
+	// the user-url callback returning an error.
+	KindAborted
+
+	// KindTimeout is the context's deadline or a network timeout being hit.
+	KindTimeout
+)
+
+func (k ErrorKind) String() string {
+	switch k {
+	case KindTransport:
+		return "transport"
+	case KindRejected:
+		return "rejected"
+	case KindUserInteractionRequired:
+		return "user interaction required"
+	case KindAborted:
+		return "aborted"
+	case KindTimeout:
+		return "timeout"
+	default:
+		return fmt.Sprintf("ErrorKind(%d)", int(k))
+	}
+}
+
+// DischargeError is the failure to discharge a single ticket. The error
+// returned by Client.FetchDischargeTokens wraps a DischargeError for each
+// ticket that couldn't be discharged.
+type DischargeError struct {
+	// Location is the third party location of the ticket's caveat.
+	Location string
+
+	// Ticket is the ticket that couldn't be discharged.
+	Ticket []byte
+
+	// Kind classifies the failure.
+	Kind ErrorKind
+
+	// Err is the underlying error.
+	Err error
+}
+
+func (e *DischargeError) Error() string {
+	return fmt.Sprintf("discharge %s: %v", e.Location, e.Err)
+}
+
+func (e *DischargeError) Unwrap() error {
+	return e.Err
+}
+
+// DischargeErrors returns the DischargeErrors wrapped by err, in order.
+func DischargeErrors(err error) []*DischargeError {
+	var ret []*DischargeError
+
+	var walk func(error)
+	walk = func(err error) {
+		switch e := err.(type) {
+		case nil:
+		case *DischargeError:
+			ret = append(ret, e)
+		case interface{ Unwrap() []error }:
+			for _, ee := range e.Unwrap() {
+				walk(ee)
+			}
+		case interface{ Unwrap() error }:
+			walk(e.Unwrap())
+		}
+	}
+
+	walk(err)
+
+	return ret
+}
+
+// newDischargeError wraps err in a DischargeError, unless it's nil or already
+// a DischargeError (e.g. from a custom DischargeProtocol).
+func newDischargeError(thirdPartyLocation string, ticket []byte, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	var de *DischargeError
+	if errors.As(err, &de) {
+		return err
+	}
+
+	return &DischargeError{
+		Location: thirdPartyLocation,
+		Ticket:   ticket,
+		Kind:     errorKind(err),
+		Err:      err,
+	}
+}
+
+func errorKind(err error) ErrorKind {
+	var (
+		tpErr  *Error
+		netErr net.Error
+		cbErr  callbackError
+	)
+
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return KindTimeout
+	case errors.Is(err, context.Canceled), errors.As(err, &cbErr):
+		return KindAborted
+	case errors.Is(err, ErrMissingUserURLCallback):
+		return KindUserInteractionRequired
+	case errors.As(err, &tpErr):
+		return KindRejected
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return KindTimeout
+	default:
+		return KindTransport
+	}
+}
+
+// callbackError is an error returned by the user-url or pending callback. It
+// marks the error as aborting the flow without changing its message.
+type callbackError struct {
+	error
+}
+
+func (e callbackError) Unwrap() error {
+	return e.error
+}
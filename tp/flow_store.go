@@ -0,0 +1,130 @@
+package tp
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+// FlowState is the state of an in-flight discharge flow that a FlowStore
+// persists so the flow can be resumed. It only contains information the third
+// party has already given the client. In particular, it doesn't include the
+// ticket.
+type FlowState struct {
+	// Location is the third party's location.
+	Location string `json:"location"`
+
+	// PollURL is the URL to poll for the discharge.
+	PollURL string `json:"poll_url"`
+
+	// UserURL is the URL the user was sent to, for user-interactive flows.
+	// It is passed to the client's UserURLCallback again when the flow is
+	// resumed, in case the user didn't finish.
+	UserURL string `json:"user_url,omitempty"`
+}
+
+// FlowStore persists in-flight discharge flows so that a Client can resume
+// polling for a discharge after it is restarted, rather than starting the flow
+// over (and possibly sending the user through a browser flow again). Flows are
+// keyed by a digest of the ticket. See WithFlowStore.
+type FlowStore interface {
+	// Save stores the flow for key, replacing any existing flow.
+	Save(ctx context.Context, key string, flow *FlowState) error
+
+	// Load returns the flow for key, or nil if there isn't one.
+	Load(ctx context.Context, key string) (*FlowState, error)
+
+	// Delete removes the flow for key. It isn't an error if there isn't one.
+	Delete(ctx context.Context, key string) error
+}
+
+// FileFlowStore is a FlowStore keeping each flow in a JSON file in Dir.
+type FileFlowStore struct {
+	Dir string
+}
+
+var _ FlowStore = (*FileFlowStore)(nil)
+
+// NewFileFlowStore returns a FileFlowStore keeping flows in dir, creating it
+// if necessary. Poll URLs are secrets, so dir and the files in it are only
+// accessible by the current user.
+func NewFileFlowStore(dir string) (*FileFlowStore, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("create flow store: %w", err)
+	}
+
+	return &FileFlowStore{Dir: dir}, nil
+}
+
+// Save implements FlowStore. The file is written atomically.
+func (s *FileFlowStore) Save(_ context.Context, key string, flow *FlowState) error {
+	b, err := json.Marshal(flow)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp(s.Dir, ".flow-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), s.path(key))
+}
+
+// Load implements FlowStore.
+func (s *FileFlowStore) Load(_ context.Context, key string) (*FlowState, error) {
+	b, err := os.ReadFile(s.path(key))
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		return nil, nil
+	case err != nil:
+		return nil, err
+	}
+
+	var flow FlowState
+	if err := json.Unmarshal(b, &flow); err != nil {
+		return nil, fmt.Errorf("decode flow: %w", err)
+	}
+
+	return &flow, nil
+}
+
+// Delete implements FlowStore.
+func (s *FileFlowStore) Delete(_ context.Context, key string) error {
+	if err := os.Remove(s.path(key)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	return nil
+}
+
+func (s *FileFlowStore) path(key string) string {
+	return filepath.Join(s.Dir, key+".json")
+}
+
+// flowKey returns the FlowStore key for a ticket.
+func flowKey(ticket []byte) string {
+	return digest(ticket)
+}
+
+// isFlowGone checks if polling failed because the third party no longer knows
+// about the flow.
+func isFlowGone(err error) bool {
+	var tpErr *Error
+	return errors.As(err, &tpErr) && (tpErr.StatusCode == http.StatusNotFound || tpErr.StatusCode == http.StatusGone)
+}
@@ -0,0 +1,58 @@
+package tp
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/alecthomas/assert/v2"
+)
+
+func TestFileFlowStore(t *testing.T) {
+	ctx := context.Background()
+
+	fs, err := NewFileFlowStore(t.TempDir() + "/flows")
+	assert.NoError(t, err)
+
+	fi, err := os.Stat(fs.Dir)
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o700), fi.Mode().Perm())
+
+	flow, err := fs.Load(ctx, "a")
+	assert.NoError(t, err)
+	assert.Zero(t, flow)
+
+	a := &FlowState{Location: "https://tp", PollURL: "https://tp/poll/a", UserURL: "https://tp/user/a"}
+	assert.NoError(t, fs.Save(ctx, "a", a))
+	assert.NoError(t, fs.Save(ctx, "b", &FlowState{Location: "https://tp", PollURL: "https://tp/poll/b"}))
+
+	flow, err = fs.Load(ctx, "a")
+	assert.NoError(t, err)
+	assert.Equal(t, a, flow)
+
+	fi, err = os.Stat(fs.path("a"))
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o600), fi.Mode().Perm())
+
+	// replace
+	a.PollURL = "https://tp/poll/a2"
+	assert.NoError(t, fs.Save(ctx, "a", a))
+	flow, err = fs.Load(ctx, "a")
+	assert.NoError(t, err)
+	assert.Equal(t, a, flow)
+
+	assert.NoError(t, fs.Delete(ctx, "a"))
+	assert.NoError(t, fs.Delete(ctx, "a"))
+
+	flow, err = fs.Load(ctx, "a")
+	assert.NoError(t, err)
+	assert.Zero(t, flow)
+
+	flow, err = fs.Load(ctx, "b")
+	assert.NoError(t, err)
+	assert.Equal(t, "https://tp/poll/b", flow.PollURL)
+
+	entries, err := os.ReadDir(fs.Dir)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(entries))
+}
@@ -0,0 +1,174 @@
+package tp
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru/v2"
+)
+
+// RateLimiter decides whether a request identified by key may proceed. See
+// TP.InitRateLimit and TP.PollRateLimit.
+type RateLimiter interface {
+	Allow(key string) bool
+}
+
+// RetryAfterer may be implemented by RateLimiters that know how long a client
+// should wait before retrying a request that wasn't allowed. The result is
+// sent to the client in the Retry-After header. Otherwise, clients are asked to
+// wait a second.
+type RetryAfterer interface {
+	RetryAfter(key string) time.Duration
+}
+
+// MemoryRateLimiter is an in-memory token bucket RateLimiter. Each key gets its
+// own bucket holding up to burst tokens, which refills at a rate of one token
+// per interval. Only the most recently used buckets are remembered, so keys
+// that are evicted start over with a full bucket.
+type MemoryRateLimiter struct {
+	interval time.Duration
+	burst    float64
+	buckets  *lru.Cache[string, *bucket]
+	m        sync.Mutex
+
+	// for testing
+	now func() time.Time
+}
+
+var (
+	_ RateLimiter  = (*MemoryRateLimiter)(nil)
+	_ RetryAfterer = (*MemoryRateLimiter)(nil)
+)
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// NewMemoryRateLimiter returns a MemoryRateLimiter allowing bursts of up to
+// burst requests per key, refilling at one request per interval. At most size
+// keys are tracked.
+func NewMemoryRateLimiter(interval time.Duration, burst, size int) (*MemoryRateLimiter, error) {
+	buckets, err := lru.New[string, *bucket](size)
+	if err != nil {
+		return nil, err
+	}
+
+	return &MemoryRateLimiter{
+		interval: interval,
+		burst:    float64(burst),
+		buckets:  buckets,
+		now:      time.Now,
+	}, nil
+}
+
+// Allow implements RateLimiter.
+func (l *MemoryRateLimiter) Allow(key string) bool {
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	b := l.refill(key)
+	if b.tokens < 1 {
+		return false
+	}
+
+	b.tokens--
+	return true
+}
+
+// RetryAfter implements RetryAfterer.
+func (l *MemoryRateLimiter) RetryAfter(key string) time.Duration {
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	b := l.refill(key)
+	if b.tokens >= 1 {
+		return 0
+	}
+
+	return time.Duration((1 - b.tokens) * float64(l.interval))
+}
+
+// refill must be called with the lock held.
+func (l *MemoryRateLimiter) refill(key string) *bucket {
+	now := l.now()
+
+	b, ok := l.buckets.Get(key)
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets.Add(key, b)
+		return b
+	}
+
+	if l.interval > 0 {
+		b.tokens += float64(now.Sub(b.last)) / float64(l.interval)
+	} else {
+		b.tokens = l.burst
+	}
+
+	if b.tokens > l.burst {
+		b.tokens = l.burst
+	}
+
+	b.last = now
+
+	return b
+}
+
+// allowOrError checks the rate limit for key, responding with a 429 if it is
+// exceeded.
+func (tp *TP) allowOrError(w http.ResponseWriter, r *http.Request, rl RateLimiter, key string) bool {
+	if rl == nil || rl.Allow(key) {
+		return true
+	}
+
+	retryAfter := time.Second
+	if ra, ok := rl.(RetryAfterer); ok {
+		retryAfter = ra.RetryAfter(key)
+	}
+
+	// Retry-After is in whole seconds. Round up so clients don't come back
+	// too early.
+	secs := int64((retryAfter + time.Second - 1) / time.Second)
+	if secs < 1 {
+		secs = 1
+	}
+
+	w.Header().Set("Retry-After", strconv.FormatInt(secs, 10))
+	tp.RespondError(w, r, http.StatusTooManyRequests, "rate limited")
+
+	return false
+}
+
+// remoteIP returns the IP address of the client making r.
+func remoteIP(r *http.Request) string {
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
+// retryAfter parses the Retry-After header from resp, which may be either a
+// number of seconds or an HTTP date.
+func retryAfter(resp *http.Response) (time.Duration, bool) {
+	v := resp.Header.Get("Retry-After")
+	if v == "" {
+		return 0, false
+	}
+
+	if secs, err := strconv.Atoi(v); err == nil && secs >= 0 {
+		return time.Duration(secs) * time.Second, true
+	}
+
+	if t, err := http.ParseTime(v); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d, true
+		}
+		return 0, true
+	}
+
+	return 0, false
+}
@@ -0,0 +1,63 @@
+package tp
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/alecthomas/assert/v2"
+)
+
+func TestMemoryRateLimiter(t *testing.T) {
+	rl, err := NewMemoryRateLimiter(time.Second, 2, 100)
+	assert.NoError(t, err)
+
+	now := time.Now()
+	rl.now = func() time.Time { return now }
+
+	// burst
+	assert.True(t, rl.Allow("a"))
+	assert.True(t, rl.Allow("a"))
+	assert.False(t, rl.Allow("a"))
+	assert.Equal(t, time.Second, rl.RetryAfter("a"))
+
+	// keys are independent
+	assert.True(t, rl.Allow("b"))
+	assert.Equal(t, time.Duration(0), rl.RetryAfter("b"))
+
+	// refill
+	now = now.Add(500 * time.Millisecond)
+	assert.False(t, rl.Allow("a"))
+	assert.Equal(t, 500*time.Millisecond, rl.RetryAfter("a"))
+
+	now = now.Add(500 * time.Millisecond)
+	assert.True(t, rl.Allow("a"))
+	assert.False(t, rl.Allow("a"))
+
+	// refills don't exceed burst
+	now = now.Add(time.Hour)
+	assert.True(t, rl.Allow("a"))
+	assert.True(t, rl.Allow("a"))
+	assert.False(t, rl.Allow("a"))
+}
+
+func TestRetryAfter(t *testing.T) {
+	resp := func(v string) *http.Response {
+		return &http.Response{Header: http.Header{"Retry-After": {v}}}
+	}
+
+	d, ok := retryAfter(&http.Response{Header: http.Header{}})
+	assert.False(t, ok)
+	assert.Equal(t, time.Duration(0), d)
+
+	d, ok = retryAfter(resp("3"))
+	assert.True(t, ok)
+	assert.Equal(t, 3*time.Second, d)
+
+	d, ok = retryAfter(resp(time.Now().Add(time.Minute).UTC().Format(http.TimeFormat)))
+	assert.True(t, ok)
+	assert.True(t, d > 50*time.Second && d <= time.Minute)
+
+	_, ok = retryAfter(resp("soon"))
+	assert.False(t, ok)
+}
@@ -0,0 +1,95 @@
+package tp_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/alecthomas/assert/v2"
+	"github.com/superfly/macaroon"
+	"github.com/superfly/macaroon/macaroontest"
+	"github.com/superfly/macaroon/tp"
+	"golang.org/x/exp/slices"
+)
+
+func TestImmediateResponse(t *testing.T) {
+	realm := macaroontest.NewRealm(t, macaroontest.WithDischargePolicy(func(r *http.Request) ([]macaroon.Caveat, error) {
+		_, err := tp.CaveatsFromRequest(r)
+		assert.NoError(t, err)
+
+		return []macaroon.Caveat{realmCaveat("dis-cav")}, nil
+	}))
+
+	hdr := realm.Issuer.Mint(realmCaveat("fp-cav"))
+	hdr, err := realm.Client.FetchDischargeTokens(context.Background(), hdr)
+	assert.NoError(t, err)
+
+	assert.NoError(t, realm.Verify(hdr, &realmAccess{"fp-cav", "dis-cav"}))
+	assert.IsError(t, realm.Verify(hdr, &realmAccess{"fp-cav"}), macaroon.ErrUnauthorized)
+}
+
+func TestMaxDischargeSize(t *testing.T) {
+	var (
+		dischargeCaveats []macaroon.Caveat
+		access           = realmAccess{"fp-cav"}
+	)
+	for i := 0; i < 20; i++ {
+		dischargeCaveats = append(dischargeCaveats, realmCaveat(fmt.Sprintf("dis-cav-%d", i)))
+		access = append(access, fmt.Sprintf("dis-cav-%d", i))
+	}
+
+	realm := macaroontest.NewRealm(t, macaroontest.WithDischargePolicy(func(r *http.Request) ([]macaroon.Caveat, error) {
+		return dischargeCaveats, nil
+	}))
+
+	hdr := realm.Issuer.Mint(realmCaveat("fp-cav"))
+
+	perm, _, err := macaroon.ParsePermissionAndDischargeTokens(hdr, realm.Issuer.Location)
+	assert.NoError(t, err)
+	ticket, err := macaroon.ThirdPartyTicket(perm, realm.TP.Location)
+	assert.NoError(t, err)
+
+	size, err := tp.EstimateDischargeSize(ticket, realm.TP.Key, realm.TP.Location, dischargeCaveats...)
+	assert.NoError(t, err)
+
+	realm.TP.MaxDischargeSize = size - 1
+	_, err = realm.Client.FetchDischargeTokens(context.Background(), hdr)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), tp.ErrDischargeTooLarge.Error())
+
+	realm.TP.MaxDischargeSize = size
+	withDischarge, err := realm.Client.FetchDischargeTokens(context.Background(), hdr)
+	assert.NoError(t, err)
+	assert.NoError(t, realm.Verify(withDischarge, &access))
+
+	realm.TP.MaxDischargeSize = -1
+	_, err = realm.Client.FetchDischargeTokens(context.Background(), hdr)
+	assert.NoError(t, err)
+}
+
+// realmCaveat allows accesses listing its value.
+type realmCaveat string
+
+func init() { macaroon.RegisterCaveatType(new(realmCaveat)) }
+
+func (c realmCaveat) CaveatType() macaroon.CaveatType { return macaroon.CavMinUserDefined + 1 }
+func (c realmCaveat) Name() string                    { return "realmCaveat" }
+
+func (c realmCaveat) Prohibits(a macaroon.Access) error {
+	ra, ok := a.(*realmAccess)
+	switch {
+	case !ok:
+		return macaroon.ErrInvalidAccess
+	case !slices.Contains(*ra, string(c)):
+		return macaroon.ErrUnauthorized
+	default:
+		return nil
+	}
+}
+
+type realmAccess []string
+
+func (a *realmAccess) Now() time.Time  { return time.Now() }
+func (a *realmAccess) Validate() error { return nil }
@@ -1,10 +1,12 @@
 package tp
 
 import (
+	"compress/gzip"
 	"context"
 	"crypto/rand"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"net/http"
 	"net/url"
@@ -12,22 +14,126 @@ import (
 
 	"github.com/sirupsen/logrus"
 	"github.com/superfly/macaroon"
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
 )
 
 type flowData struct {
-	ticket    []byte
-	caveats   []macaroon.Caveat
-	discharge *macaroon.Macaroon
-	log       logrus.FieldLogger
+	ticket           []byte
+	location         string
+	caveats          []macaroon.Caveat
+	requestedCaveats []macaroon.Caveat
+	discharge        *macaroon.Macaroon
+	log              logrus.FieldLogger
+
+	// additional has the flow data for each of the request's additional
+	// tickets, or nil for tickets that couldn't be recovered.
+	additional []*flowData
 }
 
 type TP struct {
 	Location string
 	Key      macaroon.EncryptionKey
-	Store    Store
-	Log      logrus.FieldLogger
+
+	// AdditionalLocations are other locations that the TP discharges tickets
+	// for, mapped to their keys. This allows one server to act as several
+	// third parties (e.g. while migrating to a new location). Clients with
+	// tickets for several of the server's locations can have them discharged
+	// in a single flow. See RespondDischarges.
+	AdditionalLocations map[string]macaroon.EncryptionKey
+
+	// AcceptedLocations are the locations that the TP discharges tickets for.
+	// First parties record the location they added a third-party caveat for in
+	// its ticket, and tickets for other locations are refused with a
+	// *LocationMismatchError, since their discharges wouldn't be recognized by
+	// the first party. Defaults to Location. The location for the
+	// AdditionalLocations key that recovered a ticket is always accepted.
+	// Tickets from first parties that don't record the location are accepted
+	// regardless.
+	AcceptedLocations []string
+
+	Store Store
+	Log   logrus.FieldLogger
+
+	// InitRateLimit, if set, limits discharge requests handled by
+	// InitRequestMiddleware. Requests are keyed by the ticket digest and the
+	// client's IP address.
+	InitRateLimit RateLimiter
+
+	// PollRateLimit, if set, limits requests handled by HandlePollRequest.
+	// Requests are keyed by the poll secret digest.
+	PollRateLimit RateLimiter
+
+	// MaxDischargeSize is the maximum size in bytes of an encoded discharge
+	// token. Larger discharges aren't sent to the client, since they would
+	// likely make its Authorization header too large for proxies to accept.
+	// Defaults to DefaultMaxDischargeSize. A negative value disables the
+	// check. See EstimateDischargeSize.
+	MaxDischargeSize int
 }
 
+// ErrInvalidLocation is returned by TP.Validate for locations that aren't
+// normalized absolute URLs.
+var ErrInvalidLocation = errors.New("invalid location")
+
+// Validate checks the TP's configuration. It should be called at startup,
+// since a misconfigured Location (e.g. with a trailing slash) otherwise only
+// shows up as discharges that first parties don't recognize. Location and
+// AdditionalLocations must be normalized absolute URLs.
+func (tp *TP) Validate() error {
+	if len(tp.Key) != macaroon.EncryptionKeySize {
+		return fmt.Errorf("bad key size for %s: have %d, need %d", tp.Location, len(tp.Key), macaroon.EncryptionKeySize)
+	}
+
+	if err := validateLocation(tp.Location); err != nil {
+		return err
+	}
+
+	for loc, key := range tp.AdditionalLocations {
+		if len(key) != macaroon.EncryptionKeySize {
+			return fmt.Errorf("bad key size for %s: have %d, need %d", loc, len(key), macaroon.EncryptionKeySize)
+		}
+
+		if err := validateLocation(loc); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func validateLocation(loc string) error {
+	u, err := url.Parse(loc)
+	switch {
+	case err != nil:
+		return fmt.Errorf("%w %q: %w", ErrInvalidLocation, loc, err)
+	case !u.IsAbs() || u.Host == "":
+		return fmt.Errorf("%w %q: not an absolute URL", ErrInvalidLocation, loc)
+	case u.User != nil, u.RawQuery != "", u.ForceQuery, u.Fragment != "":
+		return fmt.Errorf("%w %q: has userinfo, query, or fragment", ErrInvalidLocation, loc)
+	case strings.HasSuffix(u.Path, "/"):
+		return fmt.Errorf("%w %q: has a trailing slash", ErrInvalidLocation, loc)
+	}
+
+	u.Host = strings.ToLower(u.Host)
+	if norm := u.String(); norm != loc {
+		return fmt.Errorf("%w %q: not normalized (expected %q)", ErrInvalidLocation, loc, norm)
+	}
+
+	return nil
+}
+
+// DefaultMaxDischargeSize is the default for TP.MaxDischargeSize.
+const DefaultMaxDischargeSize = 8 << 10
+
+// ErrDischargeTooLarge is returned when a discharge exceeds
+// TP.MaxDischargeSize.
+var ErrDischargeTooLarge = errors.New("discharge too large")
+
+// maxAdditionalTickets is the most additional tickets that are recovered from
+// a single init request. Others are ignored and left for separate flows.
+const maxAdditionalTickets = 16
+
 func (tp *TP) InitRequestMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		var jr jsonInitRequest
@@ -37,15 +143,117 @@ func (tp *TP) InitRequestMiddleware(next http.Handler) http.Handler {
 			return
 		}
 
+		if len(jr.Ticket) == 0 && jr.TicketRef != "" {
+			if jr.Ticket = tp.ticketFromRefOrError(w, r, jr.TicketRef); jr.Ticket == nil {
+				return
+			}
+		}
+
+		if !tp.allowOrError(w, r, tp.InitRateLimit, digest(jr.Ticket)+"/"+remoteIP(r)) {
+			return
+		}
+
 		fd, r := tp.newFDOrError(w, r, "init", jr.Ticket)
 		if fd == nil {
 			return
 		}
 
+		if jr.RequestedCaveats != nil {
+			fd.requestedCaveats = jr.RequestedCaveats.Caveats
+		}
+
+		for i, ticket := range jr.AdditionalTickets {
+			if i == maxAdditionalTickets {
+				break
+			}
+
+			afd, err := tp.newFD(r, "init", ticket)
+			if err != nil {
+				tp.getLog(r).WithError(err).Warn("recover additional ticket")
+			}
+
+			fd.additional = append(fd.additional, afd)
+		}
+
 		next.ServeHTTP(w, r)
 	})
 }
 
+// MaxTicketSize is the largest ticket accepted by HandleInitTicketRequest.
+const MaxTicketSize = 1 << 20
+
+// ticketRefStatus is the ResponseStatus of StoreData for tickets sent to
+// InitTicketPath, distinguishing them from poll flows, which have no status
+// until they're finished.
+const ticketRefStatus = http.StatusCreated
+
+// HandleInitTicketRequest handles requests to InitTicketPath. Clients send
+// tickets that would make init requests too large here first, getting back a
+// reference to use in the init request instead. References are stored in the
+// Store and can only be used once. Third parties that don't handle this path
+// should respond with a 404 and clients will send the whole ticket with the
+// init request.
+func (tp *TP) HandleInitTicketRequest(w http.ResponseWriter, r *http.Request) {
+	store := tp.storeOrError(w, r)
+	if store == nil {
+		return
+	}
+
+	ticket, err := io.ReadAll(io.LimitReader(r.Body, MaxTicketSize+1))
+	switch {
+	case err != nil:
+		tp.getLog(r).WithError(err).Warn("read request")
+		http.Error(w, `{"error": "internal server error"}`, http.StatusInternalServerError)
+		return
+	case len(ticket) > MaxTicketSize:
+		http.Error(w, `{"error": "ticket too large"}`, http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	if !tp.allowOrError(w, r, tp.InitRateLimit, digest(ticket)+"/"+remoteIP(r)) {
+		return
+	}
+
+	// make sure it's a ticket we can recover before storing it
+	fd, r := tp.newFDOrError(w, r, "init-ticket", ticket)
+	if fd == nil {
+		return
+	}
+
+	_, ref, err := store.Insert(r.Context(), &StoreData{Ticket: ticket, ResponseStatus: ticketRefStatus})
+	if err != nil {
+		tp.getLog(r).WithError(err).Warn("store insert")
+		http.Error(w, `{"error": "internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	tp.respond(w, r, "init-ticket", http.StatusCreated, &jsonResponse{TicketRef: ref})
+}
+
+// ticketFromRefOrError looks up and deletes a ticket stored by
+// HandleInitTicketRequest.
+func (tp *TP) ticketFromRefOrError(w http.ResponseWriter, r *http.Request, ref string) []byte {
+	store := tp.storeOrError(w, r)
+	if store == nil {
+		return nil
+	}
+
+	sd, err := store.GetByPollSecret(r.Context(), ref)
+	if err != nil || sd == nil || sd.ResponseStatus != ticketRefStatus || sd.ResponseBody != nil {
+		tp.getLog(r).WithError(err).Warn("store lookup by ticket ref")
+		http.Error(w, `{"error": "not found"}`, http.StatusNotFound)
+		return nil
+	}
+
+	if err := store.DeleteByPollSecret(r.Context(), ref); err != nil {
+		tp.getLog(r).WithError(err).Warn("store delete")
+		http.Error(w, `{"error": "internal server error"}`, http.StatusInternalServerError)
+		return nil
+	}
+
+	return sd.Ticket
+}
+
 func (tp *TP) HandlePollRequest(w http.ResponseWriter, r *http.Request) {
 	store := tp.storeOrError(w, r)
 	if store == nil {
@@ -55,6 +263,10 @@ func (tp *TP) HandlePollRequest(w http.ResponseWriter, r *http.Request) {
 	parts := strings.Split(r.URL.EscapedPath(), "/")
 	last := parts[len(parts)-1]
 
+	if !tp.allowOrError(w, r, tp.PollRateLimit, digest(last)) {
+		return
+	}
+
 	sd, err := store.GetByPollSecret(r.Context(), last)
 	if err != nil || sd == nil {
 		tp.getLog(r).WithError(err).Warn("store lookup by poll secret")
@@ -67,11 +279,19 @@ func (tp *TP) HandlePollRequest(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if sd.ResponseBody == nil || sd.ResponseStatus == 0 {
+	if sd.ResponseBody == nil || sd.ResponseStatus == 0 || sd.ResponseStatus == ticketRefStatus {
 		tp.RespondError(w, r, http.StatusAccepted, "not ready")
 		return
 	}
 
+	// pending flows stay in the store until they're resolved
+	if sd.ResponseStatus == http.StatusAccepted {
+		if err := writeBody(w, r, sd.ResponseStatus, sd.ResponseBody); err != nil {
+			tp.getLog(r).WithError(err).Warn("writing response")
+		}
+		return
+	}
+
 	if err := store.DeleteByPollSecret(r.Context(), last); err != nil {
 		tp.getLog(r).WithError(err).Warn("store delete")
 		http.Error(w, `{"error": "internal server error"}`, http.StatusInternalServerError)
@@ -83,8 +303,7 @@ func (tp *TP) HandlePollRequest(w http.ResponseWriter, r *http.Request) {
 		"resp":   "discharge",
 	})
 
-	w.WriteHeader(sd.ResponseStatus)
-	if _, err := w.Write(sd.ResponseBody); err != nil {
+	if err := writeBody(w, r, sd.ResponseStatus, sd.ResponseBody); err != nil {
 		log.WithError(err).Warn("writing response")
 		return
 	}
@@ -138,22 +357,99 @@ func (tp *TP) respondDischarge(w http.ResponseWriter, r *http.Request, respType
 		return
 	}
 
-	if err := fd.discharge.Add(caveats...); err != nil {
-		tp.getLog(r).WithError(err).Warn("attenuating discharge")
-		http.Error(w, `{"error": "internal server error"}`, http.StatusInternalServerError)
+	tok, ok := tp.issueDischargeOrError(w, r, fd, caveats)
+	if !ok {
+		return
+	}
+
+	tp.respond(w, r, respType, http.StatusCreated, &jsonResponse{
+		Discharge: tok,
+	})
+}
+
+// RespondDischarges is like RespondDischarge, but also discharges the
+// additional tickets that the client included in the request (see
+// TicketsFromRequest). The caveats map locations to the caveats to add to
+// discharges for tickets with that location. Tickets for locations that
+// aren't in the map aren't discharged, and the client will need to discharge
+// them separately. If the location of the request's primary ticket (the one
+// described by CaveatsFromRequest) isn't in the map, an error is returned to
+// the client.
+func (tp *TP) RespondDischarges(w http.ResponseWriter, r *http.Request, caveats map[string][]macaroon.Caveat) {
+	fd := tp.fdOrError(w, r)
+	if fd == nil {
+		return
+	}
+
+	cavs, ok := caveats[fd.location]
+	if !ok {
+		tp.RespondError(w, r, http.StatusForbidden, "discharge refused")
+		return
+	}
+
+	tok, ok := tp.issueDischargeOrError(w, r, fd, cavs)
+	if !ok {
 		return
 	}
 
+	jresp := &jsonResponse{Discharge: tok}
+
+	if len(fd.additional) != 0 {
+		jresp.AdditionalDischarges = make([]string, len(fd.additional))
+
+		for i, afd := range fd.additional {
+			if afd == nil {
+				continue
+			}
+
+			cavs, ok := caveats[afd.location]
+			if !ok {
+				continue
+			}
+
+			tok, err := tp.issueDischarge(r, afd, cavs)
+			if err != nil {
+				afd.log.WithError(err).Warn("issue additional discharge")
+				continue
+			}
+
+			jresp.AdditionalDischarges[i] = tok
+		}
+	}
+
+	tp.respond(w, r, "immediate", http.StatusCreated, jresp)
+}
+
+func (tp *TP) issueDischargeOrError(w http.ResponseWriter, r *http.Request, fd *flowData, caveats []macaroon.Caveat) (string, bool) {
+	tok, err := tp.issueDischarge(r, fd, caveats)
+	switch {
+	case errors.Is(err, ErrDischargeTooLarge):
+		tp.RespondError(w, r, http.StatusInternalServerError, err.Error())
+		return "", false
+	case err != nil:
+		tp.getLog(r).WithError(err).Warn("issue discharge")
+		http.Error(w, `{"error": "internal server error"}`, http.StatusInternalServerError)
+		return "", false
+	}
+
+	return tok, true
+}
+
+func (tp *TP) issueDischarge(r *http.Request, fd *flowData, caveats []macaroon.Caveat) (string, error) {
+	if err := fd.discharge.Add(caveats...); err != nil {
+		return "", fmt.Errorf("attenuate discharge: %w", err)
+	}
+
 	tok, err := fd.discharge.String()
 	if err != nil {
-		tp.getLog(r).WithError(err).Warn("encode discharge")
-		http.Error(w, `{"error": "internal server error"}`, http.StatusInternalServerError)
-		return
+		return "", fmt.Errorf("encode discharge: %w", err)
 	}
 
-	tp.respond(w, r, respType, http.StatusCreated, &jsonResponse{
-		Discharge: tok,
-	})
+	if err := tp.checkDischargeSize(r, fd.discharge, tok); err != nil {
+		return "", err
+	}
+
+	return tok, nil
 }
 
 func (tp *TP) RespondPoll(w http.ResponseWriter, r *http.Request) string {
@@ -179,6 +475,105 @@ func (tp *TP) RespondPoll(w http.ResponseWriter, r *http.Request) string {
 	return pollSecret
 }
 
+// RespondPending is like RespondPoll, but for flows waiting for something
+// outside of the third party's control, such as approval by another user. Polls
+// return pi, so that clients can show it to the user, until the flow is
+// resolved with DischargePoll or AbortPoll. It can be updated with
+// SetPendingByPollSecret. The poll secret is returned.
+func (tp *TP) RespondPending(w http.ResponseWriter, r *http.Request, pi PendingInfo) string {
+	var (
+		fd    = tp.fdOrError(w, r)
+		store = tp.storeOrError(w, r)
+	)
+	if fd == nil || store == nil {
+		return ""
+	}
+
+	body, err := pendingBody(pi)
+	if err != nil {
+		tp.getLog(r).WithError(err).Warn("marshal pending")
+		http.Error(w, `{"error": "internal server error"}`, http.StatusInternalServerError)
+		return ""
+	}
+
+	_, pollSecret, err := store.Insert(r.Context(), &StoreData{
+		Ticket:         fd.ticket,
+		ResponseStatus: http.StatusAccepted,
+		ResponseBody:   body,
+	})
+	if err != nil {
+		tp.getLog(r).WithError(err).Warn("store insert")
+		http.Error(w, `{"error": "internal server error"}`, http.StatusInternalServerError)
+		return ""
+	}
+
+	tp.respond(w, r, "pending", http.StatusCreated, &jsonResponse{
+		PollURL: tp.url("/poll/" + url.PathEscape(pollSecret)),
+		Pending: &pi,
+	})
+
+	return pollSecret
+}
+
+// SetPendingByPollSecret sets the PendingInfo returned by polls for an
+// unresolved polling flow, returning ErrFlowResolved if it has already been
+// discharged or aborted. See RespondPending and PendingStore.
+func (tp *TP) SetPendingByPollSecret(ctx context.Context, pollSecret string, pi PendingInfo) error {
+	return tp.setPending(ctx, pollSecret, "", pi)
+}
+
+// SetPendingByUserSecret sets the PendingInfo returned by polls for an
+// unresolved user-interactive flow, e.g. once the user has asked somebody else
+// to approve the request. See RespondPending.
+func (tp *TP) SetPendingByUserSecret(ctx context.Context, userSecret string, pi PendingInfo) error {
+	return tp.setPending(ctx, "", userSecret, pi)
+}
+
+func (tp *TP) setPending(ctx context.Context, pollSecret, userSecret string, pi PendingInfo) error {
+	if tp.Store == nil {
+		return errors.New("no store")
+	}
+
+	var (
+		sd  *StoreData
+		err error
+	)
+	if pollSecret != "" {
+		sd, err = tp.Store.GetByPollSecret(ctx, pollSecret)
+	} else {
+		sd, err = tp.Store.GetByUserSecret(ctx, userSecret)
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := sd.checkPending(); err != nil {
+		return err
+	}
+
+	if sd.ResponseBody, err = pendingBody(pi); err != nil {
+		return err
+	}
+	sd.ResponseStatus = http.StatusAccepted
+
+	switch ps, isPending := tp.Store.(PendingStore); {
+	case isPending && pollSecret != "":
+		return ps.UpdatePendingByPollSecret(ctx, pollSecret, sd)
+	case isPending:
+		return ps.UpdatePendingByUserSecret(ctx, userSecret, sd)
+	case pollSecret != "":
+		return tp.Store.UpdateByPollSecret(ctx, pollSecret, sd)
+	default:
+		return tp.Store.UpdateByUserSecret(ctx, userSecret, sd)
+	}
+}
+
+// pendingBody is the body of poll responses for pending flows. The error
+// message is for clients that don't understand the pending field.
+func pendingBody(pi PendingInfo) ([]byte, error) {
+	return json.Marshal(&jsonResponse{Error: "not ready", Pending: &pi})
+}
+
 func (tp *TP) DischargePoll(ctx context.Context, pollSecret string, caveats ...macaroon.Caveat) error {
 	return tp.dischargePoller(ctx, pollSecret, "", caveats...)
 }
@@ -253,6 +648,10 @@ func (tp *TP) dischargePoller(ctx context.Context, pollSecret, userSecret string
 		return err
 	}
 
+	if err := tp.checkDischargeSize(nil, fd.discharge, tok); err != nil {
+		return err
+	}
+
 	jresp, err := json.Marshal(&jsonResponse{Discharge: tok})
 	if err != nil {
 		return err
@@ -311,14 +710,72 @@ func (tp *TP) abortPoller(ctx context.Context, pollSecret, userSecret string, me
 	return nil
 }
 
+// checkDischargeSize returns ErrDischargeTooLarge if the encoded discharge tok
+// exceeds MaxDischargeSize, logging a breakdown of its caveats.
+func (tp *TP) checkDischargeSize(r *http.Request, discharge *macaroon.Macaroon, tok string) error {
+	max := tp.MaxDischargeSize
+	if max == 0 {
+		max = DefaultMaxDischargeSize
+	}
+
+	if max < 0 || len(tok) <= max {
+		return nil
+	}
+
+	cavsByName := map[string]int{}
+	for _, cav := range discharge.UnsafeCaveats.Caveats {
+		cavsByName[cav.Name()]++
+	}
+
+	tp.getLog(r).WithFields(logrus.Fields{
+		"size":    len(tok),
+		"max":     max,
+		"caveats": len(discharge.UnsafeCaveats.Caveats),
+		"by_type": cavsByName,
+	}).Warn("discharge too large")
+
+	return fmt.Errorf("%w: %d bytes exceeds %d", ErrDischargeTooLarge, len(tok), max)
+}
+
+// EstimateDischargeSize returns the size in bytes of the encoded discharge
+// that would be issued for ticket with the given caveats. Handlers can use
+// this to leave out optional caveats rather than exceeding
+// TP.MaxDischargeSize. The estimate is exact up to variation in the size of
+// caveat encodings.
+func EstimateDischargeSize(ticket []byte, key macaroon.EncryptionKey, loc string, cavs ...macaroon.Caveat) (int, error) {
+	_, discharge, err := macaroon.DischargeTicket(key, loc, ticket)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := discharge.Add(cavs...); err != nil {
+		return 0, err
+	}
+
+	tok, err := discharge.String()
+	if err != nil {
+		return 0, err
+	}
+
+	return len(tok), nil
+}
+
 func (tp *TP) respond(w http.ResponseWriter, r *http.Request, respType string, statusCode int, jresp *jsonResponse) {
 	log := tp.getLog(r).WithFields(logrus.Fields{
 		"status": statusCode,
 		"resp":   respType,
 	})
 
-	w.WriteHeader(statusCode)
-	if err := json.NewEncoder(w).Encode(jresp); err != nil {
+	jresp.Capabilities = []string{capabilityMultipleDischarges}
+
+	body, err := json.Marshal(jresp)
+	if err != nil {
+		log.WithError(err).Warn("marshal response")
+		http.Error(w, `{"error": "internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	if err := writeBody(w, r, statusCode, append(body, '\n')); err != nil {
 		log.WithError(err).Warn("writing response")
 		return
 	}
@@ -326,6 +783,50 @@ func (tp *TP) respond(w http.ResponseWriter, r *http.Request, respType string, s
 	log.Info()
 }
 
+// minGzipSize is the smallest response body that is compressed for clients
+// that accept it. Discharges with many caveats can be large.
+const minGzipSize = 1 << 10
+
+func writeBody(w http.ResponseWriter, r *http.Request, statusCode int, body []byte) error {
+	w.Header().Add("Vary", "Accept-Encoding")
+
+	if len(body) < minGzipSize || !acceptsGzip(r) {
+		w.WriteHeader(statusCode)
+		_, err := w.Write(body)
+		return err
+	}
+
+	w.Header().Set("Content-Encoding", "gzip")
+	w.Header().Del("Content-Length")
+	w.WriteHeader(statusCode)
+
+	zw := gzip.NewWriter(w)
+	if _, err := zw.Write(body); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+func acceptsGzip(r *http.Request) bool {
+	for _, hdr := range r.Header.Values("Accept-Encoding") {
+		for _, enc := range strings.Split(hdr, ",") {
+			name, params, _ := strings.Cut(strings.TrimSpace(enc), ";")
+			if !strings.EqualFold(strings.TrimSpace(name), "gzip") {
+				continue
+			}
+
+			q := strings.ReplaceAll(params, " ", "")
+			if q == "q=0" || strings.HasPrefix(q, "q=0.") && strings.Trim(q[4:], "0") == "" {
+				continue
+			}
+
+			return true
+		}
+	}
+
+	return false
+}
+
 type contextKey string
 
 const contextKeyFlowData = contextKey("flow-data")
@@ -338,11 +839,63 @@ func CaveatsFromRequest(r *http.Request) ([]macaroon.Caveat, error) {
 	return nil, errors.New("middleware not called")
 }
 
+// Ticket describes a ticket that the client asked the TP to discharge.
+type Ticket struct {
+	// Location is the location the ticket was issued for: either TP.Location
+	// or one of TP.AdditionalLocations.
+	Location string
+
+	// Caveats are the caveats that the first party put in the ticket.
+	Caveats []macaroon.Caveat
+}
+
+// TicketsFromRequest returns the tickets that the client asked to have
+// discharged. The first is the ticket described by CaveatsFromRequest. It is
+// followed by any additional tickets the client included, which can be
+// discharged with RespondDischarges. Additional tickets are only available in
+// the handler passed to InitRequestMiddleware and those that the TP can't
+// recover are omitted.
+func TicketsFromRequest(r *http.Request) ([]Ticket, error) {
+	fd, ok := r.Context().Value(contextKeyFlowData).(*flowData)
+	if !ok || fd == nil {
+		return nil, errors.New("middleware not called")
+	}
+
+	ret := []Ticket{{Location: fd.location, Caveats: fd.caveats}}
+	for _, afd := range fd.additional {
+		if afd != nil {
+			ret = append(ret, Ticket{Location: afd.location, Caveats: afd.caveats})
+		}
+	}
+
+	return ret, nil
+}
+
+// RequestedCaveatsFromRequest returns the caveats the client asked to have
+// added to the discharge (see WithRequestedCaveats). These are only available
+// in the handler passed to InitRequestMiddleware. The client is untrusted, so
+// handlers must check that requested caveats are acceptable before passing
+// them along to RespondDischarge or DischargePoll.
+func RequestedCaveatsFromRequest(r *http.Request) ([]macaroon.Caveat, error) {
+	if fd, ok := r.Context().Value(contextKeyFlowData).(*flowData); ok && fd != nil {
+		return fd.requestedCaveats, nil
+	}
+
+	return nil, errors.New("middleware not called")
+}
+
 func (tp *TP) newFDOrError(w http.ResponseWriter, r *http.Request, reqType string, ticket []byte) (*flowData, *http.Request) {
 	fd, err := tp.newFD(r, reqType, ticket)
 	if err != nil {
 		tp.getLog(r).WithError(err).Warn("recover ticket")
-		http.Error(w, `{"error": "internal server error"}`, http.StatusInternalServerError)
+
+		var lmErr *LocationMismatchError
+		if errors.As(err, &lmErr) {
+			tp.RespondError(w, r, http.StatusBadRequest, lmErr.Error())
+		} else {
+			http.Error(w, `{"error": "internal server error"}`, http.StatusInternalServerError)
+		}
+
 		return nil, r
 	}
 
@@ -353,13 +906,14 @@ func (tp *TP) newFDOrError(w http.ResponseWriter, r *http.Request, reqType strin
 func (tp *TP) newFD(r *http.Request, reqType string, ticket []byte) (*flowData, error) {
 	log := tp.getLog(r).WithField("req", reqType)
 
-	caveats, discharge, err := macaroon.DischargeTicket(tp.Key, tp.Location, ticket)
+	location, caveats, discharge, err := tp.dischargeTicket(ticket)
 	if err != nil {
 		return nil, err
 	}
 
 	fd := &flowData{
 		ticket:    ticket,
+		location:  location,
 		caveats:   caveats,
 		discharge: discharge,
 		log:       log.WithField("tid", digest(ticket)),
@@ -368,6 +922,45 @@ func (tp *TP) newFD(r *http.Request, reqType string, ticket []byte) (*flowData,
 	return fd, nil
 }
 
+// dischargeTicket recovers the ticket with the key for TP.Location, or else
+// with the key for one of TP.AdditionalLocations, returning the location whose
+// key worked. Tickets for locations that aren't accepted are refused.
+func (tp *TP) dischargeTicket(ticket []byte) (string, []macaroon.Caveat, *macaroon.Macaroon, error) {
+	ticketLoc, caveats, discharge, err := macaroon.DischargeTicketWithLocation(tp.Key, tp.Location, ticket)
+	if err == nil {
+		return tp.Location, caveats, discharge, tp.checkTicketLocation(tp.Location, ticketLoc)
+	}
+
+	locations := maps.Keys(tp.AdditionalLocations)
+	slices.Sort(locations)
+
+	for _, loc := range locations {
+		if ticketLoc, caveats, discharge, aerr := macaroon.DischargeTicketWithLocation(tp.AdditionalLocations[loc], loc, ticket); aerr == nil {
+			return loc, caveats, discharge, tp.checkTicketLocation(loc, ticketLoc)
+		}
+	}
+
+	return "", nil, nil, err
+}
+
+// checkTicketLocation checks that the location recorded in a ticket recovered
+// with the key for loc is accepted.
+func (tp *TP) checkTicketLocation(loc, ticketLoc string) error {
+	accepted := tp.AcceptedLocations
+	if len(accepted) == 0 {
+		accepted = []string{tp.Location}
+	}
+	if !slices.Contains(accepted, loc) {
+		accepted = append(slices.Clip(accepted), loc)
+	}
+
+	if ticketLoc == "" || slices.Contains(accepted, ticketLoc) {
+		return nil
+	}
+
+	return &LocationMismatchError{TicketLocation: ticketLoc, Accepted: accepted}
+}
+
 func (tp *TP) fdOrError(w http.ResponseWriter, r *http.Request) *flowData {
 	if fd, ok := r.Context().Value(contextKeyFlowData).(*flowData); ok && fd != nil {
 		return fd
@@ -33,6 +33,41 @@ type Store interface {
 	UserSecretMunger
 }
 
+// ErrFlowResolved is returned when making a flow pending that has already
+// been discharged or aborted.
+var ErrFlowResolved = errors.New("flow already resolved")
+
+// PendingStore is implemented by Stores that can update pending flows
+// atomically. TP.SetPendingByPollSecret and SetPendingByUserSecret use it if
+// the Store implements it. Otherwise, they check that the flow is unresolved
+// before updating it, so a flow discharged or aborted concurrently (e.g. by
+// another server sharing the Store) can be overwritten and never finish.
+type PendingStore interface {
+	Store
+
+	// UpdatePendingByPollSecret is like UpdateByPollSecret, but returns
+	// ErrFlowResolved without updating the flow if it has already been
+	// discharged or aborted.
+	UpdatePendingByPollSecret(context.Context, string, *StoreData) error
+
+	// UpdatePendingByUserSecret is like UpdateByUserSecret, but returns
+	// ErrFlowResolved without updating the flow if it has already been
+	// discharged or aborted.
+	UpdatePendingByUserSecret(context.Context, string, *StoreData) error
+}
+
+// checkPending returns an error unless sd is a flow that can be made pending.
+func (sd *StoreData) checkPending() error {
+	switch sd.ResponseStatus {
+	case 0, http.StatusAccepted:
+		return nil
+	case ticketRefStatus:
+		return errNotFound
+	default:
+		return ErrFlowResolved
+	}
+}
+
 type UserSecretMunger interface {
 	UserSecretToURL(userSecret string) (url string)
 	UserSecretFromRequest(r *http.Request) (string, error)
@@ -55,7 +90,7 @@ func NewMemoryStore(m UserSecretMunger, size int) (*MemoryStore, error) {
 	}, nil
 }
 
-var _ Store = (*MemoryStore)(nil)
+var _ PendingStore = (*MemoryStore)(nil)
 
 var (
 	errNotFound = errors.New("not found")
@@ -101,6 +136,16 @@ func (s *MemoryStore) UpdateByUserSecret(_ context.Context, userSecret string, s
 	return lsd.updateStoreData(sd)
 }
 
+func (s *MemoryStore) UpdatePendingByPollSecret(_ context.Context, pollSecret string, sd *StoreData) error {
+	lsd, _ := s.Cache.Get(pollSecretKey(pollSecret))
+	return lsd.updatePendingStoreData(sd)
+}
+
+func (s *MemoryStore) UpdatePendingByUserSecret(_ context.Context, userSecret string, sd *StoreData) error {
+	lsd, _ := s.Cache.Get(userSecretKey(userSecret))
+	return lsd.updatePendingStoreData(sd)
+}
+
 func (s *MemoryStore) DeleteByPollSecret(ctx context.Context, pollSecret string) error {
 	if lsd, _ := s.Cache.Get(pollSecretKey(pollSecret)); lsd != nil {
 		s.Cache.Remove(lsd.pollSecretKey)
@@ -157,6 +202,23 @@ func (lsd *lockedStoreData) updateStoreData(sd *StoreData) error {
 	return nil
 }
 
+func (lsd *lockedStoreData) updatePendingStoreData(sd *StoreData) error {
+	if lsd == nil {
+		return errNotFound
+	}
+
+	lsd.Lock()
+	defer lsd.Unlock()
+
+	if err := lsd.StoreData.checkPending(); err != nil {
+		return err
+	}
+
+	lsd.StoreData = *sd
+
+	return nil
+}
+
 func digest[T string | []byte](d T) string {
 	digest := blake2b.Sum256([]byte(d))
 	return hex.EncodeToString(digest[:])
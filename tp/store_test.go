@@ -2,6 +2,7 @@ package tp
 
 import (
 	"context"
+	"net/http"
 	"testing"
 
 	"github.com/alecthomas/assert/v2"
@@ -131,3 +132,66 @@ func TestMemoryStoreSecrets(t *testing.T) {
 	_, err = ms.GetByUserSecret(ctx, bUS)
 	assert.Equal(t, errNotFound, err)
 }
+
+func TestMemoryStorePending(t *testing.T) {
+	ctx := context.Background()
+
+	ms, err := NewMemoryStore(PrefixMunger("/user/"), 100)
+	assert.NoError(t, err)
+
+	pending := &StoreData{Ticket: []byte("a"), ResponseStatus: http.StatusAccepted, ResponseBody: []byte("pending")}
+	resolved := &StoreData{Ticket: []byte("a"), ResponseStatus: http.StatusOK, ResponseBody: []byte("discharge")}
+
+	us, ps, err := ms.Insert(ctx, &StoreData{Ticket: []byte("a")})
+	assert.NoError(t, err)
+	assert.NoError(t, ms.UpdatePendingByPollSecret(ctx, ps, pending))
+	assert.NoError(t, ms.UpdatePendingByUserSecret(ctx, us, pending))
+
+	assert.NoError(t, ms.UpdateByPollSecret(ctx, ps, resolved))
+	assert.IsError(t, ms.UpdatePendingByPollSecret(ctx, ps, pending), ErrFlowResolved)
+	assert.IsError(t, ms.UpdatePendingByUserSecret(ctx, us, pending), ErrFlowResolved)
+
+	sd, err := ms.GetByPollSecret(ctx, ps)
+	assert.NoError(t, err)
+	assert.Equal(t, resolved, sd)
+
+	// ticket references aren't flows
+	_, ref, err := ms.Insert(ctx, &StoreData{Ticket: []byte("b"), ResponseStatus: ticketRefStatus})
+	assert.NoError(t, err)
+	assert.Equal(t, errNotFound, ms.UpdatePendingByPollSecret(ctx, ref, pending))
+	assert.Equal(t, errNotFound, ms.UpdatePendingByPollSecret(ctx, "missing", pending))
+}
+
+// resolvingStore resolves flows right after they're read, as if they were
+// discharged concurrently.
+type resolvingStore struct {
+	*MemoryStore
+}
+
+func (s resolvingStore) GetByPollSecret(ctx context.Context, pollSecret string) (*StoreData, error) {
+	sd, err := s.MemoryStore.GetByPollSecret(ctx, pollSecret)
+	if err != nil {
+		return nil, err
+	}
+
+	resolved := *sd
+	resolved.ResponseStatus = http.StatusOK
+	return sd, s.MemoryStore.UpdateByPollSecret(ctx, pollSecret, &resolved)
+}
+
+func TestSetPendingRace(t *testing.T) {
+	ctx := context.Background()
+
+	ms, err := NewMemoryStore(PrefixMunger("/user/"), 100)
+	assert.NoError(t, err)
+
+	tp := &TP{Store: resolvingStore{ms}}
+
+	_, ps, err := ms.Insert(ctx, &StoreData{Ticket: []byte("a")})
+	assert.NoError(t, err)
+	assert.IsError(t, tp.SetPendingByPollSecret(ctx, ps, PendingInfo{Actor: "alice"}), ErrFlowResolved)
+
+	sd, err := ms.GetByPollSecret(ctx, ps)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, sd.ResponseStatus)
+}
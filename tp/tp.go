@@ -1,12 +1,39 @@
 package tp
 
+import (
+	"time"
+
+	"github.com/superfly/macaroon"
+)
+
 const (
 	InitPath       = "/.well-known/macfly/3p"
 	PollPathPrefix = "/.well-known/macfly/3p/poll/"
+
+	// InitTicketPath is where clients send tickets too large to include in
+	// init requests. The raw ticket is sent as the request body and the
+	// response has a reference to it for use in the init request. See
+	// TP.HandleInitTicketRequest.
+	InitTicketPath = "/.well-known/macfly/3p/init-ticket"
 )
 
 type jsonInitRequest struct {
 	Ticket []byte `json:"ticket,omitempty"`
+
+	// RequestedCaveats are caveats the client would like added to the
+	// discharge. Third parties that don't support caveat negotiation ignore
+	// this field.
+	RequestedCaveats *macaroon.CaveatSet `json:"requested_caveats,omitempty"`
+
+	// AdditionalTickets are tickets for other locations served by the same
+	// host that the client would like discharged in the same flow. Third
+	// parties that don't advertise capabilityMultipleDischarges ignore this
+	// field.
+	AdditionalTickets [][]byte `json:"additional_tickets,omitempty"`
+
+	// TicketRef refers to a ticket previously sent to InitTicketPath. It is
+	// set instead of Ticket.
+	TicketRef string `json:"ticket_ref,omitempty"`
 }
 
 type jsonResponse struct {
@@ -14,8 +41,46 @@ type jsonResponse struct {
 	Discharge       string               `json:"discharge,omitempty"`
 	PollURL         string               `json:"poll_url,omitempty"`
 	UserInteractive *jsonUserInteractive `json:"user_interactive,omitempty"`
+
+	// AdditionalDischarges are the discharges for the request's
+	// AdditionalTickets, in the same order. Tickets that weren't discharged
+	// have an empty string.
+	AdditionalDischarges []string `json:"additional_discharges,omitempty"`
+
+	// Capabilities are the optional protocol features the third party
+	// supports.
+	Capabilities []string `json:"capabilities,omitempty"`
+
+	// TicketRef is the response to a request to InitTicketPath.
+	TicketRef string `json:"ticket_ref,omitempty"`
+
+	// Pending is set in poll responses (and the response starting the flow)
+	// while the third party is waiting for something outside of its control.
+	// Clients that don't know about it see a normal "not ready" response.
+	Pending *PendingInfo `json:"pending,omitempty"`
+}
+
+// PendingInfo describes what a discharge flow is waiting for when the third
+// party can't issue the discharge until somebody else acts (e.g. an approver
+// responding to a chat message). It is for display to the user. See
+// TP.RespondPending and WithPendingCallback.
+type PendingInfo struct {
+	// Reason describes what the flow is waiting for (e.g. "waiting for
+	// approval").
+	Reason string `json:"reason"`
+
+	// Actor identifies who needs to act (e.g. "@alice"), if known.
+	Actor string `json:"actor,omitempty"`
+
+	// RequestedAt is when the action was requested, or the zero time if it
+	// isn't known.
+	RequestedAt time.Time `json:"requested_at"`
 }
 
+// capabilityMultipleDischarges indicates that the third party handles
+// jsonInitRequest.AdditionalTickets.
+const capabilityMultipleDischarges = "multiple-discharges"
+
 type jsonUserInteractive struct {
 	PollURL string `json:"poll_url,omitempty"`
 	UserURL string `json:"user_url,omitempty"`
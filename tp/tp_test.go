@@ -1,10 +1,17 @@
 package tp
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
+	"sort"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -12,6 +19,9 @@ import (
 	"github.com/hashicorp/go-cleanhttp"
 	"github.com/sirupsen/logrus"
 	"github.com/superfly/macaroon"
+	"github.com/superfly/macaroon/bundle"
+	"github.com/superfly/macaroon/crypto"
+	"github.com/vmihailenco/msgpack/v5"
 )
 
 func TestTP(t *testing.T) {
@@ -46,22 +56,6 @@ func TestTP(t *testing.T) {
 		Log:      logrus.StandardLogger(),
 	}
 
-	t.Run("immediate response", func(t *testing.T) {
-		handleInit = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			_, err := CaveatsFromRequest(r)
-			assert.NoError(t, err)
-
-			tp.RespondDischarge(w, r, myCaveat("dis-cav"))
-		})
-
-		hdr := genFP(t, tp, myCaveat("fp-cav"))
-		c := NewClient(firstPartyLocation)
-		hdr, err = c.FetchDischargeTokens(context.Background(), hdr)
-		assert.NoError(t, err)
-		cavs := checkFP(t, hdr)
-		assert.Equal(t, []string{"fp-cav", "dis-cav"}, cavs)
-	})
-
 	t.Run("WithBearerAuthentication", func(t *testing.T) {
 		t.Run("sends token to correct host", func(t *testing.T) {
 			handleInit = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -106,6 +100,41 @@ func TestTP(t *testing.T) {
 		})
 	})
 
+	t.Run("WithRequestedCaveats", func(t *testing.T) {
+		handleInit = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requested, err := RequestedCaveatsFromRequest(r)
+			assert.NoError(t, err)
+
+			// only allow clients to request validity windows
+			var cavs []macaroon.Caveat
+			for _, cav := range requested {
+				if _, ok := cav.(*macaroon.ValidityWindow); ok {
+					cavs = append(cavs, cav)
+				}
+			}
+
+			tp.RespondDischarge(w, r, append(cavs, myCaveat("dis-cav"))...)
+		})
+
+		vw := &macaroon.ValidityWindow{
+			NotBefore: time.Now().Add(-time.Minute).Unix(),
+			NotAfter:  time.Now().Add(time.Minute).Unix(),
+		}
+
+		hdr := genFP(t, tp, myCaveat("fp-cav"))
+		c := NewClient(firstPartyLocation,
+			WithRequestedCaveats(tp.Location, vw, myCaveat("requested-cav")),
+			WithRequestedCaveats("https://wrong.com", &macaroon.ValidityWindow{}),
+		)
+		hdr, err = c.FetchDischargeTokens(context.Background(), hdr)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"fp-cav", "dis-cav"}, checkFP(t, hdr))
+
+		cs, err := validateFirstPartyMacaroon(hdr)
+		assert.NoError(t, err)
+		assert.Equal(t, []*macaroon.ValidityWindow{vw}, macaroon.GetCaveats[*macaroon.ValidityWindow](cs))
+	})
+
 	t.Run("poll response", func(t *testing.T) {
 		pollSecret := ""
 		pollSecretSet := make(chan struct{})
@@ -152,6 +181,69 @@ func TestTP(t *testing.T) {
 		assert.Equal(t, []string{"fp-cav", "dis-cav"}, cavs)
 	})
 
+	t.Run("pending response", func(t *testing.T) {
+		var (
+			pollSecret  string
+			requestedAt = time.Unix(1700000000, 0).UTC()
+			alice       = PendingInfo{Reason: "needs approval", Actor: "alice", RequestedAt: requestedAt}
+			bob         = PendingInfo{Reason: "needs approval", Actor: "bob", RequestedAt: requestedAt}
+			seen        []PendingInfo
+		)
+
+		handleInit = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, err := CaveatsFromRequest(r)
+			assert.NoError(t, err)
+
+			pollSecret = tp.RespondPending(w, r, alice)
+		})
+
+		hdr := genFP(t, tp, myCaveat("fp-cav"))
+
+		c := NewClient(firstPartyLocation,
+			WithPollingBackoff(func(time.Duration) time.Duration {
+				return 10 * time.Millisecond
+			}),
+			WithPendingCallback(func(_ context.Context, pi PendingInfo) error {
+				seen = append(seen, pi)
+
+				switch len(seen) {
+				case 1:
+					// reassigned before the first poll
+					assert.NoError(t, tp.SetPendingByPollSecret(context.Background(), pollSecret, bob))
+				case 2:
+					// clients that don't know about pending flows just
+					// see that the discharge isn't ready.
+					resp, err := http.Get(s.URL + PollPathPrefix + url.PathEscape(pollSecret))
+					assert.NoError(t, err)
+					defer resp.Body.Close()
+					assert.Equal(t, http.StatusAccepted, resp.StatusCode)
+
+					var jresp struct{ Error string }
+					assert.NoError(t, json.NewDecoder(resp.Body).Decode(&jresp))
+					assert.Equal(t, "not ready", jresp.Error)
+
+					assert.NoError(t, tp.DischargePoll(context.Background(), pollSecret, myCaveat("dis-cav")))
+				default:
+					t.Fatal("unexpected pending callback")
+				}
+
+				return nil
+			}),
+		)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		hdr, err = c.FetchDischargeTokens(ctx, hdr)
+		assert.NoError(t, err)
+		assert.Equal(t, []PendingInfo{alice, bob}, seen)
+		cavs := checkFP(t, hdr)
+		assert.Equal(t, []string{"fp-cav", "dis-cav"}, cavs)
+
+		// resolved flows can't be made pending again
+		assert.Error(t, tp.SetPendingByPollSecret(context.Background(), pollSecret, alice))
+	})
+
 	t.Run("user interactive response", func(t *testing.T) {
 		userSecret := ""
 
@@ -186,6 +278,273 @@ func TestTP(t *testing.T) {
 		cavs := checkFP(t, hdr)
 		assert.Equal(t, []string{"fp-cav", "dis-cav"}, cavs)
 	})
+
+	t.Run("InitRateLimit", func(t *testing.T) {
+		rl, err := NewMemoryRateLimiter(time.Hour, 1, 100)
+		assert.NoError(t, err)
+		tp.InitRateLimit = rl
+		t.Cleanup(func() { tp.InitRateLimit = nil })
+
+		handleInit = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			tp.RespondDischarge(w, r)
+		})
+
+		hdr := genFP(t, tp)
+		c := NewClient(firstPartyLocation)
+		_, err = c.FetchDischargeTokens(context.Background(), hdr)
+		assert.NoError(t, err)
+
+		// same ticket from the same client
+		_, err = c.FetchDischargeTokens(context.Background(), hdr)
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "(429)")
+
+		// different ticket
+		_, err = c.FetchDischargeTokens(context.Background(), genFP(t, tp))
+		assert.NoError(t, err)
+	})
+
+	t.Run("PollRateLimit", func(t *testing.T) {
+		rl, err := NewMemoryRateLimiter(time.Second, 1, 100)
+		assert.NoError(t, err)
+		tp.PollRateLimit = rl
+		t.Cleanup(func() { tp.PollRateLimit = nil })
+
+		pollSecret := ""
+		handleInit = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			pollSecret = tp.RespondPoll(w, r)
+		})
+
+		var polls []int
+		c := NewClient(firstPartyLocation,
+			WithHTTP(&http.Client{Transport: roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+				resp, err := cleanhttp.DefaultTransport().RoundTrip(r)
+				if err != nil || !strings.HasPrefix(r.URL.Path, PollPathPrefix) {
+					return resp, err
+				}
+
+				polls = append(polls, resp.StatusCode)
+
+				// discharge once the client has been rate limited
+				if resp.StatusCode == http.StatusTooManyRequests {
+					assert.Equal(t, "1", resp.Header.Get("Retry-After"))
+					assert.NoError(t, tp.DischargePoll(context.Background(), pollSecret))
+				}
+
+				return resp, err
+			})}),
+			// without Retry-After, the client would wait too long
+			WithPollingBackoff(func(last time.Duration) time.Duration {
+				if last == 0 {
+					return 10 * time.Millisecond
+				}
+				return time.Minute
+			}),
+		)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		_, err = c.FetchDischargeTokens(ctx, genFP(t, tp))
+		assert.NoError(t, err)
+		assert.Equal(t, []int{http.StatusAccepted, http.StatusTooManyRequests, http.StatusOK}, polls)
+	})
+
+	t.Run("WithFlowStore", func(t *testing.T) {
+		var (
+			pollSecret string
+			inits      int
+		)
+
+		handleInit = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			inits++
+			pollSecret = tp.RespondPoll(w, r)
+		})
+
+		fs, err := NewFileFlowStore(t.TempDir())
+		assert.NoError(t, err)
+
+		// interrupt the client once it starts polling
+		interrupted := func(opts ...ClientOption) (*Client, context.Context) {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			t.Cleanup(cancel)
+
+			return NewClient(firstPartyLocation, append([]ClientOption{
+				WithFlowStore(fs),
+				WithPollingBackoff(func(time.Duration) time.Duration { return time.Minute }),
+				WithHTTP(&http.Client{Transport: roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+					resp, err := cleanhttp.DefaultTransport().RoundTrip(r)
+					if err == nil && strings.HasPrefix(r.URL.Path, PollPathPrefix) && resp.StatusCode == http.StatusAccepted {
+						cancel()
+					}
+					return resp, err
+				})}),
+			}, opts...)...), ctx
+		}
+
+		files := func() int {
+			entries, err := os.ReadDir(fs.Dir)
+			assert.NoError(t, err)
+			return len(entries)
+		}
+
+		t.Run("resume", func(t *testing.T) {
+			inits = 0
+			hdr := genFP(t, tp, myCaveat("fp-cav"))
+
+			c, ctx := interrupted()
+			_, err := c.FetchDischargeTokens(ctx, hdr)
+			assert.IsError(t, err, context.Canceled)
+			assert.Equal(t, 1, inits)
+			assert.Equal(t, 1, files())
+
+			// the flow completes while the client isn't running
+			assert.NoError(t, tp.DischargePoll(context.Background(), pollSecret, myCaveat("dis-cav")))
+
+			hdr, err = NewClient(firstPartyLocation, WithFlowStore(fs)).FetchDischargeTokens(context.Background(), hdr)
+			assert.NoError(t, err)
+			assert.Equal(t, []string{"fp-cav", "dis-cav"}, checkFP(t, hdr))
+			assert.Equal(t, 1, inits)
+			assert.Equal(t, 0, files())
+		})
+
+		t.Run("restart gone flow", func(t *testing.T) {
+			inits = 0
+			hdr := genFP(t, tp, myCaveat("fp-cav"))
+
+			c, ctx := interrupted()
+			_, err := c.FetchDischargeTokens(ctx, hdr)
+			assert.IsError(t, err, context.Canceled)
+			assert.Equal(t, 1, files())
+
+			// the third party forgets about the flow
+			assert.NoError(t, tp.Store.DeleteByPollSecret(context.Background(), pollSecret))
+
+			handleInit = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				inits++
+				tp.RespondDischarge(w, r, myCaveat("dis-cav"))
+			})
+
+			hdr, err = NewClient(firstPartyLocation, WithFlowStore(fs)).FetchDischargeTokens(context.Background(), hdr)
+			assert.NoError(t, err)
+			assert.Equal(t, []string{"fp-cav", "dis-cav"}, checkFP(t, hdr))
+			assert.Equal(t, 2, inits)
+			assert.Equal(t, 0, files())
+		})
+
+		t.Run("user interactive", func(t *testing.T) {
+			var userSecret string
+
+			inits = 0
+			handleInit = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				inits++
+				userSecret = tp.RespondUserInteractive(w, r)
+			})
+
+			var opened []string
+			openURL := func(err error) ClientOption {
+				return WithUserURLCallback(func(_ context.Context, url string) error {
+					opened = append(opened, url)
+					return err
+				})
+			}
+
+			// flows the user wasn't sent to aren't saved
+			hdr := genFP(t, tp, myCaveat("fp-cav"))
+			_, err := NewClient(firstPartyLocation, WithFlowStore(fs), openURL(errors.New("no browser"))).FetchDischargeTokens(context.Background(), hdr)
+			assert.Error(t, err)
+			assert.Equal(t, 1, len(opened))
+			assert.Equal(t, 0, files())
+
+			// the user is sent to the same URL again when the flow is resumed
+			opened, inits = nil, 0
+			hdr = genFP(t, tp, myCaveat("fp-cav"))
+			c, ctx := interrupted(openURL(nil))
+			_, err = c.FetchDischargeTokens(ctx, hdr)
+			assert.IsError(t, err, context.Canceled)
+			assert.Equal(t, 1, files())
+
+			assert.NoError(t, tp.DischargeUserInteractive(context.Background(), userSecret, myCaveat("dis-cav")))
+
+			hdr, err = NewClient(firstPartyLocation, WithFlowStore(fs), openURL(nil)).FetchDischargeTokens(context.Background(), hdr)
+			assert.NoError(t, err)
+			assert.Equal(t, []string{"fp-cav", "dis-cav"}, checkFP(t, hdr))
+			assert.Equal(t, 1, inits)
+			assert.Equal(t, 2, len(opened))
+			assert.Equal(t, opened[0], opened[1])
+			assert.Equal(t, 0, files())
+
+			// flows are dropped if the callback fails when they're resumed
+			opened = nil
+			hdr = genFP(t, tp, myCaveat("fp-cav"))
+			c, ctx = interrupted(openURL(nil))
+			_, err = c.FetchDischargeTokens(ctx, hdr)
+			assert.IsError(t, err, context.Canceled)
+			assert.Equal(t, 1, files())
+
+			_, err = NewClient(firstPartyLocation, WithFlowStore(fs), openURL(errors.New("no browser"))).FetchDischargeTokens(context.Background(), hdr)
+			assert.Error(t, err)
+			assert.Equal(t, 2, len(opened))
+			assert.Equal(t, 0, files())
+		})
+	})
+
+	t.Run("WithProtocol", func(t *testing.T) {
+		handleInit = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, err := CaveatsFromRequest(r)
+			assert.NoError(t, err)
+
+			tp.RespondDischarge(w, r, myCaveat("http-cav"))
+		})
+
+		var (
+			otherLoc = "grpc://auth.internal"
+			otherKey = macaroon.NewEncryptionKey()
+		)
+
+		fp, err := macaroon.New(fpKID, firstPartyLocation, fpKey)
+		assert.NoError(t, err)
+		assert.NoError(t, fp.Add3P(tp.Key, tp.Location))
+		assert.NoError(t, fp.Add3P(otherKey, otherLoc))
+		tok, err := fp.Encode()
+		assert.NoError(t, err)
+
+		var gotLoc string
+		c := NewClient(firstPartyLocation,
+			WithProtocol(".internal", protocolFunc(func(_ context.Context, location string, ticket []byte) (string, error) {
+				gotLoc = location
+
+				_, dm, err := macaroon.DischargeTicket(otherKey, location, ticket)
+				if err != nil {
+					return "", err
+				}
+				if err := dm.Add(myCaveat("grpc-cav")); err != nil {
+					return "", err
+				}
+				return dm.String()
+			})),
+		)
+
+		hdr, err := c.FetchDischargeTokens(context.Background(), macaroon.ToAuthorizationHeader(tok))
+		assert.NoError(t, err)
+		assert.Equal(t, otherLoc, gotLoc)
+
+		cavs := checkFP(t, hdr)
+		sort.Strings(cavs)
+		assert.Equal(t, []string{"grpc-cav", "http-cav"}, cavs)
+	})
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+type protocolFunc func(ctx context.Context, location string, ticket []byte) (string, error)
+
+func (f protocolFunc) Discharge(ctx context.Context, location string, ticket []byte) (string, error) {
+	return f(ctx, location, ticket)
 }
 
 var (
@@ -286,3 +645,679 @@ func init() { macaroon.RegisterCaveatType(new(myCaveat)) }
 func (c myCaveat) CaveatType() macaroon.CaveatType   { return macaroon.CavMinUserDefined }
 func (c myCaveat) Name() string                      { return "myCaveat" }
 func (c myCaveat) Prohibits(f macaroon.Access) error { return nil }
+
+func TestMultipleDischarges(t *testing.T) {
+	var (
+		tp         *TP
+		handleInit http.Handler
+		nInit      int
+		m          sync.Mutex
+	)
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch path := r.URL.EscapedPath(); path {
+		case InitPath, "/accounts" + InitPath:
+			m.Lock()
+			nInit++
+			m.Unlock()
+
+			tp.InitRequestMiddleware(handleInit).ServeHTTP(w, r)
+		default:
+			panic(path)
+		}
+	}))
+	t.Cleanup(s.Close)
+
+	var (
+		authLoc     = s.URL
+		accountsLoc = s.URL + "/accounts"
+		accountsKey = macaroon.NewEncryptionKey()
+	)
+
+	tp = &TP{
+		Location:            authLoc,
+		Key:                 macaroon.NewEncryptionKey(),
+		AdditionalLocations: map[string]macaroon.EncryptionKey{accountsLoc: accountsKey},
+	}
+
+	genHdr := func(t *testing.T) string {
+		m, err := macaroon.New(fpKID, firstPartyLocation, fpKey)
+		assert.NoError(t, err)
+		assert.NoError(t, m.Add3P(tp.Key, authLoc))
+		assert.NoError(t, m.Add3P(accountsKey, accountsLoc))
+
+		tok, err := m.Encode()
+		assert.NoError(t, err)
+
+		return macaroon.ToAuthorizationHeader(tok)
+	}
+
+	fetch := func(t *testing.T) []string {
+		nInit = 0
+
+		hdr, err := NewClient(firstPartyLocation).FetchDischargeTokens(context.Background(), genHdr(t))
+		assert.NoError(t, err)
+
+		cavs := checkFP(t, hdr)
+		sort.Strings(cavs)
+		return cavs
+	}
+
+	t.Run("one round trip", func(t *testing.T) {
+		handleInit = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			tickets, err := TicketsFromRequest(r)
+			assert.NoError(t, err)
+			assert.Equal(t, 2, len(tickets))
+
+			cavs := map[string][]macaroon.Caveat{}
+			for _, ticket := range tickets {
+				cavs[ticket.Location] = []macaroon.Caveat{myCaveat(strings.TrimPrefix(ticket.Location, s.URL))}
+			}
+
+			tp.RespondDischarges(w, r, cavs)
+		})
+
+		assert.Equal(t, []string{"", "/accounts"}, fetch(t))
+		assert.Equal(t, 1, nInit)
+	})
+
+	t.Run("partial", func(t *testing.T) {
+		handleInit = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			tickets, err := TicketsFromRequest(r)
+			assert.NoError(t, err)
+
+			// only the primary ticket is discharged in each flow
+			tp.RespondDischarges(w, r, map[string][]macaroon.Caveat{
+				tickets[0].Location: {myCaveat("partial")},
+			})
+		})
+
+		assert.Equal(t, []string{"partial", "partial"}, fetch(t))
+		assert.Equal(t, 2, nInit)
+	})
+
+	t.Run("handler using RespondDischarge", func(t *testing.T) {
+		handleInit = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			tp.RespondDischarge(w, r, myCaveat("single"))
+		})
+
+		assert.Equal(t, []string{"single", "single"}, fetch(t))
+		assert.Equal(t, 2, nInit)
+	})
+
+	t.Run("old server", func(t *testing.T) {
+		handleInit = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fd := tp.fdOrError(w, r)
+			tok, err := fd.discharge.String()
+			assert.NoError(t, err)
+
+			// no capabilities or additional discharges
+			w.WriteHeader(http.StatusCreated)
+			assert.NoError(t, json.NewEncoder(w).Encode(map[string]string{"discharge": tok}))
+		})
+
+		assert.Equal(t, []string{}, fetch(t))
+		assert.Equal(t, 2, nInit)
+	})
+}
+
+func TestDischargeErrors(t *testing.T) {
+	var (
+		tp         *TP
+		handleInit http.Handler
+	)
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path := r.URL.EscapedPath()
+
+		switch {
+		case path == InitPath, path == "/other"+InitPath:
+			tp.InitRequestMiddleware(handleInit).ServeHTTP(w, r)
+		case strings.HasPrefix(path, PollPathPrefix):
+			tp.HandlePollRequest(w, r)
+		default:
+			panic(path)
+		}
+	}))
+	t.Cleanup(s.Close)
+
+	ms, err := NewMemoryStore(PrefixMunger("/user/"), 100)
+	assert.NoError(t, err)
+
+	otherLoc := s.URL + "/other"
+
+	tp = &TP{
+		Location:            s.URL,
+		Key:                 macaroon.NewEncryptionKey(),
+		AdditionalLocations: map[string]macaroon.EncryptionKey{otherLoc: macaroon.NewEncryptionKey()},
+		Store:               ms,
+		Log:                 logrus.StandardLogger(),
+	}
+
+	fastPoll := WithPollingBackoff(func(time.Duration) time.Duration {
+		return 10 * time.Millisecond
+	})
+
+	fetch := func(t *testing.T, ctx context.Context, opts ...ClientOption) *DischargeError {
+		t.Helper()
+
+		_, err := NewClient(firstPartyLocation, opts...).FetchDischargeTokens(ctx, genFP(t, tp))
+		assert.Error(t, err)
+
+		des := DischargeErrors(err)
+		assert.Equal(t, 1, len(des))
+		assert.Equal(t, s.URL, des[0].Location)
+		assert.NotZero(t, des[0].Ticket)
+
+		return des[0]
+	}
+
+	t.Run("transport", func(t *testing.T) {
+		handleInit = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("not json"))
+		})
+
+		de := fetch(t, context.Background())
+		assert.Equal(t, KindTransport, de.Kind)
+	})
+
+	t.Run("rejected", func(t *testing.T) {
+		handleInit = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			tp.RespondError(w, r, http.StatusForbidden, "nope")
+		})
+
+		de := fetch(t, context.Background())
+		assert.Equal(t, KindRejected, de.Kind)
+
+		var tpErr *Error
+		assert.True(t, errors.As(de, &tpErr))
+		assert.Equal(t, "nope", tpErr.Msg)
+	})
+
+	t.Run("user interaction required", func(t *testing.T) {
+		handleInit = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			tp.RespondUserInteractive(w, r)
+		})
+
+		de := fetch(t, context.Background())
+		assert.Equal(t, KindUserInteractionRequired, de.Kind)
+		assert.IsError(t, de, ErrMissingUserURLCallback)
+	})
+
+	t.Run("aborted", func(t *testing.T) {
+		handleInit = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			tp.RespondUserInteractive(w, r)
+		})
+
+		cbErr := errors.New("user declined")
+
+		de := fetch(t, context.Background(), WithUserURLCallback(func(context.Context, string) error {
+			return cbErr
+		}))
+		assert.Equal(t, KindAborted, de.Kind)
+		assert.IsError(t, de, cbErr)
+		assert.Equal(t, "discharge "+s.URL+": user declined", de.Error())
+	})
+
+	t.Run("pending aborted", func(t *testing.T) {
+		handleInit = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			tp.RespondPending(w, r, PendingInfo{Reason: "needs approval"})
+		})
+
+		cbErr := errors.New("gave up")
+
+		de := fetch(t, context.Background(), fastPoll, WithPendingCallback(func(context.Context, PendingInfo) error {
+			return cbErr
+		}))
+		assert.Equal(t, KindAborted, de.Kind)
+		assert.IsError(t, de, cbErr)
+	})
+
+	t.Run("canceled", func(t *testing.T) {
+		handleInit = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			tp.RespondPoll(w, r)
+		})
+
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(50*time.Millisecond, cancel)
+
+		de := fetch(t, ctx, fastPoll)
+		assert.Equal(t, KindAborted, de.Kind)
+		assert.IsError(t, de, context.Canceled)
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		handleInit = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			tp.RespondPoll(w, r)
+		})
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+
+		de := fetch(t, ctx, fastPoll)
+		assert.Equal(t, KindTimeout, de.Kind)
+		assert.IsError(t, de, context.DeadlineExceeded)
+	})
+
+	t.Run("multiple", func(t *testing.T) {
+		handleInit = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			tp.RespondError(w, r, http.StatusForbidden, "nope")
+		})
+
+		m, err := macaroon.New(fpKID, firstPartyLocation, fpKey)
+		assert.NoError(t, err)
+		assert.NoError(t, m.Add3P(tp.Key, s.URL))
+		assert.NoError(t, m.Add3P(tp.AdditionalLocations[otherLoc], otherLoc))
+		tok, err := m.Encode()
+		assert.NoError(t, err)
+
+		_, err = NewClient(firstPartyLocation).FetchDischargeTokens(context.Background(), macaroon.ToAuthorizationHeader(tok))
+		assert.Error(t, err)
+
+		des := DischargeErrors(err)
+		assert.Equal(t, 2, len(des))
+
+		locs := []string{des[0].Location, des[1].Location}
+		sort.Strings(locs)
+		assert.Equal(t, []string{s.URL, otherLoc}, locs)
+
+		for _, de := range des {
+			assert.Equal(t, KindRejected, de.Kind)
+		}
+	})
+}
+
+func TestRefreshDischarges(t *testing.T) {
+	var (
+		tp         *TP
+		handleInit http.Handler
+	)
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch path := r.URL.EscapedPath(); path {
+		case InitPath, "/other" + InitPath:
+			tp.InitRequestMiddleware(handleInit).ServeHTTP(w, r)
+		default:
+			panic(path)
+		}
+	}))
+	t.Cleanup(s.Close)
+
+	otherLoc := s.URL + "/other"
+
+	tp = &TP{
+		Location:            s.URL,
+		Key:                 macaroon.NewEncryptionKey(),
+		AdditionalLocations: map[string]macaroon.EncryptionKey{otherLoc: macaroon.NewEncryptionKey()},
+	}
+
+	validFor := func(d time.Duration) macaroon.Caveat {
+		return &macaroon.ValidityWindow{NotBefore: time.Now().Unix(), NotAfter: time.Now().Add(d).Unix()}
+	}
+
+	policy := bundle.RefreshPolicy{ExpiringWithin: time.Minute}
+
+	// a bundle where the discharge for s.URL expires soon and the one for
+	// otherLoc doesn't
+	setup := func(t *testing.T) *bundle.Bundle {
+		t.Helper()
+
+		m, err := macaroon.New(fpKID, firstPartyLocation, fpKey)
+		assert.NoError(t, err)
+		assert.NoError(t, m.Add3P(tp.Key, s.URL))
+		assert.NoError(t, m.Add3P(tp.AdditionalLocations[otherLoc], otherLoc))
+		tok, err := m.Encode()
+		assert.NoError(t, err)
+
+		handleInit = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			tp.RespondDischarges(w, r, map[string][]macaroon.Caveat{
+				s.URL:    {myCaveat("original"), validFor(30 * time.Second)},
+				otherLoc: {myCaveat("original"), validFor(time.Hour)},
+			})
+		})
+
+		hdr, err := NewClient(firstPartyLocation).FetchDischargeTokens(context.Background(), macaroon.ToAuthorizationHeader(tok))
+		assert.NoError(t, err)
+
+		b, err := bundle.ParseBundle(firstPartyLocation, hdr)
+		assert.NoError(t, err)
+		assert.NoError(t, b.AddTokens("other-token"))
+		assert.Equal(t, 1, len(b.ExpiringDischarges(policy)))
+
+		return b
+	}
+
+	t.Run("refresh", func(t *testing.T) {
+		b := setup(t)
+		before := b.String()
+
+		handleInit = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			tickets, err := TicketsFromRequest(r)
+			assert.NoError(t, err)
+			assert.Equal(t, 1, len(tickets))
+			assert.Equal(t, s.URL, tickets[0].Location)
+
+			tp.RespondDischarge(w, r, myCaveat("refreshed"), validFor(time.Hour))
+		})
+
+		assert.NoError(t, NewClient(firstPartyLocation).RefreshDischarges(context.Background(), b, policy))
+		assert.Equal(t, 0, len(b.ExpiringDischarges(policy)))
+
+		cavs := checkFP(t, b.Select(bundle.Not(bundle.IsNonMacaroon)).Header())
+		sort.Strings(cavs)
+		assert.Equal(t, []string{"original", "refreshed"}, cavs)
+
+		// only the expiring discharge was replaced
+		var (
+			oldToks = strings.Split(before, ",")
+			newToks = strings.Split(b.String(), ",")
+		)
+		assert.Equal(t, len(oldToks), len(newToks))
+		for i := range oldToks {
+			if i == 1 {
+				assert.NotEqual(t, oldToks[i], newToks[i])
+			} else {
+				assert.Equal(t, oldToks[i], newToks[i])
+			}
+		}
+	})
+
+	t.Run("nothing expiring", func(t *testing.T) {
+		b := setup(t)
+		before := b.String()
+
+		handleInit = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			panic("unexpected discharge")
+		})
+
+		assert.NoError(t, NewClient(firstPartyLocation).RefreshDischarges(context.Background(), b, bundle.RefreshPolicy{}))
+		assert.Equal(t, before, b.String())
+	})
+
+	t.Run("failure", func(t *testing.T) {
+		b := setup(t)
+		before := b.String()
+
+		handleInit = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			tp.RespondError(w, r, http.StatusForbidden, "nope")
+		})
+
+		err := NewClient(firstPartyLocation).RefreshDischarges(context.Background(), b, policy)
+		des := DischargeErrors(err)
+		assert.Equal(t, 1, len(des))
+		assert.Equal(t, s.URL, des[0].Location)
+		assert.Equal(t, KindRejected, des[0].Kind)
+		assert.Equal(t, before, b.String())
+	})
+}
+
+func TestTicketLocation(t *testing.T) {
+	var tp *TP
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tp.InitRequestMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			tp.RespondDischarge(w, r)
+		})).ServeHTTP(w, r)
+	}))
+	t.Cleanup(s.Close)
+
+	const oldLoc = "https://old-third-party"
+
+	tp = &TP{
+		Location: s.URL,
+		Key:      macaroon.NewEncryptionKey(),
+	}
+	assert.NoError(t, tp.Validate())
+
+	ticketFor := func(t *testing.T, loc string) []byte {
+		t.Helper()
+
+		m, err := macaroon.New(fpKID, firstPartyLocation, fpKey)
+		assert.NoError(t, err)
+		assert.NoError(t, m.Add3PWithTicketLocation(tp.Key, loc))
+
+		return m.TicketsForThirdParty(loc)[0]
+	}
+
+	initRequest := func(t *testing.T, ticket []byte) (int, *jsonResponse) {
+		t.Helper()
+
+		body, err := json.Marshal(&jsonInitRequest{Ticket: ticket})
+		assert.NoError(t, err)
+
+		resp, err := http.Post(s.URL+InitPath, "application/json", bytes.NewReader(body))
+		assert.NoError(t, err)
+		defer resp.Body.Close()
+
+		var jresp jsonResponse
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&jresp))
+
+		return resp.StatusCode, &jresp
+	}
+
+	t.Run("matching", func(t *testing.T) {
+		status, jresp := initRequest(t, ticketFor(t, s.URL))
+		assert.Equal(t, http.StatusCreated, status)
+		assert.NotZero(t, jresp.Discharge)
+	})
+
+	t.Run("mismatch", func(t *testing.T) {
+		status, jresp := initRequest(t, ticketFor(t, oldLoc))
+		assert.Equal(t, http.StatusBadRequest, status)
+		assert.Zero(t, jresp.Discharge)
+		assert.Contains(t, jresp.Error, oldLoc)
+		assert.Contains(t, jresp.Error, s.URL)
+	})
+
+	t.Run("accepted", func(t *testing.T) {
+		tp.AcceptedLocations = []string{s.URL, oldLoc}
+		t.Cleanup(func() { tp.AcceptedLocations = nil })
+
+		status, jresp := initRequest(t, ticketFor(t, oldLoc))
+		assert.Equal(t, http.StatusCreated, status)
+		assert.NotZero(t, jresp.Discharge)
+	})
+
+	t.Run("legacy", func(t *testing.T) {
+		// tickets from older first parties don't record their location
+		legacy := struct {
+			DischargeKey []byte
+			Caveats      macaroon.CaveatSet
+		}{
+			DischargeKey: macaroon.NewSigningKey(),
+			Caveats:      *macaroon.NewCaveatSet(),
+		}
+
+		var buf bytes.Buffer
+		enc := msgpack.NewEncoder(&buf)
+		enc.UseArrayEncodedStructs(true)
+		assert.NoError(t, enc.Encode(&legacy))
+
+		ticket, err := crypto.Seal(tp.Key, buf.Bytes())
+		assert.NoError(t, err)
+
+		status, jresp := initRequest(t, ticket)
+		assert.Equal(t, http.StatusCreated, status)
+		assert.NotZero(t, jresp.Discharge)
+	})
+
+	t.Run("client", func(t *testing.T) {
+		m, err := macaroon.New(fpKID, firstPartyLocation, fpKey)
+		assert.NoError(t, err)
+		assert.NoError(t, m.Add3PWithTicketLocation(tp.Key, s.URL+"/"))
+		tok, err := m.Encode()
+		assert.NoError(t, err)
+
+		_, err = NewClient(firstPartyLocation).FetchDischargeTokens(context.Background(), macaroon.ToAuthorizationHeader(tok))
+
+		des := DischargeErrors(err)
+		assert.Equal(t, 1, len(des))
+		assert.Equal(t, KindRejected, des[0].Kind)
+		assert.Contains(t, des[0].Error(), "expected one of")
+	})
+}
+
+func TestValidate(t *testing.T) {
+	key := macaroon.NewEncryptionKey()
+
+	for loc, valid := range map[string]bool{
+		"https://auth.example.com":         true,
+		"https://auth.example.com/tp":      true,
+		"http://127.0.0.1:8080":            true,
+		"https://auth.example.com/":        false,
+		"https://auth.example.com/tp/":     false,
+		"https://Auth.Example.com":         false,
+		"HTTPS://auth.example.com":         false,
+		"https://auth.example.com?x=1":     false,
+		"https://auth.example.com#x":       false,
+		"https://user@auth.example.com":    false,
+		"auth.example.com":                 false,
+		"/tp":                              false,
+		"":                                 false,
+		"https://auth.example.com/a%2fb/c": true,
+	} {
+		err := (&TP{Location: loc, Key: key}).Validate()
+		if valid {
+			assert.NoError(t, err, loc)
+		} else {
+			assert.IsError(t, err, ErrInvalidLocation, loc)
+		}
+
+		err = (&TP{Location: "https://auth.example.com", Key: key, AdditionalLocations: map[string]macaroon.EncryptionKey{loc: key}}).Validate()
+		if valid {
+			assert.NoError(t, err, loc)
+		} else {
+			assert.IsError(t, err, ErrInvalidLocation, loc)
+		}
+	}
+
+	assert.Error(t, (&TP{Location: "https://auth.example.com", Key: key[:10]}).Validate())
+}
+
+func TestLargeTickets(t *testing.T) {
+	var (
+		tp            *TP
+		handleTicket  http.HandlerFunc
+		paths         []string
+		gzipResponses int
+	)
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path := r.URL.EscapedPath()
+
+		switch {
+		case path == InitPath:
+			tp.InitRequestMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				cavs, err := CaveatsFromRequest(r)
+				assert.NoError(t, err)
+				tp.RespondDischarge(w, r, cavs...)
+			})).ServeHTTP(w, r)
+		case path == InitTicketPath:
+			handleTicket(w, r)
+		default:
+			panic(path)
+		}
+	}))
+	t.Cleanup(s.Close)
+
+	ms, err := NewMemoryStore(PrefixMunger("/user/"), 100)
+	assert.NoError(t, err)
+
+	tp = &TP{
+		Location:         s.URL,
+		Key:              macaroon.NewEncryptionKey(),
+		Store:            ms,
+		Log:              logrus.StandardLogger(),
+		MaxDischargeSize: -1,
+	}
+
+	client := &http.Client{Transport: roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		paths = append(paths, r.URL.Path)
+
+		resp, err := cleanhttp.DefaultTransport().RoundTrip(r)
+		if err == nil && resp.Header.Get("Content-Encoding") == "gzip" {
+			gzipResponses++
+		}
+		return resp, err
+	})}
+
+	// a few hundred KB ticket, which the discharge also contains, along with
+	// the caveat echoed back by the handler.
+	big := myCaveat(strings.Repeat("x", 300<<10))
+
+	genBigFP := func(t *testing.T) string {
+		t.Helper()
+
+		m, err := macaroon.New(fpKID, firstPartyLocation, fpKey)
+		assert.NoError(t, err)
+		assert.NoError(t, m.Add3P(tp.Key, tp.Location, &big))
+
+		tok, err := m.Encode()
+		assert.NoError(t, err)
+
+		return macaroon.ToAuthorizationHeader(tok)
+	}
+
+	fetch := func(t *testing.T) {
+		t.Helper()
+
+		paths, gzipResponses = nil, 0
+
+		hdr, err := NewClient(firstPartyLocation, WithHTTP(client)).FetchDischargeTokens(context.Background(), genBigFP(t))
+		assert.NoError(t, err)
+		assert.Equal(t, []string{string(big)}, checkFP(t, hdr))
+	}
+
+	t.Run("ticket ref", func(t *testing.T) {
+		handleTicket = tp.HandleInitTicketRequest
+
+		fetch(t)
+		assert.Equal(t, []string{InitTicketPath, InitPath}, paths)
+		assert.Equal(t, 1, gzipResponses)
+	})
+
+	t.Run("unsupported ticket ref", func(t *testing.T) {
+		handleTicket = http.NotFound
+
+		fetch(t)
+		assert.Equal(t, []string{InitTicketPath, InitPath}, paths)
+		assert.Equal(t, 1, gzipResponses)
+	})
+
+	t.Run("ticket ref single use", func(t *testing.T) {
+		handleTicket = tp.HandleInitTicketRequest
+
+		m, err := macaroon.New(fpKID, firstPartyLocation, fpKey)
+		assert.NoError(t, err)
+		assert.NoError(t, m.Add3P(tp.Key, tp.Location, &big))
+		ticket := m.TicketsForThirdParty(tp.Location)[0]
+
+		p := &HTTPProtocol{HTTP: client}
+		ref, err := p.doInitTicketRequest(context.Background(), tp.Location, ticket)
+		assert.NoError(t, err)
+
+		init := func() (*http.Response, error) {
+			body, err := json.Marshal(&jsonInitRequest{TicketRef: ref})
+			assert.NoError(t, err)
+			return http.Post(s.URL+InitPath, "application/json", bytes.NewReader(body))
+		}
+
+		resp, err := init()
+		assert.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusCreated, resp.StatusCode)
+
+		resp, err = init()
+		assert.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	})
+
+	t.Run("bogus ticket", func(t *testing.T) {
+		handleTicket = tp.HandleInitTicketRequest
+
+		_, err := (&HTTPProtocol{HTTP: client}).doInitTicketRequest(context.Background(), tp.Location, []byte("bogus"))
+		assert.Error(t, err)
+		assert.NotIsError(t, err, errTicketRefUnsupported)
+	})
+}
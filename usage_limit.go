@@ -0,0 +1,142 @@
+package macaroon
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// UsageLimit limits the number of times a token may be used. The library can't
+// count uses itself, so enforcing the limit requires the verifying service to
+// keep a counter for CounterID: the Access must implement UsageCountGetter,
+// and the service must record each successful use (e.g. with RecordUsage).
+// Accesses that don't implement UsageCountGetter are denied with
+// ErrResourceUnspecified, so that services that haven't wired up a counter
+// don't silently allow unlimited use.
+//
+// Checking the count during verification and recording the use afterwards
+// isn't atomic, so concurrent requests may together exceed Max. Services
+// needing a strict limit should reserve a use atomically before authorizing
+// the request (e.g. with an increment-and-compare in their database) and
+// report the count from before the reservation.
+type UsageLimit struct {
+	// Max is the number of times the token may be used.
+	Max uint64 `json:"max"`
+
+	// CounterID identifies the counter tracking uses of the token. It is
+	// chosen by the issuer and must be unique among tokens sharing a counter
+	// store. Tokens may share a counter to share a limit.
+	CounterID []byte `json:"counter_id"`
+}
+
+// UsageCountGetter is implemented by Accesses that can report how many times a
+// token was used. It is consulted by UsageLimit.
+type UsageCountGetter interface {
+	Access
+
+	// GetUsageCount returns the number of recorded uses of the counter, and
+	// whether the count is known.
+	GetUsageCount(counterID []byte) (uint64, bool)
+}
+
+// UsageCountIncrementer is implemented by counter stores that record uses
+// of tokens with UsageLimit caveats. See RecordUsage.
+type UsageCountIncrementer interface {
+	// IncrementUsageCount records a use of the counter and returns the new
+	// count.
+	IncrementUsageCount(counterID []byte) uint64
+}
+
+var (
+	_ DescribableCaveat = (*UsageLimit)(nil)
+	_ DenialExplainer   = (*UsageLimit)(nil)
+)
+
+func init()                                  { RegisterCaveatConstructor(func() Caveat { return &UsageLimit{} }) }
+func (c *UsageLimit) CaveatType() CaveatType { return CavUsageLimit }
+func (c *UsageLimit) Name() string           { return "UsageLimit" }
+
+func (c *UsageLimit) Prohibits(f Access) error {
+	if len(c.CounterID) == 0 {
+		return fmt.Errorf("%w: usage limit without counter", ErrBadCaveat)
+	}
+
+	ucg, ok := f.(UsageCountGetter)
+	if !ok {
+		return fmt.Errorf("%w usage count", ErrResourceUnspecified)
+	}
+
+	count, ok := ucg.GetUsageCount(c.CounterID)
+	if !ok {
+		return fmt.Errorf("%w usage count", ErrResourceUnspecified)
+	}
+
+	if count >= c.Max {
+		return fmt.Errorf("%w: token used %d times, limit %d", ErrUnauthorized, count, c.Max)
+	}
+
+	return nil
+}
+
+func (c *UsageLimit) Describe() string {
+	return fmt.Sprintf("Restricts use to %d times (counter %x)", c.Max, c.CounterID)
+}
+
+// ExplainDenial implements DenialExplainer.
+func (c *UsageLimit) ExplainDenial(err *CaveatError, resolve NameResolver) string {
+	if !errors.Is(err, ErrUnauthorized) || errors.Is(err, ErrResourceUnspecified) {
+		return ""
+	}
+
+	return "Your token has been used the maximum number of times."
+}
+
+// RecordUsage records a use of each of the counters of the UsageLimit caveats
+// in cs. It should be called after an access is authorized with the caveats
+// returned from verification. Counters shared by several caveats are only
+// incremented once.
+func RecordUsage(cs *CaveatSet, counter UsageCountIncrementer) {
+	seen := map[string]bool{}
+
+	for _, c := range GetCaveats[*UsageLimit](cs) {
+		if len(c.CounterID) == 0 || seen[string(c.CounterID)] {
+			continue
+		}
+
+		seen[string(c.CounterID)] = true
+		counter.IncrementUsageCount(c.CounterID)
+	}
+}
+
+// MemoryUsageCounter is an in-memory reference implementation of a usage
+// counter store, suitable for tests and single-process services. Embed it in
+// an Access to implement UsageCountGetter. Counts are lost on restart, which
+// resets the limits of all tokens. Its zero value is ready to use.
+type MemoryUsageCounter struct {
+	m      sync.Mutex
+	counts map[string]uint64
+}
+
+var _ UsageCountIncrementer = (*MemoryUsageCounter)(nil)
+
+// GetUsageCount returns the number of recorded uses of the counter. Counters
+// that haven't been used have a known count of zero.
+func (c *MemoryUsageCounter) GetUsageCount(counterID []byte) (uint64, bool) {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	return c.counts[string(counterID)], true
+}
+
+// IncrementUsageCount implements UsageCountIncrementer.
+func (c *MemoryUsageCounter) IncrementUsageCount(counterID []byte) uint64 {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	if c.counts == nil {
+		c.counts = map[string]uint64{}
+	}
+
+	c.counts[string(counterID)]++
+	return c.counts[string(counterID)]
+}
@@ -0,0 +1,114 @@
+package macaroon
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/alecthomas/assert/v2"
+)
+
+type usageAccess struct {
+	testAccess
+	*MemoryUsageCounter
+}
+
+var _ UsageCountGetter = (*usageAccess)(nil)
+
+type unknownUsageAccess struct {
+	testAccess
+}
+
+var _ UsageCountGetter = (*unknownUsageAccess)(nil)
+
+func (a *unknownUsageAccess) GetUsageCount([]byte) (uint64, bool) { return 0, false }
+
+func TestUsageLimit(t *testing.T) {
+	limit := &UsageLimit{Max: 2, CounterID: []byte("webhook-1")}
+
+	t.Run("serialization", func(t *testing.T) {
+		cs := NewCaveatSet(limit)
+
+		b, err := json.Marshal(cs)
+		assert.NoError(t, err)
+		cs2 := NewCaveatSet()
+		assert.NoError(t, json.Unmarshal(b, cs2))
+		assert.Equal(t, cs, cs2)
+
+		b, err = cs.MarshalMsgpack()
+		assert.NoError(t, err)
+		cs2, err = DecodeCaveats(b)
+		assert.NoError(t, err)
+		assert.Equal(t, cs, cs2)
+
+		assert.NoError(t, CheckCanonicalEncoding(limit))
+		assert.Equal(t, "Restricts use to 2 times (counter 776562686f6f6b2d31)", DescribeCaveat(limit))
+	})
+
+	t.Run("prohibits", func(t *testing.T) {
+		counter := new(MemoryUsageCounter)
+		access := &usageAccess{MemoryUsageCounter: counter}
+
+		assert.NoError(t, limit.Prohibits(access))
+		counter.IncrementUsageCount(limit.CounterID)
+		assert.NoError(t, limit.Prohibits(access))
+		counter.IncrementUsageCount(limit.CounterID)
+		assert.IsError(t, limit.Prohibits(access), ErrUnauthorized)
+		assert.False(t, IsTokenBug(limit.Prohibits(access)))
+
+		// other counters are unaffected
+		assert.NoError(t, (&UsageLimit{Max: 1, CounterID: []byte("webhook-2")}).Prohibits(access))
+
+		assert.IsError(t, (&UsageLimit{Max: 0, CounterID: []byte("webhook-2")}).Prohibits(access), ErrUnauthorized)
+		assert.True(t, IsTokenBug((&UsageLimit{Max: 1}).Prohibits(access)))
+	})
+
+	t.Run("unknown count", func(t *testing.T) {
+		assert.IsError(t, limit.Prohibits(&testAccess{}), ErrResourceUnspecified)
+		assert.IsError(t, limit.Prohibits(&unknownUsageAccess{}), ErrResourceUnspecified)
+		assert.Zero(t, ExplainDenial(NewCaveatSet(limit).Validate(&testAccess{}), nil))
+	})
+
+	t.Run("record usage", func(t *testing.T) {
+		var (
+			key     = NewSigningKey()
+			counter = new(MemoryUsageCounter)
+			access  = &usageAccess{MemoryUsageCounter: counter}
+		)
+
+		m, err := New(rbuf(10), "loc", key)
+		assert.NoError(t, err)
+		assert.NoError(t, m.Add(limit))
+
+		tok, err := m.Encode()
+		assert.NoError(t, err)
+
+		use := func() error {
+			m, err := Decode(tok)
+			assert.NoError(t, err)
+
+			cs, err := m.Verify(key, nil, nil)
+			assert.NoError(t, err)
+
+			if err := cs.Validate(access); err != nil {
+				return err
+			}
+
+			RecordUsage(cs, counter)
+			return nil
+		}
+
+		assert.NoError(t, use())
+		assert.NoError(t, use())
+
+		err = use()
+		assert.IsError(t, err, ErrUnauthorized)
+		assert.Equal(t, []string{"Your token has been used the maximum number of times."}, ExplainDenial(err, nil))
+
+		// attenuating with another limit on the same counter doesn't count uses
+		// twice.
+		count, _ := counter.GetUsageCount(limit.CounterID)
+		RecordUsage(NewCaveatSet(limit, &UsageLimit{Max: 5, CounterID: limit.CounterID}), counter)
+		count2, _ := counter.GetUsageCount(limit.CounterID)
+		assert.Equal(t, count+1, count2)
+	})
+}
@@ -0,0 +1,85 @@
+package macaroon
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+// VerifyOutcome categorizes the result of verifying a macaroon, for metrics.
+type VerifyOutcome string
+
+const (
+	// VerifyOK means that the macaroon was verified.
+	VerifyOK VerifyOutcome = "ok"
+
+	// VerifyBadSignature means that the signature of the macaroon or of one
+	// of its discharges didn't match. See ErrInvalidSignature.
+	VerifyBadSignature VerifyOutcome = "bad-signature"
+
+	// VerifyMissingDischarge means that a third-party caveat wasn't
+	// discharged. See ErrMissingDischarge.
+	VerifyMissingDischarge VerifyOutcome = "missing-discharge"
+
+	// VerifyBadTicket means that a discharge didn't match the ticket of the
+	// third-party caveat it was meant to discharge. See ErrUntrustedDischarge.
+	VerifyBadTicket VerifyOutcome = "bad-ticket"
+
+	// VerifyError is any other verification failure.
+	VerifyError VerifyOutcome = "error"
+)
+
+// VerifyStats describes a single call to Macaroon.Verify, Macaroon.VerifyParsed
+// or Macaroon.VerifyDetailed. Counts include any discharge macaroons that were
+// verified along the way.
+type VerifyStats struct {
+	// Caveats is the number of caveats whose signatures were checked.
+	Caveats int
+
+	// ThirdPartyCaveats is the number of third-party caveats found.
+	ThirdPartyCaveats int
+
+	// DischargesTried is the number of discharge macaroons that were tried
+	// against third-party caveats.
+	DischargesTried int
+
+	// Duration is how long verification took.
+	Duration time.Duration
+
+	// Outcome categorizes Err.
+	Outcome VerifyOutcome
+
+	// Err is the error returned from verification, if any.
+	Err error
+}
+
+var verifyObserver atomic.Pointer[func(VerifyStats)]
+
+// SetVerifyObserver installs a function to be called with the VerifyStats of
+// each call to Macaroon.Verify, Macaroon.VerifyParsed or
+// Macaroon.VerifyDetailed, e.g. to record metrics. It is called once per call,
+// after verification, and may be called concurrently. Pass nil to remove the
+// observer.
+func SetVerifyObserver(obs func(VerifyStats)) {
+	if obs == nil {
+		verifyObserver.Store(nil)
+		return
+	}
+
+	verifyObserver.Store(&obs)
+}
+
+func verifyOutcome(err error) VerifyOutcome {
+	switch {
+	case err == nil:
+		return VerifyOK
+	case errors.Is(err, ErrMissingDischarge):
+		return VerifyMissingDischarge
+	case errors.Is(err, ErrUntrustedDischarge):
+		return VerifyBadTicket
+	case errors.Is(err, ErrInvalidSignature):
+		return VerifyBadSignature
+	default:
+		return VerifyError
+	}
+}
@@ -0,0 +1,169 @@
+package macaroon
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alecthomas/assert/v2"
+)
+
+func TestVerifyObserver(t *testing.T) {
+	var (
+		mu    sync.Mutex
+		stats []VerifyStats
+	)
+
+	SetVerifyObserver(func(vs VerifyStats) {
+		mu.Lock()
+		defer mu.Unlock()
+		stats = append(stats, vs)
+	})
+	t.Cleanup(func() { SetVerifyObserver(nil) })
+
+	observe := func(t *testing.T, f func()) VerifyStats {
+		t.Helper()
+
+		mu.Lock()
+		stats = nil
+		mu.Unlock()
+
+		f()
+
+		mu.Lock()
+		defer mu.Unlock()
+		assert.Equal(t, 1, len(stats))
+		return stats[0]
+	}
+
+	var (
+		key = NewSigningKey()
+		ka  = NewEncryptionKey()
+		loc = "https://tp"
+	)
+
+	m, err := New(rbuf(10), "loc", key)
+	assert.NoError(t, err)
+	assert.NoError(t, m.Add(cavParent(ActionRead, 123), cavExpiry(time.Hour)))
+	assert.NoError(t, m.Add3P(ka, loc))
+
+	ticket, err := m.ThirdPartyTicket(loc)
+	assert.NoError(t, err)
+
+	discharge := func(t *testing.T, cavs ...Caveat) []byte {
+		t.Helper()
+
+		_, dm, err := DischargeTicket(ka, loc, ticket)
+		assert.NoError(t, err)
+		assert.NoError(t, dm.Add(cavs...))
+
+		tok, err := dm.Encode()
+		assert.NoError(t, err)
+
+		return tok
+	}
+
+	t.Run("ok", func(t *testing.T) {
+		vs := observe(t, func() {
+			_, err := m.Verify(key, [][]byte{discharge(t, cavParent(ActionRead, 234))}, nil)
+			assert.NoError(t, err)
+		})
+
+		assert.Equal(t, VerifyOK, vs.Outcome)
+		assert.NoError(t, vs.Err)
+		assert.Equal(t, 4, vs.Caveats) // includes the discharge's caveat
+		assert.Equal(t, 1, vs.ThirdPartyCaveats)
+		assert.Equal(t, 1, vs.DischargesTried)
+		assert.NotZero(t, vs.Duration)
+	})
+
+	t.Run("bad signature", func(t *testing.T) {
+		vs := observe(t, func() {
+			_, err := m.Verify(NewSigningKey(), [][]byte{discharge(t)}, nil)
+			assert.IsError(t, err, ErrInvalidSignature)
+		})
+
+		assert.Equal(t, VerifyBadSignature, vs.Outcome)
+		assert.IsError(t, vs.Err, ErrInvalidSignature)
+	})
+
+	t.Run("missing discharge", func(t *testing.T) {
+		vs := observe(t, func() {
+			_, err := m.Verify(key, nil, nil)
+			assert.IsError(t, err, ErrMissingDischarge)
+		})
+
+		assert.Equal(t, VerifyMissingDischarge, vs.Outcome)
+		assert.Equal(t, 0, vs.DischargesTried)
+	})
+
+	t.Run("bad ticket", func(t *testing.T) {
+		// a third-party caveat whose ticket has a different discharge key
+		// than its VerifierKey.
+		bad, err := New(rbuf(10), "loc", key)
+		assert.NoError(t, err)
+
+		rn := rbuf(32)
+		wt, err := encode(&wireTicket{DischargeKey: rbuf(32), Location: loc})
+		assert.NoError(t, err)
+		badTicket := seal(ka, wt)
+		assert.NoError(t, bad.add(&Caveat3P{Location: loc, Ticket: badTicket, rn: rn}))
+
+		dm, err := newMacaroon(badTicket, loc, rn, true, nil)
+		assert.NoError(t, err)
+		assert.NoError(t, dm.finalize())
+		dtok, err := dm.Encode()
+		assert.NoError(t, err)
+
+		vs := observe(t, func() {
+			_, err := bad.Verify(key, [][]byte{dtok}, map[string][]EncryptionKey{loc: {ka}})
+			assert.IsError(t, err, ErrUntrustedDischarge)
+		})
+
+		assert.Equal(t, VerifyBadTicket, vs.Outcome)
+		assert.Equal(t, 1, vs.DischargesTried)
+	})
+
+	t.Run("concurrent", func(t *testing.T) {
+		dtok := discharge(t)
+
+		mu.Lock()
+		stats = nil
+		mu.Unlock()
+
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_, err := m.Verify(key, [][]byte{dtok}, nil)
+				assert.NoError(t, err)
+			}()
+		}
+		wg.Wait()
+
+		mu.Lock()
+		defer mu.Unlock()
+		assert.Equal(t, 10, len(stats))
+		for _, vs := range stats {
+			assert.Equal(t, VerifyOK, vs.Outcome)
+			assert.Equal(t, 1, vs.DischargesTried)
+		}
+	})
+
+	t.Run("removed", func(t *testing.T) {
+		SetVerifyObserver(nil)
+		t.Cleanup(func() { SetVerifyObserver(func(vs VerifyStats) {}) })
+
+		mu.Lock()
+		stats = nil
+		mu.Unlock()
+
+		_, err := m.Verify(key, nil, nil)
+		assert.Error(t, err)
+
+		mu.Lock()
+		defer mu.Unlock()
+		assert.Equal(t, 0, len(stats))
+	})
+}
@@ -0,0 +1,40 @@
+package macaroon
+
+import (
+	"os"
+	"os/exec"
+	"testing"
+)
+
+// wasmPackages must build for js/wasm and with TinyGo, so that caveats can be
+// evaluated in browsers and edge workers.
+var wasmPackages = []string{".", "./resset", "./flyio", "./auth", "./examples/wasm"}
+
+func TestWasmBuild(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping wasm build in short mode")
+	}
+
+	goBin, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("go toolchain not found")
+	}
+
+	cmd := exec.Command(goBin, append([]string{"build"}, wasmPackages...)...)
+	cmd.Env = append(os.Environ(), "GOOS=js", "GOARCH=wasm")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("GOOS=js GOARCH=wasm go build: %s\n%s", err, out)
+	}
+
+	tinygo, err := exec.LookPath("tinygo")
+	if err != nil {
+		t.Log("tinygo not found; skipping tinygo build")
+		return
+	}
+
+	// tinygo only builds main packages, which pull in the rest
+	cmd = exec.Command(tinygo, "build", "-o", os.DevNull, "-target", "wasm", "./examples/wasm")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("tinygo build: %s\n%s", err, out)
+	}
+}
@@ -0,0 +1,168 @@
+package macaroon
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+)
+
+// A macaroon's signature is a chain of HMACs, starting with the nonce and
+// continuing with the wire encoding of each caveat in turn. The signature
+// rules are defined in terms of those already-encoded bytes, rather than the
+// decoded caveats. With msgpack, which is the only format this library emits,
+// a caveat's wire encoding is that of a CaveatSet containing just that caveat.
+// Since msgpack encodings are canonical, decoded msgpack caveats are simply
+// re-encoded for verification.
+//
+// Alternate wire formats (e.g. CBOR) can be decoded into Macaroons by
+// registering a decoder with RegisterWireFormat. Such decoders preserve the
+// original bytes of each caveat with Macaroon.SetCaveatEncodings, and those
+// bytes are used in place of the msgpack encoding when verifying the
+// macaroon. Verification then trusts that the decoded caveats mean the same
+// thing as their preserved bytes, so decoders must be strict, rejecting
+// caveats with fields that they don't understand rather than ignoring them.
+
+// WireFormatMsgpack is the name of the wire format that this library emits.
+// It is registered with Decode as its decoder.
+const WireFormatMsgpack = "msgpack"
+
+var wireFormats = map[string]func([]byte) (*Macaroon, error){
+	WireFormatMsgpack: Decode,
+}
+
+// RegisterWireFormat registers a decoder for an alternate wire encoding of
+// macaroons, for use with DecodeWireFormat. The decoder must preserve the
+// original encoding of each caveat with Macaroon.SetCaveatEncodings. This
+// panics if a format with the same name is already registered.
+func RegisterWireFormat(name string, dec func([]byte) (*Macaroon, error)) {
+	if name == "" || dec == nil {
+		panic("bad wire format")
+	}
+	if _, dup := wireFormats[name]; dup {
+		panic("duplicate wire format")
+	}
+
+	wireFormats[name] = dec
+}
+
+func unregisterWireFormat(name string) {
+	if name != WireFormatMsgpack {
+		delete(wireFormats, name)
+	}
+}
+
+// DecodeWireFormat decodes a macaroon using the decoder registered for the
+// named wire format. See RegisterWireFormat.
+func DecodeWireFormat(name string, buf []byte) (*Macaroon, error) {
+	dec, ok := wireFormats[name]
+	if !ok {
+		return nil, fmt.Errorf("macaroon decode: unknown wire format %q", name)
+	}
+
+	m, err := dec(buf)
+	if err != nil {
+		return nil, err
+	}
+
+	if m.UnsafeCaveats.Caveats == nil {
+		m.UnsafeCaveats.Caveats = []Caveat{}
+	}
+
+	return m, nil
+}
+
+// SetCaveatEncodings records the original wire encoding of each of the
+// macaroon's caveats, for use by alternate wire format decoders. There must be
+// an encoding for each of UnsafeCaveats. A nil encoding means that the caveat
+// was encoded with msgpack. The preserved encodings are used instead of
+// re-encoding the caveats when verifying the macaroon.
+func (m *Macaroon) SetCaveatEncodings(wire [][]byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if len(wire) != len(m.UnsafeCaveats.Caveats) {
+		return fmt.Errorf("%d caveat encodings for %d caveats", len(wire), len(m.UnsafeCaveats.Caveats))
+	}
+
+	m.wire = make([][]byte, len(wire))
+	for i, w := range wire {
+		if w != nil {
+			m.wire[i] = append([]byte{}, w...)
+		}
+	}
+
+	return nil
+}
+
+// AddEncodedCaveat is like Add, but signs wire as the caveat's encoding
+// rather than its msgpack encoding. This allows attenuating macaroons in
+// alternate wire formats. The caveat is added as-is, so third-party caveats
+// can't be added this way. See Macaroon.Add3P.
+func (m *Macaroon) AddEncodedCaveat(cav Caveat, wire []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	switch {
+	case m.Nonce.Proof && !m.newProof:
+		return errors.New("can't add caveats to finalized proof")
+	case len(wire) == 0:
+		return errors.New("missing caveat encoding")
+	case IsAttestation(cav) && !m.Nonce.Proof:
+		return errors.New("cannot add attestations to non-proof macaroons")
+	}
+
+	if _, is3P := cav.(*Caveat3P); is3P {
+		return errors.New("third-party caveats must be added via Macaroon.Add3P")
+	}
+
+	if err := checkMaxCaveats(len(m.UnsafeCaveats.Caveats) + 1); err != nil {
+		return err
+	}
+
+	i := len(m.UnsafeCaveats.Caveats)
+	m.UnsafeCaveats.Caveats = append(m.UnsafeCaveats.Caveats, cav)
+	m.setCaveatEncoding(i, append([]byte{}, wire...))
+	m.Tail = sign(SigningKey(m.Tail), wire)
+
+	return nil
+}
+
+func (m *Macaroon) setCaveatEncoding(i int, wire []byte) {
+	for len(m.wire) <= i {
+		m.wire = append(m.wire, nil)
+	}
+
+	m.wire[i] = wire
+}
+
+// caveatEncoding returns the bytes that the i'th caveat's signature covers:
+// its preserved original encoding, if any, or its msgpack encoding.
+func (m *Macaroon) caveatEncoding(i int) ([]byte, error) {
+	if i < len(m.wire) && m.wire[i] != nil {
+		return m.wire[i], nil
+	}
+
+	return NewCaveatSet(m.UnsafeCaveats.Caveats[i]).MarshalMsgpack()
+}
+
+// checkReencoding returns an error if encoding the macaroon with msgpack would
+// change the encoding of any caveat with a preserved original encoding, which
+// would invalidate the macaroon's signature.
+func (m *Macaroon) checkReencoding() error {
+	for i, w := range m.wire {
+		if w == nil || i >= len(m.UnsafeCaveats.Caveats) {
+			continue
+		}
+
+		packed, err := NewCaveatSet(m.UnsafeCaveats.Caveats[i]).MarshalMsgpack()
+		if err != nil {
+			return err
+		}
+
+		if !bytes.Equal(packed, w) {
+			return fmt.Errorf("%w: %s caveat", ErrReencodedCaveat, m.UnsafeCaveats.Caveats[i].Name())
+		}
+	}
+
+	return nil
+}
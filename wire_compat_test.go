@@ -0,0 +1,81 @@
+package macaroon
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/alecthomas/assert/v2"
+)
+
+// Macaroons, nonces, third-party caveats and tickets are msgpack-encoded as
+// arrays of their fields, so adding, removing or reordering their fields
+// changes the wire format and breaks every existing token. New fields may
+// only be appended, must be optional when decoding and must be left out when
+// encoding tokens that don't use them (see Nonce and wireTicket). Update
+// these expectations only after checking that the change follows these
+// rules and that internal/test-vectors' wire-compat suite still passes.
+func TestWireStructs(t *testing.T) {
+	cases := []struct {
+		v        any
+		exported bool
+		want     []string
+	}{
+		// only the exported fields of Macaroon are encoded, by EncodeMsgpack.
+		{Macaroon{}, true, []string{
+			"Nonce macaroon.Nonce `json:\"-\"`",
+			"Location string `json:\"location\"`",
+			"UnsafeCaveats macaroon.CaveatSet `json:\"caveats\"`",
+			"Tail []uint8 `json:\"-\"`",
+		}},
+		{nonceV0Fields{}, false, []string{
+			"KID []uint8 `json:\"kid\"`",
+			"Rnd []uint8 `json:\"rnd\"`",
+		}},
+		{nonceV1Fields{}, false, []string{
+			"Proof bool `json:\"proof\"`",
+		}},
+		{Caveat3P{}, false, []string{
+			"Location string",
+			"VerifierKey []uint8",
+			"Ticket []uint8",
+			"rn []uint8 `msgpack:\"-\"`",
+		}},
+		{wireTicket{}, false, []string{
+			"DischargeKey []uint8",
+			"Caveats macaroon.CaveatSet",
+			"Location string",
+		}},
+	}
+
+	for _, tc := range cases {
+		typ := reflect.TypeOf(tc.v)
+
+		var have []string
+		for i := 0; i < typ.NumField(); i++ {
+			f := typ.Field(i)
+			if tc.exported && !f.IsExported() {
+				continue
+			}
+
+			desc := fmt.Sprintf("%s %s", f.Name, f.Type)
+			if f.Tag != "" {
+				desc += fmt.Sprintf(" `%s`", f.Tag)
+			}
+			have = append(have, desc)
+		}
+
+		assert.Equal(t, tc.want, have, "the fields of %s changed, which may break the wire format. See the comment on TestWireStructs.", typ)
+	}
+}
+
+func TestWireEncoderOptions(t *testing.T) {
+	// structs are encoded as arrays and integers as compactly as possible.
+	// Changing either changes the encoding of every token.
+	buf, err := encode(&struct {
+		A uint64
+		B int64
+	}{1, -1})
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{0x92, 0x01, 0xff}, buf)
+}
@@ -0,0 +1,225 @@
+package macaroon
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/alecthomas/assert/v2"
+	msgpack "github.com/vmihailenco/msgpack/v5"
+)
+
+// testWireFormat is a synthetic alternate wire format, encoding macaroons as
+// JSON. Each caveat's wire encoding is its testWireCaveat's JSON.
+const testWireFormat = "test-json"
+
+type testWireMacaroon struct {
+	Nonce    []byte            `json:"nonce"`
+	Location string            `json:"location"`
+	Caveats  []json.RawMessage `json:"caveats"`
+	Tail     []byte            `json:"tail"`
+}
+
+type testWireCaveat struct {
+	Type CaveatType      `json:"type"`
+	Body json.RawMessage `json:"body"`
+}
+
+func encodeTestWireCaveat(t *testing.T, cav Caveat) []byte {
+	t.Helper()
+
+	body, err := json.Marshal(cav)
+	assert.NoError(t, err)
+
+	wire, err := json.Marshal(testWireCaveat{Type: cav.CaveatType(), Body: body})
+	assert.NoError(t, err)
+
+	return wire
+}
+
+func decodeTestWire(buf []byte) (*Macaroon, error) {
+	var tw testWireMacaroon
+	if err := json.Unmarshal(buf, &tw); err != nil {
+		return nil, err
+	}
+
+	m := &Macaroon{Location: tw.Location, Tail: tw.Tail}
+	if err := msgpack.Unmarshal(tw.Nonce, &m.Nonce); err != nil {
+		return nil, err
+	}
+
+	wire := make([][]byte, 0, len(tw.Caveats))
+	for _, raw := range tw.Caveats {
+		var twc testWireCaveat
+		if err := json.Unmarshal(raw, &twc); err != nil {
+			return nil, err
+		}
+
+		cav := typeToCaveat(twc.Type)
+
+		dec := json.NewDecoder(bytes.NewReader(twc.Body))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(cav); err != nil {
+			return nil, err
+		}
+
+		m.UnsafeCaveats.Caveats = append(m.UnsafeCaveats.Caveats, cav)
+		wire = append(wire, raw)
+	}
+
+	if err := m.SetCaveatEncodings(wire); err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+func TestAlternateWireFormat(t *testing.T) {
+	RegisterWireFormat(testWireFormat, decodeTestWire)
+	t.Cleanup(func() { unregisterWireFormat(testWireFormat) })
+
+	var (
+		kid  = rbuf(10)
+		key  = NewSigningKey()
+		cavs = []Caveat{cavParent(ActionRead, 123), cavExpiry(time.Hour)}
+	)
+
+	m, err := New(kid, "loc", key)
+	assert.NoError(t, err)
+
+	tw := testWireMacaroon{Nonce: m.Nonce.MustEncode(), Location: m.Location}
+	for _, cav := range cavs {
+		wire := encodeTestWireCaveat(t, cav)
+		assert.NoError(t, m.AddEncodedCaveat(cav, wire))
+		tw.Caveats = append(tw.Caveats, wire)
+	}
+	tw.Tail = m.Tail
+
+	buf, err := json.Marshal(tw)
+	assert.NoError(t, err)
+
+	decode := func(t *testing.T, buf []byte) *Macaroon {
+		t.Helper()
+
+		m, err := DecodeWireFormat(testWireFormat, buf)
+		assert.NoError(t, err)
+		return m
+	}
+
+	t.Run("verify", func(t *testing.T) {
+		decoded := decode(t, buf)
+
+		verified, err := decoded.Verify(key, nil, nil)
+		assert.NoError(t, err)
+		assert.True(t, verified.Equal(NewCaveatSet(cavs...)))
+	})
+
+	t.Run("without original encodings", func(t *testing.T) {
+		decoded := decode(t, buf)
+		decoded.wire = nil
+
+		_, err := decoded.Verify(key, nil, nil)
+		assert.IsError(t, err, ErrInvalidSignature)
+	})
+
+	t.Run("tampered encoding", func(t *testing.T) {
+		var tw2 testWireMacaroon
+		assert.NoError(t, json.Unmarshal(buf, &tw2))
+		tw2.Caveats[1] = encodeTestWireCaveat(t, cavExpiry(24*time.Hour))
+		tampered, err := json.Marshal(tw2)
+		assert.NoError(t, err)
+
+		_, err = decode(t, tampered).Verify(key, nil, nil)
+		assert.IsError(t, err, ErrInvalidSignature)
+	})
+
+	t.Run("strict decoding", func(t *testing.T) {
+		var (
+			tw2  testWireMacaroon
+			twc  testWireCaveat
+			body map[string]any
+			err  error
+		)
+		assert.NoError(t, json.Unmarshal(buf, &tw2))
+		assert.NoError(t, json.Unmarshal(tw2.Caveats[0], &twc))
+		assert.NoError(t, json.Unmarshal(twc.Body, &body))
+
+		body["Unknown"] = 1
+		twc.Body, err = json.Marshal(body)
+		assert.NoError(t, err)
+		tw2.Caveats[0], err = json.Marshal(twc)
+		assert.NoError(t, err)
+		buf2, err := json.Marshal(tw2)
+		assert.NoError(t, err)
+
+		_, err = DecodeWireFormat(testWireFormat, buf2)
+		assert.Error(t, err)
+	})
+
+	t.Run("attenuate", func(t *testing.T) {
+		decoded := decode(t, buf)
+		assert.NoError(t, decoded.Add(cavParent(ActionRead, 234)))
+
+		verified, err := decoded.Verify(key, nil, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, 3, len(verified.Caveats))
+	})
+
+	t.Run("re-encoding is flagged", func(t *testing.T) {
+		decoded := decode(t, buf)
+
+		_, err := decoded.Encode()
+		assert.IsError(t, err, ErrReencodedCaveat)
+
+		_, err = msgpack.Marshal(decoded)
+		assert.IsError(t, err, ErrReencodedCaveat)
+	})
+
+	t.Run("msgpack encodings", func(t *testing.T) {
+		m, err := New(kid, "loc", key)
+		assert.NoError(t, err)
+
+		var wire [][]byte
+		for _, cav := range cavs {
+			packed, err := NewCaveatSet(cav).MarshalMsgpack()
+			assert.NoError(t, err)
+			assert.NoError(t, m.AddEncodedCaveat(cav, packed))
+			wire = append(wire, packed)
+		}
+
+		// preserved bytes that match the msgpack encoding survive
+		// re-encoding.
+		tok, err := m.Encode()
+		assert.NoError(t, err)
+
+		decoded, err := DecodeWireFormat(WireFormatMsgpack, tok)
+		assert.NoError(t, err)
+		assert.NoError(t, decoded.SetCaveatEncodings(wire))
+
+		_, err = decoded.Verify(key, nil, nil)
+		assert.NoError(t, err)
+	})
+}
+
+func TestWireFormatRegistration(t *testing.T) {
+	RegisterWireFormat(testWireFormat, decodeTestWire)
+	t.Cleanup(func() { unregisterWireFormat(testWireFormat) })
+
+	assert.Panics(t, func() { RegisterWireFormat(testWireFormat, decodeTestWire) })
+	assert.Panics(t, func() { RegisterWireFormat(WireFormatMsgpack, decodeTestWire) })
+	assert.Panics(t, func() { RegisterWireFormat("", decodeTestWire) })
+
+	_, err := DecodeWireFormat("bogus", nil)
+	assert.Error(t, err)
+}
+
+func TestAddEncodedCaveat(t *testing.T) {
+	m, err := New(rbuf(10), "loc", NewSigningKey())
+	assert.NoError(t, err)
+
+	assert.Error(t, m.AddEncodedCaveat(cavParent(ActionRead, 123), nil))
+	assert.Error(t, m.AddEncodedCaveat(&Caveat3P{Location: "tp"}, []byte("wire")))
+	assert.Error(t, m.SetCaveatEncodings([][]byte{nil}))
+	assert.Equal(t, 0, len(m.UnsafeCaveats.Caveats))
+}